@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/client"
+	"github.com/grumpylabs/gopogo/internal/lineedit"
+	"github.com/spf13/cobra"
+)
+
+var cliCmd = &cobra.Command{
+	Use:   "cli [command [arg ...]]",
+	Short: "Interactive client for gopogo and Redis servers",
+	Long: `Cli connects to a gopogo or Redis server over RESP. With arguments it
+runs a single command and prints the reply; without, it starts an
+interactive prompt with line editing and history kept in ~/.gopogo_history.
+
+The server is taken from --host, --port, --socket and --auth, or from
+--url.`,
+	RunE: runCli,
+}
+
+func init() {
+	cliCmd.Flags().String("url", "", "Server URL (redis://[user:password@]host:port[/db]), overrides --host and --port")
+	cliCmd.Flags().Bool("raw", false, "Print replies without type annotations or quoting")
+
+	rootCmd.AddCommand(cliCmd)
+}
+
+func runCli(cmd *cobra.Command, args []string) error {
+	raw, _ := cmd.Flags().GetBool("raw")
+
+	addr, opts, err := cliTarget(cmd)
+	if err != nil {
+		return err
+	}
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %w", addr, err)
+	}
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	if len(args) > 0 {
+		reply, err := conn.Do(args...)
+		if err != nil && !isReplyError(err) {
+			return err
+		}
+		if err != nil {
+			reply = err
+		}
+		fmt.Print(formatReply(reply, raw, ""))
+		if isReplyError(err) {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	editor := lineedit.New(os.Stdin, os.Stdout)
+	historyPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyPath = filepath.Join(home, ".gopogo_history")
+		editor.LoadHistory(historyPath)
+	}
+
+	prompt := addr + "> "
+	for {
+		line, err := editor.ReadLine(prompt)
+		if err == lineedit.ErrInterrupt {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		words, err := splitArgs(line)
+		if err != nil {
+			fmt.Println("Invalid argument(s):", err)
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+		editor.AddHistory(line)
+		if name := strings.ToLower(words[0]); name == "quit" || name == "exit" {
+			break
+		}
+
+		reply, err := conn.Do(words...)
+		if err != nil && !isReplyError(err) {
+			// The connection is gone; try once to reconnect and retry.
+			conn.Close()
+			if conn, err = client.Dial(addr, opts); err != nil {
+				fmt.Printf("Could not connect to %s: %v\n", addr, err)
+				conn = nil
+				break
+			}
+			reply, err = conn.Do(words...)
+			if err != nil && !isReplyError(err) {
+				fmt.Println("Error:", err)
+				continue
+			}
+		}
+		if err != nil {
+			reply = err
+		}
+		fmt.Print(formatReply(reply, raw, ""))
+	}
+
+	if historyPath != "" {
+		editor.SaveHistory(historyPath)
+	}
+	if conn == nil {
+		return errors.New("connection lost")
+	}
+	return nil
+}
+
+// cliTarget returns the address and dial options from the connection
+// flags.
+func cliTarget(cmd *cobra.Command) (string, *client.Options, error) {
+	if rawURL, _ := cmd.Flags().GetString("url"); rawURL != "" {
+		addr, opts, err := client.ParseURL(rawURL)
+		if err != nil {
+			return "", nil, err
+		}
+		opts.Timeout = 10 * time.Second
+		return addr, opts, nil
+	}
+
+	host, _ := cmd.Flags().GetString("host")
+	port, _ := cmd.Flags().GetInt("port")
+	socket, _ := cmd.Flags().GetString("socket")
+	auth, _ := cmd.Flags().GetString("auth")
+	if path, _ := cmd.Flags().GetString("auth-file"); auth == "" && path != "" {
+		passwords, err := readSecretFile(path)
+		if err != nil {
+			return "", nil, fmt.Errorf("auth-file: %w", err)
+		}
+		auth = passwords[0]
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if socket != "" {
+		addr = socket
+	}
+	return addr, &client.Options{Password: auth, Timeout: 10 * time.Second}, nil
+}
+
+// splitArgs splits a command line the way redis-cli does: on spaces,
+// with "double quoted" strings supporting \n, \r, \t, \xHH and \" escapes
+// and 'single quoted' strings taken literally except for \'.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg strings.Builder
+		inDouble, inSingle := false, false
+	scan:
+		for ; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case inDouble:
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg.WriteByte('\n')
+					case 'r':
+						arg.WriteByte('\r')
+					case 't':
+						arg.WriteByte('\t')
+					case 'x':
+						if i+2 < len(line) {
+							if v, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+								arg.WriteByte(byte(v))
+								i += 2
+								continue
+							}
+						}
+						arg.WriteByte('x')
+					default:
+						arg.WriteByte(line[i])
+					}
+				} else if c == '"' {
+					inDouble = false
+					if i+1 < len(line) && line[i+1] != ' ' && line[i+1] != '\t' {
+						return nil, errors.New("closing quote must be followed by a space")
+					}
+				} else {
+					arg.WriteByte(c)
+				}
+			case inSingle:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg.WriteByte('\'')
+				} else if c == '\'' {
+					inSingle = false
+					if i+1 < len(line) && line[i+1] != ' ' && line[i+1] != '\t' {
+						return nil, errors.New("closing quote must be followed by a space")
+					}
+				} else {
+					arg.WriteByte(c)
+				}
+			case c == ' ' || c == '\t':
+				break scan
+			case c == '"':
+				inDouble = true
+			case c == '\'':
+				inSingle = true
+			default:
+				arg.WriteByte(c)
+			}
+		}
+		if inDouble || inSingle {
+			return nil, errors.New("unbalanced quotes")
+		}
+		args = append(args, arg.String())
+	}
+}
+
+// formatReply renders a reply like redis-cli: annotated and quoted, or
+// bare in raw mode. indent prefixes the continuation lines of arrays.
+func formatReply(reply interface{}, raw bool, indent string) string {
+	switch v := reply.(type) {
+	case client.Error:
+		if raw {
+			return string(v) + "\n"
+		}
+		return "(error) " + string(v) + "\n"
+	case error:
+		return "(error) " + v.Error() + "\n"
+	case string:
+		return v + "\n"
+	case int64:
+		if raw {
+			return strconv.FormatInt(v, 10) + "\n"
+		}
+		return "(integer) " + strconv.FormatInt(v, 10) + "\n"
+	case []byte:
+		if raw {
+			return string(v) + "\n"
+		}
+		return strconv.Quote(string(v)) + "\n"
+	case nil:
+		if raw {
+			return "\n"
+		}
+		return "(nil)\n"
+	case []interface{}:
+		if len(v) == 0 {
+			if raw {
+				return ""
+			}
+			return "(empty array)\n"
+		}
+		var b strings.Builder
+		if raw {
+			for _, item := range v {
+				b.WriteString(formatReply(item, raw, ""))
+			}
+			return b.String()
+		}
+		width := len(strconv.Itoa(len(v)))
+		for i, item := range v {
+			label := fmt.Sprintf("%*d) ", width, i+1)
+			if i > 0 {
+				b.WriteString(indent)
+			}
+			b.WriteString(label)
+			b.WriteString(formatReply(item, raw, indent+strings.Repeat(" ", len(label))))
+		}
+		return b.String()
+	default:
+		return fmt.Sprintf("%v\n", v)
+	}
+}
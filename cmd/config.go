@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// configOnly are settings that control the command rather than the
+// server, left out of --print-config.
+var configOnly = []string{"config", "print-config", "version"}
+
+// secretSettings are printed as "<redacted>" when set.
+var secretSettings = []string{"auth"}
+
+// printConfig writes the configuration the server would run with, after
+// merging flags, GOPOGO_* environment variables and the config file, as
+// YAML or JSON. The output can be used as a config file.
+func printConfig(w io.Writer, format string) error {
+	settings := viper.AllSettings()
+	for _, key := range configOnly {
+		delete(settings, key)
+	}
+	for _, key := range secretSettings {
+		if v, _ := settings[key].(string); v != "" {
+			settings[key] = "<redacted>"
+		}
+	}
+
+	switch format {
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(settings); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(settings)
+	}
+	return fmt.Errorf("invalid print-config format %q (want yaml or json)", format)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/client"
+	"github.com/grumpylabs/gopogo/internal/persistence"
+	"github.com/spf13/cobra"
+)
+
+var dumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Back up the keys of a running server to a file",
+	Long: `Dump lists the keys of a running gopogo with KEYS and writes each one,
+with its value, flags and expiry, to a file in the snapshot format. The
+file can be loaded back with restore, with --preload at startup, or
+checked with snapshot verify. The server keeps serving while it runs, so
+the dump is not a point-in-time copy: keys changed during it may or may
+not be included.`,
+	Args: cobra.NoArgs,
+	RunE: runDump,
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Load a dump file into a running server",
+	Long: `Restore writes the keys of a dump or snapshot file into a running
+gopogo with RESTORE, keeping their flags and expiry times. Keys that have
+expired since the dump was taken are skipped.`,
+	Args: cobra.NoArgs,
+	RunE: runRestore,
+}
+
+func init() {
+	dumpCmd.Flags().String("url", "", "Server URL (redis://[user:password@]host:port[/db]), overrides --host and --port")
+	dumpCmd.Flags().String("out", "", "Output file (- for standard output)")
+	dumpCmd.Flags().String("match", "*", "Only dump keys matching this pattern")
+	dumpCmd.Flags().Int("batch", 1000, "Keys per pipeline batch")
+	dumpCmd.MarkFlagRequired("out")
+
+	restoreCmd.Flags().String("url", "", "Server URL (redis://[user:password@]host:port[/db]), overrides --host and --port")
+	restoreCmd.Flags().String("in", "", "Input file (- for standard input)")
+	restoreCmd.Flags().Int("batch", 1000, "Keys per pipeline batch")
+	restoreCmd.Flags().Bool("replace", true, "Overwrite keys that already exist in the server")
+	restoreCmd.MarkFlagRequired("in")
+
+	rootCmd.AddCommand(dumpCmd)
+	rootCmd.AddCommand(restoreCmd)
+}
+
+func runDump(cmd *cobra.Command, _ []string) error {
+	out, _ := cmd.Flags().GetString("out")
+	match, _ := cmd.Flags().GetString("match")
+	batch, _ := cmd.Flags().GetInt("batch")
+	quiet, _ := cmd.Flags().GetBool("quiet")
+
+	conn, err := dialTarget(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Write to a temporary file so that a failed dump does not replace
+	// an earlier one.
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if out != "-" {
+		if f, err = os.Create(out + ".tmp"); err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriterSize(w, 64*1024)
+	if err := persistence.WriteFileHeader(bw); err != nil {
+		return err
+	}
+	enc := persistence.NewEncoder(bw)
+	if err := enc.Encode(&persistence.Op{Type: persistence.OpSnapshotStart, Time: time.Now().UnixNano()}); err != nil {
+		return err
+	}
+
+	// gopogo has no SCAN, so the key list comes from KEYS in one reply.
+	reply, err := conn.Do("KEYS", match)
+	if err != nil {
+		return fmt.Errorf("KEYS: %w", err)
+	}
+	keys, ok := reply.([]interface{})
+	if !ok {
+		return errors.New("unexpected KEYS reply")
+	}
+
+	start := time.Now()
+	dumped := 0
+	for len(keys) > 0 {
+		n := min(batch, len(keys))
+		d, err := dumpBatch(conn, enc, keys[:n])
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+		dumped += d
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "\rDumped %d keys", dumped)
+		}
+	}
+
+	if err := enc.Encode(&persistence.Op{Type: persistence.OpSnapshotEnd, Count: uint64(dumped)}); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if f != nil {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(f.Name(), out); err != nil {
+			return err
+		}
+	}
+
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "\rDumped %d keys in %s\n", dumped, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// dumpBatch fetches keys with DUMP and PTTL in one pipelined round trip
+// and encodes them. It returns the number of keys written; keys deleted
+// or expired since they were listed are left out.
+func dumpBatch(conn *client.Client, enc *persistence.Encoder, keys []interface{}) (int, error) {
+	for _, key := range keys {
+		k, _ := key.([]byte)
+		conn.Send("DUMP", string(k))
+		conn.Send("PTTL", string(k))
+	}
+	if err := conn.Flush(); err != nil {
+		return 0, err
+	}
+
+	dumped := 0
+	for _, key := range keys {
+		k, _ := key.([]byte)
+
+		payload, err := conn.Receive()
+		if err != nil {
+			return 0, fmt.Errorf("DUMP %q: %w", k, err)
+		}
+		ttl, err := conn.Receive()
+		if err != nil {
+			return 0, fmt.Errorf("PTTL %q: %w", k, err)
+		}
+
+		p, ok := payload.([]byte)
+		ms, _ := ttl.(int64)
+		if !ok || ms == -2 {
+			continue
+		}
+		value, flags, err := persistence.ParseDump(p)
+		if err != nil {
+			return 0, fmt.Errorf("DUMP %q: %w", k, err)
+		}
+
+		op := &persistence.Op{Type: persistence.OpStore, Key: k, Value: value, Flags: flags}
+		if ms > 0 {
+			op.ExpireAt = time.Now().Add(time.Duration(ms) * time.Millisecond).UnixNano()
+		}
+		if err := enc.Encode(op); err != nil {
+			return 0, err
+		}
+		dumped++
+	}
+	return dumped, nil
+}
+
+func runRestore(cmd *cobra.Command, _ []string) error {
+	in, _ := cmd.Flags().GetString("in")
+	batch, _ := cmd.Flags().GetInt("batch")
+	replace, _ := cmd.Flags().GetBool("replace")
+	quiet, _ := cmd.Flags().GetBool("quiet")
+
+	var r io.Reader = os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	br := bufio.NewReaderSize(r, 64*1024)
+	magic, err := br.Peek(len(persistence.FileMagic))
+	if err != nil || string(magic) != persistence.FileMagic {
+		return fmt.Errorf("%s is not a gopogo dump file", in)
+	}
+	br.Discard(len(magic))
+
+	conn, err := dialTarget(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	var restored, skipped, pending int
+	flush := func() error {
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		for ; pending > 0; pending-- {
+			if _, err := conn.Receive(); err != nil {
+				if !isReplyError(err) {
+					return err
+				}
+				// BUSYKEY without --replace, or a size limit.
+				fmt.Fprintf(os.Stderr, "RESTORE failed: %v\n", err)
+				skipped++
+				continue
+			}
+			restored++
+		}
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "\rRestored %d keys, skipped %d", restored, skipped)
+		}
+		return nil
+	}
+
+	dec := persistence.NewDecoder(br)
+	for {
+		op, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", restored+skipped+pending+1, err)
+		}
+
+		switch op.Type {
+		case persistence.OpStore:
+			args := []string{"RESTORE", string(op.Key), "0", string(persistence.Dump(op.Value, op.Flags))}
+			if op.ExpireAt != 0 {
+				if op.ExpireAt <= time.Now().UnixNano() {
+					skipped++
+					continue
+				}
+				args[2] = strconv.FormatInt(time.Unix(0, op.ExpireAt).UnixMilli(), 10)
+				args = append(args, "ABSTTL")
+			}
+			if replace {
+				args = append(args, "REPLACE")
+			}
+			conn.Send(args...)
+		case persistence.OpDelete:
+			// A differential snapshot records deletes.
+			conn.Send("DEL", string(op.Key))
+		default:
+			continue
+		}
+
+		if pending++; pending == batch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "\rRestored %d keys, skipped %d in %s\n", restored, skipped, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+func dialTarget(cmd *cobra.Command) (*client.Client, error) {
+	addr, opts, err := cliTarget(cmd)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", addr, err)
+	}
+	return conn, nil
+}
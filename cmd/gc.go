@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+// parseGCPercent parses --gc-percent: a percentage as GOGC takes it, or
+// "off" to collect only when the heap nears the memory limit. ok is false
+// if it is not set, leaving GOGC in charge.
+func parseGCPercent(s string) (percent int, ok bool, err error) {
+	switch s {
+	case "":
+		return 0, false, nil
+	case "off":
+		return -1, true, nil
+	}
+	percent, err = strconv.Atoi(s)
+	if err != nil || percent < 0 {
+		return 0, false, fmt.Errorf("invalid gc-percent %q (want a non-negative integer or off)", s)
+	}
+	return percent, true, nil
+}
+
+// gcMemoryLimit returns the soft memory limit for the Go runtime: the
+// cache's limit plus headroom percent of it for connection buffers, the
+// runtime itself and garbage not yet collected. It returns 0, no limit,
+// when the cache has none.
+func gcMemoryLimit(maxMemory int64, headroom int) int64 {
+	if maxMemory <= 0 {
+		return 0
+	}
+	extra := float64(maxMemory) * float64(headroom) / 100
+	if float64(maxMemory)+extra >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return maxMemory + int64(extra)
+}
+
+// configureGC makes Go's garbage collector work with the cache's memory
+// limit. Without a soft limit the heap may grow to twice the live data
+// before a collection starts, so a cache that stays within --maxmemory
+// can still be OOM-killed. A GOMEMLIMIT in the environment takes
+// precedence over the limit derived from --maxmemory.
+func configureGC(maxMemory int64, quiet bool) error {
+	percent, setPercent, err := parseGCPercent(viper.GetString("gc-percent"))
+	if err != nil {
+		return err
+	}
+	headroom := viper.GetInt("gc-headroom")
+	if headroom < 0 {
+		return fmt.Errorf("invalid gc-headroom %d (want a percentage of maxmemory, 0 or more)", headroom)
+	}
+
+	limit := int64(0)
+	if os.Getenv("GOMEMLIMIT") == "" {
+		limit = gcMemoryLimit(maxMemory, headroom)
+	}
+	if setPercent && percent < 0 && limit == 0 && os.Getenv("GOMEMLIMIT") == "" {
+		return fmt.Errorf("gc-percent off needs maxmemory or GOMEMLIMIT, or the heap would grow without bound")
+	}
+
+	if limit > 0 {
+		debug.SetMemoryLimit(limit)
+	}
+	if setPercent {
+		debug.SetGCPercent(percent)
+	}
+
+	if !quiet && (limit > 0 || setPercent) {
+		// A negative limit reads the current one without changing it.
+		attrs := []any{"memory_limit", formatBytes(debug.SetMemoryLimit(-1))}
+		if setPercent {
+			attrs = append(attrs, "gc_percent", viper.GetString("gc-percent"))
+		}
+		slog.Info("configured garbage collector", attrs...)
+	}
+	return nil
+}
@@ -1,12 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/metrics"
+	"github.com/grumpylabs/gopogo/internal/objstore"
+	"github.com/grumpylabs/gopogo/internal/origin"
+	"github.com/grumpylabs/gopogo/internal/persistence"
+	"github.com/grumpylabs/gopogo/internal/protocol"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+	"github.com/grumpylabs/gopogo/internal/rdb"
 	"github.com/grumpylabs/gopogo/internal/server"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -30,29 +44,101 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().String("host", "127.0.0.1", "Listening hostname")
+	rootCmd.PersistentFlags().StringSlice("bind", nil, "Listening addresses, overriding --host (repeatable)")
 	rootCmd.PersistentFlags().IntP("port", "p", 6379, "Listening port")
+	rootCmd.PersistentFlags().Int("redis-port", 0, "Port serving only the Redis protocol")
+	rootCmd.PersistentFlags().Int("memcache-port", 0, "Port serving only the Memcache protocol")
+	rootCmd.PersistentFlags().Int("memcache-udp-port", 0, "UDP port serving the Memcache protocol (0 = disabled)")
+	rootCmd.PersistentFlags().Int("dns-port", 0, "Port answering DNS queries over UDP and TCP from dns:<name>:<type> keys (0 = disabled)")
+	rootCmd.PersistentFlags().Duration("dns-ttl", time.Minute, "TTL of DNS records whose key does not expire")
+	rootCmd.PersistentFlags().Int("http-port", 0, "Port serving only the HTTP protocol")
+	rootCmd.PersistentFlags().Int("postgres-port", 0, "Port serving only the Postgres protocol")
 	rootCmd.PersistentFlags().StringP("socket", "s", "", "Unix socket path")
+	rootCmd.PersistentFlags().String("socket-perm", "", "Unix socket file mode in octal (e.g., 0770)")
+	rootCmd.PersistentFlags().String("socket-owner", "", "Unix socket owner as user[:group]")
 	rootCmd.PersistentFlags().String("auth", "", "Authentication password")
+	rootCmd.PersistentFlags().String("auth-file", "", "File of accepted authentication passwords, one per line")
 
 	rootCmd.PersistentFlags().Int("threads", runtime.NumCPU(), "Number of threads")
+	rootCmd.PersistentFlags().Bool("reuseport", false, "Open one SO_REUSEPORT listener per thread")
+	rootCmd.PersistentFlags().String("conn-model", "goroutine", "Connection model (goroutine, pool)")
+	rootCmd.PersistentFlags().Int("pool-size", 0, "Worker pool size for the pool model, each holding one client, idle or not (0 = 256 per thread)")
+	rootCmd.PersistentFlags().Duration("pool-idle-timeout", 5*time.Minute, "Disconnect clients of the pool model idle this long, freeing their worker (0 = never)")
 	rootCmd.PersistentFlags().Int("shards", 16, "Number of cache shards")
 	rootCmd.PersistentFlags().String("maxmemory", "0", "Maximum memory (e.g., 1GB, 512MB)")
-	rootCmd.PersistentFlags().String("evict", "2random", "Eviction policy (noevict, 2random, lru)")
+	rootCmd.PersistentFlags().String("gc-percent", "", "Go GC target percentage, or off to collect only near the memory limit (default GOGC or 100)")
+	rootCmd.PersistentFlags().Int("gc-headroom", 50, "Percentage of maxmemory added to it for Go's soft memory limit")
+	rootCmd.PersistentFlags().String("evict", "2random", "Eviction policy (2random, lru, lfu, slru)")
+	rootCmd.PersistentFlags().Bool("admission", false, "Admit a new key over an eviction victim only if it is accessed more often (TinyLFU)")
+	rootCmd.PersistentFlags().StringSlice("sliding-ttl", nil, "Key prefixes whose TTLs slide: each read extends the TTL by its original length")
+	rootCmd.PersistentFlags().String("max-pinned", "0", "Maximum memory for pinned entries (e.g., 100MB; 0 = half of maxmemory, -1 = no pinning)")
+	rootCmd.PersistentFlags().String("disk-tier", "", "File for a disk tier that holds large evicted values instead of dropping them")
+	rootCmd.PersistentFlags().String("disk-tier-min-value", "4KB", "Smallest value spilled to the disk tier on eviction")
+	rootCmd.PersistentFlags().String("disk-tier-max", "0", "Maximum size of the disk tier file (e.g., 10GB; 0 = no limit)")
+	rootCmd.PersistentFlags().Duration("eviction-storm-threshold", cache.DefaultStormThreshold, "Evict in bulk once a shard spends this much of a second evicting (0 = never)")
+	rootCmd.PersistentFlags().Int("eviction-bulk-percent", cache.DefaultBulkPercent, "Percentage of a shard's memory limit freed at once while evicting in bulk")
 	rootCmd.PersistentFlags().Bool("autosweep", true, "Enable automatic background sweeping of evicted entries")
 	rootCmd.PersistentFlags().Duration("sweepinterval", 10*time.Second, "Interval for automatic background sweeping")
 
 	rootCmd.PersistentFlags().Int("tlsport", 0, "TLS listening port")
 	rootCmd.PersistentFlags().String("tlscert", "", "TLS certificate file")
 	rootCmd.PersistentFlags().String("tlskey", "", "TLS key file")
+	rootCmd.PersistentFlags().String("tlskey-passphrase-file", "", "File holding the passphrase of an encrypted TLS key")
+	rootCmd.PersistentFlags().String("tls-min-version", "1.2", "Minimum TLS version (1.0, 1.1, 1.2, 1.3; 1.3 allows TLS 1.3 only)")
+	rootCmd.PersistentFlags().StringSlice("tls-ciphers", nil, "TLS 1.2 and earlier cipher suites to allow, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (default Go's secure suites)")
+	rootCmd.PersistentFlags().StringSlice("tls-curves", nil, "Key exchange curves in order of preference (X25519, X25519MLKEM768, P256, P384, P521)")
+	rootCmd.PersistentFlags().StringToString("protocol-tls", nil, "Whether a protocol is optional, required or disabled over TLS, e.g. all=required,memcache=disabled")
+	rootCmd.PersistentFlags().StringSlice("tls-exempt", nil, "Client addresses or CIDR ranges, or unix, that may use plaintext for protocols requiring TLS")
 
 	rootCmd.PersistentFlags().Bool("http", false, "Enable HTTP protocol")
 	rootCmd.PersistentFlags().Bool("memcache", false, "Enable Memcache protocol")
 	rootCmd.PersistentFlags().Bool("postgres", false, "Enable Postgres protocol")
 	rootCmd.PersistentFlags().Bool("redis", true, "Enable Redis protocol")
+	rootCmd.PersistentFlags().StringSlice("protocols", nil, "Registered add-on protocols to enable, by name")
+	rootCmd.PersistentFlags().Bool("enable-debug", false, "Allow the DEBUG command (SLEEP, OBJECT, SET-ACTIVE-EXPIRE, TRACE)")
+	rootCmd.PersistentFlags().Int("hotkeys", 0, "Track this many of the most accessed keys per shard (0 = disabled)")
+	rootCmd.PersistentFlags().StringToString("namespace", nil, "Confine a protocol's keys to a prefix, e.g. memcache=mc:,http=web:")
+	rootCmd.PersistentFlags().Duration("handshake-timeout", 10*time.Second, "Disconnect clients that do not finish the TLS handshake and identify their protocol in time (0 = no limit)")
+	rootCmd.PersistentFlags().Duration("http-header-timeout", 10*time.Second, "Maximum time to read HTTP request headers")
+	rootCmd.PersistentFlags().StringSlice("ws-allowed-origins", nil, "Origins of other sites whose pages may open WebSockets, e.g. https://app.example.com (* = any)")
+	rootCmd.PersistentFlags().StringSlice("proxy-protocol", nil, "Expect a PROXY protocol header on connections from these proxy addresses or CIDR ranges")
+	rootCmd.PersistentFlags().String("origin", "", "Backing store (http(s):// base URL or redis:// URL) that GET misses are read through from")
+	rootCmd.PersistentFlags().Duration("origin-ttl", 0, "TTL of values read through from the origin (0 = no TTL)")
+	rootCmd.PersistentFlags().Duration("origin-timeout", 5*time.Second, "Timeout for origin fetches and writes")
+	rootCmd.PersistentFlags().String("write-behind", "", "Backing store (http(s):// base URL or redis:// URL) that stores and deletes are asynchronously written to")
+	rootCmd.PersistentFlags().Int("write-behind-batch", 100, "Maximum changes per write-behind batch")
+	rootCmd.PersistentFlags().Duration("write-behind-interval", time.Second, "Maximum time changes wait before they are written behind")
+	rootCmd.PersistentFlags().Int("write-behind-retries", 5, "Retries of a failed write-behind batch before it is dropped")
+	rootCmd.PersistentFlags().String("sentinel-master", "", "Answer SENTINEL discovery commands as this master name")
+	rootCmd.PersistentFlags().Bool("admin", false, "Serve the web admin dashboard under /admin/ on the HTTP protocol")
+	rootCmd.PersistentFlags().Int("admin-port", 0, "Dedicated listening port for the web admin dashboard")
+	rootCmd.PersistentFlags().String("proto-max-bulk-len", "512MB", "Maximum size of a single RESP bulk string, memcache data block, PostgreSQL message or HTTP request body")
+	rootCmd.PersistentFlags().Int("proto-max-multibulk-len", 1024*1024, "Maximum number of arguments in a RESP command")
+	rootCmd.PersistentFlags().String("max-key-size", "0", "Maximum key size on every protocol (e.g., 1KB, 0 = unlimited)")
+	rootCmd.PersistentFlags().String("max-value-size", "0", "Maximum value size on every protocol (e.g., 1MB, 0 = unlimited)")
+
+	rootCmd.PersistentFlags().Float64("rate-conn-cmds", 0, "Maximum commands per second per connection (0 = unlimited)")
+	rootCmd.PersistentFlags().String("rate-conn-bytes", "0", "Maximum bytes read per second per connection (e.g., 10MB)")
+	rootCmd.PersistentFlags().Float64("rate-ip-cmds", 0, "Maximum commands per second per client IP (0 = unlimited)")
+	rootCmd.PersistentFlags().String("rate-ip-bytes", "0", "Maximum bytes read per second per client IP (e.g., 50MB)")
+
+	rootCmd.PersistentFlags().String("preload", "", "Load key/value pairs from a file (JSON lines or gopogo binary) before accepting connections")
+	rootCmd.PersistentFlags().String("snapshot-url", "", "Upload snapshots to this s3://, gs:// or file:// location and restore the latest at startup")
+	rootCmd.PersistentFlags().Duration("snapshot-interval", time.Hour, "Interval between snapshots (0 = only at shutdown)")
+	rootCmd.PersistentFlags().Int("snapshot-full-every", 1, "Make every Nth snapshot a full one and the rest differential (1 = always full)")
+	rootCmd.PersistentFlags().String("load-rdb", "", "Load a Redis RDB dump into the cache before accepting connections")
+
+	rootCmd.PersistentFlags().String("statsd-addr", "", "Push metrics to this statsd host:port over UDP")
+	rootCmd.PersistentFlags().String("graphite-addr", "", "Push metrics to this Graphite plaintext host:port over TCP")
+	rootCmd.PersistentFlags().Duration("metrics-interval", 10*time.Second, "Interval between metrics pushes")
+	rootCmd.PersistentFlags().String("metrics-prefix", "gopogo", "Prefix of pushed metric names")
 
 	rootCmd.PersistentFlags().String("config", "", "Config file path")
 	rootCmd.PersistentFlags().Bool("quiet", false, "Quiet mode")
 	rootCmd.PersistentFlags().Bool("verbose", false, "Verbose output")
+	rootCmd.PersistentFlags().String("log-format", "text", "Log format (text, json)")
+	rootCmd.PersistentFlags().String("print-config", "", "Print the resolved configuration as yaml or json and exit")
+	rootCmd.PersistentFlags().Lookup("print-config").NoOptDefVal = "yaml"
 	rootCmd.PersistentFlags().Bool("version", false, "Show version")
 
 	viper.BindPFlags(rootCmd.PersistentFlags())
@@ -70,11 +156,28 @@ func initConfig() {
 	}
 
 	viper.SetEnvPrefix("GOPOGO")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
 
-	if err := viper.ReadInConfig(); err == nil && !viper.GetBool("quiet") {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	err := viper.ReadInConfig()
+	initLogging()
+	if err == nil && !viper.GetBool("quiet") {
+		slog.Info("using config file", "path", viper.ConfigFileUsed())
+	}
+}
+
+// initLogging makes slog, and the log package through it, write text or
+// JSON records to standard error as --log-format says.
+func initLogging() {
+	opts := &slog.HandlerOptions{}
+	if viper.GetBool("verbose") {
+		opts.Level = slog.LevelDebug
+	}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if viper.GetString("log-format") == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
 	}
+	slog.SetDefault(slog.New(handler))
 }
 
 func runServer(cmd *cobra.Command, args []string) {
@@ -82,42 +185,371 @@ func runServer(cmd *cobra.Command, args []string) {
 		fmt.Printf("gopogo version %s (commit: %s)\n", version, commit)
 		os.Exit(0)
 	}
+	if format := viper.GetString("print-config"); format != "" {
+		if err := printConfig(os.Stdout, format); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	switch viper.GetString("log-format") {
+	case "text", "json":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid log-format %q (want text or json)\n", viper.GetString("log-format"))
+		os.Exit(1)
+	}
 
 	maxMemory := parseMemorySize(viper.GetString("maxmemory"))
+	policy, err := cache.ParseEvictionPolicy(viper.GetString("evict"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := configureGC(maxMemory, viper.GetBool("quiet")); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch viper.GetString("conn-model") {
+	case server.ConnModelGoroutine, server.ConnModelPool:
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid conn-model %q (want goroutine or pool)\n", viper.GetString("conn-model"))
+		os.Exit(1)
+	}
+
+	for proto := range viper.GetStringMapString("namespace") {
+		switch proto {
+		case "redis", "http", "memcache", "postgres":
+		default:
+			fmt.Fprintf(os.Stderr, "Error: invalid namespace protocol %q (want redis, http, memcache or postgres)\n", proto)
+			os.Exit(1)
+		}
+	}
+
+	for proto := range viper.GetStringMapString("protocol-tls") {
+		switch proto {
+		case "redis", "http", "memcache", "postgres", "dns", "all":
+		default:
+			if _, ok := protocol.Lookup(proto); ok {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Error: invalid protocol-tls protocol %q (want redis, http, memcache, postgres, dns or all)\n", proto)
+			os.Exit(1)
+		}
+	}
+
+	// A dedicated port enables its protocol.
+	for _, proto := range []string{"redis", "memcache", "http", "postgres"} {
+		if viper.GetInt(proto+"-port") > 0 {
+			viper.Set(proto, true)
+		}
+	}
+	if viper.GetInt("memcache-udp-port") > 0 {
+		viper.Set("memcache", true)
+	}
+
+	var socketPerm os.FileMode
+	if v := viper.GetString("socket-perm"); v != "" {
+		perm, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || perm > 0777 {
+			fmt.Fprintf(os.Stderr, "Error: invalid socket-perm %q (want an octal mode such as 0770)\n", v)
+			os.Exit(1)
+		}
+		socketPerm = os.FileMode(perm)
+	}
+
+	passwords, err := authPasswords()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	passphrase, err := tlsKeyPassphrase()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	tlsMinVersion, err := server.ParseTLSVersion(viper.GetString("tls-min-version"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	tlsCiphers, err := server.ParseCipherSuites(viper.GetStringSlice("tls-ciphers"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(tlsCiphers) > 0 && tlsMinVersion == tls.VersionTLS13 {
+		fmt.Fprintf(os.Stderr, "Error: tls-ciphers has no effect with tls-min-version 1.3\n")
+		os.Exit(1)
+	}
+	tlsCurves, err := server.ParseCurves(viper.GetStringSlice("tls-curves"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var backing origin.Origin
+	if u := viper.GetString("origin"); u != "" {
+		store, err := origin.New(u, viper.GetDuration("origin-timeout"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		backing = store
+	}
+
+	var writeBehind *origin.WriteBehind
+	if u := viper.GetString("write-behind"); u != "" {
+		store, err := origin.New(u, viper.GetDuration("origin-timeout"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		writeBehind = origin.NewWriteBehind(store, &origin.WriteBehindOptions{
+			BatchSize:  viper.GetInt("write-behind-batch"),
+			Interval:   viper.GetDuration("write-behind-interval"),
+			MaxRetries: viper.GetInt("write-behind-retries"),
+			Timeout:    viper.GetDuration("origin-timeout"),
+		})
+	}
 
 	c := cache.New(
 		viper.GetInt("shards"),
 		maxMemory,
 	)
+	c.EnableHotKeys(viper.GetInt("hotkeys"))
+	c.SetEvictionPolicy(policy)
+	c.SetEvictionStorm(viper.GetDuration("eviction-storm-threshold"), viper.GetInt("eviction-bulk-percent"))
+	if viper.GetBool("admission") {
+		c.EnableAdmission()
+	}
+	c.SetSlidingPrefixes(viper.GetStringSlice("sliding-ttl"))
+	if s := viper.GetString("max-pinned"); s == "-1" {
+		c.SetMaxPinned(-1)
+	} else {
+		c.SetMaxPinned(parseMemorySize(s))
+	}
+	if path := viper.GetString("disk-tier"); path != "" {
+		minValue := parseMemorySize(viper.GetString("disk-tier-min-value"))
+		if err := c.EnableDiskTier(path, int(minValue), parseMemorySize(viper.GetString("disk-tier-max"))); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening disk tier: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	c.SetSizeLimits(
+		parseMemorySize(viper.GetString("max-key-size")),
+		parseMemorySize(viper.GetString("max-value-size")),
+	)
+
+	var pusher *metrics.Pusher
+	if viper.GetString("statsd-addr") != "" || viper.GetString("graphite-addr") != "" {
+		if viper.GetDuration("metrics-interval") <= 0 {
+			fmt.Fprintln(os.Stderr, "Error: metrics-interval must be positive")
+			os.Exit(1)
+		}
+		pusher = &metrics.Pusher{
+			StatsdAddr:   viper.GetString("statsd-addr"),
+			GraphiteAddr: viper.GetString("graphite-addr"),
+			Prefix:       viper.GetString("metrics-prefix"),
+			Interval:     viper.GetDuration("metrics-interval"),
+		}
+	}
+
+	var snapshots *persistence.Snapshotter
+	if u := viper.GetString("snapshot-url"); u != "" {
+		store, err := objstore.Open(u)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		snapshots = &persistence.Snapshotter{
+			Cache:     c,
+			Store:     store,
+			FullEvery: viper.GetInt("snapshot-full-every"),
+		}
+	}
 
 	srv := server.New(&server.Config{
 		Host:     viper.GetString("host"),
 		Port:     viper.GetInt("port"),
 		Socket:   viper.GetString("socket"),
-		Auth:     viper.GetString("auth"),
+		Binds:        viper.GetStringSlice("bind"),
+		RedisPort:    viper.GetInt("redis-port"),
+		MemcachePort: viper.GetInt("memcache-port"),
+		MemcacheUDPPort: viper.GetInt("memcache-udp-port"),
+		DNSPort:         viper.GetInt("dns-port"),
+		DNSTTL:          viper.GetDuration("dns-ttl"),
+		HTTPPort:     viper.GetInt("http-port"),
+		PostgresPort: viper.GetInt("postgres-port"),
+		SocketPerm:  socketPerm,
+		SocketOwner: viper.GetString("socket-owner"),
+		Auth:     passwords,
 		Threads:  viper.GetInt("threads"),
 		TLSPort:  viper.GetInt("tlsport"),
 		TLSCert:  viper.GetString("tlscert"),
 		TLSKey:   viper.GetString("tlskey"),
+		TLSKeyPassphrase: passphrase,
+		TLSMinVersion:    tlsMinVersion,
+		TLSCipherSuites:  tlsCiphers,
+		TLSCurves:        tlsCurves,
+		ProtocolTLS:      viper.GetStringMapString("protocol-tls"),
+		TLSExempt:        viper.GetStringSlice("tls-exempt"),
 		HTTP:     viper.GetBool("http"),
 		Memcache: viper.GetBool("memcache"),
 		Postgres: viper.GetBool("postgres"),
 		Redis:    viper.GetBool("redis"),
+		Protocols: viper.GetStringSlice("protocols"),
 		Quiet:    viper.GetBool("quiet"),
 		Verbose:  viper.GetBool("verbose"),
 		Cache:        c,
 		AutoSweep:    viper.GetBool("autosweep"),
 		SweepInterval: viper.GetDuration("sweepinterval"),
+		MaxBulkLen:      parseMemorySize(viper.GetString("proto-max-bulk-len")),
+		MaxMultiBulkLen: viper.GetInt64("proto-max-multibulk-len"),
+		ReusePort:       viper.GetBool("reuseport"),
+		ConnModel:       viper.GetString("conn-model"),
+		PoolSize:        viper.GetInt("pool-size"),
+		PoolIdleTimeout: viper.GetDuration("pool-idle-timeout"),
+		Admin:           viper.GetBool("admin"),
+		AdminPort:       viper.GetInt("admin-port"),
+		SentinelMaster:  viper.GetString("sentinel-master"),
+		EnableDebug:     viper.GetBool("enable-debug"),
+		Namespaces:      viper.GetStringMapString("namespace"),
+		HandshakeTimeout:  viper.GetDuration("handshake-timeout"),
+		HTTPHeaderTimeout: viper.GetDuration("http-header-timeout"),
+		WSAllowedOrigins:  viper.GetStringSlice("ws-allowed-origins"),
+		TrustedProxies:    viper.GetStringSlice("proxy-protocol"),
+		Origin:            backing,
+		OriginTTL:         viper.GetDuration("origin-ttl"),
+		WriteBehind:       writeBehind,
+		Snapshots:         snapshots,
+		SnapshotInterval:  viper.GetDuration("snapshot-interval"),
+		Metrics:           pusher,
+		Version:           version,
+		Commit:            commit,
+		RateLimits: ratelimit.Limits{
+			ConnCommands: viper.GetFloat64("rate-conn-cmds"),
+			ConnBytes:    float64(parseMemorySize(viper.GetString("rate-conn-bytes"))),
+			IPCommands:   viper.GetFloat64("rate-ip-cmds"),
+			IPBytes:      float64(parseMemorySize(viper.GetString("rate-ip-bytes"))),
+		},
 	})
 
 	if !viper.GetBool("quiet") {
-		printStartupBanner(c, maxMemory)
+		logStartup(maxMemory)
+	}
+
+	if snapshots != nil {
+		if err := restoreSnapshot(snapshots, viper.GetString("snapshot-url"), viper.GetBool("quiet")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error restoring snapshot: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if path := viper.GetString("preload"); path != "" {
+		if err := preload(c, path, viper.GetBool("quiet")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error preloading %s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+
+	if path := viper.GetString("load-rdb"); path != "" {
+		if err := loadRDB(c, path, viper.GetBool("quiet")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", path, err)
+			os.Exit(1)
+		}
 	}
 
 	if err := srv.Start(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error starting server: %v\n", err)
 		os.Exit(1)
 	}
+	if err := c.CloseDiskTier(); err != nil && !viper.GetBool("quiet") {
+		slog.Warn("removing disk tier", "error", err)
+	}
+}
+
+func restoreSnapshot(s *persistence.Snapshotter, location string, quiet bool) error {
+	start := time.Now()
+	var progress func(int)
+	if !quiet {
+		progress = func(n int) {
+			slog.Info("restoring snapshot", "keys", n)
+		}
+	}
+
+	name, n, err := s.Restore(context.Background(), progress)
+	if errors.Is(err, persistence.ErrNoSnapshot) {
+		if !quiet {
+			slog.Info("no snapshot, starting empty", "location", location)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !quiet {
+		slog.Info("restored snapshot", "name", name, "keys", n, "duration", time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+func preload(c *cache.Cache, path string, quiet bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	var progress func(int)
+	if !quiet {
+		progress = func(n int) {
+			slog.Info("preloading", "path", path, "keys", n)
+		}
+	}
+
+	n, err := persistence.Preload(f, c, progress)
+	if err != nil {
+		return err
+	}
+
+	if !quiet {
+		slog.Info("preloaded", "path", path, "keys", n, "duration", time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+func loadRDB(c *cache.Cache, path string, quiet bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	var progress func(rdb.LoadStats)
+	if !quiet {
+		progress = func(stats rdb.LoadStats) {
+			slog.Info("loading RDB", "path", path, "keys", stats.Loaded)
+		}
+	}
+
+	stats, err := rdb.Load(bufio.NewReader(f), c, progress)
+	if err != nil {
+		return err
+	}
+
+	if !quiet {
+		slog.Info("loaded RDB", "path", path, "keys", stats.Loaded, "expired", stats.Expired,
+			"duration", time.Since(start).Round(time.Millisecond))
+		for t, n := range stats.Skipped {
+			slog.Warn("skipped RDB keys: only strings are supported", "type", t, "keys", n)
+		}
+	}
+	return nil
 }
 
 func parseMemorySize(s string) int64 {
@@ -144,35 +576,34 @@ func parseMemorySize(s string) int64 {
 	}
 }
 
-func printStartupBanner(c *cache.Cache, maxMemory int64) {
-	fmt.Printf("Version: %s (commit: %s)\n", version, commit)
-	fmt.Printf("Host: %s:%d\n", viper.GetString("host"), viper.GetInt("port"))
-	fmt.Printf("Threads: %d\n", viper.GetInt("threads"))
-	fmt.Printf("Shards: %d\n", viper.GetInt("shards"))
-
+// logStartup logs the version and the main settings the server starts
+// with.
+func logStartup(maxMemory int64) {
+	memory := "unlimited"
 	if maxMemory > 0 {
-		fmt.Printf("Max Memory: %s\n", formatBytes(maxMemory))
-	} else {
-		fmt.Println("Max Memory: unlimited")
+		memory = formatBytes(maxMemory)
 	}
 
 	protocols := []string{}
-	if viper.GetBool("redis") {
-		protocols = append(protocols, "Redis")
+	for _, proto := range []string{"redis", "http", "memcache", "postgres"} {
+		if viper.GetBool(proto) {
+			protocols = append(protocols, proto)
+		}
 	}
-	if viper.GetBool("http") {
-		protocols = append(protocols, "HTTP")
-	}
-	if viper.GetBool("memcache") {
-		protocols = append(protocols, "Memcache")
-	}
-	if viper.GetBool("postgres") {
-		protocols = append(protocols, "Postgres")
+	if viper.GetInt("dns-port") > 0 {
+		protocols = append(protocols, "dns")
 	}
+	protocols = append(protocols, viper.GetStringSlice("protocols")...)
 
-	if len(protocols) > 0 {
-		fmt.Printf("Protocols: %v\n", protocols)
-	}
+	slog.Info("starting gopogo",
+		"version", version,
+		"commit", commit,
+		"host", viper.GetString("host"),
+		"port", viper.GetInt("port"),
+		"threads", viper.GetInt("threads"),
+		"shards", viper.GetInt("shards"),
+		"maxmemory", memory,
+		"protocols", protocols)
 }
 
 func formatBytes(b int64) string {
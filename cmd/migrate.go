@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/client"
+	"github.com/spf13/cobra"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copy the keys of a Redis server into gopogo",
+	Long: `Migrate SCANs an existing Redis server and bulk loads its string keys
+into a running gopogo, preserving TTLs. Keys of other types are skipped
+and counted.`,
+	Args: cobra.NoArgs,
+	RunE: runMigrate,
+}
+
+func init() {
+	migrateCmd.Flags().String("from", "", "Source server URL (redis://[user:password@]host:port[/db])")
+	migrateCmd.Flags().String("to", "redis://127.0.0.1:6379", "Target gopogo URL")
+	migrateCmd.Flags().String("match", "*", "Only migrate keys matching this pattern")
+	migrateCmd.Flags().Int("batch", 1000, "Keys per SCAN and pipeline batch")
+	migrateCmd.Flags().Bool("replace", true, "Overwrite keys that already exist in the target")
+	migrateCmd.MarkFlagRequired("from")
+
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func runMigrate(cmd *cobra.Command, _ []string) error {
+	from, _ := cmd.Flags().GetString("from")
+	to, _ := cmd.Flags().GetString("to")
+	match, _ := cmd.Flags().GetString("match")
+	batch, _ := cmd.Flags().GetInt("batch")
+	replace, _ := cmd.Flags().GetBool("replace")
+	quiet, _ := cmd.Flags().GetBool("quiet")
+
+	src, err := client.DialURL(from, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("connecting to source: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := client.DialURL(to, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("connecting to target: %w", err)
+	}
+	defer dst.Close()
+
+	start := time.Now()
+	var migrated, skipped int
+	cursor := "0"
+
+	for {
+		reply, err := src.Do("SCAN", cursor, "MATCH", match, "COUNT", strconv.Itoa(batch))
+		if err != nil {
+			return fmt.Errorf("SCAN: %w", err)
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return errors.New("unexpected SCAN reply")
+		}
+		next, _ := items[0].([]byte)
+		keys, _ := items[1].([]interface{})
+
+		n, s, err := migrateBatch(src, dst, keys, replace)
+		if err != nil {
+			return err
+		}
+		migrated += n
+		skipped += s
+
+		if !quiet && len(keys) > 0 {
+			fmt.Printf("\rMigrated %d keys, skipped %d", migrated, skipped)
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	if !quiet {
+		fmt.Printf("\rMigrated %d keys, skipped %d in %s\n", migrated, skipped, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// migrateBatch copies keys with one pipelined round trip to each server.
+// It returns the number of keys copied and skipped.
+func migrateBatch(src, dst *client.Client, keys []interface{}, replace bool) (int, int, error) {
+	for _, key := range keys {
+		k, _ := key.([]byte)
+		src.Send("GET", string(k))
+		src.Send("PTTL", string(k))
+	}
+	if err := src.Flush(); err != nil {
+		return 0, 0, err
+	}
+
+	skipped, sent := 0, 0
+	for _, key := range keys {
+		k, _ := key.([]byte)
+
+		value, getErr := src.Receive()
+		ttl, ttlErr := src.Receive()
+		if ttlErr != nil && !isReplyError(ttlErr) {
+			return 0, 0, ttlErr
+		}
+		if getErr != nil && !isReplyError(getErr) {
+			return 0, 0, getErr
+		}
+
+		v, ok := value.([]byte)
+		ms, _ := ttl.(int64)
+		// Non-string types fail GET with WRONGTYPE; keys deleted or
+		// expired since SCAN come back nil.
+		if getErr != nil || !ok || ms == -2 {
+			skipped++
+			continue
+		}
+
+		args := []string{"SET", string(k), string(v)}
+		if ms > 0 {
+			args = append(args, "PX", strconv.FormatInt(ms, 10))
+		}
+		if !replace {
+			args = append(args, "NX")
+		}
+		dst.Send(args...)
+		sent++
+	}
+	if err := dst.Flush(); err != nil {
+		return 0, 0, err
+	}
+
+	migrated := 0
+	for i := 0; i < sent; i++ {
+		reply, err := dst.Receive()
+		if err != nil {
+			if isReplyError(err) {
+				fmt.Fprintf(os.Stderr, "SET failed: %v\n", err)
+				skipped++
+				continue
+			}
+			return 0, 0, err
+		}
+		if reply == nil {
+			skipped++ // NX and the key already existed
+			continue
+		}
+		migrated++
+	}
+
+	return migrated, skipped, nil
+}
+
+func isReplyError(err error) bool {
+	var replyErr client.Error
+	return errors.As(err, &replyErr)
+}
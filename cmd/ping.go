@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/client"
+	"github.com/spf13/cobra"
+)
+
+var pingCmd = &cobra.Command{
+	Use:   "ping",
+	Short: "Check that a server answers PING",
+	Long: `Ping connects to a gopogo or Redis server, sends PING and exits 0 if it
+answers PONG, or 1 otherwise. It is meant for container health checks and
+takes the same connection flags as cli.`,
+	Args: cobra.NoArgs,
+	Run:  runPing,
+}
+
+func init() {
+	pingCmd.Flags().String("url", "", "Server URL (redis://[user:password@]host:port[/db]), overrides --host and --port")
+	pingCmd.Flags().Duration("timeout", 2*time.Second, "Connect and reply timeout")
+
+	rootCmd.AddCommand(pingCmd)
+}
+
+func runPing(cmd *cobra.Command, _ []string) {
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	quiet, _ := cmd.Flags().GetBool("quiet")
+
+	if err := ping(cmd, timeout); err != nil {
+		if !quiet {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		os.Exit(1)
+	}
+	if !quiet {
+		fmt.Println("PONG")
+	}
+}
+
+func ping(cmd *cobra.Command, timeout time.Duration) error {
+	addr, opts, err := cliTarget(cmd)
+	if err != nil {
+		return err
+	}
+	opts.Timeout = timeout
+
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	reply, err := conn.Do("PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply %v", reply)
+	}
+	return nil
+}
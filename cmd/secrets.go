@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// readSecretFile reads a file of secrets, one per line, such as a
+// mounted Kubernetes or Docker secret. Blank lines and lines starting with
+// # are skipped, and surrounding whitespace, including the trailing
+// newline most editors add, is trimmed.
+func readSecretFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			secrets = append(secrets, line)
+		}
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("%s holds no secret", path)
+	}
+	return secrets, nil
+}
+
+// authPasswords returns the passwords the server accepts: --auth, if set,
+// and every password in --auth-file, so that a new password can be added
+// and clients moved over before the old one is removed.
+func authPasswords() ([]string, error) {
+	var passwords []string
+	if auth := viper.GetString("auth"); auth != "" {
+		passwords = append(passwords, auth)
+	}
+	if path := viper.GetString("auth-file"); path != "" {
+		secrets, err := readSecretFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("auth-file: %w", err)
+		}
+		passwords = append(passwords, secrets...)
+	}
+	return passwords, nil
+}
+
+// tlsKeyPassphrase returns the passphrase in --tlskey-passphrase-file, or
+// "" if it is not set.
+func tlsKeyPassphrase() (string, error) {
+	path := viper.GetString("tlskey-passphrase-file")
+	if path == "" {
+		return "", nil
+	}
+	secrets, err := readSecretFile(path)
+	if err != nil {
+		return "", fmt.Errorf("tlskey-passphrase-file: %w", err)
+	}
+	return secrets[0], nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/objstore"
+	"github.com/grumpylabs/gopogo/internal/persistence"
+	"github.com/spf13/cobra"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Inspect snapshots",
+}
+
+var snapshotVerifyCmd = &cobra.Command{
+	Use:   "verify <file | url>",
+	Short: "Check the integrity of snapshots",
+	Long: `Verify reads a snapshot through to the end, checking every record's
+checksum and that none are missing, and prints what it holds. The argument
+is a local file, a snapshot URL such as
+s3://bucket/prefix/snapshot-20260101T000000.000Z.gopogo, or a --snapshot-url
+location, in which case every snapshot stored there is checked. It exits 1
+if any snapshot is damaged.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runSnapshotVerify,
+}
+
+func init() {
+	snapshotCmd.AddCommand(snapshotVerifyCmd)
+	rootCmd.AddCommand(snapshotCmd)
+}
+
+func runSnapshotVerify(cmd *cobra.Command, args []string) error {
+	target := args[0]
+	ctx := context.Background()
+
+	if !strings.Contains(target, "://") {
+		f, err := os.Open(target)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if !verifySnapshot(target, f) {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	location, name := target, ""
+	if base := path.Base(target); strings.HasPrefix(base, "snapshot-") {
+		location, name = strings.TrimSuffix(target, "/"+base), base
+	}
+	store, err := objstore.Open(location)
+	if err != nil {
+		return err
+	}
+
+	names := []string{name}
+	if name == "" {
+		if names, err = store.List(ctx); err != nil {
+			return err
+		}
+	}
+
+	ok := true
+	for _, name := range names {
+		r, err := store.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		ok = verifySnapshot(name, r) && ok
+		r.Close()
+	}
+	if !ok {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func verifySnapshot(name string, r io.Reader) bool {
+	info, err := persistence.VerifySnapshot(r)
+	if err != nil {
+		fmt.Printf("%s: DAMAGED: %v\n", name, err)
+		return false
+	}
+
+	kind := "full"
+	if info.Base != "" {
+		kind = "differential on " + info.Base
+	}
+	fmt.Printf("%s: OK, %s, taken %s, %d records (%d stores, %d deletes), %s\n",
+		name, kind, info.Taken.UTC().Format(time.RFC3339), info.Records, info.Stores, info.Deletes, formatBytes(info.Bytes))
+	return true
+}
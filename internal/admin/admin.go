@@ -0,0 +1,211 @@
+// Package admin serves the embedded web dashboard and the JSON API
+// behind it.
+package admin
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/clients"
+	"github.com/grumpylabs/gopogo/internal/health"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+const (
+	defaultKeyLimit = 100
+	topKeyLimit     = 20
+)
+
+// Config holds what the dashboard reports on and acts upon.
+type Config struct {
+	Cache   *cache.Cache
+	Clients *clients.Registry
+	// Auth lists the accepted passwords. With none, the dashboard is only
+	// served to clients on the same host.
+	Auth []string
+	// Health, if set, is served on /healthz and /readyz.
+	Health func() *health.Status
+}
+
+// Handler serves the dashboard under /admin/.
+type Handler struct {
+	config *Config
+	mux    *http.ServeMux
+}
+
+func NewHandler(config *Config) *Handler {
+	h := &Handler{
+		config: config,
+		mux:    http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("GET /admin/{$}", h.handleIndex)
+	h.mux.HandleFunc("GET /admin/api/stats", h.handleStats)
+	h.mux.HandleFunc("GET /admin/api/keys", h.handleKeys)
+	h.mux.HandleFunc("DELETE /admin/api/keys/{key...}", h.handleDelete)
+	h.mux.HandleFunc("POST /admin/api/flush", h.handleFlush)
+	h.mux.Handle("GET /{$}", http.RedirectHandler("/admin/", http.StatusFound))
+	if config.Health != nil {
+		health.Register(h.mux, config.Health)
+	}
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case health.IsPath(req.URL.Path):
+	case len(h.config.Auth) == 0 && !isLocal(req.RemoteAddr):
+		http.Error(w, "Forbidden: set --auth to use the admin dashboard from another host", http.StatusForbidden)
+		return
+	case len(h.config.Auth) > 0 && !h.authorized(req):
+		w.Header().Set("WWW-Authenticate", `Basic realm="gopogo"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	case !sameOrigin(req):
+		http.Error(w, "Forbidden: cross-origin request", http.StatusForbidden)
+		return
+	}
+
+	h.mux.ServeHTTP(w, req)
+}
+
+// isLocal reports whether a client connected from this host: over
+// loopback, or over a Unix socket, whose address has no port.
+func isLocal(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// sameOrigin reports whether req may be served: it only reads, or it
+// comes from the dashboard's own pages or from a client that is not a
+// browser. Browsers resend basic auth to any site that submits a form to
+// the dashboard, so without this a page elsewhere could flush the cache.
+// They mark such requests with Sec-Fetch-Site, or in older versions at
+// least with Origin.
+func sameOrigin(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+// authorized accepts a server password either as a bearer token or as
+// the password of HTTP basic auth, which browsers can prompt for.
+func (h *Handler) authorized(req *http.Request) bool {
+	password, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if _, basic, isBasic := req.BasicAuth(); isBasic {
+		password, ok = basic, true
+	}
+	if !ok {
+		return false
+	}
+
+	valid := false
+	for _, p := range h.config.Auth {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(p)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func (h *Handler) handleIndex(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(indexHTML)
+}
+
+func (h *Handler) handleStats(w http.ResponseWriter, _ *http.Request) {
+	resp := map[string]interface{}{
+		"stats":  h.config.Cache.Stats(),
+		"shards": h.config.Cache.ShardStats(),
+	}
+	if topKeys := h.config.Cache.TopKeys(topKeyLimit); topKeys != nil {
+		resp["top_keys"] = topKeys
+	}
+	if h.config.Clients != nil {
+		resp["clients"] = h.config.Clients.List()
+	}
+
+	writeJSON(w, resp)
+}
+
+type keyInfo struct {
+	Key  string `json:"key"`
+	Size int    `json:"size"`
+	TTL  int64  `json:"ttl"`
+}
+
+func (h *Handler) handleKeys(w http.ResponseWriter, req *http.Request) {
+	pattern := req.URL.Query().Get("pattern")
+	limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultKeyLimit
+	}
+
+	keys := make([]keyInfo, 0)
+	h.config.Cache.IterateSnapshot(func(entry *cache.Entry) bool {
+		key := string(entry.Key())
+		if pattern != "" && !strings.Contains(key, pattern) {
+			return true
+		}
+
+		ttl := int64(-1)
+		if expireAt := entry.ExpireAt(); expireAt > 0 {
+			ttl = max((expireAt-time.Now().UnixNano())/int64(time.Second), 0)
+		}
+		keys = append(keys, keyInfo{Key: key, Size: len(entry.Value()), TTL: ttl})
+
+		return len(keys) < limit
+	})
+
+	writeJSON(w, keys)
+}
+
+func (h *Handler) handleDelete(w http.ResponseWriter, req *http.Request) {
+	deleted := h.config.Cache.Delete([]byte(req.PathValue("key")))
+	writeJSON(w, map[string]bool{"deleted": deleted})
+}
+
+func (h *Handler) handleFlush(w http.ResponseWriter, _ *http.Request) {
+	h.config.Cache.Clear()
+	writeJSON(w, map[string]bool{"flushed": true})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+func newTestHandler(auth ...string) (*Handler, *cache.Cache) {
+	c := cache.New(1, 0)
+	return NewHandler(&Config{Cache: c, Auth: auth}), c
+}
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuth(t *testing.T) {
+	h, _ := newTestHandler("secret")
+
+	tests := []struct {
+		name      string
+		authorize func(req *http.Request)
+		want      int
+	}{
+		{"none", func(*http.Request) {}, http.StatusUnauthorized},
+		{"wrong password", func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"basic", func(req *http.Request) { req.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin/api/stats", nil)
+		tt.authorize(req)
+		if got := serve(h, req).Code; got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNoAuthIsLocalOnly(t *testing.T) {
+	h, _ := newTestHandler()
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"127.0.0.1:50000", http.StatusOK},
+		{"[::1]:50000", http.StatusOK},
+		{"@", http.StatusOK},
+		{"192.0.2.1:50000", http.StatusForbidden},
+		{"[2001:db8::1]:50000", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin/api/stats", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if got := serve(h, req).Code; got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"no browser headers", nil, http.StatusOK},
+		{"same origin", map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://example.com"}, http.StatusOK},
+		{"same origin header", map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+		{"cross site", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "http://evil.test"}, http.StatusForbidden},
+		{"same site", map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"cross origin header", map[string]string{"Origin": "http://evil.test"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		h, c := newTestHandler("secret")
+		c.Store([]byte("key"), []byte("value"), nil)
+
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/admin/api/flush", nil)
+		req.SetBasicAuth("admin", "secret")
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+		if got := serve(h, req).Code; got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+		_, found := c.Load([]byte("key"))
+		if flushed := !found; flushed != (tt.want == http.StatusOK) {
+			t.Errorf("%s: flushed = %v", tt.name, flushed)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	h, c := newTestHandler("secret")
+
+	c.Store([]byte("users/1"), []byte("a"), nil)
+	c.Store([]byte("users/2"), []byte("b"), nil)
+	c.Store([]byte("plain"), []byte("c"), nil)
+
+	// Keys may contain slashes, whether escaped or not.
+	for _, path := range []string{"/admin/api/keys/users/1", "/admin/api/keys/users%2F2", "/admin/api/keys/plain"} {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := serve(h, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"deleted":true}` {
+			t.Errorf("DELETE %s: %d %q", path, rec.Code, rec.Body.String())
+		}
+	}
+	for _, key := range []string{"users/1", "users/2", "plain"} {
+		if _, found := c.Load([]byte(key)); found {
+			t.Errorf("%s was not deleted", key)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/admin/api/keys/users/1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	if got := serve(h, req).Code; got != http.StatusForbidden {
+		t.Errorf("cross-site DELETE: status %d, want %d", got, http.StatusForbidden)
+	}
+}
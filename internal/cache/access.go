@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// EvictionPolicy selects the entries a full shard evicts.
+type EvictionPolicy int
+
+const (
+	// EvictRandom compares two random entries, preferring expired ones
+	// and then the one expiring soonest. Entries carry no access data.
+	EvictRandom EvictionPolicy = iota
+	// EvictLRU evicts the least recently accessed of a sample of entries.
+	EvictLRU
+	// EvictLFU evicts the least frequently accessed of a sample of
+	// entries, using a decaying logarithmic counter as Redis does.
+	EvictLFU
+	// EvictSLRU splits entries into a probation segment of entries not
+	// accessed since they were stored and a protected segment of those
+	// accessed again, and evicts the least recently accessed probation
+	// entry of a sample.
+	EvictSLRU
+)
+
+const (
+	evictionSamples = 5
+
+	// The LFU counter starts at lfuInitVal so new keys are not evicted
+	// before they have had a chance to be read, grows logarithmically
+	// with lfuLogFactor, and loses one point per lfuDecayTime idle.
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuMaxVal    = 255
+	lfuDecayTime = time.Minute
+)
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "2random", "":
+		return EvictRandom, nil
+	case "lru":
+		return EvictLRU, nil
+	case "lfu":
+		return EvictLFU, nil
+	case "slru":
+		return EvictSLRU, nil
+	}
+	return EvictRandom, fmt.Errorf("unknown eviction policy %q (want 2random, lru, lfu or slru)", s)
+}
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	case EvictSLRU:
+		return "slru"
+	}
+	return "2random"
+}
+
+// SetEvictionPolicy sets the policy full shards evict by. The LRU and LFU
+// policies record access metadata on every entry stored afterwards, so
+// set the policy before loading data.
+func (c *Cache) SetEvictionPolicy(policy EvictionPolicy) {
+	c.policy = policy
+	for shard := range c.allShards() {
+		shard.lock()
+		shard.policy = policy
+		shard.unlock()
+	}
+}
+
+func (c *Cache) EvictionPolicy() EvictionPolicy {
+	return c.policy
+}
+
+// access is the metadata an entry carries under the LRU and LFU
+// policies. Reads update it under the shard's read lock, so its fields
+// are atomic; concurrent updates may lose an increment, which only makes
+// the approximation slightly coarser.
+type access struct {
+	lastAccess atomic.Int64
+	counter    atomic.Uint32
+	// protected is set once the entry is accessed after being stored,
+	// moving it to the protected segment under EvictSLRU.
+	protected atomic.Bool
+}
+
+func newAccess(now int64) *access {
+	a := &access{}
+	a.lastAccess.Store(now)
+	a.counter.Store(lfuInitVal)
+	return a
+}
+
+// trackAccess attaches access metadata to a new entry if the shard's
+// policy needs it.
+func (s *Shard) trackAccess(entry *Entry) {
+	if s.policy != EvictRandom && entry.metadata == nil {
+		entry.metadata = unsafe.Pointer(newAccess(time.Now().UnixNano()))
+	}
+}
+
+func (e *Entry) access() *access {
+	return (*access)(atomic.LoadPointer(&e.metadata))
+}
+
+// touch records an access to the entry.
+func (e *Entry) touch() {
+	a := e.access()
+	if a == nil {
+		return
+	}
+	
+	now := time.Now().UnixNano()
+	counter := decayedCounter(a.counter.Load(), a.lastAccess.Swap(now), now)
+	a.counter.Store(logIncrement(counter))
+	if !a.protected.Load() {
+		a.protected.Store(true)
+	}
+}
+
+// IdleTime returns the time since the entry was last accessed, and false
+// if the entry does not track accesses.
+func (e *Entry) IdleTime() (time.Duration, bool) {
+	a := e.access()
+	if a == nil {
+		return 0, false
+	}
+	return time.Duration(time.Now().UnixNano() - a.lastAccess.Load()), true
+}
+
+// Frequency returns the entry's logarithmic access counter (0-255), and
+// false if the entry does not track accesses.
+func (e *Entry) Frequency() (int, bool) {
+	a := e.access()
+	if a == nil {
+		return 0, false
+	}
+	return int(decayedCounter(a.counter.Load(), a.lastAccess.Load(), time.Now().UnixNano())), true
+}
+
+func decayedCounter(counter uint32, lastAccess, now int64) uint32 {
+	periods := uint32((now - lastAccess) / int64(lfuDecayTime))
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// logIncrement increments counter with a probability that falls as the
+// counter grows, so 255 represents on the order of a million accesses.
+func logIncrement(counter uint32) uint32 {
+	if counter >= lfuMaxVal {
+		return lfuMaxVal
+	}
+	base := float64(max(int(counter)-lfuInitVal, 0))
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// evictionCandidate picks the entry to evict from a sample of live
+// entries under the LRU, LFU or SLRU policy. Expired entries go first.
+func (s *Shard) evictionCandidate() *Entry {
+	if s.policy == EvictSLRU {
+		return s.slruCandidate()
+	}
+	
+	var victim *Entry
+	var victimScore int64
+	now := time.Now().UnixNano()
+	
+	for _, entry := range s.m.sampleEntries(evictionSamples) {
+		if entry.IsExpired() {
+			return entry
+		}
+		
+		a := entry.access()
+		if a == nil {
+			// Stored before the policy was set: the oldest possible.
+			return entry
+		}
+		
+		var score int64
+		if s.policy == EvictLFU {
+			score = int64(decayedCounter(a.counter.Load(), a.lastAccess.Load(), now))
+		} else {
+			score = a.lastAccess.Load()
+		}
+		if victim == nil || score < victimScore {
+			victim, victimScore = entry, score
+		}
+	}
+	
+	return victim
+}
+
+// sampleEntries returns up to n live entries starting from a random
+// bucket, so repeated samples cover the whole table.
+func (m *Map) sampleEntries(n int) []*Entry {
+	if m.numItems == 0 {
+		return nil
+	}
+	
+	entries := make([]*Entry, 0, n)
+	start := rand.Intn(len(m.buckets))
+	for i := 0; i < len(m.buckets) && len(entries) < n; i++ {
+		entry := m.buckets[(start+i)&int(m.mask)].entry.Load()
+		if entry != nil && !entry.IsEvicted() && !entry.pinned {
+			entries = append(entries, entry)
+		}
+	}
+	
+	return entries
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// sketchWidth is the number of counters in each row of a shard's
+	// frequency sketch, and sketchDepth the number of rows.
+	sketchBits  = 12
+	sketchWidth = 1 << sketchBits
+	sketchDepth = 4
+	// sketchMax is the count at which counters saturate.
+	sketchMax = 15
+
+	// ghostCapacity is the number of evicted keys a shard remembers.
+	ghostCapacity = 4096
+)
+
+// admission decides, TinyLFU style, whether a new key is worth evicting
+// another for. It estimates how often each key was accessed recently with
+// a count-min sketch and remembers the hashes of recently evicted keys in
+// a ghost list.
+type admission struct {
+	// counters are sketchDepth rows of sketchWidth counters. Reads
+	// update them without the shard lock, so they are atomic; a lost
+	// increment only makes an estimate a little lower.
+	counters []atomic.Uint32
+	// additions counts increments since the counters were last halved.
+	additions atomic.Uint32
+
+	// ghosts is a ring of the hashes of recently evicted keys, indexed
+	// by ghostSet. Both are guarded by the shard lock.
+	ghosts    []uint64
+	ghostNext int
+	ghostSet  map[uint64]int
+
+	numRejected  atomic.Uint64
+	numGhostHits atomic.Uint64
+}
+
+func newAdmission() *admission {
+	return &admission{
+		counters: make([]atomic.Uint32, sketchDepth*sketchWidth),
+		ghosts:   make([]uint64, 0, ghostCapacity),
+		ghostSet: make(map[uint64]int, ghostCapacity),
+	}
+}
+
+// counter returns the counter of hash in row i. Each row takes different
+// bits of the hash, remixed so the rows are independent.
+func (a *admission) counter(hash uint64, i int) *atomic.Uint32 {
+	h := hash * (0x9E3779B97F4A7C15 + 2*uint64(i))
+	return &a.counters[i*sketchWidth+int(h>>(64-sketchBits))]
+}
+
+// record counts an access to the key with hash. Every 10 accesses per
+// counter all counters are halved, so the sketch follows changes in
+// popularity.
+func (a *admission) record(hash uint64) {
+	for i := 0; i < sketchDepth; i++ {
+		c := a.counter(hash, i)
+		if n := c.Load(); n < sketchMax {
+			c.CompareAndSwap(n, n+1)
+		}
+	}
+	if a.additions.Add(1) == 10*sketchWidth {
+		a.additions.Store(0)
+		for i := range a.counters {
+			a.counters[i].Store(a.counters[i].Load() / 2)
+		}
+	}
+}
+
+// estimate returns how often the key with hash was accessed recently.
+func (a *admission) estimate(hash uint64) uint32 {
+	n := uint32(sketchMax)
+	for i := 0; i < sketchDepth; i++ {
+		n = min(n, a.counter(hash, i).Load())
+	}
+	return n
+}
+
+// addGhost remembers that the key with hash was evicted, forgetting the
+// oldest ghost if the list is full. The caller holds the shard lock.
+func (a *admission) addGhost(hash uint64) {
+	if len(a.ghosts) < ghostCapacity {
+		a.ghosts = append(a.ghosts, hash)
+	} else {
+		old := a.ghosts[a.ghostNext]
+		if a.ghostSet[old]--; a.ghostSet[old] <= 0 {
+			delete(a.ghostSet, old)
+		}
+		a.ghosts[a.ghostNext] = hash
+		a.ghostNext = (a.ghostNext + 1) % ghostCapacity
+	}
+	a.ghostSet[hash]++
+}
+
+// EnableAdmission turns on admission control. A Store that must evict to
+// make room for a new key then compares how often the key was accessed
+// recently with how often the entry it would evict was, and keeps the
+// entry, dropping the new key instead, if the entry is used more. A key
+// that was evicted recently is always admitted: it has proven to be
+// reused. This keeps a scan of keys read once from flushing the working
+// set, at the cost of new keys not being cached until they are accessed a
+// few times. Dropped keys are counted in Stats as num_admission_rejected.
+// Call it before the cache is in use.
+func (c *Cache) EnableAdmission() {
+	for shard := range c.allShards() {
+		shard.lock()
+		shard.admission = newAdmission()
+		shard.unlock()
+	}
+}
+
+// AdmissionEnabled reports whether EnableAdmission was called.
+func (c *Cache) AdmissionEnabled() bool {
+	return c.table.Load().shards[0].admission != nil
+}
+
+// admit reports whether a store of size bytes under key may go ahead. It
+// is always allowed unless admission control is on and the store would
+// evict an entry for a new key. The caller holds the shard lock.
+func (c *Cache) admit(shard *Shard, key []byte, size int64) bool {
+	a := shard.admission
+	if a == nil || shard.maxMemory <= 0 || shard.MemUsed()+size <= shard.maxMemory {
+		return true
+	}
+	if liveEntry(shard.m.get(key)) {
+		return true
+	}
+
+	hash := hashKey(key)
+	if a.ghostSet[hash] > 0 {
+		a.numGhostHits.Add(1)
+		return true
+	}
+	victim := shard.evictionVictim()
+	if victim == nil || a.estimate(hash) > a.estimate(hashKey(victim.key)) {
+		return true
+	}
+	a.numRejected.Add(1)
+	return false
+}
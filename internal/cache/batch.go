@@ -0,0 +1,80 @@
+package cache
+
+// LoadMany is Load for many keys at once: entries[i] is the live entry
+// for keys[i], or nil. Keys are grouped by shard and each shard is
+// read-locked once for all of its keys, rather than once per key. Keys
+// whose entry must be removed, or read back from the disk tier, go through
+// Load one by one.
+func (c *Cache) LoadMany(keys [][]byte) []*Entry {
+	return c.loadMany(keys, true)
+}
+
+// LoadManyNoTouch is LoadMany without recording the accesses, as
+// LoadNoTouch.
+func (c *Cache) LoadManyNoTouch(keys [][]byte) []*Entry {
+	return c.loadMany(keys, false)
+}
+
+func (c *Cache) loadMany(keys [][]byte, touch bool) []*Entry {
+	entries := make([]*Entry, len(keys))
+	
+	groups := make(map[*Shard][]int)
+	for i, key := range keys {
+		shard := c.getShard(key)
+		groups[shard] = append(groups[shard], i)
+	}
+	
+	var single []int
+	for shard, indexes := range groups {
+		shard.rlock()
+		if shard.next.Load() != nil {
+			// Migrated by a resize since it was looked up.
+			shard.mu.RUnlock()
+			single = append(single, indexes...)
+			continue
+		}
+		
+		var misses []int
+		for _, i := range indexes {
+			entry := shard.m.get(keys[i])
+			switch {
+			case liveEntry(entry):
+				entries[i] = entry
+			case entry != nil || c.disk != nil:
+				single = append(single, i)
+			default:
+				misses = append(misses, i)
+			}
+		}
+		shard.mu.RUnlock()
+		
+		// Hooks run without the lock, as they do for Load.
+		for _, i := range indexes {
+			if entry := entries[i]; entry != nil {
+				shard.recordRead(keys[i], touch)
+				shard.hit(entry, touch)
+			}
+		}
+		for _, i := range misses {
+			shard.recordRead(keys[i], touch)
+			shard.miss(keys[i])
+		}
+	}
+	
+	for _, i := range single {
+		entries[i], _ = c.load(keys[i], touch)
+	}
+	return entries
+}
+
+// StoreMany stores values[i] under keys[i], all with opts. It is Apply for
+// a batch of stores: the shards of all the keys are locked together, once
+// each, and the batch is stored atomically, or not at all if a key or
+// value is over the size limits. keys and values must be the same length.
+func (c *Cache) StoreMany(keys, values [][]byte, opts *StoreOptions) error {
+	ops := make([]Op, len(keys))
+	for i, key := range keys {
+		ops[i] = Op{Key: key, Value: values[i], Options: opts}
+	}
+	return c.Apply(ops)
+}
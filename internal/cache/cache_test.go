@@ -2,8 +2,13 @@ package cache
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -97,6 +102,162 @@ func TestIncrement(t *testing.T) {
 	if val != 6 {
 		t.Fatalf("Expected 6, got %d", val)
 	}
+	
+	if entry, _ := c.Load(key); string(entry.Value()) != "6" {
+		t.Errorf("Stored counter = %q, want \"6\"", entry.Value())
+	}
+	
+	c.Store([]byte("text"), []byte("abc"), nil)
+	if _, err := c.Increment([]byte("text"), 1); !errors.Is(err, ErrNotInteger) {
+		t.Errorf("Increment of text = %v, want ErrNotInteger", err)
+	}
+	c.Store([]byte("max"), []byte("9223372036854775807"), nil)
+	if _, err := c.Increment([]byte("max"), 1); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Increment past MaxInt64 = %v, want ErrOverflow", err)
+	}
+}
+
+func TestIncrementUnsigned(t *testing.T) {
+	c := New(1, 0)
+	c.Store([]byte("n"), []byte("10"), &StoreOptions{Flags: 7})
+	c.Store([]byte("max"), []byte("18446744073709551615"), nil)
+	c.Store([]byte("text"), []byte("abc"), nil)
+	c.Store([]byte("negative"), []byte("-1"), nil)
+	
+	tests := []struct {
+		key   string
+		delta uint64
+		decr  bool
+		want  uint64
+		err   error
+	}{
+		{"n", 5, false, 15, nil},
+		{"n", 3, true, 12, nil},
+		{"n", 100, true, 0, nil},
+		{"max", 2, false, 1, nil},
+		{"missing", 1, false, 0, ErrNoSuchKey},
+		{"text", 1, false, 0, ErrNotInteger},
+		{"negative", 1, false, 0, ErrNotInteger},
+	}
+	for _, tt := range tests {
+		got, err := c.IncrementUnsigned([]byte(tt.key), tt.delta, tt.decr)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("IncrementUnsigned(%s, %d, %v) = %d, %v, want %d, %v", tt.key, tt.delta, tt.decr, got, err, tt.want, tt.err)
+		}
+	}
+	
+	entry, _ := c.Load([]byte("n"))
+	if string(entry.Value()) != "0" || entry.Flags() != 7 {
+		t.Errorf("n = %q with flags %d, want \"0\" with flags 7", entry.Value(), entry.Flags())
+	}
+	if _, found := c.Load([]byte("missing")); found {
+		t.Error("IncrementUnsigned created a missing key")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	c := New(1, 0)
+	c.Store([]byte("k"), []byte("ab"), &StoreOptions{TTL: time.Hour, Flags: 3})
+	
+	c.Update([]byte("k"), func(value []byte, found bool) []byte {
+		if !found || string(value) != "ab" {
+			t.Errorf("Update passed %q, %v", value, found)
+		}
+		return append(bytes.Clone(value), 'c')
+	})
+	entry, _ := c.Load([]byte("k"))
+	if string(entry.Value()) != "abc" || entry.Flags() != 3 || entry.ExpireAt() == 0 {
+		t.Errorf("k = %q with flags %d, expiry %d, want \"abc\" keeping flags and TTL", entry.Value(), entry.Flags(), entry.ExpireAt())
+	}
+	
+	c.Update([]byte("missing"), func(value []byte, found bool) []byte {
+		if found {
+			t.Error("Update found a missing key")
+		}
+		return nil
+	})
+	if _, found := c.Load([]byte("missing")); found {
+		t.Error("Update returning nil created the key")
+	}
+	
+	c.Update([]byte("new"), func([]byte, bool) []byte { return []byte("v") })
+	if entry, found := c.Load([]byte("new")); !found || string(entry.Value()) != "v" {
+		t.Error("Update did not create the key")
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	c := New(1, 0)
+	c.SetSizeLimits(4, 8)
+	
+	if err := c.Store([]byte("keys"), []byte("12345678"), nil); err != nil {
+		t.Fatalf("Store at the limits: %v", err)
+	}
+	if err := c.Store([]byte("key-5"), []byte("v"), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Store with a long key = %v, want ErrKeyTooLarge", err)
+	}
+	if err := c.Store([]byte("k"), []byte("123456789"), nil); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Store with a long value = %v, want ErrValueTooLarge", err)
+	}
+	if _, err := c.CompareAndSwap([]byte("keys"), []byte("123456789"), 0, nil); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("CompareAndSwap with a long value = %v, want ErrValueTooLarge", err)
+	}
+	if _, err := c.Increment([]byte("key-5"), 1); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Increment with a long key = %v, want ErrKeyTooLarge", err)
+	}
+	if _, err := c.Rename([]byte("keys"), []byte("key-5"), false); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Rename to a long key = %v, want ErrKeyTooLarge", err)
+	}
+	
+	err := c.Update([]byte("keys"), func(value []byte, _ bool) []byte {
+		return append(bytes.Clone(value), '9')
+	})
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Update growing past the limit = %v, want ErrValueTooLarge", err)
+	}
+	if entry, _ := c.Load([]byte("keys")); string(entry.Value()) != "12345678" {
+		t.Errorf("keys = %q after rejected writes", entry.Value())
+	}
+	
+	c.SetSizeLimits(0, 0)
+	if err := c.Store([]byte("key-5"), []byte("123456789"), nil); err != nil {
+		t.Errorf("Store without limits: %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	c := New(16, 0)
+	c.Store([]byte("gone"), []byte("x"), nil)
+	
+	var deleted []string
+	c.AddHooks(&Hooks{OnDelete: func(key []byte) { deleted = append(deleted, string(key)) }})
+	
+	var ops []Op
+	for i := 0; i < 50; i++ {
+		ops = append(ops, Op{Key: []byte(fmt.Sprintf("k%d", i)), Value: []byte("v")})
+	}
+	ops = append(ops, Op{Key: []byte("k0"), Value: []byte("last")}, Op{Key: []byte("gone"), Delete: true})
+	if err := c.Apply(ops); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if c.NumItems() != 50 {
+		t.Errorf("NumItems = %d, want 50", c.NumItems())
+	}
+	if entry, _ := c.Load([]byte("k0")); string(entry.Value()) != "last" {
+		t.Errorf("k0 = %q, want the later write", entry.Value())
+	}
+	if len(deleted) != 1 || deleted[0] != "gone" {
+		t.Errorf("deleted = %q", deleted)
+	}
+	
+	c.SetSizeLimits(0, 2)
+	err := c.Apply([]Op{{Key: []byte("new"), Value: []byte("v")}, {Key: []byte("big"), Value: []byte("123")}})
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Apply with a long value = %v, want ErrValueTooLarge", err)
+	}
+	if _, found := c.Load([]byte("new")); found {
+		t.Error("a rejected batch was partly applied")
+	}
 }
 
 func TestCompareAndSwap(t *testing.T) {
@@ -131,6 +292,288 @@ func TestCompareAndSwap(t *testing.T) {
 	}
 }
 
+func TestLoadAndDelete(t *testing.T) {
+	c := New(16, 0)
+	
+	key := []byte("key")
+	c.Store(key, []byte("value"), nil)
+	
+	entry, found := c.LoadAndDelete(key)
+	if !found || string(entry.Value()) != "value" {
+		t.Fatalf("LoadAndDelete = %v, %v", entry, found)
+	}
+	if _, found := c.Load(key); found {
+		t.Fatal("LoadAndDelete did not delete the key")
+	}
+	if entry, found := c.LoadAndDelete(key); found {
+		t.Errorf("LoadAndDelete on a missing key = %q", entry.Value())
+	}
+	if stats := c.Stats(); stats.Items != 0 || stats.MemUsed != 0 {
+		t.Errorf("Stats after LoadAndDelete = %+v", stats)
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	c := New(16, 0)
+	
+	key := []byte("cas-key")
+	c.Store(key, []byte("value1"), nil)
+	entry, _ := c.Load(key)
+	stale := entry.CAS()
+	c.Store(key, []byte("value2"), nil)
+	entry, _ = c.Load(key)
+	
+	if deleted, err := c.CompareAndDelete(key, stale); deleted || err != nil {
+		t.Fatalf("CompareAndDelete with a stale CAS = %v, %v", deleted, err)
+	}
+	if _, found := c.Load(key); !found {
+		t.Fatal("CompareAndDelete with a stale CAS deleted the key")
+	}
+	
+	if deleted, err := c.CompareAndDelete(key, entry.CAS()); !deleted || err != nil {
+		t.Fatalf("CompareAndDelete = %v, %v", deleted, err)
+	}
+	if _, found := c.Load(key); found {
+		t.Fatal("CompareAndDelete did not delete the key")
+	}
+	
+	if _, err := c.CompareAndDelete(key, entry.CAS()); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("CompareAndDelete on a missing key = %v, want ErrNoSuchKey", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	c := New(16, 0)
+	
+	c.Store([]byte("src"), []byte("value"), &StoreOptions{TTL: time.Hour, Flags: 7})
+	c.Store([]byte("taken"), []byte("other"), nil)
+	
+	renamed, err := c.Rename([]byte("src"), []byte("taken"), true)
+	if err != nil || renamed {
+		t.Fatalf("Rename NX onto an existing key: renamed=%v err=%v", renamed, err)
+	}
+	
+	renamed, err = c.Rename([]byte("src"), []byte("dst"), false)
+	if err != nil || !renamed {
+		t.Fatalf("Rename failed: renamed=%v err=%v", renamed, err)
+	}
+	
+	if _, found := c.Load([]byte("src")); found {
+		t.Fatal("Source key still present after rename")
+	}
+	entry, found := c.Load([]byte("dst"))
+	if !found || !bytes.Equal(entry.Value(), []byte("value")) {
+		t.Fatal("Destination key missing or wrong after rename")
+	}
+	if entry.ExpireAt() == 0 || entry.Flags() != 7 {
+		t.Fatal("Rename did not keep expiry and flags")
+	}
+	
+	if _, err := c.Rename([]byte("src"), []byte("dst"), false); err != ErrNoSuchKey {
+		t.Fatalf("Expected ErrNoSuchKey, got %v", err)
+	}
+	
+	if c.NumItems() != 2 {
+		t.Fatalf("Expected 2 items, got %d", c.NumItems())
+	}
+}
+
+func TestCopy(t *testing.T) {
+	c := New(16, 0)
+	
+	c.Store([]byte("src"), []byte("value"), nil)
+	c.Store([]byte("taken"), []byte("other"), nil)
+	
+	if copied, _ := c.Copy([]byte("src"), []byte("taken"), false); copied {
+		t.Fatal("Copy overwrote an existing key without replace")
+	}
+	if copied, _ := c.Copy([]byte("src"), []byte("taken"), true); !copied {
+		t.Fatal("Copy with replace failed")
+	}
+	if copied, _ := c.Copy([]byte("missing"), []byte("dst"), false); copied {
+		t.Fatal("Copy of a missing key succeeded")
+	}
+	
+	for _, key := range []string{"src", "taken"} {
+		entry, found := c.Load([]byte(key))
+		if !found || !bytes.Equal(entry.Value(), []byte("value")) {
+			t.Fatalf("Key %s missing or wrong after copy", key)
+		}
+	}
+}
+
+func TestRenameConcurrent(t *testing.T) {
+	c := New(16, 0)
+	
+	a, b := []byte("key-a"), []byte("key-b")
+	if c.shardIndex(a) == c.shardIndex(b) {
+		t.Skip("keys hash to the same shard")
+	}
+	c.Store(a, []byte("value"), nil)
+	
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			
+			for j := 0; j < 1000; j++ {
+				if i%2 == 0 {
+					c.Rename(a, b, false)
+				} else {
+					c.Rename(b, a, false)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	
+	if c.NumItems() != 1 {
+		t.Fatalf("Expected exactly one key after concurrent renames, got %d", c.NumItems())
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	c := New(16, 0)
+	mc := c.Namespace("mc:")
+	
+	c.Store([]byte("key"), []byte("global"), nil)
+	mc.Store([]byte("key"), []byte("scoped"), nil)
+	mc.Store([]byte("other"), []byte("value"), nil)
+	
+	entry, found := mc.Load([]byte("key"))
+	if !found || !bytes.Equal(entry.Value(), []byte("scoped")) {
+		t.Fatal("Namespace did not load its own key")
+	}
+	entry, found = c.Load([]byte("mc:key"))
+	if !found || !bytes.Equal(entry.Value(), []byte("scoped")) {
+		t.Fatal("Namespaced key not stored under its prefix")
+	}
+	
+	if mc.NumItems() != 2 {
+		t.Fatalf("Expected 2 items in namespace, got %d", mc.NumItems())
+	}
+	mc.Iterate(func(e *Entry) bool {
+		if bytes.HasPrefix(e.Key(), []byte("mc:")) {
+			t.Fatalf("Iterate returned prefixed key %q", e.Key())
+		}
+		return true
+	})
+	
+	mc.Clear()
+	if mc.NumItems() != 0 {
+		t.Fatal("Clear left keys in the namespace")
+	}
+	if _, found := c.Load([]byte("key")); !found {
+		t.Fatal("Clear removed a key outside the namespace")
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	c := New(4, 0)
+	for i := 0; i < 1000; i++ {
+		c.Store([]byte(fmt.Sprintf("tenant1:%d", i)), []byte("v"), nil)
+	}
+	c.Store([]byte("tenant2:1"), []byte("v"), nil)
+	
+	deleted := 0
+	c.AddHooks(&Hooks{OnDelete: func(key []byte) { deleted++ }})
+	
+	<-c.DeletePrefix([]byte("tenant1:"))
+	if c.NumItems() != 1 {
+		t.Fatalf("Expected only tenant2:1 left, got %d keys", c.NumItems())
+	}
+	if deleted != 1000 {
+		t.Fatalf("Expected 1000 delete hooks, got %d", deleted)
+	}
+	if statuses := c.PrefixDeletes(); len(statuses) != 0 {
+		t.Fatalf("Finished delete still reported: %+v", statuses)
+	}
+	
+	ns := c.Namespace("tenant2:")
+	<-ns.DeletePrefix(nil)
+	if c.NumItems() != 0 {
+		t.Fatal("Namespace DeletePrefix left its key")
+	}
+}
+
+func TestTopKeys(t *testing.T) {
+	c := New(4, 0)
+	if c.TopKeys(10) != nil {
+		t.Fatal("TopKeys should be nil when tracking is disabled")
+	}
+	c.EnableHotKeys(8)
+	
+	for i := 0; i < 100; i++ {
+		c.Load([]byte("user:hot"))
+	}
+	c.Store([]byte("user:hot"), []byte("v"), nil)
+	for i := 0; i < 1000; i++ {
+		c.Load([]byte(fmt.Sprintf("cold:%d", i)))
+	}
+	
+	top := c.TopKeys(1)
+	if len(top) != 1 || top[0].Key != "user:hot" {
+		t.Fatalf("Expected user:hot on top, got %+v", top)
+	}
+	if top[0].Reads != 100 || top[0].Writes != 1 {
+		t.Fatalf("Expected 100 reads and 1 write, got %+v", top[0])
+	}
+	
+	grouped := GroupByPrefix(c.TopKeys(0), ":", 0)
+	// Space-Saving counts always sum to the number of accesses.
+	if len(grouped) != 2 || grouped[0].Key != "cold:" || grouped[0].Count != 1000 || grouped[1].Count != 101 {
+		t.Fatalf("Unexpected prefix groups %+v", grouped)
+	}
+}
+
+func TestSizeReport(t *testing.T) {
+	c := New(4, 0)
+	
+	c.Store([]byte("small"), []byte("v"), nil)
+	c.Store([]byte("big"), make([]byte, 100000), nil)
+	c.Store([]byte("medium"), make([]byte, 1000), nil)
+	
+	report := c.SizeReport(2)
+	if report.Keys != 3 || report.Bytes != c.MemUsed() {
+		t.Fatalf("Expected 3 keys using %d bytes, got %d keys using %d", c.MemUsed(), report.Keys, report.Bytes)
+	}
+	if len(report.Largest) != 2 || report.Largest[0].Key != "big" || report.Largest[1].Key != "medium" {
+		t.Fatalf("Unexpected largest keys %+v", report.Largest)
+	}
+	
+	keys := 0
+	for _, bucket := range report.Histogram {
+		keys += bucket.Keys
+	}
+	if keys != 3 || report.Histogram[0].Keys != 1 {
+		t.Fatalf("Unexpected histogram %+v", report.Histogram)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	c := New(1, 0)
+	
+	for i := 0; i < 1000; i++ {
+		c.Store([]byte(fmt.Sprintf("key:%d", i)), []byte("value"), &StoreOptions{TTL: time.Millisecond})
+	}
+	c.Store([]byte("keep"), []byte("value"), nil)
+	grown := c.MemoryStats().Shards[0].Buckets
+	
+	time.Sleep(5 * time.Millisecond)
+	if removed := c.Purge(); removed != 1000 {
+		t.Fatalf("Expected 1000 purged entries, got %d", removed)
+	}
+	
+	stats := c.MemoryStats()
+	if stats.Items != 1 || stats.Shards[0].Buckets >= grown {
+		t.Fatalf("Purge did not shrink the table: %+v (was %d buckets)", stats.Shards[0], grown)
+	}
+	if _, found := c.Load([]byte("keep")); !found {
+		t.Fatal("Purge removed a live key")
+	}
+}
+
 func TestConcurrency(t *testing.T) {
 	c := New(16, 0)
 	
@@ -165,7 +608,7 @@ func TestConcurrency(t *testing.T) {
 	wg.Wait()
 	
 	stats := c.Stats()
-	if stats["num_ops"].(uint64) == 0 {
+	if stats.Ops == 0 {
 		t.Error("No operations recorded")
 	}
 }
@@ -186,11 +629,227 @@ func TestMemoryLimit(t *testing.T) {
 	}
 	
 	stats := c.Stats()
-	if stats["num_evicted"].(uint64) == 0 {
+	if stats.Evicted == 0 {
 		t.Error("No evictions occurred despite memory limit")
 	}
 }
 
+func TestEvictionPolicy(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictLFU} {
+		t.Run(policy.String(), func(t *testing.T) {
+			c := New(1, 2048)
+			c.SetEvictionPolicy(policy)
+			
+			hot := []byte("hot")
+			c.Store(hot, make([]byte, 100), nil)
+			for i := 0; i < 200; i++ {
+				c.Store([]byte(fmt.Sprintf("key-%d", i)), make([]byte, 100), nil)
+				for j := 0; j < 10; j++ {
+					c.Load(hot)
+				}
+			}
+			
+			if c.Stats().Evicted == 0 {
+				t.Fatal("No evictions occurred despite memory limit")
+			}
+			if _, found := c.Load(hot); !found {
+				t.Fatal("The most used key was evicted")
+			}
+			
+			info, _ := c.Inspect(hot)
+			if !info.Tracked || info.Idle > time.Second {
+				t.Errorf("Expected a tracked, recently used entry, got %+v", info)
+			}
+			if info.Frequency <= lfuInitVal {
+				t.Errorf("Expected the access counter to grow past %d, got %d", lfuInitVal, info.Frequency)
+			}
+		})
+	}
+	
+	c := New(1, 0)
+	c.Store([]byte("key"), []byte("value"), nil)
+	if info, _ := c.Inspect([]byte("key")); info.Tracked {
+		t.Error("The random policy should not track accesses")
+	}
+}
+
+func TestEvictionRemovesEntries(t *testing.T) {
+	c := New(1, 2048)
+	for i := 0; i < 200; i++ {
+		c.Store([]byte(fmt.Sprintf("key-%d", i)), make([]byte, 100), nil)
+	}
+	if c.Stats().Evicted == 0 {
+		t.Fatal("No evictions occurred despite memory limit")
+	}
+	
+	// Victims leave the map at once: NumItems counts only the keys that
+	// are still there.
+	live := 0
+	for i := 0; i < 200; i++ {
+		if _, found := c.LoadNoTouch([]byte(fmt.Sprintf("key-%d", i))); found {
+			live++
+		}
+	}
+	if n := c.NumItems(); n != live {
+		t.Errorf("NumItems = %d, want the %d keys that can be loaded", n, live)
+	}
+	c.Iterate(func(e *Entry) bool {
+		if e.IsEvicted() {
+			t.Errorf("evicted %s still in the map", e.Key())
+		}
+		return true
+	})
+}
+
+func TestEvictionStorm(t *testing.T) {
+	c := New(1, 10000)
+	c.SetEvictionPolicy(EvictLRU)
+	shard := c.getShard([]byte("key"))
+	
+	// A shard that spent half of the last second evicting is in a storm.
+	shard.lock()
+	shard.pressure.windowStart = time.Now().Add(-evictionWindow).UnixNano()
+	c.recordEvictions(shard, 1000, evictionWindow/2)
+	shard.unlock()
+	if stats := c.EvictionStats(); !stats.Pressure || stats.PerSecond < 900 || stats.Busy < 0.4 {
+		t.Fatalf("EvictionStats = %+v, want pressure at about 1000 evictions/s and 50%% busy", stats)
+	}
+	if !c.Stats().EvictionPressure {
+		t.Error("Stats does not report eviction pressure")
+	}
+	
+	// In a storm, one eviction frees DefaultBulkPercent of the memory.
+	for i := 0; shard.NumEvicted() == 0; i++ {
+		c.Store([]byte(fmt.Sprintf("key-%d", i)), make([]byte, 76), nil)
+	}
+	if used, want := shard.MemUsed(), int64(10000*(100-DefaultBulkPercent)/100); used > want {
+		t.Errorf("MemUsed = %d after a bulk eviction, want at most %d", used, want)
+	}
+	if stats := c.EvictionStats(); stats.BulkEvictions != 1 {
+		t.Errorf("BulkEvictions = %d, want 1", stats.BulkEvictions)
+	}
+	
+	// The storm is over once evicting takes under half the threshold.
+	shard.lock()
+	shard.pressure.windowStart = time.Now().Add(-evictionWindow).UnixNano()
+	c.recordEvictions(shard, 10, time.Millisecond)
+	shard.unlock()
+	if c.EvictionStats().Pressure {
+		t.Error("Eviction pressure reported after the storm ended")
+	}
+	
+	c.SetEvictionStorm(0, 0)
+	shard.lock()
+	shard.pressure.windowStart = time.Now().Add(-evictionWindow).UnixNano()
+	c.recordEvictions(shard, 1000, evictionWindow)
+	shard.unlock()
+	if c.EvictionStats().Pressure {
+		t.Error("Bulk eviction started with SetEvictionStorm(0, 0)")
+	}
+}
+
+func TestSLRU(t *testing.T) {
+	c := New(1, 4096)
+	c.SetEvictionPolicy(EvictSLRU)
+	
+	// A working set read once after being stored, then a longer scan.
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("hot-%d", i))
+		c.Store(key, make([]byte, 100), nil)
+		c.Load(key)
+	}
+	for i := 0; i < 500; i++ {
+		c.Store([]byte(fmt.Sprintf("scan-%d", i)), make([]byte, 100), nil)
+	}
+	
+	hits := 0
+	for i := 0; i < 20; i++ {
+		if _, found := c.Load([]byte(fmt.Sprintf("hot-%d", i))); found {
+			hits++
+		}
+	}
+	if hits < 18 {
+		t.Errorf("%d of 20 protected keys survived the scan, want at least 18", hits)
+	}
+	
+	// When every entry is protected, the oldest are demoted and evicted.
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		c.Store(key, make([]byte, 100), nil)
+		c.Load(key)
+	}
+	if used := c.MemUsed(); used > 4096 {
+		t.Errorf("MemUsed = %d over the limit of 4096", used)
+	}
+	if _, found := c.Load([]byte("key-499")); !found {
+		t.Error("The newest protected key was evicted")
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	c := New(1, 4096)
+	c.SetEvictionPolicy(EvictLRU)
+	c.EnableAdmission()
+	
+	// A working set read over and over, then a scan of keys read once.
+	for i := 0; i < 20; i++ {
+		c.Store([]byte(fmt.Sprintf("hot-%d", i)), make([]byte, 100), nil)
+	}
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			c.Load([]byte(fmt.Sprintf("hot-%d", i)))
+		}
+	}
+	for i := 0; i < 500; i++ {
+		c.Store([]byte(fmt.Sprintf("scan-%d", i)), make([]byte, 100), nil)
+	}
+	
+	hits := 0
+	for i := 0; i < 20; i++ {
+		if _, found := c.Load([]byte(fmt.Sprintf("hot-%d", i))); found {
+			hits++
+		}
+	}
+	if hits < 18 {
+		t.Errorf("%d of 20 hot keys survived the scan, want at least 18", hits)
+	}
+	if c.Stats().AdmissionRejected == 0 {
+		t.Error("No stores rejected")
+	}
+	
+	// A key evicted recently is admitted again straight away.
+	shard := c.getShard([]byte("ghost"))
+	shard.lock()
+	shard.admission.addGhost(hashKey([]byte("ghost")))
+	shard.unlock()
+	c.Store([]byte("ghost"), make([]byte, 100), nil)
+	if _, found := c.Load([]byte("ghost")); !found {
+		t.Error("A recently evicted key was not admitted")
+	}
+	if c.Stats().GhostHits != 1 {
+		t.Errorf("num_ghost_hits = %v, want 1", c.Stats().GhostHits)
+	}
+}
+
+func TestLoadNoTouch(t *testing.T) {
+	c := New(1, 0)
+	c.SetEvictionPolicy(EvictLFU)
+	c.Store([]byte("key"), []byte("value"), nil)
+	
+	for i := 0; i < 100; i++ {
+		if _, found := c.LoadNoTouch([]byte("key")); !found {
+			t.Fatal("LoadNoTouch missed a stored key")
+		}
+	}
+	
+	if info, _ := c.Inspect([]byte("key")); info.Frequency != lfuInitVal {
+		t.Errorf("Expected the access counter to stay at %d, got %d", lfuInitVal, info.Frequency)
+	}
+	if hits := c.Stats().Hits; hits != 100 {
+		t.Errorf("Expected 100 hits, got %d", hits)
+	}
+}
+
 func TestSweep(t *testing.T) {
 	c := New(16, 0)
 	
@@ -255,17 +914,42 @@ func BenchmarkLoad(b *testing.B) {
 	})
 }
 
-func BenchmarkDelete(b *testing.B) {
+// BenchmarkLoadMixed reads nine times for every write across a set of
+// keys, the workload where readers used to queue on the shard lock.
+func BenchmarkLoadMixed(b *testing.B) {
 	c := New(16, 0)
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		c.Store(keys[i], []byte("value"), nil)
+	}
 	
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		i := 0
 		for pb.Next() {
-			key := []byte(fmt.Sprintf("key-%d", i))
-			c.Store(key, []byte("value"), nil)
-			c.Delete(key)
-			i++
+			key := keys[i%len(keys)]
+			if i%10 == 0 {
+				c.Store(key, []byte("value"), nil)
+			} else {
+				c.Load(key)
+			}
+			i += 7
+		}
+	})
+}
+
+func BenchmarkDelete(b *testing.B) {
+	c := New(16, 0)
+	
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			c.Store(key, []byte("value"), nil)
+			c.Delete(key)
+			i++
 		}
 	})
 }
@@ -280,4 +964,768 @@ func BenchmarkIncrement(b *testing.B) {
 			c.Increment(key, 1)
 		}
 	})
-}
\ No newline at end of file
+}
+
+func TestExpiryIndex(t *testing.T) {
+	c := New(4, 0)
+	now := time.Now()
+	
+	// Short TTLs, one of them extended and one removed before it passes.
+	for i := 0; i < 10; i++ {
+		c.Store([]byte(fmt.Sprintf("short-%d", i)), []byte("v"), &StoreOptions{TTL: 50 * time.Millisecond})
+	}
+	c.Expire([]byte("short-0"), now.Add(time.Hour).UnixNano())
+	c.Expire([]byte("short-1"), 0)
+	c.Delete([]byte("short-2"))
+	
+	// Long TTLs, overwritten several times to leave stale index items.
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 5; i++ {
+			c.Store([]byte(fmt.Sprintf("long-%d", i)), []byte("v"), &StoreOptions{TTL: 30 * time.Second})
+		}
+	}
+	c.Store([]byte("persistent"), []byte("v"), nil)
+	
+	stats := c.ExpiryStats()
+	if stats.Volatile != 13 || stats.NextMinute != 12 {
+		t.Errorf("Expected 13 volatile keys, 12 within a minute, got %+v", stats)
+	}
+	if stats.Soonest < now.UnixNano() || stats.Soonest > now.Add(time.Second).UnixNano() {
+		t.Errorf("Soonest expiry %v is not the short TTL", time.Unix(0, stats.Soonest))
+	}
+	
+	time.Sleep(100 * time.Millisecond)
+	
+	if expired := c.Sweep(); expired != 7 {
+		t.Errorf("Expected 7 expired entries, got %d", expired)
+	}
+	for _, key := range []string{"short-0", "short-1", "long-4", "persistent"} {
+		if _, found := c.Load([]byte(key)); !found {
+			t.Errorf("Key %s was swept", key)
+		}
+	}
+	if stats := c.ExpiryStats(); stats.Volatile != 6 {
+		t.Errorf("Expected 6 volatile keys after the sweep, got %+v", stats)
+	}
+}
+
+func TestLoadOrStore(t *testing.T) {
+	c := New(4, 0)
+	
+	var wg sync.WaitGroup
+	var stored atomic.Int32
+	values := make([]string, 32)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entry, loaded := c.LoadOrStore([]byte("key"), []byte(fmt.Sprintf("value-%d", i)), nil)
+			if !loaded {
+				stored.Add(1)
+			}
+			values[i] = string(entry.Value())
+		}(i)
+	}
+	wg.Wait()
+	
+	if stored.Load() != 1 {
+		t.Fatalf("Expected exactly one caller to store, got %d", stored.Load())
+	}
+	for _, v := range values {
+		if v != values[0] {
+			t.Fatalf("Callers saw different values: %q and %q", v, values[0])
+		}
+	}
+	
+	// Expired entries count as absent.
+	c.Store([]byte("expired"), []byte("old"), &StoreOptions{TTL: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+	if entry, loaded := c.LoadOrStore([]byte("expired"), []byte("new"), nil); loaded || string(entry.Value()) != "new" {
+		t.Errorf("Expected an expired key to be replaced, got %q (loaded %v)", entry.Value(), loaded)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	c := New(4, 0)
+	
+	calls := 0
+	load := func() ([]byte, error) {
+		calls++
+		return []byte("loaded"), nil
+	}
+	for i := 0; i < 3; i++ {
+		entry, _, err := c.Fetch([]byte("key"), &StoreOptions{TTL: time.Minute}, load)
+		if err != nil || string(entry.Value()) != "loaded" {
+			t.Fatalf("Fetch = %q, %v", entry.Value(), err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the loader to run once, ran %d times", calls)
+	}
+	
+	failure := errors.New("origin down")
+	if _, _, err := c.Fetch([]byte("other"), nil, func() ([]byte, error) { return nil, failure }); err != failure {
+		t.Errorf("Expected the loader error, got %v", err)
+	}
+	if _, found := c.Load([]byte("other")); found {
+		t.Error("A failed load stored a value")
+	}
+}
+
+func TestFetchCoalescesMisses(t *testing.T) {
+	c := New(4, 0)
+	
+	var calls atomic.Int32
+	release := make(chan struct{})
+	load := func() ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte("loaded"), nil
+	}
+	
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, _, err := c.Fetch([]byte("key"), nil, load)
+			if err != nil || string(entry.Value()) != "loaded" {
+				t.Errorf("Fetch = %v, %v", entry, err)
+			}
+		}()
+	}
+	
+	// Give the callers time to pile up behind the first load.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	
+	if calls.Load() != 1 {
+		t.Errorf("Expected one load for concurrent misses, got %d", calls.Load())
+	}
+	stats := c.Stats()
+	if stats.Fetches != 1 || stats.Coalesced != 19 {
+		t.Errorf("Expected 1 fetch and 19 coalesced, got %v and %v", stats.Fetches, stats.Coalesced)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	c := New(4, 0)
+	
+	if _, replaced := c.Swap([]byte("key"), []byte("first"), nil); replaced {
+		t.Error("Swap on a missing key reported a replaced entry")
+	}
+	old, replaced := c.Swap([]byte("key"), []byte("second"), nil)
+	if !replaced || string(old.Value()) != "first" {
+		t.Errorf("Expected to replace %q, got %v", "first", old)
+	}
+	if entry, _ := c.Load([]byte("key")); string(entry.Value()) != "second" {
+		t.Errorf("Expected %q, got %q", "second", entry.Value())
+	}
+}
+
+func TestSoftTTL(t *testing.T) {
+	c := New(1, 0)
+	
+	c.Store([]byte("key"), []byte("v1"), &StoreOptions{TTL: time.Hour, SoftTTL: 20 * time.Millisecond})
+	entry, _ := c.Load([]byte("key"))
+	if entry.NeedsRefresh() {
+		t.Error("Entry needs a refresh before its soft TTL")
+	}
+	
+	time.Sleep(40 * time.Millisecond)
+	
+	entry, found := c.Load([]byte("key"))
+	if !found {
+		t.Fatal("Entry removed at its soft TTL")
+	}
+	if !entry.NeedsRefresh() {
+		t.Error("Entry does not need a refresh after its soft TTL")
+	}
+	
+	// Storing a new value resets the soft TTL.
+	c.Store([]byte("key"), []byte("v2"), &StoreOptions{TTL: time.Hour, SoftTTL: time.Hour})
+	if entry, _ := c.Load([]byte("key")); entry.NeedsRefresh() {
+		t.Error("Entry needs a refresh after being stored again")
+	}
+	
+	c.Store([]byte("plain"), []byte("v"), &StoreOptions{TTL: time.Hour})
+	if entry, _ := c.Load([]byte("plain")); entry.NeedsRefresh() || entry.SoftExpireAt() != 0 {
+		t.Error("Entry without a soft TTL needs a refresh")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	c := New(1, 0)
+	
+	var events []string
+	remove := c.AddHooks(&Hooks{
+		OnStore:  func(e *Entry) { events = append(events, "store "+string(e.Key())) },
+		OnDelete: func(key []byte) { events = append(events, "delete "+string(key)) },
+		OnExpire: func(key []byte) { events = append(events, "expire "+string(key)) },
+		OnHit:    func(e *Entry) { events = append(events, "hit "+string(e.Key())) },
+		OnMiss:   func(key []byte) { events = append(events, "miss "+string(key)) },
+	})
+	
+	c.Store([]byte("a"), []byte("1"), nil)
+	c.Load([]byte("a"))
+	c.Load([]byte("b"))
+	c.Rename([]byte("a"), []byte("b"), false)
+	c.Increment([]byte("n"), 1)
+	c.Delete([]byte("b"))
+	c.Delete([]byte("b"))
+	c.Store([]byte("short"), []byte("v"), &StoreOptions{TTL: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+	c.Load([]byte("short"))
+	
+	want := []string{
+		"store a", "hit a", "miss b", "delete a", "store b", "store n",
+		"delete b", "store short", "expire short", "miss short",
+	}
+	if !slices.Equal(events, want) {
+		t.Errorf("Events = %q, want %q", events, want)
+	}
+	
+	remove()
+	events = nil
+	c.Store([]byte("a"), []byte("1"), nil)
+	if len(events) != 0 {
+		t.Errorf("Removed hooks still called: %q", events)
+	}
+}
+
+func TestEvictHook(t *testing.T) {
+	c := New(1, 1000)
+	
+	evicted := 0
+	c.AddHooks(&Hooks{OnEvict: func(e *Entry) { evicted++ }})
+	
+	for i := 0; i < 100; i++ {
+		c.Store([]byte(fmt.Sprintf("key-%d", i)), make([]byte, 50), nil)
+	}
+	if evicted == 0 || uint64(evicted) != c.Stats().Evicted {
+		t.Errorf("OnEvict called %d times, stats report %v evictions", evicted, c.Stats().Evicted)
+	}
+}
+
+func TestResize(t *testing.T) {
+	c := New(4, 0)
+	
+	for i := 0; i < 10000; i++ {
+		c.Store([]byte(fmt.Sprintf("key-%d", i)), []byte("value"), nil)
+	}
+	c.Store([]byte("short"), []byte("v"), &StoreOptions{TTL: time.Millisecond})
+	memUsed := c.MemUsed()
+	time.Sleep(5 * time.Millisecond)
+	
+	// Writers keep going while the entries move.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := []byte(fmt.Sprintf("writer-%d-%d", w, i%100))
+				c.Store(key, []byte("v"), nil)
+				c.Load(key)
+				c.Rename(key, []byte(fmt.Sprintf("renamed-%d-%d", w, i%100)), false)
+			}
+		}(w)
+	}
+	
+	if err := c.Resize(7); err != nil {
+		t.Fatalf("Resize: %v", err)
+	}
+	if err := c.Resize(9); !errors.Is(err, ErrResizing) {
+		t.Errorf("Resize during a resize = %v, want ErrResizing", err)
+	}
+	
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, running := c.ResizeStatus(); !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Resize did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	
+	if n := c.NumShards(); n != 7 {
+		t.Errorf("NumShards = %d, want 7", n)
+	}
+	if n := len(c.ShardStats()); n != 7 {
+		t.Errorf("ShardStats has %d shards, want 7", n)
+	}
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if entry, ok := c.Load(key); !ok || string(entry.Value()) != "value" {
+			t.Fatalf("%s lost in resize", key)
+		}
+	}
+	if _, ok := c.Load([]byte("short")); ok {
+		t.Error("Expired key survived the resize")
+	}
+	
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 100; i++ {
+			c.Delete([]byte(fmt.Sprintf("writer-%d-%d", w, i)))
+			c.Delete([]byte(fmt.Sprintf("renamed-%d-%d", w, i)))
+		}
+	}
+	if got, want := c.MemUsed(), memUsed-(&Entry{key: []byte("short"), value: []byte("v")}).Size(); got != want {
+		t.Errorf("MemUsed = %d after resize, want %d", got, want)
+	}
+	if n := c.NumItems(); n != 10000 {
+		t.Errorf("NumItems = %d, want 10000", n)
+	}
+}
+
+func TestLockWaitStats(t *testing.T) {
+	c := New(1, 0)
+	c.Store([]byte("key"), []byte("value"), nil)
+	
+	shard := c.getShard([]byte("key"))
+	shard.lock()
+	done := make(chan struct{})
+	go func() {
+		c.Load([]byte("key"))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	shard.unlock()
+	<-done
+	
+	stats := c.ShardStats()
+	if stats[0].LockWaits != 1 || stats[0].LockWait < 5*time.Millisecond {
+		t.Errorf("LockWaits = %d, LockWait = %v, want 1 wait of at least 5ms", stats[0].LockWaits, stats[0].LockWait)
+	}
+	if got := c.Stats().LockWaits; got != 1 {
+		t.Errorf("num_lock_waits = %v, want 1", got)
+	}
+}
+
+// TestLoadDuringWrites runs lock-free Loads of keys that stay put while
+// other goroutines store and delete keys around them, which moves entries
+// between buckets and grows and shrinks the tables. Run it with -race.
+func TestLoadDuringWrites(t *testing.T) {
+	c := New(2, 0)
+	stable := make([][]byte, 64)
+	for i := range stable {
+		stable[i] = []byte(fmt.Sprintf("stable-%d", i))
+		c.Store(stable[i], []byte(fmt.Sprintf("value-%d", i)), nil)
+	}
+	
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	for w := range 2 {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := []byte(fmt.Sprintf("churn-%d-%d", w, i%2048))
+				if i/2048%2 == 0 {
+					c.Store(key, []byte("x"), nil)
+				} else {
+					c.Delete(key)
+				}
+			}
+		}()
+	}
+	
+	var readers sync.WaitGroup
+	for r := range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := range 20000 {
+				j := (i*7 + r) % len(stable)
+				entry, found := c.Load(stable[j])
+				if !found || string(entry.Value()) != fmt.Sprintf("value-%d", j) {
+					t.Errorf("Load(%s) = %v, %v during writes", stable[j], entry, found)
+					return
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	close(stop)
+	writers.Wait()
+}
+
+func TestMapCollect(t *testing.T) {
+	m := NewMap(16)
+	for i := 0; i < 11; i++ {
+		m.insert(&Entry{key: []byte(fmt.Sprintf("key-%d", i))})
+	}
+	
+	// Every batch size must visit each entry exactly once, including
+	// entries that wrapped around the end of the array.
+	for batch := uint64(1); batch <= 16; batch++ {
+		seen := make(map[string]int)
+		for from := uint64(0); from <= m.mask; from += batch {
+			for _, bucket := range m.collect(from, from+batch, nil) {
+				seen[string(bucket.entry.key)]++
+			}
+		}
+		if len(seen) != 11 {
+			t.Errorf("batch %d: visited %d entries, want 11", batch, len(seen))
+		}
+		for key, n := range seen {
+			if n != 1 {
+				t.Errorf("batch %d: visited %s %d times", batch, key, n)
+			}
+		}
+	}
+}
+
+func TestMapRandomEntries(t *testing.T) {
+	m := NewMap(16)
+	for i := 0; i < 100; i++ {
+		m.insert(&Entry{key: []byte(fmt.Sprintf("key-%d", i))})
+	}
+	m.get([]byte("key-0")).SetEvicted(true)
+	
+	// 20000 picks over 99 entries is about 202 each; a bias toward low
+	// buckets would starve the entries in the high ones.
+	picks := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		entries := m.randomEntries(2)
+		if len(entries) != 2 || entries[0] == entries[1] {
+			t.Fatalf("randomEntries(2) = %d entries, want 2 distinct", len(entries))
+		}
+		for _, entry := range entries {
+			picks[string(entry.key)]++
+		}
+	}
+	if picks["key-0"] != 0 {
+		t.Errorf("evicted entry picked %d times", picks["key-0"])
+	}
+	for i := 1; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if n := picks[key]; n < 100 || n > 320 {
+			t.Errorf("%s picked %d times, want about 202", key, n)
+		}
+	}
+	
+	if got := len(m.randomEntries(500)); got != 99 {
+		t.Errorf("randomEntries(500) = %d entries, want all 99", got)
+	}
+}
+
+func TestSample(t *testing.T) {
+	c := New(8, 0)
+	if got := c.Sample(10); len(got) != 0 {
+		t.Errorf("Sample of an empty cache = %d entries", len(got))
+	}
+	for i := 0; i < 1000; i++ {
+		c.Store([]byte(fmt.Sprintf("key-%d", i)), []byte("v"), nil)
+	}
+	
+	entries := c.Sample(50)
+	if len(entries) != 50 {
+		t.Fatalf("Sample(50) = %d entries", len(entries))
+	}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if seen[string(entry.Key())] {
+			t.Errorf("%s sampled twice", entry.Key())
+		}
+		seen[string(entry.Key())] = true
+	}
+	if got := len(c.Sample(5000)); got != 1000 {
+		t.Errorf("Sample(5000) = %d entries, want 1000", got)
+	}
+}
+
+func TestIterateSnapshot(t *testing.T) {
+	c := New(2, 0)
+	for i := 0; i < 2000; i++ {
+		c.Store([]byte(fmt.Sprintf("stable-%d", i)), []byte("v"), nil)
+	}
+	for i := 0; i < 500; i++ {
+		c.Store([]byte(fmt.Sprintf("doomed-%d", i)), []byte("v"), nil)
+	}
+	
+	// Writes between batches grow and shrink the tables under the
+	// iteration; keys present throughout must still come up once.
+	seen := make(map[string]int)
+	calls := 0
+	c.IterateSnapshot(func(e *Entry) bool {
+		seen[string(e.Key())]++
+		calls++
+		switch calls {
+		case 100:
+			for i := 0; i < 5000; i++ {
+				c.Store([]byte(fmt.Sprintf("new-%d", i)), []byte("v"), nil)
+			}
+		case 1500:
+			for i := 0; i < 5000; i++ {
+				c.Delete([]byte(fmt.Sprintf("new-%d", i)))
+			}
+			for i := 0; i < 500; i++ {
+				c.Delete([]byte(fmt.Sprintf("doomed-%d", i)))
+			}
+		}
+		return true
+	})
+	
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("stable-%d", i)
+		if seen[key] != 1 {
+			t.Errorf("%s visited %d times, want 1", key, seen[key])
+		}
+	}
+	for key, n := range seen {
+		if n > 1 {
+			t.Errorf("%s visited %d times", key, n)
+		}
+	}
+}
+
+func TestIterateParallel(t *testing.T) {
+	c := New(16, 0)
+	for i := 0; i < 5000; i++ {
+		c.Store([]byte(fmt.Sprintf("key-%d", i)), []byte("v"), nil)
+	}
+	
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	c.IterateParallel(func(e *Entry) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[string(e.Key())]++
+		return true
+	}, 4)
+	if len(seen) != 5000 {
+		t.Errorf("visited %d keys, want 5000", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("%s visited %d times, want 1", key, n)
+		}
+	}
+	
+	// Returning false stops every worker; calls already under way finish.
+	var calls atomic.Int64
+	c.IterateParallel(func(e *Entry) bool {
+		return calls.Add(1) < 10
+	}, 4)
+	if n := calls.Load(); n < 10 || n > 13 {
+		t.Errorf("fn called %d times after stopping at 10", n)
+	}
+}
+
+func TestDiskTier(t *testing.T) {
+	c := New(1, 4096)
+	path := filepath.Join(t.TempDir(), "tier")
+	if err := c.EnableDiskTier(path, 500, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseDiskTier()
+	
+	// Large values are spilled on eviction, small ones dropped.
+	for i := 0; i < 40; i++ {
+		value := bytes.Repeat([]byte{byte('a' + i%26)}, 1000)
+		c.Store([]byte(fmt.Sprintf("large-%d", i)), value, &StoreOptions{Flags: uint32(i)})
+		c.Store([]byte(fmt.Sprintf("small-%d", i)), []byte("x"), nil)
+	}
+	disk, ok := c.DiskTierStats()
+	if !ok || disk.Keys == 0 {
+		t.Fatalf("DiskTierStats() = %+v, %v, want spilled keys", disk, ok)
+	}
+	
+	for i := 0; i < 40; i++ {
+		entry, found := c.Load([]byte(fmt.Sprintf("large-%d", i)))
+		if !found {
+			t.Fatalf("large-%d lost", i)
+		}
+		if want := bytes.Repeat([]byte{byte('a' + i%26)}, 1000); !bytes.Equal(entry.Value(), want) || entry.Flags() != uint32(i) {
+			t.Fatalf("large-%d read back as %q with flags %d", i, entry.Value()[:10], entry.Flags())
+		}
+	}
+	if disk, _ := c.DiskTierStats(); disk.Restored == 0 {
+		t.Error("No keys read back from disk")
+	}
+	
+	// Writes and deletes replace what was spilled.
+	c.Store([]byte("large-0"), bytes.Repeat([]byte("z"), 1000), nil)
+	for i := 0; i < 40; i++ {
+		c.Load([]byte(fmt.Sprintf("large-%d", i)))
+	}
+	if entry, _ := c.Load([]byte("large-0")); entry == nil || entry.Value()[0] != 'z' {
+		t.Error("A stale spilled value replaced a newer write")
+	}
+	for i := 0; i < 40; i++ {
+		c.Delete([]byte(fmt.Sprintf("large-%d", i)))
+	}
+	for i := 0; i < 40; i++ {
+		if _, found := c.Load([]byte(fmt.Sprintf("large-%d", i))); found {
+			t.Fatalf("large-%d found after Delete", i)
+		}
+	}
+	if disk, _ := c.DiskTierStats(); disk.Keys != 0 || disk.Bytes != 0 {
+		t.Errorf("DiskTierStats() = %+v after deleting everything", disk)
+	}
+}
+
+func TestDiskTierCompaction(t *testing.T) {
+	c := New(1, 2048)
+	dir := t.TempDir()
+	if err := c.EnableDiskTier(filepath.Join(dir, "tier"), 1, 8192); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Reading keys back leaves garbage that compaction must reclaim.
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 10; i++ {
+			c.Store([]byte(fmt.Sprintf("key-%d", i)), make([]byte, 500), nil)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		c.Load([]byte(fmt.Sprintf("key-%d", i%10)))
+	}
+	
+	disk, _ := c.DiskTierStats()
+	if disk.FileBytes > 8192 {
+		t.Errorf("Disk tier file grew to %d bytes, over its 8192 byte limit", disk.FileBytes)
+	}
+	if disk.Compactions < 2 {
+		t.Errorf("Disk tier compacted %d times, want at least 2", disk.Compactions)
+	}
+	
+	// The file keeps its path through compactions, so closing removes it.
+	if err := c.CloseDiskTier(); err != nil {
+		t.Fatalf("CloseDiskTier: %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Files left after CloseDiskTier: %v", files)
+	}
+}
+
+func TestPinned(t *testing.T) {
+	c := New(1, 4096)
+	c.SetEvictionPolicy(EvictLRU)
+	
+	if err := c.Store([]byte("config"), make([]byte, 1000), &StoreOptions{Pinned: true}); err != nil {
+		t.Fatalf("Store pinned: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		c.Store([]byte(fmt.Sprintf("key-%d", i)), make([]byte, 100), nil)
+	}
+	entry, found := c.Load([]byte("config"))
+	if !found || !entry.Pinned() {
+		t.Fatal("A pinned entry was evicted")
+	}
+	if got := c.PinnedBytes(); got != entry.Size() {
+		t.Errorf("PinnedBytes() = %d, want %d", got, entry.Size())
+	}
+	
+	// The default limit is half the memory limit.
+	if err := c.Store([]byte("big"), make([]byte, 1100), &StoreOptions{Pinned: true}); !errors.Is(err, ErrPinnedLimit) {
+		t.Errorf("Store over the pinned limit = %v, want ErrPinnedLimit", err)
+	}
+	// Replacing a pinned entry frees its share first.
+	if err := c.Store([]byte("config"), make([]byte, 2000), &StoreOptions{Pinned: true}); err != nil {
+		t.Errorf("Store replacing the pinned entry: %v", err)
+	}
+	
+	c.Store([]byte("config"), []byte("unpinned"), nil)
+	if entry, _ := c.Load([]byte("config")); entry.Pinned() || c.PinnedBytes() != 0 {
+		t.Errorf("Overwriting left the entry pinned, %d bytes pinned", c.PinnedBytes())
+	}
+	
+	c.SetMaxPinned(-1)
+	if err := c.Store([]byte("config"), []byte("v"), &StoreOptions{Pinned: true}); !errors.Is(err, ErrPinnedLimit) {
+		t.Errorf("Store pinned with pinning off = %v, want ErrPinnedLimit", err)
+	}
+}
+
+func TestSlidingTTL(t *testing.T) {
+	c := New(1, 0)
+	c.SetSlidingPrefixes([]string{"session:"})
+	
+	c.Store([]byte("sliding"), []byte("v"), &StoreOptions{TTL: 100 * time.Millisecond, Sliding: true})
+	c.Store([]byte("session:1"), []byte("v"), &StoreOptions{TTL: 100 * time.Millisecond})
+	c.Store([]byte("fixed"), []byte("v"), &StoreOptions{TTL: 100 * time.Millisecond})
+	
+	// Reads every 40ms keep the sliding keys alive well past their TTL.
+	for i := 0; i < 5; i++ {
+		time.Sleep(40 * time.Millisecond)
+		for _, key := range []string{"sliding", "session:1"} {
+			if _, found := c.Load([]byte(key)); !found {
+				t.Fatalf("%s expired after %d reads", key, i)
+			}
+		}
+		c.Sweep()
+	}
+	if _, found := c.Load([]byte("fixed")); found {
+		t.Error("A fixed TTL was extended by reads")
+	}
+	
+	// LoadNoTouch does not count as a read.
+	time.Sleep(60 * time.Millisecond)
+	c.LoadNoTouch([]byte("sliding"))
+	time.Sleep(60 * time.Millisecond)
+	if _, found := c.Peek([]byte("sliding")); found {
+		t.Error("LoadNoTouch extended a sliding TTL")
+	}
+	
+	// The sweeper follows a TTL that slid past its index entry.
+	if c.Sweep() == 0 {
+		t.Error("Sweep did not remove the sliding keys once unread")
+	}
+	if c.NumItems() != 0 {
+		t.Errorf("NumItems() = %d after the sliding keys expired", c.NumItems())
+	}
+}
+
+func TestLoadManyStoreMany(t *testing.T) {
+	c := New(8, 0)
+	var keys, values [][]byte
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+		values = append(values, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	if err := c.StoreMany(keys, values, &StoreOptions{TTL: time.Hour}); err != nil {
+		t.Fatalf("StoreMany: %v", err)
+	}
+	c.Store([]byte("expired"), []byte("v"), &StoreOptions{TTL: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+	
+	lookups := append(slices.Clone(keys), []byte("missing"), []byte("expired"))
+	entries := c.LoadMany(lookups)
+	for i := range keys {
+		if entries[i] == nil || !bytes.Equal(entries[i].Value(), values[i]) || entries[i].ExpireAt() == 0 {
+			t.Fatalf("LoadMany entry %d = %v", i, entries[i])
+		}
+	}
+	if entries[100] != nil || entries[101] != nil {
+		t.Error("LoadMany found a missing or expired key")
+	}
+	stats := c.Stats()
+	if stats.Hits != 100 || stats.Misses != 2 {
+		t.Errorf("hits = %v, misses = %v, want 100 and 2", stats.Hits, stats.Misses)
+	}
+	
+	c.SetSizeLimits(0, 7)
+	if err := c.StoreMany([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("too long")}, nil); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("StoreMany with a long value = %v, want ErrValueTooLarge", err)
+	}
+	if _, found := c.Load([]byte("a")); found {
+		t.Error("A rejected StoreMany was partly applied")
+	}
+}
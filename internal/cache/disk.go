@@ -0,0 +1,355 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// diskHeaderSize is the size of the header before the key and value of a
+// record in the disk tier: key and value lengths, expiry, flags and CAS.
+const diskHeaderSize = 4 + 4 + 8 + 4 + 8
+
+// diskRecord locates a spilled entry in the disk tier's file and keeps
+// its metadata, so that only the value has to be read back.
+type diskRecord struct {
+	offset   int64
+	valueLen int
+	expireAt int64
+	flags    uint32
+	cas      uint64
+	slide    int64
+}
+
+// diskTier holds entries evicted from memory in an append-only file,
+// indexed in memory by key. Records of keys that were read back, deleted
+// or overwritten become garbage, which is compacted away when the file
+// reaches its size limit. The file is scratch space: it is truncated when
+// the tier is opened and removed when it is closed.
+//
+// A single mutex guards the whole tier. Every miss in memory takes it to
+// look the key up, and so do operations that fault a key in before
+// changing it. Spilling takes it under the evicting shard's lock, and a
+// compaction, which copies every live record, runs there too: while it
+// does, that shard and misses on every other shard wait for it.
+type diskTier struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	index    map[string]diskRecord
+	size     int64
+	live     int64
+	minValue int
+	maxBytes int64
+
+	numSpilled   atomic.Uint64
+	numRestored  atomic.Uint64
+	numRejected  atomic.Uint64
+	numCompacted atomic.Uint64
+}
+
+// DiskTierStats describes the disk tier.
+type DiskTierStats struct {
+	Keys int `json:"keys"`
+	// Bytes is the size of the live records and FileBytes that of the
+	// file, garbage included.
+	Bytes     int64 `json:"bytes"`
+	FileBytes int64 `json:"file_bytes"`
+	// Spilled counts the entries written to disk instead of being
+	// dropped, Restored those read back into memory, and Rejected those
+	// dropped because the tier was full.
+	Spilled     uint64 `json:"spilled"`
+	Restored    uint64 `json:"restored"`
+	Rejected    uint64 `json:"rejected"`
+	Compactions uint64 `json:"compactions"`
+}
+
+// EnableDiskTier adds a second tier on local disk, in a file at path.
+// Entries evicted from memory whose value is at least minValue bytes are
+// written to it instead of being dropped, and read back into memory, as
+// if they had never left, the next time they are accessed. The file is
+// held under maxBytes (0 means no limit) by compacting it, and entries
+// that do not fit are dropped. Spilled keys are not counted by NumItems
+// or visited by Iterate until they are read back. Call it before the
+// cache is in use.
+func (c *Cache) EnableDiskTier(path string, minValue int, maxBytes int64) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	c.disk = &diskTier{
+		path:     path,
+		file:     file,
+		index:    make(map[string]diskRecord),
+		minValue: max(minValue, 1),
+		maxBytes: maxBytes,
+	}
+	return nil
+}
+
+// CloseDiskTier removes the disk tier's file. Spilled entries are lost.
+func (c *Cache) CloseDiskTier() error {
+	d := c.disk
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.index = make(map[string]diskRecord)
+	d.file.Close()
+	return os.Remove(d.path)
+}
+
+// DiskTierStats reports on the disk tier, and false if there is none.
+func (c *Cache) DiskTierStats() (DiskTierStats, bool) {
+	d := c.disk
+	if d == nil {
+		return DiskTierStats{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return DiskTierStats{
+		Keys:        len(d.index),
+		Bytes:       d.live,
+		FileBytes:   d.size,
+		Spilled:     d.numSpilled.Load(),
+		Restored:    d.numRestored.Load(),
+		Rejected:    d.numRejected.Load(),
+		Compactions: d.numCompacted.Load(),
+	}, true
+}
+
+// recordSize returns the size of the record of an entry on disk.
+func recordSize(keyLen, valueLen int) int64 {
+	return int64(diskHeaderSize + keyLen + valueLen)
+}
+
+// spill writes an entry being evicted to disk, if it is large enough and
+// fits. The caller holds the entry's shard lock.
+func (d *diskTier) spill(entry *Entry) {
+	if len(entry.value) < d.minValue || entry.IsExpired() {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	size := recordSize(len(entry.key), len(entry.value))
+	if d.maxBytes > 0 && d.size+size > d.maxBytes {
+		if d.live+size > d.maxBytes || d.compact() != nil {
+			d.numRejected.Add(1)
+			return
+		}
+	}
+
+	record := diskRecord{
+		offset:   d.size,
+		valueLen: len(entry.value),
+		expireAt: entry.ExpireAt(),
+		flags:    entry.Flags(),
+		cas:      entry.CAS(),
+		slide:    entry.SlidingTTL().Nanoseconds(),
+	}
+	if _, err := d.file.WriteAt(encodeRecord(entry.key, entry.value, record), d.size); err != nil {
+		d.numRejected.Add(1)
+		return
+	}
+	d.forgetLocked(entry.key)
+	d.index[string(entry.key)] = record
+	d.size += size
+	d.live += size
+	d.numSpilled.Add(1)
+}
+
+func encodeRecord(key, value []byte, r diskRecord) []byte {
+	buf := make([]byte, diskHeaderSize, recordSize(len(key), len(value)))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(value)))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(r.expireAt))
+	binary.LittleEndian.PutUint32(buf[16:], r.flags)
+	binary.LittleEndian.PutUint64(buf[20:], r.cas)
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+// has reports whether key is on disk.
+func (d *diskTier) has(key []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.index[string(key)]
+	return ok
+}
+
+// take removes key from the disk tier and returns it as a new entry, or
+// nil if it is not there or has expired.
+func (d *diskTier) take(key []byte) *Entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	record, ok := d.index[string(key)]
+	if !ok {
+		return nil
+	}
+	d.forgetLocked(key)
+	if record.expireAt > 0 && record.expireAt < time.Now().UnixNano() {
+		return nil
+	}
+
+	value := make([]byte, record.valueLen)
+	if _, err := d.file.ReadAt(value, record.offset+diskHeaderSize+int64(len(key))); err != nil {
+		return nil
+	}
+	d.numRestored.Add(1)
+	return &Entry{
+		key:      bytes.Clone(key),
+		value:    value,
+		expireAt: record.expireAt,
+		flags:    record.flags,
+		cas:      record.cas,
+		slide:    record.slide,
+	}
+}
+
+// forget drops key from the disk tier, reporting whether it was there.
+func (d *diskTier) forget(key []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.forgetLocked(key)
+}
+
+func (d *diskTier) forgetLocked(key []byte) bool {
+	record, ok := d.index[string(key)]
+	if ok {
+		delete(d.index, string(key))
+		d.live -= recordSize(len(key), record.valueLen)
+	}
+	return ok
+}
+
+// forgetPrefix drops every key starting with prefix.
+func (d *diskTier) forgetPrefix(prefix []byte) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for key := range d.index {
+		if bytes.HasPrefix([]byte(key), prefix) && d.forgetLocked([]byte(key)) {
+			n++
+		}
+	}
+	return n
+}
+
+// clear drops every key and truncates the file.
+func (d *diskTier) clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.index = make(map[string]diskRecord)
+	d.size, d.live = 0, 0
+	d.file.Truncate(0)
+}
+
+var errCompactTooLarge = errors.New("disk tier: live records exceed the size limit")
+
+// compact rewrites the file with only the live, unexpired records. The
+// caller holds d.mu.
+func (d *diskTier) compact() error {
+	if d.live > d.maxBytes {
+		return errCompactTooLarge
+	}
+
+	tmp, err := os.OpenFile(d.path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	index := make(map[string]diskRecord, len(d.index))
+	var offset int64
+	for key, record := range d.index {
+		if record.expireAt > 0 && record.expireAt < now {
+			continue
+		}
+		size := recordSize(len(key), record.valueLen)
+		buf := make([]byte, size)
+		if _, err := d.file.ReadAt(buf, record.offset); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		if _, err := tmp.WriteAt(buf, offset); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		record.offset = offset
+		index[key] = record
+		offset += size
+	}
+
+	if err := os.Rename(tmp.Name(), d.path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	d.file.Close()
+	d.file = tmp
+	d.index = index
+	d.size, d.live = offset, offset
+	d.numCompacted.Add(1)
+	return nil
+}
+
+// restore reads key back from the disk tier into memory, if it was
+// spilled, and returns the entry. Restoring is not a write: no hooks run
+// and the entry keeps its CAS.
+func (c *Cache) restore(key []byte) (*Entry, bool) {
+	if c.disk == nil {
+		return nil, false
+	}
+	entry := c.disk.take(key)
+	if entry == nil {
+		return nil, false
+	}
+
+	shard := c.lockShard(key)
+	defer shard.unlock()
+
+	// A write since the take above wins over the spilled value.
+	if existing := shard.m.get(key); liveEntry(existing) {
+		return existing, true
+	}
+
+	shard.trackAccess(entry)
+	shard.assignCAS(entry)
+	c.evictIfNeeded(shard, entry.Size())
+	if old := shard.m.insert(entry); old != nil && !old.IsEvicted() {
+		shard.addMemUsed(-old.Size())
+	}
+	shard.addMemUsed(entry.Size())
+	shard.indexExpiry(entry.key, entry.expireAt)
+	return entry, true
+}
+
+// faultIn reads key back from the disk tier before an operation that
+// works on its current value.
+func (c *Cache) faultIn(key []byte) {
+	if c.disk != nil && c.disk.has(key) {
+		c.restore(key)
+	}
+}
+
+// forgetSpilled drops key from the disk tier before it is overwritten or
+// deleted in memory, reporting whether it was there.
+func (c *Cache) forgetSpilled(key []byte) bool {
+	return c.disk != nil && c.disk.forget(key)
+}
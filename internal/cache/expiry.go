@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+)
+
+// expiryItem records that key was given a TTL ending at expireAt. Items
+// are not removed when the key is deleted, overwritten or given another
+// TTL; such stale items are recognized and dropped when they come due.
+type expiryItem struct {
+	expireAt int64
+	key      []byte
+}
+
+// expiryIndex is a min-heap of expiration times, so the sweeper only
+// visits the entries that are due.
+type expiryIndex []expiryItem
+
+func (x expiryIndex) Len() int           { return len(x) }
+func (x expiryIndex) Less(i, j int) bool { return x[i].expireAt < x[j].expireAt }
+func (x expiryIndex) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x *expiryIndex) Push(v any)        { *x = append(*x, v.(expiryItem)) }
+
+func (x *expiryIndex) Pop() any {
+	old := *x
+	item := old[len(old)-1]
+	*x = old[:len(old)-1]
+	return item
+}
+
+// ExpiryStats summarizes the keys that have a TTL.
+type ExpiryStats struct {
+	// Volatile is the number of live keys with a TTL.
+	Volatile int `json:"volatile"`
+	// Soonest is the earliest expiration time in Unix nanoseconds, or 0
+	// if no key has a TTL.
+	Soonest int64 `json:"soonest"`
+	// NextMinute is the number of keys that expire within a minute.
+	NextMinute int `json:"next_minute"`
+	// AvgTTL is the mean time left to live of the keys with a TTL.
+	AvgTTL time.Duration `json:"avg_ttl"`
+}
+
+// indexExpiry records a TTL set on key. The caller holds the shard lock.
+func (s *Shard) indexExpiry(key []byte, expireAt int64) {
+	if expireAt > 0 {
+		heap.Push(&s.expiries, expiryItem{expireAt: expireAt, key: key})
+	}
+}
+
+// current reports whether item still describes the TTL of a live entry.
+// The caller holds the shard lock.
+func (s *Shard) current(item expiryItem) (*Entry, bool) {
+	entry := s.m.get(item.key)
+	if entry == nil || entry.IsEvicted() || entry.ExpireAt() != item.expireAt {
+		return nil, false
+	}
+	return entry, true
+}
+
+// sweepExpired deletes the entries whose TTL has passed, in O(expired)
+// plus the stale items it drops along the way. The caller holds the
+// shard lock.
+func (s *Shard) sweepExpired(now int64) int {
+	expired := 0
+	
+	for len(s.expiries) > 0 && s.expiries[0].expireAt < now {
+		item := heap.Pop(&s.expiries).(expiryItem)
+		if _, ok := s.current(item); !ok {
+			// A sliding TTL moved on without the index; follow it.
+			if entry := s.m.get(item.key); entry != nil && !entry.IsEvicted() &&
+				entry.SlidingTTL() > 0 && entry.ExpireAt() > item.expireAt {
+				s.indexExpiry(entry.key, entry.ExpireAt())
+			}
+			continue
+		}
+		
+		if entry := s.m.delete(item.key, hashKey(item.key)); entry != nil {
+			s.addMemUsed(-entry.Size())
+			expired++
+			atomic.AddUint64(&s.numExpired, 1)
+			s.hooks.expire(item.key)
+		}
+	}
+	
+	// Keys that are rewritten with a new TTL leave stale items behind
+	// until their old TTL passes. Rebuild the index if they dominate.
+	if len(s.expiries) > 2*s.m.numItems+64 {
+		s.rebuildExpiries()
+	}
+	
+	return expired
+}
+
+// rebuildExpiries recreates the index from the entries in the map. The
+// caller holds the shard lock.
+func (s *Shard) rebuildExpiries() {
+	s.expiries = s.expiries[:0]
+	s.m.iter(func(e *Entry) bool {
+		if expireAt := e.ExpireAt(); expireAt > 0 && !e.IsEvicted() {
+			s.expiries = append(s.expiries, expiryItem{expireAt: expireAt, key: e.key})
+		}
+		return true
+	})
+	heap.Init(&s.expiries)
+}
+
+// Expire sets the expiration time of a live key, in Unix nanoseconds; 0
+// removes any TTL. A sliding TTL becomes the time until the new
+// expiration. It reports whether the key exists.
+func (c *Cache) Expire(key []byte, expireAt int64) bool {
+	c.faultIn(key)
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	atomic.AddUint64(&shard.numOps, 1)
+	
+	entry := shard.m.get(key)
+	if !liveEntry(entry) {
+		return false
+	}
+	
+	entry.SetExpireAt(expireAt)
+	if expireAt == 0 {
+		atomic.StoreInt64(&entry.slide, 0)
+	} else if entry.SlidingTTL() > 0 {
+		atomic.StoreInt64(&entry.slide, max(expireAt-time.Now().UnixNano(), 1))
+	}
+	shard.indexExpiry(entry.key, expireAt)
+	
+	return true
+}
+
+// ExpiryStats counts the keys with a TTL and finds the soonest to expire.
+func (c *Cache) ExpiryStats() ExpiryStats {
+	var stats ExpiryStats
+	var ttls int64
+	now := time.Now().UnixNano()
+	nextMinute := now + int64(time.Minute)
+	
+	for shard := range c.allShards() {
+		shard.mu.RLock()
+		
+		for _, item := range shard.expiries {
+			if item.expireAt < now {
+				continue
+			}
+			if _, ok := shard.current(item); !ok {
+				continue
+			}
+			
+			stats.Volatile++
+			ttls += item.expireAt - now
+			if item.expireAt <= nextMinute {
+				stats.NextMinute++
+			}
+			if stats.Soonest == 0 || item.expireAt < stats.Soonest {
+				stats.Soonest = item.expireAt
+			}
+		}
+		
+		shard.mu.RUnlock()
+	}
+	if stats.Volatile > 0 {
+		stats.AvgTTL = time.Duration(ttls / int64(stats.Volatile))
+	}
+	
+	return stats
+}
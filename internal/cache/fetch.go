@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// LoadOrStore returns the live entry for key if there is one, and
+// otherwise stores value and returns the new entry. loaded reports whether
+// the entry already existed. The check and the store happen under the
+// shard lock, so concurrent callers all end up with the same entry.
+func (c *Cache) LoadOrStore(key, value []byte, opts *StoreOptions) (entry *Entry, loaded bool) {
+	if entry, found := c.Load(key); found {
+		return entry, true
+	}
+	
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	// Another caller may have stored the key since the Load above.
+	if existing := shard.m.get(key); liveEntry(existing) {
+		return existing, true
+	}
+	
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
+	atomic.AddUint64(&shard.numOps, 1)
+	
+	entry = c.newEntry(key, value, opts)
+	shard.trackAccess(entry)
+	c.replaceLocked(shard, entry)
+	
+	return entry, false
+}
+
+// flight is a load in progress, which callers missing the same key wait
+// on instead of starting their own.
+type flight struct {
+	done  chan struct{}
+	entry *Entry
+	err   error
+}
+
+var errLoadPanicked = errors.New("cache: loader panicked")
+
+// Fetch returns the live entry for key, or calls load and stores what it
+// returns. Concurrent misses on the same key are coalesced: one caller
+// runs load, outside any lock, and the others wait for its result, so a
+// popular key that expires costs a single load rather than a stampede.
+// loaded reports whether this caller did not run load itself. If load
+// fails or returns a value over the size limit, nothing is stored and
+// every waiting caller gets the error. Unlike
+// Store, Fetch copies key before keeping it.
+func (c *Cache) Fetch(key []byte, opts *StoreOptions, load func() ([]byte, error)) (entry *Entry, loaded bool, err error) {
+	if entry, found := c.Load(key); found {
+		return entry, true, nil
+	}
+	
+	shard := c.getShard(key)
+	
+	shard.flightMu.Lock()
+	if f, ok := shard.flights[string(key)]; ok {
+		shard.flightMu.Unlock()
+		atomic.AddUint64(&shard.numCoalesced, 1)
+		<-f.done
+		return f.entry, true, f.err
+	}
+	f := &flight{done: make(chan struct{}), err: errLoadPanicked}
+	if shard.flights == nil {
+		shard.flights = make(map[string]*flight)
+	}
+	shard.flights[string(key)] = f
+	shard.flightMu.Unlock()
+	
+	defer func() {
+		shard.flightMu.Lock()
+		delete(shard.flights, string(key))
+		shard.flightMu.Unlock()
+		close(f.done)
+	}()
+	
+	atomic.AddUint64(&shard.numFetches, 1)
+	value, err := load()
+	if err == nil {
+		err = c.CheckSize(len(key), len(value))
+	}
+	if err != nil {
+		f.err = err
+		return nil, false, err
+	}
+	
+	// A write that landed while loading takes precedence.
+	f.entry, loaded = c.LoadOrStore(bytes.Clone(key), value, opts)
+	f.err = nil
+	return f.entry, loaded, nil
+}
+
+// Swap stores value under key and returns a copy of the live entry it
+// replaced, if there was one, as a single atomic step.
+func (c *Cache) Swap(key, value []byte, opts *StoreOptions) (*Entry, bool) {
+	c.faultIn(key)
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
+	
+	atomic.AddUint64(&shard.numOps, 1)
+	
+	var old *Entry
+	if existing := shard.m.get(key); liveEntry(existing) {
+		copied := *existing
+		old = &copied
+	}
+	
+	entry := c.newEntry(key, value, opts)
+	shard.trackAccess(entry)
+	c.replaceLocked(shard, entry)
+	
+	return old, old != nil
+}
+
+func newEntry(key, value []byte, opts *StoreOptions) *Entry {
+	entry := &Entry{
+		key:   key,
+		value: value,
+	}
+	
+	if opts != nil {
+		if opts.TTL > 0 {
+			entry.expireAt = time.Now().Add(opts.TTL).UnixNano()
+		}
+		if opts.SoftTTL > 0 {
+			entry.softExpire = time.Now().Add(opts.SoftTTL).UnixNano()
+		}
+		entry.flags = opts.Flags
+		entry.cas = opts.CAS
+	}
+	
+	return entry
+}
+
+// replaceLocked inserts entry, first removing an evicted or expired entry
+// with the same key so that the new one does not inherit its state. The
+// caller holds the shard lock.
+func (c *Cache) replaceLocked(shard *Shard, entry *Entry) {
+	if existing := shard.m.get(entry.key); existing != nil && !liveEntry(existing) {
+		shard.m.delete(entry.key, hashKey(entry.key))
+		if !existing.IsEvicted() {
+			shard.addMemUsed(-existing.Size())
+			atomic.AddUint64(&shard.numExpired, 1)
+			shard.hooks.expire(existing.key)
+		}
+	}
+	
+	c.insertLocked(shard, entry)
+}
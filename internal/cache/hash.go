@@ -1,6 +1,11 @@
 package cache
 
 import (
+	"bytes"
+	"math/rand"
+	"slices"
+	"sync/atomic"
+	
 	"github.com/cespare/xxhash/v2"
 )
 
@@ -12,39 +17,49 @@ func (m *Map) resize(newSize int) {
 	oldBuckets := m.buckets
 	
 	m.buckets = make([]Bucket, newSize)
+	buckets := m.buckets
+	m.view.Store(&buckets)
 	m.mask = uint64(newSize - 1)
 	m.growAt = int(float64(newSize) * 0.75)
 	m.shrinkAt = int(float64(newSize) * 0.10)
 	m.numItems = 0
 	
 	for i := range oldBuckets {
-		if oldBuckets[i].entry != nil {
-			m.insertInternal(oldBuckets[i].entry, oldBuckets[i].hash)
+		if entry := oldBuckets[i].entry.Load(); entry != nil {
+			m.insertInternal(entry, oldBuckets[i].hash.Load())
 		}
 	}
 }
 
+// compact shrinks the bucket array to the smallest power of two that
+// holds the current items below the grow threshold.
+func (m *Map) compact() {
+	size := 16
+	for int(float64(size)*0.75) <= m.numItems {
+		size *= 2
+	}
+	if size < len(m.buckets) {
+		m.resize(size)
+	}
+}
+
 func (m *Map) insertInternal(entry *Entry, hash uint64) {
 	idx := hash & m.mask
-	distance := uint16(0)
+	distance := uint32(0)
 	
 	for {
-		if m.buckets[idx].entry == nil {
-			m.buckets[idx] = Bucket{
-				entry:    entry,
-				hash:     hash,
-				distance: distance,
-			}
+		bucket := &m.buckets[idx]
+		current := bucket.entry.Load()
+		if current == nil {
+			bucket.set(entry, hash, distance)
 			m.numItems++
 			return
 		}
 		
-		if m.buckets[idx].distance < distance {
-			m.buckets[idx], entry, hash, distance = Bucket{
-				entry:    entry,
-				hash:     hash,
-				distance: distance,
-			}, m.buckets[idx].entry, m.buckets[idx].hash, m.buckets[idx].distance
+		if currentDistance := bucket.distance.Load(); currentDistance < distance {
+			currentHash := bucket.hash.Load()
+			bucket.set(entry, hash, distance)
+			entry, hash, distance = current, currentHash, currentDistance
 		}
 		
 		idx = (idx + 1) & m.mask
@@ -54,25 +69,17 @@ func (m *Map) insertInternal(entry *Entry, hash uint64) {
 
 func (m *Map) lookup(key []byte, hash uint64) (*Entry, int) {
 	idx := int(hash & m.mask)
-	distance := uint16(0)
+	distance := uint32(0)
 	
 	for {
-		if m.buckets[idx].entry == nil || m.buckets[idx].distance < distance {
+		bucket := &m.buckets[idx]
+		entry := bucket.entry.Load()
+		if entry == nil || bucket.distance.Load() < distance {
 			return nil, -1
 		}
 		
-		if m.buckets[idx].hash == hash && 
-		   len(m.buckets[idx].entry.key) == len(key) {
-			match := true
-			for i := range key {
-				if key[i] != m.buckets[idx].entry.key[i] {
-					match = false
-					break
-				}
-			}
-			if match {
-				return m.buckets[idx].entry, idx
-			}
+		if bucket.hash.Load() == hash && bytes.Equal(entry.key, key) {
+			return entry, idx
 		}
 		
 		idx = int((uint64(idx) + 1) & m.mask)
@@ -80,20 +87,83 @@ func (m *Map) lookup(key []byte, hash uint64) (*Entry, int) {
 	}
 }
 
+// lookupConcurrent is lookup for readers that do not hold the shard
+// lock. A writer may be moving buckets while it probes, so the caller
+// must check the shard's seq before trusting the result. The bucket
+// fields are atomic, so the probe itself is race-free; it stays within
+// the published bucket array and gives up after one pass over it. Keys
+// never change once an entry is stored, so comparing them needs no lock.
+func (m *Map) lookupConcurrent(key []byte, hash uint64) *Entry {
+	buckets := *m.view.Load()
+	mask := uint64(len(buckets) - 1)
+	idx := hash & mask
+	
+	for distance := 0; distance < len(buckets); distance++ {
+		bucket := &buckets[idx]
+		entry := bucket.entry.Load()
+		if entry == nil || int(bucket.distance.Load()) < distance {
+			return nil
+		}
+		if bucket.hash.Load() == hash && bytes.Equal(entry.key, key) {
+			return entry
+		}
+		idx = (idx + 1) & mask
+	}
+	
+	return nil
+}
+
+// collect appends the buckets of the entries whose home bucket is in
+// [from, to). Robin Hood probing leaves no empty bucket between an
+// entry's home and where it sits, so they all lie between from and the
+// first empty bucket at or after to, which may wrap past the end of the
+// array. The order of entries within a cluster does not matter.
+func (m *Map) collect(from, to uint64, out []bucketCopy) []bucketCopy {
+	size := uint64(len(m.buckets))
+	to = min(to, size)
+	
+	for pos := from; pos < to+size; pos++ {
+		bucket := &m.buckets[pos&m.mask]
+		entry := bucket.entry.Load()
+		if entry == nil {
+			if pos >= to {
+				break
+			}
+			continue
+		}
+		
+		// Positions past the end of the array are kept unwrapped, so an
+		// entry that wrapped around has its home at the end.
+		distance := uint64(bucket.distance.Load())
+		if pos >= distance && pos-distance >= from && pos-distance < to {
+			out = append(out, bucketCopy{entry: entry, hash: bucket.hash.Load()})
+		}
+	}
+	
+	return out
+}
+
 func (m *Map) delete(key []byte, hash uint64) *Entry {
 	entry, idx := m.lookup(key, hash)
 	if entry == nil {
 		return nil
 	}
 	
-	m.buckets[idx].entry = nil
+	m.buckets[idx].entry.Store(nil)
 	m.numItems--
+	if entry.pinned {
+		m.pinnedBytes -= entry.Size()
+	}
 	
 	nextIdx := int((uint64(idx) + 1) & m.mask)
-	for m.buckets[nextIdx].entry != nil && m.buckets[nextIdx].distance > 0 {
-		m.buckets[idx] = m.buckets[nextIdx]
-		m.buckets[idx].distance--
-		m.buckets[nextIdx].entry = nil
+	for {
+		next := &m.buckets[nextIdx]
+		moved := next.entry.Load()
+		if moved == nil || next.distance.Load() == 0 {
+			break
+		}
+		m.buckets[idx].set(moved, next.hash.Load(), next.distance.Load()-1)
+		next.entry.Store(nil)
 		
 		idx = nextIdx
 		nextIdx = int((uint64(idx) + 1) & m.mask)
@@ -111,10 +181,21 @@ func (m *Map) insert(entry *Entry) *Entry {
 	
 	if existing, _ := m.lookup(entry.key, hash); existing != nil {
 		oldEntry := *existing
+		if existing.pinned {
+			m.pinnedBytes -= existing.Size()
+		}
 		existing.value = entry.value
 		existing.expireAt = entry.expireAt
+		existing.softExpire = entry.softExpire
 		existing.flags = entry.flags
-		existing.IncrementCAS()
+		atomic.StoreInt64(&existing.slide, entry.slide)
+		existing.pinned = entry.pinned
+		existing.evicted = false
+		atomic.StoreUint64(&existing.cas, entry.cas)
+		existing.touch()
+		if existing.pinned {
+			m.pinnedBytes += existing.Size()
+		}
 		return &oldEntry
 	}
 	
@@ -123,6 +204,9 @@ func (m *Map) insert(entry *Entry) *Entry {
 	}
 	
 	m.insertInternal(entry, hash)
+	if entry.pinned {
+		m.pinnedBytes += entry.Size()
+	}
 	return nil
 }
 
@@ -132,43 +216,62 @@ func (m *Map) get(key []byte) *Entry {
 	return entry
 }
 
+// randomProbes is how many buckets randomEntries probes per entry wanted
+// before falling back to a pass over the whole table.
+const randomProbes = 32
+
+// randomEntries returns up to n distinct entries that are not evicted,
+// chosen uniformly at random: every such entry is equally likely to be
+// picked, wherever its bucket is. It probes random buckets, which is
+// uniform because each entry has one bucket, and falls back to reservoir
+// sampling over the table when they are too sparse.
 func (m *Map) randomEntries(n int) []*Entry {
 	if n <= 0 || m.numItems == 0 {
 		return nil
 	}
-	
-	entries := make([]*Entry, 0, n)
-	
-	// Simple case: return all entries if we have fewer items than requested
 	if n >= m.numItems {
+		entries := make([]*Entry, 0, m.numItems)
 		for i := range m.buckets {
-			if m.buckets[i].entry != nil {
-				entries = append(entries, m.buckets[i].entry)
+			if entry := m.buckets[i].entry.Load(); entry != nil && !entry.IsEvicted() {
+				entries = append(entries, entry)
 			}
 		}
 		return entries
 	}
 	
-	// Sampling case: select every nth item approximately
-	step := (m.numItems / n) + 1
-	seen := 0
-	
-	for i := 0; i < len(m.buckets) && len(entries) < n; i++ {
-		if m.buckets[i].entry != nil {
-			if seen%step == 0 {
-				entries = append(entries, m.buckets[i].entry)
-			}
-			seen++
+	entries := make([]*Entry, 0, n)
+	for probes := 0; probes < randomProbes*n && len(entries) < n; probes++ {
+		entry := m.buckets[rand.Intn(len(m.buckets))].entry.Load()
+		if entry != nil && !entry.IsEvicted() && !slices.Contains(entries, entry) {
+			entries = append(entries, entry)
 		}
 	}
+	if len(entries) == n {
+		return entries
+	}
 	
+	// Mostly empty or evicted buckets: Algorithm R over every entry.
+	entries = entries[:0]
+	seen := 0
+	for i := range m.buckets {
+		entry := m.buckets[i].entry.Load()
+		if entry == nil || entry.IsEvicted() {
+			continue
+		}
+		if seen < n {
+			entries = append(entries, entry)
+		} else if r := rand.Intn(seen + 1); r < n {
+			entries[r] = entry
+		}
+		seen++
+	}
 	return entries
 }
 
 func (m *Map) iter(fn func(*Entry) bool) {
 	for i := range m.buckets {
-		if m.buckets[i].entry != nil {
-			if !fn(m.buckets[i].entry) {
+		if entry := m.buckets[i].entry.Load(); entry != nil {
+			if !fn(entry) {
 				return
 			}
 		}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Hooks are callbacks for changes to the cache, for keyspace
+// notifications, metrics, replication or invalidation fan-out. Any field
+// may be nil.
+//
+// Hooks run synchronously on the goroutine making the change, most of
+// them while the key's shard is locked, so they must be quick and must
+// not call back into the Cache; hand work off to a channel or goroutine
+// instead. Keys and entries belong to the cache and must not be modified
+// or retained past the call. Clear and Namespace.Clear do not report the
+// keys they remove.
+type Hooks struct {
+	// OnStore is called with the new entry whenever a key is written,
+	// including by CompareAndSwap, Increment, Rename and Copy.
+	OnStore func(entry *Entry)
+	// OnDelete is called when a live key is deleted or renamed away.
+	OnDelete func(key []byte)
+	// OnEvict is called when an entry is evicted to make room.
+	OnEvict func(entry *Entry)
+	// OnExpire is called when an expired entry is removed, whether by the
+	// sweeper or lazily when it is accessed.
+	OnExpire func(key []byte)
+	// OnHit and OnMiss are called by Load, outside the shard lock.
+	OnHit  func(entry *Entry)
+	OnMiss func(key []byte)
+}
+
+// hookRegistry is shared by a cache and its shards. Registration copies
+// the list so the hot paths only pay for an atomic load.
+type hookRegistry struct {
+	mu    sync.Mutex
+	hooks atomic.Pointer[[]*Hooks]
+}
+
+// AddHooks registers hooks and returns a function that unregisters them.
+func (c *Cache) AddHooks(hooks *Hooks) (remove func()) {
+	r := c.hooks
+	
+	r.mu.Lock()
+	r.hooks.Store(ptr(append(slices.Clone(r.list()), hooks)))
+	r.mu.Unlock()
+	
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		
+		list := slices.Clone(r.list())
+		if i := slices.Index(list, hooks); i >= 0 {
+			r.hooks.Store(ptr(slices.Delete(list, i, i+1)))
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func (r *hookRegistry) list() []*Hooks {
+	if r == nil {
+		return nil
+	}
+	if hooks := r.hooks.Load(); hooks != nil {
+		return *hooks
+	}
+	return nil
+}
+
+func (r *hookRegistry) store(entry *Entry) {
+	for _, h := range r.list() {
+		if h.OnStore != nil {
+			h.OnStore(entry)
+		}
+	}
+}
+
+func (r *hookRegistry) delete(key []byte) {
+	for _, h := range r.list() {
+		if h.OnDelete != nil {
+			h.OnDelete(key)
+		}
+	}
+}
+
+func (r *hookRegistry) evict(entry *Entry) {
+	for _, h := range r.list() {
+		if h.OnEvict != nil {
+			h.OnEvict(entry)
+		}
+	}
+}
+
+func (r *hookRegistry) expire(key []byte) {
+	for _, h := range r.list() {
+		if h.OnExpire != nil {
+			h.OnExpire(key)
+		}
+	}
+}
+
+func (r *hookRegistry) hit(entry *Entry) {
+	for _, h := range r.list() {
+		if h.OnHit != nil {
+			h.OnHit(entry)
+		}
+	}
+}
+
+func (r *hookRegistry) miss(key []byte) {
+	for _, h := range r.list() {
+		if h.OnMiss != nil {
+			h.OnMiss(key)
+		}
+	}
+}
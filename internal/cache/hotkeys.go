@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeyStat is the estimated access count of a tracked key. Count may
+// overestimate the true count by at most Error; Reads and Writes count
+// only the accesses seen since the key was last admitted to the tracker.
+type KeyStat struct {
+	Key    string `json:"key"`
+	Count  uint64 `json:"count"`
+	Error  uint64 `json:"error"`
+	Reads  uint64 `json:"reads"`
+	Writes uint64 `json:"writes"`
+}
+
+// hotKeys tracks the most frequently accessed keys of a shard with the
+// Space-Saving algorithm: it holds at most capacity counters and, when
+// full, hands the least counted slot to a new key, which inherits that
+// count as its error bound.
+type hotKeys struct {
+	mu       sync.Mutex
+	capacity int
+	index    map[string]int
+	heap     []*KeyStat // min-heap ordered by Count
+}
+
+func newHotKeys(capacity int) *hotKeys {
+	return &hotKeys{
+		capacity: capacity,
+		index:    make(map[string]int, capacity),
+		heap:     make([]*KeyStat, 0, capacity),
+	}
+}
+
+func (h *hotKeys) record(key []byte, write bool) {
+	h.mu.Lock()
+	
+	i, ok := h.index[string(key)]
+	if !ok {
+		if len(h.heap) < h.capacity {
+			h.heap = append(h.heap, &KeyStat{Key: string(key)})
+			i = len(h.heap) - 1
+		} else {
+			// Replace the least counted key.
+			i = 0
+			delete(h.index, h.heap[0].Key)
+			min := h.heap[0].Count
+			*h.heap[0] = KeyStat{Key: string(key), Count: min, Error: min}
+		}
+		h.index[string(key)] = i
+	}
+	
+	stat := h.heap[i]
+	stat.Count++
+	if write {
+		stat.Writes++
+	} else {
+		stat.Reads++
+	}
+	h.fix(i)
+	
+	h.mu.Unlock()
+}
+
+// fix restores the heap order after the count at i changed, keeping
+// index in step with the moves.
+func (h *hotKeys) fix(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if h.heap[parent].Count <= h.heap[i].Count {
+			break
+		}
+		h.swap(i, parent)
+		i = parent
+	}
+	for {
+		smallest := i
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(h.heap) && h.heap[child].Count < h.heap[smallest].Count {
+				smallest = child
+			}
+		}
+		if smallest == i {
+			return
+		}
+		h.swap(i, smallest)
+		i = smallest
+	}
+}
+
+func (h *hotKeys) swap(i, j int) {
+	h.heap[i], h.heap[j] = h.heap[j], h.heap[i]
+	h.index[h.heap[i].Key] = i
+	h.index[h.heap[j].Key] = j
+}
+
+func (h *hotKeys) appendStats(stats []KeyStat) []KeyStat {
+	h.mu.Lock()
+	for _, stat := range h.heap {
+		stats = append(stats, *stat)
+	}
+	h.mu.Unlock()
+	return stats
+}
+
+func (h *hotKeys) reset() {
+	h.mu.Lock()
+	h.index = make(map[string]int, h.capacity)
+	h.heap = h.heap[:0]
+	h.mu.Unlock()
+}
+
+// EnableHotKeys starts tracking the capacity most accessed keys of every
+// shard. Keys never span shards, so the cache-wide top keys are exact
+// merges of the shard trackers. It must be called before the cache is
+// shared.
+func (c *Cache) EnableHotKeys(capacity int) {
+	if capacity <= 0 {
+		return
+	}
+	for shard := range c.allShards() {
+		shard.hotKeys = newHotKeys(capacity)
+	}
+}
+
+// HotKeysEnabled reports whether EnableHotKeys was called.
+func (c *Cache) HotKeysEnabled() bool {
+	return c.table.Load().shards[0].hotKeys != nil
+}
+
+// TopKeys returns up to n of the most accessed keys, most accessed first.
+// It returns nil if hot key tracking is disabled.
+func (c *Cache) TopKeys(n int) []KeyStat {
+	return c.topKeys(n, func(*KeyStat) bool { return true })
+}
+
+func (c *Cache) topKeys(n int, keep func(*KeyStat) bool) []KeyStat {
+	if !c.HotKeysEnabled() {
+		return nil
+	}
+	
+	var all []KeyStat
+	for shard := range c.allShards() {
+		all = shard.hotKeys.appendStats(all)
+	}
+	
+	stats := all[:0]
+	for i := range all {
+		if keep(&all[i]) {
+			stats = append(stats, all[i])
+		}
+	}
+	return sortKeyStats(stats, n)
+}
+
+// ResetHotKeys clears the hot key trackers.
+func (c *Cache) ResetHotKeys() {
+	if !c.HotKeysEnabled() {
+		return
+	}
+	for shard := range c.allShards() {
+		shard.hotKeys.reset()
+	}
+}
+
+// GroupByPrefix sums stats by the part of each key before the last
+// occurrence of sep; keys without sep are grouped under their full name.
+func GroupByPrefix(stats []KeyStat, sep string, n int) []KeyStat {
+	groups := make(map[string]*KeyStat)
+	for _, stat := range stats {
+		prefix := stat.Key
+		if i := strings.LastIndex(stat.Key, sep); i >= 0 && sep != "" {
+			prefix = stat.Key[:i+len(sep)]
+		}
+		group, ok := groups[prefix]
+		if !ok {
+			group = &KeyStat{Key: prefix}
+			groups[prefix] = group
+		}
+		group.Count += stat.Count
+		group.Error += stat.Error
+		group.Reads += stat.Reads
+		group.Writes += stat.Writes
+	}
+	
+	out := make([]KeyStat, 0, len(groups))
+	for _, group := range groups {
+		out = append(out, *group)
+	}
+	return sortKeyStats(out, n)
+}
+
+func sortKeyStats(stats []KeyStat, n int) []KeyStat {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
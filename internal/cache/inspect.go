@@ -0,0 +1,69 @@
+package cache
+
+import "time"
+
+// EntryInfo describes where and how an entry is stored, for DEBUG OBJECT.
+type EntryInfo struct {
+	Shard     int
+	Bucket    int
+	Distance  int
+	Size      int64
+	CAS       uint64
+	Flags     uint32
+	ExpireAt  int64
+	// Tracked reports whether the entry carries access metadata, which
+	// the LRU and LFU eviction policies record.
+	Tracked   bool
+	Idle      time.Duration
+	Frequency int
+}
+
+// Inspect returns the internal placement of a live key.
+func (c *Cache) Inspect(key []byte) (EntryInfo, bool) {
+	c.faultIn(key)
+	shard := c.rlockShard(key)
+	defer shard.mu.RUnlock()
+	
+	entry, bucket := shard.m.lookup(key, hashKey(key))
+	if entry == nil || entry.IsEvicted() || entry.IsExpired() {
+		return EntryInfo{}, false
+	}
+	
+	idle, tracked := entry.IdleTime()
+	frequency, _ := entry.Frequency()
+	
+	return EntryInfo{
+		Shard:     shard.index,
+		Bucket:    bucket,
+		Distance:  int(shard.m.buckets[bucket].distance.Load()),
+		Size:      entry.Size(),
+		CAS:       entry.CAS(),
+		Flags:     entry.Flags(),
+		ExpireAt:  entry.ExpireAt(),
+		Tracked:   tracked,
+		Idle:      idle,
+		Frequency: frequency,
+	}, true
+}
+
+// Peek returns the live entry for key without counting a hit or miss,
+// recording an access or removing an expired entry. A key spilled to the
+// disk tier is read back.
+func (c *Cache) Peek(key []byte) (*Entry, bool) {
+	c.faultIn(key)
+	_, entry := c.lookup(key)
+	if !liveEntry(entry) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// SetActiveExpire turns the background sweeper's work on or off. Expired
+// keys are still removed lazily when accessed.
+func (c *Cache) SetActiveExpire(enabled bool) {
+	c.activeExpireOff.Store(!enabled)
+}
+
+func (c *Cache) ActiveExpire() bool {
+	return !c.activeExpireOff.Load()
+}
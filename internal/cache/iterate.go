@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// iterateBatch is the number of home buckets IterateSnapshot reads from
+// a shard per acquisition of its read lock.
+const iterateBatch = 256
+
+// scanMark records that a pass over a shard's table with the given mask
+// visited every entry whose home bucket is below cursor.
+type scanMark struct {
+	mask   uint64
+	cursor uint64
+}
+
+// scanned reports whether an entry with the given hash was visited by
+// one of the passes in marks.
+func scanned(hash uint64, marks []scanMark) bool {
+	for _, mark := range marks {
+		if hash&mark.mask < mark.cursor {
+			return true
+		}
+	}
+	return false
+}
+
+// IterateSnapshot calls fn for every live entry, like Iterate, but holds
+// no shard lock while fn runs, so a slow consumer does not block writers.
+// Each shard is read in batches of entry pointers, taking its read lock
+// once per batch and releasing it before fn sees the batch.
+//
+// The consistency guarantee is weaker than a point-in-time snapshot:
+//   - an entry that stays in the cache for the whole iteration is visited
+//     exactly once, even if its shard is written to or grows meanwhile;
+//   - an entry stored or deleted during the iteration may or may not be
+//     visited;
+//   - an entry overwritten during the iteration shows its new value if fn
+//     runs after the write.
+//
+// A resharding started during the iteration waits for it to finish, so fn
+// must not call Resize or other methods that visit every shard.
+func (c *Cache) IterateSnapshot(fn func(*Entry) bool) {
+	var batch []bucketCopy
+	
+	for shard := range c.allShards() {
+		if !shard.iterateSnapshot(fn, &batch) {
+			return
+		}
+	}
+}
+
+// IterateParallel is IterateSnapshot with up to workers shards read at
+// once, each by its own goroutine, for full scans of caches too large to
+// walk one shard at a time; workers of 0 or less means GOMAXPROCS. fn is
+// called concurrently and must be safe for that. Once fn returns false
+// no more entries are passed to it, though calls already running finish.
+// Each shard is visited with the guarantees of IterateSnapshot, and
+// IterateParallel returns once every worker has stopped.
+func (c *Cache) IterateParallel(fn func(*Entry) bool, workers int) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	
+	c.resizeMu.RLock()
+	defer c.resizeMu.RUnlock()
+	
+	list := c.shardList()
+	shards := make(chan *Shard)
+	var stopped atomic.Bool
+	visit := func(e *Entry) bool {
+		if stopped.Load() {
+			return false
+		}
+		if !fn(e) {
+			stopped.Store(true)
+			return false
+		}
+		return true
+	}
+	
+	var wg sync.WaitGroup
+	for range min(workers, len(list)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var batch []bucketCopy
+			for shard := range shards {
+				if !stopped.Load() {
+					shard.iterateSnapshot(visit, &batch)
+				}
+			}
+		}()
+	}
+	for _, shard := range list {
+		shards <- shard
+	}
+	close(shards)
+	wg.Wait()
+}
+
+// iterateSnapshot visits the shard for IterateSnapshot, reusing *batch as
+// its buffer, and reports whether fn wants more entries.
+func (s *Shard) iterateSnapshot(fn func(*Entry) bool, batch *[]bucketCopy) bool {
+	var marks []scanMark
+	var m *Map
+	var mask, cursor uint64
+	
+	for {
+		s.rlock()
+		
+		// Home buckets are only meaningful for one table size; after a
+		// resize or a Clear, start over and skip what was visited.
+		if s.m != m || s.m.mask != mask {
+			if m != nil {
+				marks = append(marks, scanMark{mask: mask, cursor: cursor})
+			}
+			m, mask, cursor = s.m, s.m.mask, 0
+		}
+		if cursor > mask {
+			s.mu.RUnlock()
+			return true
+		}
+		
+		*batch = m.collect(cursor, cursor+iterateBatch, (*batch)[:0])
+		cursor += iterateBatch
+		s.mu.RUnlock()
+		
+		for _, bucket := range *batch {
+			entry := bucket.entry
+			if entry.IsEvicted() || entry.IsExpired() || scanned(bucket.hash, marks) {
+				continue
+			}
+			if !fn(entry) {
+				return false
+			}
+		}
+	}
+}
+
+// Sample returns up to n live entries chosen at random from the whole
+// cache, for tooling that estimates key and value sizes or TTLs without a
+// full scan. Each shard contributes in proportion to its number of
+// entries, and within a shard every entry is equally likely to be picked.
+func (c *Cache) Sample(n int) []*Entry {
+	if n <= 0 {
+		return nil
+	}
+	
+	c.resizeMu.RLock()
+	defer c.resizeMu.RUnlock()
+	
+	shards := c.shardList()
+	counts := make([]int, len(shards))
+	total := 0
+	for i, shard := range shards {
+		shard.rlock()
+		counts[i] = shard.m.numItems
+		shard.mu.RUnlock()
+		total += counts[i]
+	}
+	if total == 0 {
+		return nil
+	}
+	
+	// Pick the shard of each entry in the sample, weighted by the entries
+	// not picked yet, as if drawing them one by one.
+	want := make([]int, len(shards))
+	for left := total; left > total-min(n, total); left-- {
+		r := rand.Intn(left)
+		for i, count := range counts {
+			if r < count-want[i] {
+				want[i]++
+				break
+			}
+			r -= count - want[i]
+		}
+	}
+	
+	entries := make([]*Entry, 0, min(n, total))
+	for i, shard := range shards {
+		if want[i] == 0 {
+			continue
+		}
+		shard.rlock()
+		for _, entry := range shard.m.randomEntries(want[i]) {
+			if !entry.IsExpired() {
+				entries = append(entries, entry)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return entries
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// entryOverhead is the memory an entry takes beyond its key and value: the
+// Entry itself and the hash table bucket pointing at it.
+const entryOverhead = int64(unsafe.Sizeof(Entry{}) + unsafe.Sizeof(Bucket{}))
+
+// MemoryUsage estimates the bytes the entry occupies, including its
+// header and bucket. It is larger than Size, the flat estimate counted
+// against maxmemory.
+func (e *Entry) MemoryUsage() int64 {
+	return int64(len(e.key)+cap(e.value)) + entryOverhead
+}
+
+// ShardMemory is the memory breakdown of one shard.
+type ShardMemory struct {
+	Items        int   `json:"items"`
+	DatasetBytes int64 `json:"dataset_bytes"`
+	Buckets      int   `json:"buckets"`
+	// Overhead is the hash table's bucket array plus the entry headers.
+	Overhead int64 `json:"overhead"`
+}
+
+// MemoryStats is the breakdown reported by MEMORY STATS.
+type MemoryStats struct {
+	MaxMemory    int64         `json:"max_memory"`
+	Items        int           `json:"items"`
+	DatasetBytes int64         `json:"dataset_bytes"`
+	Overhead     int64         `json:"overhead"`
+	Shards       []ShardMemory `json:"shards"`
+}
+
+func (c *Cache) MemoryStats() *MemoryStats {
+	stats := &MemoryStats{
+		MaxMemory: c.maxMemory,
+	}
+	
+	for shard := range c.allShards() {
+		shard.mu.RLock()
+		items := shard.m.numItems
+		buckets := len(shard.m.buckets)
+		shard.mu.RUnlock()
+		
+		overhead := int64(buckets)*int64(unsafe.Sizeof(Bucket{})) + int64(items)*int64(unsafe.Sizeof(Entry{}))
+		stats.Shards = append(stats.Shards, ShardMemory{
+			Items:        items,
+			DatasetBytes: shard.MemUsed(),
+			Buckets:      buckets,
+			Overhead:     overhead,
+		})
+		
+		stats.Items += items
+		stats.DatasetBytes += shard.MemUsed()
+		stats.Overhead += overhead
+	}
+	
+	return stats
+}
+
+// Purge removes every expired entry, without waiting for the sweeper,
+// and shrinks each shard's hash table to fit what remains. It returns the
+// number of entries removed.
+func (c *Cache) Purge() int {
+	removed := 0
+	
+	for shard := range c.allShards() {
+		shard.lock()
+		
+		var toDelete [][]byte
+		shard.m.iter(func(e *Entry) bool {
+			if e.IsExpired() {
+				toDelete = append(toDelete, e.key)
+			}
+			return true
+		})
+		
+		for _, key := range toDelete {
+			entry := shard.m.delete(key, hashKey(key))
+			if entry == nil {
+				continue
+			}
+			removed++
+			shard.addMemUsed(-entry.Size())
+			atomic.AddUint64(&shard.numExpired, 1)
+			shard.hooks.expire(key)
+		}
+		shard.m.compact()
+		shard.rebuildExpiries()
+		
+		shard.unlock()
+	}
+	
+	return removed
+}
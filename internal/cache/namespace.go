@@ -0,0 +1,315 @@
+package cache
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Namespace is a view of a Cache restricted to keys under a prefix. Keys
+// passed to it and reported by Iterate exclude the prefix, so clients of
+// different namespaces cannot see or overwrite each other's keys. Stats
+// remain server-wide.
+type Namespace struct {
+	c      *Cache
+	prefix []byte
+}
+
+func (c *Cache) Namespace(prefix string) *Namespace {
+	return &Namespace{
+		c:      c,
+		prefix: []byte(prefix),
+	}
+}
+
+func (n *Namespace) Prefix() string {
+	return string(n.prefix)
+}
+
+// key returns the full key for k. The result is a fresh slice, so it can
+// be retained by the cache.
+func (n *Namespace) key(k []byte) []byte {
+	full := make([]byte, len(n.prefix)+len(k))
+	copy(full, n.prefix)
+	copy(full[len(n.prefix):], k)
+	return full
+}
+
+func (n *Namespace) Store(key, value []byte, opts *StoreOptions) error {
+	return n.c.Store(n.key(key), value, opts)
+}
+
+func (n *Namespace) Load(key []byte) (*Entry, bool) {
+	return n.c.Load(n.key(key))
+}
+
+func (n *Namespace) LoadNoTouch(key []byte) (*Entry, bool) {
+	return n.c.LoadNoTouch(n.key(key))
+}
+
+func (n *Namespace) LoadOrStore(key, value []byte, opts *StoreOptions) (*Entry, bool) {
+	return n.c.LoadOrStore(n.key(key), value, opts)
+}
+
+func (n *Namespace) Fetch(key []byte, opts *StoreOptions, load func() ([]byte, error)) (*Entry, bool, error) {
+	return n.c.Fetch(n.key(key), opts, load)
+}
+
+func (n *Namespace) Swap(key, value []byte, opts *StoreOptions) (*Entry, bool) {
+	return n.c.Swap(n.key(key), value, opts)
+}
+
+func (n *Namespace) Delete(key []byte) bool {
+	return n.c.Delete(n.key(key))
+}
+
+func (n *Namespace) LoadAndDelete(key []byte) (*Entry, bool) {
+	return n.c.LoadAndDelete(n.key(key))
+}
+
+func (n *Namespace) CompareAndSwap(key, value []byte, cas uint64, opts *StoreOptions) (bool, error) {
+	return n.c.CompareAndSwap(n.key(key), value, cas, opts)
+}
+
+func (n *Namespace) CompareAndDelete(key []byte, cas uint64) (bool, error) {
+	return n.c.CompareAndDelete(n.key(key), cas)
+}
+
+func (n *Namespace) Increment(key []byte, delta int64) (int64, error) {
+	return n.c.Increment(n.key(key), delta)
+}
+
+func (n *Namespace) IncrementUnsigned(key []byte, delta uint64, decr bool) (uint64, error) {
+	return n.c.IncrementUnsigned(n.key(key), delta, decr)
+}
+
+func (n *Namespace) Update(key []byte, fn func(value []byte, found bool) []byte) error {
+	return n.c.Update(n.key(key), fn)
+}
+
+// CheckSize is Cache.CheckSize for a key in the namespace, which is
+// stored with the prefix.
+func (n *Namespace) CheckSize(keyLen, valueLen int) error {
+	return n.c.CheckSize(len(n.prefix)+keyLen, valueLen)
+}
+
+func (n *Namespace) SizeLimits() (maxKey, maxValue int64) {
+	return n.c.SizeLimits()
+}
+
+func (n *Namespace) LoadMany(keys [][]byte) []*Entry {
+	return n.c.LoadMany(n.keys(keys))
+}
+
+func (n *Namespace) LoadManyNoTouch(keys [][]byte) []*Entry {
+	return n.c.LoadManyNoTouch(n.keys(keys))
+}
+
+func (n *Namespace) StoreMany(keys, values [][]byte, opts *StoreOptions) error {
+	return n.c.StoreMany(n.keys(keys), values, opts)
+}
+
+// keys returns the full key of each of keys.
+func (n *Namespace) keys(keys [][]byte) [][]byte {
+	full := make([][]byte, len(keys))
+	for i, k := range keys {
+		full[i] = n.key(k)
+	}
+	return full
+}
+
+func (n *Namespace) Apply(ops []Op) error {
+	prefixed := make([]Op, len(ops))
+	for i, op := range ops {
+		prefixed[i] = op
+		prefixed[i].Key = n.key(op.Key)
+	}
+	return n.c.Apply(prefixed)
+}
+
+func (n *Namespace) Rename(src, dst []byte, nx bool) (bool, error) {
+	return n.c.Rename(n.key(src), n.key(dst), nx)
+}
+
+func (n *Namespace) Copy(src, dst []byte, replace bool) (bool, error) {
+	return n.c.Copy(n.key(src), n.key(dst), replace)
+}
+
+// Iterate calls fn for every live entry in the namespace. The entries
+// passed to fn are read-only copies whose Key excludes the prefix.
+func (n *Namespace) Iterate(fn func(*Entry) bool) {
+	n.c.Iterate(func(e *Entry) bool {
+		if !bytes.HasPrefix(e.key, n.prefix) {
+			return true
+		}
+		return fn(&Entry{
+			key:        e.key[len(n.prefix):],
+			value:      e.value,
+			expireAt:   e.ExpireAt(),
+			softExpire: e.SoftExpireAt(),
+			flags:      e.Flags(),
+			cas:        e.CAS(),
+		})
+	})
+}
+
+// IterateSnapshot is Iterate without holding shard locks while fn runs;
+// see Cache.IterateSnapshot for what it guarantees.
+func (n *Namespace) IterateSnapshot(fn func(*Entry) bool) {
+	n.c.IterateSnapshot(func(e *Entry) bool {
+		if !bytes.HasPrefix(e.key, n.prefix) {
+			return true
+		}
+		return fn(&Entry{
+			key:        e.key[len(n.prefix):],
+			value:      e.value,
+			expireAt:   e.ExpireAt(),
+			softExpire: e.SoftExpireAt(),
+			flags:      e.Flags(),
+			cas:        e.CAS(),
+		})
+	})
+}
+
+// IterateParallel is IterateSnapshot reading several shards at once; see
+// Cache.IterateParallel.
+func (n *Namespace) IterateParallel(fn func(*Entry) bool, workers int) {
+	n.c.IterateParallel(func(e *Entry) bool {
+		if !bytes.HasPrefix(e.key, n.prefix) {
+			return true
+		}
+		return fn(&Entry{
+			key:        e.key[len(n.prefix):],
+			value:      e.value,
+			expireAt:   e.ExpireAt(),
+			softExpire: e.SoftExpireAt(),
+			flags:      e.Flags(),
+			cas:        e.CAS(),
+		})
+	}, workers)
+}
+
+// DeletePrefix removes every key in the namespace starting with prefix
+// in the background; see Cache.DeletePrefix.
+func (n *Namespace) DeletePrefix(prefix []byte) <-chan struct{} {
+	return n.c.DeletePrefix(n.key(prefix))
+}
+
+// PrefixDeletes reports the DeletePrefix calls still running in the
+// namespace, with prefixes relative to it.
+func (n *Namespace) PrefixDeletes() []PrefixDeleteStatus {
+	var statuses []PrefixDeleteStatus
+	for _, status := range n.c.PrefixDeletes() {
+		if prefix, ok := strings.CutPrefix(status.Prefix, string(n.prefix)); ok {
+			status.Prefix = prefix
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// ClearAsync removes every key in the namespace in the background. Unlike
+// Clear, which holds each shard's lock while it searches the shard for
+// the namespace's keys, it never blocks other clients for long.
+func (n *Namespace) ClearAsync() {
+	n.DeletePrefix(nil)
+}
+
+// Clear removes every key in the namespace.
+func (n *Namespace) Clear() {
+	for shard := range n.c.allShards() {
+		shard.lock()
+		
+		var toDelete [][]byte
+		shard.m.iter(func(e *Entry) bool {
+			if bytes.HasPrefix(e.key, n.prefix) {
+				toDelete = append(toDelete, e.key)
+			}
+			return true
+		})
+		
+		for _, key := range toDelete {
+			if entry := shard.m.delete(key, hashKey(key)); entry != nil && !entry.IsEvicted() {
+				shard.addMemUsed(-entry.Size())
+			}
+		}
+		atomic.AddUint64(&shard.numOps, 1)
+		
+		shard.unlock()
+	}
+}
+
+func (n *Namespace) NumItems() int {
+	count := 0
+	n.Iterate(func(*Entry) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// TopKeys returns up to n of the most accessed keys in the namespace,
+// without the prefix.
+func (n *Namespace) TopKeys(count int) []KeyStat {
+	stats := n.c.topKeys(count, func(stat *KeyStat) bool {
+		return strings.HasPrefix(stat.Key, string(n.prefix))
+	})
+	for i := range stats {
+		stats[i].Key = stats[i].Key[len(n.prefix):]
+	}
+	return stats
+}
+
+// SizeReport is like Cache.SizeReport, restricted to the namespace.
+func (n *Namespace) SizeReport(count int) *SizeReport {
+	return n.c.sizeReport(count, n.prefix)
+}
+
+func (n *Namespace) Expire(key []byte, expireAt int64) bool {
+	return n.c.Expire(n.key(key), expireAt)
+}
+
+func (n *Namespace) ExpiryStats() ExpiryStats {
+	return n.c.ExpiryStats()
+}
+
+func (n *Namespace) Inspect(key []byte) (EntryInfo, bool) {
+	return n.c.Inspect(n.key(key))
+}
+
+func (n *Namespace) SetActiveExpire(enabled bool) {
+	n.c.SetActiveExpire(enabled)
+}
+
+func (n *Namespace) MemoryStats() *MemoryStats {
+	return n.c.MemoryStats()
+}
+
+func (n *Namespace) Purge() int {
+	return n.c.Purge()
+}
+
+func (n *Namespace) Stats() Stats {
+	return n.c.Stats()
+}
+
+func (n *Namespace) NumShards() int {
+	return n.c.NumShards()
+}
+
+func (n *Namespace) ShardStats() []ShardStats {
+	return n.c.ShardStats()
+}
+
+func (n *Namespace) LockWait() time.Duration {
+	return n.c.LockWait()
+}
+
+func (n *Namespace) Resize(shards int) error {
+	return n.c.Resize(shards)
+}
+
+func (n *Namespace) ResizeStatus() (ResizeStatus, bool) {
+	return n.c.ResizeStatus()
+}
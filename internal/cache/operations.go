@@ -1,87 +1,244 @@
 package cache
 
 import (
+	"bytes"
+	"errors"
+	"math"
 	"math/rand"
+	"slices"
+	"sort"
+	"strconv"
 	"sync/atomic"
 	"time"
 )
 
+var (
+	// ErrNoSuchKey is returned by Rename and IncrementUnsigned when the
+	// key does not exist.
+	ErrNoSuchKey = errors.New("no such key")
+	// ErrNotInteger is returned by Increment and IncrementUnsigned when
+	// the stored value is not a decimal integer in range.
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	// ErrOverflow is returned by Increment when the result would not
+	// fit in an int64.
+	ErrOverflow = errors.New("increment or decrement would overflow")
+	// ErrKeyTooLarge and ErrValueTooLarge are returned by the operations
+	// that store a key or value longer than the limits set with
+	// SetSizeLimits.
+	ErrKeyTooLarge   = errors.New("key exceeds the maximum key size")
+	ErrValueTooLarge = errors.New("value exceeds the maximum value size")
+)
+
+// SetSizeLimits sets the longest key and value the cache accepts, in
+// bytes; 0 means no limit. Store, CompareAndSwap, Fetch, Update,
+// Increment, Rename, Copy and Apply enforce them. LoadOrStore and Swap
+// cannot report an error, so their callers check with CheckSize first.
+func (c *Cache) SetSizeLimits(maxKey, maxValue int64) {
+	c.maxKeySize.Store(maxKey)
+	c.maxValueSize.Store(maxValue)
+}
+
+// SizeLimits returns the limits set with SetSizeLimits.
+func (c *Cache) SizeLimits() (maxKey, maxValue int64) {
+	return c.maxKeySize.Load(), c.maxValueSize.Load()
+}
+
+// CheckSize returns ErrKeyTooLarge or ErrValueTooLarge if a key or value
+// of the given lengths would exceed the size limits.
+func (c *Cache) CheckSize(keyLen, valueLen int) error {
+	if limit := c.maxKeySize.Load(); limit > 0 && int64(keyLen) > limit {
+		return ErrKeyTooLarge
+	}
+	if limit := c.maxValueSize.Load(); limit > 0 && int64(valueLen) > limit {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
 type StoreOptions struct {
-	TTL   time.Duration
-	Flags uint32
-	CAS   uint64
+	// TTL is the hard TTL: the entry is removed once it passes.
+	TTL time.Duration
+	// SoftTTL, if set, marks the entry as due for a refresh once it
+	// passes, without removing it. See Entry.NeedsRefresh.
+	SoftTTL time.Duration
+	Flags   uint32
+	CAS     uint64
+	// Sliding makes TTL a sliding TTL: every read of the entry through
+	// Load, or a Fetch that finds it, pushes its expiration back to TTL
+	// from then, so it only expires once it has gone unread for that
+	// long. It has no effect without a TTL.
+	Sliding bool
+	// Pinned keeps the entry from ever being evicted, within the limit
+	// set with SetMaxPinned. It still expires. Only Store pins entries;
+	// the other writes ignore it, and CompareAndSwap, Increment, Update
+	// and Rename keep whether the entry was pinned.
+	Pinned bool
 }
 
 func (c *Cache) Store(key, value []byte, opts *StoreOptions) error {
-	shard := c.getShard(key)
-	
-	entry := &Entry{
-		key:   key,
-		value: value,
+	if err := c.CheckSize(len(key), len(value)); err != nil {
+		return err
 	}
 	
-	if opts != nil {
-		if opts.TTL > 0 {
-			entry.expireAt = time.Now().Add(opts.TTL).UnixNano()
-		}
-		entry.flags = opts.Flags
-		entry.cas = opts.CAS
-	}
+	entry := c.newEntry(key, value, opts)
+	
+	shard := c.lockShard(key)
+	defer shard.unlock()
 	
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
+	if shard.admission != nil {
+		shard.admission.record(hashKey(key))
+	}
 	
 	atomic.AddUint64(&shard.numOps, 1)
 	
+	// Pinned entries are never evicted, so there is no victim to weigh
+	// them against.
+	if opts != nil && opts.Pinned {
+		if !c.pinAllowed(shard, entry) {
+			return ErrPinnedLimit
+		}
+		entry.pinned = true
+	} else if !c.admit(shard, key, entry.Size()) {
+		return nil
+	}
+	
+	shard.trackAccess(entry)
+	shard.assignCAS(entry)
 	c.evictIfNeeded(shard, entry.Size())
+	// Evicting may have spilled the old entry; the new one replaces it.
+	c.forgetSpilled(key)
 	
 	oldEntry := shard.m.insert(entry)
 	
-	if oldEntry != nil {
+	// Evicted entries have already been taken out of the memory count.
+	if oldEntry != nil && !oldEntry.IsEvicted() {
 		shard.addMemUsed(-oldEntry.Size())
 	}
 	shard.addMemUsed(entry.Size())
+	shard.indexExpiry(key, entry.expireAt)
+	shard.hooks.store(entry)
 	
 	return nil
 }
 
 func (c *Cache) Load(key []byte) (*Entry, bool) {
-	shard := c.getShard(key)
-	
-	shard.mu.RLock()
-	entry := shard.m.get(key)
-	shard.mu.RUnlock()
-	
-	atomic.AddUint64(&shard.numOps, 1)
+	return c.load(key, true)
+}
+
+// LoadNoTouch is Load without recording the access: hits and misses are
+// counted, but the entry's LRU and LFU statistics and the hot key counts
+// are left as they were, so that monitoring reads do not change what gets
+// evicted.
+func (c *Cache) LoadNoTouch(key []byte) (*Entry, bool) {
+	return c.load(key, false)
+}
+
+func (c *Cache) load(key []byte, touch bool) (*Entry, bool) {
+	shard, entry := c.lookup(key)
+	shard.recordRead(key, touch)
 	
-	if entry == nil {
-		atomic.AddUint64(&shard.numMisses, 1)
-		return nil, false
+	// Evicted after the lookup found it: already gone from the map.
+	if entry != nil && entry.IsEvicted() {
+		entry = nil
 	}
 	
-	// Check if entry was evicted
-	if entry.IsEvicted() {
-		c.Delete(key)
-		atomic.AddUint64(&shard.numMisses, 1)
+	if entry == nil {
+		if entry, ok := c.restore(key); ok {
+			if touch {
+				entry.extend()
+			}
+			atomic.AddUint64(&shard.numHits, 1)
+			shard.hooks.hit(entry)
+			return entry, true
+		}
+		shard.miss(key)
 		return nil, false
 	}
 	
 	if entry.IsExpired() {
-		c.Delete(key)
+		c.remove(key, (*hookRegistry).expire)
 		atomic.AddUint64(&shard.numExpired, 1)
-		atomic.AddUint64(&shard.numMisses, 1)
+		shard.miss(key)
 		return nil, false
 	}
 	
-	atomic.AddUint64(&shard.numHits, 1)
+	shard.hit(entry, touch)
 	return entry, true
 }
 
+// recordRead counts a read of key, and, if touch is set, records it in
+// the hot key and admission statistics.
+func (s *Shard) recordRead(key []byte, touch bool) {
+	if s.hotKeys != nil && touch {
+		s.hotKeys.record(key, false)
+	}
+	if s.admission != nil && touch {
+		s.admission.record(hashKey(key))
+	}
+	
+	atomic.AddUint64(&s.numOps, 1)
+}
+
+// hit counts a read that found entry live and, if touch is set, records
+// the access on the entry.
+func (s *Shard) hit(entry *Entry, touch bool) {
+	atomic.AddUint64(&s.numHits, 1)
+	if touch {
+		entry.touch()
+		entry.extend()
+	}
+	s.hooks.hit(entry)
+}
+
+// miss counts a read that found nothing live under key.
+func (s *Shard) miss(key []byte) {
+	atomic.AddUint64(&s.numMisses, 1)
+	s.hooks.miss(key)
+}
+
 func (c *Cache) Delete(key []byte) bool {
-	shard := c.getShard(key)
+	spilled := c.forgetSpilled(key)
+	return c.remove(key, (*hookRegistry).delete) || spilled
+}
+
+// LoadAndDelete deletes key and returns the live entry it held, if
+// there was one, as a single atomic step.
+func (c *Cache) LoadAndDelete(key []byte) (*Entry, bool) {
+	c.faultIn(key)
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
+	
+	atomic.AddUint64(&shard.numOps, 1)
+	
+	existing := shard.m.get(key)
+	if !liveEntry(existing) {
+		return nil, false
+	}
+	
+	shard.m.delete(key, hashKey(key))
+	shard.addMemUsed(-existing.Size())
+	c.forgetSpilled(key)
+	shard.hooks.delete(key)
 	
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
+	return existing, true
+}
+
+// remove deletes key and reports the removal to the hooks through event,
+// if it is not nil.
+func (c *Cache) remove(key []byte, event func(*hookRegistry, []byte)) bool {
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
 	
 	atomic.AddUint64(&shard.numOps, 1)
 	
@@ -91,20 +248,33 @@ func (c *Cache) Delete(key []byte) bool {
 	}
 	
 	shard.addMemUsed(-entry.Size())
+	if event != nil && !entry.IsEvicted() {
+		event(shard.hooks, key)
+	}
 	return true
 }
 
+// CompareAndSwap stores value under key only if the live entry there
+// still has the given CAS token, and reports whether it did. The entry
+// gets a new token. It returns ErrNoSuchKey if key does not exist.
 func (c *Cache) CompareAndSwap(key, value []byte, cas uint64, opts *StoreOptions) (bool, error) {
-	shard := c.getShard(key)
+	if err := c.CheckSize(len(key), len(value)); err != nil {
+		return false, err
+	}
 	
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
+	c.faultIn(key)
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
 	
 	atomic.AddUint64(&shard.numOps, 1)
 	
 	existing := shard.m.get(key)
-	if existing == nil {
-		return false, nil
+	if !liveEntry(existing) {
+		return false, ErrNoSuchKey
 	}
 	
 	if existing.CAS() != cas {
@@ -112,134 +282,484 @@ func (c *Cache) CompareAndSwap(key, value []byte, cas uint64, opts *StoreOptions
 	}
 	
 	// Calculate new expiration and flags
-	var newExpireAt int64
+	var newExpireAt, newSoftExpire, newSlide int64
 	var newFlags uint32
 	if opts != nil {
 		if opts.TTL > 0 {
 			newExpireAt = time.Now().Add(opts.TTL).UnixNano()
 		}
+		if opts.SoftTTL > 0 {
+			newSoftExpire = time.Now().Add(opts.SoftTTL).UnixNano()
+		}
 		newFlags = opts.Flags
+		if c.slides(key, opts) {
+			newSlide = int64(opts.TTL)
+		}
 	}
 	
 	// Calculate size difference with new value
 	sizeDelta := int64(len(value) - len(existing.value))
 	
 	c.evictIfNeeded(shard, sizeDelta)
+	if existing.IsEvicted() {
+		// Evicted to make room for its own new value: put it back.
+		existing.SetEvicted(false)
+		shard.m.insert(existing)
+		shard.addMemUsed(existing.Size())
+	}
+	c.forgetSpilled(key)
 	
 	// Update the existing entry
 	existing.value = value
 	existing.expireAt = newExpireAt
+	existing.softExpire = newSoftExpire
 	existing.flags = newFlags
-	existing.IncrementCAS()
+	atomic.StoreInt64(&existing.slide, newSlide)
+	atomic.StoreUint64(&existing.cas, shard.nextCAS())
+	existing.touch()
+	shard.indexExpiry(existing.key, newExpireAt)
+	if existing.pinned {
+		shard.m.pinnedBytes += sizeDelta
+	}
 	
 	shard.addMemUsed(sizeDelta)
+	shard.hooks.store(existing)
 	
 	return true, nil
 }
 
+// CompareAndDelete deletes key only if the live entry there still has the
+// given CAS token, and reports whether it did. It returns ErrNoSuchKey if
+// key does not exist.
+func (c *Cache) CompareAndDelete(key []byte, cas uint64) (bool, error) {
+	c.faultIn(key)
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
+	
+	atomic.AddUint64(&shard.numOps, 1)
+	
+	existing := shard.m.get(key)
+	if !liveEntry(existing) {
+		return false, ErrNoSuchKey
+	}
+	
+	if existing.CAS() != cas {
+		return false, nil
+	}
+	
+	shard.m.delete(key, hashKey(key))
+	shard.addMemUsed(-existing.Size())
+	c.forgetSpilled(key)
+	shard.hooks.delete(key)
+	
+	return true, nil
+}
+
+// Increment adds delta to the signed decimal integer stored at key, as
+// Redis INCRBY does. A missing key counts as 0. The result is stored back
+// as decimal text, keeping the entry's TTL and flags.
 func (c *Cache) Increment(key []byte, delta int64) (int64, error) {
-	shard := c.getShard(key)
+	if err := c.CheckSize(len(key), 0); err != nil {
+		return 0, err
+	}
 	
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
+	c.faultIn(key)
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
 	
 	atomic.AddUint64(&shard.numOps, 1)
 	
 	entry := shard.m.get(key)
-	if entry == nil {
-		val := delta
+	if !liveEntry(entry) {
 		entry = &Entry{
 			key:   key,
-			value: int64ToBytes(val),
+			value: strconv.AppendInt(nil, delta, 10),
 		}
+		shard.trackAccess(entry)
+		c.replaceLocked(shard, entry)
 		
-		c.evictIfNeeded(shard, entry.Size())
-		shard.m.insert(entry)
-		shard.addMemUsed(entry.Size())
-		
-		return val, nil
+		return delta, nil
 	}
 	
-	currentVal := bytesToInt64(entry.value)
-	newVal := currentVal + delta
+	current, err := strconv.ParseInt(string(entry.value), 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
 	
-	oldSize := entry.Size()
-	entry.value = int64ToBytes(newVal)
-	entry.IncrementCAS()
-	newSize := entry.Size()
+	newVal := current + delta
+	shard.setValueLocked(entry, strconv.AppendInt(nil, newVal, 10))
+	
+	return newVal, nil
+}
+
+// IncrementUnsigned applies a memcached incr or decr of delta to the
+// unsigned decimal integer stored at key. Incrementing wraps around at
+// 2^64 and decrementing stops at 0. Unlike Increment it does not create
+// missing keys, returning ErrNoSuchKey instead.
+func (c *Cache) IncrementUnsigned(key []byte, delta uint64, decr bool) (uint64, error) {
+	c.faultIn(key)
+	
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
+	
+	atomic.AddUint64(&shard.numOps, 1)
+	
+	entry := shard.m.get(key)
+	if !liveEntry(entry) {
+		return 0, ErrNoSuchKey
+	}
+	
+	// memcached pads a counter that shrank with spaces, so clients
+	// that write counters the same way may leave them behind.
+	current, err := strconv.ParseUint(string(bytes.TrimRight(entry.value, " ")), 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
 	
-	shard.addMemUsed(newSize - oldSize)
+	var newVal uint64
+	switch {
+	case !decr:
+		newVal = current + delta
+	case delta < current:
+		newVal = current - delta
+	}
+	shard.setValueLocked(entry, strconv.AppendUint(nil, newVal, 10))
 	
 	return newVal, nil
 }
 
-func (c *Cache) Sweep() int {
-	expired := 0
+// Update replaces the value of key with what fn returns, as one atomic
+// step. fn runs under the shard lock and is passed the live value, or nil
+// and false if there is none; it must not modify the value or call into
+// the cache. If fn returns nil the key is left as it was. Otherwise an
+// existing entry keeps its TTL and flags, and a missing key is created
+// without a TTL. A value over the size limit is not stored and
+// ErrValueTooLarge is returned.
+func (c *Cache) Update(key []byte, fn func(value []byte, found bool) []byte) error {
+	if err := c.CheckSize(len(key), 0); err != nil {
+		return err
+	}
 	
-	for _, shard := range c.shards {
-		shard.mu.Lock()
-		
-		toDelete := make([][]byte, 0)
-		shard.m.iter(func(e *Entry) bool {
-			if e.IsExpired() {
-				toDelete = append(toDelete, e.key)
+	c.faultIn(key)
+	shard := c.lockShard(key)
+	defer shard.unlock()
+	
+	if shard.hotKeys != nil {
+		shard.hotKeys.record(key, true)
+	}
+	
+	atomic.AddUint64(&shard.numOps, 1)
+	
+	entry := shard.m.get(key)
+	found := liveEntry(entry)
+	var value []byte
+	if found {
+		value = fn(entry.value, true)
+	} else {
+		value = fn(nil, false)
+	}
+	if value == nil {
+		return nil
+	}
+	if err := c.CheckSize(len(key), len(value)); err != nil {
+		return err
+	}
+	
+	if found {
+		shard.setValueLocked(entry, value)
+		return nil
+	}
+	entry = &Entry{key: key, value: value}
+	shard.trackAccess(entry)
+	c.replaceLocked(shard, entry)
+	return nil
+}
+
+// setValueLocked replaces the value of a live entry in place, keeping its
+// TTL and flags. The caller holds the shard lock.
+func (s *Shard) setValueLocked(entry *Entry, value []byte) {
+	oldSize := entry.Size()
+	entry.value = value
+	atomic.StoreUint64(&entry.cas, s.nextCAS())
+	entry.touch()
+	
+	s.addMemUsed(entry.Size() - oldSize)
+	if entry.pinned {
+		s.m.pinnedBytes += entry.Size() - oldSize
+	}
+	s.hooks.store(entry)
+}
+
+// Rename moves the entry at src to dst atomically, keeping its value,
+// expiry, flags and CAS. An existing dst is overwritten unless nx is set,
+// in which case Rename reports false and changes nothing. It returns
+// ErrNoSuchKey if src does not exist.
+func (c *Cache) Rename(src, dst []byte, nx bool) (bool, error) {
+	if err := c.CheckSize(len(dst), 0); err != nil {
+		return false, err
+	}
+	
+	c.faultIn(src)
+	srcShard, dstShard, unlock := c.lockKeys(src, dst)
+	defer unlock()
+	
+	atomic.AddUint64(&srcShard.numOps, 1)
+	
+	entry := srcShard.m.get(src)
+	if entry == nil || entry.IsEvicted() || entry.IsExpired() {
+		return false, ErrNoSuchKey
+	}
+	
+	if bytes.Equal(src, dst) {
+		return !nx, nil
+	}
+	
+	if nx && liveEntry(dstShard.m.get(dst)) {
+		return false, nil
+	}
+	
+	srcShard.m.delete(src, hashKey(src))
+	srcShard.addMemUsed(-entry.Size())
+	srcShard.hooks.delete(src)
+	
+	renamed := &Entry{
+		key:        dst,
+		value:      entry.value,
+		expireAt:   entry.ExpireAt(),
+		softExpire: entry.SoftExpireAt(),
+		flags:      entry.Flags(),
+		cas:        entry.CAS(),
+		metadata:   entry.metadata,
+		pinned:     entry.pinned,
+		slide:      entry.SlidingTTL().Nanoseconds(),
+	}
+	c.insertLocked(dstShard, renamed)
+	
+	return true, nil
+}
+
+// Copy stores a copy of the entry at src under dst, keeping its expiry
+// and flags. It reports false if src does not exist, or if dst exists and
+// replace is not set.
+func (c *Cache) Copy(src, dst []byte, replace bool) (bool, error) {
+	if err := c.CheckSize(len(dst), 0); err != nil {
+		return false, err
+	}
+	
+	c.faultIn(src)
+	srcShard, dstShard, unlock := c.lockKeys(src, dst)
+	defer unlock()
+	
+	atomic.AddUint64(&srcShard.numOps, 1)
+	
+	entry := srcShard.m.get(src)
+	if entry == nil || entry.IsEvicted() || entry.IsExpired() {
+		return false, nil
+	}
+	
+	if bytes.Equal(src, dst) {
+		return false, nil
+	}
+	
+	if !replace && liveEntry(dstShard.m.get(dst)) {
+		return false, nil
+	}
+	
+	copied := &Entry{
+		key:        dst,
+		value:      bytes.Clone(entry.value),
+		expireAt:   entry.ExpireAt(),
+		softExpire: entry.SoftExpireAt(),
+		flags:      entry.Flags(),
+		slide:      entry.SlidingTTL().Nanoseconds(),
+	}
+	dstShard.trackAccess(copied)
+	c.insertLocked(dstShard, copied)
+	
+	return true, nil
+}
+
+// lockKeys write-locks the shards of both keys and returns them with the
+// matching unlock. Shards are always locked in creation order so
+// concurrent operations on the same pair cannot deadlock. If a resize
+// moves either shard first, both are released and the lookup retried.
+func (c *Cache) lockKeys(a, b []byte) (*Shard, *Shard, func()) {
+	ha, hb := hashKey(a), hashKey(b)
+	for {
+		sa, sb := c.route(ha), c.route(hb)
+		if sa == sb {
+			sa.lock()
+			if sa.next.Load() == nil {
+				return sa, sa, sa.unlock
 			}
-			return true
-		})
+			sa.unlock()
+			continue
+		}
 		
-		for _, key := range toDelete {
-			if entry := shard.m.delete(key, hashKey(key)); entry != nil {
-				shard.addMemUsed(-entry.Size())
-				expired++
-				atomic.AddUint64(&shard.numExpired, 1)
-			}
+		first, second := sa, sb
+		if second.id < first.id {
+			first, second = second, first
 		}
+		first.lock()
+		second.lock()
 		
-		shard.mu.Unlock()
+		if first.next.Load() == nil && second.next.Load() == nil {
+			return sa, sb, func() {
+				second.unlock()
+				first.unlock()
+			}
+		}
+		second.unlock()
+		first.unlock()
 	}
-	
-	return expired
 }
 
-// SweepEvicted removes evicted entries to free memory
-// Ensures no more than 10% of cache memory is used by evicted entries
-func (c *Cache) SweepEvicted() int {
-	evicted := 0
+// Op is one write of a batch passed to Apply: Value stored under Key
+// with Options, or Key deleted if Delete is set.
+type Op struct {
+	Key     []byte
+	Value   []byte
+	Options *StoreOptions
+	Delete  bool
+}
+
+// Apply performs a batch of writes atomically: the shards of all the keys
+// are locked together, so no reader sees some of the writes without the
+// others. Later writes to a key replace earlier ones. Sizes are checked
+// before anything is written, and an error leaves the cache unchanged.
+func (c *Cache) Apply(ops []Op) error {
+	keys := make([][]byte, len(ops))
+	for i, op := range ops {
+		valueLen := len(op.Value)
+		if op.Delete {
+			valueLen = 0
+		}
+		if err := c.CheckSize(len(op.Key), valueLen); err != nil {
+			return err
+		}
+		keys[i] = op.Key
+	}
 	
-	for _, shard := range c.shards {
-		shard.mu.Lock()
-		
-		// Calculate how much memory is used by evicted entries
-		evictedMemory := int64(0)
-		totalMemory := shard.MemUsed()
-		toDelete := make([][]byte, 0)
+	shards, unlock := c.lockShards(keys)
+	defer unlock()
+	
+	for i, op := range ops {
+		shard := shards[i]
+		if shard.hotKeys != nil {
+			shard.hotKeys.record(op.Key, true)
+		}
+		atomic.AddUint64(&shard.numOps, 1)
 		
-		shard.m.iter(func(e *Entry) bool {
-			if e.IsEvicted() {
-				evictedMemory += e.Size()
-				toDelete = append(toDelete, e.key)
+		if op.Delete {
+			c.forgetSpilled(op.Key)
+			entry := shard.m.delete(op.Key, hashKey(op.Key))
+			if entry == nil {
+				continue
 			}
-			return true
-		})
+			shard.addMemUsed(-entry.Size())
+			if !entry.IsEvicted() {
+				shard.hooks.delete(op.Key)
+			}
+			continue
+		}
 		
-		// If evicted entries use more than 10% of memory, clean them up
-		if evictedMemory > totalMemory/10 {
-			for _, key := range toDelete {
-				if entry := shard.m.delete(key, hashKey(key)); entry != nil {
-					shard.addMemUsed(-entry.Size())
-					evicted++
-				}
+		entry := c.newEntry(op.Key, op.Value, op.Options)
+		shard.trackAccess(entry)
+		c.insertLocked(shard, entry)
+	}
+	return nil
+}
+
+// lockShards is lockKeys for any number of keys, returning the shard of
+// each key.
+func (c *Cache) lockShards(keys [][]byte) ([]*Shard, func()) {
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i] = hashKey(key)
+	}
+	
+	shards := make([]*Shard, len(keys))
+	for {
+		seen := make(map[*Shard]bool)
+		var locked []*Shard
+		for i, h := range hashes {
+			shards[i] = c.route(h)
+			if !seen[shards[i]] {
+				seen[shards[i]] = true
+				locked = append(locked, shards[i])
 			}
 		}
+		sort.Slice(locked, func(i, j int) bool { return locked[i].id < locked[j].id })
 		
-		shard.mu.Unlock()
+		moved := false
+		for _, shard := range locked {
+			shard.lock()
+			moved = moved || shard.next.Load() != nil
+		}
+		unlock := func() {
+			for i := len(locked) - 1; i >= 0; i-- {
+				locked[i].unlock()
+			}
+		}
+		if !moved {
+			return shards, unlock
+		}
+		unlock()
 	}
+}
+
+// insertLocked inserts entry into shard, replacing any entry with the
+// same key. The caller holds the shard lock.
+func (c *Cache) insertLocked(shard *Shard, entry *Entry) {
+	shard.assignCAS(entry)
+	c.evictIfNeeded(shard, entry.Size())
+	c.forgetSpilled(entry.key)
 	
-	return evicted
+	// Evicted entries have already been taken out of the memory count.
+	if old := shard.m.insert(entry); old != nil && !old.IsEvicted() {
+		shard.addMemUsed(-old.Size())
+	}
+	shard.addMemUsed(entry.Size())
+	shard.indexExpiry(entry.key, entry.expireAt)
+	shard.hooks.store(entry)
+}
+
+func liveEntry(entry *Entry) bool {
+	return entry != nil && !entry.IsEvicted() && !entry.IsExpired()
+}
+
+// Sweep deletes the entries whose TTL has passed, visiting only those
+// entries through each shard's expiration index.
+func (c *Cache) Sweep() int {
+	expired := 0
+	now := time.Now().UnixNano()
+	
+	for shard := range c.allShards() {
+		shard.lock()
+		expired += shard.sweepExpired(now)
+		shard.unlock()
+	}
+	
+	return expired
 }
 
 func (c *Cache) Iterate(fn func(*Entry) bool) {
-	for _, shard := range c.shards {
+	for shard := range c.allShards() {
 		shard.mu.RLock()
 		
 		stop := false
@@ -262,84 +782,105 @@ func (c *Cache) Iterate(fn func(*Entry) bool) {
 	}
 }
 
+// ClearAsync removes every key without waiting for their memory to be
+// freed. Clear already only swaps in empty maps, leaving the old ones to
+// the concurrent garbage collector, so the two are the same for a Cache.
+func (c *Cache) ClearAsync() {
+	c.Clear()
+}
+
 func (c *Cache) Clear() {
-	for _, shard := range c.shards {
-		shard.mu.Lock()
-		shard.m = NewMap(16)
+	for shard := range c.allShards() {
+		shard.lock()
+		shard.setMap(NewMap(16))
+		shard.expiries = nil
 		atomic.StoreInt64(&shard.memUsed, 0)
-		shard.mu.Unlock()
+		shard.unlock()
+	}
+	if c.disk != nil {
+		c.disk.clear()
 	}
 }
 
 func (c *Cache) evictIfNeeded(shard *Shard, requiredSpace int64) {
 	// Don't evict if there's no memory limit
-	if shard.maxMemory <= 0 {
+	if shard.maxMemory <= 0 || shard.MemUsed()+requiredSpace <= shard.maxMemory {
 		return
 	}
-	for shard.MemUsed()+requiredSpace > shard.maxMemory && shard.m.numItems > 0 {
-		entries := shard.m.randomEntries(2)
-		if len(entries) == 0 {
+	
+	start := time.Now()
+	target := c.evictionTarget(shard)
+	evicted := 0
+	for shard.MemUsed()+requiredSpace > target && shard.m.numItems > 0 {
+		toEvict := shard.evictionVictim()
+		if toEvict == nil {
 			break
 		}
 		
-		var toEvict *Entry
-		if len(entries) == 1 {
-			toEvict = entries[0]
-		} else {
-			// Enhanced 2-random eviction: prefer expired entries first
-			entry0Expired := entries[0].IsExpired()
-			entry1Expired := entries[1].IsExpired()
-			
-			if entry0Expired && !entry1Expired {
-				toEvict = entries[0]
-			} else if !entry0Expired && entry1Expired {
-				toEvict = entries[1]
-			} else if entry0Expired && entry1Expired {
-				// Both expired, pick the one expiring soonest
-				if entries[0].ExpireAt() < entries[1].ExpireAt() {
-					toEvict = entries[0]
-				} else {
-					toEvict = entries[1]
-				}
-			} else {
-				// Neither expired, use original 2-random with TTL consideration
-				if entries[0].ExpireAt() > 0 && entries[1].ExpireAt() > 0 {
-					if entries[0].ExpireAt() < entries[1].ExpireAt() {
-						toEvict = entries[0]
-					} else {
-						toEvict = entries[1]
-					}
-				} else if rand.Intn(2) == 0 {
-					toEvict = entries[0]
-				} else {
-					toEvict = entries[1]
-				}
-			}
+		// Spill to disk if there is a tier for it, then take the entry
+		// out of the map. It stays marked as evicted for readers that
+		// found it before it was removed.
+		if c.disk != nil {
+			c.disk.spill(toEvict)
 		}
-		
-		// Mark as evicted and reduce memory usage immediately
 		toEvict.SetEvicted(true)
+		shard.m.delete(toEvict.key, hashKey(toEvict.key))
 		shard.addMemUsed(-toEvict.Size())
 		atomic.AddUint64(&shard.numEvicted, 1)
+		if shard.admission != nil {
+			shard.admission.addGhost(hashKey(toEvict.key))
+		}
+		shard.hooks.evict(toEvict)
+		evicted++
 	}
+	c.recordEvictions(shard, evicted, time.Since(start))
 }
 
-func int64ToBytes(n int64) []byte {
-	b := make([]byte, 8)
-	for i := 7; i >= 0; i-- {
-		b[i] = byte(n)
-		n >>= 8
+// evictionVictim picks the next entry to evict under the shard's policy,
+// or returns nil if there is none.
+func (s *Shard) evictionVictim() *Entry {
+	if s.policy != EvictRandom {
+		return s.evictionCandidate()
 	}
-	return b
-}
-
-func bytesToInt64(b []byte) int64 {
-	if len(b) != 8 {
-		return 0
+	
+	entries := slices.DeleteFunc(s.m.randomEntries(2), (*Entry).Pinned)
+	if len(entries) == 0 {
+		// Sampling from a random bucket finds unpinned entries wherever
+		// they are.
+		entries = s.m.sampleEntries(2)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if len(entries) == 1 {
+		return entries[0]
 	}
-	var n int64
-	for i := 0; i < 8; i++ {
-		n = (n << 8) | int64(b[i])
+	
+	// Enhanced 2-random eviction: prefer expired entries first
+	entry0Expired := entries[0].IsExpired()
+	entry1Expired := entries[1].IsExpired()
+	
+	if entry0Expired && !entry1Expired {
+		return entries[0]
+	} else if !entry0Expired && entry1Expired {
+		return entries[1]
+	} else if entry0Expired && entry1Expired {
+		// Both expired, pick the one expiring soonest
+		if entries[0].ExpireAt() < entries[1].ExpireAt() {
+			return entries[0]
+		}
+		return entries[1]
 	}
-	return n
-}
\ No newline at end of file
+	
+	// Neither expired, use original 2-random with TTL consideration
+	if entries[0].ExpireAt() > 0 && entries[1].ExpireAt() > 0 {
+		if entries[0].ExpireAt() < entries[1].ExpireAt() {
+			return entries[0]
+		}
+		return entries[1]
+	}
+	if rand.Intn(2) == 0 {
+		return entries[0]
+	}
+	return entries[1]
+}
@@ -0,0 +1,64 @@
+package cache
+
+import "errors"
+
+// ErrPinnedLimit is returned by Store when pinning the entry would take
+// the pinned entries of its shard over their share of the limit set with
+// SetMaxPinned.
+var ErrPinnedLimit = errors.New("pinned entries would exceed the pinned memory limit")
+
+// Pinned reports whether the entry was stored with StoreOptions.Pinned,
+// so that it is never evicted.
+func (e *Entry) Pinned() bool {
+	return e.pinned
+}
+
+// SetMaxPinned limits the memory pinned entries may take, in bytes. Each
+// shard allows its share, as with the memory limit. 0, the default, allows
+// half the memory limit, or no limit if the cache has none; a negative
+// limit turns pinning off.
+func (c *Cache) SetMaxPinned(bytes int64) {
+	c.maxPinned.Store(bytes)
+}
+
+// MaxPinned returns the limit on pinned memory, or 0 if there is none.
+func (c *Cache) MaxPinned() int64 {
+	switch limit := c.maxPinned.Load(); {
+	case limit < 0:
+		return 0
+	case limit > 0:
+		return limit
+	default:
+		return c.maxMemory / 2
+	}
+}
+
+// PinnedBytes returns the memory taken by pinned entries.
+func (c *Cache) PinnedBytes() int64 {
+	var total int64
+	for shard := range c.allShards() {
+		shard.mu.RLock()
+		total += shard.m.pinnedBytes
+		shard.mu.RUnlock()
+	}
+	return total
+}
+
+// pinAllowed reports whether entry may be pinned in place of the entry
+// with the same key, if any. The caller holds the shard lock.
+func (c *Cache) pinAllowed(shard *Shard, entry *Entry) bool {
+	if c.maxPinned.Load() < 0 {
+		return false
+	}
+	limit := c.MaxPinned()
+	if limit == 0 {
+		return true
+	}
+	limit /= int64(len(c.table.Load().shards))
+	
+	pinned := shard.m.pinnedBytes
+	if old := shard.m.get(entry.key); old != nil && old.pinned {
+		pinned -= old.Size()
+	}
+	return pinned+entry.Size() <= limit
+}
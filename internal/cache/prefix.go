@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"bytes"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// prefixDelete is a DeletePrefix in progress.
+type prefixDelete struct {
+	prefix  []byte
+	deleted atomic.Int64
+	started time.Time
+	done    chan struct{}
+}
+
+// PrefixDeleteStatus describes a DeletePrefix in progress.
+type PrefixDeleteStatus struct {
+	Prefix  string    `json:"prefix"`
+	Deleted int64     `json:"deleted"`
+	Started time.Time `json:"started"`
+}
+
+// DeletePrefix removes every key starting with prefix in the background
+// and returns a channel that is closed once it is done. Keys are deleted
+// one at a time, each holding only its shard's lock, so other clients are
+// never blocked for longer than a single Delete; PrefixDeletes reports the
+// progress. Keys stored under the prefix while it runs may or may not be
+// deleted.
+func (c *Cache) DeletePrefix(prefix []byte) <-chan struct{} {
+	d := &prefixDelete{
+		prefix:  bytes.Clone(prefix),
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	
+	c.prefixMu.Lock()
+	c.prefixDeletes = append(c.prefixDeletes, d)
+	c.prefixMu.Unlock()
+	
+	go func() {
+		defer close(d.done)
+		
+		if c.disk != nil {
+			d.deleted.Add(int64(c.disk.forgetPrefix(d.prefix)))
+		}
+		c.IterateSnapshot(func(entry *Entry) bool {
+			if bytes.HasPrefix(entry.key, d.prefix) && c.Delete(entry.key) {
+				d.deleted.Add(1)
+			}
+			return true
+		})
+		
+		c.prefixMu.Lock()
+		c.prefixDeletes = slices.DeleteFunc(c.prefixDeletes, func(x *prefixDelete) bool { return x == d })
+		c.prefixMu.Unlock()
+	}()
+	return d.done
+}
+
+// PrefixDeletes reports the DeletePrefix calls still running, oldest
+// first.
+func (c *Cache) PrefixDeletes() []PrefixDeleteStatus {
+	c.prefixMu.Lock()
+	defer c.prefixMu.Unlock()
+	
+	statuses := make([]PrefixDeleteStatus, len(c.prefixDeletes))
+	for i, d := range c.prefixDeletes {
+		statuses[i] = PrefixDeleteStatus{
+			Prefix:  string(d.prefix),
+			Deleted: d.deleted.Load(),
+			Started: d.started,
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// evictionWindow is the period over which a shard measures its
+	// eviction rate and the time it spends evicting.
+	evictionWindow = time.Second
+
+	// DefaultStormThreshold and DefaultBulkPercent are the eviction
+	// storm settings of a new Cache.
+	DefaultStormThreshold = 100 * time.Millisecond
+	DefaultBulkPercent    = 5
+)
+
+// evictionPressure measures how hard a shard works to stay under its
+// memory limit. The window fields are updated under the shard lock; the
+// published rates are read by Stats without it.
+type evictionPressure struct {
+	windowStart int64
+	evicted     uint64
+	busy        int64
+
+	// rate and busyRate are the evictions per second and the nanoseconds
+	// spent evicting per second over the last full window, published
+	// at windowEnd.
+	rate      atomic.Uint64
+	busyRate  atomic.Int64
+	windowEnd atomic.Int64
+
+	// bulk is set while the shard is in an eviction storm and evicts a
+	// share of its memory at once instead of one entry per write.
+	bulk    atomic.Bool
+	numBulk atomic.Uint64
+	busyNs  atomic.Int64
+}
+
+// SetEvictionStorm sets when shards switch to bulk eviction: once a shard
+// spends more than threshold of a second evicting, each eviction frees
+// percent of its memory limit beyond what the write needs, until the
+// time spent falls below half the threshold. Evicting one entry per write
+// near the memory limit makes every write pay for an eviction; evicting
+// in bulk lets most writes through without one. A threshold of 0 turns
+// bulk eviction off.
+func (c *Cache) SetEvictionStorm(threshold time.Duration, percent int) {
+	c.stormThreshold.Store(int64(threshold))
+	c.bulkPercent.Store(int64(min(max(percent, 0), 100)))
+}
+
+// evictionTarget returns the memory use a shard that must evict should
+// bring itself down to.
+func (c *Cache) evictionTarget(shard *Shard) int64 {
+	if !shard.pressure.bulk.Load() {
+		return shard.maxMemory
+	}
+	return shard.maxMemory - shard.maxMemory*c.bulkPercent.Load()/100
+}
+
+// recordEvictions adds n evictions that took d to the shard's window,
+// and, once the window is over, publishes its rates and decides whether
+// the shard is in an eviction storm. The caller holds the shard lock.
+func (c *Cache) recordEvictions(shard *Shard, n int, d time.Duration) {
+	p := &shard.pressure
+	now := time.Now().UnixNano()
+	if p.windowStart == 0 {
+		p.windowStart = now
+	}
+	p.evicted += uint64(n)
+	p.busy += int64(d)
+	p.busyNs.Add(int64(d))
+	if p.bulk.Load() {
+		p.numBulk.Add(1)
+	}
+
+	elapsed := now - p.windowStart
+	if elapsed < int64(evictionWindow) {
+		return
+	}
+	busy := p.busy * int64(time.Second) / elapsed
+	p.rate.Store(p.evicted * uint64(time.Second) / uint64(elapsed))
+	p.busyRate.Store(busy)
+	p.windowEnd.Store(now)
+	p.windowStart, p.evicted, p.busy = now, 0, 0
+
+	threshold := c.stormThreshold.Load()
+	switch {
+	case threshold <= 0:
+		p.bulk.Store(false)
+	case busy > threshold:
+		p.bulk.Store(true)
+	case busy < threshold/2:
+		p.bulk.Store(false)
+	}
+}
+
+// EvictionStats describes how much eviction work a shard, or the whole
+// cache, is doing.
+type EvictionStats struct {
+	// PerSecond is the number of entries evicted per second and Busy
+	// the share of each second spent evicting, both over the last
+	// second in which a shard evicted anything.
+	PerSecond uint64  `json:"evictions_per_sec"`
+	Busy      float64 `json:"eviction_busy"`
+	// Pressure is set while a shard is in an eviction storm and evicts
+	// in bulk; for the whole cache, while any shard is.
+	Pressure bool `json:"eviction_pressure"`
+	// BulkEvictions counts the times a shard evicted in bulk, and Time
+	// is the total time spent evicting.
+	BulkEvictions uint64        `json:"bulk_evictions"`
+	Time          time.Duration `json:"eviction_time_ns"`
+}
+
+// evictionStats reads the shard's eviction pressure. Rates older than two
+// windows are stale: the shard has stopped evicting.
+func (s *Shard) evictionStats(now int64) EvictionStats {
+	p := &s.pressure
+	stats := EvictionStats{
+		BulkEvictions: p.numBulk.Load(),
+		Time:          time.Duration(p.busyNs.Load()),
+	}
+	if now-p.windowEnd.Load() <= int64(2*evictionWindow) {
+		stats.PerSecond = p.rate.Load()
+		stats.Busy = float64(p.busyRate.Load()) / float64(time.Second)
+		stats.Pressure = p.bulk.Load()
+	}
+	return stats
+}
+
+// EvictionStats sums the eviction work of every shard. Busy is that of
+// the busiest shard, since shards evict independently.
+func (c *Cache) EvictionStats() EvictionStats {
+	var total EvictionStats
+	now := time.Now().UnixNano()
+	for shard := range c.allShards() {
+		stats := shard.evictionStats(now)
+		total.PerSecond += stats.PerSecond
+		total.Busy = max(total.Busy, stats.Busy)
+		total.Pressure = total.Pressure || stats.Pressure
+		total.BulkEvictions += stats.BulkEvictions
+		total.Time += stats.Time
+	}
+	return total
+}
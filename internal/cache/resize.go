@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"errors"
+	"iter"
+	"sync/atomic"
+	"time"
+)
+
+// ErrResizing is returned by Resize while an earlier resize is still
+// migrating entries.
+var ErrResizing = errors.New("cache: a resize is already in progress")
+
+// lookupAttempts is how many lock-free probes lookup makes before it
+// takes the read lock.
+const lookupAttempts = 3
+
+// nextShardID numbers shards in creation order, which is the order
+// operations spanning two shards lock them in.
+var nextShardID atomic.Uint64
+
+// shardTable is a set of shards that keys are hashed across.
+type shardTable struct {
+	shards []*Shard
+}
+
+// newShardTable creates n shards sharing c's memory limit, hooks and CAS
+// counter.
+func newShardTable(c *Cache, n int) *shardTable {
+	t := &shardTable{shards: make([]*Shard, n)}
+	for i := range t.shards {
+		t.shards[i] = NewShard(c.maxMemory / int64(n))
+		t.shards[i].index = i
+		t.shards[i].hooks = c.hooks
+		t.shards[i].casSeq = &c.casSeq
+	}
+	return t
+}
+
+// resize is the state of a resize in progress. It is guarded by the
+// cache's resizeMu.
+type resize struct {
+	to       *shardTable
+	from     int
+	migrated int
+	started  time.Time
+}
+
+// ResizeStatus describes a resize in progress.
+type ResizeStatus struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+	// Migrated is the number of old shards whose entries have moved.
+	Migrated int       `json:"migrated"`
+	Started  time.Time `json:"started"`
+}
+
+// route returns the shard a key with hash h belongs to, following
+// migrated shards to their replacements. Without the shard's lock the
+// answer may be stale by the time it is used.
+func (c *Cache) route(h uint64) *Shard {
+	t := c.table.Load()
+	for {
+		shard := t.shards[h%uint64(len(t.shards))]
+		next := shard.next.Load()
+		if next == nil {
+			return shard
+		}
+		t = next
+	}
+}
+
+// lockShard write-locks and returns the shard key belongs to. If the
+// shard was migrated while the caller waited for its lock, the lock is
+// released and the lookup retried on the replacement.
+func (c *Cache) lockShard(key []byte) *Shard {
+	h := hashKey(key)
+	for {
+		shard := c.route(h)
+		shard.lock()
+		if shard.next.Load() == nil {
+			return shard
+		}
+		shard.unlock()
+	}
+}
+
+// rlockShard is lockShard with a read lock.
+func (c *Cache) rlockShard(key []byte) *Shard {
+	h := hashKey(key)
+	for {
+		shard := c.route(h)
+		shard.rlock()
+		if shard.next.Load() == nil {
+			return shard
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+// lookup returns the shard key belongs to and its entry, if any. It
+// first probes the shard without locking and keeps the result if no
+// writer locked the shard meanwhile, so concurrent readers do not contend
+// on the lock. After a few attempts spoiled by writers it falls back to
+// the read lock.
+func (c *Cache) lookup(key []byte) (*Shard, *Entry) {
+	h := hashKey(key)
+	for range lookupAttempts {
+		shard := c.route(h)
+		seq := shard.seq.Load()
+		if seq&1 != 0 || shard.next.Load() != nil {
+			continue
+		}
+		entry := shard.view.Load().lookupConcurrent(key, h)
+		if shard.seq.Load() == seq {
+			return shard, entry
+		}
+	}
+	
+	shard := c.rlockShard(key)
+	entry := shard.m.get(key)
+	shard.mu.RUnlock()
+	return shard, entry
+}
+
+// allShards yields every shard that holds entries: during a resize, the
+// old shards not yet migrated and then the new ones. It holds resizeMu
+// for reading, so no entry moves between shards while the caller
+// iterates; the loop body must not start another whole-cache operation.
+func (c *Cache) allShards() iter.Seq[*Shard] {
+	return func(yield func(*Shard) bool) {
+		c.resizeMu.RLock()
+		defer c.resizeMu.RUnlock()
+		
+		for _, shard := range c.shardList() {
+			if !yield(shard) {
+				return
+			}
+		}
+	}
+}
+
+// shardList returns the shards allShards yields. The caller holds
+// resizeMu for reading.
+func (c *Cache) shardList() []*Shard {
+	var shards []*Shard
+	for _, shard := range c.table.Load().shards {
+		if shard.next.Load() == nil {
+			shards = append(shards, shard)
+		}
+	}
+	if c.resizing != nil {
+		shards = append(shards, c.resizing.to.shards...)
+	}
+	return shards
+}
+
+// NumShards returns the number of shards keys are hashed across. During
+// a resize it is the old count until every entry has moved.
+func (c *Cache) NumShards() int {
+	return len(c.table.Load().shards)
+}
+
+// ResizeStatus reports the progress of a resize, and false if none is
+// running.
+func (c *Cache) ResizeStatus() (ResizeStatus, bool) {
+	c.resizeMu.RLock()
+	defer c.resizeMu.RUnlock()
+	
+	if c.resizing == nil {
+		return ResizeStatus{}, false
+	}
+	return ResizeStatus{
+		From:     c.resizing.from,
+		To:       len(c.resizing.to.shards),
+		Migrated: c.resizing.migrated,
+		Started:  c.resizing.started,
+	}, true
+}
+
+// Resize changes the number of shards to n without taking the cache
+// offline. Entries are migrated in the background one old shard at a
+// time: only keys in the shard being migrated wait, and every other key
+// stays readable and writable throughout. Each new shard gets an equal
+// part of the memory limit. Resize returns once migration has started;
+// ResizeStatus reports its progress.
+func (c *Cache) Resize(n int) error {
+	if n <= 0 {
+		return errors.New("cache: shard count must be positive")
+	}
+	
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+	
+	if c.resizing != nil {
+		return ErrResizing
+	}
+	from := c.table.Load()
+	if len(from.shards) == n {
+		return nil
+	}
+	
+	to := newShardTable(c, n)
+	for _, shard := range to.shards {
+		shard.policy = c.policy
+		if hk := from.shards[0].hotKeys; hk != nil {
+			shard.hotKeys = newHotKeys(hk.capacity)
+		}
+		if from.shards[0].admission != nil {
+			shard.admission = newAdmission()
+		}
+	}
+	c.resizing = &resize{to: to, from: len(from.shards), started: time.Now()}
+	
+	go c.migrate(from, to)
+	return nil
+}
+
+// migrate moves the entries of every shard in from to to, then makes to
+// the table keys are hashed across.
+func (c *Cache) migrate(from, to *shardTable) {
+	for _, shard := range from.shards {
+		c.migrateShard(shard, to)
+	}
+	
+	c.resizeMu.Lock()
+	c.table.Store(to)
+	c.resizing = nil
+	c.resizeMu.Unlock()
+}
+
+// migrateShard moves the live entries of shard into to and redirects
+// later lookups there. Expired entries are dropped rather than moved.
+func (c *Cache) migrateShard(shard *Shard, to *shardTable) {
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+	
+	shard.lock()
+	defer shard.unlock()
+	
+	batches := make([][]*Entry, len(to.shards))
+	shard.m.iter(func(e *Entry) bool {
+		switch {
+		case e.IsEvicted():
+		case e.IsExpired():
+			atomic.AddUint64(&shard.numExpired, 1)
+			shard.hooks.expire(e.key)
+		default:
+			i := hashKey(e.key) % uint64(len(to.shards))
+			batches[i] = append(batches[i], e)
+		}
+		return true
+	})
+	
+	// The moved keys can only be reached through shard, which stays
+	// locked, so each target needs its own lock only while it is filled.
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		target := to.shards[i]
+		target.lock()
+		for _, entry := range batch {
+			target.m.insert(entry)
+			target.addMemUsed(entry.Size())
+			target.indexExpiry(entry.key, entry.ExpireAt())
+		}
+		target.unlock()
+	}
+	
+	// Fold the counters into a new shard so cache-wide totals carry on.
+	heir := to.shards[shard.index%len(to.shards)]
+	atomic.AddUint64(&heir.numOps, atomic.LoadUint64(&shard.numOps))
+	atomic.AddUint64(&heir.numHits, atomic.LoadUint64(&shard.numHits))
+	atomic.AddUint64(&heir.numMisses, atomic.LoadUint64(&shard.numMisses))
+	atomic.AddUint64(&heir.numEvicted, atomic.LoadUint64(&shard.numEvicted))
+	atomic.AddUint64(&heir.numExpired, atomic.LoadUint64(&shard.numExpired))
+	atomic.AddUint64(&heir.numFetches, atomic.LoadUint64(&shard.numFetches))
+	atomic.AddUint64(&heir.numCoalesced, atomic.LoadUint64(&shard.numCoalesced))
+	atomic.AddUint64(&heir.numLockWaits, atomic.LoadUint64(&shard.numLockWaits))
+	atomic.AddInt64(&heir.lockWait, atomic.LoadInt64(&shard.lockWait))
+	
+	shard.setMap(NewMap(16))
+	shard.expiries = nil
+	atomic.StoreInt64(&shard.memUsed, 0)
+	shard.next.Store(to)
+	c.resizing.migrated++
+}
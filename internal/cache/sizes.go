@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+)
+
+// sizeBounds are the upper bounds of the size histogram buckets, in
+// bytes. Entries larger than the last bound fall in a final open bucket.
+var sizeBounds = []int64{
+	64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10,
+	1 << 20, 4 << 20, 16 << 20, 64 << 20,
+}
+
+// SizeBucket counts the entries whose size is at most Max and above the
+// previous bucket's Max. The last bucket has Max -1 and is unbounded.
+type SizeBucket struct {
+	Max   int64 `json:"max"`
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// BigKey is one of the largest entries found by SizeReport. Size is the
+// entry's estimated memory use, as counted against maxmemory.
+type BigKey struct {
+	Key   string `json:"key"`
+	Size  int64  `json:"size"`
+	Shard int    `json:"shard"`
+}
+
+// SizeReport describes how memory is spread over the entries of a cache.
+type SizeReport struct {
+	Keys      int          `json:"keys"`
+	Bytes     int64        `json:"bytes"`
+	Histogram []SizeBucket `json:"histogram"`
+	Largest   []BigKey     `json:"largest"`
+	// ShardMaxMemory is the memory limit of each shard, 0 if unlimited.
+	ShardMaxMemory int64 `json:"shard_max_memory"`
+}
+
+// SizeReport scans the cache and returns a histogram of entry sizes and
+// its n largest entries. The scan holds each shard's read lock in turn,
+// so it is meant for diagnostics rather than frequent polling.
+func (c *Cache) SizeReport(n int) *SizeReport {
+	return c.sizeReport(n, nil)
+}
+
+func (c *Cache) sizeReport(n int, prefix []byte) *SizeReport {
+	report := &SizeReport{
+		Histogram: make([]SizeBucket, len(sizeBounds)+1),
+	}
+	report.ShardMaxMemory = c.table.Load().shards[0].maxMemory
+	for i, bound := range sizeBounds {
+		report.Histogram[i].Max = bound
+	}
+	report.Histogram[len(sizeBounds)].Max = -1
+	
+	var largest bigKeyHeap
+	for shard := range c.allShards() {
+		i := shard.index
+		shard.mu.RLock()
+		
+		shard.m.iter(func(e *Entry) bool {
+			if e.IsExpired() || e.IsEvicted() || !bytes.HasPrefix(e.key, prefix) {
+				return true
+			}
+			size := e.Size()
+			
+			report.Keys++
+			report.Bytes += size
+			bucket := sort.Search(len(sizeBounds), func(i int) bool { return size <= sizeBounds[i] })
+			report.Histogram[bucket].Keys++
+			report.Histogram[bucket].Bytes += size
+			
+			if n <= 0 {
+				return true
+			}
+			if len(largest) < n {
+				heap.Push(&largest, BigKey{Key: string(e.key[len(prefix):]), Size: size, Shard: i})
+			} else if size > largest[0].Size {
+				largest[0] = BigKey{Key: string(e.key[len(prefix):]), Size: size, Shard: i}
+				heap.Fix(&largest, 0)
+			}
+			return true
+		})
+		
+		shard.mu.RUnlock()
+	}
+	
+	report.Largest = []BigKey(largest)
+	if report.Largest == nil {
+		report.Largest = []BigKey{}
+	}
+	sort.Slice(report.Largest, func(i, j int) bool {
+		return report.Largest[i].Size > report.Largest[j].Size
+	})
+	return report
+}
+
+// bigKeyHeap is a min-heap of the largest entries seen so far.
+type bigKeyHeap []BigKey
+
+func (h bigKeyHeap) Len() int           { return len(h) }
+func (h bigKeyHeap) Less(i, j int) bool { return h[i].Size < h[j].Size }
+func (h bigKeyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *bigKeyHeap) Push(x any)        { *h = append(*h, x.(BigKey)) }
+func (h *bigKeyHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SetSlidingPrefixes makes the TTL of every key under one of prefixes
+// slide, as if stored with StoreOptions.Sliding. Keys already stored keep
+// the mode they were stored with. Call it before the cache is in use.
+func (c *Cache) SetSlidingPrefixes(prefixes []string) {
+	c.slidingPrefixes.Store(&prefixes)
+}
+
+// slides reports whether a key stored with opts gets a sliding TTL.
+func (c *Cache) slides(key []byte, opts *StoreOptions) bool {
+	if opts == nil || opts.TTL <= 0 {
+		return false
+	}
+	if opts.Sliding {
+		return true
+	}
+	if prefixes := c.slidingPrefixes.Load(); prefixes != nil {
+		for _, prefix := range *prefixes {
+			if strings.HasPrefix(string(key), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newEntry builds the entry Store and the other writes insert for key.
+func (c *Cache) newEntry(key, value []byte, opts *StoreOptions) *Entry {
+	entry := newEntry(key, value, opts)
+	if c.slides(key, opts) {
+		entry.slide = int64(opts.TTL)
+	}
+	return entry
+}
+
+// SlidingTTL returns the TTL the entry's expiration is extended by each
+// time it is read, or 0 if its TTL is fixed.
+func (e *Entry) SlidingTTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&e.slide))
+}
+
+// extend pushes back the expiration of an entry with a sliding TTL after a
+// read. The shard's expiration index is left as it is: the sweeper finds
+// the entry there at its old time and indexes it again.
+func (e *Entry) extend() {
+	if slide := atomic.LoadInt64(&e.slide); slide > 0 {
+		atomic.StoreInt64(&e.expireAt, time.Now().UnixNano()+slide)
+	}
+}
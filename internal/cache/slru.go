@@ -0,0 +1,55 @@
+package cache
+
+const (
+	// slruSamples is the number of entries an SLRU shard samples. It is
+	// larger than for the other policies, so that a sample of protected
+	// entries alone is unlikely until protected entries fill nearly the
+	// whole shard.
+	slruSamples = 16
+	// slruDemotions is how many times an SLRU shard that samples only
+	// protected entries demotes the least recently used of them and
+	// samples again before evicting a protected entry.
+	slruDemotions = 2
+)
+
+// slruCandidate picks the entry to evict under EvictSLRU: the least
+// recently accessed probation entry of a sample. Keys stored by a scan and
+// never read again stay in probation, so they are evicted before the
+// working set, which has been accessed again and is protected. A sample of
+// protected entries alone means the protected segment has grown to
+// nearly the whole shard; its least recently used entry is demoted to
+// probation, where it gets a last chance to be accessed, and the shard
+// samples again.
+func (s *Shard) slruCandidate() *Entry {
+	var oldest *Entry
+	for attempt := 0; attempt <= slruDemotions; attempt++ {
+		var victim *Entry
+		oldest = nil
+		for _, entry := range s.m.sampleEntries(slruSamples) {
+			if entry.IsExpired() {
+				return entry
+			}
+			a := entry.access()
+			if a == nil {
+				// Stored before the policy was set: the oldest possible.
+				return entry
+			}
+			
+			last := a.lastAccess.Load()
+			if !a.protected.Load() {
+				if victim == nil || last < victim.access().lastAccess.Load() {
+					victim = entry
+				}
+			} else if oldest == nil || last < oldest.access().lastAccess.Load() {
+				oldest = entry
+			}
+		}
+		if victim != nil || oldest == nil {
+			return victim
+		}
+		if attempt < slruDemotions {
+			oldest.access().protected.Store(false)
+		}
+	}
+	return oldest
+}
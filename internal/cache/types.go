@@ -11,10 +11,14 @@ type Entry struct {
 	key        []byte
 	value      []byte
 	expireAt   int64
+	softExpire int64
 	flags      uint32
 	cas        uint64
 	metadata   unsafe.Pointer
 	evicted    bool
+	pinned     bool
+	// slide is the sliding TTL in nanoseconds; see SlidingTTL.
+	slide int64
 }
 
 func (e *Entry) Key() []byte {
@@ -33,10 +37,27 @@ func (e *Entry) ExpireAt() int64 {
 	return atomic.LoadInt64(&e.expireAt)
 }
 
+// SetExpireAt changes the expiration time of an entry without updating
+// its shard's expiration index, so the sweeper will not remove it when it
+// expires. Use Cache.Expire to change the TTL of a stored key.
 func (e *Entry) SetExpireAt(t int64) {
 	atomic.StoreInt64(&e.expireAt, t)
 }
 
+// SoftExpireAt returns the time, in Unix nanoseconds, after which the
+// entry should be refreshed, or 0 if it has no soft TTL.
+func (e *Entry) SoftExpireAt() int64 {
+	return atomic.LoadInt64(&e.softExpire)
+}
+
+// NeedsRefresh reports whether the entry's soft TTL has passed. The entry
+// is still served until its hard TTL; callers use this as a hint to
+// reload the value in the background.
+func (e *Entry) NeedsRefresh() bool {
+	softExpire := e.SoftExpireAt()
+	return softExpire > 0 && softExpire < time.Now().UnixNano()
+}
+
 func (e *Entry) IsExpired() bool {
 	expireAt := e.ExpireAt()
 	return expireAt > 0 && expireAt < time.Now().UnixNano()
@@ -54,10 +75,6 @@ func (e *Entry) CAS() uint64 {
 	return atomic.LoadUint64(&e.cas)
 }
 
-func (e *Entry) IncrementCAS() uint64 {
-	return atomic.AddUint64(&e.cas, 1)
-}
-
 func (e *Entry) IsEvicted() bool {
 	return e.evicted
 }
@@ -70,10 +87,26 @@ func (e *Entry) Size() int64 {
 	return int64(len(e.key) + len(e.value) + 24)
 }
 
+// Bucket is a slot of a shard's hash table. Its fields are atomic because
+// lock-free readers probe buckets while a writer holding the shard lock
+// moves entries between them.
 type Bucket struct {
-	entry    *Entry
-	hash     uint64
-	distance uint16
+	entry    atomic.Pointer[Entry]
+	hash     atomic.Uint64
+	distance atomic.Uint32
+}
+
+// set fills the bucket. The caller holds the shard's write lock.
+func (b *Bucket) set(entry *Entry, hash uint64, distance uint32) {
+	b.hash.Store(hash)
+	b.distance.Store(distance)
+	b.entry.Store(entry)
+}
+
+// bucketCopy is what collect copies out of a bucket.
+type bucketCopy struct {
+	entry *Entry
+	hash  uint64
 }
 
 type Map struct {
@@ -82,6 +115,13 @@ type Map struct {
 	mask     uint64
 	growAt   int
 	shrinkAt int
+	
+	// pinnedBytes is the size of the pinned entries.
+	pinnedBytes int64
+	
+	// view publishes buckets to readers that do not hold the shard
+	// lock, so they never see a torn slice header.
+	view atomic.Pointer[[]Bucket]
 }
 
 func NewMap(initialSize int) *Map {
@@ -90,30 +130,131 @@ func NewMap(initialSize int) *Map {
 		size *= 2
 	}
 	
-	return &Map{
+	m := &Map{
 		buckets:  make([]Bucket, size),
 		mask:     uint64(size - 1),
 		growAt:   int(float64(size) * 0.75),
 		shrinkAt: int(float64(size) * 0.10),
 	}
+	m.view.Store(&m.buckets)
+	
+	return m
 }
 
 type Shard struct {
-	mu          sync.RWMutex
-	m           *Map
-	memUsed     int64
-	maxMemory   int64
-	numOps      uint64
-	numHits     uint64
-	numMisses   uint64
-	numEvicted  uint64
-	numExpired  uint64
+	mu         sync.RWMutex
+	m          *Map
+	memUsed    int64
+	maxMemory  int64
+	numOps     uint64
+	numHits    uint64
+	numMisses  uint64
+	numEvicted uint64
+	numExpired uint64
+	hotKeys    *hotKeys
+	admission  *admission
+	
+	// view publishes m to lock-free readers.
+	view atomic.Pointer[Map]
+	
+	// seq is odd while the shard is write-locked and changes with every
+	// write lock, so lock-free readers can tell whether a writer ran
+	// while they looked.
+	seq atomic.Uint64
+	
+	// numLockWaits counts the lookups that found the shard locked, and
+	// lockWait sums how long they waited in nanoseconds.
+	numLockWaits uint64
+	lockWait     int64
+	
+	pressure evictionPressure
+	
+	policy   EvictionPolicy
+	expiries expiryIndex
+	hooks    *hookRegistry
+	
+	// id orders shards for locking, and index is the shard's position
+	// in its table. next is set once a resize has moved the shard's
+	// entries to another table.
+	id    uint64
+	index int
+	next  atomic.Pointer[shardTable]
+	
+	// casSeq is the cache-wide CAS counter, shared by every shard.
+	casSeq *atomic.Uint64
+	
+	flightMu     sync.Mutex
+	flights      map[string]*flight
+	numFetches   uint64
+	numCoalesced uint64
 }
 
 func NewShard(maxMemory int64) *Shard {
-	return &Shard{
-		m:         NewMap(16),
+	s := &Shard{
 		maxMemory: maxMemory,
+		id:        nextShardID.Add(1),
+	}
+	s.setMap(NewMap(16))
+	return s
+}
+
+// setMap replaces the shard's map. The caller holds the write lock, or
+// owns a shard no one else has seen yet.
+func (s *Shard) setMap(m *Map) {
+	s.m = m
+	s.view.Store(m)
+}
+
+// lock write-locks the shard, recording the wait if it was held.
+func (s *Shard) lock() {
+	if !s.mu.TryLock() {
+		start := time.Now()
+		s.mu.Lock()
+		s.recordWait(start)
+	}
+	s.seq.Add(1)
+}
+
+func (s *Shard) unlock() {
+	s.seq.Add(1)
+	s.mu.Unlock()
+}
+
+// rlock read-locks the shard, recording the wait if it was write-locked.
+func (s *Shard) rlock() {
+	if s.mu.TryRLock() {
+		return
+	}
+	start := time.Now()
+	s.mu.RLock()
+	s.recordWait(start)
+}
+
+func (s *Shard) recordWait(start time.Time) {
+	atomic.AddUint64(&s.numLockWaits, 1)
+	atomic.AddInt64(&s.lockWait, int64(time.Since(start)))
+}
+
+// nextCAS returns a CAS token higher than any handed out before in the
+// cache.
+func (s *Shard) nextCAS() uint64 {
+	return s.casSeq.Add(1)
+}
+
+// assignCAS gives a new entry the next CAS token. An entry that already
+// has one, restored from a snapshot or log, keeps it, and later tokens
+// are raised past it so they cannot collide. The caller holds the shard
+// lock.
+func (s *Shard) assignCAS(entry *Entry) {
+	if entry.cas == 0 {
+		entry.cas = s.nextCAS()
+		return
+	}
+	for {
+		last := s.casSeq.Load()
+		if last >= entry.cas || s.casSeq.CompareAndSwap(last, entry.cas) {
+			return
+		}
 	}
 }
 
@@ -146,9 +287,40 @@ func (s *Shard) NumExpired() uint64 {
 }
 
 type Cache struct {
-	shards    []*Shard
-	numShards int
+	table     atomic.Pointer[shardTable]
 	maxMemory int64
+	policy    EvictionPolicy
+	hooks     *hookRegistry
+	
+	// resizeMu is held for writing while a resize moves a shard's
+	// entries, and for reading by operations that visit every shard.
+	resizeMu sync.RWMutex
+	resizing *resize
+	
+	// casSeq is the last CAS token handed out by any shard.
+	casSeq atomic.Uint64
+	
+	maxKeySize   atomic.Int64
+	maxValueSize atomic.Int64
+	
+	activeExpireOff atomic.Bool
+	
+	// stormThreshold and bulkPercent are set by SetEvictionStorm.
+	stormThreshold atomic.Int64
+	bulkPercent    atomic.Int64
+	
+	// maxPinned is set by SetMaxPinned.
+	maxPinned atomic.Int64
+	
+	// slidingPrefixes is set by SetSlidingPrefixes.
+	slidingPrefixes atomic.Pointer[[]string]
+	
+	// disk is the overflow tier set up by EnableDiskTier, if any.
+	disk *diskTier
+	
+	// prefixDeletes are the DeletePrefix calls still running.
+	prefixMu      sync.Mutex
+	prefixDeletes []*prefixDelete
 }
 
 func New(numShards int, maxMemory int64) *Cache {
@@ -156,28 +328,31 @@ func New(numShards int, maxMemory int64) *Cache {
 		numShards = 16
 	}
 	
-	shards := make([]*Shard, numShards)
-	shardMaxMem := maxMemory / int64(numShards)
-	
-	for i := 0; i < numShards; i++ {
-		shards[i] = NewShard(shardMaxMem)
-	}
-	
-	return &Cache{
-		shards:    shards,
-		numShards: numShards,
+	c := &Cache{
 		maxMemory: maxMemory,
+		hooks:     &hookRegistry{},
 	}
+	c.table.Store(newShardTable(c, numShards))
+	c.SetEvictionStorm(DefaultStormThreshold, DefaultBulkPercent)
+	
+	return c
 }
 
 func (c *Cache) getShard(key []byte) *Shard {
-	h := hashKey(key)
-	return c.shards[h%uint64(c.numShards)]
+	return c.route(hashKey(key))
+}
+
+func (c *Cache) shardIndex(key []byte) int {
+	return c.getShard(key).index
+}
+
+func (c *Cache) MaxMemory() int64 {
+	return c.maxMemory
 }
 
 func (c *Cache) MemUsed() int64 {
 	var total int64
-	for _, shard := range c.shards {
+	for shard := range c.allShards() {
 		total += shard.MemUsed()
 	}
 	return total
@@ -185,7 +360,7 @@ func (c *Cache) MemUsed() int64 {
 
 func (c *Cache) NumItems() int {
 	var total int
-	for _, shard := range c.shards {
+	for shard := range c.allShards() {
 		shard.mu.RLock()
 		total += shard.m.numItems
 		shard.mu.RUnlock()
@@ -193,40 +368,145 @@ func (c *Cache) NumItems() int {
 	return total
 }
 
-func (c *Cache) Stats() map[string]interface{} {
-	stats := make(map[string]interface{})
+// ShardStats describes the contents and counters of a single shard.
+type ShardStats struct {
+	Shard   int    `json:"shard"`
+	Items   int    `json:"items"`
+	MemUsed int64  `json:"mem_used"`
+	Ops     uint64 `json:"ops"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Evicted uint64 `json:"evicted"`
+	Expired uint64 `json:"expired"`
+	// LockWaits counts the key lookups that had to wait for the shard's
+	// lock, and LockWait is their total wait.
+	LockWaits uint64        `json:"lock_waits"`
+	LockWait  time.Duration `json:"lock_wait_ns"`
+	Eviction  EvictionStats `json:"eviction"`
+}
+
+func (c *Cache) ShardStats() []ShardStats {
+	return c.Stats().Shards
+}
+
+// stats reads the shard's contents and counters under its read lock, so
+// that its item count and memory agree with each other.
+func (s *Shard) stats(now int64) ShardStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	
-	var ops, hits, misses, evicted, expired uint64
-	var memUsed int64
-	var numItems int
+	return ShardStats{
+		Shard:     s.index,
+		Items:     s.m.numItems,
+		MemUsed:   s.MemUsed(),
+		Ops:       s.NumOps(),
+		Hits:      s.NumHits(),
+		Misses:    s.NumMisses(),
+		Evicted:   s.NumEvicted(),
+		Expired:   s.NumExpired(),
+		LockWaits: atomic.LoadUint64(&s.numLockWaits),
+		LockWait:  time.Duration(atomic.LoadInt64(&s.lockWait)),
+		Eviction:  s.evictionStats(now),
+	}
+}
+
+// Stats is a snapshot of the cache's contents and counters. The totals
+// are the sums of the per-shard figures in Shards, read in one pass, so
+// they always agree; the JSON names are those of GET /stats.
+type Stats struct {
+	Items     int     `json:"num_items"`
+	MemUsed   int64   `json:"mem_used"`
+	MaxMemory int64   `json:"max_memory"`
+	Ops       uint64  `json:"num_ops"`
+	Hits      uint64  `json:"num_hits"`
+	Misses    uint64  `json:"num_misses"`
+	HitRate   float64 `json:"hit_rate"`
+	Evicted   uint64  `json:"num_evicted"`
+	Expired   uint64  `json:"num_expired"`
+	// EvictionPolicy is the name --evict takes.
+	EvictionPolicy string `json:"eviction_policy"`
+	// Fetches counts the loads from an origin and Coalesced the
+	// lookups that waited for another's load instead.
+	Fetches   uint64        `json:"num_fetches"`
+	Coalesced uint64        `json:"num_coalesced"`
+	LockWaits uint64        `json:"num_lock_waits"`
+	LockWait  time.Duration `json:"lock_wait_ns"`
+	// AdmissionRejected and GhostHits count the writes the admission
+	// filter turned away and those it let in because the key had been
+	// evicted recently.
+	AdmissionRejected uint64 `json:"num_admission_rejected"`
+	GhostHits         uint64 `json:"num_ghost_hits"`
+	PinnedBytes       int64  `json:"pinned_bytes"`
+	MaxPinned         int64  `json:"max_pinned"`
+	DiskKeys          int    `json:"disk_keys"`
+	DiskBytes         int64  `json:"disk_bytes"`
+	Spilled           uint64 `json:"num_spilled"`
+	Restored          uint64 `json:"num_restored"`
+	// The eviction figures are those of EvictionStats.
+	EvictionsPerSec  uint64        `json:"evictions_per_sec"`
+	EvictionBusy     float64       `json:"eviction_busy"`
+	EvictionPressure bool          `json:"eviction_pressure"`
+	BulkEvictions    uint64        `json:"num_bulk_evictions"`
+	EvictionTime     time.Duration `json:"eviction_time_ns"`
+	Shards           []ShardStats  `json:"shards"`
+}
+
+// Stats returns a snapshot of the cache's contents and counters.
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		MaxMemory:      c.maxMemory,
+		EvictionPolicy: c.policy.String(),
+		PinnedBytes:    c.PinnedBytes(),
+		MaxPinned:      c.MaxPinned(),
+	}
+	now := time.Now().UnixNano()
 	
-	for _, shard := range c.shards {
-		ops += shard.NumOps()
-		hits += shard.NumHits()
-		misses += shard.NumMisses()
-		evicted += shard.NumEvicted()
-		expired += shard.NumExpired()
-		memUsed += shard.MemUsed()
+	for shard := range c.allShards() {
+		s := shard.stats(now)
+		stats.Shards = append(stats.Shards, s)
 		
-		shard.mu.RLock()
-		numItems += shard.m.numItems
-		shard.mu.RUnlock()
+		stats.Items += s.Items
+		stats.MemUsed += s.MemUsed
+		stats.Ops += s.Ops
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+		stats.Evicted += s.Evicted
+		stats.Expired += s.Expired
+		stats.LockWaits += s.LockWaits
+		stats.LockWait += s.LockWait
+		stats.EvictionsPerSec += s.Eviction.PerSecond
+		stats.EvictionBusy = max(stats.EvictionBusy, s.Eviction.Busy)
+		stats.EvictionPressure = stats.EvictionPressure || s.Eviction.Pressure
+		stats.BulkEvictions += s.Eviction.BulkEvictions
+		stats.EvictionTime += s.Eviction.Time
+		
+		stats.Fetches += atomic.LoadUint64(&shard.numFetches)
+		stats.Coalesced += atomic.LoadUint64(&shard.numCoalesced)
+		if shard.admission != nil {
+			stats.AdmissionRejected += shard.admission.numRejected.Load()
+			stats.GhostHits += shard.admission.numGhostHits.Load()
+		}
 	}
 	
-	stats["num_items"] = numItems
-	stats["mem_used"] = memUsed
-	stats["max_memory"] = c.maxMemory
-	stats["num_ops"] = ops
-	stats["num_hits"] = hits
-	stats["num_misses"] = misses
-	stats["num_evicted"] = evicted
-	stats["num_expired"] = expired
-	
-	if ops > 0 {
-		stats["hit_rate"] = float64(hits) / float64(hits+misses)
-	} else {
-		stats["hit_rate"] = 0.0
+	if disk, ok := c.DiskTierStats(); ok {
+		stats.DiskKeys = disk.Keys
+		stats.DiskBytes = disk.Bytes
+		stats.Spilled = disk.Spilled
+		stats.Restored = disk.Restored
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
 	}
 	
 	return stats
-}
\ No newline at end of file
+}
+
+// LockWait returns the total time lookups in every shard have waited for
+// the shard's lock.
+func (c *Cache) LockWait() time.Duration {
+	var wait int64
+	for shard := range c.allShards() {
+		wait += atomic.LoadInt64(&shard.lockWait)
+	}
+	return time.Duration(wait)
+}
@@ -0,0 +1,240 @@
+// Package client is a minimal RESP client used by the gopogo subcommands
+// to talk to gopogo and Redis servers.
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Client is a connection to a RESP server. Replies are decoded as
+// string (simple strings), []byte (bulk strings), int64, nil, Error or
+// []interface{}. A Client is not safe for concurrent use.
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// Options configures Dial.
+type Options struct {
+	Username string
+	Password string
+	DB       int
+	TLS      *tls.Config
+	Timeout  time.Duration
+}
+
+func Dial(addr string, opts *Options) (*Client, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	var conn net.Conn
+	var err error
+	if strings.HasPrefix(addr, "/") {
+		conn, err = dialer.Dial("unix", addr)
+	} else if opts.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, opts.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+
+	if opts.Password != "" {
+		args := []string{"AUTH", opts.Password}
+		if opts.Username != "" {
+			args = []string{"AUTH", opts.Username, opts.Password}
+		}
+		if _, err := c.Do(args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("auth failed: %w", err)
+		}
+	}
+
+	if opts.DB != 0 {
+		if _, err := c.Do("SELECT", strconv.Itoa(opts.DB)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("select failed: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// DialURL connects to a redis:// or rediss:// URL of the form
+// redis://[user:password@]host[:port][/db].
+func DialURL(rawURL string, timeout time.Duration) (*Client, error) {
+	addr, opts, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	opts.Timeout = timeout
+	return Dial(addr, opts)
+}
+
+func ParseURL(rawURL string) (string, *Options, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	opts := &Options{}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		opts.TLS = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return "", nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+		// redis://:password@host carries no user name.
+		if opts.Password == "" {
+			opts.Password, opts.Username = opts.Username, ""
+		}
+	}
+
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		opts.DB, err = strconv.Atoi(db)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	return host, opts, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// SetDeadline sets the read and write deadline of the connection.
+func (c *Client) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// Do sends a command and returns its reply. Error replies are returned
+// as an Error.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	return c.Receive()
+}
+
+// Send buffers a command without waiting for its reply, for pipelining.
+func (c *Client) Send(args ...string) error {
+	c.writer.WriteString("*")
+	c.writer.WriteString(strconv.Itoa(len(args)))
+	c.writer.WriteString("\r\n")
+	for _, arg := range args {
+		c.writer.WriteString("$")
+		c.writer.WriteString(strconv.Itoa(len(arg)))
+		c.writer.WriteString("\r\n")
+		c.writer.WriteString(arg)
+		c.writer.WriteString("\r\n")
+	}
+	return nil
+}
+
+func (c *Client) Flush() error {
+	return c.writer.Flush()
+}
+
+// Receive reads one reply. An error reply is returned as the error.
+func (c *Client) Receive() (interface{}, error) {
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+var errMalformed = errors.New("malformed reply")
+
+func (c *Client) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errMalformed
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return Error(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errMalformed
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errMalformed
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, errMalformed
+	}
+}
@@ -0,0 +1,75 @@
+// Package clients tracks the connections currently served by the server.
+package clients
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Client describes a connected client.
+type Client struct {
+	ID          uint64    `json:"id"`
+	Addr        string    `json:"addr"`
+	LocalAddr   string    `json:"local_addr"`
+	Protocol    string    `json:"protocol"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// Registry is a concurrency-safe set of connected clients.
+type Registry struct {
+	mu      sync.RWMutex
+	nextID  uint64
+	clients map[uint64]*Client
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		clients: make(map[uint64]*Client),
+	}
+}
+
+// Add registers a connection and returns its client record.
+func (r *Registry) Add(conn net.Conn, protocol string) *Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	c := &Client{
+		ID:          r.nextID,
+		Addr:        conn.RemoteAddr().String(),
+		LocalAddr:   conn.LocalAddr().String(),
+		Protocol:    protocol,
+		ConnectedAt: time.Now(),
+	}
+	r.clients[c.ID] = c
+	return c
+}
+
+func (r *Registry) Remove(c *Client) {
+	r.mu.Lock()
+	delete(r.clients, c.ID)
+	r.mu.Unlock()
+}
+
+func (r *Registry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.clients)
+}
+
+// List returns a snapshot of the connected clients ordered by ID.
+func (r *Registry) List() []Client {
+	r.mu.RLock()
+	list := make([]Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		list = append(list, *c)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
@@ -0,0 +1,73 @@
+// Package health serves the /healthz and /readyz endpoints used by
+// liveness and readiness probes.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Listener is the state of one of the server's listeners.
+type Listener struct {
+	Addr string `json:"addr"`
+	Open bool   `json:"open"`
+}
+
+// Memory reports how close the cache is to its memory limit. Pressure is
+// Used/Max, or 0 without a limit.
+type Memory struct {
+	Used     int64   `json:"used"`
+	Max      int64   `json:"max"`
+	Pressure float64 `json:"pressure"`
+}
+
+// Replication mirrors the replication section of INFO.
+type Replication struct {
+	Role              string `json:"role"`
+	ConnectedReplicas int    `json:"connected_replicas"`
+}
+
+// Status is the body of both endpoints. The server is live while it is
+// running and ready while it is also accepting connections on every
+// listener; Reason says why it is not.
+type Status struct {
+	Live        bool        `json:"live"`
+	Ready       bool        `json:"ready"`
+	Reason      string      `json:"reason,omitempty"`
+	Listeners   []Listener  `json:"listeners"`
+	Memory      Memory      `json:"memory"`
+	Replication Replication `json:"replication"`
+}
+
+// IsPath reports whether path is served by Register. These endpoints
+// skip authentication so that probes need no credentials.
+func IsPath(path string) bool {
+	return path == "/healthz" || path == "/readyz"
+}
+
+// Register adds GET /healthz and GET /readyz to mux. Each answers 200
+// when the server is live or ready respectively and 503 otherwise, with
+// the Status as JSON.
+func Register(mux *http.ServeMux, check func() *Status) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		status := check()
+		write(w, status, status.Live)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		status := check()
+		write(w, status, status.Ready)
+	})
+}
+
+func write(w http.ResponseWriter, status *Status, ok bool) {
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	body, _ := json.Marshal(status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(body)
+}
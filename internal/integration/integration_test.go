@@ -0,0 +1,298 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/server"
+)
+
+// addrs are the addresses a test server listens on: the port shared by
+// every protocol, told apart by detection, and each protocol's own port.
+type addrs struct {
+	shared, redis, memcache, http, postgres string
+}
+
+// freePort returns a port nothing is listening on. Another process could
+// take it before the server does, but not in practice on loopback.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startServer runs a server with every protocol enabled, as gopogo runs
+// by default, and waits until all its ports accept connections.
+func startServer(t *testing.T) addrs {
+	t.Helper()
+
+	config := &server.Config{
+		Host:         "127.0.0.1",
+		Port:         freePort(t),
+		RedisPort:    freePort(t),
+		MemcachePort: freePort(t),
+		HTTPPort:     freePort(t),
+		PostgresPort: freePort(t),
+		Redis:        true,
+		Memcache:     true,
+		HTTP:         true,
+		Postgres:     true,
+		Quiet:        true,
+		Cache:        cache.New(16, 0),
+	}
+	s := server.New(config)
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	t.Cleanup(func() {
+		s.Stop()
+		<-done
+	})
+
+	addr := func(port int) string { return net.JoinHostPort(config.Host, strconv.Itoa(port)) }
+	a := addrs{
+		shared:   addr(config.Port),
+		redis:    addr(config.RedisPort),
+		memcache: addr(config.MemcachePort),
+		http:     addr(config.HTTPPort),
+		postgres: addr(config.PostgresPort),
+	}
+	for _, address := range []string{a.shared, a.redis, a.memcache, a.http, a.postgres} {
+		waitListening(t, address, done)
+	}
+	return a
+}
+
+func waitListening(t *testing.T, address string, done <-chan error) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("server stopped: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not listening: %v", address, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// clients holds a client of each protocol, connected to one server.
+type clients struct {
+	redis    *redis.Client
+	memcache *memcache.Client
+	postgres *sql.DB
+	http     string
+}
+
+func connect(t *testing.T, redisAddr, memcacheAddr, httpAddr, postgresAddr string) *clients {
+	t.Helper()
+
+	c := &clients{
+		redis:    redis.NewClient(&redis.Options{Addr: redisAddr, Protocol: 2}),
+		memcache: memcache.New(memcacheAddr),
+		http:     "http://" + httpAddr,
+	}
+	t.Cleanup(func() { c.redis.Close() })
+	t.Cleanup(func() { c.memcache.Close() })
+
+	db, err := sql.Open("postgres", "postgres://test@"+postgresAddr+"/gopogo?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	c.postgres = db
+	return c
+}
+
+// httpGet returns the value of key over HTTP, or "" and false if there is
+// none.
+func (c *clients) httpGet(t *testing.T, key string) (string, bool) {
+	t.Helper()
+
+	resp, err := http.Get(c.http + "/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return string(body), true
+	case http.StatusNotFound:
+		return "", false
+	}
+	t.Fatalf("GET /%s: %s: %s", key, resp.Status, body)
+	return "", false
+}
+
+func (c *clients) httpPut(t *testing.T, key, value string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPut, c.http+"/"+key, strings.NewReader(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		t.Fatalf("PUT /%s: %s", key, resp.Status)
+	}
+}
+
+// postgresGet returns the value of key id in table over PostgreSQL.
+func (c *clients) postgresGet(t *testing.T, table, id string) (string, bool) {
+	t.Helper()
+
+	var key, value string
+	err := c.postgres.QueryRow("SELECT * FROM "+table+" WHERE key = $1", id).Scan(&key, &value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatalf("SELECT %s:%s: %v", table, id, err)
+	}
+	return value, true
+}
+
+func (c *clients) memcacheGet(t *testing.T, key string) (string, bool) {
+	t.Helper()
+
+	item, err := c.memcache.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatalf("memcache get %s: %v", key, err)
+	}
+	return string(item.Value), true
+}
+
+func (c *clients) redisGet(t *testing.T, key string) (string, bool) {
+	t.Helper()
+
+	value, err := c.redis.Get(context.Background(), key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatalf("redis GET %s: %v", key, err)
+	}
+	return value, true
+}
+
+// tableKey returns the key PostgreSQL stores row id of table under: the
+// table name, upper-cased with the rest of the query, a colon and the id.
+func tableKey(table, id string) string {
+	return strings.ToUpper(table) + ":" + id
+}
+
+// checkEverywhere checks that every protocol reads the same value for row
+// id of table, or that none finds it if want is "".
+func (c *clients) checkEverywhere(t *testing.T, table, id, want string) {
+	t.Helper()
+
+	key := tableKey(table, id)
+	for name, get := range map[string]func() (string, bool){
+		"redis":    func() (string, bool) { return c.redisGet(t, key) },
+		"memcache": func() (string, bool) { return c.memcacheGet(t, key) },
+		"http":     func() (string, bool) { return c.httpGet(t, key) },
+		"postgres": func() (string, bool) { return c.postgresGet(t, table, id) },
+	} {
+		got, ok := get()
+		if want == "" && ok {
+			t.Errorf("%s: %s = %q, want no value", name, key, got)
+		}
+		if want != "" && got != want {
+			t.Errorf("%s: %s = %q, %v, want %q", name, key, got, ok, want)
+		}
+	}
+}
+
+// crossProtocol writes keys with each client and checks that every other
+// client sees each write.
+func crossProtocol(t *testing.T, c *clients, table string) {
+	ctx := context.Background()
+
+	if err := c.redis.Set(ctx, tableKey(table, "1"), "from redis", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	c.checkEverywhere(t, table, "1", "from redis")
+
+	if err := c.memcache.Set(&memcache.Item{Key: tableKey(table, "2"), Value: []byte("from memcache")}); err != nil {
+		t.Fatal(err)
+	}
+	c.checkEverywhere(t, table, "2", "from memcache")
+
+	c.httpPut(t, tableKey(table, "3"), "from http")
+	c.checkEverywhere(t, table, "3", "from http")
+
+	if _, err := c.postgres.Exec("INSERT INTO "+table+" (key, value) VALUES ($1, $2)", "4", "from postgres"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkEverywhere(t, table, "4", "from postgres")
+
+	// A change made over one protocol is seen by the others.
+	if err := c.memcache.Append(&memcache.Item{Key: tableKey(table, "4"), Value: []byte(" and memcache")}); err != nil {
+		t.Fatal(err)
+	}
+	c.checkEverywhere(t, table, "4", "from postgres and memcache")
+
+	if err := c.memcache.Delete(tableKey(table, "1")); err != nil {
+		t.Fatal(err)
+	}
+	c.checkEverywhere(t, table, "1", "")
+
+	if _, err := c.postgres.Exec("DELETE FROM "+table+" WHERE key = $1", "3"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkEverywhere(t, table, "3", "")
+
+	n, err := c.redis.Exists(ctx, tableKey(table, "1"), tableKey(table, "2"), tableKey(table, "3"), tableKey(table, "4")).Result()
+	if err != nil || n != 2 {
+		t.Errorf("EXISTS = %d, %v, want 2", n, err)
+	}
+}
+
+func TestCrossProtocol(t *testing.T) {
+	a := startServer(t)
+
+	t.Run("shared port", func(t *testing.T) {
+		crossProtocol(t, connect(t, a.shared, a.shared, a.shared, a.shared), "shared")
+	})
+	t.Run("protocol ports", func(t *testing.T) {
+		crossProtocol(t, connect(t, a.redis, a.memcache, a.http, a.postgres), "dedicated")
+	})
+}
@@ -0,0 +1,351 @@
+// Package jsonpath reads and updates parts of JSON documents addressed by
+// the JSONPath subset RedisJSON commands accept.
+//
+// A path starting with "$" selects every match, and a path in the legacy
+// syntax of RedisJSON 1, "." or one without a leading "$", selects the
+// first. Paths are made of child names (.name, ['name'] or ["name"]),
+// array indexes ([2], [-1] from the end) and wildcards (.* and [*]).
+// Recursive descent, slices and filters are not supported.
+package jsonpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Object is a decoded JSON object. It keeps its members in document
+// order, so a document re-encodes the way it was written.
+type Object struct {
+	keys   []string
+	values map[string]any
+}
+
+// NewObject returns an empty object.
+func NewObject() *Object {
+	return &Object{values: make(map[string]any)}
+}
+
+// Keys returns the member names in document order. The caller must not
+// modify the slice.
+func (o *Object) Keys() []string {
+	return o.keys
+}
+
+// Get returns the member named key.
+func (o *Object) Get(key string) (any, bool) {
+	v, ok := o.values[key]
+	return v, ok
+}
+
+// Set sets the member named key, appending it if it is new.
+func (o *Object) Set(key string, v any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+// Decode parses one JSON value into nil, bool, json.Number, string,
+// []any or *Object.
+func Decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: unexpected data after the value")
+	}
+	return v, nil
+}
+
+func decodeValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil, errors.New("invalid JSON: unexpected end of input")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := NewObject()
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON: %w", err)
+			}
+			v, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.Set(tok.(string), v)
+		}
+		return obj, closeDelim(dec)
+	case json.Delim('['):
+		arr := []any{}
+		for dec.More() {
+			v, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, closeDelim(dec)
+	}
+	return tok, nil
+}
+
+// closeDelim reads the ']' or '}' that ends an array or object.
+func closeDelim(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return nil
+}
+
+// Encode returns the compact JSON encoding of a value returned by Decode.
+func Encode(v any) []byte {
+	return appendValue(nil, v)
+}
+
+func appendValue(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, "null"...)
+	case bool:
+		return strconv.AppendBool(b, v)
+	case json.Number:
+		return append(b, v...)
+	case string:
+		return appendString(b, v)
+	case []any:
+		b = append(b, '[')
+		for i, elem := range v {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendValue(b, elem)
+		}
+		return append(b, ']')
+	case *Object:
+		b = append(b, '{')
+		for i, key := range v.keys {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendString(b, key)
+			b = append(b, ':')
+			b = appendValue(b, v.values[key])
+		}
+		return append(b, '}')
+	}
+	panic(fmt.Sprintf("jsonpath: cannot encode %T", v))
+}
+
+// appendString appends s as a JSON string, leaving <, > and & as they
+// are, unlike json.Marshal.
+func appendString(b []byte, s string) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return append(b, bytes.TrimSuffix(buf.Bytes(), []byte("\n"))...)
+}
+
+// segment is one step of a path: a child name, an array index or, if
+// wildcard is set, every child.
+type segment struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Path is a parsed JSONPath.
+type Path struct {
+	segments []segment
+	legacy   bool
+}
+
+// Parse parses a path.
+func Parse(s string) (*Path, error) {
+	p := &Path{}
+	rest := s
+	switch {
+	case strings.HasPrefix(s, "$"):
+		rest = s[1:]
+	case s == ".":
+		p.legacy = true
+		rest = ""
+	default:
+		p.legacy = true
+		if !strings.HasPrefix(s, ".") && !strings.HasPrefix(s, "[") {
+			rest = "." + s
+		}
+	}
+
+	for rest != "" {
+		var seg segment
+		var err error
+		switch rest[0] {
+		case '.':
+			seg, rest, err = parseDot(rest[1:])
+		case '[':
+			seg, rest, err = parseBracket(rest[1:])
+		default:
+			err = errors.New("expected '.' or '['")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSONPath '%s': %w", s, err)
+		}
+		p.segments = append(p.segments, seg)
+	}
+	return p, nil
+}
+
+func parseDot(s string) (segment, string, error) {
+	if strings.HasPrefix(s, "*") {
+		return segment{wildcard: true}, s[1:], nil
+	}
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		end = len(s)
+	}
+	if end == 0 {
+		return segment{}, "", errors.New("empty member name")
+	}
+	return segment{name: s[:end]}, s[end:], nil
+}
+
+func parseBracket(s string) (segment, string, error) {
+	if strings.HasPrefix(s, "*]") {
+		return segment{wildcard: true}, s[2:], nil
+	}
+
+	if strings.HasPrefix(s, "'") || strings.HasPrefix(s, `"`) {
+		quote := s[0]
+		end := strings.IndexByte(s[1:], quote)
+		if end < 0 || !strings.HasPrefix(s[end+2:], "]") {
+			return segment{}, "", errors.New("unterminated member name")
+		}
+		return segment{name: s[1 : end+1]}, s[end+3:], nil
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return segment{}, "", errors.New("missing ']'")
+	}
+	index, err := strconv.Atoi(s[:end])
+	if err != nil {
+		return segment{}, "", fmt.Errorf("invalid array index %q", s[:end])
+	}
+	return segment{index: index, isIndex: true}, s[end+1:], nil
+}
+
+// Legacy reports whether p uses the legacy syntax, which selects a single
+// value rather than every match.
+func (p *Path) Legacy() bool {
+	return p.legacy
+}
+
+// IsRoot reports whether p addresses the whole document.
+func (p *Path) IsRoot() bool {
+	return len(p.segments) == 0
+}
+
+// Get returns the values p selects in doc, in document order.
+func (p *Path) Get(doc any) []any {
+	matches := []any{doc}
+	for _, seg := range p.segments {
+		var next []any
+		for _, v := range matches {
+			seg.each(v, func(child any, _ func(any)) {
+				next = append(next, child)
+			})
+		}
+		matches = next
+	}
+	return matches
+}
+
+// Set replaces every value p selects in doc with v, and, if the last
+// segment names a member missing from an object p selects, adds it. It
+// returns the updated document, which is v itself if p is the root, and
+// the number of values set. Each match receives its own copy of v.
+func (p *Path) Set(doc, v any) (any, int) {
+	if p.IsRoot() {
+		return v, 1
+	}
+
+	parents := (&Path{segments: p.segments[:len(p.segments)-1]}).Get(doc)
+	last := p.segments[len(p.segments)-1]
+	n := 0
+	for _, parent := range parents {
+		if obj, ok := parent.(*Object); ok && last.name != "" {
+			obj.Set(last.name, clone(v))
+			n++
+			continue
+		}
+		last.each(parent, func(_ any, set func(any)) {
+			set(clone(v))
+			n++
+		})
+	}
+	return doc, n
+}
+
+// each calls fn with each child of v the segment selects and a function
+// that replaces it.
+func (seg segment) each(v any, fn func(child any, set func(any))) {
+	switch v := v.(type) {
+	case *Object:
+		if seg.wildcard {
+			for _, key := range v.keys {
+				fn(v.values[key], func(x any) { v.values[key] = x })
+			}
+		} else if child, ok := v.values[seg.name]; ok && !seg.isIndex {
+			fn(child, func(x any) { v.values[seg.name] = x })
+		}
+	case []any:
+		if seg.wildcard {
+			for i := range v {
+				fn(v[i], func(x any) { v[i] = x })
+			}
+		} else if seg.isIndex {
+			i := seg.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				fn(v[i], func(x any) { v[i] = x })
+			}
+		}
+	}
+}
+
+// clone returns a deep copy of a decoded value.
+func clone(v any) any {
+	switch v := v.(type) {
+	case []any:
+		c := make([]any, len(v))
+		for i, elem := range v {
+			c[i] = clone(elem)
+		}
+		return c
+	case *Object:
+		c := &Object{keys: append([]string(nil), v.keys...), values: make(map[string]any, len(v.values))}
+		for key, elem := range v.values {
+			c.values[key] = clone(elem)
+		}
+		return c
+	}
+	return v
+}
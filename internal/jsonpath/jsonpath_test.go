@@ -0,0 +1,106 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const doc = `{"name":"gopogo","tags":["cache","redis"],"owner":{"name":"grumpy","email":"a<b>&c"},"n":1.50}`
+
+func TestDecodeEncode(t *testing.T) {
+	v, err := Decode([]byte(" " + doc + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(Encode(v)); got != doc {
+		t.Errorf("Encode(Decode(doc)) = %s, want %s", got, doc)
+	}
+
+	for _, bad := range []string{"", "{", `{"a":}`, "[1,]", "1 2", "nope"} {
+		if _, err := Decode([]byte(bad)); err == nil {
+			t.Errorf("Decode(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	v, _ := Decode([]byte(doc))
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"$", `[` + doc + `]`},
+		{"$.name", `["gopogo"]`},
+		{"$.owner.name", `["grumpy"]`},
+		{"$['owner'][\"email\"]", `["a<b>&c"]`},
+		{"$.tags[1]", `["redis"]`},
+		{"$.tags[-1]", `["redis"]`},
+		{"$.tags[2]", `[]`},
+		{"$.tags[*]", `["cache","redis"]`},
+		{"$.*.name", `["grumpy"]`},
+		{"$.missing", `[]`},
+		{"$.name.deeper", `[]`},
+		{".owner.name", `["grumpy"]`},
+		{"owner.name", `["grumpy"]`},
+		{".", `[` + doc + `]`},
+	}
+	for _, tt := range tests {
+		path, err := Parse(tt.path)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.path, err)
+			continue
+		}
+		if got := string(Encode(path.Get(v))); got != tt.want {
+			t.Errorf("Get(%q) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"$.", "$[", "$['a'", "$[x]", "$x", "$..a"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		path  string
+		value string
+		n     int
+		want  string
+	}{
+		{"$", `7`, 1, `7`},
+		{"$.a", `2`, 1, `{"a":2,"b":[1,2],"c":{"a":3}}`},
+		{"$.new", `{"x":[]}`, 1, `{"a":1,"b":[1,2],"c":{"a":3},"new":{"x":[]}}`},
+		{"$.b[-1]", `"z"`, 1, `{"a":1,"b":[1,"z"],"c":{"a":3}}`},
+		{"$.b[5]", `0`, 0, `{"a":1,"b":[1,2],"c":{"a":3}}`},
+		{"$.*.a", `null`, 1, `{"a":1,"b":[1,2],"c":{"a":null}}`},
+		{"$.b[*]", `[]`, 2, `{"a":1,"b":[[],[]],"c":{"a":3}}`},
+		{"$.missing.x", `1`, 0, `{"a":1,"b":[1,2],"c":{"a":3}}`},
+	}
+	for _, tt := range tests {
+		path, err := Parse(tt.path)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.path, err)
+		}
+		doc, _ := Decode([]byte(`{"a":1,"b":[1,2],"c":{"a":3}}`))
+		value, _ := Decode([]byte(tt.value))
+		doc, n := path.Set(doc, value)
+		if got := string(Encode(doc)); n != tt.n || got != tt.want {
+			t.Errorf("Set(%q, %s) = %s, %d; want %s, %d", tt.path, tt.value, got, n, tt.want, tt.n)
+		}
+	}
+
+	// Every match gets its own copy, so later changes to one do not show
+	// through another.
+	doc, _ := Decode([]byte(`[0,0]`))
+	value, _ := Decode([]byte(`{"k":1}`))
+	path, _ := Parse("$[*]")
+	doc, _ = path.Set(doc, value)
+	inner, _ := Parse("$[0].k")
+	doc, _ = inner.Set(doc, json.Number("2"))
+	if got := string(Encode(doc)); got != `[{"k":2},{"k":1}]` {
+		t.Errorf("document after setting one copy = %s", got)
+	}
+}
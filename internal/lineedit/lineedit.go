@@ -0,0 +1,257 @@
+// Package lineedit reads lines from a terminal with cursor movement and
+// history, enough for the gopogo cli without an external readline
+// dependency. When the input is not a terminal it reads plain lines.
+package lineedit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrInterrupt is returned by ReadLine when the user presses Ctrl-C.
+var ErrInterrupt = errors.New("interrupt")
+
+const maxHistory = 1000
+
+// Editor reads lines from a terminal.
+type Editor struct {
+	in      *os.File
+	out     io.Writer
+	reader  *bufio.Reader
+	history []string
+}
+
+func New(in *os.File, out io.Writer) *Editor {
+	return &Editor{
+		in:     in,
+		out:    out,
+		reader: bufio.NewReader(in),
+	}
+}
+
+// History returns the lines entered so far, oldest first.
+func (e *Editor) History() []string {
+	return e.history
+}
+
+// AddHistory appends line to the history unless it repeats the last one.
+func (e *Editor) AddHistory(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// LoadHistory reads history from a file of one line per entry. A missing
+// file is not an error.
+func (e *Editor) LoadHistory(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		e.AddHistory(line)
+	}
+	return nil
+}
+
+// SaveHistory writes the history to a file readable by LoadHistory.
+func (e *Editor) SaveHistory(path string) error {
+	var buf bytes.Buffer
+	for _, line := range e.history {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// ReadLine shows prompt and returns the line entered, without the line
+// ending. It returns io.EOF at the end of input or on Ctrl-D at an empty
+// line, and ErrInterrupt on Ctrl-C.
+func (e *Editor) ReadLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.in)
+	if err != nil {
+		// Not a terminal: read a plain line.
+		io.WriteString(e.out, prompt)
+		line, err := e.reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer restore()
+	
+	return e.edit(prompt)
+}
+
+func (e *Editor) edit(prompt string) (string, error) {
+	var line []rune
+	pos := 0
+	histPos := len(e.history)
+	saved := ""
+	
+	redraw := func() {
+		// Return to the start, rewrite, clear the rest and put the
+		// cursor back.
+		var b strings.Builder
+		b.WriteString("\r")
+		b.WriteString(prompt)
+		b.WriteString(string(line))
+		b.WriteString("\x1b[K")
+		if back := len(line) - pos; back > 0 {
+			b.WriteString("\x1b[")
+			b.WriteString(itoa(back))
+			b.WriteString("D")
+		}
+		io.WriteString(e.out, b.String())
+	}
+	setLine := func(s string) {
+		line = []rune(s)
+		pos = len(line)
+		redraw()
+	}
+	
+	io.WriteString(e.out, prompt)
+	for {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		
+		switch r {
+		case '\r', '\n':
+			io.WriteString(e.out, "\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			io.WriteString(e.out, "^C\r\n")
+			return "", ErrInterrupt
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				io.WriteString(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+				redraw()
+			}
+		case 1: // Ctrl-A
+			pos = 0
+			redraw()
+		case 5: // Ctrl-E
+			pos = len(line)
+			redraw()
+		case 11: // Ctrl-K
+			line = line[:pos]
+			redraw()
+		case 21: // Ctrl-U
+			line = line[pos:]
+			pos = 0
+			redraw()
+		case 12: // Ctrl-L
+			io.WriteString(e.out, "\x1b[H\x1b[2J")
+			redraw()
+		case 127, 8: // Backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+				redraw()
+			}
+		case 27: // Escape sequence
+			switch e.readEscape() {
+			case 'A': // Up
+				if histPos > 0 {
+					if histPos == len(e.history) {
+						saved = string(line)
+					}
+					histPos--
+					setLine(e.history[histPos])
+				}
+			case 'B': // Down
+				if histPos < len(e.history) {
+					histPos++
+					if histPos == len(e.history) {
+						setLine(saved)
+					} else {
+						setLine(e.history[histPos])
+					}
+				}
+			case 'C': // Right
+				if pos < len(line) {
+					pos++
+					redraw()
+				}
+			case 'D': // Left
+				if pos > 0 {
+					pos--
+					redraw()
+				}
+			case 'H':
+				pos = 0
+				redraw()
+			case 'F':
+				pos = len(line)
+				redraw()
+			case '3': // Delete
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+					redraw()
+				}
+			}
+		default:
+			if r >= 32 {
+				line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+				pos++
+				redraw()
+			}
+		}
+	}
+}
+
+// readEscape consumes a CSI or SS3 sequence and returns its final byte,
+// or '3' for the Delete key's ESC [ 3 ~.
+func (e *Editor) readEscape() byte {
+	b, err := e.reader.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0
+	}
+	b, err = e.reader.ReadByte()
+	if err != nil {
+		return 0
+	}
+	if b >= '0' && b <= '9' {
+		final := b
+		for b >= '0' && b <= '9' || b == ';' {
+			if b, err = e.reader.ReadByte(); err != nil {
+				return 0
+			}
+		}
+		if b == '~' && final == '3' {
+			return '3'
+		}
+		return 0
+	}
+	return b
+}
+
+func itoa(n int) string {
+	var buf [20]byte
+	i := len(buf)
+	for n >= 10 {
+		i--
+		buf[i] = byte('0' + n%10)
+		n /= 10
+	}
+	i--
+	buf[i] = byte('0' + n)
+	return string(buf[i:])
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package lineedit
+
+import (
+	"errors"
+	"os"
+)
+
+func makeRaw(_ *os.File) (func(), error) {
+	return nil, errors.New("line editing is not supported on this platform")
+}
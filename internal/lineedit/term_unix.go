@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package lineedit
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// makeRaw puts the terminal into raw mode and returns a function that
+// restores it. It fails if f is not a terminal.
+func makeRaw(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	
+	return func() {
+		unix.IoctlSetTermios(fd, ioctlSetTermios, old)
+	}, nil
+}
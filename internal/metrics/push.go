@@ -0,0 +1,155 @@
+// Package metrics pushes the server's metrics to statsd or Graphite, for
+// monitoring systems that do not scrape /metrics.
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxDatagram bounds statsd datagrams to stay below the usual MTU.
+	maxDatagram = 1432
+	// dialTimeout bounds connecting to Graphite.
+	dialTimeout = 5 * time.Second
+)
+
+// Sample is a reading of the server's metrics. Gauges are reported as
+// they are. Counters are running totals: Graphite receives the totals,
+// statsd the increase since the previous push.
+type Sample struct {
+	Gauges   map[string]float64
+	Counters map[string]int64
+}
+
+// Pusher sends samples to a statsd server over UDP, to the plaintext port
+// of a Graphite server over TCP, or to both. Metric names are prefixed
+// with Prefix and a dot. A Pusher must not be used concurrently.
+type Pusher struct {
+	StatsdAddr   string
+	GraphiteAddr string
+	Prefix       string
+	// Interval is how often the server pushes a sample.
+	Interval time.Duration
+
+	statsd net.Conn
+	last   map[string]int64
+}
+
+// Push sends s to the configured endpoints. An endpoint that fails does
+// not keep the sample from the others.
+func (p *Pusher) Push(s Sample) error {
+	var errs []error
+	if p.StatsdAddr != "" {
+		if err := p.pushStatsd(s); err != nil {
+			errs = append(errs, fmt.Errorf("statsd %s: %w", p.StatsdAddr, err))
+		}
+	}
+	if p.GraphiteAddr != "" {
+		if err := p.pushGraphite(s, time.Now()); err != nil {
+			errs = append(errs, fmt.Errorf("graphite %s: %w", p.GraphiteAddr, err))
+		}
+	}
+
+	// Counter deltas are taken from this sample whether or not statsd
+	// received it, so a lost datagram is not counted twice.
+	p.last = s.Counters
+	return errors.Join(errs...)
+}
+
+// Close releases the statsd socket.
+func (p *Pusher) Close() error {
+	if p.statsd == nil {
+		return nil
+	}
+	return p.statsd.Close()
+}
+
+func (p *Pusher) pushStatsd(s Sample) error {
+	if p.statsd == nil {
+		conn, err := net.Dial("udp", p.StatsdAddr)
+		if err != nil {
+			return err
+		}
+		p.statsd = conn
+	}
+
+	var lines [][]byte
+	for _, name := range sortedKeys(s.Gauges) {
+		lines = append(lines, fmt.Appendf(nil, "%s:%s|g", p.name(name), formatFloat(s.Gauges[name])))
+	}
+	for _, name := range sortedKeys(s.Counters) {
+		delta := s.Counters[name] - p.last[name]
+		if delta < 0 {
+			// The counter was reset.
+			delta = s.Counters[name]
+		}
+		lines = append(lines, fmt.Appendf(nil, "%s:%d|c", p.name(name), delta))
+	}
+
+	// Several metrics share a datagram, separated by newlines.
+	var datagram []byte
+	for _, line := range lines {
+		if len(datagram) > 0 && len(datagram)+1+len(line) > maxDatagram {
+			if _, err := p.statsd.Write(datagram); err != nil {
+				return err
+			}
+			datagram = datagram[:0]
+		}
+		if len(datagram) > 0 {
+			datagram = append(datagram, '\n')
+		}
+		datagram = append(datagram, line...)
+	}
+	if len(datagram) > 0 {
+		if _, err := p.statsd.Write(datagram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pusher) pushGraphite(s Sample, now time.Time) error {
+	var b bytes.Buffer
+	ts := now.Unix()
+	for _, name := range sortedKeys(s.Gauges) {
+		fmt.Fprintf(&b, "%s %s %d\n", p.name(name), formatFloat(s.Gauges[name]), ts)
+	}
+	for _, name := range sortedKeys(s.Counters) {
+		fmt.Fprintf(&b, "%s %d %d\n", p.name(name), s.Counters[name], ts)
+	}
+
+	conn, err := net.DialTimeout("tcp", p.GraphiteAddr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	_, err = conn.Write(b.Bytes())
+	return err
+}
+
+func (p *Pusher) name(metric string) string {
+	if p.Prefix == "" {
+		return metric
+	}
+	return p.Prefix + "." + metric
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
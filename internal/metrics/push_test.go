@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushStatsd(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	p := &Pusher{StatsdAddr: pc.LocalAddr().String(), Prefix: "gopogo"}
+	defer p.Close()
+
+	read := func() string {
+		t.Helper()
+		pc.SetDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, maxDatagram)
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	if err := p.Push(Sample{Gauges: map[string]float64{"keys": 3, "hit_rate": 0.5}, Counters: map[string]int64{"hits": 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(), "gopogo.hit_rate:0.5|g\ngopogo.keys:3|g\ngopogo.hits:10|c"; got != want {
+		t.Errorf("First push sent %q, want %q", got, want)
+	}
+
+	// Counters are sent as the increase since the previous push.
+	if err := p.Push(Sample{Counters: map[string]int64{"hits": 25}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != "gopogo.hits:15|c" {
+		t.Errorf("Second push sent %q", got)
+	}
+
+	// Metrics that do not fit one datagram are split across several.
+	counters := make(map[string]int64)
+	for i := range 200 {
+		counters[strings.Repeat("c", 20)+string(rune('a'+i%26))+strings.Repeat("x", i/26)] = 1
+	}
+	if err := p.Push(Sample{Counters: counters}); err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for lines < len(counters) {
+		datagram := read()
+		if len(datagram) > maxDatagram {
+			t.Fatalf("Datagram of %d bytes", len(datagram))
+		}
+		lines += strings.Count(datagram, "\n") + 1
+	}
+	if lines != len(counters) {
+		t.Errorf("Received %d metrics, want %d", lines, len(counters))
+	}
+}
+
+func TestPushGraphite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	p := &Pusher{GraphiteAddr: ln.Addr().String(), Prefix: "cache"}
+	if err := p.pushGraphite(Sample{
+		Gauges:   map[string]float64{"memory.used_bytes": 1024},
+		Counters: map[string]int64{"hits": 7},
+	}, time.Unix(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "cache.memory.used_bytes 1024 1700000000\ncache.hits 7 1700000000\n"
+	select {
+	case got := <-received:
+		if got != want {
+			t.Errorf("Graphite received %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Nothing received")
+	}
+}
@@ -0,0 +1,115 @@
+// Package objstore reads and writes whole objects in S3-compatible object
+// storage (Amazon S3, Google Cloud Storage, MinIO) or a local directory,
+// for shipping snapshots off the host.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrNotFound is returned by Get for an object that does not exist.
+var ErrNotFound = errors.New("objstore: object not found")
+
+// Store holds objects under a common prefix. Names are relative to it.
+type Store interface {
+	// Put uploads size bytes read from r as the object name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of the objects in the store, sorted.
+	List(ctx context.Context) ([]string, error)
+}
+
+// Open returns the store at rawURL, one of
+//
+//	s3://bucket/prefix   Amazon S3, or any S3-compatible service when
+//	                     AWS_ENDPOINT_URL is set
+//	gs://bucket/prefix   Google Cloud Storage through its S3-compatible
+//	                     API, authenticated with an HMAC key
+//	file:///path         a local directory
+//
+// S3 and GCS credentials are read from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, and the S3 region from
+// AWS_REGION.
+func Open(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "s3", "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("objstore: %q has no bucket", rawURL)
+		}
+		return newS3(u.Scheme, u.Host, strings.Trim(u.Path, "/"))
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("objstore: %q has no path", rawURL)
+		}
+		return &Dir{Path: u.Path}, nil
+	}
+	return nil, fmt.Errorf("objstore: unsupported URL scheme %q (want s3, gs or file)", u.Scheme)
+}
+
+// Dir is a Store in a local directory.
+type Dir struct {
+	Path string
+}
+
+// Put writes the object to a temporary file and renames it into place,
+// so readers never see a partial object.
+func (d *Dir) Put(_ context.Context, name string, r io.Reader, _ int64) error {
+	if err := os.MkdirAll(d.Path, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(d.Path, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(d.Path, name))
+}
+
+func (d *Dir) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(d.Path, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (d *Dir) List(context.Context) ([]string, error) {
+	entries, err := os.ReadDir(d.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
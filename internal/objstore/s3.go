@@ -0,0 +1,356 @@
+package objstore
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Objects larger than partSize are uploaded in parts of that size.
+	// S3 allows 10,000 parts, so objects of up to 640 GiB.
+	partSize = 64 << 20
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3 is a Store in an S3-compatible bucket, signing requests with AWS
+// Signature Version 4.
+type S3 struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	pathStyle bool
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+func newS3(scheme, bucket, prefix string) (*S3, error) {
+	s := &S3{
+		bucket:       bucket,
+		region:       cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if prefix != "" {
+		s.prefix = prefix + "/"
+	}
+
+	endpoint := cmp.Or(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+	switch {
+	case scheme == "gs":
+		endpoint, s.region, s.pathStyle = "https://storage.googleapis.com", "auto", true
+	case endpoint != "":
+		// MinIO and most other S3-compatible services expect path-style
+		// requests.
+		s.pathStyle = true
+	default:
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("objstore: invalid endpoint %q", endpoint)
+	}
+	s.endpoint = u
+
+	return s, nil
+}
+
+func (s *S3) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if size <= partSize {
+		resp, err := s.do(ctx, http.MethodPut, s.prefix+name, nil, r, size)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	return s.putMultipart(ctx, s.prefix+name, r)
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3) putMultipart(ctx context.Context, key string, r io.Reader) (err error) {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("objstore: starting upload of %s: %w", key, err)
+	}
+
+	defer func() {
+		if err != nil {
+			// Abandoned parts are billed until the upload is aborted.
+			if resp, abortErr := s.do(context.WithoutCancel(ctx), http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, 0); abortErr == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	var complete completeMultipartUpload
+	buf := make([]byte, partSize)
+	for number := 1; ; number++ {
+		n, readErr := io.ReadFull(r, buf)
+		if n == 0 && readErr != nil {
+			break
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadID}}
+		resp, err := s.do(ctx, http.MethodPut, key, query, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	body, _ := xml.Marshal(complete)
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// CompleteMultipartUpload can fail after answering 200, with the
+	// error in the body.
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("objstore: completing upload of %s: %s: %s", key, result.Code, result.Message)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.prefix+name, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) List(ctx context.Context) ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("objstore: listing %s: %w", s.bucket, err)
+		}
+
+		for _, object := range page.Contents {
+			if name := strings.TrimPrefix(object.Key, s.prefix); name != "" && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// do sends a signed request for key (or the bucket, if key is empty) and
+// returns the response if it succeeded. Error responses are decoded into
+// the returned error.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = nil
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet && key != "" {
+		return nil, ErrNotFound
+	}
+	var apiErr struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&apiErr)
+	return nil, fmt.Errorf("objstore: %s %s/%s: %s %s: %s", method, s.bucket, key, resp.Status, apiErr.Code, apiErr.Message)
+}
+
+// sign adds AWS Signature Version 4 headers to req. The payload is left
+// unsigned so that uploads can stream; TLS protects it in transit.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	if s.accessKey == "" {
+		return
+	}
+	req.Header.Set("Authorization", s.authorization(req, now))
+}
+
+func (s *S3) authorization(req *http.Request, now time.Time) string {
+	date := now.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	headers := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers = append(headers, lower)
+		}
+	}
+	sort.Strings(headers)
+
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(req.URL.EscapedPath() + "\n")
+	canonical.WriteString(req.URL.RawQuery + "\n")
+	for _, name := range headers {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonical.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonical.WriteString("\n" + strings.Join(headers, ";") + "\n")
+	canonical.WriteString(req.Header.Get("X-Amz-Content-Sha256"))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + sha256Hex(canonical.String())
+	signature := hex.EncodeToString(hmacSHA256(signingKey(s.secretKey, date, s.region, "s3"), stringToSign))
+
+	return "AWS4-HMAC-SHA256 Credential=" + s.accessKey + "/" + scope +
+		", SignedHeaders=" + strings.Join(headers, ";") +
+		", Signature=" + signature
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalQuery encodes query the way Signature Version 4 expects:
+// sorted by name, with every reserved character escaped.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes everything but the unreserved characters, and slashes
+// too if encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
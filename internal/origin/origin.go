@@ -0,0 +1,134 @@
+// Package origin connects the cache to the backing store it sits in
+// front of: misses are read through from it and, in write-behind mode,
+// changes are written back to it.
+package origin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the origin has no value for a key.
+var ErrNotFound = errors.New("origin: not found")
+
+// Origin is a backing store that cache misses are loaded from.
+type Origin interface {
+	Fetch(ctx context.Context, key string) ([]byte, error)
+}
+
+// Change is a write to apply to a backing store: the key's latest value,
+// or its deletion.
+type Change struct {
+	Key   string
+	Value []byte
+	// ExpireAt is the key's expiration time in Unix nanoseconds, or 0.
+	ExpireAt int64
+	Delete   bool
+}
+
+// Writer is a backing store that changes can be written back to.
+// Implementations apply a batch in order and return an error if any
+// change in it failed; the whole batch is then retried.
+type Writer interface {
+	Write(ctx context.Context, changes []Change) error
+}
+
+// Store is a backing store that can be both read and written.
+type Store interface {
+	Origin
+	Writer
+}
+
+// New returns the store at rawURL: redis:// and rediss:// URLs name a
+// Redis server, http:// and https:// URLs an HTTP store.
+func New(rawURL string, timeout time.Duration) (Store, error) {
+	if strings.HasPrefix(rawURL, "redis://") || strings.HasPrefix(rawURL, "rediss://") {
+		return NewRedis(rawURL, timeout)
+	}
+	return NewHTTP(rawURL, timeout)
+}
+
+// HTTP is an origin that serves each key at its base URL followed by the
+// escaped key, answering 200 with the value or 404 if there is none. As
+// a Writer it is sent a PUT with the value, or a DELETE, at the same URL.
+type HTTP struct {
+	base   string
+	client *http.Client
+}
+
+func NewHTTP(baseURL string, timeout time.Duration) (*HTTP, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid origin URL %q", baseURL)
+	}
+
+	return &HTTP{
+		base:   strings.TrimSuffix(baseURL, "/") + "/",
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (o *HTTP) Fetch(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.base+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	}
+	return nil, fmt.Errorf("origin: %s returned %s", req.URL, resp.Status)
+}
+
+func (o *HTTP) Write(ctx context.Context, changes []Change) error {
+	for _, change := range changes {
+		if err := o.write(ctx, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *HTTP) write(ctx context.Context, change Change) error {
+	method, body := http.MethodPut, io.Reader(bytes.NewReader(change.Value))
+	if change.Delete {
+		method, body = http.MethodDelete, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, o.base+url.PathEscape(change.Key), body)
+	if err != nil {
+		return err
+	}
+	if change.ExpireAt > 0 {
+		req.Header.Set("X-Expire-At", strconv.FormatInt(change.ExpireAt/int64(time.Millisecond), 10))
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 || (change.Delete && resp.StatusCode == http.StatusNotFound) {
+		return nil
+	}
+	return fmt.Errorf("origin: %s %s returned %s", method, req.URL, resp.Status)
+}
@@ -0,0 +1,80 @@
+package origin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.EscapedPath() {
+		case "/values/user%2F42":
+			w.Write([]byte("alice"))
+		case "/values/broken":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+
+	o, err := NewHTTP(srv.URL+"/values", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := o.Fetch(context.Background(), "user/42"); err != nil || string(value) != "alice" {
+		t.Errorf("Fetch = %q, %v", value, err)
+	}
+	if _, err := o.Fetch(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := o.Fetch(context.Background(), "broken"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a server error, got %v", err)
+	}
+
+	if _, err := NewHTTP("localhost:8080", time.Second); err == nil {
+		t.Error("NewHTTP accepted a URL without a scheme")
+	}
+}
+
+func TestHTTPWrite(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		requests = append(requests, req.Method+" "+req.URL.EscapedPath()+" "+string(body)+" "+req.Header.Get("X-Expire-At"))
+		if req.Method == http.MethodDelete {
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+
+	o, err := NewHTTP(srv.URL+"/values", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = o.Write(context.Background(), []Change{
+		{Key: "user/42", Value: []byte("alice")},
+		{Key: "session", Value: []byte("s"), ExpireAt: 1700000000 * int64(time.Second)},
+		{Key: "gone", Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"PUT /values/user%2F42 alice ",
+		"PUT /values/session s 1700000000000",
+		"DELETE /values/gone  ",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Requests = %q, want %q", requests, want)
+	}
+}
@@ -0,0 +1,107 @@
+package origin
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/client"
+)
+
+// Redis is an origin backed by a Redis (or gopogo) server, reading keys
+// with GET and writing changes back as pipelined SET and DEL commands.
+// It keeps one connection, dialed on first use and replaced after an
+// error.
+type Redis struct {
+	url     string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn *client.Client
+}
+
+func NewRedis(rawURL string, timeout time.Duration) (*Redis, error) {
+	if _, _, err := client.ParseURL(rawURL); err != nil {
+		return nil, err
+	}
+	return &Redis{url: rawURL, timeout: timeout}, nil
+}
+
+func (o *Redis) Fetch(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := o.do(ctx, func(conn *client.Client) error {
+		reply, err := conn.Do("GET", key)
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			return ErrNotFound
+		}
+		value, _ = reply.([]byte)
+		return nil
+	})
+	return value, err
+}
+
+func (o *Redis) Write(ctx context.Context, changes []Change) error {
+	return o.do(ctx, func(conn *client.Client) error {
+		now := time.Now().UnixNano()
+		for _, change := range changes {
+			switch {
+			case change.Delete || (change.ExpireAt > 0 && change.ExpireAt <= now):
+				conn.Send("DEL", change.Key)
+			case change.ExpireAt > 0:
+				// PX rather than PXAT, which older servers lack.
+				ttl := max((change.ExpireAt-now)/int64(time.Millisecond), 1)
+				conn.Send("SET", change.Key, string(change.Value), "PX", strconv.FormatInt(ttl, 10))
+			default:
+				conn.Send("SET", change.Key, string(change.Value))
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+
+		// Read every reply so the connection stays in sync, and report
+		// the first error.
+		var firstErr error
+		for range changes {
+			if _, err := conn.Receive(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	})
+}
+
+// do runs fn on the connection, dialing it if needed, and drops the
+// connection if fn fails with anything but an error reply or a miss.
+func (o *Redis) do(ctx context.Context, fn func(*client.Client) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.conn == nil {
+		conn, err := client.DialURL(o.url, o.timeout)
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+	}
+
+	deadline := time.Now().Add(o.timeout)
+	if d, ok := ctx.Deadline(); ok && (o.timeout <= 0 || d.Before(deadline)) {
+		deadline = d
+	} else if o.timeout <= 0 {
+		deadline = time.Time{}
+	}
+	o.conn.SetDeadline(deadline)
+
+	err := fn(o.conn)
+	if _, isReply := err.(client.Error); err != nil && !isReply && !errors.Is(err, ErrNotFound) {
+		o.conn.Close()
+		o.conn = nil
+	}
+	return err
+}
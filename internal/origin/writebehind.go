@@ -0,0 +1,260 @@
+package origin
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+const (
+	defaultBatchSize  = 100
+	defaultInterval   = time.Second
+	defaultMaxPending = 100000
+	defaultMaxRetries = 5
+	maxRetryBackoff   = 30 * time.Second
+)
+
+// WriteBehindOptions configures a WriteBehind queue. Zero values select
+// the defaults.
+type WriteBehindOptions struct {
+	// BatchSize is the most changes passed to one Write (default 100).
+	BatchSize int
+	// Interval is how long changes are collected before they are written
+	// if fewer than BatchSize are waiting (default 1s).
+	Interval time.Duration
+	// MaxPending bounds the keys waiting to be written. Changes to further
+	// keys are dropped until the queue drains (default 100000).
+	MaxPending int
+	// MaxRetries is how many times a failed batch is retried, with
+	// exponential backoff, before it is dropped (default 5).
+	MaxRetries int
+	// Timeout bounds each Write (default none).
+	Timeout time.Duration
+}
+
+// WriteBehindStats counts what a WriteBehind queue has done.
+type WriteBehindStats struct {
+	Pending int    `json:"pending"`
+	Written uint64 `json:"written"`
+	// Coalesced counts changes superseded by a later change to the same
+	// key before they were written.
+	Coalesced uint64 `json:"coalesced"`
+	Retries   uint64 `json:"retries"`
+	// Failed counts changes dropped after their batch ran out of retries,
+	// and Dropped those refused because the queue was full.
+	Failed  uint64 `json:"failed"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// WriteBehind queues cache changes and writes them to a backing store in
+// the background, in batches, so writes complete at cache speed while the
+// store stays eventually consistent. Only the latest change to a key is
+// kept while it waits, so a key written many times between flushes costs
+// one write. Changes still queued when the process dies are lost.
+type WriteBehind struct {
+	w    Writer
+	opts WriteBehindOptions
+
+	mu      sync.Mutex
+	pending map[string]Change
+	order   []string
+
+	kick   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	abort  context.Context
+	cancel context.CancelFunc
+	closed sync.Once
+
+	written   atomic.Uint64
+	coalesced atomic.Uint64
+	retries   atomic.Uint64
+	failed    atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// NewWriteBehind starts a queue writing to w. Call Close to flush it.
+func NewWriteBehind(w Writer, opts *WriteBehindOptions) *WriteBehind {
+	q := &WriteBehind{
+		w:       w,
+		pending: make(map[string]Change),
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if opts != nil {
+		q.opts = *opts
+	}
+	if q.opts.BatchSize <= 0 {
+		q.opts.BatchSize = defaultBatchSize
+	}
+	if q.opts.Interval <= 0 {
+		q.opts.Interval = defaultInterval
+	}
+	if q.opts.MaxPending <= 0 {
+		q.opts.MaxPending = defaultMaxPending
+	}
+	if q.opts.MaxRetries <= 0 {
+		q.opts.MaxRetries = defaultMaxRetries
+	}
+	q.abort, q.cancel = context.WithCancel(context.Background())
+
+	go q.run()
+	return q
+}
+
+// Hooks returns the cache hooks that feed the queue: stores and deletes
+// are written back, while evictions and expirations stay local to the
+// cache.
+func (q *WriteBehind) Hooks() *cache.Hooks {
+	return &cache.Hooks{
+		OnStore: func(entry *cache.Entry) {
+			q.Enqueue(Change{
+				Key:      string(entry.Key()),
+				Value:    bytes.Clone(entry.Value()),
+				ExpireAt: entry.ExpireAt(),
+			})
+		},
+		OnDelete: func(key []byte) {
+			q.Enqueue(Change{Key: string(key), Delete: true})
+		},
+	}
+}
+
+// Enqueue adds a change to the queue, replacing any change to the same
+// key that has not been written yet.
+func (q *WriteBehind) Enqueue(change Change) {
+	q.mu.Lock()
+	if _, ok := q.pending[change.Key]; ok {
+		q.pending[change.Key] = change
+		q.coalesced.Add(1)
+	} else if len(q.pending) >= q.opts.MaxPending {
+		q.dropped.Add(1)
+	} else {
+		q.pending[change.Key] = change
+		q.order = append(q.order, change.Key)
+	}
+	full := len(q.order) >= q.opts.BatchSize
+	q.mu.Unlock()
+
+	if full {
+		select {
+		case q.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *WriteBehind) Stats() WriteBehindStats {
+	q.mu.Lock()
+	pending := len(q.pending)
+	q.mu.Unlock()
+
+	return WriteBehindStats{
+		Pending:   pending,
+		Written:   q.written.Load(),
+		Coalesced: q.coalesced.Load(),
+		Retries:   q.retries.Load(),
+		Failed:    q.failed.Load(),
+		Dropped:   q.dropped.Load(),
+	}
+}
+
+// Close writes out what is queued and stops the queue. If ctx ends
+// first, retries are abandoned and the remaining changes are lost.
+func (q *WriteBehind) Close(ctx context.Context) error {
+	q.closed.Do(func() { close(q.stop) })
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-q.done
+		return ctx.Err()
+	}
+}
+
+func (q *WriteBehind) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			q.flush()
+			return
+		case <-ticker.C:
+		case <-q.kick:
+		}
+		q.flush()
+	}
+}
+
+// flush writes batches until the queue is empty.
+func (q *WriteBehind) flush() {
+	for q.abort.Err() == nil {
+		batch := q.take()
+		if len(batch) == 0 {
+			return
+		}
+		q.write(batch)
+	}
+}
+
+// take removes the oldest BatchSize changes from the queue.
+func (q *WriteBehind) take() []Change {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := min(len(q.order), q.opts.BatchSize)
+	batch := make([]Change, n)
+	for i, key := range q.order[:n] {
+		batch[i] = q.pending[key]
+		delete(q.pending, key)
+	}
+	q.order = q.order[n:]
+
+	return batch
+}
+
+func (q *WriteBehind) write(batch []Change) {
+	backoff := q.opts.Interval
+	for attempt := 0; ; attempt++ {
+		err := q.writeOnce(batch)
+		if err == nil {
+			q.written.Add(uint64(len(batch)))
+			return
+		}
+
+		if attempt == q.opts.MaxRetries || q.abort.Err() != nil {
+			q.failed.Add(uint64(len(batch)))
+			log.Printf("write-behind: dropping %d changes after %d attempts: %v", len(batch), attempt+1, err)
+			return
+		}
+		q.retries.Add(1)
+
+		select {
+		case <-time.After(backoff):
+		case <-q.abort.Done():
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+func (q *WriteBehind) writeOnce(batch []Change) error {
+	ctx := q.abort
+	if q.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.opts.Timeout)
+		defer cancel()
+	}
+	return q.w.Write(ctx, batch)
+}
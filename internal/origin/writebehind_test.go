@@ -0,0 +1,105 @@
+package origin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// memWriter records the batches it is given, failing the first failures
+// calls.
+type memWriter struct {
+	mu       sync.Mutex
+	batches  [][]Change
+	failures int
+}
+
+func (w *memWriter) Write(_ context.Context, changes []Change) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failures > 0 {
+		w.failures--
+		return errors.New("unavailable")
+	}
+	w.batches = append(w.batches, changes)
+	return nil
+}
+
+func (w *memWriter) changes() []Change {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var all []Change
+	for _, batch := range w.batches {
+		all = append(all, batch...)
+	}
+	return all
+}
+
+func TestWriteBehind(t *testing.T) {
+	w := &memWriter{}
+	q := NewWriteBehind(w, &WriteBehindOptions{BatchSize: 10, Interval: time.Hour})
+
+	c := cache.New(4, 0)
+	c.AddHooks(q.Hooks())
+
+	for i := 0; i < 25; i++ {
+		c.Store([]byte(fmt.Sprintf("key-%d", i)), []byte("v1"), nil)
+	}
+	// Rewritten before the flush: only the latest value is written.
+	c.Store([]byte("key-24"), []byte("v2"), nil)
+	c.Delete([]byte("key-23"))
+
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := w.changes()
+	if len(changes) != 25 {
+		t.Fatalf("Wrote %d changes, want 25", len(changes))
+	}
+	for _, batch := range w.batches {
+		if len(batch) > 10 {
+			t.Errorf("Batch of %d changes exceeds the batch size", len(batch))
+		}
+	}
+	if last := changes[24]; last.Key != "key-24" || string(last.Value) != "v2" {
+		t.Errorf("Last change = %+v, want key-24=v2", last)
+	}
+	if del := changes[23]; del.Key != "key-23" || !del.Delete {
+		t.Errorf("Change to key-23 = %+v, want a delete", del)
+	}
+
+	stats := q.Stats()
+	if stats.Written != 25 || stats.Coalesced != 2 || stats.Pending != 0 {
+		t.Errorf("Stats = %+v", stats)
+	}
+}
+
+func TestWriteBehindRetries(t *testing.T) {
+	w := &memWriter{failures: 2}
+	q := NewWriteBehind(w, &WriteBehindOptions{Interval: time.Millisecond, MaxRetries: 3})
+
+	q.Enqueue(Change{Key: "a", Value: []byte("1")})
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.Stats(); stats.Written != 1 || stats.Retries != 2 || stats.Failed != 0 {
+		t.Errorf("Stats = %+v", stats)
+	}
+
+	// A store that stays down costs the batch once retries run out.
+	w = &memWriter{failures: 100}
+	q = NewWriteBehind(w, &WriteBehindOptions{Interval: time.Millisecond, MaxRetries: 2})
+	q.Enqueue(Change{Key: "a", Value: []byte("1")})
+	q.Close(context.Background())
+	if stats := q.Stats(); stats.Written != 0 || stats.Failed != 1 {
+		t.Errorf("Stats = %+v", stats)
+	}
+}
@@ -0,0 +1,55 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+)
+
+// DumpVersion is the current version of the DUMP payload format.
+const DumpVersion = 1
+
+// ErrBadDump is returned for a DUMP payload with an unknown version,
+// bad checksum or malformed body.
+var ErrBadDump = errors.New("persistence: DUMP payload version or checksum are wrong")
+
+// Dump serializes a value for the DUMP command. The payload is
+//
+//	version   1 byte, DumpVersion
+//	flags     uvarint, the entry's client flags
+//	length    uvarint, the value length
+//	value     length bytes
+//	checksum  8 bytes, little-endian CRC-64/ECMA of everything above
+//
+// Expiry is not part of the payload; RESTORE takes it as an argument.
+func Dump(value []byte, flags uint32) []byte {
+	buf := make([]byte, 0, 1+2*binary.MaxVarintLen32+len(value)+8)
+	buf = append(buf, DumpVersion)
+	buf = binary.AppendUvarint(buf, uint64(flags))
+	buf = appendBytes(buf, value)
+	return binary.LittleEndian.AppendUint64(buf, crc64.Checksum(buf, crc64Table))
+}
+
+// ParseDump validates a payload produced by Dump and returns the value
+// and flags it holds. The value aliases payload.
+func ParseDump(payload []byte) ([]byte, uint32, error) {
+	if len(payload) < 1+8 || payload[0] != DumpVersion {
+		return nil, 0, ErrBadDump
+	}
+
+	body := payload[:len(payload)-8]
+	if binary.LittleEndian.Uint64(payload[len(body):]) != crc64.Checksum(body, crc64Table) {
+		return nil, 0, ErrBadDump
+	}
+
+	d := decoder{buf: body[1:]}
+	flags := d.uvarint()
+	value := d.bytes()
+	if d.err != nil || len(d.buf) != 0 || flags > 0xffffffff {
+		return nil, 0, ErrBadDump
+	}
+
+	return value, uint32(flags), nil
+}
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
@@ -0,0 +1,392 @@
+// Package persistence encodes cache mutations as logical operations for
+// write-ahead logging and replication.
+//
+// Operations record intent rather than resulting values: an Increment is
+// logged as its delta and a CompareAndSwap as the expected CAS plus the
+// new value. Replaying a log in order against the state it started from
+// therefore reproduces the same cache, and a replica can be sent the same
+// compact records.
+package persistence
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// OpType identifies a logged operation. Values are part of the on-disk
+// format and must not be renumbered.
+type OpType byte
+
+const (
+	OpStore OpType = iota + 1
+	OpDelete
+	OpIncrement
+	OpCompareAndSwap
+	OpExpire
+	OpRename
+	OpCopy
+	OpClear
+	OpSnapshotStart
+	OpSnapshotEnd
+)
+
+func (t OpType) String() string {
+	switch t {
+	case OpStore:
+		return "store"
+	case OpDelete:
+		return "delete"
+	case OpIncrement:
+		return "increment"
+	case OpCompareAndSwap:
+		return "cas"
+	case OpExpire:
+		return "expire"
+	case OpRename:
+		return "rename"
+	case OpCopy:
+		return "copy"
+	case OpClear:
+		return "clear"
+	case OpSnapshotStart:
+		return "snapshot-start"
+	case OpSnapshotEnd:
+		return "snapshot-end"
+	default:
+		return fmt.Sprintf("op(%d)", byte(t))
+	}
+}
+
+// Op is a single logical cache mutation. Which fields are meaningful
+// depends on Type:
+//
+//	OpStore           Key, Value, ExpireAt, Flags, CAS
+//	OpDelete          Key
+//	OpIncrement       Key, Delta
+//	OpCompareAndSwap  Key, Value, ExpireAt, Flags, CAS (the expected value)
+//	OpExpire          Key, ExpireAt (0 removes the expiry)
+//	OpRename          Key, Dst, NX
+//	OpCopy            Key, Dst, NX (set means do not replace)
+//	OpClear           none
+//	OpSnapshotStart   Time, Dst (the full snapshot a differential one
+//	                  applies on top of; empty for a full snapshot)
+//	OpSnapshotEnd     Count (the records between start and end)
+//
+// The snapshot markers bracket a snapshot so that a reader can tell a
+// complete one from one cut short at a record boundary. Applying them
+// does nothing.
+//
+// Expiry is an absolute time in Unix nanoseconds so that replay does not
+// depend on when it happens.
+type Op struct {
+	Type     OpType
+	Key      []byte
+	Value    []byte
+	Dst      []byte
+	Delta    int64
+	CAS      uint64
+	ExpireAt int64
+	Flags    uint32
+	NX       bool
+	Time     int64
+	Count    uint64
+}
+
+var (
+	ErrShortOp     = errors.New("persistence: truncated operation")
+	ErrUnknownOp   = errors.New("persistence: unknown operation type")
+	ErrBadChecksum = errors.New("persistence: record checksum mismatch")
+)
+
+// AppendOp appends the encoding of op to dst and returns the result.
+func AppendOp(dst []byte, op *Op) []byte {
+	dst = append(dst, byte(op.Type))
+
+	switch op.Type {
+	case OpStore, OpCompareAndSwap:
+		dst = appendBytes(dst, op.Key)
+		dst = appendBytes(dst, op.Value)
+		dst = binary.AppendVarint(dst, op.ExpireAt)
+		dst = binary.AppendUvarint(dst, uint64(op.Flags))
+		dst = binary.AppendUvarint(dst, op.CAS)
+	case OpDelete:
+		dst = appendBytes(dst, op.Key)
+	case OpIncrement:
+		dst = appendBytes(dst, op.Key)
+		dst = binary.AppendVarint(dst, op.Delta)
+	case OpExpire:
+		dst = appendBytes(dst, op.Key)
+		dst = binary.AppendVarint(dst, op.ExpireAt)
+	case OpRename, OpCopy:
+		dst = appendBytes(dst, op.Key)
+		dst = appendBytes(dst, op.Dst)
+		dst = appendBool(dst, op.NX)
+	case OpSnapshotStart:
+		dst = binary.AppendVarint(dst, op.Time)
+		dst = appendBytes(dst, op.Dst)
+	case OpSnapshotEnd:
+		dst = binary.AppendUvarint(dst, op.Count)
+	}
+
+	return dst
+}
+
+// DecodeOp decodes a single operation from b, returning it and the
+// number of bytes consumed. Byte slices in the result alias b.
+func DecodeOp(b []byte) (Op, int, error) {
+	var op Op
+	if len(b) == 0 {
+		return op, 0, ErrShortOp
+	}
+
+	d := decoder{buf: b[1:]}
+	op.Type = OpType(b[0])
+
+	switch op.Type {
+	case OpStore, OpCompareAndSwap:
+		op.Key = d.bytes()
+		op.Value = d.bytes()
+		op.ExpireAt = d.varint()
+		op.Flags = uint32(d.uvarint())
+		op.CAS = d.uvarint()
+	case OpDelete:
+		op.Key = d.bytes()
+	case OpIncrement:
+		op.Key = d.bytes()
+		op.Delta = d.varint()
+	case OpExpire:
+		op.Key = d.bytes()
+		op.ExpireAt = d.varint()
+	case OpRename, OpCopy:
+		op.Key = d.bytes()
+		op.Dst = d.bytes()
+		op.NX = d.bool()
+	case OpSnapshotStart:
+		op.Time = d.varint()
+		op.Dst = d.bytes()
+	case OpSnapshotEnd:
+		op.Count = d.uvarint()
+	case OpClear:
+	default:
+		return op, 0, fmt.Errorf("%w: %d", ErrUnknownOp, byte(op.Type))
+	}
+
+	if d.err != nil {
+		return op, 0, d.err
+	}
+	return op, len(b) - len(d.buf), nil
+}
+
+// Apply replays op against c.
+func Apply(c *cache.Cache, op *Op) error {
+	switch op.Type {
+	case OpStore:
+		ttl, live := remaining(op.ExpireAt)
+		if !live {
+			c.Delete(op.Key)
+			return nil
+		}
+		return c.Store(op.Key, op.Value, &cache.StoreOptions{TTL: ttl, Flags: op.Flags, CAS: op.CAS})
+	case OpDelete:
+		c.Delete(op.Key)
+	case OpIncrement:
+		_, err := c.Increment(op.Key, op.Delta)
+		return err
+	case OpCompareAndSwap:
+		ttl, _ := remaining(op.ExpireAt)
+		_, err := c.CompareAndSwap(op.Key, op.Value, op.CAS, &cache.StoreOptions{TTL: ttl, Flags: op.Flags})
+		if errors.Is(err, cache.ErrNoSuchKey) {
+			return nil
+		}
+		return err
+	case OpExpire:
+		c.Expire(op.Key, op.ExpireAt)
+	case OpRename:
+		_, err := c.Rename(op.Key, op.Dst, op.NX)
+		if errors.Is(err, cache.ErrNoSuchKey) {
+			return nil
+		}
+		return err
+	case OpCopy:
+		_, err := c.Copy(op.Key, op.Dst, !op.NX)
+		return err
+	case OpClear:
+		c.Clear()
+	case OpSnapshotStart, OpSnapshotEnd:
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownOp, byte(op.Type))
+	}
+	return nil
+}
+
+// remaining converts an absolute expiry into a TTL. It reports false if
+// the expiry has already passed.
+func remaining(expireAt int64) (time.Duration, bool) {
+	if expireAt == 0 {
+		return 0, true
+	}
+	ttl := time.Until(time.Unix(0, expireAt))
+	return ttl, ttl > 0
+}
+
+// Encoder writes operations as length-prefixed, CRC32-checked records.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes one record: a uvarint payload length, the payload, and
+// the payload's CRC32 (Castagnoli) in little-endian order.
+func (e *Encoder) Encode(op *Op) error {
+	payload := AppendOp(e.buf[:0], op)
+	e.buf = binary.LittleEndian.AppendUint32(payload, crc32.Checksum(payload, castagnoli))
+
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(len(payload)))
+	if _, err := e.w.Write(header[:n]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// maxRecordLen bounds the payload length accepted by Decoder, so a
+// corrupt length cannot trigger a huge allocation.
+const maxRecordLen = 1 << 30
+
+// Reader is the input of a Decoder, typically a *bufio.Reader.
+type Reader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Decoder reads records written by Encoder.
+type Decoder struct {
+	r   Reader
+	buf []byte
+}
+
+func NewDecoder(r Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next operation. It returns io.EOF at a clean end of
+// input and io.ErrUnexpectedEOF for a torn final record. The returned Op
+// is only valid until the next call.
+func (d *Decoder) Decode() (Op, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return Op{}, err
+	}
+	if n > maxRecordLen {
+		return Op{}, fmt.Errorf("persistence: record length %d exceeds limit", n)
+	}
+
+	if cap(d.buf) < int(n)+4 {
+		d.buf = make([]byte, int(n)+4)
+	}
+	rec := d.buf[:int(n)+4]
+	if _, err := io.ReadFull(d.r, rec); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Op{}, err
+	}
+
+	payload := rec[:n]
+	if binary.LittleEndian.Uint32(rec[n:]) != crc32.Checksum(payload, castagnoli) {
+		return Op{}, ErrBadChecksum
+	}
+
+	op, used, err := DecodeOp(payload)
+	if err != nil {
+		return Op{}, err
+	}
+	if used != len(payload) {
+		return Op{}, fmt.Errorf("persistence: %d trailing bytes in record", len(payload)-used)
+	}
+	return op, nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func appendBytes(dst, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+func appendBool(dst []byte, v bool) []byte {
+	if v {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// decoder reads fields from a buffer, remembering the first error.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrShortOp
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = ErrShortOp
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = ErrShortOp
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.buf) == 0 {
+		d.err = ErrShortOp
+		return false
+	}
+	v := d.buf[0] != 0
+	d.buf = d.buf[1:]
+	return v
+}
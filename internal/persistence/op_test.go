@@ -0,0 +1,167 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+var testOps = []Op{
+	{Type: OpStore, Key: []byte("a"), Value: []byte("hello"), ExpireAt: 1700000000000000000, Flags: 3, CAS: 9},
+	{Type: OpDelete, Key: []byte("a")},
+	{Type: OpIncrement, Key: []byte("counter"), Delta: -42},
+	{Type: OpCompareAndSwap, Key: []byte("b"), Value: []byte("new"), CAS: 1 << 40},
+	{Type: OpExpire, Key: []byte("b"), ExpireAt: 0},
+	{Type: OpRename, Key: []byte("b"), Dst: []byte("c"), NX: true},
+	{Type: OpCopy, Key: []byte("c"), Dst: []byte("d")},
+	{Type: OpClear},
+	{Type: OpSnapshotStart, Time: 1700000000000000000, Dst: []byte("snapshot-full.gopogo")},
+	{Type: OpSnapshotEnd, Count: 8},
+}
+
+func TestOpRoundTrip(t *testing.T) {
+	for _, op := range testOps {
+		buf := AppendOp(nil, &op)
+
+		got, n, err := DecodeOp(buf)
+		if err != nil {
+			t.Fatalf("%s: decode failed: %v", op.Type, err)
+		}
+		if n != len(buf) {
+			t.Fatalf("%s: consumed %d of %d bytes", op.Type, n, len(buf))
+		}
+		if !opsEqual(got, op) {
+			t.Fatalf("%s: got %+v, want %+v", op.Type, got, op)
+		}
+
+		// Every strict prefix must be rejected rather than misread.
+		for i := 0; i < len(buf); i++ {
+			if _, _, err := DecodeOp(buf[:i]); err == nil && op.Type != OpClear {
+				t.Fatalf("%s: decoding %d of %d bytes succeeded", op.Type, i, len(buf))
+			}
+		}
+	}
+}
+
+func TestDecodeUnknownOp(t *testing.T) {
+	if _, _, err := DecodeOp([]byte{0xff}); !errors.Is(err, ErrUnknownOp) {
+		t.Fatalf("Expected ErrUnknownOp, got %v", err)
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, op := range testOps {
+		if err := enc.Encode(&op); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+	}
+	encoded := buf.Bytes()
+
+	dec := NewDecoder(bufio.NewReader(bytes.NewReader(encoded)))
+	for _, want := range testOps {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if !opsEqual(got, want) {
+			t.Fatalf("Got %+v, want %+v", got, want)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+
+	torn := NewDecoder(bufio.NewReader(bytes.NewReader(encoded[:len(encoded)-2])))
+	var err error
+	for err == nil {
+		_, err = torn.Decode()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF for a torn record, got %v", err)
+	}
+
+	corrupt := bytes.Clone(encoded)
+	corrupt[3] ^= 0xff
+	if _, err := NewDecoder(bufio.NewReader(bytes.NewReader(corrupt))).Decode(); !errors.Is(err, ErrBadChecksum) {
+		t.Fatalf("Expected ErrBadChecksum, got %v", err)
+	}
+}
+
+// TestReplayDeterministic replays a log containing increments and CAS
+// operations into two caches and checks that they end up identical.
+func TestReplayDeterministic(t *testing.T) {
+	expireAt := time.Now().Add(time.Hour).UnixNano()
+	log := []Op{
+		{Type: OpStore, Key: []byte("k"), Value: []byte("v1"), CAS: 5, ExpireAt: expireAt},
+		{Type: OpCompareAndSwap, Key: []byte("k"), Value: []byte("v2"), CAS: 5},
+		{Type: OpCompareAndSwap, Key: []byte("k"), Value: []byte("lost"), CAS: 5},
+		{Type: OpIncrement, Key: []byte("n"), Delta: 10},
+		{Type: OpIncrement, Key: []byte("n"), Delta: -3},
+		{Type: OpRename, Key: []byte("n"), Dst: []byte("m")},
+	}
+
+	replay := func() *cache.Cache {
+		c := cache.New(4, 0)
+		for _, op := range log {
+			if err := Apply(c, &op); err != nil {
+				t.Fatalf("Apply %s failed: %v", op.Type, err)
+			}
+		}
+		return c
+	}
+
+	for _, c := range []*cache.Cache{replay(), replay()} {
+		entry, found := c.Load([]byte("k"))
+		if !found || string(entry.Value()) != "v2" || entry.CAS() != 6 {
+			t.Fatalf("Unexpected k after replay: found=%v", found)
+		}
+
+		n, err := c.Increment([]byte("m"), 0)
+		if err != nil || n != 7 {
+			t.Fatalf("Expected m=7 after replay, got %d (%v)", n, err)
+		}
+	}
+}
+
+func opsEqual(a, b Op) bool {
+	norm := func(op Op) Op {
+		for _, p := range []*[]byte{&op.Key, &op.Value, &op.Dst} {
+			if len(*p) == 0 {
+				*p = nil
+			}
+		}
+		return op
+	}
+	return reflect.DeepEqual(norm(a), norm(b))
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	payload := Dump([]byte("some value"), 42)
+
+	value, flags, err := ParseDump(payload)
+	if err != nil {
+		t.Fatalf("ParseDump failed: %v", err)
+	}
+	if string(value) != "some value" || flags != 42 {
+		t.Fatalf("Got %q/%d, want %q/42", value, flags, "some value")
+	}
+
+	for i := range payload {
+		corrupt := bytes.Clone(payload)
+		corrupt[i] ^= 0x01
+		if _, _, err := ParseDump(corrupt); err != ErrBadDump {
+			t.Fatalf("Flipping byte %d was not detected", i)
+		}
+	}
+	if _, _, err := ParseDump(payload[:len(payload)-1]); err != ErrBadDump {
+		t.Fatal("Truncated payload was not rejected")
+	}
+}
@@ -0,0 +1,149 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// FileMagic starts every binary gopogo data file. It is followed by a
+// stream of Encoder records.
+const FileMagic = "GOPOGO\x00\x01"
+
+// progressInterval is how many records Preload applies between progress
+// calls.
+const progressInterval = 100000
+
+// WriteFileHeader writes FileMagic to w.
+func WriteFileHeader(w io.Writer) error {
+	_, err := io.WriteString(w, FileMagic)
+	return err
+}
+
+// JSONRecord is one line of a newline-delimited JSON preload file. TTL is
+// in seconds; Base64 marks a binary Value encoded as standard base64.
+type JSONRecord struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Base64 bool   `json:"base64,omitempty"`
+	TTL    int64  `json:"ttl,omitempty"`
+	Flags  uint32 `json:"flags,omitempty"`
+}
+
+// Preload loads a data file into c and returns the number of records
+// applied. Files starting with FileMagic are read as binary records;
+// anything else is read as newline-delimited JSONRecords. If progress
+// is non-nil it is called periodically with the running count. A
+// snapshot cut short before its end marker is loaded as far as it goes
+// and reported as ErrTruncatedSnapshot.
+func Preload(r io.Reader, c *cache.Cache, progress func(int)) (int, error) {
+	return preloadFile(r, c, progress, nil)
+}
+
+// preloadFile is Preload, calling start, if it is not nil, with the start
+// marker of a snapshot before applying any of its records.
+func preloadFile(r io.Reader, c *cache.Cache, progress func(int), start func(*Op) error) (int, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	magic, err := br.Peek(len(FileMagic))
+	if err == nil && string(magic) == FileMagic {
+		br.Discard(len(FileMagic))
+		return preloadBinary(br, c, progress, start)
+	}
+	if start != nil {
+		return 0, errors.New("persistence: not a snapshot")
+	}
+	return preloadJSON(br, c, progress)
+}
+
+func preloadBinary(r *bufio.Reader, c *cache.Cache, progress func(int), start func(*Op) error) (int, error) {
+	dec := NewDecoder(r)
+	n := 0
+	snapshot, ended := false, false
+
+	for {
+		op, err := dec.Decode()
+		if err == io.EOF {
+			if snapshot && !ended {
+				return n, ErrTruncatedSnapshot
+			}
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("record %d: %w", n+1, err)
+		}
+
+		switch op.Type {
+		case OpSnapshotStart:
+			snapshot = true
+			if start != nil {
+				if err := start(&op); err != nil {
+					return n, err
+				}
+			}
+			continue
+		case OpSnapshotEnd:
+			if op.Count != uint64(n) {
+				return n, ErrTruncatedSnapshot
+			}
+			ended = true
+			continue
+		}
+
+		// Decoded slices are reused by the next Decode.
+		op.Key = bytes.Clone(op.Key)
+		op.Value = bytes.Clone(op.Value)
+		op.Dst = bytes.Clone(op.Dst)
+		if err := Apply(c, &op); err != nil {
+			return n, fmt.Errorf("record %d: %w", n+1, err)
+		}
+
+		n++
+		if progress != nil && n%progressInterval == 0 {
+			progress(n)
+		}
+	}
+}
+
+func preloadJSON(r io.Reader, c *cache.Cache, progress func(int)) (int, error) {
+	dec := json.NewDecoder(r)
+	n := 0
+
+	for {
+		var rec JSONRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("record %d: %w", n+1, err)
+		}
+
+		value := []byte(rec.Value)
+		if rec.Base64 {
+			if value, err = base64.StdEncoding.DecodeString(rec.Value); err != nil {
+				return n, fmt.Errorf("record %d: %w", n+1, err)
+			}
+		}
+
+		opts := &cache.StoreOptions{Flags: rec.Flags}
+		if rec.TTL > 0 {
+			opts.TTL = time.Duration(rec.TTL) * time.Second
+		}
+		if err := c.Store([]byte(rec.Key), value, opts); err != nil {
+			return n, fmt.Errorf("record %d: %w", n+1, err)
+		}
+
+		n++
+		if progress != nil && n%progressInterval == 0 {
+			progress(n)
+		}
+	}
+}
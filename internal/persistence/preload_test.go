@@ -0,0 +1,160 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/objstore"
+)
+
+func TestPreloadJSON(t *testing.T) {
+	input := `{"key":"a","value":"hello","ttl":60}
+{"key":"b","value":"AAEC","base64":true,"flags":4}
+`
+	c := cache.New(4, 0)
+
+	n, err := Preload(strings.NewReader(input), c, nil)
+	if err != nil || n != 2 {
+		t.Fatalf("Preload returned %d, %v", n, err)
+	}
+
+	a, found := c.Load([]byte("a"))
+	if !found || string(a.Value()) != "hello" || a.ExpireAt() == 0 {
+		t.Fatal("Key a not loaded with its TTL")
+	}
+	b, found := c.Load([]byte("b"))
+	if !found || !bytes.Equal(b.Value(), []byte{0, 1, 2}) || b.Flags() != 4 {
+		t.Fatal("Key b not loaded from base64 with its flags")
+	}
+
+	if _, err := Preload(strings.NewReader(`{"key":`), c, nil); err == nil {
+		t.Fatal("Malformed JSON loaded without error")
+	}
+}
+
+func TestPreloadBinary(t *testing.T) {
+	var buf bytes.Buffer
+	WriteFileHeader(&buf)
+	enc := NewEncoder(&buf)
+	for i := 0; i < 3; i++ {
+		enc.Encode(&Op{Type: OpStore, Key: []byte{'k', byte('0' + i)}, Value: []byte("v")})
+	}
+
+	c := cache.New(4, 0)
+	n, err := Preload(&buf, c, nil)
+	if err != nil || n != 3 {
+		t.Fatalf("Preload returned %d, %v", n, err)
+	}
+	for _, key := range []string{"k0", "k1", "k2"} {
+		if _, found := c.Load([]byte(key)); !found {
+			t.Fatalf("Key %s not loaded", key)
+		}
+	}
+}
+
+func TestSnapshotter(t *testing.T) {
+	store, _ := objstore.Open("file://" + t.TempDir())
+	ctx := context.Background()
+
+	src := cache.New(4, 0)
+	src.Store([]byte("a"), []byte("1"), &cache.StoreOptions{TTL: time.Hour, Flags: 7})
+	src.Store([]byte("b"), []byte("2"), nil)
+	src.Store([]byte("c"), []byte("3"), nil)
+
+	s := &Snapshotter{Cache: cache.New(4, 0), Store: store}
+	if _, _, err := s.Restore(ctx, nil); !errors.Is(err, ErrNoSnapshot) {
+		t.Fatalf("Expected ErrNoSnapshot, got %v", err)
+	}
+
+	saver := &Snapshotter{Cache: src, Store: store, FullEvery: 3}
+	saver.TrackChanges()
+
+	full, n, err := saver.Save(ctx)
+	if err != nil || n != 3 || strings.HasSuffix(full, differentialSuffix) {
+		t.Fatalf("First Save = %s, %d, %v; want a full snapshot of 3 keys", full, n, err)
+	}
+
+	// Two differentials, each holding every change since the full one.
+	src.Store([]byte("b"), []byte("changed"), nil)
+	time.Sleep(2 * time.Millisecond)
+	if _, n, err := saver.Save(ctx); err != nil || n != 1 {
+		t.Fatalf("Second Save = %d, %v; want a differential of 1 key", n, err)
+	}
+	src.Delete([]byte("c"))
+	src.Store([]byte("d"), []byte("4"), nil)
+	time.Sleep(2 * time.Millisecond)
+	latest, n, err := saver.Save(ctx)
+	if err != nil || n != 3 || !strings.HasSuffix(latest, differentialSuffix) {
+		t.Fatalf("Third Save = %s, %d, %v; want a differential of 3 keys", latest, n, err)
+	}
+
+	restored, n, err := s.Restore(ctx, nil)
+	if err != nil || restored != latest || n != 6 {
+		t.Fatalf("Restore = %s, %d, %v; want %s", restored, n, err, latest)
+	}
+	want := map[string]string{"a": "1", "b": "changed", "d": "4"}
+	for key, value := range want {
+		if entry, found := s.Cache.Load([]byte(key)); !found || string(entry.Value()) != value {
+			t.Errorf("Key %s not restored as %s", key, value)
+		}
+	}
+	if _, found := s.Cache.Load([]byte("c")); found {
+		t.Error("Deleted key c restored")
+	}
+	if a, _ := s.Cache.Load([]byte("a")); a.Flags() != 7 || a.ExpireAt() == 0 {
+		t.Error("Key a restored without its TTL and flags")
+	}
+
+	// The fourth snapshot is full again.
+	time.Sleep(2 * time.Millisecond)
+	if name, n, err := saver.Save(ctx); err != nil || n != 3 || strings.HasSuffix(name, differentialSuffix) {
+		t.Fatalf("Fourth Save = %s, %d, %v; want a full snapshot", name, n, err)
+	}
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	c := cache.New(4, 0)
+	for i := 0; i < 10; i++ {
+		c.Store([]byte{'k', byte('0' + i)}, []byte("value"), nil)
+	}
+
+	var buf bytes.Buffer
+	if _, err := WriteSnapshot(&buf, c); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	info, err := VerifySnapshot(bytes.NewReader(snapshot))
+	if err != nil || info.Records != 10 || info.Base != "" || info.Bytes != int64(len(snapshot)) {
+		t.Fatalf("VerifySnapshot = %+v, %v", info, err)
+	}
+
+	var diff bytes.Buffer
+	WriteDifferential(&diff, c, "snapshot-base.gopogo", [][]byte{[]byte("k0"), []byte("gone")})
+	info, err = VerifySnapshot(&diff)
+	if err != nil || info.Base != "snapshot-base.gopogo" || info.Stores != 1 || info.Deletes != 1 {
+		t.Fatalf("VerifySnapshot of a differential = %+v, %v", info, err)
+	}
+
+	// Cut at the last record boundary: every checksum passes, but the end
+	// marker is missing.
+	end := AppendOp(nil, &Op{Type: OpSnapshotEnd, Count: 10})
+	truncated := snapshot[:len(snapshot)-len(end)-5]
+	if _, err := VerifySnapshot(bytes.NewReader(truncated)); !errors.Is(err, ErrTruncatedSnapshot) {
+		t.Errorf("Expected ErrTruncatedSnapshot, got %v", err)
+	}
+	if _, err := Preload(bytes.NewReader(truncated), cache.New(1, 0), nil); !errors.Is(err, ErrTruncatedSnapshot) {
+		t.Errorf("Preload of a truncated snapshot: expected ErrTruncatedSnapshot, got %v", err)
+	}
+
+	corrupt := bytes.Clone(snapshot)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if _, err := VerifySnapshot(bytes.NewReader(corrupt)); err == nil {
+		t.Error("Corrupt snapshot verified")
+	}
+}
@@ -0,0 +1,415 @@
+package persistence
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/objstore"
+)
+
+var (
+	// ErrNoSnapshot is returned by Restore when the store holds no full
+	// snapshot.
+	ErrNoSnapshot = errors.New("persistence: no snapshot found")
+	// ErrTruncatedSnapshot is returned for a snapshot that has no end
+	// marker, or whose end marker counts a different number of records.
+	ErrTruncatedSnapshot = errors.New("persistence: snapshot is truncated")
+)
+
+const (
+	snapshotPrefix     = "snapshot-"
+	snapshotSuffix     = ".gopogo"
+	differentialSuffix = ".diff.gopogo"
+)
+
+// A snapshot is a binary data file whose records are bracketed by an
+// OpSnapshotStart and an OpSnapshotEnd record. A full snapshot holds an
+// OpStore for every live key. A differential snapshot names the full
+// snapshot it is based on and holds an OpStore or OpDelete for every key
+// that changed since then, so restoring the full snapshot and then its
+// latest differential reproduces the cache.
+type snapshotWriter struct {
+	enc *Encoder
+	n   uint64
+}
+
+func newSnapshotWriter(w io.Writer, base string) (*snapshotWriter, error) {
+	if err := WriteFileHeader(w); err != nil {
+		return nil, err
+	}
+	sw := &snapshotWriter{enc: NewEncoder(w)}
+	err := sw.enc.Encode(&Op{Type: OpSnapshotStart, Time: time.Now().UnixNano(), Dst: []byte(base)})
+	return sw, err
+}
+
+func (sw *snapshotWriter) store(e *cache.Entry) error {
+	sw.n++
+	return sw.enc.Encode(&Op{
+		Type:     OpStore,
+		Key:      e.Key(),
+		Value:    e.Value(),
+		ExpireAt: e.ExpireAt(),
+		Flags:    e.Flags(),
+		CAS:      e.CAS(),
+	})
+}
+
+func (sw *snapshotWriter) delete(key []byte) error {
+	sw.n++
+	return sw.enc.Encode(&Op{Type: OpDelete, Key: key})
+}
+
+func (sw *snapshotWriter) end() error {
+	return sw.enc.Encode(&Op{Type: OpSnapshotEnd, Count: sw.n})
+}
+
+// WriteSnapshot writes a full snapshot of every live entry in c to w,
+// which Preload reads back, and returns the number of entries written.
+func WriteSnapshot(w io.Writer, c *cache.Cache) (int, error) {
+	sw, err := newSnapshotWriter(w, "")
+	if err != nil {
+		return 0, err
+	}
+
+	// Shards are read in parallel; the encoder is not safe for concurrent
+	// use, so entries are written one at a time.
+	var mu sync.Mutex
+	c.IterateParallel(func(e *cache.Entry) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			return false
+		}
+		err = sw.store(e)
+		return err == nil
+	}, 0)
+	if err != nil {
+		return int(sw.n), err
+	}
+
+	return int(sw.n), sw.end()
+}
+
+// WriteDifferential writes a differential snapshot on top of the full
+// snapshot named base, recording the current state of each of keys.
+func WriteDifferential(w io.Writer, c *cache.Cache, base string, keys [][]byte) (int, error) {
+	sw, err := newSnapshotWriter(w, base)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		if entry, found := c.Peek(key); found {
+			err = sw.store(entry)
+		} else {
+			err = sw.delete(key)
+		}
+		if err != nil {
+			return int(sw.n), err
+		}
+	}
+
+	return int(sw.n), sw.end()
+}
+
+// SnapshotName names a full or differential snapshot taken at t. Names
+// sort in the order the snapshots were taken.
+func SnapshotName(t time.Time, differential bool) string {
+	name := snapshotPrefix + t.UTC().Format("20060102T150405.000Z")
+	if differential {
+		return name + differentialSuffix
+	}
+	return name + snapshotSuffix
+}
+
+// SnapshotInfo describes a snapshot checked by VerifySnapshot.
+type SnapshotInfo struct {
+	Taken time.Time
+	// Base is the full snapshot a differential snapshot applies to, and
+	// empty for a full snapshot.
+	Base    string
+	Records int
+	Stores  int
+	Deletes int
+	Bytes   int64
+}
+
+// VerifySnapshot reads a snapshot through to the end, checking its magic,
+// the checksum of every record and that the end marker accounts for all
+// of them.
+func VerifySnapshot(r io.Reader) (SnapshotInfo, error) {
+	var info SnapshotInfo
+	counter := &countingReader{r: r}
+	br := bufio.NewReaderSize(counter, 64*1024)
+
+	magic := make([]byte, len(FileMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != FileMagic {
+		return info, errors.New("persistence: not a gopogo data file")
+	}
+
+	dec := NewDecoder(br)
+	started := false
+	for record := 1; ; record++ {
+		op, err := dec.Decode()
+		if err == io.EOF {
+			return info, ErrTruncatedSnapshot
+		}
+		if err != nil {
+			return info, fmt.Errorf("record %d: %w", record, err)
+		}
+
+		switch op.Type {
+		case OpSnapshotStart:
+			if started {
+				return info, fmt.Errorf("record %d: second start marker", record)
+			}
+			started = true
+			info.Taken = time.Unix(0, op.Time)
+			info.Base = string(op.Dst)
+		case OpSnapshotEnd:
+			if !started || op.Count != uint64(info.Records) {
+				return info, ErrTruncatedSnapshot
+			}
+			if _, err := dec.Decode(); err != io.EOF {
+				return info, fmt.Errorf("record %d: data after the end marker", record+1)
+			}
+			info.Bytes = counter.n
+			return info, nil
+		case OpStore:
+			info.Records++
+			info.Stores++
+		case OpDelete:
+			info.Records++
+			info.Deletes++
+		default:
+			return info, fmt.Errorf("record %d: unexpected %s operation in a snapshot", record, op.Type)
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Snapshotter saves snapshots of a cache to an object store and restores
+// the most recent one.
+type Snapshotter struct {
+	Cache *cache.Cache
+	Store objstore.Store
+	// TempDir holds snapshots while they are written, before upload. The
+	// default is os.TempDir.
+	TempDir string
+	// FullEvery makes every FullEvery-th snapshot a full one and the
+	// others differential. Differential snapshots need TrackChanges; 0 or
+	// 1 takes only full snapshots.
+	FullEvery int
+
+	saveMu    sync.Mutex
+	base      string
+	sinceFull int
+
+	mu       sync.Mutex
+	tracking bool
+	dirty    map[string]struct{}
+	status   SaveStatus
+}
+
+// SaveStatus describes the snapshots saved since the process started.
+type SaveStatus struct {
+	// Saving is set while a snapshot is being written or uploaded.
+	Saving bool
+	// Saves counts the snapshots saved successfully.
+	Saves int
+	// LastSave is when the last successful snapshot was started, or the
+	// zero time if none was.
+	LastSave time.Time
+	// LastFailed reports whether the most recent attempt failed, and
+	// LastDuration is how long it took.
+	LastFailed   bool
+	LastDuration time.Duration
+}
+
+// Status returns the state of the snapshots saved so far.
+func (s *Snapshotter) Status() SaveStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// TrackChanges registers cache hooks that record the keys changed since
+// the last full snapshot, which differential snapshots are made of. The
+// first snapshot after it is called is a full one.
+func (s *Snapshotter) TrackChanges() (remove func()) {
+	s.mu.Lock()
+	s.tracking = true
+	s.dirty = make(map[string]struct{})
+	s.mu.Unlock()
+
+	mark := func(key []byte) {
+		s.mu.Lock()
+		s.dirty[string(key)] = struct{}{}
+		s.mu.Unlock()
+	}
+	return s.Cache.AddHooks(&cache.Hooks{
+		OnStore:  func(e *cache.Entry) { mark(e.Key()) },
+		OnDelete: mark,
+		OnEvict:  func(e *cache.Entry) { mark(e.Key()) },
+		OnExpire: mark,
+	})
+}
+
+// Save writes a snapshot to a temporary file, uploads it, and returns its
+// name and the number of records in it.
+func (s *Snapshotter) Save(ctx context.Context) (string, int, error) {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	start := time.Now()
+	s.mu.Lock()
+	s.status.Saving = true
+	full := !s.tracking || s.base == "" || s.FullEvery <= 1 || s.sinceFull+1 >= s.FullEvery
+	var keys [][]byte
+	if full {
+		// Changes from here on belong to the next differential, even if
+		// the full snapshot also catches some of them.
+		clear(s.dirty)
+	} else {
+		keys = make([][]byte, 0, len(s.dirty))
+		for key := range s.dirty {
+			keys = append(keys, []byte(key))
+		}
+	}
+	s.mu.Unlock()
+
+	name := SnapshotName(start, !full)
+	n, err := s.save(ctx, name, func(w io.Writer) (int, error) {
+		if full {
+			return WriteSnapshot(w, s.Cache)
+		}
+		return WriteDifferential(w, s.Cache, s.base, keys)
+	})
+
+	s.mu.Lock()
+	s.status.Saving = false
+	s.status.LastFailed = err != nil
+	s.status.LastDuration = time.Since(start)
+	if err == nil {
+		s.status.Saves++
+		s.status.LastSave = start
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		if full {
+			// The changes since the previous full snapshot were forgotten.
+			s.base = ""
+		}
+		return "", 0, err
+	}
+
+	if full {
+		s.base, s.sinceFull = name, 0
+	} else {
+		s.sinceFull++
+	}
+	return name, n, nil
+}
+
+func (s *Snapshotter) save(ctx context.Context, name string, write func(io.Writer) (int, error)) (int, error) {
+	f, err := os.CreateTemp(s.TempDir, "gopogo-snapshot-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriterSize(f, 256*1024)
+	n, err := write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("writing snapshot: %w", err)
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := s.Store.Put(ctx, name, f, size); err != nil {
+		return 0, fmt.Errorf("uploading snapshot: %w", err)
+	}
+
+	return n, nil
+}
+
+// Restore loads the most recent full snapshot into the cache, followed by
+// the latest differential snapshot taken on top of it, if any. It returns
+// the name of the last snapshot applied and the number of records loaded,
+// or ErrNoSnapshot.
+func (s *Snapshotter) Restore(ctx context.Context, progress func(int)) (string, int, error) {
+	names, err := s.Store.List(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+
+	full, differential := "", ""
+	for _, name := range names {
+		if !strings.HasPrefix(name, snapshotPrefix) {
+			continue
+		}
+		if strings.HasSuffix(name, differentialSuffix) {
+			differential = max(differential, name)
+		} else if strings.HasSuffix(name, snapshotSuffix) {
+			full = max(full, name)
+		}
+	}
+	if full == "" {
+		return "", 0, ErrNoSnapshot
+	}
+
+	n, err := s.restore(ctx, full, "", progress)
+	if err != nil || differential < full {
+		return full, n, err
+	}
+
+	m, err := s.restore(ctx, differential, full, progress)
+	return differential, n + m, err
+}
+
+func (s *Snapshotter) restore(ctx context.Context, name, base string, progress func(int)) (int, error) {
+	r, err := s.Store.Get(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := preloadFile(r, s.Cache, progress, func(start *Op) error {
+		if string(start.Dst) != base {
+			return fmt.Errorf("based on %q, not %q", start.Dst, base)
+		}
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("restoring %s: %w", name, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,292 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// bitfieldOverflow is how BITFIELD SET and INCRBY treat a result that does
+// not fit the field.
+type bitfieldOverflow int
+
+const (
+	overflowWrap bitfieldOverflow = iota
+	overflowSat
+	overflowFail
+)
+
+// bitfieldOp is one GET, SET or INCRBY of a BITFIELD command.
+type bitfieldOp struct {
+	op       string
+	signed   bool
+	bits     uint
+	offset   uint64
+	value    int64
+	overflow bitfieldOverflow
+}
+
+// parseBitfield parses the subcommands of BITFIELD, or of BITFIELD_RO if
+// readOnly is set, and reports whether any of them writes. On error it
+// returns the message to reply with.
+func (h *RedisHandler) parseBitfield(args [][]byte, readOnly bool) ([]bitfieldOp, bool, string) {
+	var ops []bitfieldOp
+	overflow := overflowWrap
+	writes := false
+	
+	for i := 0; i < len(args); {
+		sub := strings.ToUpper(string(args[i]))
+		arity := 3
+		switch sub {
+		case "GET":
+			arity = 2
+		case "OVERFLOW":
+			arity = 1
+		case "SET", "INCRBY":
+		default:
+			return nil, false, "ERR syntax error"
+		}
+		if i+arity >= len(args) {
+			return nil, false, "ERR syntax error"
+		}
+		if readOnly && sub != "GET" {
+			return nil, false, "ERR BITFIELD_RO only supports the GET subcommand"
+		}
+		
+		if sub == "OVERFLOW" {
+			switch strings.ToUpper(string(args[i+1])) {
+			case "WRAP":
+				overflow = overflowWrap
+			case "SAT":
+				overflow = overflowSat
+			case "FAIL":
+				overflow = overflowFail
+			default:
+				return nil, false, "ERR Invalid OVERFLOW type specified"
+			}
+			i += 2
+			continue
+		}
+		
+		op := bitfieldOp{op: sub, overflow: overflow}
+		var ok bool
+		if op.signed, op.bits, ok = parseBitfieldType(args[i+1]); !ok {
+			return nil, false, "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+		}
+		if op.offset, ok = h.parseBitOffset(args[i+2], op.bits); !ok {
+			return nil, false, "ERR bit offset is not an integer or out of range"
+		}
+		if sub != "GET" {
+			value, err := parseInt(args[i+3])
+			if err != nil {
+				return nil, false, "ERR value is not an integer or out of range"
+			}
+			op.value = value
+			writes = true
+		}
+		ops = append(ops, op)
+		i += arity + 1
+	}
+	
+	return ops, writes, ""
+}
+
+// parseBitfieldType parses a field type such as i8 or u16. Unsigned
+// fields are limited to 63 bits so every value fits a RESP integer.
+func parseBitfieldType(arg []byte) (signed bool, bits uint, ok bool) {
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u') {
+		return false, 0, false
+	}
+	n, err := strconv.ParseUint(string(arg[1:]), 10, 8)
+	signed = arg[0] == 'i'
+	if err != nil || n < 1 || n > 64 || (!signed && n == 64) {
+		return false, 0, false
+	}
+	return signed, uint(n), true
+}
+
+// parseBitOffset parses a bit offset, which with a leading '#' counts
+// fields of the given width rather than bits. The field must end within
+// the largest value a client may send.
+func (h *RedisHandler) parseBitOffset(arg []byte, bits uint) (uint64, bool) {
+	multiplier := uint64(1)
+	if len(arg) > 0 && arg[0] == '#' {
+		multiplier = uint64(bits)
+		arg = arg[1:]
+	}
+	n, err := strconv.ParseUint(string(arg), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	
+	maxBulkLen := h.config.MaxBulkLen
+	if maxBulkLen <= 0 {
+		maxBulkLen = DefaultMaxBulkLen
+	}
+	limit := uint64(maxBulkLen) * 8
+	if n > limit/multiplier || n*multiplier+uint64(bits) > limit {
+		return 0, false
+	}
+	return n * multiplier, true
+}
+
+func (h *RedisHandler) handleBitfield(writer *bufio.Writer, key []byte, args [][]byte, readOnly bool) {
+	ops, writes, errMsg := h.parseBitfield(args, readOnly)
+	if errMsg != "" {
+		h.writeError(writer, errMsg)
+		return
+	}
+	
+	results := make([]*int64, len(ops))
+	run := func(value []byte, found bool) []byte {
+		if writes {
+			// Grow the value to hold every field written, even one that
+			// fails to overflow, as Redis does.
+			size := len(value)
+			for _, op := range ops {
+				if op.op != "GET" {
+					size = max(size, int((op.offset+uint64(op.bits)+7)/8))
+				}
+			}
+			grown := make([]byte, size)
+			copy(grown, value)
+			value = grown
+		}
+		
+		for i, op := range ops {
+			old := getBits(value, op.offset, op.bits)
+			current := int64(old)
+			if op.signed {
+				current = signExtend(old, op.bits)
+			}
+			
+			switch op.op {
+			case "GET":
+				results[i] = &current
+			case "SET":
+				if stored, ok := op.fit(op.value, 0); ok {
+					setBits(value, op.offset, op.bits, uint64(stored))
+					results[i] = &current
+				}
+			case "INCRBY":
+				if stored, ok := op.fit(current, op.value); ok {
+					setBits(value, op.offset, op.bits, uint64(stored))
+					results[i] = &stored
+				}
+			}
+		}
+		
+		if !writes {
+			return nil
+		}
+		return value
+	}
+	
+	if writes {
+		if err := h.cache.Update(bytes.Clone(key), run); h.writeSizeError(writer, err) {
+			return
+		}
+	} else if entry, found := h.cache.Load(key); found {
+		run(entry.Value(), true)
+	} else {
+		run(nil, false)
+	}
+	
+	h.writeArrayLen(writer, len(results))
+	for _, result := range results {
+		if result == nil {
+			h.writeNil(writer)
+		} else {
+			h.writeInteger(writer, *result)
+		}
+	}
+}
+
+// fit returns value plus incr as the field stores it, applying the
+// overflow policy, and false if the policy is FAIL and it does not fit.
+func (op bitfieldOp) fit(value, incr int64) (int64, bool) {
+	if op.signed {
+		return fitSigned(value, incr, op.bits, op.overflow)
+	}
+	result, ok := fitUnsigned(uint64(value), incr, op.bits, op.overflow)
+	return int64(result), ok
+}
+
+func fitUnsigned(value uint64, incr int64, bits uint, overflow bitfieldOverflow) (uint64, bool) {
+	limit := uint64(1)<<bits - 1
+	over := value > limit || (incr > 0 && uint64(incr) > limit-value)
+	// -incr overflows for the most negative increment; negate in uint64.
+	under := !over && incr < 0 && -uint64(incr) > value
+	if !over && !under {
+		return value + uint64(incr), true
+	}
+	
+	switch overflow {
+	case overflowSat:
+		if over {
+			return limit, true
+		}
+		return 0, true
+	case overflowFail:
+		return 0, false
+	}
+	return (value + uint64(incr)) & limit, true
+}
+
+func fitSigned(value, incr int64, bits uint, overflow bitfieldOverflow) (int64, bool) {
+	limit := int64(uint64(1)<<(bits-1) - 1)
+	lowest := -limit - 1
+	over := value > limit || (incr > 0 && value > limit-incr)
+	under := value < lowest || (incr < 0 && value < lowest-incr)
+	if !over && !under {
+		return value + incr, true
+	}
+	
+	switch overflow {
+	case overflowSat:
+		if over {
+			return limit, true
+		}
+		return lowest, true
+	case overflowFail:
+		return 0, false
+	}
+	return signExtend(uint64(value)+uint64(incr), bits), true
+}
+
+// signExtend interprets the low bits of v as a two's complement number.
+func signExtend(v uint64, bits uint) int64 {
+	shift := 64 - bits
+	return int64(v<<shift) >> shift
+}
+
+// getBits reads the bits-wide unsigned field at offset, counting bits
+// from the most significant bit of the first byte. Bits past the end of
+// value read as zero.
+func getBits(value []byte, offset uint64, bits uint) uint64 {
+	var v uint64
+	for i := uint64(0); i < uint64(bits); i++ {
+		pos := offset + i
+		bit := uint64(0)
+		if pos/8 < uint64(len(value)) {
+			bit = uint64(value[pos/8]>>(7-pos%8)) & 1
+		}
+		v = v<<1 | bit
+	}
+	return v
+}
+
+// setBits writes the low bits of v to the field at offset, which value
+// must be long enough to hold.
+func setBits(value []byte, offset uint64, bits uint, v uint64) {
+	for i := uint64(0); i < uint64(bits); i++ {
+		pos := offset + i
+		mask := byte(1) << (7 - pos%8)
+		if v>>(uint64(bits)-1-i)&1 != 0 {
+			value[pos/8] |= mask
+		} else {
+			value[pos/8] &^= mask
+		}
+	}
+}
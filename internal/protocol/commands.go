@@ -0,0 +1,279 @@
+package protocol
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+)
+
+// redisCommand describes a Redis command: how Handle checks and runs it,
+// and what COMMAND and COMMAND DOCS report about it.
+type redisCommand struct {
+	name string
+	// arity is the number of arguments including the command name, or,
+	// if negative, the minimum number.
+	arity int
+	flags []string
+	// firstKey, lastKey and step give the positions of the key
+	// arguments, as in Redis. A lastKey of -1 means the last argument;
+	// firstKey 0 means the command takes no keys.
+	firstKey, lastKey, step int
+	categories              []string
+	group                   string
+	// since is the Redis version that introduced the command, or empty
+	// for commands of gopogo's own.
+	since   string
+	summary string
+	// run serves the command once its arity has been checked. args are
+	// the arguments after the command name.
+	run func(h *RedisHandler, c *redisClient, args [][]byte)
+}
+
+// checkArity reports whether a command with nargs arguments, its name
+// included, satisfies the command's arity.
+func (cmd *redisCommand) checkArity(nargs int) bool {
+	if cmd.arity < 0 {
+		return nargs >= -cmd.arity
+	}
+	return nargs == cmd.arity
+}
+
+// hasFlag reports whether the command has flag, such as "write" or
+// "no_auth".
+func (cmd *redisCommand) hasFlag(flag string) bool {
+	return slices.Contains(cmd.flags, flag)
+}
+
+// redisCommands lists every command RedisHandler.Handle serves, sorted by
+// name. Adding a command here is all it takes to serve it.
+var redisCommands = []redisCommand{
+	{"auth", -2, []string{"noscript", "loading", "stale", "fast", "no_auth"}, 0, 0, 0, []string{"@fast", "@connection"}, "connection", "1.0.0", "Authenticates the connection.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleAuth(c, args[0]) }},
+	{"bitfield", -2, []string{"write", "denyoom"}, 1, 1, 1, []string{"@write", "@bitmap", "@slow"}, "bitmap", "3.2.0", "Performs arbitrary bitfield integer operations on strings.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleBitfield(c.writer, args[0], args[1:], false) }},
+	{"bitfield_ro", -2, []string{"readonly", "fast"}, 1, 1, 1, []string{"@read", "@bitmap", "@fast"}, "bitmap", "6.0.0", "Performs arbitrary read-only bitfield integer operations on strings.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleBitfield(c.writer, args[0], args[1:], true) }},
+	{"client", -2, []string{"admin", "noscript", "random", "loading", "stale"}, 0, 0, 0, []string{"@admin", "@slow", "@dangerous", "@connection"}, "connection", "2.4.0", "Inspects client connections.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleClient(c, args) }},
+	{"command", -1, []string{"random", "loading", "stale"}, 0, 0, 0, []string{"@slow", "@connection"}, "server", "2.8.13", "Returns detailed information about all commands.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleCommand(c.writer, args) }},
+	{"config", -2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0, []string{"@admin", "@slow", "@dangerous"}, "server", "2.0.0", "Gets or sets configuration parameters.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleConfig(c.writer, args) }},
+	{"copy", -3, []string{"write", "denyoom"}, 1, 2, 1, []string{"@keyspace", "@write", "@slow"}, "generic", "6.2.0", "Copies the value of a key to a new key.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleCopy(c.writer, args) }},
+	{"dbsize", 1, []string{"readonly", "fast"}, 0, 0, 0, []string{"@keyspace", "@read", "@fast"}, "server", "1.0.0", "Returns the number of keys in the database.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.writeInteger(c.writer, int64(h.cache.NumItems())) }},
+	{"debug", -2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0, []string{"@admin", "@slow", "@dangerous"}, "server", "1.0.0", "A container for debugging commands.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleDebug(c, args) }},
+	{"decr", 2, []string{"write", "denyoom", "fast"}, 1, 1, 1, []string{"@write", "@string", "@fast"}, "string", "1.0.0", "Decrements the integer value of a key by one.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleIncr(c.writer, args[0], -1) }},
+	{"decrby", 3, []string{"write", "denyoom", "fast"}, 1, 1, 1, []string{"@write", "@string", "@fast"}, "string", "1.0.0", "Decrements a number from the integer value of a key.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleIncrBy(c.writer, args[0], args[1], -1) }},
+	{"del", -2, []string{"write"}, 1, -1, 1, []string{"@keyspace", "@write", "@slow"}, "generic", "1.0.0", "Deletes one or more keys.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleDel(c.writer, args) }},
+	{"delprefix", 2, []string{"write"}, 0, 0, 0, []string{"@keyspace", "@write", "@slow", "@dangerous"}, "generic", "", "Deletes every key starting with a prefix in the background.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleDelPrefix(c.writer, args[0]) }},
+	{"dump", 2, []string{"readonly", "random"}, 1, 1, 1, []string{"@keyspace", "@read", "@slow"}, "generic", "2.6.0", "Returns a serialized representation of the value stored at a key.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleDump(c.writer, args[0]) }},
+	{"echo", 2, []string{"fast"}, 0, 0, 0, []string{"@fast", "@connection"}, "connection", "1.0.0", "Returns the given string.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.writeBulk(c.writer, args[0]) }},
+	{"exists", -2, []string{"readonly", "fast"}, 1, -1, 1, []string{"@keyspace", "@read", "@fast"}, "generic", "1.0.0", "Determines whether one or more keys exist.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleExists(c.writer, args) }},
+	{"expire", 3, []string{"write", "fast"}, 1, 1, 1, []string{"@keyspace", "@write", "@fast"}, "generic", "1.0.0", "Sets the expiration time of a key in seconds.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleExpire(c.writer, args[0], args[1]) }},
+	{"flushall", -1, []string{"write"}, 0, 0, 0, []string{"@keyspace", "@write", "@slow", "@dangerous"}, "server", "1.0.0", "Removes all keys from all databases.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleFlush(c.writer, args) }},
+	{"flushdb", -1, []string{"write"}, 0, 0, 0, []string{"@keyspace", "@write", "@slow", "@dangerous"}, "server", "1.0.0", "Removes all keys from the current database.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleFlush(c.writer, args) }},
+	{"get", 2, []string{"readonly", "fast"}, 1, 1, 1, []string{"@read", "@string", "@fast"}, "string", "1.0.0", "Returns the string value of a key.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleGet(c.writer, args[0]) }},
+	{"getdel", 2, []string{"write", "fast"}, 1, 1, 1, []string{"@write", "@string", "@fast"}, "string", "6.2.0", "Returns the string value of a key after deleting the key.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleGetDel(c.writer, args[0]) }},
+	{"getrange", 4, []string{"readonly"}, 1, 1, 1, []string{"@read", "@string", "@slow"}, "string", "2.4.0", "Returns a substring of the string stored at a key.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleGetRange(c.writer, args[0], args[1], args[2]) }},
+	{"getset", 3, []string{"write", "denyoom", "fast"}, 1, 1, 1, []string{"@write", "@string", "@fast"}, "string", "1.0.0", "Returns the previous string value of a key after setting it to a new value.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleSet(c.writer, [][]byte{args[0], args[1], []byte("GET")}) }},
+	{"incr", 2, []string{"write", "denyoom", "fast"}, 1, 1, 1, []string{"@write", "@string", "@fast"}, "string", "1.0.0", "Increments the integer value of a key by one.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleIncr(c.writer, args[0], 1) }},
+	{"incrby", 3, []string{"write", "denyoom", "fast"}, 1, 1, 1, []string{"@write", "@string", "@fast"}, "string", "1.0.0", "Increments the integer value of a key by a number.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleIncrBy(c.writer, args[0], args[1], 1) }},
+	{"info", -1, []string{"random", "loading", "stale"}, 0, 0, 0, []string{"@slow", "@dangerous"}, "server", "1.0.0", "Returns information and statistics about the server.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleInfo(c.writer, args) }},
+	{"json.get", -2, []string{"readonly"}, 1, 1, 1, []string{"@read", "@json", "@slow"}, "json", "", "Gets the value at one or more paths in JSON serialized form.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleJSONGet(c.writer, args[0], args[1:]) }},
+	{"json.set", -4, []string{"write", "denyoom"}, 1, 1, 1, []string{"@write", "@json", "@slow"}, "json", "", "Sets or updates the JSON value at a path.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleJSONSet(c.writer, args[0], args[1], args[2], args[3:]) }},
+	{"keys", 2, []string{"readonly", "sort_for_script"}, 0, 0, 0, []string{"@keyspace", "@read", "@slow", "@dangerous"}, "generic", "1.0.0", "Returns all key names that match a pattern.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleKeys(c.writer, string(args[0])) }},
+	{"memory", -2, []string{"readonly", "random"}, 0, 0, 0, []string{"@read", "@slow"}, "server", "4.0.0", "Reports memory usage.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleMemory(c.writer, args) }},
+	{"mget", -2, []string{"readonly", "fast"}, 1, -1, 1, []string{"@read", "@string", "@fast"}, "string", "1.0.0", "Atomically returns the string values of one or more keys.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleMGet(c.writer, args) }},
+	{"mset", -3, []string{"write", "denyoom"}, 1, -1, 2, []string{"@write", "@string", "@slow"}, "string", "1.0.1", "Atomically creates or modifies the string values of one or more keys.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleMSet(c.writer, args) }},
+	{"object", -2, []string{"readonly", "random"}, 2, 2, 1, []string{"@keyspace", "@read", "@slow"}, "generic", "2.2.3", "Inspects the internals of a key.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleObject(c.writer, args) }},
+	{"ping", -1, []string{"stale", "fast", "no_auth"}, 0, 0, 0, []string{"@fast", "@connection"}, "connection", "1.0.0", "Returns the server's liveliness response.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handlePing(c.writer, args) }},
+	{"pttl", 2, []string{"readonly", "random", "fast"}, 1, 1, 1, []string{"@keyspace", "@read", "@fast"}, "generic", "2.6.0", "Returns the expiration time in milliseconds of a key.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleTTL(c.writer, args[0], true) }},
+	{"quit", -1, []string{"loading", "stale", "fast"}, 0, 0, 0, []string{"@fast", "@connection"}, "connection", "1.0.0", "Closes the connection.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleQuit(c) }},
+	{"rename", 3, []string{"write"}, 1, 2, 1, []string{"@keyspace", "@write", "@slow"}, "generic", "1.0.0", "Renames a key and overwrites the destination.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleRename(c.writer, args[0], args[1], false) }},
+	{"renamenx", 3, []string{"write", "fast"}, 1, 2, 1, []string{"@keyspace", "@write", "@fast"}, "generic", "1.0.0", "Renames a key only when the target key name doesn't exist.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleRename(c.writer, args[0], args[1], true) }},
+	{"reset", 1, []string{"noscript", "loading", "stale", "fast", "no_auth", "allow_busy"}, 0, 0, 0, []string{"@fast", "@connection"}, "connection", "6.2.0", "Resets the connection.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleReset(c) }},
+	{"restore", -4, []string{"write", "denyoom"}, 1, 1, 1, []string{"@keyspace", "@write", "@slow", "@dangerous"}, "generic", "2.6.0", "Creates a key from the serialized representation of a value.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleRestore(c.writer, args) }},
+	{"select", 2, []string{"loading", "stale", "fast"}, 0, 0, 0, []string{"@keyspace", "@fast"}, "connection", "1.0.0", "Changes the selected database.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.writeSimpleString(c.writer, "OK") }},
+	{"sentinel", -2, []string{"admin", "loading", "stale"}, 0, 0, 0, []string{"@admin", "@slow", "@dangerous"}, "sentinel", "2.8.4", "A container for Redis Sentinel commands.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleSentinel(c.writer, c.conn.LocalAddr(), args) }},
+	{"set", -3, []string{"write", "denyoom"}, 1, 1, 1, []string{"@write", "@string", "@slow"}, "string", "1.0.0", "Sets the string value of a key, ignoring its type.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleSet(c.writer, args) }},
+	{"shardinfo", -1, []string{"readonly", "random", "loading", "stale"}, 0, 0, 0, []string{"@read", "@slow"}, "server", "", "Returns per-shard entry, memory and lock statistics.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleShardInfo(c.writer, args) }},
+	{"strlen", 2, []string{"readonly", "fast"}, 1, 1, 1, []string{"@read", "@string", "@fast"}, "string", "2.2.0", "Returns the length of a string value.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleStrlen(c.writer, args[0]) }},
+	{"substr", 4, []string{"readonly"}, 1, 1, 1, []string{"@read", "@string", "@slow"}, "string", "1.0.0", "Returns a substring from a string value.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleGetRange(c.writer, args[0], args[1], args[2]) }},
+	{"topkeys", -1, []string{"readonly", "random"}, 0, 0, 0, []string{"@read", "@slow"}, "server", "", "Returns the most frequently accessed keys.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleTopKeys(c.writer, args) }},
+	{"ttl", 2, []string{"readonly", "random", "fast"}, 1, 1, 1, []string{"@keyspace", "@read", "@fast"}, "generic", "1.0.0", "Returns the expiration time in seconds of a key.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleTTL(c.writer, args[0], false) }},
+	{"unlink", -2, []string{"write", "fast"}, 1, -1, 1, []string{"@keyspace", "@write", "@fast"}, "generic", "4.0.0", "Asynchronously deletes one or more keys.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleDel(c.writer, args) }},
+	{"wait", 3, []string{"noscript"}, 0, 0, 0, []string{"@slow", "@connection"}, "generic", "3.0.0", "Blocks until writes are acknowledged by replicas.",
+		func(h *RedisHandler, c *redisClient, args [][]byte) { h.handleWait(c, args[0], args[1]) }},
+}
+
+// newCommandIndex returns the commands a handler with config serves, by
+// upper-case name: SENTINEL only when it is enabled.
+func newCommandIndex(config *Config) map[string]*redisCommand {
+	index := make(map[string]*redisCommand, len(redisCommands))
+	for i := range redisCommands {
+		cmd := &redisCommands[i]
+		if cmd.name == "sentinel" && config.SentinelMaster == "" {
+			continue
+		}
+		index[strings.ToUpper(cmd.name)] = cmd
+	}
+	return index
+}
+
+// commands returns the commands this handler serves, sorted by name.
+func (h *RedisHandler) commands() []*redisCommand {
+	cmds := make([]*redisCommand, 0, len(h.commandIndex))
+	for _, cmd := range h.commandIndex {
+		cmds = append(cmds, cmd)
+	}
+	slices.SortFunc(cmds, func(a, b *redisCommand) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return cmds
+}
+
+// findCommand returns the command named name, in any case.
+func (h *RedisHandler) findCommand(name []byte) (*redisCommand, bool) {
+	cmd, ok := h.commandIndex[strings.ToUpper(string(name))]
+	return cmd, ok
+}
+
+// handleCommand serves COMMAND and its COUNT, INFO, DOCS and LIST
+// subcommands.
+func (h *RedisHandler) handleCommand(writer *bufio.Writer, args [][]byte) {
+	cmds := h.commands()
+	if len(args) == 0 {
+		h.writeArrayLen(writer, len(cmds))
+		for _, cmd := range cmds {
+			h.writeCommandInfo(writer, cmd)
+		}
+		return
+	}
+	
+	switch strings.ToUpper(string(args[0])) {
+	case "COUNT":
+		if len(args) != 1 {
+			h.writeError(writer, "ERR wrong number of arguments for 'command|count' command")
+			return
+		}
+		h.writeInteger(writer, int64(len(cmds)))
+	
+	case "LIST":
+		if len(args) != 1 {
+			h.writeError(writer, "ERR syntax error")
+			return
+		}
+		names := make([]string, len(cmds))
+		for i, cmd := range cmds {
+			names[i] = cmd.name
+		}
+		h.writeArray(writer, names)
+	
+	case "INFO":
+		if len(args) == 1 {
+			h.handleCommand(writer, nil)
+			return
+		}
+		h.writeArrayLen(writer, len(args)-1)
+		for _, name := range args[1:] {
+			if cmd, ok := h.findCommand(name); ok {
+				h.writeCommandInfo(writer, cmd)
+			} else {
+				h.writeNilArray(writer)
+			}
+		}
+	
+	case "DOCS":
+		// Unknown names are left out, as Redis does.
+		if len(args) > 1 {
+			var found []*redisCommand
+			for _, name := range args[1:] {
+				if cmd, ok := h.findCommand(name); ok {
+					found = append(found, cmd)
+				}
+			}
+			cmds = found
+		}
+		h.writeArrayLen(writer, 2*len(cmds))
+		for _, cmd := range cmds {
+			h.writeBulkString(writer, cmd.name)
+			h.writeCommandDocs(writer, cmd)
+		}
+	
+	default:
+		h.writeUnknownSubcommand(writer, "COMMAND", args[0])
+	}
+}
+
+// writeCommandInfo writes cmd in the layout COMMAND INFO uses in Redis 6:
+// name, arity, flags, first key, last key, key step and ACL categories.
+func (h *RedisHandler) writeCommandInfo(writer *bufio.Writer, cmd *redisCommand) {
+	h.writeArrayLen(writer, 7)
+	h.writeBulkString(writer, cmd.name)
+	h.writeInteger(writer, int64(cmd.arity))
+	h.writeArrayLen(writer, len(cmd.flags))
+	for _, flag := range cmd.flags {
+		h.writeSimpleString(writer, flag)
+	}
+	h.writeInteger(writer, int64(cmd.firstKey))
+	h.writeInteger(writer, int64(cmd.lastKey))
+	h.writeInteger(writer, int64(cmd.step))
+	h.writeArrayLen(writer, len(cmd.categories))
+	for _, category := range cmd.categories {
+		h.writeSimpleString(writer, category)
+	}
+}
+
+// writeCommandDocs writes the documentation map of cmd as a flat array of
+// field names and values.
+func (h *RedisHandler) writeCommandDocs(writer *bufio.Writer, cmd *redisCommand) {
+	fields := []string{"summary", cmd.summary}
+	if cmd.since != "" {
+		fields = append(fields, "since", cmd.since)
+	}
+	fields = append(fields, "group", cmd.group)
+	h.writeArray(writer, fields)
+}
@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CommandStats counts the calls of each Redis command, how many failed or
+// were rejected and how long they took, for INFO commandstats and
+// latencystats, GET /stats and GET /metrics. A nil *CommandStats counts
+// nothing.
+type CommandStats struct {
+	commands sync.Map // command name -> *commandCounters
+}
+
+// CommandStat describes the calls of one command, as Redis reports them.
+// Calls counts the commands that ran, failed ones included, and Usec
+// their total time; RejectedCalls counts those refused before running,
+// for a wrong number of arguments, a missing AUTH or the rate limit, and
+// FailedCalls those that ran and replied with an error.
+type CommandStat struct {
+	Calls         uint64  `json:"calls"`
+	Usec          uint64  `json:"usec"`
+	UsecPerCall   float64 `json:"usec_per_call"`
+	RejectedCalls uint64  `json:"rejected_calls"`
+	FailedCalls   uint64  `json:"failed_calls"`
+	// P50, P99 and P999 are percentiles of the call times in
+	// microseconds, accurate to within a fifth.
+	P50  float64 `json:"p50"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p99.9"`
+}
+
+// latencyBuckets is the number of buckets of a command's histogram of
+// call times: four per power of two of nanoseconds.
+const latencyBuckets = 64 * 4
+
+type commandCounters struct {
+	calls    atomic.Uint64
+	nanos    atomic.Uint64
+	rejected atomic.Uint64
+	failed   atomic.Uint64
+	latency  [latencyBuckets]atomic.Uint64
+}
+
+func NewCommandStats() *CommandStats {
+	return &CommandStats{}
+}
+
+func (s *CommandStats) of(name string) *commandCounters {
+	if cc, ok := s.commands.Load(name); ok {
+		return cc.(*commandCounters)
+	}
+	cc, _ := s.commands.LoadOrStore(name, &commandCounters{})
+	return cc.(*commandCounters)
+}
+
+// record counts a call of the named command that took d.
+func (s *CommandStats) record(name string, d time.Duration, failed bool) {
+	if s == nil {
+		return
+	}
+	cc := s.of(name)
+	cc.calls.Add(1)
+	cc.nanos.Add(uint64(d))
+	cc.latency[latencyBucket(uint64(d))].Add(1)
+	if failed {
+		cc.failed.Add(1)
+	}
+}
+
+// reject counts a call of the named command refused before it ran.
+func (s *CommandStats) reject(name string) {
+	if s != nil {
+		s.of(name).rejected.Add(1)
+	}
+}
+
+// Stats returns the counters of every command called since the server
+// started, by name.
+func (s *CommandStats) Stats() map[string]CommandStat {
+	stats := make(map[string]CommandStat)
+	if s == nil {
+		return stats
+	}
+	s.commands.Range(func(name, v any) bool {
+		stats[name.(string)] = v.(*commandCounters).stat()
+		return true
+	})
+	return stats
+}
+
+func (cc *commandCounters) stat() CommandStat {
+	stat := CommandStat{
+		Calls:         cc.calls.Load(),
+		Usec:          cc.nanos.Load() / 1000,
+		RejectedCalls: cc.rejected.Load(),
+		FailedCalls:   cc.failed.Load(),
+	}
+	if stat.Calls > 0 {
+		stat.UsecPerCall = float64(cc.nanos.Load()) / 1000 / float64(stat.Calls)
+	}
+
+	var counts [latencyBuckets]uint64
+	var total uint64
+	for i := range cc.latency {
+		counts[i] = cc.latency[i].Load()
+		total += counts[i]
+	}
+	stat.P50 = percentile(&counts, total, 0.5)
+	stat.P99 = percentile(&counts, total, 0.99)
+	stat.P999 = percentile(&counts, total, 0.999)
+	return stat
+}
+
+// latencyBucket returns the histogram bucket of a call time in
+// nanoseconds: its highest set bit and the two bits below it.
+func latencyBucket(ns uint64) int {
+	if ns < 4 {
+		return int(ns)
+	}
+	top := bits.Len64(ns) - 1
+	return top*4 + int(ns>>(top-2)&3)
+}
+
+// bucketLimit returns the largest call time in nanoseconds that falls in
+// bucket b.
+func bucketLimit(b int) uint64 {
+	if b < 4 {
+		return uint64(b)
+	}
+	top, sub := b/4, uint64(b%4)
+	return (4+sub+1)<<(top-2) - 1
+}
+
+// percentile returns the call time in microseconds that a share p of the
+// calls counted in counts did not exceed.
+func percentile(counts *[latencyBuckets]uint64, total uint64, p float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	rank := max(uint64(math.Ceil(p*float64(total))), 1)
+	var seen uint64
+	for b, n := range counts {
+		if seen += n; seen >= rank {
+			return float64(bucketLimit(b)) / 1000
+		}
+	}
+	return 0
+}
+
+// commandNames returns the names in stats in order.
+func commandNames(stats map[string]CommandStat) []string {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replyWriter is what a Redis client's buffered writer flushes to. Every
+// command's reply is flushed before the next command runs, so the first
+// byte written after reset tells whether the reply was an error.
+type replyWriter struct {
+	w       io.Writer
+	started bool
+	failed  bool
+}
+
+func (r *replyWriter) reset() {
+	r.started, r.failed = false, false
+}
+
+func (r *replyWriter) Write(p []byte) (int, error) {
+	if !r.started && len(p) > 0 {
+		r.started = true
+		r.failed = p[0] == '-'
+	}
+	return r.w.Write(p)
+}
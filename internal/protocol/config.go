@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/clients"
+	"github.com/grumpylabs/gopogo/internal/health"
+	"github.com/grumpylabs/gopogo/internal/origin"
+	"github.com/grumpylabs/gopogo/internal/persistence"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+// Config holds settings shared by the protocol handlers. Zero values
+// select the defaults.
+type Config struct {
+	// Auth lists the passwords clients may authenticate with; more than
+	// one lets a password be rotated. Empty disables authentication.
+	Auth            []string
+	MaxBulkLen      int64
+	MaxMultiBulkLen int64
+	Limits          *ratelimit.Registry
+	TLS             *tls.Config
+	// RequireTLS, if set, reports whether a Postgres client on a
+	// plaintext connection must upgrade with SSLRequest before its
+	// startup message is accepted.
+	RequireTLS func(conn net.Conn) bool
+	// SentinelMaster, if set, enables the SENTINEL discovery commands,
+	// which report this server as the master of that name.
+	SentinelMaster string
+	// Clients, if set, is listed by CLIENT LIST.
+	Clients *clients.Registry
+	// Traffic, if set, counts each protocol's commands and bytes for
+	// the stats endpoints and INFO.
+	Traffic *Traffic
+	// Commands, if set, counts the calls of each Redis command for INFO
+	// commandstats and the stats endpoints.
+	Commands *CommandStats
+	// Errors, if set, counts each protocol's parse, authentication and
+	// internal errors for the stats endpoints.
+	Errors *ErrorStats
+	// Version and Commit identify the gopogo build, and Started is when
+	// the server started, for INFO, memcached stats and the stats
+	// endpoints.
+	Version string
+	Commit  string
+	Started time.Time
+	// Host is the address SENTINEL reports, with Port, to clients that
+	// are not connected over TCP.
+	Host string
+	// Port is the TCP port INFO reports Redis is served on.
+	Port int
+	// Snapshots, if set, is reported in the persistence section of INFO.
+	Snapshots *persistence.Snapshotter
+	// Origin, if set, is the backing store that GET misses are read
+	// through from; fetched values are cached for OriginTTL (0 = no TTL).
+	Origin    origin.Origin
+	OriginTTL time.Duration
+	// WriteBehind, if set, is the queue writing changes back to the
+	// backing store, reported on /stats/writebehind.
+	WriteBehind *origin.WriteBehind
+	// Health reports the server state for /healthz and /readyz.
+	Health func() *health.Status
+	// EnableDebug allows the DEBUG command.
+	EnableDebug bool
+	// Namespaces maps a protocol name ("redis", "http", "memcache",
+	// "postgres") to a key prefix its clients are confined to.
+	Namespaces map[string]string
+	// HandshakeTimeout bounds the PostgreSQL startup exchange, including
+	// any TLS upgrade.
+	HandshakeTimeout time.Duration
+	// HTTPHeaderTimeout bounds how long an HTTP client may take to send
+	// request headers.
+	HTTPHeaderTimeout time.Duration
+	// WSAllowedOrigins lists the origins, such as https://app.example.com,
+	// of other sites whose pages may open WebSockets; "*" allows any.
+	// Pages served from the server's own host are always allowed.
+	WSAllowedOrigins []string
+	// DNSTTL is the TTL of DNS records whose key does not expire
+	// (0 = one minute).
+	DNSTTL time.Duration
+
+	// Admin, if set, is mounted on the HTTP protocol under /admin/ and
+	// does its own authentication.
+	Admin http.Handler
+}
+
+// uptime returns how long the server has been running, or 0 if the
+// configuration does not say when it started.
+func (c *Config) uptime(now time.Time) time.Duration {
+	if c.Started.IsZero() {
+		return 0
+	}
+	return now.Sub(c.Started)
+}
+
+// version returns the gopogo version, or "dev" if it was not set.
+func (c *Config) version() string {
+	if c.Version == "" {
+		return "dev"
+	}
+	return c.Version
+}
+
+// checkAuth reports whether password is one of the accepted passwords.
+func (c *Config) checkAuth(password string) bool {
+	ok := false
+	for _, p := range c.Auth {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(p)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
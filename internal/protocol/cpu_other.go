@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package protocol
+
+import "time"
+
+func cpuTime() (user, sys time.Duration) {
+	return 0, 0
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package protocol
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime returns the CPU time the process has spent in user and in
+// system mode.
+func cpuTime() (user, sys time.Duration) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0
+	}
+	return time.Duration(usage.Utime.Nano()), time.Duration(usage.Stime.Nano())
+}
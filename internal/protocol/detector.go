@@ -3,8 +3,11 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"slices"
 )
 
 type Type int
@@ -15,31 +18,107 @@ const (
 	TypeHTTP
 	TypeMemcache
 	TypePostgres
+	// TypeTLS is a TLS ClientHello arriving on a plain listener.
+	TypeTLS
+	// TypeMemcacheBinary is the memcached binary protocol, which gopogo
+	// does not implement.
+	TypeMemcacheBinary
+	// TypeDNS is DNS over TCP, served on its own port only.
+	TypeDNS
 )
 
+func (t Type) String() string {
+	switch t {
+	case TypeRedis:
+		return "redis"
+	case TypeHTTP:
+		return "http"
+	case TypeMemcache:
+		return "memcache"
+	case TypePostgres:
+		return "postgres"
+	case TypeTLS:
+		return "tls"
+	case TypeMemcacheBinary:
+		return "memcache-binary"
+	case TypeDNS:
+		return "dns"
+	default:
+		if p := registered(t); p != nil {
+			return p.Name
+		}
+		return "unknown"
+	}
+}
+
+// Refuse tells a client of protocol t why its connection is about to be
+// closed, in a form its client library will report, before any request
+// has been read.
+func Refuse(conn net.Conn, t Type, message string) {
+	var reply []byte
+	switch t {
+	case TypeHTTP:
+		reply = fmt.Appendf(nil, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n", len(message)+1, message)
+	case TypeMemcache:
+		reply = fmt.Appendf(nil, "SERVER_ERROR %s\r\n", message)
+	case TypeDNS:
+		// DNS has no way to report an error before a query arrives.
+		return
+	case TypePostgres:
+		fields := "SFATAL\x00C28000\x00M" + message + "\x00\x00"
+		reply = binary.BigEndian.AppendUint32([]byte{'E'}, uint32(4+len(fields)))
+		reply = append(reply, fields...)
+	default:
+		reply = fmt.Appendf(nil, "-ERR %s\r\n", message)
+	}
+	conn.Write(reply)
+}
+
 type Detector struct {
-	conn   net.Conn
-	reader *bufio.Reader
-	peeked []byte
+	conn    net.Conn
+	reader  *bufio.Reader
+	peeked  []byte
+	enabled []Type
 }
 
-func NewDetector(conn net.Conn) *Detector {
+// NewDetector returns a Detector for conn. enabled lists the protocols
+// the server serves, which registered protocols must be among to be
+// detected and which input no protocol claims is given to; with none,
+// every protocol is taken to be enabled.
+func NewDetector(conn net.Conn, enabled ...Type) *Detector {
 	return &Detector{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		enabled: enabled,
 	}
 }
 
+// Detect identifies the protocol from the first bytes the client sends.
+// It waits for the first read to arrive, bounded by any deadline set on
+// the connection, and then inspects up to 8 bytes of it without waiting
+// for more, so short inline commands are not held up.
 func (d *Detector) Detect() (Type, error) {
-	peek, err := d.reader.Peek(8)
+	_, err := d.reader.Peek(1)
 	if err != nil && err != io.EOF {
 		return TypeUnknown, err
 	}
+	peek, _ := d.reader.Peek(min(d.reader.Buffered(), 8))
 	
 	d.peeked = peek
 	
 	if len(peek) == 0 {
-		return TypeRedis, nil
+		return d.fallback(), nil
+	}
+	
+	// A TLS handshake record (type 22, version 3.x) carrying a
+	// ClientHello (handshake type 1).
+	if len(peek) >= 6 && peek[0] == 0x16 && peek[1] == 0x03 && peek[5] == 0x01 {
+		return TypeTLS, nil
+	}
+	
+	// The request magic byte of the memcached binary protocol.
+	if peek[0] == 0x80 {
+		return TypeMemcacheBinary, nil
 	}
 	
 	if peek[0] == '*' || peek[0] == '$' || peek[0] == '+' || peek[0] == '-' || peek[0] == ':' {
@@ -57,9 +136,14 @@ func (d *Detector) Detect() (Type, error) {
 	}
 	
 	if bytes.HasPrefix(peek, []byte("get ")) ||
+	   bytes.HasPrefix(peek, []byte("gets ")) ||
 	   bytes.HasPrefix(peek, []byte("set ")) ||
 	   bytes.HasPrefix(peek, []byte("add ")) ||
 	   bytes.HasPrefix(peek, []byte("replace ")) ||
+	   bytes.HasPrefix(peek, []byte("append ")) ||
+	   bytes.HasPrefix(peek, []byte("prepend ")) ||
+	   bytes.HasPrefix(peek, []byte("cas ")) ||
+	   bytes.HasPrefix(peek, []byte("touch ")) ||
 	   bytes.HasPrefix(peek, []byte("delete ")) ||
 	   bytes.HasPrefix(peek, []byte("incr ")) ||
 	   bytes.HasPrefix(peek, []byte("decr ")) ||
@@ -73,7 +157,42 @@ func (d *Detector) Detect() (Type, error) {
 		return TypePostgres, nil
 	}
 	
-	return TypeRedis, nil
+	// SSLRequest and GSSENCRequest: length 8 followed by request code
+	// 80877103 or 80877104. CancelRequest: length 16 followed by
+	// 80877102, then the process ID and secret key.
+	if len(peek) >= 8 && bytes.Equal(peek[:7], []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16}) &&
+		(peek[7] == 0x2f || peek[7] == 0x30) {
+		return TypePostgres, nil
+	}
+	if len(peek) >= 8 && bytes.Equal(peek[:8], []byte{0x00, 0x00, 0x00, 0x10, 0x04, 0xd2, 0x16, 0x2e}) {
+		return TypePostgres, nil
+	}
+	
+	if t, ok := matchRegistered(peek, d.isEnabled); ok {
+		return t, nil
+	}
+	
+	return d.fallback(), nil
+}
+
+func (d *Detector) isEnabled(t Type) bool {
+	return len(d.enabled) == 0 || slices.Contains(d.enabled, t)
+}
+
+// fallback returns the protocol of input no protocol claims: Redis, whose
+// inline commands can be any text, if it is enabled; otherwise the only
+// enabled protocol, or memcache, the other text protocol. With several
+// others enabled the input is TypeUnknown.
+func (d *Detector) fallback() Type {
+	switch {
+	case d.isEnabled(TypeRedis):
+		return TypeRedis
+	case len(d.enabled) == 1:
+		return d.enabled[0]
+	case d.isEnabled(TypeMemcache):
+		return TypeMemcache
+	}
+	return TypeUnknown
 }
 
 func (d *Detector) Conn() net.Conn {
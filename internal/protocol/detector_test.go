@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  Type
+	}{
+		{"resp", []byte("*1\r\n$4\r\nPING\r\n"), TypeRedis},
+		{"http", []byte("GET /key HTTP/1.1\r\n\r\n"), TypeHTTP},
+		{"memcache text", []byte("get key\r\n"), TypeMemcache},
+		{"memcache gets", []byte("gets key\r\n"), TypeMemcache},
+		{"memcache cas", []byte("cas key 0 0 1 42\r\nx\r\n"), TypeMemcache},
+		{"memcache binary", []byte{0x80, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 'k', 'e', 'y'}, TypeMemcacheBinary},
+		{"postgres startup", []byte{0x00, 0x00, 0x00, 0x09, 0x00, 0x03, 0x00, 0x00, 0x00}, TypePostgres},
+		{"postgres ssl request", []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}, TypePostgres},
+		{"postgres gssenc request", []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x30}, TypePostgres},
+		{"postgres cancel request", []byte{0x00, 0x00, 0x00, 0x10, 0x04, 0xd2, 0x16, 0x2e, 0, 0, 0, 1, 0, 0, 0, 2}, TypePostgres},
+		{"tls client hello", []byte{0x16, 0x03, 0x01, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xf0, 0x03, 0x03}, TypeTLS},
+		{"unknown", []byte("HELLOWORLD"), TypeRedis},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+
+			go func() {
+				client.Write(tt.input)
+				client.Close()
+			}()
+
+			detector := NewDetector(server)
+			got, err := detector.Detect()
+			if err != nil {
+				t.Fatalf("Detect failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("Detected %v, want %v", got, tt.want)
+			}
+
+			// Detection must not consume the input.
+			data, _ := io.ReadAll(detector.Conn())
+			if string(data) != string(tt.input) {
+				t.Fatalf("Conn returned %q, want %q", data, tt.input)
+			}
+		})
+	}
+}
+
+func TestDetectShortInput(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// An inline command shorter than the detector's peek must not wait
+	// for bytes the client is never going to send.
+	go client.Write([]byte("PING\r\n"))
+	server.SetDeadline(time.Now().Add(time.Second))
+
+	got, err := NewDetector(server).Detect()
+	if err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if got != TypeRedis {
+		t.Fatalf("Detected %v, want %v", got, TypeRedis)
+	}
+}
+
+func TestDetectEnabled(t *testing.T) {
+	inputs := map[string][]byte{
+		"resp":      []byte("*1\r\n$4\r\nPING\r\n"),
+		"http":      []byte("GET /key HTTP/1.1\r\n\r\n"),
+		"memcache":  []byte("get key\r\n"),
+		"postgres":  {0x00, 0x00, 0x00, 0x09, 0x00, 0x03, 0x00, 0x00, 0x00},
+		"ambiguous": []byte("PING\r\n"),
+		"empty":     {},
+	}
+	tests := []struct {
+		enabled []Type
+		want    map[string]Type
+	}{
+		{[]Type{TypeRedis}, map[string]Type{"ambiguous": TypeRedis, "empty": TypeRedis}},
+		{[]Type{TypeHTTP}, map[string]Type{"ambiguous": TypeHTTP, "empty": TypeHTTP}},
+		{[]Type{TypeMemcache}, map[string]Type{"ambiguous": TypeMemcache, "empty": TypeMemcache}},
+		{[]Type{TypePostgres}, map[string]Type{"ambiguous": TypePostgres, "empty": TypePostgres}},
+		{[]Type{TypeRedis, TypeMemcache}, map[string]Type{"ambiguous": TypeRedis, "empty": TypeRedis}},
+		{[]Type{TypeHTTP, TypeMemcache}, map[string]Type{"ambiguous": TypeMemcache, "empty": TypeMemcache}},
+		{[]Type{TypeHTTP, TypePostgres}, map[string]Type{"ambiguous": TypeUnknown, "empty": TypeUnknown}},
+	}
+
+	for _, tt := range tests {
+		for name, input := range inputs {
+			// Input a protocol claims is detected as that protocol
+			// whatever is enabled.
+			want, ok := tt.want[name]
+			if !ok {
+				want = map[string]Type{"resp": TypeRedis, "http": TypeHTTP, "memcache": TypeMemcache, "postgres": TypePostgres}[name]
+			}
+
+			client, server := net.Pipe()
+			go func() {
+				client.Write(input)
+				client.Close()
+			}()
+			got, err := NewDetector(server, tt.enabled...).Detect()
+			server.Close()
+			if err != nil {
+				t.Fatalf("%v, %s: Detect failed: %v", tt.enabled, name, err)
+			}
+			if got != want {
+				t.Errorf("%v enabled, %s detected as %v, want %v", tt.enabled, name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// DNS record types, classes and response codes used by the DNS mode.
+const (
+	dnsTypeA    = 1
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeOPT  = 41
+	dnsClassIN  = 1
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+)
+
+const (
+	// dnsHeaderLen is the size of a DNS message header.
+	dnsHeaderLen = 12
+	// dnsUDPSize is the largest UDP response sent to a client that did
+	// not advertise a larger buffer with EDNS.
+	dnsUDPSize = 512
+	// dnsEDNSSize is the UDP buffer size advertised in responses, the
+	// size recommended to avoid IP fragmentation.
+	dnsEDNSSize = 1232
+	// dnsDefaultTTL is the TTL of records whose key does not expire, if
+	// Config.DNSTTL is not set.
+	dnsDefaultTTL = time.Minute
+)
+
+// dnsTypes maps the record types the DNS mode answers to the suffix of
+// their keys, dns:<name>:<type>.
+var dnsTypes = map[uint16]string{
+	dnsTypeA:    "A",
+	dnsTypeTXT:  "TXT",
+	dnsTypeAAAA: "AAAA",
+}
+
+var errDNSFormat = errors.New("malformed DNS message")
+
+// DNSHandler answers DNS queries for A, AAAA and TXT records from the keys
+// dns:<name>:<type>, with the name in lower case and without the trailing
+// dot. A and AAAA values list addresses separated by whitespace; each line
+// of a TXT value is one record. Records take the TTL left on their key.
+type DNSHandler struct {
+	cache   Keyspace
+	config  *Config
+	traffic *trafficCounters
+}
+
+func NewDNSHandler(cache *cache.Cache, config *Config) *DNSHandler {
+	return &DNSHandler{
+		cache:   keyspace(cache, config, TypeDNS),
+		config:  config,
+		traffic: config.Traffic.of(TypeDNS.String()),
+	}
+}
+
+// Handle serves DNS over TCP, where each message is preceded by its
+// length.
+func (h *DNSHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	conn = h.traffic.wrap(conn)
+	limiter := h.config.Limits.Open(conn.RemoteAddr())
+	defer limiter.Close()
+
+	reader := bufio.NewReader(limiter.Reader(conn))
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(reader, query); err != nil {
+			return
+		}
+
+		h.traffic.command()
+		reply := h.answer(query, 0xffff, limiter.AllowCommand())
+		if reply == nil {
+			return
+		}
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(reply))), reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// ServeUDP serves DNS over UDP until pc is closed. Responses that do not
+// fit the client's buffer are truncated, telling it to retry over TCP.
+func (h *DNSHandler) ServeUDP(pc net.PacketConn) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		allowed := h.config.Limits.Packet(addr).AllowPacket(n)
+		h.traffic.command()
+		reply := h.answer(buf[:n], dnsUDPSize, allowed)
+		if reply != nil {
+			pc.WriteTo(reply, addr)
+		}
+		h.traffic.packet(n, len(reply))
+	}
+}
+
+// dnsQuery is the part of a query the response is built from.
+type dnsQuery struct {
+	id       uint16
+	flags    uint16
+	question []byte // the question section as sent
+	name     string // the queried name, in lower case without the final dot
+	qtype    uint16
+	qclass   uint16
+	edns     bool
+	udpSize  int
+}
+
+// answer returns the response to the query message msg, at most maxSize
+// bytes unless the query advertised a larger EDNS buffer, or nil if msg
+// is too short to answer. Refused queries get REFUSED.
+func (h *DNSHandler) answer(msg []byte, maxSize int, allowed bool) []byte {
+	if len(msg) < dnsHeaderLen {
+		return nil
+	}
+	q, err := parseDNSQuery(msg)
+	switch {
+	case q.flags&0x8000 != 0:
+		// A response, not a query: never answer it, to avoid loops.
+		return nil
+	case err != nil:
+		h.config.Errors.count(TypeDNS, errorParse)
+		return dnsResponse(q, dnsRcodeFormErr, nil, 0)
+	case (q.flags>>11)&0xf != 0:
+		return dnsResponse(q, dnsRcodeNotImp, nil, 0)
+	case !allowed:
+		return dnsResponse(q, dnsRcodeRefused, nil, 0)
+	}
+	if q.edns && q.udpSize > maxSize {
+		maxSize = q.udpSize
+	}
+
+	if q.qclass != dnsClassIN {
+		return dnsResponse(q, dnsRcodeNotImp, nil, 0)
+	}
+
+	var records [][]byte
+	var ttl uint32
+	found := false
+	for qtype, suffix := range dnsTypes {
+		entry, ok := h.cache.Load([]byte("dns:" + q.name + ":" + suffix))
+		if !ok {
+			continue
+		}
+		found = true
+		if qtype != q.qtype {
+			continue
+		}
+		records, err = dnsRecords(qtype, entry.Value())
+		if err != nil {
+			h.config.Errors.count(TypeDNS, errorInternal)
+			return dnsResponse(q, dnsRcodeServFail, nil, 0)
+		}
+		ttl = h.recordTTL(entry)
+	}
+	if !found {
+		return dnsResponse(q, dnsRcodeNXDomain, nil, 0)
+	}
+
+	reply := dnsResponse(q, 0, records, ttl)
+	if len(reply) > maxSize {
+		reply = dnsResponse(q, 0, nil, 0)
+		binary.BigEndian.PutUint16(reply[2:], binary.BigEndian.Uint16(reply[2:])|0x0200) // TC
+	}
+	return reply
+}
+
+// recordTTL returns the TTL of the records held by entry: the time left
+// before it expires, rounded up, or the configured default.
+func (h *DNSHandler) recordTTL(entry *cache.Entry) uint32 {
+	expireAt := entry.ExpireAt()
+	if expireAt == 0 {
+		ttl := h.config.DNSTTL
+		if ttl <= 0 {
+			ttl = dnsDefaultTTL
+		}
+		return uint32(ttl / time.Second)
+	}
+	remaining := time.Duration(expireAt - time.Now().UnixNano())
+	return uint32(max(remaining+time.Second-1, 0) / time.Second)
+}
+
+// parseDNSQuery parses the header and single question of msg, and the
+// EDNS OPT record if the additional section holds one. It fills in the
+// header fields of the returned query even if the rest is malformed.
+func parseDNSQuery(msg []byte) (dnsQuery, error) {
+	q := dnsQuery{
+		id:    binary.BigEndian.Uint16(msg[0:]),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:])
+	ancount := binary.BigEndian.Uint16(msg[6:])
+	nscount := binary.BigEndian.Uint16(msg[8:])
+	arcount := binary.BigEndian.Uint16(msg[10:])
+	if qdcount != 1 || ancount != 0 || nscount != 0 {
+		return q, errDNSFormat
+	}
+
+	// The name is a sequence of labels ending with the empty root label.
+	// Compression pointers are not expected in the only question.
+	var labels []string
+	off := dnsHeaderLen
+	for {
+		if off >= len(msg) {
+			return q, errDNSFormat
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n > 63 || off+n > len(msg) {
+			return q, errDNSFormat
+		}
+		labels = append(labels, strings.ToLower(string(msg[off:off+n])))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return q, errDNSFormat
+	}
+	q.qtype = binary.BigEndian.Uint16(msg[off:])
+	q.qclass = binary.BigEndian.Uint16(msg[off+2:])
+	off += 4
+	q.question = msg[dnsHeaderLen:off]
+	q.name = strings.Join(labels, ".")
+
+	// An OPT record has the root name, type OPT, the client's UDP buffer
+	// size as its class, a TTL and its options.
+	if arcount == 1 && off+11 <= len(msg) && msg[off] == 0 && binary.BigEndian.Uint16(msg[off+1:]) == dnsTypeOPT {
+		q.edns = true
+		q.udpSize = int(binary.BigEndian.Uint16(msg[off+3:]))
+	}
+	return q, nil
+}
+
+// dnsRecords returns the RDATA of the records of type qtype held in value.
+func dnsRecords(qtype uint16, value []byte) ([][]byte, error) {
+	var records [][]byte
+	switch qtype {
+	case dnsTypeA, dnsTypeAAAA:
+		for _, field := range strings.Fields(string(value)) {
+			addr, err := netip.ParseAddr(field)
+			if err != nil || addr.Is4() != (qtype == dnsTypeA) {
+				return nil, errDNSFormat
+			}
+			records = append(records, addr.AsSlice())
+		}
+	case dnsTypeTXT:
+		for _, line := range strings.Split(strings.TrimRight(string(value), "\n"), "\n") {
+			// A TXT record is a sequence of strings of up to 255 bytes.
+			line = strings.TrimSuffix(line, "\r")
+			var rdata []byte
+			for {
+				n := min(len(line), 255)
+				rdata = append(append(rdata, byte(n)), line[:n]...)
+				line = line[n:]
+				if line == "" {
+					break
+				}
+			}
+			records = append(records, rdata)
+		}
+	}
+	return records, nil
+}
+
+// dnsResponse builds the response to q with the given response code and
+// answer records, each for the queried name with the given TTL.
+func dnsResponse(q dnsQuery, rcode int, records [][]byte, ttl uint32) []byte {
+	// QR, the opcode and RD from the query, AA and the response code.
+	flags := 0x8000 | q.flags&0x7900 | 0x0400 | uint16(rcode)
+
+	qdcount := 0
+	if q.question != nil {
+		qdcount = 1
+	}
+	arcount := 0
+	if q.edns {
+		arcount = 1
+	}
+
+	resp := make([]byte, 0, 512)
+	resp = binary.BigEndian.AppendUint16(resp, q.id)
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(qdcount))
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(records)))
+	resp = binary.BigEndian.AppendUint16(resp, 0)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(arcount))
+	resp = append(resp, q.question...)
+
+	for _, rdata := range records {
+		// A compression pointer to the name in the question.
+		resp = binary.BigEndian.AppendUint16(resp, 0xc000|dnsHeaderLen)
+		resp = binary.BigEndian.AppendUint16(resp, q.qtype)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, ttl)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+
+	if q.edns {
+		resp = append(resp, 0)
+		resp = binary.BigEndian.AppendUint16(resp, dnsTypeOPT)
+		resp = binary.BigEndian.AppendUint16(resp, dnsEDNSSize)
+		resp = binary.BigEndian.AppendUint32(resp, 0)
+		resp = binary.BigEndian.AppendUint16(resp, 0)
+	}
+	return resp
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+func TestDNS(t *testing.T) {
+	c := cache.New(1, 0)
+	c.Store([]byte("dns:www.example.com:A"), []byte("192.0.2.1 192.0.2.2"), &cache.StoreOptions{TTL: 30 * time.Second})
+	c.Store([]byte("dns:www.example.com:AAAA"), []byte("2001:db8::1"), nil)
+	c.Store([]byte("dns:example.com:TXT"), []byte("v=spf1 -all\n"+strings.Repeat("x", 300)), nil)
+	c.Store([]byte("dns:big.example.com:TXT"), []byte(strings.Repeat("y\n", 200)), nil)
+	c.Store([]byte("dns:bad.example.com:A"), []byte("2001:db8::1"), nil)
+	h := NewDNSHandler(c, &Config{})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go h.ServeUDP(pc)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go h.Handle(conn)
+		}
+	}()
+
+	// The Go resolver falls back to TCP for truncated responses.
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			if network == "tcp" {
+				return d.DialContext(ctx, network, ln.Addr().String())
+			}
+			return d.DialContext(ctx, network, pc.LocalAddr().String())
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, err := resolver.LookupHost(ctx, "WWW.Example.com")
+	slices.Sort(addrs)
+	if err != nil || !slices.Equal(addrs, []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}) {
+		t.Errorf("LookupHost = %v, %v", addrs, err)
+	}
+
+	txts, err := resolver.LookupTXT(ctx, "example.com")
+	slices.Sort(txts)
+	if err != nil || !slices.Equal(txts, []string{"v=spf1 -all", strings.Repeat("x", 300)}) {
+		t.Errorf("LookupTXT = %v, %v", txts, err)
+	}
+
+	txts, err = resolver.LookupTXT(ctx, "big.example.com")
+	if err != nil || len(txts) != 200 {
+		t.Errorf("LookupTXT over TCP = %d records, %v", len(txts), err)
+	}
+
+	var dnsErr *net.DNSError
+	if _, err := resolver.LookupHost(ctx, "missing.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupHost of a missing name = %v", err)
+	}
+	if _, err := resolver.LookupTXT(ctx, "www.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupTXT of a name without TXT records = %v", err)
+	}
+	if _, err := resolver.LookupIP(ctx, "ip4", "bad.example.com"); err == nil || errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		t.Errorf("LookupIP of an invalid record = %v", err)
+	}
+}
+
+func TestDNSRateLimit(t *testing.T) {
+	c := cache.New(1, 0)
+	c.Store([]byte("dns:a.test:A"), []byte("192.0.2.1"), nil)
+	h := NewDNSHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{IPCommands: 2})})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go h.ServeUDP(pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Repeated queries from one address are refused over the per-IP
+	// limit.
+	buf := make([]byte, 512)
+	for id := uint16(0); id < 3; id++ {
+		query := binary.BigEndian.AppendUint16(nil, id)
+		query = append(query, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+		query = append(query, "\x01a\x04test\x00\x00\x01\x00\x01"...)
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || n < dnsHeaderLen {
+			t.Fatalf("Query %d: %d bytes, %v", id, n, err)
+		}
+		want := 0
+		if id == 2 {
+			want = dnsRcodeRefused
+		}
+		if rcode := int(buf[3] & 0xf); rcode != want {
+			t.Errorf("Query %d: rcode %d, want %d", id, rcode, want)
+		}
+	}
+}
+
+func TestDNSRecordTTL(t *testing.T) {
+	c := cache.New(1, 0)
+	c.Store([]byte("dns:a.test:A"), []byte("192.0.2.1"), &cache.StoreOptions{TTL: 90 * time.Second})
+	c.Store([]byte("dns:b.test:A"), []byte("192.0.2.1"), nil)
+	h := NewDNSHandler(c, &Config{DNSTTL: 5 * time.Minute})
+
+	if entry, _ := c.Load([]byte("dns:a.test:A")); h.recordTTL(entry) != 90 {
+		t.Errorf("TTL of an expiring key = %d, want 90", h.recordTTL(entry))
+	}
+	if entry, _ := c.Load([]byte("dns:b.test:A")); h.recordTTL(entry) != 300 {
+		t.Errorf("TTL of a persistent key = %d, want 300", h.recordTTL(entry))
+	}
+}
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrorStats counts the errors each protocol's clients run into, by kind,
+// for GET /stats and GET /metrics, so that a rising error rate can be
+// alerted on. A nil *ErrorStats counts nothing.
+type ErrorStats struct {
+	counters sync.Map // errorKey -> *atomic.Uint64
+}
+
+// The kinds of errors counted.
+const (
+	// errorParse is a request that could not be parsed: broken protocol
+	// framing, an unknown memcache command or a malformed query.
+	errorParse = "parse"
+	// errorAuth is a request refused for a missing or wrong password.
+	errorAuth = "auth"
+	// errorInternal is a request the server failed to carry out, such
+	// as a read-through the origin failed.
+	errorInternal = "internal"
+)
+
+type errorKey struct {
+	proto, kind string
+}
+
+func NewErrorStats() *ErrorStats {
+	return &ErrorStats{}
+}
+
+// count counts an error of the given kind on proto.
+func (s *ErrorStats) count(proto Type, kind string) {
+	if s == nil {
+		return
+	}
+	key := errorKey{proto.String(), kind}
+	n, ok := s.counters.Load(key)
+	if !ok {
+		n, _ = s.counters.LoadOrStore(key, new(atomic.Uint64))
+	}
+	n.(*atomic.Uint64).Add(1)
+}
+
+// Stats returns the errors counted so far, by protocol and then by kind.
+// Protocols and kinds without errors are left out.
+func (s *ErrorStats) Stats() map[string]map[string]uint64 {
+	stats := make(map[string]map[string]uint64)
+	if s == nil {
+		return stats
+	}
+	s.counters.Range(func(k, v any) bool {
+		key := k.(errorKey)
+		if stats[key.proto] == nil {
+			stats[key.proto] = make(map[string]uint64)
+		}
+		stats[key.proto][key.kind] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	return stats
+}
+
+// errorNames returns the keys of m in order.
+func errorNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// eventsKeepalive is how often an idle event stream sends a comment, so
+// that proxies do not time it out.
+const eventsKeepalive = 30 * time.Second
+
+// keyspacePrefix starts the channels keyspace notifications are published
+// on, followed by the key.
+const keyspacePrefix = "__keyspace@0__:"
+
+// handleEvents streams keyspace notifications for keys matching the
+// pattern query parameter (default "*") as server-sent events: the event
+// name is set, del, expired or evicted, and the data is {"key": ...}. If
+// the client falls too far behind, a "dropped" event carries the number
+// of notifications it missed, so a cache it keeps in sync can be reset.
+func (h *HTTPHandler) handleEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.writeError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+	pattern := req.URL.Query().Get("pattern")
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	sub := h.pubsub.subscribe()
+	defer sub.close()
+	sub.set([]string{keyspacePrefix + pattern}, true, true)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventsKeepalive)
+	defer keepalive.Stop()
+
+	var dropped uint64
+	for {
+		select {
+		case msg := <-sub.messages:
+			data, _ := json.Marshal(map[string]string{"key": strings.TrimPrefix(msg.Channel, keyspacePrefix)})
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Message, data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-req.Context().Done():
+			return
+		}
+
+		if n := sub.dropped.Load(); n != dropped {
+			fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", n-dropped)
+			dropped = n
+		}
+		flusher.Flush()
+	}
+}
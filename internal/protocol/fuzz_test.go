@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+// fuzzConn is a connection that reads the fuzzer's input and discards
+// whatever the handler writes, so that a whole handler can be fuzzed
+// without goroutines or a network.
+type fuzzConn struct {
+	io.Reader
+}
+
+func (fuzzConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (fuzzConn) Close() error                     { return nil }
+func (fuzzConn) LocalAddr() net.Addr              { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6379} }
+func (fuzzConn) RemoteAddr() net.Addr             { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000} }
+func (fuzzConn) SetDeadline(time.Time) error      { return nil }
+func (fuzzConn) SetReadDeadline(time.Time) error  { return nil }
+func (fuzzConn) SetWriteDeadline(time.Time) error { return nil }
+
+// fuzzConfig limits bulk strings so that the fuzzer can reach the limits.
+func fuzzConfig() *Config {
+	return &Config{
+		Limits:          ratelimit.NewRegistry(ratelimit.Limits{}),
+		MaxBulkLen:      1024,
+		MaxMultiBulkLen: 64,
+	}
+}
+
+func FuzzMemcacheText(f *testing.F) {
+	f.Add([]byte("set key 5 0 5\r\nvalue\r\nget key\r\n"))
+	f.Add([]byte("cas key 0 0 1 1\r\nx\r\ngets key missing\r\n"))
+	f.Add([]byte("append key 0 0 2 noreply\r\n!!\r\nincr key 18446744073709551615\r\n"))
+	f.Add([]byte("set key 0 0 9223372036854775807\r\n"))
+	f.Add([]byte("set key 0 0 -1\r\n"))
+	f.Add([]byte("touch key -1\r\ndelete key 0\r\nstats\r\nversion\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := NewMemcacheHandler(cache.New(1, 0), fuzzConfig())
+		var out bytes.Buffer
+		writer := bufio.NewWriter(&out)
+		h.serve(bufio.NewReader(bytes.NewReader(data)), writer, h.config.Limits.Open(fuzzConn{}.RemoteAddr()))
+		writer.Flush()
+
+		// Every reply is whole lines.
+		if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\r\n")) {
+			t.Fatalf("reply does not end a line: %q", out.Bytes())
+		}
+	})
+}
+
+func FuzzPostgresMessages(f *testing.F) {
+	startup := pgStartup()
+	f.Add([]byte(startup + wireMessage('Q', "SELECT 1\x00")))
+	f.Add([]byte(startup + wireMessage('Q', "INSERT INTO t VALUES ('k', 'v')\x00") + wireMessage('Q', "SELECT * FROM t WHERE key = 'k'\x00")))
+	f.Add([]byte(startup + wireMessage('P', message("s", "SELECT $1", int16(1), int32(pgTextOID))) +
+		wireMessage('B', message("", "s", int16(0), int16(1), []byte("x"), int16(0))) +
+		wireMessage('E', message("", int32(0))) + wireMessage('S', "")))
+	f.Add([]byte(startup + wireMessage('Q', "COPY t FROM STDIN\x00") + wireMessage('d', "a\tb\n") + wireMessage('c', "")))
+	f.Add([]byte(startup + "Q\x00\x00\x00\x00"))
+	f.Add([]byte(startup + "Q\xff\xff\xff\xff"))
+	f.Add([]byte("\x00\x00\x00\x04\x00\x03\x00\x00"))
+	f.Add([]byte("\xff\xff\xff\xff\x00\x03\x00\x00"))
+	f.Add([]byte("\x00\x00\x00\x08\x04\xd2\x16\x2f" + startup))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := NewPostgresHandler(cache.New(1, 0), fuzzConfig())
+		h.Handle(fuzzConn{bytes.NewReader(data)})
+	})
+}
+
+func FuzzDetect(f *testing.F) {
+	f.Add([]byte("*1\r\n$4\r\nPING\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\n"))
+	f.Add([]byte("get key\r\n"))
+	f.Add([]byte{0x80, 0x00})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f})
+	f.Add([]byte{0x16, 0x03, 0x01, 0x00, 0xf4, 0x01})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		detector := NewDetector(fuzzConn{bytes.NewReader(data)}, TypeRedis, TypeMemcache, TypeHTTP, TypePostgres)
+		if _, err := detector.Detect(); err != nil {
+			t.Fatalf("Detect: %v", err)
+		}
+
+		// Detection must not consume the input.
+		got, _ := io.ReadAll(detector.Conn())
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Conn returned %q, want %q", got, data)
+		}
+	})
+}
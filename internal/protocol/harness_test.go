@@ -0,0 +1,257 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+// harness serves a Handler over an in-memory pipe so that a test can hold
+// a conversation with it: requests are written as raw bytes and each reply
+// is read whole, in the framing of the handler's protocol, and compared
+// byte for byte.
+type harness struct {
+	t         *testing.T
+	conn      net.Conn
+	reader    *bufio.Reader
+	readReply func(r *bufio.Reader) (string, error)
+}
+
+// exchange is a request and the reply the handler must answer it with.
+type exchange struct {
+	request string
+	reply   string
+}
+
+func newHarness(t *testing.T, h Handler, readReply func(r *bufio.Reader) (string, error)) *harness {
+	t.Helper()
+
+	client, server := net.Pipe()
+	go h.Handle(server)
+	t.Cleanup(func() { client.Close() })
+
+	return &harness{t: t, conn: client, reader: bufio.NewReader(client), readReply: readReply}
+}
+
+// converse sends each request in turn on the one connection and checks
+// the reply to it. Requests are written while the reply is read, so a
+// handler that answers before reading all of a request cannot block the
+// pipe.
+func (h *harness) converse(exchanges []exchange) {
+	h.t.Helper()
+
+	for _, ex := range exchanges {
+		h.conn.SetDeadline(time.Now().Add(2 * time.Second))
+		written := make(chan error, 1)
+		go func() {
+			_, err := io.WriteString(h.conn, ex.request)
+			written <- err
+		}()
+
+		reply, err := h.readReply(h.reader)
+		if err != nil {
+			h.t.Fatalf("%q: reading reply: %v (read %q)", ex.request, err, reply)
+		}
+		if err := <-written; err != nil {
+			h.t.Fatalf("%q: %v", ex.request, err)
+		}
+		if reply != ex.reply {
+			h.t.Errorf("%q:\n got %q\nwant %q", ex.request, reply, ex.reply)
+		}
+	}
+}
+
+// respReply reads one RESP reply.
+func respReply(r *bufio.Reader) (string, error) {
+	var b bytes.Buffer
+	err := readReply(r, &b)
+	return b.String(), err
+}
+
+// memcacheReply reads one memcache text protocol reply: a line, or the
+// VALUE blocks or STAT lines before the line that ends them.
+func memcacheReply(r *bufio.Reader) (string, error) {
+	var b strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		b.WriteString(line)
+		if err != nil {
+			return b.String(), err
+		}
+		if strings.HasPrefix(line, "STAT ") {
+			continue
+		}
+		if !strings.HasPrefix(line, "VALUE ") {
+			return b.String(), nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return b.String(), fmt.Errorf("malformed VALUE line %q", line)
+		}
+		n, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return b.String(), err
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(r, data)
+		b.Write(data)
+		if err != nil {
+			return b.String(), err
+		}
+	}
+}
+
+// httpReply reads one HTTP response and writes it back out with its
+// headers sorted and without Date, which changes from one run to the
+// next.
+func httpReply(r *bufio.Reader) (string, error) {
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\r\n", resp.Proto, resp.Status)
+	resp.Header.Del("Date")
+	for _, name := range slices.Sorted(maps.Keys(resp.Header)) {
+		for _, value := range resp.Header[name] {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+		}
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+	return b.String(), err
+}
+
+// postgresReply reads the backend messages up to and including
+// ReadyForQuery, leaving out ParameterStatus messages, which describe the
+// server rather than answer the request.
+func postgresReply(r *bufio.Reader) (string, error) {
+	var b bytes.Buffer
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return b.String(), err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return b.String(), err
+		}
+		if header[0] != 'S' {
+			b.Write(header)
+			b.Write(data)
+		}
+		if header[0] == 'Z' {
+			return b.String(), nil
+		}
+	}
+}
+
+// wireMessage returns a whole message of the given type, as sent on the
+// wire in either direction.
+func wireMessage(msgType byte, data string) string {
+	return string(binary.BigEndian.AppendUint32([]byte{msgType}, uint32(4+len(data)))) + data
+}
+
+// pgStartup returns a startup message for user test.
+func pgStartup() string {
+	body := binary.BigEndian.AppendUint32(nil, postgresProtocolVersion)
+	body = append(body, "user\x00test\x00\x00"...)
+	return string(binary.BigEndian.AppendUint32(nil, uint32(4+len(body)))) + string(body)
+}
+
+func TestHandlerConversations(t *testing.T) {
+	config := func() *Config {
+		return &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})}
+	}
+
+	t.Run("redis", func(t *testing.T) {
+		h := newHarness(t, NewRedisHandler(cache.New(1, 0), config()), respReply)
+		h.converse([]exchange{
+			{"PING\r\n", "+PONG\r\n"},
+			{"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n", "+OK\r\n"},
+			{"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", "$5\r\nvalue\r\n"},
+			{"GET missing\r\n", "$-1\r\n"},
+			{"MSET a 1 b 2\r\n", "+OK\r\n"},
+			{"MGET a b c\r\n", "*3\r\n$1\r\n1\r\n$1\r\n2\r\n$-1\r\n"},
+			{"INCRBY a 41\r\n", ":42\r\n"},
+			{"DEL a b c\r\n", ":2\r\n"},
+			{"GET\r\n", "-ERR wrong number of arguments for 'get' command\r\n"},
+			{"NOSUCH x\r\n", "-ERR unknown command 'NOSUCH', with args beginning with: 'x' \r\n"},
+			// Pipelined commands are answered in order.
+			{"EXISTS key\r\nSTRLEN key\r\n", ":1\r\n"},
+			{"", ":5\r\n"},
+		})
+	})
+
+	t.Run("memcache", func(t *testing.T) {
+		h := newHarness(t, NewMemcacheHandler(cache.New(1, 0), config()), memcacheReply)
+		h.converse([]exchange{
+			{"set key 5 0 5\r\nvalue\r\n", "STORED\r\n"},
+			{"get key\r\n", "VALUE key 5 5\r\nvalue\r\nEND\r\n"},
+			{"get missing\r\n", "END\r\n"},
+			{"add key 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+			{"append key 0 0 2\r\n!!\r\n", "STORED\r\n"},
+			{"get key missing\r\n", "VALUE key 5 7\r\nvalue!!\r\nEND\r\n"},
+			{"set n 0 0 2\r\n10\r\n", "STORED\r\n"},
+			{"incr n 5\r\n", "15\r\n"},
+			{"decr n 20\r\n", "0\r\n"},
+			{"delete n\r\n", "DELETED\r\n"},
+			{"delete n\r\n", "NOT_FOUND\r\n"},
+			{"set key 0 0 x\r\n", "CLIENT_ERROR bad command line format\r\n"},
+			{"bogus\r\n", "ERROR\r\n"},
+		})
+	})
+
+	t.Run("http", func(t *testing.T) {
+		h := newHarness(t, NewHTTPHandler(cache.New(1, 0), config()), httpReply)
+		request := func(method, path, body string) string {
+			return fmt.Sprintf("%s %s HTTP/1.1\r\nHost: cache\r\nContent-Length: %d\r\n\r\n%s", method, path, len(body), body)
+		}
+		h.converse([]exchange{
+			{request("PUT", "/key", "value"),
+				"HTTP/1.1 201 Created\r\nContent-Length: 2\r\nContent-Type: text/plain; charset=utf-8\r\nServer: gopogo/1.0\r\n\r\nOK"},
+			{request("GET", "/key", ""),
+				"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: application/octet-stream\r\nEtag: \"1\"\r\nServer: gopogo/1.0\r\nX-Cas: 1\r\nX-Flags: 0\r\n\r\nvalue"},
+			{request("GET", "/missing", ""),
+				"HTTP/1.1 404 Not Found\r\nContent-Length: 25\r\nContent-Type: application/json\r\nServer: gopogo/1.0\r\n\r\n{\"error\":\"Key not found\"}"},
+			{request("DELETE", "/key", ""),
+				"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Type: text/plain; charset=utf-8\r\nServer: gopogo/1.0\r\n\r\nOK"},
+			{request("GET", "/key", ""),
+				"HTTP/1.1 404 Not Found\r\nContent-Length: 25\r\nContent-Type: application/json\r\nServer: gopogo/1.0\r\n\r\n{\"error\":\"Key not found\"}"},
+		})
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		h := newHarness(t, NewPostgresHandler(cache.New(1, 0), config()), postgresReply)
+		ready := wireMessage('Z', "I")
+		h.converse([]exchange{
+			{pgStartup(), wireMessage('R', "\x00\x00\x00\x00") + ready},
+			{wireMessage('Q', "INSERT INTO users (key, value) VALUES ('1', '42')\x00"), wireMessage('C', "INSERT 0 1\x00") + ready},
+			{wireMessage('Q', "SELECT * FROM users WHERE key = '1'\x00"),
+				wireMessage('T', message(int16(2),
+					"key", int32(0), int16(0), int32(pgTextOID), int16(-1), int32(-1), int16(0),
+					"value", int32(0), int16(0), int32(pgTextOID), int16(-1), int32(-1), int16(0))) +
+					wireMessage('D', message(int16(2), []byte("1"), []byte("42"))) +
+					wireMessage('C', "SELECT 1\x00") + ready},
+			{wireMessage('Q', "DELETE FROM users WHERE key = '1'\x00"), wireMessage('C', "DELETE 1\x00") + ready},
+			{wireMessage('Q', "NOSUCH\x00"),
+				wireMessage('E', "SERROR\x00C42601\x00Msyntax error\x00\x00") + ready},
+		})
+	})
+}
@@ -1,247 +1,1096 @@
 package protocol
 
 import (
-	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/health"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
 )
 
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// HTTPHandler serves the REST interface. Connections arrive one at a time
+// from the protocol detector and are handed to a shared net/http server,
+// which takes care of keep-alive, chunked encoding, 100-continue, HEAD
+// and HTTP/2 over TLS.
 type HTTPHandler struct {
-	cache *cache.Cache
-	auth  string
+	cache  Keyspace
+	config *Config
+	server *http.Server
+	conns  sync.Map
+	// pubsub carries the messages and keyspace notifications pushed to
+	// WebSocket subscribers.
+	pubsub  *broker
+	traffic *trafficCounters
+}
+
+// httpConn tracks a connection handed to the net/http server so Handle
+// can return once the server is done with it.
+type httpConn struct {
+	limiter *ratelimit.Limiter
+	done    chan struct{}
+	once    sync.Once
 }
 
-func NewHTTPHandler(cache *cache.Cache, auth string) *HTTPHandler {
-	return &HTTPHandler{
-		cache: cache,
-		auth:  auth,
+func (c *httpConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+type httpConnKey struct{}
+
+func NewHTTPHandler(cache *cache.Cache, config *Config) *HTTPHandler {
+	h := &HTTPHandler{
+		cache:   keyspace(cache, config, TypeHTTP),
+		config:  config,
+		pubsub:  newBroker(),
+		traffic: config.Traffic.of(TypeHTTP.String()),
 	}
+	cache.AddHooks(h.pubsub.keyspaceHooks(config.Namespaces[TypeHTTP.String()]))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", h.handleStats)
+	mux.HandleFunc("GET /stats", h.handleStats)
+	mux.HandleFunc("GET /stats/topkeys", h.handleTopKeys)
+	mux.HandleFunc("GET /stats/bigkeys", h.handleBigKeys)
+	mux.HandleFunc("GET /stats/expiry", h.handleExpiry)
+	mux.HandleFunc("GET /stats/writebehind", h.handleWriteBehind)
+	mux.HandleFunc("GET /stats/deletes", h.handlePrefixDeletes)
+	mux.HandleFunc("GET /metrics", h.handleMetrics)
+	mux.HandleFunc("GET /keys", h.handleKeys)
+	mux.HandleFunc("DELETE /keys", h.handleDeletePrefix)
+	mux.HandleFunc("POST /mget", h.handleMGet)
+	mux.HandleFunc("POST /mset", h.handleMSet)
+	mux.HandleFunc("GET /keys/{key}/ttl", h.handleGetTTL)
+	mux.HandleFunc("PUT /keys/{key}/ttl", h.handleSetTTL)
+	mux.HandleFunc("POST /keys/{key}/incr", h.handleIncr)
+	mux.HandleFunc("GET /keys/{key}/meta", h.handleMeta)
+	mux.HandleFunc("GET /ws", h.handleWebSocket)
+	mux.HandleFunc("GET /events", h.handleEvents)
+	mux.HandleFunc("GET /json/{key...}", h.handleJSONGet)
+	mux.HandleFunc("PUT /json/{key...}", h.handleJSONSet)
+	mux.HandleFunc("GET /{key...}", h.handleGet)
+	mux.HandleFunc("PUT /{key...}", h.handleSet)
+	mux.HandleFunc("POST /{key...}", h.handleSet)
+	mux.HandleFunc("DELETE /{key...}", h.handleDelete)
+	if config.Health != nil {
+		health.Register(mux, config.Health)
+	}
+	if config.Admin != nil {
+		for _, method := range []string{"GET", "POST", "DELETE"} {
+			mux.Handle(method+" /admin/", config.Admin)
+		}
+	}
+	mux.HandleFunc("/{path...}", func(w http.ResponseWriter, _ *http.Request) {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	})
+
+	h.server = &http.Server{
+		Handler:           h.middleware(mux),
+		ReadHeaderTimeout: cmp.Or(config.HTTPHeaderTimeout, httpReadHeaderTimeout),
+		IdleTimeout:       httpIdleTimeout,
+		ConnState:         h.connState,
+		ConnContext:       h.connContext,
+	}
+
+	return h
 }
 
 func (h *HTTPHandler) Handle(conn net.Conn) {
 	defer conn.Close()
-	
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-	
-	for {
-		req, err := http.ReadRequest(reader)
-		if err != nil {
-			if err != io.EOF {
-				h.writeError(writer, http.StatusBadRequest, err.Error())
-			}
-			return
+
+	limiter := h.config.Limits.Open(conn.RemoteAddr())
+	defer limiter.Close()
+
+	// HTTP/2 needs the *tls.Conn itself, so bandwidth shaping and byte
+	// counting only wrap HTTP/1 connections.
+	if tlsConn, ok := conn.(*tls.Conn); !ok || tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+		conn = h.traffic.wrap(conn)
+		if reader := limiter.Reader(conn); reader != io.Reader(conn) {
+			conn = &readerConn{Conn: conn, reader: reader}
 		}
-		
-		if h.auth != "" {
+	}
+
+	state := &httpConn{
+		limiter: limiter,
+		done:    make(chan struct{}),
+	}
+	h.conns.Store(conn, state)
+	defer h.conns.Delete(conn)
+
+	h.server.Serve(&singleConnListener{conn: conn, state: state})
+}
+
+// connState ends Handle once the server closes a connection. A handler
+// that hijacks one closes it itself when done.
+func (h *HTTPHandler) connState(conn net.Conn, state http.ConnState) {
+	if state != http.StateClosed {
+		return
+	}
+	if v, ok := h.conns.Load(conn); ok {
+		v.(*httpConn).close()
+	}
+}
+
+func (h *HTTPHandler) connContext(ctx context.Context, conn net.Conn) context.Context {
+	if v, ok := h.conns.Load(conn); ok {
+		return context.WithValue(ctx, httpConnKey{}, v)
+	}
+	return ctx
+}
+
+// middleware applies the checks shared by every route.
+func (h *HTTPHandler) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "gopogo/1.0")
+		h.traffic.command()
+
+		if len(h.config.Auth) > 0 && !h.isAdmin(req) && !health.IsPath(req.URL.Path) {
 			authHeader := req.Header.Get("Authorization")
-			if !strings.HasPrefix(authHeader, "Bearer ") || authHeader[7:] != h.auth {
-				h.writeError(writer, http.StatusUnauthorized, "Unauthorized")
-				continue
+			// Browsers cannot set headers on WebSocket requests, so
+			// /ws also takes the token as a query parameter. Proxies
+			// and access logs in front of the server may record it
+			// with the URL.
+			if req.URL.Path == "/ws" && req.URL.Query().Has("token") {
+				authHeader = "Bearer " + req.URL.Query().Get("token")
+			}
+			if !strings.HasPrefix(authHeader, "Bearer ") || !h.config.checkAuth(authHeader[7:]) {
+				h.writeError(w, http.StatusUnauthorized, "Unauthorized")
+				return
 			}
 		}
-		
-		switch req.Method {
-		case http.MethodGet:
-			h.handleGet(writer, req)
-		case http.MethodPost, http.MethodPut:
-			h.handleSet(writer, req)
-		case http.MethodDelete:
-			h.handleDelete(writer, req)
-		case http.MethodHead:
-			h.handleHead(writer, req)
-		default:
-			h.writeError(writer, http.StatusMethodNotAllowed, "Method not allowed")
-		}
-		
-		writer.Flush()
-		
-		if req.Header.Get("Connection") == "close" {
+
+		if state, ok := req.Context().Value(httpConnKey{}).(*httpConn); ok && !state.limiter.AllowCommand() {
+			h.writeError(w, http.StatusTooManyRequests, "Rate limit exceeded")
 			return
 		}
-	}
+
+		next.ServeHTTP(w, req)
+	})
 }
 
-func (h *HTTPHandler) handleGet(writer *bufio.Writer, req *http.Request) {
-	path := strings.TrimPrefix(req.URL.Path, "/")
-	
-	if path == "" || path == "stats" {
-		h.handleStats(writer)
-		return
+// isAdmin reports whether req is for the admin dashboard, which accepts
+// basic auth so that browsers can log in.
+func (h *HTTPHandler) isAdmin(req *http.Request) bool {
+	return h.config.Admin != nil && strings.HasPrefix(req.URL.Path, "/admin/")
+}
+
+func (h *HTTPHandler) handleGet(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+
+	entry, found := readThrough(h.cache, h.config, TypeHTTP, []byte(key))
+
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !found || !etagMatches(ifMatch, entryETag(entry), false) {
+			h.writeError(w, http.StatusPreconditionFailed, "Precondition failed")
+			return
+		}
 	}
-	
-	if path == "keys" {
-		h.handleKeys(writer, req)
+
+	if !found {
+		h.writeError(w, http.StatusNotFound, "Key not found")
 		return
 	}
-	
-	entry, found := h.cache.Load([]byte(path))
-	if !found {
-		h.writeError(writer, http.StatusNotFound, "Key not found")
+
+	etag := entryETag(entry)
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag, true) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
-	
-	h.writeResponse(writer, http.StatusOK, map[string]string{
-		"Content-Type":   "application/octet-stream",
-		"Content-Length": strconv.Itoa(len(entry.Value())),
-		"X-Flags":        strconv.FormatUint(uint64(entry.Flags()), 10),
-		"X-CAS":          strconv.FormatUint(entry.CAS(), 10),
-	}, entry.Value())
+
+	h.writeEntryHeaders(w, entry)
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.Value())
+}
+
+func (h *HTTPHandler) writeEntryHeaders(w http.ResponseWriter, entry *cache.Entry) {
+	header := w.Header()
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", strconv.Itoa(len(entry.Value())))
+	header.Set("ETag", entryETag(entry))
+	header.Set("X-Flags", strconv.FormatUint(uint64(entry.Flags()), 10))
+	header["X-CAS"] = []string{strconv.FormatUint(entry.CAS(), 10)}
+	if entry.Pinned() {
+		header["X-Pin"] = []string{"true"}
+	}
+
+	now := time.Now().UnixNano()
+	if expireAt := entry.ExpireAt(); expireAt > 0 {
+		header["X-TTL"] = []string{remainingSeconds(expireAt, now)}
+		if entry.SlidingTTL() > 0 {
+			header["X-Sliding-TTL"] = []string{"true"}
+		}
+	}
+	if softExpire := entry.SoftExpireAt(); softExpire > 0 {
+		header["X-Soft-TTL"] = []string{remainingSeconds(softExpire, now)}
+		if entry.NeedsRefresh() {
+			header.Set("X-Refresh-Due", "true")
+		}
+	}
+}
+
+// remainingSeconds formats the whole seconds left until t, rounded up,
+// or 0 if t has passed.
+func remainingSeconds(t, now int64) string {
+	remaining := time.Duration(t - now)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return strconv.FormatInt(int64((remaining+time.Second-1)/time.Second), 10)
+}
+
+// entryETag formats the entry's CAS value as a strong entity tag.
+func entryETag(entry *cache.Entry) string {
+	return `"` + strconv.FormatUint(entry.CAS(), 10) + `"`
 }
 
-func (h *HTTPHandler) handleSet(writer *bufio.Writer, req *http.Request) {
-	path := strings.TrimPrefix(req.URL.Path, "/")
-	if path == "" {
-		h.writeError(writer, http.StatusBadRequest, "Key required")
+// etagMatches reports whether an If-Match or If-None-Match header lists
+// etag. If-None-Match uses weak comparison, so W/ prefixes are ignored.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HTTPHandler) handleSet(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+	if key == "" {
+		h.writeError(w, http.StatusBadRequest, "Key required")
 		return
 	}
-	
-	body := make([]byte, req.ContentLength)
-	_, err := io.ReadFull(req.Body, body)
-	if err != nil {
-		h.writeError(writer, http.StatusBadRequest, "Failed to read body")
+
+	if err := h.cache.CheckSize(len(key), 0); h.writeSizeError(w, err) {
 		return
 	}
-	
+	body, ok := h.readBody(w, req, h.maxValueLen())
+	if !ok {
+		return
+	}
+
 	opts := &cache.StoreOptions{}
-	
+
 	if ttl := req.Header.Get("X-TTL"); ttl != "" {
 		seconds, err := strconv.Atoi(ttl)
 		if err == nil {
 			opts.TTL = time.Duration(seconds) * time.Second
 		}
 	}
-	
+
+	if ttl := req.Header.Get("X-Soft-TTL"); ttl != "" {
+		seconds, err := strconv.Atoi(ttl)
+		if err == nil {
+			opts.SoftTTL = time.Duration(seconds) * time.Second
+		}
+	}
+
 	if flags := req.Header.Get("X-Flags"); flags != "" {
 		f, err := strconv.ParseUint(flags, 10, 32)
 		if err == nil {
 			opts.Flags = uint32(f)
 		}
 	}
-	
+
+	if sliding := req.Header.Get("X-Sliding-TTL"); sliding != "" {
+		opts.Sliding, _ = strconv.ParseBool(sliding)
+	}
+
+	if pin := req.Header.Get("X-Pin"); pin != "" {
+		opts.Pinned, _ = strconv.ParseBool(pin)
+	}
+	ifAbsent, _ := strconv.ParseBool(req.URL.Query().Get("if-absent"))
+	if opts.Pinned && (ifAbsent || req.Header.Get("If-Match") != "" || req.Header.Get("X-CAS") != "") {
+		h.writeError(w, http.StatusBadRequest, "X-Pin cannot be combined with if-absent, If-Match or X-CAS")
+		return
+	}
+
+	// With if-absent, the response is whichever value won: the existing
+	// one (200) or the one just stored (201). Concurrent writers racing to
+	// populate a missing key all receive the same value.
+	if ifAbsent {
+		entry, loaded := h.cache.LoadOrStore([]byte(key), body, opts)
+		h.writeEntryHeaders(w, entry)
+		if loaded {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write(entry.Value())
+		return
+	}
+
+	ifMatch := req.Header.Get("If-Match")
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if ifMatch != "" || ifNoneMatch != "" {
+		h.handleConditionalSet(w, key, body, ifMatch, ifNoneMatch, opts)
+		return
+	}
+
 	if cas := req.Header.Get("X-CAS"); cas != "" {
 		casVal, err := strconv.ParseUint(cas, 10, 64)
 		if err == nil {
 			opts.CAS = casVal
-			success, err := h.cache.CompareAndSwap([]byte(path), body, casVal, opts)
+			success, err := h.cache.CompareAndSwap([]byte(key), body, casVal, opts)
+			if errors.Is(err, cache.ErrNoSuchKey) {
+				h.writeError(w, http.StatusNotFound, "Key not found")
+				return
+			}
+			if err != nil && !h.writeSizeError(w, err) {
+				h.writeError(w, http.StatusInternalServerError, err.Error())
+			}
 			if err != nil {
-				h.writeError(writer, http.StatusInternalServerError, err.Error())
 				return
 			}
 			if !success {
-				h.writeError(writer, http.StatusConflict, "CAS mismatch")
+				h.writeError(w, http.StatusConflict, "CAS mismatch")
 				return
 			}
-			h.writeResponse(writer, http.StatusOK, nil, []byte("OK"))
+			h.writeText(w, http.StatusOK, "OK")
+			return
+		}
+	}
+
+	if err := h.cache.Store([]byte(key), body, opts); h.writeSizeError(w, err) {
+		return
+	}
+	h.writeText(w, http.StatusCreated, "OK")
+}
+
+// handleConditionalSet stores a value guarded by If-Match/If-None-Match.
+// A specific If-Match tag is applied as a compare-and-swap on the CAS
+// value it encodes, so concurrent writers cannot both succeed.
+func (h *HTTPHandler) handleConditionalSet(w http.ResponseWriter, key string, body []byte,
+	ifMatch, ifNoneMatch string, opts *cache.StoreOptions) {
+	entry, found := h.cache.Load([]byte(key))
+
+	var etag string
+	if found {
+		etag = entryETag(entry)
+	}
+
+	if ifMatch != "" && (!found || !etagMatches(ifMatch, etag, false)) {
+		h.writeError(w, http.StatusPreconditionFailed, "Precondition failed")
+		return
+	}
+
+	if ifNoneMatch != "" && found && etagMatches(ifNoneMatch, etag, true) {
+		h.writeError(w, http.StatusPreconditionFailed, "Precondition failed")
+		return
+	}
+
+	status := http.StatusCreated
+	if ifMatch != "" && strings.TrimSpace(ifMatch) != "*" {
+		success, err := h.cache.CompareAndSwap([]byte(key), body, entry.CAS(), opts)
+		if err != nil && !errors.Is(err, cache.ErrNoSuchKey) {
+			h.writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		if !success {
+			h.writeError(w, http.StatusPreconditionFailed, "Precondition failed")
+			return
+		}
+		status = http.StatusOK
+	} else if err := h.cache.Store([]byte(key), body, opts); h.writeSizeError(w, err) {
+		return
 	}
-	
-	h.cache.Store([]byte(path), body, opts)
-	h.writeResponse(writer, http.StatusCreated, nil, []byte("OK"))
+
+	if entry, found := h.cache.Load([]byte(key)); found {
+		w.Header().Set("ETag", entryETag(entry))
+	}
+	h.writeText(w, status, "OK")
 }
 
-func (h *HTTPHandler) handleDelete(writer *bufio.Writer, req *http.Request) {
-	path := strings.TrimPrefix(req.URL.Path, "/")
-	if path == "" {
-		h.writeError(writer, http.StatusBadRequest, "Key required")
+func (h *HTTPHandler) handleDelete(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+	if key == "" {
+		h.writeError(w, http.StatusBadRequest, "Key required")
+		return
+	}
+
+	ifMatch := req.Header.Get("If-Match")
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if ifMatch != "" || ifNoneMatch != "" {
+		h.handleConditionalDelete(w, key, ifMatch, ifNoneMatch)
 		return
 	}
-	
-	if h.cache.Delete([]byte(path)) {
-		h.writeResponse(writer, http.StatusOK, nil, []byte("OK"))
+
+	if h.cache.Delete([]byte(key)) {
+		h.writeText(w, http.StatusOK, "OK")
 	} else {
-		h.writeError(writer, http.StatusNotFound, "Key not found")
+		h.writeError(w, http.StatusNotFound, "Key not found")
 	}
 }
 
-func (h *HTTPHandler) handleHead(writer *bufio.Writer, req *http.Request) {
-	path := strings.TrimPrefix(req.URL.Path, "/")
-	if path == "" {
-		h.writeError(writer, http.StatusBadRequest, "Key required")
+// handleConditionalDelete deletes a key guarded by If-Match/If-None-Match.
+// As in handleConditionalSet, a specific If-Match tag is applied as a
+// compare-and-delete on the CAS value it encodes.
+func (h *HTTPHandler) handleConditionalDelete(w http.ResponseWriter, key, ifMatch, ifNoneMatch string) {
+	entry, found := h.cache.Load([]byte(key))
+
+	var etag string
+	if found {
+		etag = entryETag(entry)
+	}
+
+	if ifMatch != "" && (!found || !etagMatches(ifMatch, etag, false)) {
+		h.writeError(w, http.StatusPreconditionFailed, "Precondition failed")
 		return
 	}
-	
-	entry, found := h.cache.Load([]byte(path))
-	if !found {
-		h.writeError(writer, http.StatusNotFound, "Key not found")
+
+	if ifNoneMatch != "" && found && etagMatches(ifNoneMatch, etag, true) {
+		h.writeError(w, http.StatusPreconditionFailed, "Precondition failed")
 		return
 	}
-	
-	h.writeResponse(writer, http.StatusOK, map[string]string{
-		"Content-Type":   "application/octet-stream",
-		"Content-Length": strconv.Itoa(len(entry.Value())),
-		"X-Flags":        strconv.FormatUint(uint64(entry.Flags()), 10),
-		"X-CAS":          strconv.FormatUint(entry.CAS(), 10),
-	}, nil)
+
+	if ifMatch != "" && strings.TrimSpace(ifMatch) != "*" {
+		success, err := h.cache.CompareAndDelete([]byte(key), entry.CAS())
+		if err != nil && !errors.Is(err, cache.ErrNoSuchKey) {
+			h.writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !success {
+			h.writeError(w, http.StatusPreconditionFailed, "Precondition failed")
+			return
+		}
+	} else if !h.cache.Delete([]byte(key)) {
+		h.writeError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+	h.writeText(w, http.StatusOK, "OK")
+}
+
+func (h *HTTPHandler) handleStats(w http.ResponseWriter, req *http.Request) {
+	body, _ := json.MarshalIndent(struct {
+		Version string `json:"version"`
+		Commit  string `json:"commit"`
+		Uptime  int64  `json:"uptime_seconds"`
+		cache.Stats
+		Protocols map[string]ProtocolStats     `json:"protocols"`
+		Commands  map[string]CommandStat       `json:"commands"`
+		Errors    map[string]map[string]uint64 `json:"errors"`
+	}{
+		h.config.version(),
+		h.config.Commit,
+		int64(h.config.uptime(time.Now()).Seconds()),
+		h.cache.Stats(),
+		h.config.Traffic.Stats(),
+		h.config.Commands.Stats(),
+		h.config.Errors.Stats(),
+	}, "", "  ")
+
+	h.writeData(w, req, http.StatusOK, body)
 }
 
-func (h *HTTPHandler) handleStats(writer *bufio.Writer) {
+// handleTopKeys reports the most accessed keys. The optional count query
+// parameter limits the result (default 10) and prefix groups keys by the
+// part before the last occurrence of the given separator.
+func (h *HTTPHandler) handleTopKeys(w http.ResponseWriter, req *http.Request) {
+	count := 10
+	if v := req.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			h.writeError(w, http.StatusBadRequest, "Invalid count")
+			return
+		}
+		count = n
+	}
+
+	var stats []cache.KeyStat
+	if separator := req.URL.Query().Get("prefix"); separator != "" {
+		stats = cache.GroupByPrefix(h.cache.TopKeys(0), separator, count)
+	} else {
+		stats = h.cache.TopKeys(count)
+	}
+	if stats == nil {
+		h.writeError(w, http.StatusNotFound, "Hot key tracking is disabled")
+		return
+	}
+
+	body, _ := json.Marshal(stats)
+
+	h.writeData(w, req, http.StatusOK, body)
+}
+
+// handleBigKeys reports a histogram of entry sizes and the largest keys;
+// count sets how many (default 10).
+func (h *HTTPHandler) handleBigKeys(w http.ResponseWriter, req *http.Request) {
+	count := bigKeyReportSize
+	if v := req.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			h.writeError(w, http.StatusBadRequest, "Invalid count")
+			return
+		}
+		count = n
+	}
+
+	body, _ := json.Marshal(h.cache.SizeReport(count))
+
+	h.writeData(w, req, http.StatusOK, body)
+}
+
+func (h *HTTPHandler) handleExpiry(w http.ResponseWriter, req *http.Request) {
+	body, _ := json.Marshal(h.cache.ExpiryStats())
+
+	h.writeData(w, req, http.StatusOK, body)
+}
+
+func (h *HTTPHandler) handleWriteBehind(w http.ResponseWriter, req *http.Request) {
+	if h.config.WriteBehind == nil {
+		h.writeError(w, http.StatusNotFound, "Write-behind is not enabled")
+		return
+	}
+
+	body, _ := json.Marshal(h.config.WriteBehind.Stats())
+
+	h.writeData(w, req, http.StatusOK, body)
+}
+
+// handleMetrics reports the cache-wide and per-shard counters in the
+// Prometheus text format.
+func (h *HTTPHandler) handleMetrics(w http.ResponseWriter, _ *http.Request) {
 	stats := h.cache.Stats()
-	
-	body, _ := json.MarshalIndent(stats, "", "  ")
-	
-	h.writeResponse(writer, http.StatusOK, map[string]string{
-		"Content-Type":   "application/json",
-		"Content-Length": strconv.Itoa(len(body)),
-	}, body)
+	shards := stats.Shards
+
+	var b strings.Builder
+	metric := func(name, kind, help string, value any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	fmt.Fprintf(&b, "# HELP gopogo_build_info The gopogo build, as labels.\n# TYPE gopogo_build_info gauge\n"+
+		"gopogo_build_info{version=%q,commit=%q,goversion=%q} 1\n",
+		h.config.version(), h.config.Commit, runtime.Version())
+	if !h.config.Started.IsZero() {
+		metric("gopogo_start_time_seconds", "gauge", "When the server started, in Unix seconds.", h.config.Started.Unix())
+		metric("gopogo_uptime_seconds", "gauge", "Time since the server started.", int64(h.config.uptime(time.Now()).Seconds()))
+	}
+	metric("gopogo_keys", "gauge", "Number of keys.", stats.Items)
+	metric("gopogo_memory_used_bytes", "gauge", "Memory used by keys and values.", stats.MemUsed)
+	metric("gopogo_memory_max_bytes", "gauge", "Memory limit, or 0 if unlimited.", stats.MaxMemory)
+	metric("gopogo_operations_total", "counter", "Cache operations.", stats.Ops)
+	metric("gopogo_hits_total", "counter", "Lookups that found a key.", stats.Hits)
+	metric("gopogo_misses_total", "counter", "Lookups that found no key.", stats.Misses)
+	metric("gopogo_evicted_total", "counter", "Keys evicted to stay under the memory limit.", stats.Evicted)
+	metric("gopogo_expired_total", "counter", "Keys removed when their TTL passed.", stats.Expired)
+	metric("gopogo_evictions_per_second", "gauge", "Keys evicted per second over the last second with evictions.", stats.EvictionsPerSec)
+	metric("gopogo_eviction_time_seconds_total", "counter", "Time spent evicting keys.", stats.EvictionTime.Seconds())
+	metric("gopogo_bulk_evictions_total", "counter", "Evictions done in bulk during eviction storms.", stats.BulkEvictions)
+
+	traffic := h.config.Traffic.Stats()
+	perProtocol := func(name, help string, value func(ProtocolStats) uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, proto := range protocolNames(traffic) {
+			fmt.Fprintf(&b, "%s{protocol=\"%s\"} %d\n", name, proto, value(traffic[proto]))
+		}
+	}
+	perProtocol("gopogo_protocol_commands_total", "Commands received, by protocol.",
+		func(s ProtocolStats) uint64 { return s.Commands })
+	perProtocol("gopogo_protocol_received_bytes_total", "Bytes read from clients, by protocol.",
+		func(s ProtocolStats) uint64 { return s.BytesIn })
+	perProtocol("gopogo_protocol_sent_bytes_total", "Bytes written to clients, by protocol.",
+		func(s ProtocolStats) uint64 { return s.BytesOut })
+
+	errs := h.config.Errors.Stats()
+	fmt.Fprintf(&b, "# HELP gopogo_errors_total Parse, authentication and internal errors, by protocol.\n# TYPE gopogo_errors_total counter\n")
+	for _, proto := range errorNames(errs) {
+		for _, kind := range errorNames(errs[proto]) {
+			fmt.Fprintf(&b, "gopogo_errors_total{protocol=\"%s\",type=\"%s\"} %d\n", proto, kind, errs[proto][kind])
+		}
+	}
+
+	commands := h.config.Commands.Stats()
+	perCommand := func(name, kind, help string, value func(CommandStat) any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, cmd := range commandNames(commands) {
+			fmt.Fprintf(&b, "%s{cmd=\"%s\"} %v\n", name, cmd, value(commands[cmd]))
+		}
+	}
+	perCommand("gopogo_commands_total", "counter", "Calls of the Redis command.",
+		func(s CommandStat) any { return s.Calls })
+	perCommand("gopogo_commands_duration_seconds_total", "counter", "Time spent running the Redis command.",
+		func(s CommandStat) any { return float64(s.Usec) / 1e6 })
+	perCommand("gopogo_commands_rejected_calls_total", "counter", "Calls of the Redis command refused before it ran.",
+		func(s CommandStat) any { return s.RejectedCalls })
+	perCommand("gopogo_commands_failed_calls_total", "counter", "Calls of the Redis command that replied with an error.",
+		func(s CommandStat) any { return s.FailedCalls })
+	fmt.Fprintf(&b, "# HELP gopogo_commands_latency_seconds Percentiles of the Redis command's call times.\n# TYPE gopogo_commands_latency_seconds summary\n")
+	for _, cmd := range commandNames(commands) {
+		s := commands[cmd]
+		for _, q := range []struct {
+			quantile string
+			usec     float64
+		}{{"0.5", s.P50}, {"0.99", s.P99}, {"0.999", s.P999}} {
+			fmt.Fprintf(&b, "gopogo_commands_latency_seconds{cmd=\"%s\",quantile=\"%s\"} %v\n", cmd, q.quantile, q.usec/1e6)
+		}
+		fmt.Fprintf(&b, "gopogo_commands_latency_seconds_sum{cmd=\"%s\"} %v\n", cmd, float64(s.Usec)/1e6)
+		fmt.Fprintf(&b, "gopogo_commands_latency_seconds_count{cmd=\"%s\"} %d\n", cmd, s.Calls)
+	}
+
+	perShard := func(name, kind, help string, value func(cache.ShardStats) any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, shard := range shards {
+			fmt.Fprintf(&b, "%s{shard=\"%d\"} %v\n", name, shard.Shard, value(shard))
+		}
+	}
+	perShard("gopogo_shard_keys", "gauge", "Number of keys in the shard.",
+		func(s cache.ShardStats) any { return s.Items })
+	perShard("gopogo_shard_memory_used_bytes", "gauge", "Memory used by the shard's keys and values.",
+		func(s cache.ShardStats) any { return s.MemUsed })
+	perShard("gopogo_shard_operations_total", "counter", "Operations on the shard.",
+		func(s cache.ShardStats) any { return s.Ops })
+	perShard("gopogo_shard_hits_total", "counter", "Lookups in the shard that found a key.",
+		func(s cache.ShardStats) any { return s.Hits })
+	perShard("gopogo_shard_misses_total", "counter", "Lookups in the shard that found no key.",
+		func(s cache.ShardStats) any { return s.Misses })
+	perShard("gopogo_shard_lock_waits_total", "counter", "Lookups that waited for the shard's lock.",
+		func(s cache.ShardStats) any { return s.LockWaits })
+	perShard("gopogo_shard_lock_wait_seconds_total", "counter", "Time spent waiting for the shard's lock.",
+		func(s cache.ShardStats) any { return s.LockWait.Seconds() })
+	perShard("gopogo_shard_eviction_busy_ratio", "gauge", "Share of the last second with evictions the shard spent evicting.",
+		func(s cache.ShardStats) any { return s.Eviction.Busy })
+	perShard("gopogo_shard_eviction_pressure", "gauge", "1 while the shard is in an eviction storm and evicts in bulk.",
+		func(s cache.ShardStats) any {
+			if s.Eviction.Pressure {
+				return 1
+			}
+			return 0
+		})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
 }
 
-func (h *HTTPHandler) handleKeys(writer *bufio.Writer, req *http.Request) {
+func (h *HTTPHandler) handleKeys(w http.ResponseWriter, req *http.Request) {
 	pattern := req.URL.Query().Get("pattern")
 	if pattern == "" {
 		pattern = "*"
 	}
-	
-	keys := make([]string, 0)
-	h.cache.Iterate(func(entry *cache.Entry) bool {
-		key := string(entry.Key())
-		if pattern == "*" || matchPattern(pattern, key) {
-			keys = append(keys, key)
+
+	body, _ := json.Marshal(matchKeys(h.cache, pattern))
+
+	h.writeData(w, req, http.StatusOK, body)
+}
+
+// handleDeletePrefix starts deleting every key under the prefix query
+// parameter in the background. GET /stats/deletes reports its progress.
+func (h *HTTPHandler) handleDeletePrefix(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("prefix")
+	if prefix == "" {
+		h.writeError(w, http.StatusBadRequest, "Prefix required")
+		return
+	}
+
+	h.cache.DeletePrefix([]byte(prefix))
+	body, _ := json.Marshal(map[string]string{"prefix": prefix, "status": "started"})
+	h.writeJSON(w, http.StatusAccepted, body)
+}
+
+func (h *HTTPHandler) handlePrefixDeletes(w http.ResponseWriter, req *http.Request) {
+	deletes := h.cache.PrefixDeletes()
+	if deletes == nil {
+		deletes = []cache.PrefixDeleteStatus{}
+	}
+	body, _ := json.Marshal(deletes)
+
+	h.writeData(w, req, http.StatusOK, body)
+}
+
+// ttlSeconds returns the remaining lifetime of the entry in seconds, or
+// -1 if it does not expire.
+func ttlSeconds(entry *cache.Entry) int64 {
+	expireAt := entry.ExpireAt()
+	if expireAt == 0 {
+		return -1
+	}
+	return max((expireAt-time.Now().UnixNano())/int64(time.Second), 0)
+}
+
+func (h *HTTPHandler) handleGetTTL(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+
+	entry, found := h.cache.Load([]byte(key))
+	if !found {
+		h.writeError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"key": key,
+		"ttl": ttlSeconds(entry),
+	})
+	h.writeData(w, req, http.StatusOK, body)
+}
+
+// handleSetTTL sets the expiry from a number of seconds in the body. Zero
+// or a negative number removes the expiry.
+func (h *HTTPHandler) handleSetTTL(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+
+	body, ok := h.readBody(w, req, maxTTLBodyLen)
+	if !ok {
+		return
+	}
+
+	seconds, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, "TTL must be an integer number of seconds")
+		return
+	}
+
+	var expireAt int64
+	if seconds > 0 {
+		expireAt = time.Now().Add(time.Duration(seconds) * time.Second).UnixNano()
+	}
+
+	if !h.cache.Expire([]byte(key), expireAt) {
+		h.writeError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	h.writeText(w, http.StatusOK, "OK")
+}
+
+func (h *HTTPHandler) handleIncr(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+
+	delta := int64(1)
+	if d := req.URL.Query().Get("delta"); d != "" {
+		var err error
+		delta, err = strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			h.writeError(w, http.StatusBadRequest, "Delta must be an integer")
+			return
 		}
-		return true
+	}
+
+	value, err := h.cache.Increment([]byte(key), delta)
+	if h.writeSizeError(w, err) {
+		return
+	}
+	if errors.Is(err, cache.ErrNotInteger) || errors.Is(err, cache.ErrOverflow) {
+		h.writeError(w, http.StatusConflict, "Value is not an integer or would overflow")
+		return
+	} else if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"key":   key,
+		"value": value,
 	})
-	
-	body, _ := json.Marshal(keys)
-	
-	h.writeResponse(writer, http.StatusOK, map[string]string{
-		"Content-Type":   "application/json",
-		"Content-Length": strconv.Itoa(len(body)),
-	}, body)
+	h.writeData(w, req, http.StatusOK, body)
+}
+
+// handleMGet answers a JSON array of keys with a JSON object mapping each
+// key to its value, or null if it is missing, loading them in one batch.
+func (h *HTTPHandler) handleMGet(w http.ResponseWriter, req *http.Request) {
+	body, ok := h.readBody(w, req, h.maxBatchLen())
+	if !ok {
+		return
+	}
+	var names []string
+	if err := json.Unmarshal(body, &names); err != nil {
+		h.writeError(w, http.StatusBadRequest, "Body must be a JSON array of keys")
+		return
+	}
+
+	keys := make([][]byte, len(names))
+	for i, name := range names {
+		keys[i] = []byte(name)
+	}
+	values := make(map[string]*string, len(names))
+	for i, entry := range readThroughMany(h.cache, h.config, TypeHTTP, keys) {
+		if entry != nil {
+			value := string(entry.Value())
+			values[names[i]] = &value
+		} else {
+			values[names[i]] = nil
+		}
+	}
+
+	body, _ = json.Marshal(values)
+	h.writeData(w, req, http.StatusOK, body)
 }
 
-func (h *HTTPHandler) writeResponse(writer *bufio.Writer, status int, headers map[string]string, body []byte) {
-	writer.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status)))
-	writer.WriteString("Server: gopogo/1.0\r\n")
-	writer.WriteString("Date: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n")
-	
-	for key, value := range headers {
-		writer.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+// handleMSet stores every key of a JSON object with its string value, as
+// one atomic batch, with the TTL of an X-TTL header if there is one.
+func (h *HTTPHandler) handleMSet(w http.ResponseWriter, req *http.Request) {
+	body, ok := h.readBody(w, req, h.maxBatchLen())
+	if !ok {
+		return
+	}
+	var pairs map[string]string
+	if err := json.Unmarshal(body, &pairs); err != nil {
+		h.writeError(w, http.StatusBadRequest, "Body must be a JSON object of keys and values")
+		return
+	}
+
+	opts := &cache.StoreOptions{}
+	if ttl := req.Header.Get("X-TTL"); ttl != "" {
+		seconds, err := strconv.Atoi(ttl)
+		if err == nil {
+			opts.TTL = time.Duration(seconds) * time.Second
+		}
+	}
+
+	keys := make([][]byte, 0, len(pairs))
+	values := make([][]byte, 0, len(pairs))
+	for key, value := range pairs {
+		keys = append(keys, []byte(key))
+		values = append(values, []byte(value))
+	}
+	if err := h.cache.StoreMany(keys, values, opts); h.writeSizeError(w, err) {
+		return
+	}
+	h.writeText(w, http.StatusCreated, "OK")
+}
+
+func (h *HTTPHandler) handleMeta(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+
+	entry, found := h.cache.Load([]byte(key))
+	if !found {
+		h.writeError(w, http.StatusNotFound, "Key not found")
+		return
 	}
-	
-	if body == nil {
-		writer.WriteString("Content-Length: 0\r\n")
+
+	meta := map[string]interface{}{
+		"key":   key,
+		"flags": entry.Flags(),
+		"cas":   entry.CAS(),
+		"size":  len(entry.Value()),
+		"ttl":   ttlSeconds(entry),
+	}
+	if expireAt := entry.ExpireAt(); expireAt > 0 {
+		meta["expires_at"] = time.Unix(0, expireAt).UTC().Format(time.RFC3339Nano)
 	}
-	
-	writer.WriteString("\r\n")
-	
-	if body != nil {
-		writer.Write(body)
+
+	body, _ := json.Marshal(meta)
+	h.writeData(w, req, http.StatusOK, body)
+}
+
+// handleJSONGet returns the parts of a JSON document selected by the
+// path query parameters, as JSON.GET does; without one, the whole
+// document.
+func (h *HTTPHandler) handleJSONGet(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+	entry, found := h.cache.Load([]byte(key))
+	if !found {
+		h.writeError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	paths := req.URL.Query()["path"]
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	body, err := jsonGet(entry.Value(), paths)
+	if errors.Is(err, errNotJSON) {
+		h.writeError(w, http.StatusConflict, "Value is not JSON")
+		return
+	}
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "ERR "))
+		return
+	}
+	h.writeJSON(w, http.StatusOK, body)
+}
+
+// handleJSONSet sets the part of a JSON document selected by the path
+// query parameter, or the whole document without one, to the JSON body,
+// as JSON.SET does.
+func (h *HTTPHandler) handleJSONSet(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+	path := cmp.Or(req.URL.Query().Get("path"), "$")
+
+	body, ok := h.readBody(w, req, h.maxValueLen())
+	if !ok {
+		return
+	}
+
+	set, created, err := jsonSet(h.cache, []byte(key), path, body, false, false)
+	switch {
+	case h.writeSizeError(w, err):
+	case errors.Is(err, errNotJSON):
+		h.writeError(w, http.StatusConflict, "Value is not JSON")
+	case errors.Is(err, errNewAtRoot):
+		h.writeError(w, http.StatusNotFound, "Key not found")
+	case err != nil:
+		h.writeError(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "ERR "))
+	case !set:
+		h.writeError(w, http.StatusNotFound, "Path not found")
+	case created:
+		h.writeText(w, http.StatusCreated, "OK")
+	default:
+		h.writeText(w, http.StatusOK, "OK")
 	}
 }
 
-func (h *HTTPHandler) writeError(writer *bufio.Writer, status int, message string) {
+func (h *HTTPHandler) writeText(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+	w.WriteHeader(status)
+	io.WriteString(w, text)
+}
+
+func (h *HTTPHandler) writeJSON(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// maxTTLBodyLen bounds the body of a TTL update, which holds one number.
+const maxTTLBodyLen = 64
+
+// maxValueLen returns the largest value a client may send: the
+// --proto-max-bulk-len limit on RESP bulk strings, or the cache's value
+// size limit if that is smaller.
+// maxBatchLen returns the longest request body of a batch accepted over
+// HTTP: --proto-max-bulk-len, which bounds a whole Redis command too.
+func (h *HTTPHandler) maxBatchLen() int64 {
+	if h.config.MaxBulkLen > 0 {
+		return h.config.MaxBulkLen
+	}
+	return DefaultMaxBulkLen
+}
+
+func (h *HTTPHandler) maxValueLen() int64 {
+	limit := int64(DefaultMaxBulkLen)
+	if h.config.MaxBulkLen > 0 {
+		limit = h.config.MaxBulkLen
+	}
+	if _, maxValue := h.cache.SizeLimits(); maxValue > 0 {
+		limit = min(limit, maxValue)
+	}
+	return limit
+}
+
+// readBody reads the request body, chunked or not, refusing one longer
+// than limit with 413. A declared Content-Length over the limit is
+// refused before anything is read, and the buffer grows with the bytes
+// actually received rather than with what the header claims. It reports
+// whether the body was read; if not, the response has been written.
+func (h *HTTPHandler) readBody(w http.ResponseWriter, req *http.Request, limit int64) ([]byte, bool) {
+	if req.ContentLength > limit {
+		h.writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	if req.ContentLength > 0 {
+		buf.Grow(int(min(req.ContentLength, bodyPrealloc)))
+	}
+	_, err := buf.ReadFrom(http.MaxBytesReader(w, req.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return nil, false
+	}
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, "Failed to read body")
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// bodyPrealloc caps how much of a declared Content-Length readBody
+// allocates before the bytes arrive.
+const bodyPrealloc = 1 << 20
+
+// writeSizeError answers 414 or 413 if err is ErrKeyTooLarge or
+// ErrValueTooLarge, or 507 if it is ErrPinnedLimit, and reports whether it
+// did. Other errors, including nil, are left to the caller.
+func (h *HTTPHandler) writeSizeError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, cache.ErrKeyTooLarge):
+		h.writeError(w, http.StatusRequestURITooLong, "Key too large")
+	case errors.Is(err, cache.ErrValueTooLarge):
+		h.writeError(w, http.StatusRequestEntityTooLarge, "Value too large")
+	case errors.Is(err, cache.ErrPinnedLimit):
+		h.writeError(w, http.StatusInsufficientStorage, "Pinned memory limit reached")
+	default:
+		return false
+	}
+	return true
+}
+
+// writeError replies with status and a JSON error, counting bad requests,
+// authentication failures and server errors.
+func (h *HTTPHandler) writeError(w http.ResponseWriter, status int, message string) {
+	switch {
+	case status == http.StatusBadRequest:
+		h.config.Errors.count(TypeHTTP, errorParse)
+	case status == http.StatusUnauthorized:
+		h.config.Errors.count(TypeHTTP, errorAuth)
+	case status >= 500:
+		h.config.Errors.count(TypeHTTP, errorInternal)
+	}
 	body := fmt.Sprintf(`{"error":"%s"}`, message)
-	h.writeResponse(writer, status, map[string]string{
-		"Content-Type":   "application/json",
-		"Content-Length": strconv.Itoa(len(body)),
-	}, []byte(body))
-}
\ No newline at end of file
+	h.writeJSON(w, status, []byte(body))
+}
+
+// singleConnListener yields one connection and then blocks until the
+// HTTP server has finished with it, so Serve returns when it closes.
+type singleConnListener struct {
+	conn   net.Conn
+	state  *httpConn
+	served sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.served.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-l.state.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.state.close()
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// readerConn is a net.Conn whose reads go through a different reader.
+type readerConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,408 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+func TestHTTPEncodedKeys(t *testing.T) {
+	c := cache.New(1, 0)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	tests := []struct {
+		path string
+		key  string
+	}{
+		{"/a%20b", "a b"},
+		{"/bin%00%FF", "bin\x00\xff"},
+		{"/with%2Fslash", "with/slash"},
+		{"/dir/file", "dir/file"},
+		{"/caf%C3%A9", "café"},
+	}
+	for _, tt := range tests {
+		if rec := do("PUT", tt.path, "v"); rec.Code != http.StatusCreated {
+			t.Errorf("PUT %s = %d", tt.path, rec.Code)
+			continue
+		}
+		if entry, found := c.Load([]byte(tt.key)); !found || string(entry.Value()) != "v" {
+			t.Errorf("PUT %s did not store %q", tt.path, tt.key)
+		}
+		if rec := do("GET", tt.path, ""); rec.Code != http.StatusOK || rec.Body.String() != "v" {
+			t.Errorf("GET %s = %d %q", tt.path, rec.Code, rec.Body.String())
+		}
+	}
+
+	if rec := do("GET", "/keys/with%2Fslash/ttl", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /keys/with%%2Fslash/ttl = %d", rec.Code)
+	}
+}
+
+func TestHTTPSizeLimits(t *testing.T) {
+	c := cache.New(1, 0)
+	c.SetSizeLimits(4, 8)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+
+	put := func(path string, body io.Reader) int {
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, httptest.NewRequest("PUT", path, body))
+		return rec.Code
+	}
+
+	if code := put("/keys", strings.NewReader("12345678")); code != http.StatusCreated {
+		t.Errorf("PUT at the limits = %d", code)
+	}
+	if code := put("/key-5", strings.NewReader("v")); code != http.StatusRequestURITooLong {
+		t.Errorf("PUT with a long key = %d, want 414", code)
+	}
+	if code := put("/k", strings.NewReader("123456789")); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT with a long value = %d, want 413", code)
+	}
+	// A body of unknown length is cut off once it passes the limit.
+	if code := put("/k", io.MultiReader(strings.NewReader("12345"), strings.NewReader("6789"))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT with a long chunked value = %d, want 413", code)
+	}
+	if _, found := c.Load([]byte("k")); found {
+		t.Error("an oversized value was stored")
+	}
+}
+
+func TestHTTPBodyLimit(t *testing.T) {
+	c := cache.New(1, 0)
+	h := NewHTTPHandler(c, &Config{MaxBulkLen: 16, Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+
+	serve := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// A huge declared length is refused without reading or allocating it.
+	req := httptest.NewRequest("PUT", "/k", strings.NewReader("v"))
+	req.ContentLength = 10 << 30
+	if code := serve(req); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT declaring 10GB = %d, want 413", code)
+	}
+
+	// Chunked bodies have no declared length.
+	chunked := func(body string) *http.Request {
+		req := httptest.NewRequest("PUT", "/k", io.MultiReader(strings.NewReader(body)))
+		req.ContentLength = -1
+		return req
+	}
+	if code := serve(chunked(strings.Repeat("x", 16))); code != http.StatusCreated {
+		t.Errorf("chunked PUT at the limit = %d, want 201", code)
+	}
+	if code := serve(chunked(strings.Repeat("x", 17))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked PUT over the limit = %d, want 413", code)
+	}
+	if entry, _ := c.Load([]byte("k")); len(entry.Value()) != 16 {
+		t.Errorf("k has %d bytes, want the 16 stored at the limit", len(entry.Value()))
+	}
+
+	if code := serve(httptest.NewRequest("PUT", "/keys/k/ttl", strings.NewReader(strings.Repeat("1", 100)))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT of a 100-byte TTL = %d, want 413", code)
+	}
+}
+
+func TestHTTPJSON(t *testing.T) {
+	c := cache.New(1, 0)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+
+	do := func(method, path, body string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec.Code, rec.Body.String()
+	}
+
+	tests := []struct {
+		method, path, body string
+		code               int
+		want               string
+	}{
+		{"PUT", "/json/doc", `{"a":{"b":[1,2]},"c":"x"}`, http.StatusCreated, "OK"},
+		{"GET", "/json/doc", "", http.StatusOK, `{"a":{"b":[1,2]},"c":"x"}`},
+		{"GET", "/json/doc?path=$.a.b[1]", "", http.StatusOK, `[2]`},
+		{"GET", "/json/doc?path=.c", "", http.StatusOK, `"x"`},
+		{"PUT", "/json/doc?path=$.a.b[0]", `{"deep":true}`, http.StatusOK, "OK"},
+		{"GET", "/json/doc?path=$.a&path=$.c", "", http.StatusOK, `{"$.a":[{"b":[{"deep":true},2]}],"$.c":["x"]}`},
+		{"PUT", "/json/doc?path=$.a.b[9]", `1`, http.StatusNotFound, ""},
+		{"PUT", "/json/doc", `{bad`, http.StatusBadRequest, ""},
+		{"GET", "/json/doc?path=$[", "", http.StatusBadRequest, ""},
+		{"PUT", "/json/new?path=$.a", `1`, http.StatusNotFound, ""},
+		{"GET", "/json/missing", "", http.StatusNotFound, ""},
+		{"PUT", "/plain", "text", http.StatusCreated, "OK"},
+		{"GET", "/json/plain", "", http.StatusConflict, ""},
+	}
+	for _, tt := range tests {
+		code, body := do(tt.method, tt.path, tt.body)
+		if code != tt.code || (tt.want != "" && body != tt.want) {
+			t.Errorf("%s %s = %d %q, want %d %q", tt.method, tt.path, code, body, tt.code, tt.want)
+		}
+	}
+}
+
+func TestHTTPEvents(t *testing.T) {
+	c := cache.New(1, 0)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+	server := httptest.NewServer(h.server.Handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?pattern=foo:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	c.Store([]byte("bar"), []byte("v"), nil)
+	c.Store([]byte("foo:1"), []byte("v"), nil)
+	c.Delete([]byte("foo:1"))
+	c.Store([]byte("foo:2"), []byte("v"), &cache.StoreOptions{TTL: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+	c.Load([]byte("foo:2"))
+
+	want := "event: set\ndata: {\"key\":\"foo:1\"}\n\n" +
+		"event: del\ndata: {\"key\":\"foo:1\"}\n\n" +
+		"event: set\ndata: {\"key\":\"foo:2\"}\n\n" +
+		"event: expired\ndata: {\"key\":\"foo:2\"}\n\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestHTTPDeletePrefix(t *testing.T) {
+	c := cache.New(1, 0)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+	c.Store([]byte("tenant1:a"), []byte("v"), nil)
+	c.Store([]byte("tenant1:b"), []byte("v"), nil)
+	c.Store([]byte("tenant2:a"), []byte("v"), nil)
+
+	rec := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(rec, httptest.NewRequest("DELETE", "/keys?prefix=tenant1:", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("DELETE /keys = %d %s", rec.Code, rec.Body)
+	}
+	for deadline := time.Now().Add(time.Second); c.NumItems() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d keys left", c.NumItems())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, found := c.Load([]byte("tenant2:a")); !found {
+		t.Error("key outside the prefix was deleted")
+	}
+
+	rec = httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(rec, httptest.NewRequest("DELETE", "/keys", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("DELETE /keys without a prefix = %d", rec.Code)
+	}
+}
+
+func TestHTTPPin(t *testing.T) {
+	c := cache.New(1, 1000)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+
+	put := func(path, body string, header ...string) int {
+		req := httptest.NewRequest("PUT", path, strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := put("/config", "blob", "X-Pin", "true"); code != http.StatusCreated {
+		t.Fatalf("PUT with X-Pin = %d", code)
+	}
+	rec := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+	if rec.Header().Get("X-Pin") != "true" {
+		t.Errorf("GET of a pinned key has X-Pin %q", rec.Header().Get("X-Pin"))
+	}
+	if code := put("/big", strings.Repeat("x", 600), "X-Pin", "true"); code != http.StatusInsufficientStorage {
+		t.Errorf("PUT over the pinned limit = %d, want 507", code)
+	}
+	if code := put("/config?if-absent=true", "blob", "X-Pin", "true"); code != http.StatusBadRequest {
+		t.Errorf("PUT with X-Pin and if-absent = %d, want 400", code)
+	}
+}
+
+func TestHTTPConditionalRequests(t *testing.T) {
+	// In each tag, ETAG stands for the key's current entity tag.
+	tests := []struct {
+		method  string
+		missing bool
+		header  string
+		tag     string
+		want    int
+	}{
+		{"GET", false, "If-None-Match", `ETAG`, http.StatusNotModified},
+		{"GET", false, "If-None-Match", `W/ETAG`, http.StatusNotModified},
+		{"GET", false, "If-None-Match", `"0", ETAG`, http.StatusNotModified},
+		{"GET", false, "If-None-Match", `*`, http.StatusNotModified},
+		{"GET", false, "If-None-Match", `"0"`, http.StatusOK},
+		{"GET", false, "If-Match", `ETAG`, http.StatusOK},
+		{"GET", false, "If-Match", `W/ETAG`, http.StatusPreconditionFailed},
+		{"GET", false, "If-Match", `*`, http.StatusOK},
+		{"GET", false, "If-Match", `"0"`, http.StatusPreconditionFailed},
+		{"GET", true, "If-Match", `*`, http.StatusPreconditionFailed},
+		{"GET", true, "If-None-Match", `*`, http.StatusNotFound},
+
+		{"PUT", false, "If-Match", `ETAG`, http.StatusOK},
+		{"PUT", false, "If-Match", `W/ETAG`, http.StatusPreconditionFailed},
+		{"PUT", false, "If-Match", `"0"`, http.StatusPreconditionFailed},
+		{"PUT", false, "If-Match", `*`, http.StatusCreated},
+		{"PUT", true, "If-Match", `*`, http.StatusPreconditionFailed},
+		{"PUT", false, "If-None-Match", `*`, http.StatusPreconditionFailed},
+		{"PUT", false, "If-None-Match", `W/ETAG`, http.StatusPreconditionFailed},
+		{"PUT", false, "If-None-Match", `"0"`, http.StatusCreated},
+		{"PUT", true, "If-None-Match", `*`, http.StatusCreated},
+
+		{"DELETE", false, "If-Match", `ETAG`, http.StatusOK},
+		{"DELETE", false, "If-Match", `W/ETAG`, http.StatusPreconditionFailed},
+		{"DELETE", false, "If-Match", `"0"`, http.StatusPreconditionFailed},
+		{"DELETE", false, "If-Match", `*`, http.StatusOK},
+		{"DELETE", true, "If-Match", `*`, http.StatusPreconditionFailed},
+		{"DELETE", false, "If-None-Match", `*`, http.StatusPreconditionFailed},
+		{"DELETE", false, "If-None-Match", `"0"`, http.StatusOK},
+		{"DELETE", true, "If-None-Match", `*`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		c := cache.New(1, 0)
+		h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+
+		var etag string
+		if !tt.missing {
+			c.Store([]byte("k"), []byte("old"), nil)
+			entry, _ := c.Load([]byte("k"))
+			etag = entryETag(entry)
+		}
+		tag := strings.ReplaceAll(tt.tag, "ETAG", etag)
+		name := fmt.Sprintf("%s %s: %s", tt.method, tt.header, tag)
+
+		req := httptest.NewRequest(tt.method, "/k", strings.NewReader("new"))
+		req.Header.Set(tt.header, tag)
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, tt.want)
+			continue
+		}
+		if rec.Code == http.StatusNotModified && (rec.Header().Get("ETag") != etag || rec.Body.Len() != 0) {
+			t.Errorf("%s: 304 with ETag %q and body %q", name, rec.Header().Get("ETag"), rec.Body.String())
+		}
+
+		// Only a PUT or DELETE that succeeded changes the key.
+		var current string
+		if entry, found := c.Load([]byte("k")); found {
+			current = entryETag(entry)
+		}
+		changed := current != etag
+		if wantChanged := tt.method != "GET" && rec.Code/100 == 2; changed != wantChanged {
+			t.Errorf("%s: key changed = %v, want %v", name, changed, wantChanged)
+		}
+	}
+}
+
+func TestHTTPBatch(t *testing.T) {
+	c := cache.New(4, 0)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := post("/mset", `{"a": "1", "b": "2"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /mset = %d %s", rec.Code, rec.Body)
+	}
+	rec := post("/mget", `["a", "b", "c"]`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"a":"1","b":"2","c":null}` {
+		t.Errorf("POST /mget = %d %s", rec.Code, rec.Body)
+	}
+	if rec := post("/mget", `{"a": 1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /mget with an object = %d, want 400", rec.Code)
+	}
+}
+
+func TestHTTPStats(t *testing.T) {
+	c := cache.New(4, 0)
+	h := NewHTTPHandler(c, &Config{
+		Limits:  ratelimit.NewRegistry(ratelimit.Limits{}),
+		Traffic: NewTraffic(),
+		Version: "1.2.3",
+		Commit:  "abc123",
+		Started: time.Now().Add(-time.Minute),
+	})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	for i := 0; i < 10; i++ {
+		do("PUT", fmt.Sprintf("/k%d", i), "v")
+	}
+	do("GET", "/k0", "")
+
+	rec := do("GET", "/stats", "")
+	var stats struct {
+		Version string `json:"version"`
+		Commit  string `json:"commit"`
+		Uptime  int64  `json:"uptime_seconds"`
+		cache.Stats
+		Protocols map[string]ProtocolStats `json:"protocols"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("GET /stats: %v\n%s", err, rec.Body)
+	}
+	if stats.Items != 10 || stats.Hits != 1 || len(stats.Shards) != 4 {
+		t.Errorf("num_items = %d, num_hits = %d, %d shards; want 10, 1 and 4", stats.Items, stats.Hits, len(stats.Shards))
+	}
+	items := 0
+	for _, shard := range stats.Shards {
+		items += shard.Items
+	}
+	if items != stats.Items {
+		t.Errorf("shards hold %d items, num_items = %d", items, stats.Items)
+	}
+	if got := stats.Protocols["http"].Commands; got != 12 {
+		t.Errorf("http commands = %d, want 12", got)
+	}
+	if stats.Version != "1.2.3" || stats.Commit != "abc123" || stats.Uptime != 60 {
+		t.Errorf("version %q, commit %q, uptime %d; want 1.2.3, abc123 and 60", stats.Version, stats.Commit, stats.Uptime)
+	}
+
+	metrics := do("GET", "/metrics", "").Body.String()
+	if want := `gopogo_build_info{version="1.2.3",commit="abc123",goversion="` + runtime.Version() + `"} 1`; !strings.Contains(metrics, want) {
+		t.Errorf("GET /metrics lacks %s", want)
+	}
+	if !strings.Contains(metrics, "\ngopogo_uptime_seconds 60\n") {
+		t.Errorf("GET /metrics lacks gopogo_uptime_seconds 60")
+	}
+}
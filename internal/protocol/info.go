@@ -0,0 +1,312 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/persistence"
+)
+
+// infoSection is a section of INFO. The sections are reported in the
+// order of infoSections, and those not byDefault only when asked for by
+// name or with all or everything.
+type infoSection struct {
+	name      string
+	byDefault bool
+	write     func(h *RedisHandler, b *strings.Builder)
+}
+
+var infoSections = []infoSection{
+	{"server", true, (*RedisHandler).infoServer},
+	{"clients", true, (*RedisHandler).infoClients},
+	{"memory", true, (*RedisHandler).infoMemory},
+	{"persistence", true, (*RedisHandler).infoPersistence},
+	{"stats", true, (*RedisHandler).infoStats},
+	{"replication", true, (*RedisHandler).infoReplication},
+	{"cpu", true, (*RedisHandler).infoCPU},
+	{"commandstats", false, (*RedisHandler).infoCommandStats},
+	{"latencystats", false, (*RedisHandler).infoLatencyStats},
+	{"sharding", true, (*RedisHandler).infoSharding},
+	{"keyspace", true, (*RedisHandler).infoKeyspace},
+}
+
+// handleInfo implements INFO [section ...]. With no section it reports
+// the default sections, as does the section name default; all and
+// everything report every section. Unknown sections are ignored, so
+// asking only for those returns an empty string, as Redis does.
+func (h *RedisHandler) handleInfo(writer *bufio.Writer, args [][]byte) {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		wanted[strings.ToLower(string(arg))] = true
+	}
+	all := wanted["all"] || wanted["everything"]
+	byDefault := len(args) == 0 || wanted["default"]
+
+	var info strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] && !(byDefault && section.byDefault) {
+			continue
+		}
+		if info.Len() > 0 {
+			info.WriteString("\r\n")
+		}
+		section.write(h, &info)
+	}
+
+	h.writeBulkString(writer, info.String())
+}
+
+// infoServer reports the server. redis_version is the Redis release whose
+// commands gopogo implements, which clients check before using newer
+// ones; gopogo_version is the build's own.
+func (h *RedisHandler) infoServer(b *strings.Builder) {
+	now := time.Now()
+	uptime := h.config.uptime(now)
+	fmt.Fprintf(b, "# Server\r\n"+
+		"redis_version:7.0.0\r\n"+
+		"redis_mode:standalone\r\n"+
+		"gopogo_version:%s\r\n"+
+		"gopogo_commit:%s\r\n"+
+		"os:%s %s\r\n"+
+		"arch_bits:%d\r\n"+
+		"go_version:%s\r\n"+
+		"process_id:%d\r\n"+
+		"run_id:%s\r\n"+
+		"tcp_port:%d\r\n"+
+		"server_time_usec:%d\r\n"+
+		"uptime_in_seconds:%d\r\n"+
+		"uptime_in_days:%d\r\n",
+		h.config.version(),
+		h.config.Commit,
+		runtime.GOOS, runtime.GOARCH,
+		32<<(^uint(0)>>63),
+		runtime.Version(),
+		os.Getpid(),
+		runID,
+		h.config.Port,
+		now.UnixMicro(),
+		int64(uptime.Seconds()),
+		int64(uptime.Hours()/24))
+}
+
+func (h *RedisHandler) infoClients(b *strings.Builder) {
+	connected := 0
+	if h.config.Clients != nil {
+		connected = h.config.Clients.Count()
+	}
+	fmt.Fprintf(b, "# Clients\r\n"+
+		"connected_clients:%d\r\n",
+		connected)
+}
+
+func (h *RedisHandler) infoMemory(b *strings.Builder) {
+	stats := h.cache.Stats()
+	fmt.Fprintf(b, "# Memory\r\n"+
+		"used_memory:%d\r\n"+
+		"used_memory_human:%s\r\n"+
+		"maxmemory:%d\r\n"+
+		"maxmemory_human:%s\r\n"+
+		"pinned_memory:%d\r\n"+
+		"maxpinned:%d\r\n"+
+		"disk_tier_keys:%d\r\n"+
+		"disk_tier_bytes:%d\r\n"+
+		"maxmemory_policy:%s\r\n",
+		stats.MemUsed,
+		formatMemory(stats.MemUsed),
+		stats.MaxMemory,
+		formatMemory(stats.MaxMemory),
+		stats.PinnedBytes,
+		stats.MaxPinned,
+		stats.DiskKeys,
+		stats.DiskBytes,
+		redisEvictionPolicy(stats.EvictionPolicy))
+}
+
+// infoPersistence reports the snapshots uploaded to the object store as
+// Redis reports RDB saves. Before the first snapshot, rdb_last_save_time
+// is when the server started, as in Redis.
+func (h *RedisHandler) infoPersistence(b *strings.Builder) {
+	var status persistence.SaveStatus
+	if h.config.Snapshots != nil {
+		status = h.config.Snapshots.Status()
+	}
+	lastSave := status.LastSave
+	if lastSave.IsZero() {
+		lastSave = h.config.Started
+	}
+	lastStatus := "ok"
+	if status.LastFailed {
+		lastStatus = "err"
+	}
+	lastDuration := int64(-1)
+	if status.LastDuration > 0 {
+		lastDuration = int64(status.LastDuration.Seconds())
+	}
+	fmt.Fprintf(b, "# Persistence\r\n"+
+		"loading:0\r\n"+
+		"rdb_bgsave_in_progress:%d\r\n"+
+		"rdb_saves:%d\r\n"+
+		"rdb_last_save_time:%d\r\n"+
+		"rdb_last_bgsave_status:%s\r\n"+
+		"rdb_last_bgsave_time_sec:%d\r\n"+
+		"aof_enabled:0\r\n",
+		boolInt(status.Saving),
+		status.Saves,
+		unixSeconds(lastSave),
+		lastStatus,
+		lastDuration)
+}
+
+func (h *RedisHandler) infoStats(b *strings.Builder) {
+	stats := h.cache.Stats()
+	traffic := h.config.Traffic.Total()
+	deletes := h.cache.PrefixDeletes()
+	deleted := int64(0)
+	for _, d := range deletes {
+		deleted += d.Deleted
+	}
+	fmt.Fprintf(b, "# Stats\r\n"+
+		"total_commands_processed:%d\r\n"+
+		"total_net_input_bytes:%d\r\n"+
+		"total_net_output_bytes:%d\r\n"+
+		"keyspace_hits:%d\r\n"+
+		"keyspace_misses:%d\r\n"+
+		"evicted_keys:%d\r\n"+
+		"evictions_per_sec:%d\r\n"+
+		"eviction_busy_perc:%.2f%%\r\n"+
+		"eviction_pressure:%d\r\n"+
+		"bulk_evictions:%d\r\n"+
+		"admission_rejected:%d\r\n"+
+		"admission_ghost_hits:%d\r\n"+
+		"disk_tier_spilled:%d\r\n"+
+		"disk_tier_restored:%d\r\n"+
+		"expired_keys:%d\r\n"+
+		"prefix_deletes_in_progress:%d\r\n"+
+		"prefix_deletes_keys_deleted:%d\r\n"+
+		"acl_access_denied_auth:%d\r\n",
+		stats.Ops,
+		traffic.BytesIn,
+		traffic.BytesOut,
+		stats.Hits,
+		stats.Misses,
+		stats.Evicted,
+		stats.EvictionsPerSec,
+		100*stats.EvictionBusy,
+		boolInt(stats.EvictionPressure),
+		stats.BulkEvictions,
+		stats.AdmissionRejected,
+		stats.GhostHits,
+		stats.Spilled,
+		stats.Restored,
+		stats.Expired,
+		len(deletes),
+		deleted,
+		h.config.Errors.Stats()[TypeRedis.String()][errorAuth])
+}
+
+func (h *RedisHandler) infoReplication(b *strings.Builder) {
+	role, replicas := "master", 0
+	if h.config.Health != nil {
+		status := h.config.Health()
+		if status.Replication.Role != "" {
+			role = status.Replication.Role
+		}
+		replicas = status.Replication.ConnectedReplicas
+	}
+	fmt.Fprintf(b, "# Replication\r\n"+
+		"role:%s\r\n"+
+		"connected_slaves:%d\r\n"+
+		"master_replid:%s\r\n"+
+		"master_repl_offset:0\r\n",
+		role,
+		replicas,
+		runID)
+}
+
+func (h *RedisHandler) infoCPU(b *strings.Builder) {
+	user, sys := cpuTime()
+	fmt.Fprintf(b, "# CPU\r\n"+
+		"used_cpu_sys:%.6f\r\n"+
+		"used_cpu_user:%.6f\r\n"+
+		"goroutines:%d\r\n",
+		sys.Seconds(),
+		user.Seconds(),
+		runtime.NumGoroutine())
+}
+
+func (h *RedisHandler) infoCommandStats(b *strings.Builder) {
+	commands := h.config.Commands.Stats()
+	b.WriteString("# Commandstats\r\n")
+	for _, name := range commandNames(commands) {
+		s := commands[name]
+		fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+			name, s.Calls, s.Usec, s.UsecPerCall, s.RejectedCalls, s.FailedCalls)
+	}
+}
+
+func (h *RedisHandler) infoLatencyStats(b *strings.Builder) {
+	commands := h.config.Commands.Stats()
+	b.WriteString("# Latencystats\r\n")
+	for _, name := range commandNames(commands) {
+		if s := commands[name]; s.Calls > 0 {
+			fmt.Fprintf(b, "latency_percentiles_usec_%s:p50=%.3f,p99=%.3f,p99.9=%.3f\r\n", name, s.P50, s.P99, s.P999)
+		}
+	}
+}
+
+func (h *RedisHandler) infoSharding(b *strings.Builder) {
+	resize, running := h.cache.ResizeStatus()
+	fmt.Fprintf(b, "# Sharding\r\n"+
+		"shards:%d\r\n"+
+		"resharding_in_progress:%d\r\n"+
+		"resharding_target:%d\r\n"+
+		"resharding_migrated:%d\r\n",
+		h.cache.NumShards(),
+		boolInt(running),
+		resize.To,
+		resize.Migrated)
+}
+
+// infoKeyspace reports the keys as db0, the only database. Like Redis it
+// leaves the database out while it is empty.
+func (h *RedisHandler) infoKeyspace(b *strings.Builder) {
+	b.WriteString("# Keyspace\r\n")
+	stats := h.cache.Stats()
+	if stats.Items == 0 {
+		return
+	}
+	expiry := h.cache.ExpiryStats()
+	fmt.Fprintf(b, "db0:keys=%d,expires=%d,avg_ttl=%d\r\n",
+		stats.Items, expiry.Volatile, expiry.AvgTTL.Milliseconds())
+}
+
+// runID identifies this process in INFO, as Redis's run_id does, so that
+// tools can tell a restarted server from one that kept running.
+var runID = newRunID()
+
+func newRunID() string {
+	var id [20]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// unixSeconds returns t as Unix seconds, or 0 for the zero time.
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	
+	"github.com/grumpylabs/gopogo/internal/jsonpath"
+)
+
+var (
+	// errNotJSON is returned for a key whose value is not a JSON document.
+	errNotJSON = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	// errNewAtRoot is returned for a JSON.SET of a missing key below the
+	// root.
+	errNewAtRoot = errors.New("ERR new objects must be created at the root")
+)
+
+// jsonGet returns what JSON.GET replies for a document and its paths. A
+// single path gives its matches as an array, or for a legacy path the
+// first match; several give an object mapping each path to that.
+func jsonGet(value []byte, paths []string) ([]byte, error) {
+	doc, err := jsonpath.Decode(value)
+	if err != nil {
+		return nil, errNotJSON
+	}
+	
+	results := make([]any, len(paths))
+	for i, arg := range paths {
+		path, err := jsonpath.Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("ERR %w", err)
+		}
+		matches := path.Get(doc)
+		if !path.Legacy() {
+			results[i] = matches
+		} else if len(matches) > 0 {
+			results[i] = matches[0]
+		} else {
+			return nil, fmt.Errorf("ERR Path '%s' does not exist", arg)
+		}
+	}
+	
+	if len(paths) == 1 {
+		return jsonpath.Encode(results[0]), nil
+	}
+	obj := jsonpath.NewObject()
+	for i, arg := range paths {
+		obj.Set(arg, results[i])
+	}
+	return jsonpath.Encode(obj), nil
+}
+
+// jsonSet sets the values path selects in the document at key to the JSON
+// in value, or with nx or xx only if it selects nothing or something. It
+// reports whether anything was set and whether the key was created.
+func jsonSet(ks Keyspace, key []byte, pathArg string, value []byte, nx, xx bool) (set, created bool, err error) {
+	path, err := jsonpath.Parse(pathArg)
+	if err != nil {
+		return false, false, fmt.Errorf("ERR %w", err)
+	}
+	v, err := jsonpath.Decode(value)
+	if err != nil {
+		return false, false, fmt.Errorf("ERR %w", err)
+	}
+	
+	var opErr error
+	err = ks.Update(bytes.Clone(key), func(current []byte, found bool) []byte {
+		if !found {
+			if !path.IsRoot() {
+				opErr = errNewAtRoot
+				return nil
+			}
+			if xx {
+				return nil
+			}
+			set, created = true, true
+			return jsonpath.Encode(v)
+		}
+		
+		doc, err := jsonpath.Decode(current)
+		if err != nil {
+			opErr = errNotJSON
+			return nil
+		}
+		exists := len(path.Get(doc)) > 0
+		if (nx && exists) || (xx && !exists) {
+			return nil
+		}
+		doc, n := path.Set(doc, v)
+		if n == 0 {
+			return nil
+		}
+		set = true
+		return jsonpath.Encode(doc)
+	})
+	if err == nil {
+		err = opErr
+	}
+	return set, created, err
+}
+
+func (h *RedisHandler) handleJSONGet(writer *bufio.Writer, key []byte, paths [][]byte) {
+	entry, found := h.cache.Load(key)
+	if !found {
+		h.writeNil(writer)
+		return
+	}
+	
+	args := []string{"."}
+	if len(paths) > 0 {
+		args = make([]string, len(paths))
+		for i, path := range paths {
+			args[i] = string(path)
+		}
+	}
+	reply, err := jsonGet(entry.Value(), args)
+	if err != nil {
+		h.writeError(writer, err.Error())
+		return
+	}
+	h.writeBulk(writer, reply)
+}
+
+func (h *RedisHandler) handleJSONSet(writer *bufio.Writer, key, path, value []byte, args [][]byte) {
+	var nx, xx bool
+	for _, arg := range args {
+		switch strings.ToUpper(string(arg)) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			h.writeError(writer, "ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		h.writeError(writer, "ERR syntax error")
+		return
+	}
+	
+	set, _, err := jsonSet(h.cache, key, string(path), value, nx, xx)
+	if h.writeSizeError(writer, err) {
+		return
+	}
+	if err != nil {
+		h.writeError(writer, err.Error())
+		return
+	}
+	if !set {
+		h.writeNil(writer)
+		return
+	}
+	h.writeSimpleString(writer, "OK")
+}
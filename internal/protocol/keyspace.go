@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/origin"
+)
+
+// Keyspace is the part of the cache API the protocol handlers use. It is
+// satisfied by *cache.Cache and by *cache.Namespace, which confines a
+// protocol's clients to keys under a prefix.
+type Keyspace interface {
+	Store(key, value []byte, opts *cache.StoreOptions) error
+	Load(key []byte) (*cache.Entry, bool)
+	LoadNoTouch(key []byte) (*cache.Entry, bool)
+	LoadOrStore(key, value []byte, opts *cache.StoreOptions) (*cache.Entry, bool)
+	Swap(key, value []byte, opts *cache.StoreOptions) (*cache.Entry, bool)
+	Fetch(key []byte, opts *cache.StoreOptions, load func() ([]byte, error)) (*cache.Entry, bool, error)
+	Delete(key []byte) bool
+	LoadAndDelete(key []byte) (*cache.Entry, bool)
+	CompareAndSwap(key, value []byte, cas uint64, opts *cache.StoreOptions) (bool, error)
+	CompareAndDelete(key []byte, cas uint64) (bool, error)
+	Increment(key []byte, delta int64) (int64, error)
+	IncrementUnsigned(key []byte, delta uint64, decr bool) (uint64, error)
+	Update(key []byte, fn func(value []byte, found bool) []byte) error
+	Apply(ops []cache.Op) error
+	LoadMany(keys [][]byte) []*cache.Entry
+	LoadManyNoTouch(keys [][]byte) []*cache.Entry
+	StoreMany(keys, values [][]byte, opts *cache.StoreOptions) error
+	CheckSize(keyLen, valueLen int) error
+	SizeLimits() (maxKey, maxValue int64)
+	Rename(src, dst []byte, nx bool) (bool, error)
+	Copy(src, dst []byte, replace bool) (bool, error)
+	Iterate(fn func(*cache.Entry) bool)
+	IterateSnapshot(fn func(*cache.Entry) bool)
+	IterateParallel(fn func(*cache.Entry) bool, workers int)
+	Clear()
+	ClearAsync()
+	DeletePrefix(prefix []byte) <-chan struct{}
+	PrefixDeletes() []cache.PrefixDeleteStatus
+	NumItems() int
+	Stats() cache.Stats
+	TopKeys(n int) []cache.KeyStat
+	SizeReport(n int) *cache.SizeReport
+	MemoryStats() *cache.MemoryStats
+	Purge() int
+	Expire(key []byte, expireAt int64) bool
+	ExpiryStats() cache.ExpiryStats
+	Inspect(key []byte) (cache.EntryInfo, bool)
+	SetActiveExpire(enabled bool)
+	NumShards() int
+	ShardStats() []cache.ShardStats
+	LockWait() time.Duration
+	Resize(shards int) error
+	ResizeStatus() (cache.ResizeStatus, bool)
+}
+
+// noTouchKeyspace is the keyspace of a Redis client that turned on CLIENT
+// NO-TOUCH: its reads leave the access statistics that LRU and LFU
+// eviction and TOPKEYS go by as they were.
+type noTouchKeyspace struct {
+	Keyspace
+}
+
+func (ks noTouchKeyspace) Load(key []byte) (*cache.Entry, bool) {
+	return ks.LoadNoTouch(key)
+}
+
+func (ks noTouchKeyspace) LoadMany(keys [][]byte) []*cache.Entry {
+	return ks.LoadManyNoTouch(keys)
+}
+
+func (ks noTouchKeyspace) Fetch(key []byte, opts *cache.StoreOptions, load func() ([]byte, error)) (*cache.Entry, bool, error) {
+	if entry, found := ks.LoadNoTouch(key); found {
+		return entry, true, nil
+	}
+	return ks.Keyspace.Fetch(key, opts, load)
+}
+
+// keyspace returns the view of c that clients of protocol t may use.
+func keyspace(c *cache.Cache, config *Config, t Type) Keyspace {
+	if prefix := config.Namespaces[t.String()]; prefix != "" {
+		return c.Namespace(prefix)
+	}
+	return c
+}
+
+// readThrough returns the live entry for key. With an origin configured,
+// a miss is loaded from the origin and cached for OriginTTL; concurrent
+// misses on the same key share a single fetch. Origin errors are reported
+// as misses, and counted as internal errors of proto unless the origin
+// had no value.
+func readThrough(ks Keyspace, config *Config, proto Type, key []byte) (*cache.Entry, bool) {
+	if config.Origin == nil {
+		return ks.Load(key)
+	}
+	
+	entry, _, err := ks.Fetch(key, &cache.StoreOptions{TTL: config.OriginTTL}, func() ([]byte, error) {
+		return config.Origin.Fetch(context.Background(), string(key))
+	})
+	if err != nil && !errors.Is(err, origin.ErrNotFound) {
+		config.Errors.count(proto, errorInternal)
+	}
+	return entry, err == nil
+}
+
+// readThroughMany is readThrough for many keys. Without an origin the keys
+// are loaded in one batch, taking each shard's lock once.
+func readThroughMany(ks Keyspace, config *Config, proto Type, keys [][]byte) []*cache.Entry {
+	if config.Origin == nil {
+		return ks.LoadMany(keys)
+	}
+	
+	entries := make([]*cache.Entry, len(keys))
+	for i, key := range keys {
+		entries[i], _ = readThrough(ks, config, proto, key)
+	}
+	return entries
+}
+
+// matchKeys returns the keys in ks matching the glob pattern, for KEYS and
+// GET /keys. Shards are scanned in parallel, so the keys are in no
+// particular order.
+func matchKeys(ks Keyspace, pattern string) []string {
+	var mu sync.Mutex
+	keys := make([]string, 0)
+	
+	ks.IterateParallel(func(entry *cache.Entry) bool {
+		key := string(entry.Key())
+		if pattern == "*" || matchPattern(pattern, key) {
+			mu.Lock()
+			keys = append(keys, key)
+			mu.Unlock()
+		}
+		return true
+	}, 0)
+	return keys
+}
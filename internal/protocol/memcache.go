@@ -2,53 +2,93 @@ package protocol
 
 import (
 	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
-
+	
 	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
 )
 
 type MemcacheHandler struct {
-	cache *cache.Cache
+	cache   Keyspace
+	config  *Config
+	traffic *trafficCounters
 }
 
-func NewMemcacheHandler(cache *cache.Cache) *MemcacheHandler {
+func NewMemcacheHandler(cache *cache.Cache, config *Config) *MemcacheHandler {
 	return &MemcacheHandler{
-		cache: cache,
+		cache:   keyspace(cache, config, TypeMemcache),
+		config:  config,
+		traffic: config.Traffic.of(TypeMemcache.String()),
 	}
 }
 
 func (h *MemcacheHandler) Handle(conn net.Conn) {
 	defer conn.Close()
 	
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+	conn = h.traffic.wrap(conn)
+	limiter := h.config.Limits.Open(conn.RemoteAddr())
+	defer limiter.Close()
 	
+	reader := bufio.NewReader(limiter.Reader(conn))
+	writer := bufio.NewWriter(conn)
+	h.serve(reader, writer, limiter)
+}
+
+// serve runs the commands read from reader until it ends or the client
+// quits, writing the replies to writer.
+func (h *MemcacheHandler) serve(reader *bufio.Reader, writer *bufio.Writer, limiter *ratelimit.Limiter) {
 	for {
-		line, err := reader.ReadString('\n')
+		line, err := readMemcacheLine(reader)
+		if err == errMemcacheLineTooLong {
+			h.writeClientError(writer, "line too long")
+			writer.Flush()
+			return
+		}
 		if err != nil {
 			if err != io.EOF {
+				h.config.Errors.count(TypeMemcache, errorParse)
 				writer.WriteString("ERROR\r\n")
 				writer.Flush()
 			}
 			return
 		}
 		
-		line = strings.TrimSpace(line)
-		if line == "" {
+		// Tokens are separated by spaces only, as memcached does, so keys
+		// may hold any other byte until checkSizes checks them.
+		parts := strings.FieldsFunc(strings.TrimRight(line, "\r\n"), func(r rune) bool {
+			return r == ' '
+		})
+		if len(parts) == 0 {
 			continue
 		}
+		h.traffic.command()
 		
-		parts := strings.Fields(line)
-		if len(parts) == 0 {
+		cmd := strings.ToLower(parts[0])
+		
+		if !limiter.AllowCommand() {
+			h.discardData(reader, cmd, parts)
+			writer.WriteString("SERVER_ERROR rate limit exceeded\r\n")
+			writer.Flush()
 			continue
 		}
 		
-		cmd := strings.ToLower(parts[0])
+		if reply := h.checkSizes(cmd, parts); reply != "" {
+			if strings.HasPrefix(reply, "CLIENT_ERROR") {
+				h.config.Errors.count(TypeMemcache, errorParse)
+			}
+			h.discardData(reader, cmd, parts)
+			writer.WriteString(reply)
+			writer.Flush()
+			continue
+		}
 		
 		switch cmd {
 		case "get", "gets":
@@ -92,13 +132,14 @@ func (h *MemcacheHandler) Handle(conn net.Conn) {
 			h.handleStats(writer)
 			
 		case "version":
-			writer.WriteString("VERSION 1.6.0\r\n")
+			fmt.Fprintf(writer, "VERSION %s\r\n", h.config.version())
 			
 		case "quit":
 			writer.Flush()
 			return
 			
 		default:
+			h.config.Errors.count(TypeMemcache, errorParse)
 			writer.WriteString("ERROR\r\n")
 		}
 		
@@ -106,9 +147,128 @@ func (h *MemcacheHandler) Handle(conn net.Conn) {
 	}
 }
 
+// writeClientError replies to a command line or data block that could not
+// be parsed, counting it as a parse error.
+func (h *MemcacheHandler) writeClientError(writer *bufio.Writer, message string) {
+	h.config.Errors.count(TypeMemcache, errorParse)
+	writer.WriteString("CLIENT_ERROR " + message + "\r\n")
+}
+
+// RejectMemcacheBinary answers the first request of a memcached binary
+// protocol connection with a "not supported" error, so binary clients
+// fail with a clear message instead of a dropped connection.
+func RejectMemcacheBinary(conn net.Conn) {
+	var header [24]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return
+	}
+	
+	const statusNotSupported = 0x0083
+	msg := "Binary protocol not supported, use the text protocol"
+	
+	resp := make([]byte, 24, 24+len(msg))
+	resp[0] = 0x81      // response magic
+	resp[1] = header[1] // opcode
+	binary.BigEndian.PutUint16(resp[6:8], statusNotSupported)
+	binary.BigEndian.PutUint32(resp[8:12], uint32(len(msg)))
+	copy(resp[12:16], header[12:16]) // opaque
+	resp = append(resp, msg...)
+	
+	conn.Write(resp)
+}
+
+// maxMemcacheKeyLen is the longest key the memcached protocol allows.
+const maxMemcacheKeyLen = 250
+
+// maxMemcacheLineLen bounds a command line, which only a get of many keys
+// makes long.
+const maxMemcacheLineLen = 64 * 1024
+
+var errMemcacheLineTooLong = errors.New("line too long")
+
+// readMemcacheLine reads a line like ReadString, but fails once it grows
+// past maxMemcacheLineLen rather than buffer an endless one.
+func readMemcacheLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxMemcacheLineLen {
+			return "", errMemcacheLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// checkSizes returns the error reply for a command line whose keys are not
+// valid memcached keys, at most 250 bytes without control characters or
+// spaces, or whose keys or data block exceed the cache's size limits. It
+// returns "" if the command may go ahead.
+func (h *MemcacheHandler) checkSizes(cmd string, parts []string) string {
+	var keys []string
+	switch cmd {
+	case "get", "gets":
+		keys = parts[1:]
+	case "set", "add", "replace", "append", "prepend", "cas", "delete", "incr", "decr", "touch":
+		keys = parts[1:min(2, len(parts))]
+	}
+	
+	for _, key := range keys {
+		if len(key) > maxMemcacheKeyLen || h.cache.CheckSize(len(key), 0) != nil {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+		for i := 0; i < len(key); i++ {
+			if key[i] <= ' ' || key[i] == 0x7f {
+				return "CLIENT_ERROR bad command line format\r\n"
+			}
+		}
+	}
+	
+	switch cmd {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if len(parts) < 5 {
+			return ""
+		}
+		n, err := strconv.Atoi(parts[4])
+		if err == nil && n < 0 {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+		// Refuse an oversized value before reading it.
+		if err == nil && (int64(n) > h.maxValueLen() || h.cache.CheckSize(0, n) != nil) {
+			return "SERVER_ERROR object too large for cache\r\n"
+		}
+	}
+	return ""
+}
+
+// maxValueLen returns the largest data block accepted, the
+// --proto-max-bulk-len limit on RESP bulk strings.
+func (h *MemcacheHandler) maxValueLen() int64 {
+	if h.config.MaxBulkLen > 0 {
+		return h.config.MaxBulkLen
+	}
+	return DefaultMaxBulkLen
+}
+
+// discardData skips the data block that follows a storage command line
+// so the connection stays in sync when the command is not executed.
+func (h *MemcacheHandler) discardData(reader *bufio.Reader, cmd string, parts []string) {
+	switch cmd {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if len(parts) < 5 {
+			return
+		}
+		if n, err := strconv.Atoi(parts[4]); err == nil && n >= 0 {
+			reader.Discard(n + 2)
+		}
+	}
+}
+
 func (h *MemcacheHandler) handleGet(reader *bufio.Reader, writer *bufio.Writer, keys []string, withCAS bool) {
 	for _, key := range keys {
-		entry, found := h.cache.Load([]byte(key))
+		entry, found := readThrough(h.cache, h.config, TypeMemcache, []byte(key))
 		if !found {
 			continue
 		}
@@ -129,39 +289,38 @@ func (h *MemcacheHandler) handleGet(reader *bufio.Reader, writer *bufio.Writer,
 
 func (h *MemcacheHandler) handleStore(reader *bufio.Reader, writer *bufio.Writer, parts []string, addOnly, replaceOnly bool) {
 	if len(parts) < 5 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	key := parts[1]
 	flags, err := strconv.ParseUint(parts[2], 10, 32)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	exptime, err := strconv.ParseInt(parts[3], 10, 64)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	bytes, err := strconv.Atoi(parts[4])
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	noreply := len(parts) > 5 && parts[5] == "noreply"
 	
-	data := make([]byte, bytes)
-	_, err = io.ReadFull(reader, data)
+	data, err := readSized(reader, bytes)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		h.writeClientError(writer, "bad data chunk")
 		return
 	}
 	
-	reader.ReadString('\n')
+	readMemcacheLine(reader)
 	
 	existing, _ := h.cache.Load([]byte(key))
 	
@@ -191,7 +350,10 @@ func (h *MemcacheHandler) handleStore(reader *bufio.Reader, writer *bufio.Writer
 		}
 	}
 	
-	h.cache.Store([]byte(key), data, opts)
+	if err := h.cache.Store([]byte(key), data, opts); err != nil {
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
 	
 	if !noreply {
 		writer.WriteString("STORED\r\n")
@@ -200,45 +362,44 @@ func (h *MemcacheHandler) handleStore(reader *bufio.Reader, writer *bufio.Writer
 
 func (h *MemcacheHandler) handleCAS(reader *bufio.Reader, writer *bufio.Writer, parts []string) {
 	if len(parts) < 6 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	key := parts[1]
 	flags, err := strconv.ParseUint(parts[2], 10, 32)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	exptime, err := strconv.ParseInt(parts[3], 10, 64)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	bytes, err := strconv.Atoi(parts[4])
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	cas, err := strconv.ParseUint(parts[5], 10, 64)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	noreply := len(parts) > 6 && parts[6] == "noreply"
 	
-	data := make([]byte, bytes)
-	_, err = io.ReadFull(reader, data)
+	data, err := readSized(reader, bytes)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		h.writeClientError(writer, "bad data chunk")
 		return
 	}
 	
-	reader.ReadString('\n')
+	readMemcacheLine(reader)
 	
 	opts := &cache.StoreOptions{
 		Flags: uint32(flags),
@@ -274,27 +435,26 @@ func (h *MemcacheHandler) handleCAS(reader *bufio.Reader, writer *bufio.Writer,
 
 func (h *MemcacheHandler) handleAppend(reader *bufio.Reader, writer *bufio.Writer, parts []string, append bool) {
 	if len(parts) < 5 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	key := parts[1]
 	bytes, err := strconv.Atoi(parts[4])
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	noreply := len(parts) > 5 && parts[5] == "noreply"
 	
-	data := make([]byte, bytes)
-	_, err = io.ReadFull(reader, data)
+	data, err := readSized(reader, bytes)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		h.writeClientError(writer, "bad data chunk")
 		return
 	}
 	
-	reader.ReadString('\n')
+	readMemcacheLine(reader)
 	
 	entry, found := h.cache.Load([]byte(key))
 	if !found {
@@ -315,9 +475,13 @@ func (h *MemcacheHandler) handleAppend(reader *bufio.Reader, writer *bufio.Write
 		copy(newValue[len(data):], entry.Value())
 	}
 	
-	h.cache.Store([]byte(key), newValue, &cache.StoreOptions{
+	err = h.cache.Store([]byte(key), newValue, &cache.StoreOptions{
 		Flags: entry.Flags(),
 	})
+	if err != nil {
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
 	
 	if !noreply {
 		writer.WriteString("STORED\r\n")
@@ -326,7 +490,7 @@ func (h *MemcacheHandler) handleAppend(reader *bufio.Reader, writer *bufio.Write
 
 func (h *MemcacheHandler) handleDelete(writer *bufio.Writer, parts []string) {
 	if len(parts) < 2 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
@@ -346,12 +510,12 @@ func (h *MemcacheHandler) handleDelete(writer *bufio.Writer, parts []string) {
 
 func (h *MemcacheHandler) handleIncr(writer *bufio.Writer, parts []string, incr bool) {
 	if len(parts) < 3 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	key := parts[1]
-	delta, err := strconv.ParseInt(parts[2], 10, 64)
+	delta, err := strconv.ParseUint(parts[2], 10, 64)
 	if err != nil {
 		writer.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
 		return
@@ -359,23 +523,19 @@ func (h *MemcacheHandler) handleIncr(writer *bufio.Writer, parts []string, incr
 	
 	noreply := len(parts) > 3 && parts[3] == "noreply"
 	
-	if !incr {
-		delta = -delta
-	}
-	
-	newVal, err := h.cache.Increment([]byte(key), delta)
+	newVal, err := h.cache.IncrementUnsigned([]byte(key), delta, !incr)
 	if err != nil {
-		if !noreply {
+		if noreply {
+			return
+		}
+		if errors.Is(err, cache.ErrNotInteger) {
+			writer.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+		} else {
 			writer.WriteString("NOT_FOUND\r\n")
 		}
 		return
 	}
 	
-	if newVal < 0 {
-		newVal = 0
-		h.cache.Store([]byte(key), []byte(strconv.FormatInt(newVal, 10)), nil)
-	}
-	
 	if !noreply {
 		fmt.Fprintf(writer, "%d\r\n", newVal)
 	}
@@ -383,35 +543,33 @@ func (h *MemcacheHandler) handleIncr(writer *bufio.Writer, parts []string, incr
 
 func (h *MemcacheHandler) handleTouch(writer *bufio.Writer, parts []string) {
 	if len(parts) < 3 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	key := parts[1]
 	exptime, err := strconv.ParseInt(parts[2], 10, 64)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		h.writeClientError(writer, "bad command line format")
 		return
 	}
 	
 	noreply := len(parts) > 3 && parts[3] == "noreply"
 	
-	entry, found := h.cache.Load([]byte(key))
-	if !found {
-		if !noreply {
-			writer.WriteString("NOT_FOUND\r\n")
-		}
-		return
-	}
-	
+	var expireAt int64
 	if exptime > 0 {
 		if exptime < 2592000 {
-			entry.SetExpireAt(time.Now().Add(time.Duration(exptime) * time.Second).UnixNano())
+			expireAt = time.Now().Add(time.Duration(exptime) * time.Second).UnixNano()
 		} else {
-			entry.SetExpireAt(time.Unix(exptime, 0).UnixNano())
+			expireAt = time.Unix(exptime, 0).UnixNano()
 		}
-	} else {
-		entry.SetExpireAt(0)
+	}
+	
+	if !h.cache.Expire([]byte(key), expireAt) {
+		if !noreply {
+			writer.WriteString("NOT_FOUND\r\n")
+		}
+		return
 	}
 	
 	if !noreply {
@@ -422,13 +580,26 @@ func (h *MemcacheHandler) handleTouch(writer *bufio.Writer, parts []string) {
 func (h *MemcacheHandler) handleStats(writer *bufio.Writer) {
 	stats := h.cache.Stats()
 	
-	fmt.Fprintf(writer, "STAT curr_items %d\r\n", stats["num_items"])
-	fmt.Fprintf(writer, "STAT bytes %d\r\n", stats["mem_used"])
-	fmt.Fprintf(writer, "STAT limit_maxbytes %d\r\n", stats["max_memory"])
-	fmt.Fprintf(writer, "STAT cmd_get %d\r\n", stats["num_hits"].(uint64)+stats["num_misses"].(uint64))
-	fmt.Fprintf(writer, "STAT get_hits %d\r\n", stats["num_hits"])
-	fmt.Fprintf(writer, "STAT get_misses %d\r\n", stats["num_misses"])
-	fmt.Fprintf(writer, "STAT evictions %d\r\n", stats["num_evicted"])
-	fmt.Fprintf(writer, "STAT expired_unfetched %d\r\n", stats["num_expired"])
+	traffic := h.config.Traffic.Stats()[TypeMemcache.String()]
+	now := time.Now()
+	user, sys := cpuTime()
+	
+	fmt.Fprintf(writer, "STAT pid %d\r\n", os.Getpid())
+	fmt.Fprintf(writer, "STAT uptime %d\r\n", int64(h.config.uptime(now).Seconds()))
+	fmt.Fprintf(writer, "STAT time %d\r\n", now.Unix())
+	fmt.Fprintf(writer, "STAT version %s\r\n", h.config.version())
+	fmt.Fprintf(writer, "STAT pointer_size %d\r\n", 32<<(^uint(0)>>63))
+	fmt.Fprintf(writer, "STAT rusage_user %.6f\r\n", user.Seconds())
+	fmt.Fprintf(writer, "STAT rusage_system %.6f\r\n", sys.Seconds())
+	fmt.Fprintf(writer, "STAT curr_items %d\r\n", stats.Items)
+	fmt.Fprintf(writer, "STAT bytes %d\r\n", stats.MemUsed)
+	fmt.Fprintf(writer, "STAT limit_maxbytes %d\r\n", stats.MaxMemory)
+	fmt.Fprintf(writer, "STAT cmd_get %d\r\n", stats.Hits+stats.Misses)
+	fmt.Fprintf(writer, "STAT get_hits %d\r\n", stats.Hits)
+	fmt.Fprintf(writer, "STAT get_misses %d\r\n", stats.Misses)
+	fmt.Fprintf(writer, "STAT evictions %d\r\n", stats.Evicted)
+	fmt.Fprintf(writer, "STAT expired_unfetched %d\r\n", stats.Expired)
+	fmt.Fprintf(writer, "STAT bytes_read %d\r\n", traffic.BytesIn)
+	fmt.Fprintf(writer, "STAT bytes_written %d\r\n", traffic.BytesOut)
 	writer.WriteString("END\r\n")
 }
\ No newline at end of file
@@ -0,0 +1,299 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+// memcacheSession serves a MemcacheHandler over a pipe and returns a
+// function that sends one command, with its data block if any, and reads
+// back the reply: one line, or for retrievals each value and the line
+// after the last.
+func memcacheSession(t *testing.T, c *cache.Cache) func(cmd string) string {
+	t.Helper()
+
+	h := NewMemcacheHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+	client, server := net.Pipe()
+	go h.Handle(server)
+	t.Cleanup(func() { client.Close() })
+
+	reader := bufio.NewReader(client)
+	return func(cmd string) string {
+		t.Helper()
+
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.WriteString(client, cmd+"\r\n"); err != nil {
+			t.Fatalf("%q: %v", cmd, err)
+		}
+		var reply strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%q: %v", cmd, err)
+			}
+			reply.WriteString(line)
+			if !strings.HasPrefix(line, "VALUE ") {
+				return reply.String()
+			}
+			data, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%q: %v", cmd, err)
+			}
+			reply.WriteString(data)
+		}
+	}
+}
+
+// casOf returns the CAS token in the reply to gets for a single key.
+func casOf(t *testing.T, reply string) uint64 {
+	t.Helper()
+
+	header, _, _ := strings.Cut(reply, "\r\n")
+	fields := strings.Fields(header)
+	if len(fields) != 5 || fields[0] != "VALUE" {
+		t.Fatalf("gets reply = %q", reply)
+	}
+	cas, err := strconv.ParseUint(fields[4], 10, 64)
+	if err != nil {
+		t.Fatalf("gets reply = %q: %v", reply, err)
+	}
+	return cas
+}
+
+func TestMemcacheCASTokens(t *testing.T) {
+	do := memcacheSession(t, cache.New(4, 0))
+
+	do("set a 0 0 1\r\nx")
+	first := casOf(t, do("gets a"))
+	if first == 0 {
+		t.Fatal("gets after set returned CAS 0")
+	}
+
+	do("set b 0 0 1\r\ny")
+	second := casOf(t, do("gets b"))
+	do("set a 0 0 1\r\nz")
+	third := casOf(t, do("gets a"))
+	if !(first < second && second < third) {
+		t.Errorf("CAS tokens %d, %d, %d are not increasing", first, second, third)
+	}
+
+	if got := do("cas a 0 0 1 0\r\nw"); got != "EXISTS\r\n" {
+		t.Errorf("cas with token 0 = %q, want EXISTS", got)
+	}
+	if got := do("cas a 0 0 1 " + strconv.FormatUint(first, 10) + "\r\nw"); got != "EXISTS\r\n" {
+		t.Errorf("cas with stale token = %q, want EXISTS", got)
+	}
+	if got := do("cas a 0 0 1 " + strconv.FormatUint(third, 10) + "\r\nw"); got != "STORED\r\n" {
+		t.Errorf("cas with current token = %q, want STORED", got)
+	}
+	swapped := casOf(t, do("gets a"))
+	if swapped <= third {
+		t.Errorf("CAS after cas = %d, want more than %d", swapped, third)
+	}
+
+	do("set n 0 0 1\r\n5")
+	before := casOf(t, do("gets n"))
+	if got := do("incr n 1"); got != "6\r\n" {
+		t.Errorf("incr n 1 = %q", got)
+	}
+	if after := casOf(t, do("gets n")); after <= before {
+		t.Errorf("CAS after incr = %d, want more than %d", after, before)
+	}
+
+	if got := do("cas missing 0 0 1 1\r\nv"); got != "NOT_FOUND\r\n" {
+		t.Errorf("cas on a missing key = %q, want NOT_FOUND", got)
+	}
+}
+
+func TestMemcacheKeys(t *testing.T) {
+	c := cache.New(1, 0)
+	do := memcacheSession(t, c)
+
+	long := strings.Repeat("k", maxMemcacheKeyLen)
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"set café key 0 0 1\r\nv", "STORED\r\n"},
+		{"get café key", "VALUE café key 0 1\r\nv\r\nEND\r\n"},
+		{"set " + long + " 0 0 1\r\nv", "STORED\r\n"},
+		{"set " + long + "k 0 0 1\r\nv", "CLIENT_ERROR bad command line format\r\n"},
+		{"get " + long + "k", "CLIENT_ERROR bad command line format\r\n"},
+		{"set tab\tkey 0 0 1\r\nv", "CLIENT_ERROR bad command line format\r\n"},
+		{"delete bell\a", "CLIENT_ERROR bad command line format\r\n"},
+		{"get  café key  ", "VALUE café key 0 1\r\nv\r\nEND\r\n"},
+	}
+	for _, tt := range tests {
+		if got := do(tt.cmd); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	if _, found := c.Load([]byte("café key")); !found {
+		t.Error("key with a no-break space was split")
+	}
+}
+
+func TestMemcacheSizeLimits(t *testing.T) {
+	c := cache.New(1, 0)
+	c.SetSizeLimits(4, 8)
+	do := memcacheSession(t, c)
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"set keys 0 0 8\r\n12345678", "STORED\r\n"},
+		{"set key-5 0 0 1\r\nv", "CLIENT_ERROR bad command line format\r\n"},
+		{"set k 0 0 9\r\n123456789", "SERVER_ERROR object too large for cache\r\n"},
+		{"append keys 0 0 1\r\n9", "SERVER_ERROR object too large for cache\r\n"},
+		{"set k 0 0 -1", "CLIENT_ERROR bad command line format\r\n"},
+		{"get keys", "VALUE keys 0 8\r\n12345678\r\nEND\r\n"},
+	}
+	for _, tt := range tests {
+		if got := do(tt.cmd); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestMemcacheProtocolLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"data over max bulk len", "set k 0 0 1025\r\n", "SERVER_ERROR object too large for cache\r\n"},
+		{"huge data size", "set k 0 0 9223372036854775807\r\nget k\r\n", "SERVER_ERROR object too large for cache\r\nEND\r\n"},
+		{"short data", "set k 0 0 10\r\nabc", "CLIENT_ERROR bad data chunk\r\n"},
+		{"line too long", "get " + strings.Repeat("k", maxMemcacheLineLen) + "\r\nversion\r\n", "CLIENT_ERROR line too long\r\n"},
+	}
+
+	for _, tt := range tests {
+		h := NewMemcacheHandler(cache.New(1, 0), &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{}), MaxBulkLen: 1024})
+		var out strings.Builder
+		writer := bufio.NewWriter(&out)
+		h.serve(bufio.NewReader(strings.NewReader(tt.input)), writer, h.config.Limits.Open(nil))
+		writer.Flush()
+		if out.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+func TestMemcacheUDP(t *testing.T) {
+	c := cache.New(1, 0)
+	h := NewMemcacheHandler(c, &Config{})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go h.ServeUDP(pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// request sends cmd as request id and returns the reassembled reply.
+	request := func(id uint16, header []byte, cmd string) string {
+		t.Helper()
+
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		datagram := binary.BigEndian.AppendUint16(nil, id)
+		datagram = append(datagram, header...)
+		if _, err := conn.Write(append(datagram, cmd...)); err != nil {
+			t.Fatal(err)
+		}
+		var parts []string
+		buf := make([]byte, 2048)
+		for total := 1; len(parts) < total; {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("%q: %v", cmd, err)
+			}
+			if n < 8 || binary.BigEndian.Uint16(buf) != id {
+				t.Fatalf("%q: bad datagram %q", cmd, buf[:n])
+			}
+			if seq := int(binary.BigEndian.Uint16(buf[2:])); seq != len(parts) {
+				t.Fatalf("%q: datagram %d arrived as %d", cmd, seq, len(parts))
+			}
+			total = int(binary.BigEndian.Uint16(buf[4:]))
+			parts = append(parts, string(buf[8:n]))
+		}
+		return strings.Join(parts, "")
+	}
+	single := []byte{0, 0, 0, 1, 0, 0}
+
+	c.Store([]byte("k"), []byte("hello"), nil)
+	if got := request(1, single, "get k\r\ngets missing\r\n"); got != "VALUE k 0 5\r\nhello\r\nEND\r\nEND\r\n" {
+		t.Errorf("get and gets = %q", got)
+	}
+
+	// Only retrievals are served, so that a spoofed datagram cannot
+	// change the cache.
+	if got := request(2, single, "get k\r\nset k 0 0 1\r\nx\r\n"); got != "CLIENT_ERROR only get and gets are served over UDP\r\n" {
+		t.Errorf("set = %q", got)
+	}
+	if entry, _ := c.Load([]byte("k")); entry == nil || string(entry.Value()) != "hello" {
+		t.Error("set over UDP changed the cache")
+	}
+
+	big := strings.Repeat("x", 5000)
+	c.Store([]byte("big"), []byte(big), nil)
+	if got := request(3, single, "get big\r\n"); got != "VALUE big 0 5000\r\n"+big+"\r\nEND\r\n" {
+		t.Errorf("Reassembled reply has %d bytes", len(got))
+	}
+
+	// A reply is at most a few datagrams.
+	if got := request(5, single, "get big big big\r\n"); got != "SERVER_ERROR object too large for UDP\r\n" {
+		t.Errorf("Reply over %d datagrams has %d bytes", memcacheUDPMaxDatagrams, len(got))
+	}
+
+	if got := request(4, []byte{0, 0, 0, 2, 0, 0}, "get k\r\n"); !strings.HasPrefix(got, "SERVER_ERROR") {
+		t.Errorf("Multi-datagram request answered %q", got)
+	}
+}
+
+func TestMemcacheUDPRateLimit(t *testing.T) {
+	h := NewMemcacheHandler(cache.New(1, 0), &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{IPCommands: 2})})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go h.ServeUDP(pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A burst from one address is answered up to the per-IP limit and
+	// then dropped.
+	buf := make([]byte, 2048)
+	for id := uint16(0); id < 3; id++ {
+		datagram := binary.BigEndian.AppendUint16(nil, id)
+		datagram = append(datagram, 0, 0, 0, 1, 0, 0)
+		if _, err := conn.Write(append(datagram, "get k\r\n"...)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if answered := err == nil; answered != (id < 2) {
+			t.Errorf("Request %d answered = %v (%q)", id, answered, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	// memcacheUDPHeaderLen is the size of the frame header before each
+	// memcached UDP datagram: request ID, sequence number, datagram
+	// count and a reserved field, 16 bits each.
+	memcacheUDPHeaderLen = 8
+	// memcacheUDPMaxPayload bounds reply datagrams, header included, as
+	// memcached does, to stay below the usual MTU.
+	memcacheUDPMaxPayload = 1400
+	// memcacheUDPMaxDatagrams bounds the datagrams of one reply. Replies
+	// go to whatever source address a request claims, so a small request
+	// must not draw a large reply.
+	memcacheUDPMaxDatagrams = 8
+)
+
+// ServeUDP serves memcached get and gets commands over UDP until pc is
+// closed. Each request must fit in one datagram; replies longer than a
+// datagram are split across up to memcacheUDPMaxDatagrams carrying the
+// request's ID and their sequence number, for the client to reassemble.
+func (h *MemcacheHandler) ServeUDP(pc net.PacketConn) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		h.handleDatagram(pc, addr, buf[:n])
+	}
+}
+
+// handleDatagram runs the commands in one request datagram and sends the
+// replies back to addr. A datagram over the rate limits of its source is
+// dropped unanswered, so that requests with a spoofed source cannot make
+// gopogo send more than the limits allow.
+func (h *MemcacheHandler) handleDatagram(pc net.PacketConn, addr net.Addr, data []byte) {
+	if len(data) < memcacheUDPHeaderLen {
+		return
+	}
+	if !h.config.Limits.Packet(addr).AllowPacket(len(data)) {
+		h.traffic.packet(len(data), 0)
+		return
+	}
+	requestID := binary.BigEndian.Uint16(data[0:2])
+	
+	var out bytes.Buffer
+	switch {
+	case binary.BigEndian.Uint16(data[4:6]) != 1:
+		h.config.Errors.count(TypeMemcache, errorParse)
+		out.WriteString("SERVER_ERROR multi-packet request not supported\r\n")
+	case !onlyRetrievals(data[memcacheUDPHeaderLen:]):
+		h.config.Errors.count(TypeMemcache, errorParse)
+		out.WriteString("CLIENT_ERROR only get and gets are served over UDP\r\n")
+	default:
+		writer := bufio.NewWriter(&out)
+		h.serve(bufio.NewReader(bytes.NewReader(data[memcacheUDPHeaderLen:])), writer, nil)
+		writer.Flush()
+	}
+	
+	reply := out.Bytes()
+	defer func() { h.traffic.packet(len(data), len(reply)) }()
+	chunk := memcacheUDPMaxPayload - memcacheUDPHeaderLen
+	total := (len(reply) + chunk - 1) / chunk
+	if total > memcacheUDPMaxDatagrams {
+		total = 1
+		reply = []byte("SERVER_ERROR object too large for UDP\r\n")
+	}
+	datagram := make([]byte, 0, memcacheUDPMaxPayload)
+	for seq := 0; seq < total; seq++ {
+		part := reply[seq*chunk : min((seq+1)*chunk, len(reply))]
+		datagram = binary.BigEndian.AppendUint16(datagram[:0], requestID)
+		datagram = binary.BigEndian.AppendUint16(datagram, uint16(seq))
+		datagram = binary.BigEndian.AppendUint16(datagram, uint16(total))
+		datagram = binary.BigEndian.AppendUint16(datagram, 0)
+		if _, err := pc.WriteTo(append(datagram, part...), addr); err != nil {
+			return
+		}
+	}
+}
+
+// onlyRetrievals reports whether every command in a request is get or
+// gets. Since neither takes a data block, every line is a command.
+func onlyRetrievals(request []byte) bool {
+	for _, line := range strings.Split(string(request), "\n") {
+		cmd, _, _ := strings.Cut(strings.TrimLeft(strings.TrimRight(line, "\r"), " "), " ")
+		switch strings.ToLower(cmd) {
+		case "", "get", "gets":
+		default:
+			return false
+		}
+	}
+	return true
+}
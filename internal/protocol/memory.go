@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// bigKeyReportSize is how many of the largest keys the memory reports
+// list by default.
+const bigKeyReportSize = 10
+
+// memoryDoctor renders a size report as the human-readable text of
+// MEMORY DOCTOR, flagging keys large enough to force out many others.
+func memoryDoctor(report *cache.SizeReport) string {
+	var b strings.Builder
+	
+	if report.Keys == 0 {
+		b.WriteString("The keyspace is empty, there is nothing to report.\n")
+		return b.String()
+	}
+	
+	fmt.Fprintf(&b, "%d keys use %s, %s on average.\n\n",
+		report.Keys, formatBytes(report.Bytes), formatBytes(report.Bytes/int64(report.Keys)))
+	
+	b.WriteString("Size distribution:\n")
+	low := int64(0)
+	for _, bucket := range report.Histogram {
+		if bucket.Keys > 0 {
+			var label string
+			if bucket.Max < 0 {
+				label = "> " + formatBytes(low)
+			} else {
+				label = formatBytes(low) + " - " + formatBytes(bucket.Max)
+			}
+			fmt.Fprintf(&b, "  %-20s %10d keys %12s\n", label, bucket.Keys, formatBytes(bucket.Bytes))
+		}
+		low = bucket.Max
+	}
+	
+	if len(report.Largest) > 0 {
+		b.WriteString("\nLargest keys:\n")
+		for _, key := range report.Largest {
+			fmt.Fprintf(&b, "  %12s  shard %-3d %q\n", formatBytes(key.Size), key.Shard, key.Key)
+		}
+	}
+	
+	// A key taking a quarter of its shard's budget evicts most of the
+	// shard whenever it is written.
+	if limit := report.ShardMaxMemory / 4; limit > 0 {
+		var big []string
+		for _, key := range report.Largest {
+			if key.Size > limit {
+				big = append(big, fmt.Sprintf("%q", key.Key))
+			}
+		}
+		if len(big) > 0 {
+			fmt.Fprintf(&b, "\nWarning: keys using more than a quarter of their shard's %s memory limit "+
+				"evict many smaller keys when stored: %s\n", formatBytes(report.ShardMaxMemory), strings.Join(big, ", "))
+		}
+	}
+	
+	return b.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,228 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/grumpylabs/gopogo/internal/jsonpath"
+)
+
+// Response formats the HTTP stats and /keys endpoints can answer in,
+// chosen by the request's Accept header.
+const (
+	formatJSON = iota
+	formatMsgpack
+	formatProtobuf
+)
+
+// contentTypes maps the media types accepted for each format.
+var contentTypes = map[string]int{
+	"application/json":                formatJSON,
+	"application/msgpack":             formatMsgpack,
+	"application/x-msgpack":           formatMsgpack,
+	"application/vnd.msgpack":         formatMsgpack,
+	"application/protobuf":            formatProtobuf,
+	"application/x-protobuf":          formatProtobuf,
+	"application/vnd.google.protobuf": formatProtobuf,
+}
+
+// protobufContentType names the message protobuf responses hold, the
+// well-known google.protobuf.Value from struct.proto.
+const protobufContentType = "application/x-protobuf; messageType=google.protobuf.Value"
+
+// negotiateFormat returns the format an Accept header prefers, by quality
+// and then by order. JSON is the default for a missing header, a
+// wildcard or only unsupported types.
+func negotiateFormat(accept string) int {
+	format, best := formatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		f, ok := contentTypes[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > best {
+			format, best = f, q
+		}
+	}
+	return format
+}
+
+// writeData writes a JSON response body in the format the request
+// accepts, converting it to MessagePack or protobuf if asked to.
+func (h *HTTPHandler) writeData(w http.ResponseWriter, req *http.Request, status int, body []byte) {
+	w.Header().Add("Vary", "Accept")
+	format := negotiateFormat(req.Header.Get("Accept"))
+	if format == formatJSON {
+		h.writeJSON(w, status, body)
+		return
+	}
+
+	v, err := jsonpath.Decode(body)
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	contentType := "application/msgpack"
+	if format == formatMsgpack {
+		body = appendMsgpack(nil, v)
+	} else {
+		body = appendProtoValue(nil, v)
+		contentType = protobufContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// appendMsgpack appends the MessagePack encoding of a decoded JSON value.
+// Integers use the smallest encoding that holds them; other numbers are
+// float64.
+func appendMsgpack(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return appendMsgpackInt(b, n)
+		}
+		if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			b = append(b, 0xcf)
+			return binary.BigEndian.AppendUint64(b, n)
+		}
+		f, _ := v.Float64()
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(f))
+	case string:
+		b = appendMsgpackHeader(b, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		return append(b, v...)
+	case []any:
+		b = appendMsgpackHeader(b, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, elem := range v {
+			b = appendMsgpack(b, elem)
+		}
+		return b
+	case *jsonpath.Object:
+		keys := v.Keys()
+		b = appendMsgpackHeader(b, len(keys), 0x80, 16, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			elem, _ := v.Get(key)
+			b = appendMsgpack(b, key)
+			b = appendMsgpack(b, elem)
+		}
+		return b
+	}
+	panic("appendMsgpack: unexpected value")
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n < 128:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+// appendMsgpackHeader appends the header of a string, array or map of n
+// elements: fix|n below fixLimit, or else the type byte of the smallest
+// sized form followed by n. Arrays and maps have no 8-bit form and pass
+// c8 = 0.
+func appendMsgpackHeader(b []byte, n int, fix byte, fixLimit int, c8, c16, c32 byte) []byte {
+	switch {
+	case n < fixLimit:
+		return append(b, fix|byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		return append(b, c8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, c16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, c32), uint32(n))
+}
+
+// appendProtoValue appends the protobuf encoding of a decoded JSON value
+// as a google.protobuf.Value message. As in the protobuf JSON mapping,
+// every number is a double.
+func appendProtoValue(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		// null_value = 1, NULL_VALUE = 0.
+		return append(b, 1<<3|0, 0)
+	case bool:
+		// bool_value = 4.
+		b = append(b, 4<<3|0)
+		if v {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	case json.Number:
+		// number_value = 2.
+		f, _ := v.Float64()
+		b = append(b, 2<<3|1)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+	case string:
+		// string_value = 3.
+		return appendProtoBytes(b, 3, []byte(v))
+	case []any:
+		// list_value = 6, a ListValue of repeated Value values = 1.
+		var list []byte
+		for _, elem := range v {
+			list = appendProtoBytes(list, 1, appendProtoValue(nil, elem))
+		}
+		return appendProtoBytes(b, 6, list)
+	case *jsonpath.Object:
+		// struct_value = 5, a Struct of map<string, Value> fields = 1,
+		// each entry a message of key = 1 and value = 2.
+		var fields []byte
+		for _, key := range v.Keys() {
+			elem, _ := v.Get(key)
+			entry := appendProtoBytes(nil, 1, []byte(key))
+			entry = appendProtoBytes(entry, 2, appendProtoValue(nil, elem))
+			fields = appendProtoBytes(fields, 1, entry)
+		}
+		return appendProtoBytes(b, 5, fields)
+	}
+	panic("appendProtoValue: unexpected value")
+}
+
+// appendProtoBytes appends a length-delimited field.
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/jsonpath"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   int
+	}{
+		{"", formatJSON},
+		{"*/*", formatJSON},
+		{"text/html", formatJSON},
+		{"application/msgpack", formatMsgpack},
+		{"application/x-protobuf", formatProtobuf},
+		{"application/json, application/msgpack", formatJSON},
+		{"application/json;q=0.5, application/x-msgpack", formatMsgpack},
+		{"application/protobuf;q=0.9, application/msgpack;q=0.8", formatProtobuf},
+		{"application/msgpack;q=0", formatJSON},
+	}
+	for _, tt := range tests {
+		if got := negotiateFormat(tt.accept); got != tt.want {
+			t.Errorf("negotiateFormat(%q) = %d, want %d", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	tests := []struct {
+		json string
+		want []byte
+	}{
+		{`null`, []byte{0xc0}},
+		{`true`, []byte{0xc3}},
+		{`5`, []byte{0x05}},
+		{`-1`, []byte{0xff}},
+		{`-100`, []byte{0xd0, 0x9c}},
+		{`200`, []byte{0xcc, 0xc8}},
+		{`70000`, []byte{0xce, 0x00, 0x01, 0x11, 0x70}},
+		{`18446744073709551615`, []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{`1.5`, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{`"ab"`, []byte{0xa2, 'a', 'b'}},
+		{`[1,"x"]`, []byte{0x92, 0x01, 0xa1, 'x'}},
+		{`{"b":1,"a":[]}`, []byte{0x82, 0xa1, 'b', 0x01, 0xa1, 'a', 0x90}},
+		{`"` + strings.Repeat("s", 40) + `"`, append([]byte{0xd9, 40}, strings.Repeat("s", 40)...)},
+	}
+	for _, tt := range tests {
+		v, err := jsonpath.Decode([]byte(tt.json))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := appendMsgpack(nil, v); !bytes.Equal(got, tt.want) {
+			t.Errorf("msgpack %s = % x, want % x", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeProtobuf(t *testing.T) {
+	tests := []struct {
+		json string
+		want []byte
+	}{
+		{`null`, []byte{0x08, 0x00}},
+		{`true`, []byte{0x20, 0x01}},
+		{`1.5`, []byte{0x11, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{`"ab"`, []byte{0x1a, 0x02, 'a', 'b'}},
+		// ListValue{values: [Value{bool_value: false}]}
+		{`[false]`, []byte{0x32, 0x04, 0x0a, 0x02, 0x20, 0x00}},
+		// Struct{fields: {"k": Value{null_value}}}
+		{`{"k":null}`, []byte{0x2a, 0x09, 0x0a, 0x07, 0x0a, 0x01, 'k', 0x12, 0x02, 0x08, 0x00}},
+	}
+	for _, tt := range tests {
+		v, err := jsonpath.Decode([]byte(tt.json))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := appendProtoValue(nil, v); !bytes.Equal(got, tt.want) {
+			t.Errorf("protobuf %s = % x, want % x", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPContentNegotiation(t *testing.T) {
+	c := cache.New(1, 0)
+	c.Store([]byte("k"), []byte("v"), nil)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/keys", "application/msgpack"); rec.Header().Get("Content-Type") != "application/msgpack" || !bytes.Equal(rec.Body.Bytes(), []byte{0x91, 0xa1, 'k'}) {
+		t.Errorf("GET /keys as msgpack = %q % x", rec.Header().Get("Content-Type"), rec.Body.Bytes())
+	}
+	if rec := get("/keys", "application/x-protobuf"); rec.Header().Get("Content-Type") != protobufContentType || !bytes.Equal(rec.Body.Bytes(), []byte{0x32, 0x05, 0x0a, 0x03, 0x1a, 0x01, 'k'}) {
+		t.Errorf("GET /keys as protobuf = %q % x", rec.Header().Get("Content-Type"), rec.Body.Bytes())
+	}
+	if rec := get("/keys", ""); rec.Header().Get("Content-Type") != "application/json" || rec.Body.String() != `["k"]` {
+		t.Errorf("GET /keys = %q %q", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	if rec := get("/stats", "application/msgpack"); rec.Code != http.StatusOK || rec.Body.Len() == 0 || rec.Body.Bytes()[0]&0xf0 != 0x80 && rec.Body.Bytes()[0] != 0xde {
+		t.Errorf("GET /stats as msgpack = %d % x", rec.Code, rec.Body.Bytes())
+	}
+}
@@ -2,38 +2,57 @@ package protocol
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"net"
+	"slices"
+	"strconv"
 	"strings"
-
+	"time"
+	
 	"github.com/grumpylabs/gopogo/internal/cache"
 )
 
 type PostgresHandler struct {
-	cache *cache.Cache
-	auth  string
+	cache   Keyspace
+	config  *Config
+	traffic *trafficCounters
 }
 
-func NewPostgresHandler(cache *cache.Cache, auth string) *PostgresHandler {
+func NewPostgresHandler(cache *cache.Cache, config *Config) *PostgresHandler {
 	return &PostgresHandler{
-		cache: cache,
-		auth:  auth,
+		cache:   keyspace(cache, config, TypePostgres),
+		config:  config,
+		traffic: config.Traffic.of(TypePostgres.String()),
 	}
 }
 
 func (h *PostgresHandler) Handle(conn net.Conn) {
 	defer conn.Close()
 	
-	if err := h.handleStartup(conn); err != nil {
+	conn, err := h.handleStartup(h.traffic.wrap(conn))
+	if err != nil {
 		return
 	}
+	defer conn.Close()
+	
+	limiter := h.config.Limits.Open(conn.RemoteAddr())
+	defer limiter.Close()
 	
-	authenticated := h.auth == ""
+	reader := limiter.Reader(conn)
+	authenticated := len(h.config.Auth) == 0
+	session := newPgSession()
+	defer session.closePortals()
 	
 	for {
-		msgType, data, err := h.readMessage(conn)
+		msgType, data, err := h.readMessage(reader)
+		if err == errPgMessageLength {
+			h.sendErrorResponse(conn, "08P01", "invalid message length")
+		}
 		if err != nil {
 			return
 		}
@@ -46,78 +65,258 @@ func (h *PostgresHandler) Handle(conn net.Conn) {
 		switch msgType {
 		case 'p':
 			password := string(bytes.TrimRight(data, "\x00"))
-			if password == h.auth {
+			if h.config.checkAuth(password) {
 				authenticated = true
 				h.sendAuthenticationOk(conn)
-				h.sendReadyForQuery(conn)
+				h.sendReadyForQuery(conn, session.status())
 			} else {
 				h.sendErrorResponse(conn, "28P01", "authentication failed")
 			}
-			
+		
 		case 'Q':
+			h.traffic.command()
+			if !limiter.AllowCommand() {
+				h.sendErrorResponse(conn, "53400", "rate limit exceeded")
+				h.sendReadyForQuery(conn, session.status())
+				continue
+			}
 			query := string(bytes.TrimRight(data, "\x00"))
-			h.handleQuery(conn, query)
-			
+			if opts, ok := parseCopy(strings.TrimSpace(strings.ToUpper(query))); ok {
+				if err := h.handleCopy(conn, reader, session, opts); err != nil {
+					return
+				}
+				h.sendReadyForQuery(conn, session.status())
+				continue
+			}
+			h.handleQuery(conn, session, query)
+		
+		case 'P', 'B', 'D', 'E', 'C', 'H':
+			if session.failed {
+				continue
+			}
+			var err *pgError
+			if msgType == 'E' {
+				h.traffic.command()
+			}
+			if msgType == 'E' && !limiter.AllowCommand() {
+				err = &pgError{"53400", "rate limit exceeded"}
+			} else {
+				err = h.handleExtended(conn, session, msgType, data)
+			}
+			if err != nil {
+				h.sendErrorResponse(conn, err.code, err.message)
+				session.fail()
+			}
+		
+		case 'S':
+			session.sync()
+			h.sendReadyForQuery(conn, session.status())
+		
 		case 'X':
 			return
-			
+		
 		default:
 			h.sendErrorResponse(conn, "08P01", "unsupported message type")
 		}
 	}
 }
 
-func (h *PostgresHandler) handleStartup(conn net.Conn) error {
-	buf := make([]byte, 8)
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		return err
-	}
-	
-	length := binary.BigEndian.Uint32(buf[:4])
-	version := binary.BigEndian.Uint32(buf[4:])
-	
-	if version != 196608 {
-		return fmt.Errorf("unsupported protocol version: %d", version)
-	}
-	
-	params := make([]byte, length-8)
-	if _, err := io.ReadFull(conn, params); err != nil {
-		return err
+var (
+	errTLSRequired     = errors.New("TLS is required")
+	errPgMessageLength = errors.New("invalid message length")
+)
+
+// postgresMaxStartupLen is the longest startup message accepted, the
+// limit PostgreSQL itself sets.
+const postgresMaxStartupLen = 10000
+
+const (
+	postgresProtocolVersion = 196608
+	postgresSSLRequest      = 80877103
+	postgresGSSEncRequest   = 80877104
+	postgresCancelRequest   = 80877102
+)
+
+// handleStartup reads the startup message, first answering any SSLRequest
+// or GSSENCRequest. It returns the connection to use from then on, which
+// is a TLS connection if the client upgraded.
+func (h *PostgresHandler) handleStartup(conn net.Conn) (net.Conn, error) {
+	if timeout := h.config.HandshakeTimeout; timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
 	}
 	
-	if h.auth != "" {
-		h.sendAuthenticationCleartextPassword(conn)
-	} else {
-		h.sendAuthenticationOk(conn)
-		h.sendReadyForQuery(conn)
+	for {
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		
+		length := binary.BigEndian.Uint32(buf[:4])
+		version := binary.BigEndian.Uint32(buf[4:])
+		if length < 8 || length > postgresMaxStartupLen {
+			return nil, errPgMessageLength
+		}
+		// The requests before the startup message have no body, so the
+		// TLS handshake cannot start in the middle of one.
+		if (version == postgresSSLRequest || version == postgresGSSEncRequest) && length != 8 {
+			return nil, errPgMessageLength
+		}
+		
+		switch version {
+		case postgresSSLRequest:
+			if h.config.TLS == nil || isTLS(conn) {
+				if _, err := conn.Write([]byte{'N'}); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			
+			if _, err := conn.Write([]byte{'S'}); err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Server(conn, h.config.TLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, err
+			}
+			conn = tlsConn
+			continue
+		
+		case postgresGSSEncRequest:
+			if _, err := conn.Write([]byte{'N'}); err != nil {
+				return nil, err
+			}
+			continue
+		
+		case postgresCancelRequest:
+			// Queries complete synchronously, so there is never one to
+			// cancel. The server closes the connection without a reply,
+			// as PostgreSQL does.
+			return nil, io.EOF
+		
+		case postgresProtocolVersion:
+		
+		default:
+			return nil, fmt.Errorf("unsupported protocol version: %d", version)
+		}
+		
+		if _, err := io.CopyN(io.Discard, conn, int64(length-8)); err != nil {
+			return nil, err
+		}
+		if !isTLS(conn) && h.config.RequireTLS != nil && h.config.RequireTLS(conn) {
+			Refuse(conn, TypePostgres, "TLS is required")
+			return nil, errTLSRequired
+		}
+		conn.SetDeadline(time.Time{})
+		
+		if len(h.config.Auth) > 0 {
+			h.sendAuthenticationCleartextPassword(conn)
+		} else {
+			h.sendAuthenticationOk(conn)
+			h.sendReadyForQuery(conn, 'I')
+		}
+		
+		return conn, nil
 	}
-	
-	return nil
 }
 
-func (h *PostgresHandler) handleQuery(conn net.Conn, query string) {
+// pgError is an error reported to the client with its SQLSTATE.
+type pgError struct {
+	code    string
+	message string
+}
+
+func (e *pgError) Error() string {
+	return e.message
+}
+
+// pgResult is the outcome of a statement. A statement that returns rows
+// has columns, and rows yields them; a SELECT tag is completed with the
+// number of rows sent.
+type pgResult struct {
+	columns []string
+	rows    iter.Seq[[][]byte]
+	tag     string
+	err     *pgError
+}
+
+func pgFailure(code, message string) *pgResult {
+	return &pgResult{err: &pgError{code, message}}
+}
+
+func (h *PostgresHandler) handleQuery(conn net.Conn, s *pgSession, query string) {
+	h.sendResult(conn, h.run(s, query, nil), nil)
+	h.sendReadyForQuery(conn, s.status())
+}
+
+// execute runs a statement whose $n placeholders refer to params, which
+// is nil for a simple query, in tx if it is not nil.
+func (h *PostgresHandler) execute(query string, params [][]byte, tx *pgTransaction) *pgResult {
+	if result, ok := h.catalogQuery(bindText(query, params)); ok {
+		return result
+	}
+	
 	query = strings.TrimSpace(strings.ToUpper(query))
 	
 	if strings.HasPrefix(query, "SELECT ") {
-		h.handleSelect(conn, query)
+		return h.handleSelect(query, params, tx)
 	} else if strings.HasPrefix(query, "INSERT ") {
-		h.handleInsert(conn, query)
+		return h.handleInsert(query, params, tx)
 	} else if strings.HasPrefix(query, "UPDATE ") {
-		h.handleUpdate(conn, query)
+		return h.handleUpdate(query, params, tx)
 	} else if strings.HasPrefix(query, "DELETE ") {
-		h.handleDelete(conn, query)
-	} else {
-		h.sendErrorResponse(conn, "42601", "syntax error")
+		return h.handleDelete(query, params, tx)
+	}
+	return pgFailure("42601", "syntax error")
+}
+
+// sendResult sends a RowDescription, if the statement returns rows, then
+// the rows and the CommandComplete, or the error.
+func (h *PostgresHandler) sendResult(conn net.Conn, result *pgResult, formats []int16) {
+	if result.err != nil {
+		h.sendErrorResponse(conn, result.err.code, result.err.message)
+		return
+	}
+	
+	tag := result.tag
+	if result.columns != nil {
+		h.sendRowDescription(conn, result.columns, formats)
+		count := 0
+		for row := range result.rows {
+			h.sendDataRow(conn, row)
+			count++
+		}
+		if tag == "SELECT" {
+			tag = fmt.Sprintf("SELECT %d", count)
+		}
+	}
+	h.sendCommandComplete(conn, tag)
+}
+
+// bindArg returns the value of a key or value argument: the parameter a
+// $n placeholder refers to, or the argument without quotes.
+func bindArg(arg string, params [][]byte) (string, *pgError) {
+	arg = strings.TrimSpace(arg)
+	if len(arg) < 2 || arg[0] != '$' {
+		return strings.Trim(arg, "'\""), nil
 	}
 	
-	h.sendReadyForQuery(conn)
+	n, err := strconv.Atoi(arg[1:])
+	if err != nil {
+		return strings.Trim(arg, "'\""), nil
+	}
+	if n < 1 || n > len(params) {
+		return "", &pgError{"42P02", fmt.Sprintf("there is no parameter $%d", n)}
+	}
+	if params[n-1] == nil {
+		return "", &pgError{"23502", "null value violates not-null constraint"}
+	}
+	return string(params[n-1]), nil
 }
 
-func (h *PostgresHandler) handleSelect(conn net.Conn, query string) {
+func (h *PostgresHandler) handleSelect(query string, params [][]byte, tx *pgTransaction) *pgResult {
 	parts := strings.Fields(query)
 	if len(parts) < 4 || parts[2] != "FROM" {
-		h.sendErrorResponse(conn, "42601", "syntax error")
-		return
+		return pgFailure("42601", "syntax error")
 	}
 	
 	table := parts[3]
@@ -132,48 +331,44 @@ func (h *PostgresHandler) handleSelect(conn net.Conn, query string) {
 	}
 	
 	if whereIdx > 0 && whereIdx+3 < len(parts) && parts[whereIdx+2] == "=" {
-		key = strings.Trim(parts[whereIdx+3], "'\"")
+		var err *pgError
+		if key, err = bindArg(parts[whereIdx+3], params); err != nil {
+			return &pgResult{err: err}
+		}
 	}
 	
+	result := &pgResult{columns: []string{"key", "value"}, tag: "SELECT"}
 	if key == "" {
-		h.sendRowDescription(conn, []string{"key", "value"})
-		
-		count := 0
-		h.cache.Iterate(func(entry *cache.Entry) bool {
-			if strings.HasPrefix(string(entry.Key()), table+":") {
-				h.sendDataRow(conn, [][]byte{
-					entry.Key(),
-					entry.Value(),
-				})
-				count++
-			}
-			return true
-		})
-		
-		h.sendCommandComplete(conn, fmt.Sprintf("SELECT %d", count))
+		result.rows = func(yield func([][]byte) bool) {
+			tx.iterate(h.cache, table+":", func(key, value []byte) bool {
+				return yield([][]byte{key, pgText(value)})
+			})
+		}
 	} else {
 		fullKey := table + ":" + key
-		entry, found := h.cache.Load([]byte(fullKey))
+		value, _, found := tx.load(h.cache, []byte(fullKey))
 		
+		var rows [][][]byte
 		if found {
-			h.sendRowDescription(conn, []string{"key", "value"})
-			h.sendDataRow(conn, [][]byte{
-				[]byte(key),
-				entry.Value(),
-			})
-			h.sendCommandComplete(conn, "SELECT 1")
-		} else {
-			h.sendRowDescription(conn, []string{"key", "value"})
-			h.sendCommandComplete(conn, "SELECT 0")
+			rows = append(rows, [][]byte{[]byte(key), pgText(value)})
 		}
+		result.rows = slices.Values(rows)
+	}
+	return result
+}
+
+// pgText returns value as a non-NULL column value.
+func pgText(value []byte) []byte {
+	if value == nil {
+		return []byte{}
 	}
+	return value
 }
 
-func (h *PostgresHandler) handleInsert(conn net.Conn, query string) {
+func (h *PostgresHandler) handleInsert(query string, params [][]byte, tx *pgTransaction) *pgResult {
 	parts := strings.Fields(query)
 	if len(parts) < 5 || parts[1] != "INTO" {
-		h.sendErrorResponse(conn, "42601", "syntax error")
-		return
+		return pgFailure("42601", "syntax error")
 	}
 	
 	table := parts[2]
@@ -187,8 +382,7 @@ func (h *PostgresHandler) handleInsert(conn net.Conn, query string) {
 	}
 	
 	if valuesIdx < 0 || valuesIdx+1 >= len(parts) {
-		h.sendErrorResponse(conn, "42601", "syntax error")
-		return
+		return pgFailure("42601", "syntax error")
 	}
 	
 	values := strings.Join(parts[valuesIdx+1:], " ")
@@ -196,24 +390,31 @@ func (h *PostgresHandler) handleInsert(conn net.Conn, query string) {
 	valueParts := strings.Split(values, ",")
 	
 	if len(valueParts) < 2 {
-		h.sendErrorResponse(conn, "42601", "syntax error")
-		return
+		return pgFailure("42601", "syntax error")
 	}
 	
-	key := strings.TrimSpace(strings.Trim(valueParts[0], "'\""))
-	value := strings.TrimSpace(strings.Trim(valueParts[1], "'\""))
+	key, err := bindArg(valueParts[0], params)
+	if err != nil {
+		return &pgResult{err: err}
+	}
+	value, err := bindArg(valueParts[1], params)
+	if err != nil {
+		return &pgResult{err: err}
+	}
 	
 	fullKey := table + ":" + key
-	h.cache.Store([]byte(fullKey), []byte(value), nil)
+	if err := tx.store(h.cache, []byte(fullKey), []byte(value), nil); err != nil {
+		// 54000 is program_limit_exceeded.
+		return pgFailure("54000", err.Error())
+	}
 	
-	h.sendCommandComplete(conn, "INSERT 0 1")
+	return &pgResult{tag: "INSERT 0 1"}
 }
 
-func (h *PostgresHandler) handleUpdate(conn net.Conn, query string) {
+func (h *PostgresHandler) handleUpdate(query string, params [][]byte, tx *pgTransaction) *pgResult {
 	parts := strings.Fields(query)
 	if len(parts) < 6 || parts[2] != "SET" {
-		h.sendErrorResponse(conn, "42601", "syntax error")
-		return
+		return pgFailure("42601", "syntax error")
 	}
 	
 	table := parts[1]
@@ -227,39 +428,44 @@ func (h *PostgresHandler) handleUpdate(conn net.Conn, query string) {
 	}
 	
 	if whereIdx < 0 || whereIdx+3 >= len(parts) {
-		h.sendErrorResponse(conn, "42601", "syntax error")
-		return
+		return pgFailure("42601", "syntax error")
 	}
 	
-	key := strings.Trim(parts[whereIdx+3], "'\"")
+	key, pgErr := bindArg(parts[whereIdx+3], params)
+	if pgErr != nil {
+		return &pgResult{err: pgErr}
+	}
 	setValue := strings.Join(parts[3:whereIdx], " ")
 	valueParts := strings.Split(setValue, "=")
 	
 	if len(valueParts) < 2 {
-		h.sendErrorResponse(conn, "42601", "syntax error")
-		return
+		return pgFailure("42601", "syntax error")
 	}
 	
-	value := strings.TrimSpace(strings.Trim(valueParts[1], "'\""))
+	value, pgErr := bindArg(valueParts[1], params)
+	if pgErr != nil {
+		return &pgResult{err: pgErr}
+	}
 	
 	fullKey := table + ":" + key
-	entry, found := h.cache.Load([]byte(fullKey))
+	_, flags, found := tx.load(h.cache, []byte(fullKey))
 	
-	if found {
-		h.cache.Store([]byte(fullKey), []byte(value), &cache.StoreOptions{
-			Flags: entry.Flags(),
-		})
-		h.sendCommandComplete(conn, "UPDATE 1")
-	} else {
-		h.sendCommandComplete(conn, "UPDATE 0")
+	if !found {
+		return &pgResult{tag: "UPDATE 0"}
 	}
+	err := tx.store(h.cache, []byte(fullKey), []byte(value), &cache.StoreOptions{
+		Flags: flags,
+	})
+	if err != nil {
+		return pgFailure("54000", err.Error())
+	}
+	return &pgResult{tag: "UPDATE 1"}
 }
 
-func (h *PostgresHandler) handleDelete(conn net.Conn, query string) {
+func (h *PostgresHandler) handleDelete(query string, params [][]byte, tx *pgTransaction) *pgResult {
 	parts := strings.Fields(query)
 	if len(parts) < 6 || parts[1] != "FROM" {
-		h.sendErrorResponse(conn, "42601", "syntax error")
-		return
+		return pgFailure("42601", "syntax error")
 	}
 	
 	table := parts[2]
@@ -273,37 +479,53 @@ func (h *PostgresHandler) handleDelete(conn net.Conn, query string) {
 	}
 	
 	if whereIdx < 0 || whereIdx+3 >= len(parts) {
-		h.sendErrorResponse(conn, "42601", "syntax error")
-		return
+		return pgFailure("42601", "syntax error")
 	}
 	
-	key := strings.Trim(parts[whereIdx+3], "'\"")
+	key, err := bindArg(parts[whereIdx+3], params)
+	if err != nil {
+		return &pgResult{err: err}
+	}
 	fullKey := table + ":" + key
 	
-	if h.cache.Delete([]byte(fullKey)) {
-		h.sendCommandComplete(conn, "DELETE 1")
-	} else {
-		h.sendCommandComplete(conn, "DELETE 0")
+	if tx.delete(h.cache, []byte(fullKey)) {
+		return &pgResult{tag: "DELETE 1"}
 	}
+	return &pgResult{tag: "DELETE 0"}
 }
 
-func (h *PostgresHandler) readMessage(conn net.Conn) (byte, []byte, error) {
+// readMessage reads a frontend message. A length that cannot be right,
+// shorter than the length field or longer than --proto-max-bulk-len,
+// returns errPgMessageLength, after which the stream cannot be followed.
+func (h *PostgresHandler) readMessage(conn io.Reader) (byte, []byte, error) {
 	header := make([]byte, 5)
 	if _, err := io.ReadFull(conn, header); err != nil {
 		return 0, nil, err
 	}
 	
 	msgType := header[0]
-	length := binary.BigEndian.Uint32(header[1:]) - 4
+	length := int64(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length-4 > h.maxMessageLen() {
+		return 0, nil, errPgMessageLength
+	}
 	
-	data := make([]byte, length)
-	if _, err := io.ReadFull(conn, data); err != nil {
+	data, err := readSized(conn, int(length-4))
+	if err != nil {
 		return 0, nil, err
 	}
 	
 	return msgType, data, nil
 }
 
+// maxMessageLen returns the longest message body accepted, the
+// --proto-max-bulk-len limit that bounds a Redis command too.
+func (h *PostgresHandler) maxMessageLen() int64 {
+	if h.config.MaxBulkLen > 0 {
+		return h.config.MaxBulkLen
+	}
+	return DefaultMaxBulkLen
+}
+
 func (h *PostgresHandler) sendMessage(conn net.Conn, msgType byte, data []byte) error {
 	buf := make([]byte, 5+len(data))
 	buf[0] = msgType
@@ -318,6 +540,7 @@ func (h *PostgresHandler) sendAuthenticationOk(conn net.Conn) {
 	data := make([]byte, 4)
 	binary.BigEndian.PutUint32(data, 0)
 	h.sendMessage(conn, 'R', data)
+	h.sendParameterStatus(conn)
 }
 
 func (h *PostgresHandler) sendAuthenticationCleartextPassword(conn net.Conn) {
@@ -326,11 +549,25 @@ func (h *PostgresHandler) sendAuthenticationCleartextPassword(conn net.Conn) {
 	h.sendMessage(conn, 'R', data)
 }
 
-func (h *PostgresHandler) sendReadyForQuery(conn net.Conn) {
-	h.sendMessage(conn, 'Z', []byte{'I'})
+// sendReadyForQuery sends the transaction status: 'I' when idle, 'T' in
+// a transaction block, or 'E' in a failed one.
+func (h *PostgresHandler) sendReadyForQuery(conn net.Conn, status byte) {
+	h.sendMessage(conn, 'Z', []byte{status})
 }
 
+// sendErrorResponse sends an error with the given SQLSTATE code, counting
+// authentication failures, protocol violations and syntax errors, and
+// internal errors by their code.
 func (h *PostgresHandler) sendErrorResponse(conn net.Conn, code, message string) {
+	switch {
+	case strings.HasPrefix(code, "28"):
+		h.config.Errors.count(TypePostgres, errorAuth)
+	case code == "08P01" || code == "42601":
+		h.config.Errors.count(TypePostgres, errorParse)
+	case strings.HasPrefix(code, "XX") || strings.HasPrefix(code, "58"):
+		h.config.Errors.count(TypePostgres, errorInternal)
+	}
+	
 	var buf bytes.Buffer
 	buf.WriteByte('S')
 	buf.WriteString("ERROR")
@@ -346,29 +583,38 @@ func (h *PostgresHandler) sendErrorResponse(conn net.Conn, code, message string)
 	h.sendMessage(conn, 'E', buf.Bytes())
 }
 
-func (h *PostgresHandler) sendRowDescription(conn net.Conn, columns []string) {
+// sendRowDescription describes text columns sent in the given formats,
+// as Bind lists them: none for all text, one for all columns, or one per
+// column.
+func (h *PostgresHandler) sendRowDescription(conn net.Conn, columns []string, formats []int16) {
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, int16(len(columns)))
 	
-	for _, col := range columns {
+	for i, col := range columns {
 		buf.WriteString(col)
 		buf.WriteByte(0)
 		binary.Write(&buf, binary.BigEndian, int32(0))
 		binary.Write(&buf, binary.BigEndian, int16(0))
-		binary.Write(&buf, binary.BigEndian, int32(25))
+		binary.Write(&buf, binary.BigEndian, int32(pgTextOID))
 		binary.Write(&buf, binary.BigEndian, int16(-1))
 		binary.Write(&buf, binary.BigEndian, int32(-1))
-		binary.Write(&buf, binary.BigEndian, int16(0))
+		binary.Write(&buf, binary.BigEndian, pgFormat(formats, i))
 	}
 	
 	h.sendMessage(conn, 'T', buf.Bytes())
 }
 
+// sendDataRow sends a row, in which a nil value is NULL. A text value's
+// binary format is the same as its text format.
 func (h *PostgresHandler) sendDataRow(conn net.Conn, values [][]byte) {
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, int16(len(values)))
 	
 	for _, value := range values {
+		if value == nil {
+			binary.Write(&buf, binary.BigEndian, int32(-1))
+			continue
+		}
 		binary.Write(&buf, binary.BigEndian, int32(len(value)))
 		buf.Write(value)
 	}
@@ -379,4 +625,4 @@ func (h *PostgresHandler) sendDataRow(conn net.Conn, values [][]byte) {
 func (h *PostgresHandler) sendCommandComplete(conn net.Conn, tag string) {
 	data := append([]byte(tag), 0)
 	h.sendMessage(conn, 'C', data)
-}
\ No newline at end of file
+}
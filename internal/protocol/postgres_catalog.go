@@ -0,0 +1,700 @@
+package protocol
+
+import (
+	"fmt"
+	"iter"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// The server identity reported to clients.
+const (
+	postgresServerVersion = "14.0"
+	postgresDatabase      = "gopogo"
+	postgresUser          = "gopogo"
+)
+
+// OIDs in the virtual catalog. Tables are numbered in name order from
+// catalogFirstTableOID, so a table's OID only lasts while the set of
+// tables does.
+const (
+	catalogOwnerOID       = 10
+	catalogPgCatalogOID   = 11
+	catalogPublicOID      = 2200
+	catalogInfoSchemaOID  = 13000
+	catalogDatabaseOID    = 16384
+	catalogFirstTableOID  = 16385
+	catalogMaxIdentLength = 63
+)
+
+// postgresSettings are the run-time parameters SHOW and current_setting()
+// report, by lowercase name.
+var postgresSettings = map[string]string{
+	"server_version":              postgresServerVersion,
+	"server_version_num":          "140000",
+	"server_encoding":             "UTF8",
+	"client_encoding":             "UTF8",
+	"datestyle":                   "ISO, MDY",
+	"timezone":                    "UTC",
+	"integer_datetimes":           "on",
+	"standard_conforming_strings": "on",
+	"search_path":                 `"$user", public`,
+	"transaction_isolation":       "read committed",
+	"transaction isolation level": "read committed",
+	"max_identifier_length":       strconv.Itoa(catalogMaxIdentLength),
+	"is_superuser":                "on",
+	"application_name":            "",
+}
+
+// postgresStatusParameters are sent as ParameterStatus after
+// authentication, as PostgreSQL does; drivers read the server version
+// from them.
+var postgresStatusParameters = []string{
+	"server_version", "server_encoding", "client_encoding", "DateStyle",
+	"TimeZone", "integer_datetimes", "standard_conforming_strings", "is_superuser",
+}
+
+// catalogTable is a table of the table:key namespace.
+type catalogTable struct {
+	oid  int
+	name string
+	rows int
+}
+
+// catalogRelation is a virtual catalog table or view. Rows may hold
+// columns beyond those * selects, standing in for the joins clients use
+// to name a row's schema or table; a missing column is NULL.
+type catalogRelation struct {
+	columns []string
+	rows    func(tables []catalogTable) []map[string]string
+	// scan, if set, yields the rows instead, for relations too large to
+	// build up front.
+	scan func(h *PostgresHandler) iter.Seq[map[string]string]
+}
+
+var catalogRelations = map[string]catalogRelation{
+	// keys lists every key with its TTL in seconds, -1 for none, and its
+	// value's size in bytes.
+	"keys": {
+		columns: []string{"key", "ttl", "size"},
+		scan: func(h *PostgresHandler) iter.Seq[map[string]string] {
+			return func(yield func(map[string]string) bool) {
+				h.cache.IterateSnapshot(func(entry *cache.Entry) bool {
+					return yield(map[string]string{
+						"key":  string(entry.Key()),
+						"ttl":  strconv.FormatInt(ttlSeconds(entry), 10),
+						"size": strconv.Itoa(len(entry.Value())),
+					})
+				})
+			}
+		},
+	},
+	"pg_namespace": {
+		columns: []string{"oid", "nspname", "nspowner"},
+		rows: func([]catalogTable) []map[string]string {
+			return []map[string]string{
+				{"oid": strconv.Itoa(catalogPgCatalogOID), "nspname": "pg_catalog", "nspowner": strconv.Itoa(catalogOwnerOID)},
+				{"oid": strconv.Itoa(catalogPublicOID), "nspname": "public", "nspowner": strconv.Itoa(catalogOwnerOID)},
+				{"oid": strconv.Itoa(catalogInfoSchemaOID), "nspname": "information_schema", "nspowner": strconv.Itoa(catalogOwnerOID)},
+			}
+		},
+	},
+	"pg_database": {
+		columns: []string{"oid", "datname", "datdba", "encoding", "datcollate", "datctype", "datistemplate", "datallowconn"},
+		rows: func([]catalogTable) []map[string]string {
+			return []map[string]string{{
+				"oid": strconv.Itoa(catalogDatabaseOID), "datname": postgresDatabase, "datdba": strconv.Itoa(catalogOwnerOID),
+				"encoding": "6", "datcollate": "C", "datctype": "C", "datistemplate": "f", "datallowconn": "t",
+			}}
+		},
+	},
+	"pg_roles": {
+		columns: []string{"oid", "rolname", "rolsuper", "rolcanlogin"},
+		rows: func([]catalogTable) []map[string]string {
+			return []map[string]string{{"oid": strconv.Itoa(catalogOwnerOID), "rolname": postgresUser, "rolsuper": "t", "rolcanlogin": "t"}}
+		},
+	},
+	"pg_user": {
+		columns: []string{"usename", "usesysid", "usesuper"},
+		rows: func([]catalogTable) []map[string]string {
+			return []map[string]string{{"usename": postgresUser, "usesysid": strconv.Itoa(catalogOwnerOID), "usesuper": "t"}}
+		},
+	},
+	"pg_type": {
+		columns: []string{"oid", "typname", "typnamespace", "typlen", "typtype"},
+		rows: func([]catalogTable) []map[string]string {
+			var rows []map[string]string
+			for _, t := range []struct {
+				oid  int
+				name string
+				len  int
+			}{{pgBoolOID, "bool", 1}, {pgByteaOID, "bytea", -1}, {pgNameOID, "name", 64}, {pgInt8OID, "int8", 8}, {pgInt2OID, "int2", 2},
+				{pgInt4OID, "int4", 4}, {pgTextOID, "text", -1}, {pgOIDOID, "oid", 4}, {pgVarcharOID, "varchar", -1}} {
+				rows = append(rows, map[string]string{
+					"oid": strconv.Itoa(t.oid), "typname": t.name, "typnamespace": strconv.Itoa(catalogPgCatalogOID),
+					"typlen": strconv.Itoa(t.len), "typtype": "b",
+				})
+			}
+			return rows
+		},
+	},
+	"pg_class": {
+		columns: []string{"oid", "relname", "relnamespace", "relkind", "relowner", "reltuples", "relhasindex", "relpersistence", "relispartition"},
+		rows: func(tables []catalogTable) []map[string]string {
+			var rows []map[string]string
+			for _, t := range tables {
+				rows = append(rows, map[string]string{
+					"oid": strconv.Itoa(t.oid), "relname": t.name, "relnamespace": strconv.Itoa(catalogPublicOID),
+					"relkind": "r", "relowner": strconv.Itoa(catalogOwnerOID), "reltuples": strconv.Itoa(t.rows),
+					"relhasindex": "t", "relpersistence": "p", "relispartition": "f", "nspname": "public",
+				})
+			}
+			return rows
+		},
+	},
+	"pg_tables": {
+		columns: []string{"schemaname", "tablename", "tableowner", "hasindexes"},
+		rows: func(tables []catalogTable) []map[string]string {
+			var rows []map[string]string
+			for _, t := range tables {
+				rows = append(rows, map[string]string{"schemaname": "public", "tablename": t.name, "tableowner": postgresUser, "hasindexes": "t"})
+			}
+			return rows
+		},
+	},
+	"pg_attribute": {
+		columns: []string{"attrelid", "attname", "atttypid", "attnum", "attnotnull", "attisdropped"},
+		rows: func(tables []catalogTable) []map[string]string {
+			var rows []map[string]string
+			for _, t := range tables {
+				for i, name := range []string{"key", "value"} {
+					notNull := "f"
+					if i == 0 {
+						notNull = "t"
+					}
+					rows = append(rows, map[string]string{
+						"attrelid": strconv.Itoa(t.oid), "attname": name, "atttypid": strconv.Itoa(pgTextOID),
+						"attnum": strconv.Itoa(i + 1), "attnotnull": notNull, "attisdropped": "f",
+						"relname": t.name,
+					})
+				}
+			}
+			return rows
+		},
+	},
+	"information_schema.schemata": {
+		columns: []string{"catalog_name", "schema_name", "schema_owner"},
+		rows: func([]catalogTable) []map[string]string {
+			var rows []map[string]string
+			for _, name := range []string{"information_schema", "pg_catalog", "public"} {
+				rows = append(rows, map[string]string{"catalog_name": postgresDatabase, "schema_name": name, "schema_owner": postgresUser})
+			}
+			return rows
+		},
+	},
+	"information_schema.tables": {
+		columns: []string{"table_catalog", "table_schema", "table_name", "table_type"},
+		rows: func(tables []catalogTable) []map[string]string {
+			var rows []map[string]string
+			for _, t := range tables {
+				rows = append(rows, map[string]string{"table_catalog": postgresDatabase, "table_schema": "public", "table_name": t.name, "table_type": "BASE TABLE"})
+			}
+			return rows
+		},
+	},
+	"information_schema.columns": {
+		columns: []string{"table_catalog", "table_schema", "table_name", "column_name", "ordinal_position", "is_nullable", "data_type"},
+		rows: func(tables []catalogTable) []map[string]string {
+			var rows []map[string]string
+			for _, t := range tables {
+				for i, name := range []string{"key", "value"} {
+					nullable := "YES"
+					if i == 0 {
+						nullable = "NO"
+					}
+					rows = append(rows, map[string]string{
+						"table_catalog": postgresDatabase, "table_schema": "public", "table_name": t.name,
+						"column_name": name, "ordinal_position": strconv.Itoa(i + 1), "is_nullable": nullable, "data_type": "text",
+					})
+				}
+			}
+			return rows
+		},
+	},
+}
+
+// catalogTables returns the tables of the table:key namespace: the
+// distinct parts of keys before the first ':', lowercased as PostgreSQL
+// folds unquoted names, with how many keys each holds. It walks the whole
+// cache, which is fine for the occasional introspection query.
+func (h *PostgresHandler) catalogTables() []catalogTable {
+	counts := make(map[string]int)
+	h.cache.IterateSnapshot(func(entry *cache.Entry) bool {
+		if table, _, ok := strings.Cut(string(entry.Key()), ":"); ok && table != "" {
+			counts[strings.ToLower(table)]++
+		}
+		return true
+	})
+	
+	tables := make([]catalogTable, 0, len(counts))
+	for name, rows := range counts {
+		tables = append(tables, catalogTable{name: name, rows: rows})
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].name < tables[j].name })
+	for i := range tables {
+		tables[i].oid = catalogFirstTableOID + i
+	}
+	return tables
+}
+
+// catalogQuery answers the introspection queries psql and GUI
+// clients send on connecting and browsing: SET, SHOW, SELECT of constants
+// and functions such as version(), and SELECT from a virtual pg_catalog
+// and information_schema describing the table:key namespace. Joins,
+// ordering and conditions other than =, <>, ~ and IN on a column are
+// ignored. It reports whether query was one of these.
+func (h *PostgresHandler) catalogQuery(query string) (*pgResult, bool) {
+	query = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	word, rest, _ := strings.Cut(query, " ")
+	
+	switch word = strings.ToUpper(word); word {
+	case "SET", "RESET":
+		// Session settings are accepted and ignored.
+		return &pgResult{tag: word}, true
+	
+	case "SHOW":
+		name := strings.ToLower(strings.TrimSpace(rest))
+		value, ok := postgresSettings[name]
+		if !ok {
+			return pgFailure("42704", fmt.Sprintf("unrecognized configuration parameter \"%s\"", name)), true
+		}
+		return &pgResult{columns: []string{name}, rows: slices.Values([][][]byte{{[]byte(value)}}), tag: "SHOW"}, true
+	
+	case "SELECT":
+	default:
+		return nil, false
+	}
+	
+	clauses := splitClauses(rest)
+	var rel catalogRelation
+	var rows iter.Seq[map[string]string]
+	if from, ok := clauses["FROM"]; ok {
+		name := strings.ToLower(strings.Trim(strings.Fields(from + " ")[0], `"`))
+		if rel, ok = catalogRelations[strings.TrimPrefix(name, "pg_catalog.")]; !ok {
+			return nil, false
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(clauses["LIMIT"]))
+		if err != nil {
+			limit = -1
+		}
+		rows = func(yield func(map[string]string) bool) {
+			source := rel.scan
+			if source == nil {
+				source = func(h *PostgresHandler) iter.Seq[map[string]string] {
+					return slices.Values(rel.rows(h.catalogTables()))
+				}
+			}
+			conds := parseConditions(clauses["WHERE"])
+			n := 0
+			for row := range source(h) {
+				if n == limit {
+					return
+				}
+				if matchConditions(conds, row) {
+					n++
+					if !yield(row) {
+						return
+					}
+				}
+			}
+		}
+	}
+	
+	var names, exprs []string
+	aggregate := false
+	for _, item := range splitTopLevel(clauses[""], ",") {
+		item = strings.TrimSpace(item)
+		if item == "*" || strings.HasSuffix(item, ".*") {
+			names = append(names, rel.columns...)
+			exprs = append(exprs, rel.columns...)
+			continue
+		}
+		name, expr := selectItem(item)
+		names = append(names, name)
+		exprs = append(exprs, expr)
+		aggregate = aggregate || strings.EqualFold(expr, "count(*)")
+	}
+	
+	// Without FROM, every expression must be one understood; with it, an
+	// unknown expression is NULL.
+	result := &pgResult{columns: names, tag: "SELECT"}
+	switch {
+	case clauses["FROM"] == "" && !aggregate:
+		row, ok := h.catalogRow(exprs, nil, 0)
+		if !ok {
+			return nil, false
+		}
+		result.rows = slices.Values([][][]byte{row})
+	case aggregate:
+		result.rows = func(yield func([][]byte) bool) {
+			var first map[string]string
+			count := 0
+			for r := range rows {
+				if count == 0 {
+					first = r
+				}
+				count++
+			}
+			row, _ := h.catalogRow(exprs, first, count)
+			yield(row)
+		}
+	default:
+		result.rows = func(yield func([][]byte) bool) {
+			for r := range rows {
+				row, _ := h.catalogRow(exprs, r, 0)
+				if !yield(row) {
+					return
+				}
+			}
+		}
+	}
+	return result, true
+}
+
+// catalogRow evaluates a select list against row, which is nil without a
+// FROM clause; count is the value of count(*). A nil value is NULL.
+func (h *PostgresHandler) catalogRow(exprs []string, row map[string]string, count int) ([][]byte, bool) {
+	values := make([][]byte, len(exprs))
+	for i, expr := range exprs {
+		if strings.EqualFold(expr, "count(*)") {
+			values[i] = []byte(strconv.Itoa(count))
+			continue
+		}
+		value, null, ok := catalogValue(expr, row)
+		if !ok && row == nil {
+			return nil, false
+		}
+		if ok && !null {
+			values[i] = []byte(value)
+		}
+	}
+	return values, true
+}
+
+var (
+	catalogIdentRe    = regexp.MustCompile(`^[a-z_][a-z0-9_$]*(\.[a-z_][a-z0-9_$]*)?$`)
+	catalogNumberRe   = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+	catalogCastRe     = regexp.MustCompile(`::[a-z_ ."]+(\[\])?$`)
+	catalogCondRe     = regexp.MustCompile(`^([a-z_][a-z0-9_.]*)(\s*(?:=|<>|!=|!~|~)\s*|\s+(?:not\s+)?i?like\s+)(.+)$`)
+	catalogInRe       = regexp.MustCompile(`^([a-z_][a-z0-9_.]*)\s+(not\s+)?in\s*\((.*)\)$`)
+	catalogOperatorRe = regexp.MustCompile(`(?i)operator\(pg_catalog\.([^)]+)\)`)
+)
+
+// catalogValue evaluates one expression: a literal, a known function, or
+// a column of row. ok is false for an expression it does not understand.
+func catalogValue(expr string, row map[string]string) (value string, null, ok bool) {
+	expr = strings.TrimSpace(expr)
+	if literal, ok := catalogLiteral(expr); ok {
+		return literal, false, true
+	}
+	
+	lower := catalogCastRe.ReplaceAllString(strings.ToLower(expr), "")
+	fn := strings.TrimPrefix(strings.ReplaceAll(lower, " ", ""), "pg_catalog.")
+	switch {
+	case lower == "null":
+		return "", true, true
+	case lower == "true" || lower == "false":
+		return lower[:1], false, true
+	case fn == "version()":
+		return "PostgreSQL " + postgresServerVersion + " (gopogo)", false, true
+	case fn == "current_database()":
+		return postgresDatabase, false, true
+	case fn == "current_schema()" || fn == "current_schema":
+		return "public", false, true
+	case fn == "current_user" || fn == "session_user" || fn == "user" || fn == "current_role":
+		return postgresUser, false, true
+	case strings.HasPrefix(fn, "current_setting("):
+		name, _ := catalogLiteral(expr[strings.Index(expr, "(")+1 : strings.LastIndex(expr, ")")])
+		setting, found := postgresSettings[strings.ToLower(name)]
+		return setting, !found, true
+	case strings.HasPrefix(fn, "format_type("):
+		// Every column is text.
+		return "text", false, true
+	case catalogIdentRe.MatchString(lower) && row != nil:
+		column := lower[strings.LastIndex(lower, ".")+1:]
+		value, found := row[column]
+		return value, !found, true
+	}
+	return "", true, false
+}
+
+// catalogLiteral parses a quoted string or a number, with any cast.
+func catalogLiteral(expr string) (string, bool) {
+	expr = strings.TrimSpace(expr)
+	if i := strings.LastIndex(expr, "::"); i > 0 && !strings.Contains(expr[i:], "'") {
+		expr = strings.TrimSpace(expr[:i])
+	}
+	if catalogNumberRe.MatchString(expr) {
+		return expr, true
+	}
+	if len(expr) >= 2 && expr[0] == '\'' && expr[len(expr)-1] == '\'' {
+		inner := expr[1 : len(expr)-1]
+		if strings.Contains(strings.ReplaceAll(inner, "''", ""), "'") {
+			return "", false
+		}
+		return strings.ReplaceAll(inner, "''", "'"), true
+	}
+	return "", false
+}
+
+// selectItem returns the output column name and the expression of one
+// select-list item.
+func selectItem(item string) (name, expr string) {
+	expr = item
+	parts := splitWord(item, "AS")
+	if len(parts) > 1 {
+		expr = strings.Join(parts[:len(parts)-1], " AS ")
+		alias := strings.TrimSpace(parts[len(parts)-1])
+		if unquoted, ok := strings.CutPrefix(alias, `"`); ok {
+			return strings.TrimSuffix(unquoted, `"`), strings.TrimSpace(expr)
+		}
+		return strings.ToLower(alias), strings.TrimSpace(expr)
+	}
+	
+	expr = strings.TrimSpace(expr)
+	lower := catalogCastRe.ReplaceAllString(strings.ToLower(expr), "")
+	switch {
+	case catalogIdentRe.MatchString(lower):
+		return lower[strings.LastIndex(lower, ".")+1:], expr
+	case strings.Contains(lower, "("):
+		fn := strings.TrimSpace(lower[:strings.Index(lower, "(")])
+		if catalogIdentRe.MatchString(fn) {
+			return fn[strings.LastIndex(fn, ".")+1:], expr
+		}
+	}
+	return "?column?", expr
+}
+
+// catalogCond is one understood condition of a WHERE clause: a column
+// equal to or different from a literal, in a list of them, or matching a
+// pattern.
+type catalogCond struct {
+	column string
+	values []string
+	re     *regexp.Regexp
+	negate bool
+}
+
+// parseConditions returns the understood conditions of an AND-ed WHERE
+// clause. Other conditions are left out, as is everything for a clause
+// with OR, so that rows are only ever filtered by conditions they fail.
+func parseConditions(where string) []catalogCond {
+	if where == "" || len(splitWord(where, "OR")) > 1 {
+		return nil
+	}
+	
+	var conds []catalogCond
+	for _, cond := range splitWord(where, "AND") {
+		cond = strings.TrimSpace(cond)
+		if parts := splitWord(cond, "COLLATE"); len(parts) > 1 {
+			cond = strings.TrimSpace(parts[0])
+		}
+		cond = catalogOperatorRe.ReplaceAllString(cond, "$1")
+		lower := strings.ToLower(cond)
+		column := func(ref string) string {
+			return ref[strings.LastIndex(ref, ".")+1:]
+		}
+		
+		if m := catalogInRe.FindStringSubmatch(lower); m != nil {
+			c := catalogCond{column: column(m[1]), negate: m[2] != ""}
+			for _, item := range splitTopLevel(cond[strings.Index(lower, "(")+1:len(cond)-1], ",") {
+				if literal, ok := catalogLiteral(item); ok {
+					c.values = append(c.values, literal)
+				}
+			}
+			conds = append(conds, c)
+			continue
+		}
+		
+		m := catalogCondRe.FindStringSubmatch(lower)
+		if m == nil {
+			continue
+		}
+		literal, ok := catalogLiteral(cond[len(cond)-len(m[3]):])
+		if !ok {
+			continue
+		}
+		c := catalogCond{column: column(m[1])}
+		op := strings.Join(strings.Fields(m[2]), " ")
+		switch op {
+		case "=":
+			c.values = []string{literal}
+		case "<>", "!=":
+			c.values, c.negate = []string{literal}, true
+		case "~", "!~":
+			re, err := regexp.Compile(literal)
+			if err != nil {
+				continue
+			}
+			c.re, c.negate = re, op == "!~"
+		default:
+			// [NOT] LIKE or ILIKE.
+			pattern := likePattern(literal)
+			if strings.HasSuffix(op, "ilike") {
+				pattern = "(?i)" + pattern
+			}
+			c.re, c.negate = regexp.MustCompile(pattern), strings.HasPrefix(op, "not")
+		}
+		conds = append(conds, c)
+	}
+	return conds
+}
+
+// matchConditions reports whether row satisfies conds. A condition on a
+// column row lacks is taken as true.
+func matchConditions(conds []catalogCond, row map[string]string) bool {
+	for _, c := range conds {
+		value, found := row[c.column]
+		if !found {
+			continue
+		}
+		var match bool
+		if c.re != nil {
+			match = c.re.MatchString(value)
+		} else {
+			match = slices.Contains(c.values, value)
+		}
+		if match == c.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// likePattern converts a LIKE pattern, in which % matches any run of
+// characters, _ any one, and a backslash escapes the next, to a regular
+// expression.
+func likePattern(like string) string {
+	var b strings.Builder
+	b.WriteString("^(?s)")
+	for i := 0; i < len(like); i++ {
+		switch c := like[i]; {
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		case c == '\\' && i+1 < len(like):
+			i++
+			b.WriteString(regexp.QuoteMeta(like[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(like[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// splitClauses splits the rest of a SELECT statement into its select list,
+// under "", and its FROM, WHERE, GROUP BY, ORDER BY, LIMIT and OFFSET
+// clauses, by keyword.
+func splitClauses(s string) map[string]string {
+	clauses := make(map[string]string)
+	keywords := []string{"FROM", "WHERE", "GROUP BY", "ORDER BY", "LIMIT", "OFFSET"}
+	current, start := "", 0
+	mask := topLevel(s)
+	for i := 0; i < len(s); i++ {
+		if !mask[i] || (i > 0 && isIdentByte(s[i-1])) {
+			continue
+		}
+		for _, kw := range keywords {
+			end := i + len(kw)
+			if end <= len(s) && strings.EqualFold(s[i:end], kw) && (end == len(s) || !isIdentByte(s[end])) {
+				clauses[current] = strings.TrimSpace(s[start:i])
+				current, start = kw, end
+				i = end - 1
+				break
+			}
+		}
+	}
+	clauses[current] = strings.TrimSpace(s[start:])
+	return clauses
+}
+
+// splitWord splits s around a keyword at the top level, ignoring case.
+func splitWord(s, word string) []string {
+	var parts []string
+	mask := topLevel(s)
+	start := 0
+	for i := 0; i+len(word) <= len(s); i++ {
+		end := i + len(word)
+		if mask[i] && strings.EqualFold(s[i:end], word) && (i == 0 || !isIdentByte(s[i-1])) && (end == len(s) || !isIdentByte(s[end])) {
+			parts = append(parts, s[start:i])
+			start = end
+			i = end - 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// splitTopLevel splits s around sep where it is outside quotes and
+// parentheses.
+func splitTopLevel(s, sep string) []string {
+	var parts []string
+	mask := topLevel(s)
+	start := 0
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if mask[i] && s[i:i+len(sep)] == sep {
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// topLevel reports for each byte of s whether it is outside quotes and
+// parentheses.
+func topLevel(s string) []bool {
+	mask := make([]bool, len(s))
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '\'' || c == '"':
+			quote = c
+			continue
+		case c == '(':
+			depth++
+			continue
+		case c == ')':
+			depth--
+			continue
+		}
+		mask[i] = depth == 0
+	}
+	return mask
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// sendParameterStatus reports the postgresStatusParameters.
+func (h *PostgresHandler) sendParameterStatus(conn net.Conn) {
+	for _, name := range postgresStatusParameters {
+		data := append([]byte(name), 0)
+		data = append(data, postgresSettings[strings.ToLower(name)]...)
+		h.sendMessage(conn, 'S', append(data, 0))
+	}
+}
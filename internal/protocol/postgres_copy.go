@@ -0,0 +1,309 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// copyOptions are the parts of a COPY ... FROM STDIN statement that
+// shape the incoming rows.
+type copyOptions struct {
+	table     string
+	csv       bool
+	header    bool
+	delimiter rune
+	// keyFirst is false for a column list of (value, key).
+	keyFirst bool
+}
+
+// errCopyFailed stops the row parser when the client aborts the COPY.
+var errCopyFailed = errors.New("COPY aborted by the client")
+
+// parseCopy parses COPY table [(key, value)] FROM STDIN [[WITH] (option
+// value, ...)], also accepting the pre-9.0 forms CSV, HEADER and
+// DELIMITER 'x' after STDIN.
+func parseCopy(query string) (*copyOptions, bool) {
+	opts := &copyOptions{delimiter: '\t', keyFirst: true}
+	
+	rest, ok := strings.CutPrefix(query, "COPY ")
+	if !ok {
+		return nil, false
+	}
+	from := strings.Index(rest, " FROM STDIN")
+	if from < 0 {
+		return nil, false
+	}
+	target, options := strings.TrimSpace(rest[:from]), rest[from+len(" FROM STDIN"):]
+	
+	table, columns, hasColumns := strings.Cut(target, "(")
+	opts.table = strings.TrimSpace(table)
+	if opts.table == "" || strings.ContainsAny(opts.table, " ") {
+		return nil, false
+	}
+	if hasColumns {
+		var names []string
+		for _, name := range strings.Split(strings.TrimSuffix(strings.TrimSpace(columns), ")"), ",") {
+			names = append(names, strings.Trim(strings.TrimSpace(name), `"`))
+		}
+		switch strings.Join(names, ",") {
+		case "KEY,VALUE":
+		case "VALUE,KEY":
+			opts.keyFirst = false
+		default:
+			return nil, false
+		}
+	}
+	
+	options = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(options), ";"))
+	options = strings.TrimSpace(strings.TrimPrefix(options, "WITH"))
+	options = strings.TrimSuffix(strings.TrimPrefix(options, "("), ")")
+	fields := strings.FieldsFunc(options, func(r rune) bool { return r == ',' || r == ' ' })
+	for i := 0; i < len(fields); i++ {
+		arg := ""
+		if i+1 < len(fields) {
+			arg = strings.Trim(fields[i+1], "'")
+		}
+		switch fields[i] {
+		case "CSV":
+			opts.csv = true
+		case "HEADER":
+			opts.header = true
+			if arg == "TRUE" || arg == "FALSE" {
+				opts.header = arg == "TRUE"
+				i++
+			}
+		case "FORMAT":
+			switch arg {
+			case "CSV":
+				opts.csv = true
+			case "TEXT":
+			default:
+				return nil, false
+			}
+			i++
+		case "DELIMITER":
+			if len(arg) != 1 {
+				return nil, false
+			}
+			opts.delimiter = rune(arg[0])
+			i++
+		default:
+			return nil, false
+		}
+	}
+	if opts.csv && opts.delimiter == '\t' && !strings.Contains(options, "DELIMITER") {
+		opts.delimiter = ','
+	}
+	return opts, true
+}
+
+// handleCopy runs COPY ... FROM STDIN: it asks the client for the data
+// and stores each row as it arrives, without waiting for the end. Outside
+// a transaction block, rows stored before an error stay stored. It
+// returns an error only if the connection failed.
+func (h *PostgresHandler) handleCopy(conn net.Conn, reader io.Reader, s *pgSession, opts *copyOptions) error {
+	fail := func(code, message string) {
+		h.sendErrorResponse(conn, code, message)
+		s.abort()
+	}
+	if s.aborted() {
+		fail(errAborted.code, errAborted.message)
+		return nil
+	}
+	
+	// CopyInResponse: text format, two text columns.
+	h.sendMessage(conn, 'G', []byte{0, 0, 2, 0, 0, 0, 0})
+	
+	pr, pw := io.Pipe()
+	type copyResult struct {
+		rows int
+		err  error
+	}
+	done := make(chan copyResult, 1)
+	go func() {
+		rows, err := h.copyRows(pr, s.tx, opts)
+		// Later CopyData messages are discarded if the rows stopped early.
+		pr.CloseWithError(io.ErrClosedPipe)
+		done <- copyResult{rows, err}
+	}()
+	
+	for {
+		msgType, data, err := h.readMessage(reader)
+		if err != nil {
+			pw.CloseWithError(err)
+			<-done
+			return err
+		}
+		
+		switch msgType {
+		case 'd':
+			pw.Write(data)
+			continue
+		case 'H', 'S':
+			// Flush and Sync are ignored during COPY.
+			continue
+		case 'c':
+			pw.Close()
+		case 'f':
+			pw.CloseWithError(errCopyFailed)
+			<-done
+			fail("57014", "COPY from stdin failed: "+string(bytes.TrimRight(data, "\x00")))
+			return nil
+		default:
+			pw.CloseWithError(errCopyFailed)
+			<-done
+			fail("08P01", fmt.Sprintf("unexpected message type 0x%02x during COPY from stdin", msgType))
+			return nil
+		}
+		
+		result := <-done
+		var copyErr *pgError
+		switch {
+		case errors.As(result.err, &copyErr):
+			fail(copyErr.code, copyErr.message)
+		case result.err != nil:
+			fail("22P04", result.err.Error())
+		default:
+			h.sendCommandComplete(conn, "COPY "+strconv.Itoa(result.rows))
+		}
+		return nil
+	}
+}
+
+// copyRows reads rows from r and stores them, returning how many it
+// stored.
+func (h *PostgresHandler) copyRows(r io.Reader, tx *pgTransaction, opts *copyOptions) (int, error) {
+	store := func(line int, fields []string, null []bool) error {
+		if len(fields) < 2 {
+			return &pgError{"22P04", fmt.Sprintf("missing data for column \"value\" on line %d", line)}
+		}
+		if len(fields) > 2 {
+			return &pgError{"22P04", fmt.Sprintf("extra data after last expected column on line %d", line)}
+		}
+		key, value := 0, 1
+		if !opts.keyFirst {
+			key, value = 1, 0
+		}
+		if null != nil && null[key] {
+			return &pgError{"23502", fmt.Sprintf("null value in column \"key\" violates not-null constraint on line %d", line)}
+		}
+		if err := tx.store(h.cache, []byte(opts.table+":"+fields[key]), []byte(fields[value]), nil); err != nil {
+			return &pgError{"54000", fmt.Sprintf("%v on line %d", err, line)}
+		}
+		return nil
+	}
+	
+	rows := 0
+	if opts.csv {
+		cr := csv.NewReader(r)
+		cr.Comma = opts.delimiter
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+		for line := 1; ; line++ {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return rows, nil
+			}
+			if err != nil {
+				return rows, err
+			}
+			if line == 1 && opts.header {
+				continue
+			}
+			// encoding/csv does not tell a quoted empty field from an
+			// unquoted one, so CSV rows have no NULLs.
+			if err := store(line, record, nil); err != nil {
+				return rows, err
+			}
+			rows++
+		}
+	}
+	
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, err := br.ReadString('\n')
+		if err == io.EOF && text == "" {
+			return rows, nil
+		}
+		if err != nil && err != io.EOF {
+			return rows, err
+		}
+		text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+		if text == `\.` {
+			continue
+		}
+		
+		parts := strings.Split(text, string(opts.delimiter))
+		fields := make([]string, len(parts))
+		null := make([]bool, len(parts))
+		for i, part := range parts {
+			if part == `\N` {
+				null[i] = true
+				continue
+			}
+			fields[i] = unescapeCopyText(part)
+		}
+		if err := store(line, fields, null); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+}
+
+// unescapeCopyText decodes the backslash escapes of COPY's text format.
+func unescapeCopyText(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			n, j := 0, i+1
+			for ; j < len(s) && j < i+3 && isHex(s[j]); j++ {
+				n = n*16 + int(unhex(s[j]))
+			}
+			if j == i+1 {
+				b.WriteByte('x')
+				continue
+			}
+			b.WriteByte(byte(n))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n, j := 0, i
+			for ; j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7'; j++ {
+				n = n*8 + int(s[j]-'0')
+			}
+			b.WriteByte(byte(n))
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
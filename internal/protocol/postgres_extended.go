@@ -0,0 +1,474 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"iter"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Type OIDs of the parameter types the extended protocol converts.
+const (
+	pgBoolOID    = 16
+	pgByteaOID   = 17
+	pgNameOID    = 19
+	pgInt8OID    = 20
+	pgInt2OID    = 21
+	pgInt4OID    = 23
+	pgTextOID    = 25
+	pgOIDOID     = 26
+	pgVarcharOID = 1043
+)
+
+// pgStatement is a prepared statement, with one type per parameter.
+// Parameters Parse leaves unspecified are text.
+type pgStatement struct {
+	query      string
+	paramTypes []uint32
+}
+
+// pgPortal is a bound statement. An Execute that stops at a row limit
+// leaves the rest of the rows in next.
+type pgPortal struct {
+	stmt    *pgStatement
+	params  [][]byte
+	formats []int16
+	
+	next  func() ([][]byte, bool)
+	stop  func()
+	count int
+}
+
+func (p *pgPortal) close() {
+	if p.stop != nil {
+		p.stop()
+	}
+}
+
+// pgSession is the state of one connection: its open transaction block,
+// if any, and its prepared statements and portals for the extended query
+// protocol.
+type pgSession struct {
+	tx         *pgTransaction
+	statements map[string]*pgStatement
+	portals    map[string]*pgPortal
+	// failed is set by an error in the extended protocol; messages up to
+	// the next Sync are then ignored.
+	failed bool
+}
+
+func newPgSession() *pgSession {
+	return &pgSession{
+		statements: make(map[string]*pgStatement),
+		portals:    make(map[string]*pgPortal),
+	}
+}
+
+// sync handles a Sync. Outside a transaction block it ends the implicit
+// transaction, which closes every portal.
+func (s *pgSession) sync() {
+	if s.tx == nil {
+		s.closePortals()
+	}
+	s.failed = false
+}
+
+func (s *pgSession) closePortals() {
+	for _, p := range s.portals {
+		p.close()
+	}
+	clear(s.portals)
+}
+
+// pgMessage reads the fields of a frontend message. Reading past the end
+// sets short, which callers check once all fields are read.
+type pgMessage struct {
+	data  []byte
+	short bool
+}
+
+func (m *pgMessage) take(n int) []byte {
+	if n < 0 || n > len(m.data) {
+		m.short = true
+		m.data = nil
+		return nil
+	}
+	b := m.data[:n:n]
+	m.data = m.data[n:]
+	return b
+}
+
+func (m *pgMessage) string() string {
+	i := strings.IndexByte(string(m.data), 0)
+	if i < 0 {
+		m.short = true
+		m.data = nil
+		return ""
+	}
+	s := string(m.data[:i])
+	m.data = m.data[i+1:]
+	return s
+}
+
+func (m *pgMessage) int16() int16 {
+	b := m.take(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (m *pgMessage) int32() int32 {
+	b := m.take(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+// errInvalidMessage answers a message whose fields do not fit its length.
+var errInvalidMessage = &pgError{"08P01", "invalid message format"}
+
+// handleExtended handles a Parse, Bind, Describe, Execute, Close or Flush
+// message.
+func (h *PostgresHandler) handleExtended(conn net.Conn, s *pgSession, msgType byte, data []byte) *pgError {
+	m := &pgMessage{data: data}
+	
+	switch msgType {
+	case 'P':
+		name, query := m.string(), m.string()
+		types := make([]uint32, max(m.int16(), 0))
+		for i := range types {
+			types[i] = uint32(m.int32())
+		}
+		if m.short {
+			return errInvalidMessage
+		}
+		if _, exists := s.statements[name]; exists && name != "" {
+			return &pgError{"42P05", fmt.Sprintf("prepared statement \"%s\" already exists", name)}
+		}
+		
+		for len(types) < countParams(query) {
+			types = append(types, 0)
+		}
+		for i, oid := range types {
+			if oid == 0 {
+				types[i] = pgTextOID
+			}
+		}
+		s.statements[name] = &pgStatement{query: query, paramTypes: types}
+		h.sendMessage(conn, '1', nil)
+	
+	case 'B':
+		portal, name := m.string(), m.string()
+		formats := make([]int16, max(m.int16(), 0))
+		for i := range formats {
+			formats[i] = m.int16()
+		}
+		params := make([][]byte, max(m.int16(), 0))
+		for i := range params {
+			if n := m.int32(); n >= 0 {
+				params[i] = m.take(int(n))
+			}
+		}
+		results := make([]int16, max(m.int16(), 0))
+		for i := range results {
+			results[i] = m.int16()
+		}
+		if m.short {
+			return errInvalidMessage
+		}
+		
+		stmt, ok := s.statements[name]
+		if !ok {
+			return &pgError{"26000", fmt.Sprintf("prepared statement \"%s\" does not exist", name)}
+		}
+		if len(params) != len(stmt.paramTypes) {
+			return &pgError{"08P01", fmt.Sprintf("bind message supplies %d parameters, but prepared statement \"%s\" requires %d",
+				len(params), name, len(stmt.paramTypes))}
+		}
+		for i, raw := range params {
+			value, err := decodeParam(stmt.paramTypes[i], pgFormat(formats, i), raw)
+			if err != nil {
+				return err
+			}
+			params[i] = value
+		}
+		if old, ok := s.portals[portal]; ok {
+			old.close()
+		}
+		s.portals[portal] = &pgPortal{stmt: stmt, params: params, formats: results}
+		h.sendMessage(conn, '2', nil)
+	
+	case 'D':
+		kind, name := m.take(1), m.string()
+		if m.short {
+			return errInvalidMessage
+		}
+		if kind[0] == 'S' {
+			stmt, ok := s.statements[name]
+			if !ok {
+				return &pgError{"26000", fmt.Sprintf("prepared statement \"%s\" does not exist", name)}
+			}
+			desc := binary.BigEndian.AppendUint16(nil, uint16(len(stmt.paramTypes)))
+			for _, oid := range stmt.paramTypes {
+				desc = binary.BigEndian.AppendUint32(desc, oid)
+			}
+			h.sendMessage(conn, 't', desc)
+			h.sendDescription(conn, h.describe(stmt.query, make([][]byte, len(stmt.paramTypes))), nil)
+			return nil
+		}
+		p, ok := s.portals[name]
+		if !ok {
+			return &pgError{"34000", fmt.Sprintf("portal \"%s\" does not exist", name)}
+		}
+		h.sendDescription(conn, h.describe(p.stmt.query, p.params), p.formats)
+	
+	case 'E':
+		name, limit := m.string(), m.int32()
+		if m.short {
+			return errInvalidMessage
+		}
+		p, ok := s.portals[name]
+		if !ok {
+			return &pgError{"34000", fmt.Sprintf("portal \"%s\" does not exist", name)}
+		}
+		return h.executePortal(conn, s, p, int(limit))
+	
+	case 'C':
+		kind, name := m.take(1), m.string()
+		if m.short {
+			return errInvalidMessage
+		}
+		if kind[0] == 'S' {
+			delete(s.statements, name)
+		} else if p, ok := s.portals[name]; ok {
+			p.close()
+			delete(s.portals, name)
+		}
+		h.sendMessage(conn, '3', nil)
+	
+	case 'H':
+		// Replies are not buffered, so there is nothing to flush.
+	}
+	return nil
+}
+
+// describe returns the columns a statement returns, or nil if it returns
+// no rows, without running anything but a catalog query.
+func (h *PostgresHandler) describe(query string, params [][]byte) []string {
+	if result, ok := h.catalogQuery(bindText(query, params)); ok {
+		return result.columns
+	}
+	if strings.HasPrefix(strings.TrimSpace(strings.ToUpper(query)), "SELECT ") {
+		return []string{"key", "value"}
+	}
+	return nil
+}
+
+// sendDescription sends a RowDescription, or NoData for no columns.
+func (h *PostgresHandler) sendDescription(conn net.Conn, columns []string, formats []int16) {
+	if columns == nil {
+		h.sendMessage(conn, 'n', nil)
+		return
+	}
+	h.sendRowDescription(conn, columns, formats)
+}
+
+// executePortal runs a portal, or continues one a row limit suspended.
+// The rows follow the RowDescription sent for Describe, so none is sent
+// here.
+func (h *PostgresHandler) executePortal(conn net.Conn, s *pgSession, p *pgPortal, limit int) *pgError {
+	if p.next == nil {
+		result := h.run(s, p.stmt.query, p.params)
+		if result.err != nil {
+			return result.err
+		}
+		if result.columns == nil {
+			h.sendCommandComplete(conn, result.tag)
+			return nil
+		}
+		p.next, p.stop = iter.Pull(result.rows)
+		p.count = 0
+	}
+	
+	for sent := 0; limit <= 0 || sent < limit; sent++ {
+		row, ok := p.next()
+		if !ok {
+			p.close()
+			p.next, p.stop = nil, nil
+			h.sendCommandComplete(conn, fmt.Sprintf("SELECT %d", p.count))
+			return nil
+		}
+		h.sendDataRow(conn, row)
+		p.count++
+	}
+	// PortalSuspended: Execute again for more.
+	h.sendMessage(conn, 's', nil)
+	return nil
+}
+
+// pgFormat returns the format code for column or parameter i, from a list
+// with none for all text, one for all, or one for each.
+func pgFormat(formats []int16, i int) int16 {
+	switch {
+	case len(formats) == 0:
+		return 0
+	case len(formats) == 1:
+		return formats[0]
+	case i < len(formats):
+		return formats[i]
+	}
+	return 0
+}
+
+// decodeParam converts a bound parameter value to the text the statement
+// uses. Binary text and bytea values are the bytes themselves; binary
+// integers and booleans are converted to their text form, and bytea in
+// text format is decoded from its hex or escape form.
+func decodeParam(oid uint32, format int16, raw []byte) ([]byte, *pgError) {
+	if raw == nil {
+		return nil, nil
+	}
+	if format == 0 {
+		if oid == pgByteaOID {
+			return decodeBytea(raw)
+		}
+		return raw, nil
+	}
+	if format != 1 {
+		return nil, &pgError{"08P01", fmt.Sprintf("unsupported format code: %d", format)}
+	}
+	
+	invalid := &pgError{"22P03", fmt.Sprintf("incorrect binary data format for type %d", oid)}
+	switch oid {
+	case pgTextOID, pgVarcharOID, pgNameOID, pgByteaOID:
+		return raw, nil
+	case pgBoolOID:
+		if len(raw) != 1 {
+			return nil, invalid
+		}
+		if raw[0] != 0 {
+			return []byte("t"), nil
+		}
+		return []byte("f"), nil
+	case pgInt2OID:
+		if len(raw) != 2 {
+			return nil, invalid
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.BigEndian.Uint16(raw))), 10), nil
+	case pgInt4OID, pgOIDOID:
+		if len(raw) != 4 {
+			return nil, invalid
+		}
+		if oid == pgOIDOID {
+			return strconv.AppendUint(nil, uint64(binary.BigEndian.Uint32(raw)), 10), nil
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.BigEndian.Uint32(raw))), 10), nil
+	case pgInt8OID:
+		if len(raw) != 8 {
+			return nil, invalid
+		}
+		return strconv.AppendInt(nil, int64(binary.BigEndian.Uint64(raw)), 10), nil
+	}
+	return nil, &pgError{"22P03", fmt.Sprintf("binary format is not supported for type %d", oid)}
+}
+
+// decodeBytea decodes the text form of a bytea: \x and hex digits, or the
+// older escape form in which \\ is a backslash and \ooo an octal byte.
+func decodeBytea(text []byte) ([]byte, *pgError) {
+	invalid := &pgError{"22P02", "invalid input syntax for type bytea"}
+	if hexDigits, ok := strings.CutPrefix(string(text), `\x`); ok {
+		b, err := hex.DecodeString(hexDigits)
+		if err != nil {
+			return nil, invalid
+		}
+		return b, nil
+	}
+	
+	b := make([]byte, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			b = append(b, text[i])
+			continue
+		}
+		switch {
+		case i+1 < len(text) && text[i+1] == '\\':
+			b = append(b, '\\')
+			i++
+		case i+3 < len(text) && isOctal(text[i+1]) && isOctal(text[i+2]) && isOctal(text[i+3]) && text[i+1] <= '3':
+			b = append(b, (text[i+1]-'0')<<6|(text[i+2]-'0')<<3|(text[i+3]-'0'))
+			i += 3
+		default:
+			return nil, invalid
+		}
+	}
+	return b, nil
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// countParams returns the highest $n placeholder in query outside quotes.
+func countParams(query string) int {
+	n := 0
+	forParams(query, func(i, j, param int) {
+		n = max(n, param)
+	})
+	return n
+}
+
+// bindText substitutes params into query as SQL literals, for statements
+// evaluated from their text. Placeholders without a parameter are left.
+func bindText(query string, params [][]byte) string {
+	if len(params) == 0 {
+		return query
+	}
+	
+	var b strings.Builder
+	last := 0
+	forParams(query, func(i, j, param int) {
+		if param > len(params) {
+			return
+		}
+		b.WriteString(query[last:i])
+		if value := params[param-1]; value == nil {
+			b.WriteString("NULL")
+		} else {
+			b.WriteString("'" + strings.ReplaceAll(string(value), "'", "''") + "'")
+		}
+		last = j
+	})
+	b.WriteString(query[last:])
+	return b.String()
+}
+
+// forParams calls fn with the span and number of each $n placeholder in
+// query outside quotes.
+func forParams(query string, fn func(i, j, param int)) {
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if param, err := strconv.Atoi(query[i+1 : j]); err == nil && param > 0 {
+				fn(i, j, param)
+				i = j - 1
+			}
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+// postgresClient speaks the frontend side of the PostgreSQL protocol to a
+// PostgresHandler over a pipe. Messages are pipelined: they are written
+// while the replies are read.
+type postgresClient struct {
+	t       *testing.T
+	conn    net.Conn
+	pending []byte
+}
+
+// postgresSession serves a PostgresHandler over a pipe and completes the
+// startup handshake.
+func postgresSession(t *testing.T, c *cache.Cache) *postgresClient {
+	t.Helper()
+
+	h := NewPostgresHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+	client, server := net.Pipe()
+	go h.Handle(server)
+	t.Cleanup(func() { client.Close() })
+
+	p := &postgresClient{t: t, conn: client}
+	startup := binary.BigEndian.AppendUint32(nil, postgresProtocolVersion)
+	startup = append(startup, "user\x00test\x00\x00"...)
+	p.write(append(binary.BigEndian.AppendUint32(nil, uint32(4+len(startup))), startup...))
+	p.until('Z')
+	return p
+}
+
+func (p *postgresClient) write(b []byte) {
+	p.pending = append(p.pending, b...)
+}
+
+// send writes one message.
+func (p *postgresClient) send(msgType byte, data string) {
+	msg := binary.BigEndian.AppendUint32([]byte{msgType}, uint32(4+len(data)))
+	p.write(append(msg, data...))
+}
+
+// message builds the body of a message from strings, which are
+// NUL-terminated, int16 and int32 values, and []byte values, which are
+// length-prefixed; a nil []byte is NULL.
+func message(fields ...any) string {
+	var b []byte
+	for _, field := range fields {
+		switch field := field.(type) {
+		case string:
+			b = append(append(b, field...), 0)
+		case int16:
+			b = binary.BigEndian.AppendUint16(b, uint16(field))
+		case int32:
+			b = binary.BigEndian.AppendUint32(b, uint32(field))
+		case []byte:
+			if field == nil {
+				b = binary.BigEndian.AppendUint32(b, 0xffffffff)
+				continue
+			}
+			b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+			b = append(b, field...)
+		}
+	}
+	return string(b)
+}
+
+// until reads messages up to and including one of type last, and returns
+// them one per line: the type, then the SQLSTATE of an error, the tag of a
+// CommandComplete, the column names, marked if binary, or values, NULL as
+// \N, of a row, or the transaction status of a ReadyForQuery in a
+// transaction block. ParameterStatus messages are skipped.
+func (p *postgresClient) until(last byte) string {
+	p.t.Helper()
+
+	p.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if p.pending != nil {
+		go p.conn.Write(p.pending)
+		p.pending = nil
+	}
+	var out []string
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(p.conn, header); err != nil {
+			p.t.Fatal(err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+		if _, err := io.ReadFull(p.conn, data); err != nil {
+			p.t.Fatal(err)
+		}
+
+		line := string(header[0])
+		switch header[0] {
+		case 'C':
+			line += " " + string(bytes.TrimRight(data, "\x00"))
+		case 'E':
+			for _, field := range bytes.Split(data, []byte{0}) {
+				if len(field) > 0 && field[0] == 'C' {
+					line += " " + string(field[1:])
+				}
+			}
+		case 'T':
+			var names []string
+			for rest := data[2:]; len(rest) > 0; rest = rest[bytes.IndexByte(rest, 0)+19:] {
+				name := string(rest[:bytes.IndexByte(rest, 0)])
+				if rest[bytes.IndexByte(rest, 0)+18] == 1 {
+					name += ":binary"
+				}
+				names = append(names, name)
+			}
+			line += " " + strings.Join(names, "|")
+		case 'D':
+			var values []string
+			for rest := data[2:]; len(rest) > 0; {
+				n := int32(binary.BigEndian.Uint32(rest))
+				rest = rest[4:]
+				if n < 0 {
+					values = append(values, `\N`)
+					continue
+				}
+				values = append(values, string(rest[:n]))
+				rest = rest[n:]
+			}
+			line += " " + strings.Join(values, "|")
+		case 'Z':
+			if data[0] != 'I' {
+				line += " " + string(data[0])
+			}
+		case 'S':
+			continue
+		}
+		out = append(out, line)
+		if header[0] == last {
+			return strings.Join(out, "\n")
+		}
+	}
+}
+
+func TestPostgresCopy(t *testing.T) {
+	c := cache.New(1, 0)
+	p := postgresSession(t, c)
+
+	// Text format, with a row split across CopyData messages and escapes.
+	p.send('Q', "COPY users FROM STDIN\x00")
+	if got := p.until('G'); got != "G" {
+		t.Fatalf("COPY: got %q", got)
+	}
+	p.send('d', "alice\t1\nbob\tline\\none\\t\\\\")
+	p.send('d', "\ncarol\t\\x41\\101\n\\.\n")
+	p.send('c', "")
+	if got := p.until('Z'); got != "C COPY 3\nZ" {
+		t.Fatalf("COPY done: got %q", got)
+	}
+	for key, want := range map[string]string{"USERS:alice": "1", "USERS:bob": "line\none\t\\", "USERS:carol": "AA"} {
+		entry, found := c.Load([]byte(key))
+		if !found || string(entry.Value()) != want {
+			t.Errorf("%s: got %v, want %q", key, found, want)
+		}
+	}
+
+	// CSV with a header and the columns reversed.
+	p.send('Q', "copy items (value, key) from stdin with (format csv, header)\x00")
+	p.until('G')
+	p.send('d', "value,key\n\"a,b\",x\n")
+	p.send('c', "")
+	if got := p.until('Z'); got != "C COPY 1\nZ" {
+		t.Fatalf("CSV COPY: got %q", got)
+	}
+	if entry, found := c.Load([]byte("ITEMS:x")); !found || string(entry.Value()) != "a,b" {
+		t.Errorf("ITEMS:x: got %v", found)
+	}
+
+	// A bad row fails the COPY, but the data after it is still consumed.
+	p.send('Q', "COPY t FROM STDIN\x00")
+	p.until('G')
+	p.send('d', "a\t1\nb\n")
+	p.send('d', "c\t3\n")
+	p.send('c', "")
+	if got := p.until('Z'); got != "E 22P04\nZ" {
+		t.Fatalf("bad row: got %q", got)
+	}
+	if _, found := c.Load([]byte("T:c")); found {
+		t.Error("row after the error was stored")
+	}
+
+	p.send('Q', "COPY t FROM STDIN\x00")
+	p.until('G')
+	p.send('d', "\\N\tv\n")
+	p.send('c', "")
+	if got := p.until('Z'); got != "E 23502\nZ" {
+		t.Fatalf("NULL key: got %q", got)
+	}
+
+	p.send('Q', "COPY t FROM STDIN\x00")
+	p.until('G')
+	p.send('d', "d\t4\n")
+	p.send('f', "client gave up\x00")
+	if got := p.until('Z'); got != "E 57014\nZ" {
+		t.Fatalf("CopyFail: got %q", got)
+	}
+
+	// The connection is still usable.
+	p.send('Q', "SELECT * FROM users WHERE key = 'alice'\x00")
+	if got := p.until('Z'); !strings.Contains(got, "C SELECT") {
+		t.Fatalf("SELECT after COPY: got %q", got)
+	}
+}
+
+func TestPostgresCatalog(t *testing.T) {
+	c := cache.New(1, 0)
+	c.Store([]byte("USERS:1"), []byte("alice"), nil)
+	c.Store([]byte("USERS:2"), []byte("bob"), nil)
+	c.Store([]byte("ORDERS:1"), []byte("x"), nil)
+	c.Store([]byte("nocolon"), []byte("x"), nil)
+	p := postgresSession(t, c)
+
+	for _, tt := range []struct {
+		query, want string
+	}{
+		{"SELECT version()", "T version\nD PostgreSQL " + postgresServerVersion + " (gopogo)\nC SELECT 1\nZ"},
+		{"select current_database(), current_schema() AS s, 1, 'it''s'", "T current_database|s|?column?|?column?\nD gopogo|public|1|it's\nC SELECT 1\nZ"},
+		{"SHOW server_version;", "T server_version\nD " + postgresServerVersion + "\nC SHOW\nZ"},
+		{"SHOW nonsense", "E 42704\nZ"},
+		{"SET extra_float_digits = 3", "C SET\nZ"},
+		{"SELECT relname, reltuples FROM pg_catalog.pg_class WHERE relkind IN ('r', 'p')", "T relname|reltuples\nD orders|1\nD users|2\nC SELECT 2\nZ"},
+		{"SELECT c.oid, n.nspname, c.relname FROM pg_catalog.pg_class c LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace " +
+			"WHERE c.relname OPERATOR(pg_catalog.~) '^(users)$' COLLATE pg_catalog.default AND pg_catalog.pg_table_is_visible(c.oid) ORDER BY 2, 3;",
+			"T oid|nspname|relname\nD 16386|public|users\nC SELECT 1\nZ"},
+		{`SELECT table_name AS "Table", column_name FROM information_schema.columns WHERE table_name = 'orders'`,
+			"T Table|column_name\nD orders|key\nD orders|value\nC SELECT 2\nZ"},
+		{"SELECT count(*) FROM pg_tables", "T count\nD 2\nC SELECT 1\nZ"},
+		{"SELECT nspname, nspacl FROM pg_namespace WHERE nspname <> 'pg_catalog' LIMIT 1", "T nspname|nspacl\nD public|\\N\nC SELECT 1\nZ"},
+	} {
+		p.send('Q', tt.query+"\x00")
+		if got := p.until('Z'); got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.query, got, tt.want)
+		}
+	}
+
+	// Other queries still reach the table:key namespace.
+	p.send('Q', "SELECT * FROM users WHERE key = '1'\x00")
+	if got := p.until('Z'); got != "T key|value\nD 1|alice\nC SELECT 1\nZ" {
+		t.Errorf("SELECT from a table: got %q", got)
+	}
+}
+
+func TestPostgresExtended(t *testing.T) {
+	c := cache.New(1, 0)
+	p := postgresSession(t, c)
+
+	// Binary text and bytea parameters are stored as they are.
+	p.send('P', message("ins", "INSERT INTO t VALUES ($1, $2)", int16(2), int32(pgTextOID), int32(pgByteaOID)))
+	p.send('B', message("", "ins", int16(1), int16(1), int16(2), []byte("Key One"), []byte("\x00\xffhi"), int16(0)))
+	p.send('E', message("", int32(0)))
+	p.send('S', "")
+	if got := p.until('Z'); got != "1\n2\nC INSERT 0 1\nZ" {
+		t.Fatalf("INSERT: got %q", got)
+	}
+	if entry, found := c.Load([]byte("T:Key One")); !found || string(entry.Value()) != "\x00\xffhi" {
+		t.Fatalf("stored value: got %v", found)
+	}
+
+	// Describe reports the parameter types and the result formats.
+	p.send('P', message("", "SELECT * FROM t WHERE key = $1", int16(0)))
+	p.send('D', message("S", ""))
+	p.send('B', message("", "", int16(0), int16(1), []byte("Key One"), int16(1), int16(1)))
+	p.send('D', message("P", ""))
+	p.send('E', message("", int32(0)))
+	p.send('S', "")
+	want := "1\nt\nT key|value\n2\nT key:binary|value:binary\nD Key One|\x00\xffhi\nC SELECT 1\nZ"
+	if got := p.until('Z'); got != want {
+		t.Fatalf("SELECT: got %q, want %q", got, want)
+	}
+
+	// Binary integers and text bytea are converted to text.
+	p.send('P', message("", "SELECT $1 AS n, $2 AS b", int16(2), int32(pgInt4OID), int32(pgByteaOID)))
+	p.send('B', message("", "", int16(2), int16(1), int16(0), int16(2), []byte{0xff, 0xff, 0xff, 0xd6}, []byte(`\x6869`), int16(0)))
+	p.send('E', message("", int32(0)))
+	p.send('S', "")
+	if got := p.until('Z'); got != "1\n2\nD -42|hi\nC SELECT 1\nZ" {
+		t.Fatalf("converted parameters: got %q", got)
+	}
+
+	// A row limit suspends the portal until the next Execute.
+	c.Store([]byte("T:a"), []byte("1"), nil)
+	c.Store([]byte("T:b"), []byte("2"), nil)
+	p.send('P', message("", "SELECT * FROM t", int16(0)))
+	p.send('B', message("", "", int16(0), int16(0), int16(0)))
+	p.send('E', message("", int32(2)))
+	p.send('H', "")
+	if got := p.until('s'); strings.Count(got, "D ") != 2 {
+		t.Fatalf("first Execute: got %q", got)
+	}
+	p.send('E', message("", int32(2)))
+	p.send('S', "")
+	if got := p.until('Z'); !strings.HasSuffix(got, "C SELECT 3\nZ") || strings.Count(got, "D ") != 1 {
+		t.Fatalf("second Execute: got %q", got)
+	}
+
+	// After an error, messages up to Sync are ignored.
+	p.send('E', message("nope", int32(0)))
+	p.send('P', message("", "DELETE FROM t WHERE key = 'a'", int16(0)))
+	p.send('S', "")
+	if got := p.until('Z'); got != "E 34000\nZ" {
+		t.Fatalf("error: got %q", got)
+	}
+	if _, found := c.Load([]byte("T:a")); !found {
+		t.Error("statement after the error ran")
+	}
+}
+
+func TestPostgresKeys(t *testing.T) {
+	c := cache.New(1, 0)
+	c.Store([]byte("sess:1"), []byte("alice"), &cache.StoreOptions{TTL: time.Hour})
+	c.Store([]byte("sess:2"), []byte("bob"), nil)
+	c.Store([]byte("user:1"), []byte("{}"), nil)
+	p := postgresSession(t, c)
+
+	for _, tt := range []struct {
+		query, want string
+	}{
+		{"SELECT * FROM keys WHERE key='sess:2'", "T key|ttl|size\nD sess:2|-1|3\nC SELECT 1\nZ"},
+		{"SELECT key, ttl > 0 FROM keys WHERE key = 'sess:1' AND ttl <> '-1'", "T key|?column?\nD sess:1|\\N\nC SELECT 1\nZ"},
+		{"SELECT count(*) FROM keys WHERE key LIKE 'sess:%'", "T count\nD 2\nC SELECT 1\nZ"},
+		{"SELECT count(*) FROM keys WHERE key NOT LIKE 'sess:1' AND key ILIKE 'SESS:_'", "T count\nD 1\nC SELECT 1\nZ"},
+		{"SELECT size FROM keys WHERE key ILIKE 'USER%'", "T size\nD 2\nC SELECT 1\nZ"},
+	} {
+		p.send('Q', tt.query+"\x00")
+		if got := p.until('Z'); got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestPostgresMessageLength(t *testing.T) {
+	for _, length := range []uint32{0, 3, 0xffffffff} {
+		p := postgresSession(t, cache.New(1, 0))
+		p.write(binary.BigEndian.AppendUint32([]byte{'Q'}, length))
+		if got := p.until('E'); got != "E 08P01" {
+			t.Errorf("length %d: got %q", length, got)
+		}
+		// The stream cannot be followed after a bad length.
+		if _, err := p.conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("length %d: connection still open: %v", length, err)
+		}
+	}
+
+	// A startup message too short or too long is refused without a reply.
+	for _, length := range []uint32{4, postgresMaxStartupLen + 1} {
+		h := NewPostgresHandler(cache.New(1, 0), &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+		client, server := net.Pipe()
+		go h.Handle(server)
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		go client.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, length), postgresProtocolVersion))
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("startup length %d: got %v, want EOF", length, err)
+		}
+		client.Close()
+	}
+}
+
+// testCertificate returns a self-signed certificate for localhost.
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestPostgresSSLRequest(t *testing.T) {
+	sslRequest := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), postgresSSLRequest)
+	ready := wireMessage('R', "\x00\x00\x00\x00") + wireMessage('Z', "I")
+
+	// connect sends an SSLRequest to a handler with config and returns
+	// the client end of the connection and the one-byte answer.
+	connect := func(t *testing.T, config *Config, request []byte) (net.Conn, byte) {
+		t.Helper()
+
+		config.Limits = ratelimit.NewRegistry(ratelimit.Limits{})
+		h := NewPostgresHandler(cache.New(1, 0), config)
+		client, server := net.Pipe()
+		go h.Handle(server)
+		t.Cleanup(func() { client.Close() })
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+
+		go client.Write(request)
+		answer := make([]byte, 1)
+		if _, err := client.Read(answer); err != nil {
+			return client, 0
+		}
+		return client, answer[0]
+	}
+	// startup sends the startup message on conn and checks the reply.
+	startup := func(t *testing.T, conn net.Conn) {
+		t.Helper()
+
+		go io.WriteString(conn, pgStartup())
+		if got, err := postgresReply(bufio.NewReader(conn)); got != ready {
+			t.Errorf("startup answered %q (%v), want %q", got, err, ready)
+		}
+	}
+
+	t.Run("without TLS", func(t *testing.T) {
+		conn, answer := connect(t, &Config{}, sslRequest)
+		if answer != 'N' {
+			t.Fatalf("SSLRequest answered %q, want N", answer)
+		}
+		// The client carries on in plaintext.
+		startup(t, conn)
+	})
+
+	t.Run("with TLS", func(t *testing.T) {
+		config := &Config{TLS: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}}
+		conn, answer := connect(t, config, sslRequest)
+		if answer != 'S' {
+			t.Fatalf("SSLRequest answered %q, want S", answer)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A second SSLRequest, already over TLS, is declined.
+		go tlsConn.Write(sslRequest)
+		again := make([]byte, 1)
+		if _, err := tlsConn.Read(again); err != nil || again[0] != 'N' {
+			t.Fatalf("SSLRequest over TLS answered %q, %v, want N", again, err)
+		}
+		startup(t, tlsConn)
+	})
+
+	t.Run("with a body", func(t *testing.T) {
+		request := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 12), postgresSSLRequest)
+		config := &Config{TLS: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}}
+		if _, answer := connect(t, config, append(request, 0, 0, 0, 0)); answer != 0 {
+			t.Errorf("SSLRequest with a body answered %q, want the connection closed", answer)
+		}
+	})
+}
+
+func TestPostgresTransaction(t *testing.T) {
+	c := cache.New(1, 0)
+	c.Store([]byte("T:A"), []byte("1"), nil)
+	p := postgresSession(t, c)
+	other := postgresSession(t, c)
+
+	p.send('Q', "BEGIN\x00")
+	if got := p.until('Z'); got != "C BEGIN\nZ T" {
+		t.Fatalf("BEGIN: got %q", got)
+	}
+	p.send('Q', "INSERT INTO t VALUES ('b', '2')\x00")
+	p.send('Q', "DELETE FROM t WHERE key = 'a'\x00")
+	p.send('Q', "SELECT * FROM t\x00")
+	want := "C INSERT 0 1\nZ T\nC DELETE 1\nZ T\nT key|value\nD T:B|2\nC SELECT 1\nZ T"
+	if got := p.until('Z') + "\n" + p.until('Z') + "\n" + p.until('Z'); got != want {
+		t.Fatalf("in the block: got %q, want %q", got, want)
+	}
+
+	// Another connection sees none of the writes until COMMIT.
+	other.send('Q', "SELECT * FROM t\x00")
+	if got := other.until('Z'); got != "T key|value\nD T:A|1\nC SELECT 1\nZ" {
+		t.Fatalf("before COMMIT: got %q", got)
+	}
+	p.send('Q', "COMMIT\x00")
+	if got := p.until('Z'); got != "C COMMIT\nZ" {
+		t.Fatalf("COMMIT: got %q", got)
+	}
+	if _, found := c.Load([]byte("T:A")); found {
+		t.Error("T:A survived the COMMIT")
+	}
+	if entry, found := c.Load([]byte("T:B")); !found || string(entry.Value()) != "2" {
+		t.Errorf("T:B: got %v", found)
+	}
+
+	// After an error, statements fail until the block ends, and the block
+	// rolls back.
+	p.send('Q', "BEGIN; \x00")
+	p.until('Z')
+	p.send('Q', "INSERT INTO t VALUES ('c', '3')\x00")
+	p.send('Q', "VACUUM\x00")
+	p.send('Q', "SELECT * FROM t\x00")
+	p.send('Q', "COMMIT\x00")
+	want = "C INSERT 0 1\nZ T\nE 42601\nZ E\nE 25P02\nZ E\nC ROLLBACK\nZ"
+	if got := p.until('Z') + "\n" + p.until('Z') + "\n" + p.until('Z') + "\n" + p.until('Z'); got != want {
+		t.Fatalf("failed block: got %q, want %q", got, want)
+	}
+	if _, found := c.Load([]byte("T:C")); found {
+		t.Error("write in a failed block was applied")
+	}
+
+	p.send('Q', "START TRANSACTION\x00")
+	p.send('Q', "UPDATE t SET value = '9' WHERE key = 'b'\x00")
+	p.send('Q', "ROLLBACK\x00")
+	p.until('Z')
+	p.until('Z')
+	if got := p.until('Z'); got != "C ROLLBACK\nZ" {
+		t.Fatalf("ROLLBACK: got %q", got)
+	}
+	if entry, _ := c.Load([]byte("T:B")); string(entry.Value()) != "2" {
+		t.Errorf("T:B after ROLLBACK: got %q", entry.Value())
+	}
+}
@@ -0,0 +1,211 @@
+package protocol
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// errAborted answers statements in a transaction block after one failed.
+var errAborted = &pgError{"25P02", "current transaction is aborted, commands ignored until end of transaction block"}
+
+// pgTransaction is an open transaction block. Its writes are buffered,
+// the last one per key, until COMMIT applies them all at once. Reads in
+// the block see its own writes. A nil *pgTransaction reads and writes
+// the cache directly.
+type pgTransaction struct {
+	writes map[string]cache.Op
+	order  []string
+	failed bool
+}
+
+func (tx *pgTransaction) write(op cache.Op) {
+	key := string(op.Key)
+	if _, ok := tx.writes[key]; !ok {
+		tx.order = append(tx.order, key)
+	}
+	tx.writes[key] = op
+}
+
+// ops returns the buffered writes in the order their keys were first
+// written.
+func (tx *pgTransaction) ops() []cache.Op {
+	ops := make([]cache.Op, len(tx.order))
+	for i, key := range tx.order {
+		ops[i] = tx.writes[key]
+	}
+	return ops
+}
+
+func (tx *pgTransaction) load(ks Keyspace, key []byte) (value []byte, flags uint32, found bool) {
+	if tx != nil {
+		if op, ok := tx.writes[string(key)]; ok {
+			if op.Delete {
+				return nil, 0, false
+			}
+			return op.Value, op.Options.Flags, true
+		}
+	}
+	entry, found := ks.Load(key)
+	if !found {
+		return nil, 0, false
+	}
+	return entry.Value(), entry.Flags(), true
+}
+
+// store writes key, or buffers the write after checking its size so that
+// COMMIT fails only for reasons it could not have known.
+func (tx *pgTransaction) store(ks Keyspace, key, value []byte, opts *cache.StoreOptions) error {
+	if tx == nil {
+		return ks.Store(key, value, opts)
+	}
+	if err := ks.CheckSize(len(key), len(value)); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &cache.StoreOptions{}
+	}
+	tx.write(cache.Op{Key: key, Value: value, Options: opts})
+	return nil
+}
+
+func (tx *pgTransaction) delete(ks Keyspace, key []byte) bool {
+	if tx == nil {
+		return ks.Delete(key)
+	}
+	_, _, found := tx.load(ks, key)
+	if found {
+		tx.write(cache.Op{Key: key, Delete: true})
+	}
+	return found
+}
+
+// iterate calls fn with the key and value of every entry under prefix.
+func (tx *pgTransaction) iterate(ks Keyspace, prefix string, fn func(key, value []byte) bool) {
+	stopped := false
+	ks.IterateSnapshot(func(entry *cache.Entry) bool {
+		if !bytes.HasPrefix(entry.Key(), []byte(prefix)) {
+			return true
+		}
+		if tx != nil {
+			if _, ok := tx.writes[string(entry.Key())]; ok {
+				return true
+			}
+		}
+		stopped = !fn(entry.Key(), entry.Value())
+		return !stopped
+	})
+	if tx == nil || stopped {
+		return
+	}
+	
+	var keys []string
+	for key, op := range tx.writes {
+		if !op.Delete && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn([]byte(key), tx.writes[key].Value) {
+			return
+		}
+	}
+}
+
+// status returns the transaction status ReadyForQuery reports.
+func (s *pgSession) status() byte {
+	switch {
+	case s.tx == nil:
+		return 'I'
+	case s.tx.failed:
+		return 'E'
+	}
+	return 'T'
+}
+
+// aborted reports whether the session is in a failed transaction block.
+func (s *pgSession) aborted() bool {
+	return s.tx != nil && s.tx.failed
+}
+
+// abort marks an open transaction block failed.
+func (s *pgSession) abort() {
+	if s.tx != nil {
+		s.tx.failed = true
+	}
+}
+
+// fail handles an error in the extended protocol, which skips messages
+// up to the next Sync and fails an open transaction block.
+func (s *pgSession) fail() {
+	s.failed = true
+	s.abort()
+}
+
+// run executes a statement in the session: BEGIN, COMMIT and ROLLBACK
+// open and close a transaction block, in which a failed statement makes
+// every later one fail until the block ends.
+func (h *PostgresHandler) run(s *pgSession, query string, params [][]byte) *pgResult {
+	switch transactionVerb(query) {
+	case "BEGIN":
+		if s.tx == nil {
+			s.tx = &pgTransaction{writes: make(map[string]cache.Op)}
+		}
+		return &pgResult{tag: "BEGIN"}
+	
+	case "COMMIT":
+		tx := s.tx
+		s.tx = nil
+		if tx != nil && tx.failed {
+			return &pgResult{tag: "ROLLBACK"}
+		}
+		if tx != nil {
+			if err := h.cache.Apply(tx.ops()); err != nil {
+				return pgFailure("54000", err.Error())
+			}
+		}
+		return &pgResult{tag: "COMMIT"}
+	
+	case "ROLLBACK":
+		s.tx = nil
+		return &pgResult{tag: "ROLLBACK"}
+	}
+	
+	if s.aborted() {
+		return &pgResult{err: errAborted}
+	}
+	result := h.execute(query, params, s.tx)
+	if result.err != nil {
+		s.abort()
+	}
+	return result
+}
+
+// transactionVerb returns BEGIN, COMMIT or ROLLBACK for a statement that
+// starts, commits or rolls back a transaction block, in any of their
+// spellings, or "" for any other.
+func transactionVerb(query string) string {
+	fields := strings.Fields(strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(query), ";")))
+	if len(fields) == 0 {
+		return ""
+	}
+	switch fields[0] {
+	case "BEGIN":
+		return "BEGIN"
+	case "START":
+		if len(fields) > 1 && fields[1] == "TRANSACTION" {
+			return "BEGIN"
+		}
+	case "COMMIT", "END":
+		return "COMMIT"
+	case "ROLLBACK", "ABORT":
+		// ROLLBACK TO SAVEPOINT is not supported.
+		if len(fields) == 1 || fields[1] == "WORK" || fields[1] == "TRANSACTION" {
+			return "ROLLBACK"
+		}
+	}
+	return ""
+}
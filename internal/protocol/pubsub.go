@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// subscriberBuffer is how many messages a subscriber may fall behind by
+// before further messages to it are dropped.
+const subscriberBuffer = 1024
+
+// pubsubMessage is a message delivered to a subscriber. Pattern is set
+// when it matched a pattern subscription rather than the channel itself.
+type pubsubMessage struct {
+	Pattern string
+	Channel string
+	Message string
+}
+
+// broker fans published messages out to subscribers. Publishing never
+// blocks: a subscriber that falls more than subscriberBuffer messages
+// behind misses messages, counted in its dropped field.
+type broker struct {
+	mu    sync.RWMutex
+	subs  map[*subscriber]struct{}
+	count atomic.Int32
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[*subscriber]struct{})}
+}
+
+// subscriber is one client's set of channel and pattern subscriptions.
+type subscriber struct {
+	b        *broker
+	messages chan pubsubMessage
+	dropped  atomic.Uint64
+
+	mu       sync.Mutex
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+// subscribe returns a subscriber with no subscriptions yet. Call close
+// when done with it.
+func (b *broker) subscribe() *subscriber {
+	s := &subscriber{
+		b:        b,
+		messages: make(chan pubsubMessage, subscriberBuffer),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	b.count.Add(1)
+	return s
+}
+
+func (s *subscriber) close() {
+	s.b.mu.Lock()
+	delete(s.b.subs, s)
+	s.b.mu.Unlock()
+	s.b.count.Add(-1)
+}
+
+// set adds or, if on is false, removes channel or pattern subscriptions,
+// all of them if names is empty, and returns how many subscriptions
+// remain.
+func (s *subscriber) set(names []string, pattern, on bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.channels
+	if pattern {
+		m = s.patterns
+	}
+	if !on && len(names) == 0 {
+		clear(m)
+	}
+	for _, name := range names {
+		if on {
+			m[name] = true
+		} else {
+			delete(m, name)
+		}
+	}
+	return len(s.channels) + len(s.patterns)
+}
+
+// match returns the message for channel if s subscribes to it.
+func (s *subscriber) match(channel, message string) (pubsubMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.channels[channel] {
+		return pubsubMessage{Channel: channel, Message: message}, true
+	}
+	for pattern := range s.patterns {
+		if matchPattern(pattern, channel) {
+			return pubsubMessage{Pattern: pattern, Channel: channel, Message: message}, true
+		}
+	}
+	return pubsubMessage{}, false
+}
+
+// publish delivers message to every subscriber of channel and returns how
+// many received it.
+func (b *broker) publish(channel, message string) int {
+	if b.count.Load() == 0 {
+		return 0
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	n := 0
+	for s := range b.subs {
+		msg, ok := s.match(channel, message)
+		if !ok {
+			continue
+		}
+		select {
+		case s.messages <- msg:
+			n++
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	return n
+}
+
+// keyspaceHooks returns hooks that publish keyspace notifications as
+// Redis does: the event name on __keyspace@0__:<key> and the key on
+// __keyevent@0__:<event>, for the events set, del, expired and evicted.
+// Only keys under prefix are reported, without it.
+func (b *broker) keyspaceHooks(prefix string) *cache.Hooks {
+	notify := func(key []byte, event string) {
+		if b.count.Load() == 0 || !strings.HasPrefix(string(key), prefix) {
+			return
+		}
+		name := string(key[len(prefix):])
+		b.publish(keyspacePrefix+name, event)
+		b.publish("__keyevent@0__:"+event, name)
+	}
+
+	return &cache.Hooks{
+		OnStore:  func(entry *cache.Entry) { notify(entry.Key(), "set") },
+		OnDelete: func(key []byte) { notify(key, "del") },
+		OnExpire: func(key []byte) { notify(key, "expired") },
+		OnEvict:  func(entry *cache.Entry) { notify(entry.Key(), "evicted") },
+	}
+}
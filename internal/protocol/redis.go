@@ -2,41 +2,81 @@ package protocol
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
-
+	
 	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/clients"
+	"github.com/grumpylabs/gopogo/internal/persistence"
 )
 
 type RedisHandler struct {
-	cache        *cache.Cache
-	auth         string
+	cache        Keyspace
+	config       *Config
 	authRequired bool
+	commandIndex map[string]*redisCommand
+	// noTouch is a copy of the handler serving connections that turned on
+	// CLIENT NO-TOUCH.
+	noTouch *RedisHandler
+	traffic *trafficCounters
 }
 
-func NewRedisHandler(cache *cache.Cache, auth string) *RedisHandler {
-	return &RedisHandler{
-		cache:        cache,
-		auth:         auth,
-		authRequired: auth != "",
+func NewRedisHandler(cache *cache.Cache, config *Config) *RedisHandler {
+	h := &RedisHandler{
+		cache:        keyspace(cache, config, TypeRedis),
+		traffic:      config.Traffic.of(TypeRedis.String()),
+		config:       config,
+		authRequired: len(config.Auth) > 0,
+		commandIndex: newCommandIndex(config),
 	}
+	h.noTouch = h.withKeyspace(noTouchKeyspace{h.cache})
+	return h
 }
 
 func (h *RedisHandler) Handle(conn net.Conn) {
 	defer conn.Close()
 	
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-	authenticated := !h.authRequired
+	conn = h.traffic.wrap(conn)
+	limiter := h.config.Limits.Open(conn.RemoteAddr())
+	defer limiter.Close()
+	
+	reader := newRESPReader(limiter.Reader(conn), h.config)
+	c := &redisClient{
+		conn:          conn,
+		reader:        reader,
+		replies:       replyWriter{w: conn},
+		authenticated: !h.authRequired,
+	}
+	c.writer = bufio.NewWriter(&c.replies)
+	writer := c.writer
+	var name []byte
 	
 	for {
-		cmd, err := h.readCommand(reader)
+		var start time.Time
+		if c.trace != nil {
+			// Parsing is timed from the command's first byte, not from
+			// when the client went idle.
+			reader.Wait()
+			start = time.Now()
+		}
+		
+		cmd, err := reader.ReadCommand()
 		if err != nil {
-			if err != io.EOF {
+			var perr *protocolError
+			if errors.As(err, &perr) {
+				h.config.Errors.count(TypeRedis, errorParse)
+				h.writeError(writer, "ERR "+perr.Error())
+				writer.Flush()
+			} else if err != io.EOF {
 				h.writeError(writer, err.Error())
 				writer.Flush()
 			}
@@ -46,219 +86,177 @@ func (h *RedisHandler) Handle(conn net.Conn) {
 		if len(cmd) == 0 {
 			continue
 		}
+		h.traffic.command()
 		
-		cmdName := strings.ToUpper(cmd[0])
-		
-		if !authenticated && cmdName != "AUTH" && cmdName != "PING" {
-			h.writeError(writer, "NOAUTH Authentication required")
+		if !limiter.AllowCommand() {
+			if command := h.commandIndex[string(appendUpper(name[:0], cmd[0]))]; command != nil {
+				h.config.Commands.reject(command.name)
+			}
+			h.writeError(writer, "ERR rate limit exceeded")
 			writer.Flush()
 			continue
 		}
 		
-		switch cmdName {
-		case "AUTH":
-			if len(cmd) != 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'auth' command")
-			} else if cmd[1] == h.auth {
-				authenticated = true
-				h.writeSimpleString(writer, "OK")
-			} else {
-				h.writeError(writer, "ERR invalid password")
-			}
-			
-		case "PING":
-			if len(cmd) == 1 {
-				h.writeSimpleString(writer, "PONG")
-			} else {
-				h.writeBulkString(writer, cmd[1])
-			}
-			
-		case "GET":
-			if len(cmd) != 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'get' command")
-			} else {
-				h.handleGet(writer, cmd[1])
-			}
-			
-		case "SET":
-			if len(cmd) < 3 {
-				h.writeError(writer, "ERR wrong number of arguments for 'set' command")
-			} else {
-				h.handleSet(writer, cmd[1:])
-			}
-			
-		case "DEL":
-			if len(cmd) < 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'del' command")
-			} else {
-				h.handleDel(writer, cmd[1:])
-			}
-			
-		case "EXISTS":
-			if len(cmd) < 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'exists' command")
-			} else {
-				h.handleExists(writer, cmd[1:])
-			}
-			
-		case "INCR":
-			if len(cmd) != 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'incr' command")
-			} else {
-				h.handleIncr(writer, cmd[1], 1)
-			}
-			
-		case "DECR":
-			if len(cmd) != 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'decr' command")
-			} else {
-				h.handleIncr(writer, cmd[1], -1)
-			}
-			
-		case "INCRBY":
-			if len(cmd) != 3 {
-				h.writeError(writer, "ERR wrong number of arguments for 'incrby' command")
-			} else {
-				delta, err := strconv.ParseInt(cmd[2], 10, 64)
-				if err != nil {
-					h.writeError(writer, "ERR value is not an integer or out of range")
-				} else {
-					h.handleIncr(writer, cmd[1], delta)
-				}
-			}
-			
-		case "DECRBY":
-			if len(cmd) != 3 {
-				h.writeError(writer, "ERR wrong number of arguments for 'decrby' command")
-			} else {
-				delta, err := strconv.ParseInt(cmd[2], 10, 64)
-				if err != nil {
-					h.writeError(writer, "ERR value is not an integer or out of range")
-				} else {
-					h.handleIncr(writer, cmd[1], -delta)
-				}
-			}
-			
-		case "MGET":
-			if len(cmd) < 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'mget' command")
-			} else {
-				h.handleMGet(writer, cmd[1:])
-			}
-			
-		case "MSET":
-			if len(cmd) < 3 || len(cmd)%2 == 0 {
-				h.writeError(writer, "ERR wrong number of arguments for 'mset' command")
-			} else {
-				h.handleMSet(writer, cmd[1:])
-			}
-			
-		case "EXPIRE":
-			if len(cmd) != 3 {
-				h.writeError(writer, "ERR wrong number of arguments for 'expire' command")
-			} else {
-				h.handleExpire(writer, cmd[1], cmd[2])
-			}
-			
-		case "TTL":
-			if len(cmd) != 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'ttl' command")
-			} else {
-				h.handleTTL(writer, cmd[1])
-			}
-			
-		case "KEYS":
-			if len(cmd) != 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'keys' command")
-			} else {
-				h.handleKeys(writer, cmd[1])
-			}
-			
-		case "FLUSHDB", "FLUSHALL":
-			h.cache.Clear()
-			h.writeSimpleString(writer, "OK")
-			
-		case "DBSIZE":
-			h.writeInteger(writer, int64(h.cache.NumItems()))
-			
-		case "INFO":
-			h.handleInfo(writer)
-			
-		case "QUIT":
-			h.writeSimpleString(writer, "OK")
+		if c.trace != nil {
+			h.traceCommand(c, appendUpper(name[:0], cmd[0]), cmd, start, time.Now())
+		} else {
+			h.dispatch(c, appendUpper(name[:0], cmd[0]), cmd)
 			writer.Flush()
+		}
+		if c.quit {
 			return
-			
-		case "SELECT":
-			h.writeSimpleString(writer, "OK")
-			
-		case "ECHO":
-			if len(cmd) != 2 {
-				h.writeError(writer, "ERR wrong number of arguments for 'echo' command")
-			} else {
-				h.writeBulkString(writer, cmd[1])
-			}
-			
-		default:
-			h.writeError(writer, fmt.Sprintf("ERR unknown command '%s'", cmdName))
 		}
-		
-		writer.Flush()
 	}
 }
 
-func (h *RedisHandler) readCommand(reader *bufio.Reader) ([]string, error) {
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
+// redisClient is the state of one Redis connection.
+type redisClient struct {
+	conn          net.Conn
+	reader        *respReader
+	writer        *bufio.Writer
+	// replies is what writer flushes to.
+	replies       replyWriter
+	authenticated bool
+	// noTouch is set by CLIENT NO-TOUCH.
+	noTouch bool
+	// trace is set by DEBUG TRACE ON.
+	trace *commandTrace
+	// quit is set by QUIT to close the connection once the reply is
+	// written.
+	quit bool
+}
+
+// dispatch looks cmd up by its upper-cased name, checks that the client
+// may run it and that it has the right number of arguments, and runs it.
+func (h *RedisHandler) dispatch(c *redisClient, name []byte, cmd [][]byte) {
+	// Indexing with string(name) does not allocate.
+	command := h.commandIndex[string(name)]
 	
-	line = strings.TrimSpace(line)
-	if len(line) == 0 {
-		return nil, nil
+	if !c.authenticated && (command == nil || !command.hasFlag("no_auth")) {
+		if command != nil {
+			h.config.Commands.reject(command.name)
+		}
+		h.config.Errors.count(TypeRedis, errorAuth)
+		h.writeError(c.writer, "NOAUTH Authentication required.")
+		return
+	}
+	if command == nil {
+		h.writeUnknownCommand(c.writer, cmd)
+		return
+	}
+	if !command.checkArity(len(cmd)) {
+		h.config.Commands.reject(command.name)
+		h.writeError(c.writer, fmt.Sprintf("ERR wrong number of arguments for '%s' command", command.name))
+		return
 	}
 	
-	if line[0] == '*' {
-		return h.readArray(reader, line)
+	if c.noTouch {
+		h = h.noTouch
 	}
 	
-	return strings.Fields(line), nil
+	// Flushing around the command leaves its reply alone in replies,
+	// whose first byte tells whether it was an error.
+	c.writer.Flush()
+	c.replies.reset()
+	start := time.Now()
+	command.run(h, c, cmd[1:])
+	elapsed := time.Since(start)
+	c.writer.Flush()
+	h.config.Commands.record(command.name, elapsed, c.replies.failed)
 }
 
-func (h *RedisHandler) readArray(reader *bufio.Reader, line string) ([]string, error) {
-	count, err := strconv.Atoi(line[1:])
+func (h *RedisHandler) handleAuth(c *redisClient, password []byte) {
+	if !h.authRequired {
+		h.writeError(c.writer, "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	} else if h.config.checkAuth(string(password)) {
+		c.authenticated = true
+		h.writeSimpleString(c.writer, "OK")
+	} else {
+		h.config.Errors.count(TypeRedis, errorAuth)
+		h.writeError(c.writer, "WRONGPASS invalid username-password pair or user is disabled.")
+	}
+}
+
+func (h *RedisHandler) handlePing(writer *bufio.Writer, args [][]byte) {
+	if len(args) == 0 {
+		h.writeSimpleString(writer, "PONG")
+	} else {
+		h.writeBulk(writer, args[0])
+	}
+}
+
+func (h *RedisHandler) handleQuit(c *redisClient) {
+	h.writeSimpleString(c.writer, "OK")
+	c.quit = true
+}
+
+// handleReset implements RESET. There is no MULTI or subscription state to
+// discard; the connection goes back to unauthenticated, with NO-TOUCH and
+// DEBUG TRACE off.
+func (h *RedisHandler) handleReset(c *redisClient) {
+	c.authenticated = !h.authRequired
+	c.noTouch = false
+	c.trace = nil
+	h.writeSimpleString(c.writer, "RESET")
+}
+
+// handleIncrBy implements INCRBY, and DECRBY with sign -1.
+func (h *RedisHandler) handleIncrBy(writer *bufio.Writer, key, delta []byte, sign int64) {
+	n, err := parseInt(delta)
 	if err != nil {
-		return nil, err
+		h.writeError(writer, "ERR value is not an integer or out of range")
+		return
 	}
-	
-	args := make([]string, 0, count)
-	
-	for i := 0; i < count; i++ {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-		
-		line = strings.TrimSpace(line)
-		if len(line) == 0 || line[0] != '$' {
-			return nil, fmt.Errorf("expected bulk string")
-		}
-		
-		size, err := strconv.Atoi(line[1:])
-		if err != nil {
-			return nil, err
+	h.handleIncr(writer, key, sign*n)
+}
+
+func (h *RedisHandler) handleDelPrefix(writer *bufio.Writer, prefix []byte) {
+	h.cache.DeletePrefix(prefix)
+	h.writeSimpleString(writer, "Background prefix delete started")
+}
+
+// writeSizeError writes the error for a key or value over the size
+// limits and reports whether err was one.
+func (h *RedisHandler) writeSizeError(writer *bufio.Writer, err error) bool {
+	switch {
+	case errors.Is(err, cache.ErrKeyTooLarge):
+		h.writeError(writer, "ERR key exceeds maximum allowed size (max-key-size)")
+	case errors.Is(err, cache.ErrValueTooLarge):
+		h.writeError(writer, "ERR string exceeds maximum allowed size (max-value-size)")
+	default:
+		return false
+	}
+	return true
+}
+
+// writeUnknownCommand writes the error Redis gives for an unknown
+// command, which quotes its first arguments up to about 128 bytes.
+func (h *RedisHandler) writeUnknownCommand(writer *bufio.Writer, cmd [][]byte) {
+	args := ""
+	for _, arg := range cmd[1:] {
+		if len(args) >= 128 {
+			break
 		}
-		
-		buf := make([]byte, size+2)
-		_, err = io.ReadFull(reader, buf)
-		if err != nil {
-			return nil, err
+		args += fmt.Sprintf("'%.*s' ", 128-len(args), arg)
+	}
+	h.writeError(writer, fmt.Sprintf("ERR unknown command '%.128s', with args beginning with: %s", cmd[0], args))
+}
+
+// writeUnknownSubcommand writes the error Redis gives for an unknown
+// subcommand of command.
+func (h *RedisHandler) writeUnknownSubcommand(writer *bufio.Writer, command string, sub []byte) {
+	h.writeError(writer, fmt.Sprintf("ERR unknown subcommand '%.128s'. Try %s HELP.", sub, command))
+}
+
+// appendUpper appends an ASCII upper-cased copy of b to dst.
+func appendUpper(dst, b []byte) []byte {
+	for _, c := range b {
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
 		}
-		
-		args = append(args, string(buf[:size]))
+		dst = append(dst, c)
 	}
-	
-	return args, nil
+	return dst
 }
 
 func (h *RedisHandler) writeError(writer *bufio.Writer, msg string) {
@@ -275,153 +273,450 @@ func (h *RedisHandler) writeSimpleString(writer *bufio.Writer, msg string) {
 
 func (h *RedisHandler) writeInteger(writer *bufio.Writer, n int64) {
 	writer.WriteString(":")
-	writer.WriteString(strconv.FormatInt(n, 10))
+	writer.Write(strconv.AppendInt(writer.AvailableBuffer(), n, 10))
 	writer.WriteString("\r\n")
 }
 
 func (h *RedisHandler) writeBulkString(writer *bufio.Writer, s string) {
 	writer.WriteString("$")
-	writer.WriteString(strconv.Itoa(len(s)))
+	writer.Write(strconv.AppendInt(writer.AvailableBuffer(), int64(len(s)), 10))
 	writer.WriteString("\r\n")
 	writer.WriteString(s)
 	writer.WriteString("\r\n")
 }
 
+func (h *RedisHandler) writeBulk(writer *bufio.Writer, b []byte) {
+	writer.WriteString("$")
+	writer.Write(strconv.AppendInt(writer.AvailableBuffer(), int64(len(b)), 10))
+	writer.WriteString("\r\n")
+	writer.Write(b)
+	writer.WriteString("\r\n")
+}
+
 func (h *RedisHandler) writeNil(writer *bufio.Writer) {
 	writer.WriteString("$-1\r\n")
 }
 
-func (h *RedisHandler) writeArray(writer *bufio.Writer, items []string) {
+func (h *RedisHandler) writeNilArray(writer *bufio.Writer) {
+	writer.WriteString("*-1\r\n")
+}
+
+func (h *RedisHandler) writeArrayLen(writer *bufio.Writer, n int) {
 	writer.WriteString("*")
-	writer.WriteString(strconv.Itoa(len(items)))
+	writer.WriteString(strconv.Itoa(n))
 	writer.WriteString("\r\n")
+}
+
+func (h *RedisHandler) writeArray(writer *bufio.Writer, items []string) {
+	h.writeArrayLen(writer, len(items))
 	
 	for _, item := range items {
 		h.writeBulkString(writer, item)
 	}
 }
 
-func (h *RedisHandler) handleGet(writer *bufio.Writer, key string) {
-	entry, found := h.cache.Load([]byte(key))
+func (h *RedisHandler) handleGet(writer *bufio.Writer, key []byte) {
+	entry, found := readThrough(h.cache, h.config, TypeRedis, key)
+	if !found {
+		h.writeNil(writer)
+		return
+	}
+	
+	h.writeBulk(writer, entry.Value())
+}
+
+// handleGetDel implements GETDEL key: the value is read and the key
+// deleted under one lock, so no other client can change it in between.
+func (h *RedisHandler) handleGetDel(writer *bufio.Writer, key []byte) {
+	entry, found := h.cache.LoadAndDelete(key)
 	if !found {
 		h.writeNil(writer)
 		return
 	}
 	
-	h.writeBulkString(writer, string(entry.Value()))
+	h.writeBulk(writer, entry.Value())
 }
 
-func (h *RedisHandler) handleSet(writer *bufio.Writer, args []string) {
+// handleGetRange implements GETRANGE key start end. The range is written
+// straight from the entry's buffer, so reading a slice of a large value
+// copies nothing.
+func (h *RedisHandler) handleGetRange(writer *bufio.Writer, key, startArg, endArg []byte) {
+	start, err := parseInt(startArg)
+	if err != nil {
+		h.writeError(writer, "ERR value is not an integer or out of range")
+		return
+	}
+	end, err := parseInt(endArg)
+	if err != nil {
+		h.writeError(writer, "ERR value is not an integer or out of range")
+		return
+	}
+	
+	var value []byte
+	if entry, found := h.cache.Load(key); found {
+		value = entry.Value()
+	}
+	
+	n := int64(len(value))
+	if start < 0 {
+		start = max(start+n, 0)
+	}
+	if end < 0 {
+		end += n
+	}
+	end = min(end, n-1)
+	
+	if start > end || n == 0 {
+		h.writeBulk(writer, nil)
+		return
+	}
+	h.writeBulk(writer, value[start:end+1])
+}
+
+func (h *RedisHandler) handleStrlen(writer *bufio.Writer, key []byte) {
+	entry, found := h.cache.Load(key)
+	if !found {
+		h.writeInteger(writer, 0)
+		return
+	}
+	
+	h.writeInteger(writer, int64(len(entry.Value())))
+}
+
+func (h *RedisHandler) handleSet(writer *bufio.Writer, args [][]byte) {
 	key := args[0]
 	value := args[1]
 	
 	opts := &cache.StoreOptions{}
+	nx, xx, get := false, false, false
 	
 	for i := 2; i < len(args); i++ {
-		switch strings.ToUpper(args[i]) {
-		case "EX":
-			if i+1 < len(args) {
-				seconds, err := strconv.Atoi(args[i+1])
-				if err == nil {
-					opts.TTL = time.Duration(seconds) * time.Second
-				}
-				i++
-			}
-		case "PX":
-			if i+1 < len(args) {
-				millis, err := strconv.Atoi(args[i+1])
-				if err == nil {
-					opts.TTL = time.Duration(millis) * time.Millisecond
-				}
-				i++
+		option := strings.ToUpper(string(args[i]))
+		switch option {
+		case "EX", "PX", "EXSOFT", "PXSOFT":
+			if i+1 == len(args) {
+				h.writeError(writer, "ERR syntax error")
+				return
 			}
-		case "NX":
-			if entry, _ := h.cache.Load([]byte(key)); entry != nil {
-				h.writeNil(writer)
+			i++
+			n, err := parseInt(args[i])
+			if err != nil {
+				h.writeError(writer, "ERR value is not an integer or out of range")
 				return
 			}
-		case "XX":
-			if entry, _ := h.cache.Load([]byte(key)); entry == nil {
-				h.writeNil(writer)
+			unit := time.Second
+			if option[0] == 'P' {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				h.writeError(writer, "ERR invalid expire time in 'set' command")
 				return
 			}
+			if strings.HasSuffix(option, "SOFT") {
+				opts.SoftTTL = time.Duration(n) * unit
+			} else {
+				opts.TTL = time.Duration(n) * unit
+			}
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			get = true
+		case "PERSISTENT":
+			opts.Pinned = true
+		case "SLIDING":
+			opts.Sliding = true
+		default:
+			h.writeError(writer, "ERR syntax error")
+			return
 		}
 	}
 	
-	h.cache.Store([]byte(key), []byte(value), opts)
-	h.writeSimpleString(writer, "OK")
+	// Only a plain store pins; see cache.StoreOptions.Pinned.
+	if nx && xx || opts.Pinned && (nx || get) || opts.Sliding && opts.TTL == 0 {
+		h.writeError(writer, "ERR syntax error")
+		return
+	}
+	if h.writeSizeError(writer, h.cache.CheckSize(len(key), len(value))) {
+		return
+	}
+	if xx {
+		if entry, _ := h.cache.Load(key); entry == nil {
+			h.writeNil(writer)
+			return
+		}
+	}
+	
+	// Arguments are views into the reader's buffer; the cache keeps
+	// references to what it stores, so hand it copies.
+	key, value = bytes.Clone(key), bytes.Clone(value)
+	
+	switch {
+	case nx:
+		// The existence check and the store are one atomic step.
+		entry, loaded := h.cache.LoadOrStore(key, value, opts)
+		if get && loaded {
+			h.writeBulk(writer, entry.Value())
+		} else if get || loaded {
+			h.writeNil(writer)
+		} else {
+			h.writeSimpleString(writer, "OK")
+		}
+		
+	case get:
+		if old, replaced := h.cache.Swap(key, value, opts); replaced {
+			h.writeBulk(writer, old.Value())
+		} else {
+			h.writeNil(writer)
+		}
+		
+	default:
+		if errors.Is(h.cache.Store(key, value, opts), cache.ErrPinnedLimit) {
+			h.writeError(writer, "OOM command not allowed when pinned entries would exceed 'max-pinned'")
+			return
+		}
+		h.writeSimpleString(writer, "OK")
+	}
 }
 
-func (h *RedisHandler) handleDel(writer *bufio.Writer, keys []string) {
+func (h *RedisHandler) handleDel(writer *bufio.Writer, keys [][]byte) {
 	deleted := int64(0)
 	for _, key := range keys {
-		if h.cache.Delete([]byte(key)) {
+		if h.cache.Delete(key) {
 			deleted++
 		}
 	}
 	h.writeInteger(writer, deleted)
 }
 
-func (h *RedisHandler) handleExists(writer *bufio.Writer, keys []string) {
+func (h *RedisHandler) handleExists(writer *bufio.Writer, keys [][]byte) {
 	exists := int64(0)
 	for _, key := range keys {
-		if entry, _ := h.cache.Load([]byte(key)); entry != nil {
+		if entry, _ := h.cache.LoadNoTouch(key); entry != nil {
 			exists++
 		}
 	}
 	h.writeInteger(writer, exists)
 }
 
-func (h *RedisHandler) handleIncr(writer *bufio.Writer, key string, delta int64) {
-	newVal, err := h.cache.Increment([]byte(key), delta)
+func (h *RedisHandler) handleIncr(writer *bufio.Writer, key []byte, delta int64) {
+	newVal, err := h.cache.Increment(bytes.Clone(key), delta)
+	if h.writeSizeError(writer, err) {
+		return
+	}
 	if err != nil {
-		h.writeError(writer, err.Error())
+		h.writeError(writer, "ERR "+err.Error())
 		return
 	}
 	h.writeInteger(writer, newVal)
 }
 
-func (h *RedisHandler) handleMGet(writer *bufio.Writer, keys []string) {
+func (h *RedisHandler) handleRename(writer *bufio.Writer, src, dst []byte, nx bool) {
+	renamed, err := h.cache.Rename(src, bytes.Clone(dst), nx)
+	if errors.Is(err, cache.ErrNoSuchKey) {
+		h.writeError(writer, "ERR no such key")
+		return
+	}
+	if h.writeSizeError(writer, err) {
+		return
+	}
+	
+	if !nx {
+		h.writeSimpleString(writer, "OK")
+	} else if renamed {
+		h.writeInteger(writer, 1)
+	} else {
+		h.writeInteger(writer, 0)
+	}
+}
+
+func (h *RedisHandler) handleCopy(writer *bufio.Writer, args [][]byte) {
+	replace := false
+	
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			// There is only database 0.
+			if i+1 >= len(args) {
+				h.writeError(writer, "ERR syntax error")
+				return
+			}
+			if db, err := parseInt(args[i+1]); err != nil || db != 0 {
+				h.writeError(writer, "ERR DB index is out of range")
+				return
+			}
+			i++
+		default:
+			h.writeError(writer, "ERR syntax error")
+			return
+		}
+	}
+	
+	copied, err := h.cache.Copy(args[0], bytes.Clone(args[1]), replace)
+	if h.writeSizeError(writer, err) {
+		return
+	}
+	if copied {
+		h.writeInteger(writer, 1)
+	} else {
+		h.writeInteger(writer, 0)
+	}
+}
+
+func (h *RedisHandler) handleDump(writer *bufio.Writer, key []byte) {
+	entry, found := h.cache.Load(key)
+	if !found {
+		h.writeNil(writer)
+		return
+	}
+	
+	h.writeBulk(writer, persistence.Dump(entry.Value(), entry.Flags()))
+}
+
+// handleRestore implements RESTORE key ttl payload [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency]. IDLETIME and FREQ are accepted
+// for compatibility and ignored.
+func (h *RedisHandler) handleRestore(writer *bufio.Writer, args [][]byte) {
+	ttl, err := parseInt(args[1])
+	if err != nil || ttl < 0 {
+		h.writeError(writer, "ERR Invalid TTL value, must be >= 0")
+		return
+	}
+	
+	replace, absTTL := false, false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			if i+1 >= len(args) {
+				h.writeError(writer, "ERR syntax error")
+				return
+			}
+			i++
+		default:
+			h.writeError(writer, "ERR syntax error")
+			return
+		}
+	}
+	
+	value, flags, err := persistence.ParseDump(args[2])
+	if err != nil {
+		h.writeError(writer, "ERR DUMP payload version or checksum are wrong")
+		return
+	}
+	
+	if !replace {
+		if _, found := h.cache.Load(args[0]); found {
+			h.writeError(writer, "BUSYKEY Target key name already exists.")
+			return
+		}
+	}
+	
+	opts := &cache.StoreOptions{Flags: flags}
+	if ttl > 0 {
+		if absTTL {
+			opts.TTL = time.Until(time.UnixMilli(ttl))
+			if opts.TTL <= 0 {
+				// Already expired: behave as if stored and then expired.
+				h.cache.Delete(args[0])
+				h.writeSimpleString(writer, "OK")
+				return
+			}
+		} else {
+			opts.TTL = time.Duration(ttl) * time.Millisecond
+		}
+	}
+	
+	if err := h.cache.Store(bytes.Clone(args[0]), bytes.Clone(value), opts); h.writeSizeError(writer, err) {
+		return
+	}
+	h.writeSimpleString(writer, "OK")
+}
+
+// handleFlush implements FLUSHALL and FLUSHDB [ASYNC|SYNC].
+func (h *RedisHandler) handleFlush(writer *bufio.Writer, args [][]byte) {
+	async := false
+	if len(args) > 1 {
+		h.writeError(writer, "ERR syntax error")
+		return
+	}
+	if len(args) == 1 {
+		switch strings.ToUpper(string(args[0])) {
+		case "ASYNC":
+			async = true
+		case "SYNC":
+		default:
+			h.writeError(writer, "ERR syntax error")
+			return
+		}
+	}
+	
+	if async {
+		h.cache.ClearAsync()
+	} else {
+		h.cache.Clear()
+	}
+	h.writeSimpleString(writer, "OK")
+}
+
+func (h *RedisHandler) handleMGet(writer *bufio.Writer, keys [][]byte) {
 	writer.WriteString("*")
 	writer.WriteString(strconv.Itoa(len(keys)))
 	writer.WriteString("\r\n")
 	
-	for _, key := range keys {
-		entry, found := h.cache.Load([]byte(key))
-		if !found {
+	for _, entry := range readThroughMany(h.cache, h.config, TypeRedis, keys) {
+		if entry == nil {
 			h.writeNil(writer)
 		} else {
-			h.writeBulkString(writer, string(entry.Value()))
+			h.writeBulk(writer, entry.Value())
 		}
 	}
 }
 
-func (h *RedisHandler) handleMSet(writer *bufio.Writer, args []string) {
+func (h *RedisHandler) handleMSet(writer *bufio.Writer, args [][]byte) {
+	if len(args)%2 != 0 {
+		h.writeError(writer, "ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	
+	// StoreMany checks every pair first, so a rejected one stores nothing.
+	keys := make([][]byte, 0, len(args)/2)
+	values := make([][]byte, 0, len(args)/2)
 	for i := 0; i < len(args); i += 2 {
-		h.cache.Store([]byte(args[i]), []byte(args[i+1]), nil)
+		keys = append(keys, bytes.Clone(args[i]))
+		values = append(values, bytes.Clone(args[i+1]))
+	}
+	if h.writeSizeError(writer, h.cache.StoreMany(keys, values, nil)) {
+		return
 	}
 	h.writeSimpleString(writer, "OK")
 }
 
-func (h *RedisHandler) handleExpire(writer *bufio.Writer, key, secondsStr string) {
-	seconds, err := strconv.Atoi(secondsStr)
+func (h *RedisHandler) handleExpire(writer *bufio.Writer, key, secondsArg []byte) {
+	seconds, err := parseInt(secondsArg)
 	if err != nil {
 		h.writeError(writer, "ERR value is not an integer or out of range")
 		return
 	}
 	
-	entry, found := h.cache.Load([]byte(key))
-	if !found {
+	if !h.cache.Expire(key, time.Now().Add(time.Duration(seconds)*time.Second).UnixNano()) {
 		h.writeInteger(writer, 0)
 		return
 	}
 	
-	entry.SetExpireAt(time.Now().Add(time.Duration(seconds) * time.Second).UnixNano())
 	h.writeInteger(writer, 1)
 }
 
-func (h *RedisHandler) handleTTL(writer *bufio.Writer, key string) {
-	entry, found := h.cache.Load([]byte(key))
+// handleTTL implements TTL, or PTTL if millis is set.
+func (h *RedisHandler) handleTTL(writer *bufio.Writer, key []byte, millis bool) {
+	// Not an access: it would reset a sliding TTL it reports on.
+	entry, found := h.cache.LoadNoTouch(key)
 	if !found {
 		h.writeInteger(writer, -2)
 		return
@@ -433,7 +728,11 @@ func (h *RedisHandler) handleTTL(writer *bufio.Writer, key string) {
 		return
 	}
 	
-	ttl := (expireAt - time.Now().UnixNano()) / 1e9
+	ttl := (expireAt - time.Now().UnixNano()) / 1e6
+	if !millis {
+		// Round to the nearest second, as Redis does.
+		ttl = (ttl + 500) / 1000
+	}
 	if ttl < 0 {
 		ttl = 0
 	}
@@ -441,51 +740,592 @@ func (h *RedisHandler) handleTTL(writer *bufio.Writer, key string) {
 }
 
 func (h *RedisHandler) handleKeys(writer *bufio.Writer, pattern string) {
-	keys := make([]string, 0)
+	h.writeArray(writer, matchKeys(h.cache, pattern))
+}
+
+// handleDebug implements DEBUG SLEEP, DEBUG OBJECT, DEBUG
+// SET-ACTIVE-EXPIRE and DEBUG TRACE, for tests and operators.
+func (h *RedisHandler) handleDebug(c *redisClient, args [][]byte) {
+	writer := c.writer
+	if !h.config.EnableDebug {
+		h.writeError(writer, "ERR DEBUG command not allowed, start the server with --enable-debug")
+		return
+	}
 	
-	h.cache.Iterate(func(entry *cache.Entry) bool {
-		key := string(entry.Key())
-		if pattern == "*" || matchPattern(pattern, key) {
-			keys = append(keys, key)
+	switch strings.ToUpper(string(args[0])) {
+	case "SLEEP":
+		if len(args) != 2 {
+			h.writeError(writer, "ERR wrong number of arguments for 'debug|sleep' command")
+			return
 		}
-		return true
-	})
+		seconds, err := strconv.ParseFloat(string(args[1]), 64)
+		if err != nil || seconds < 0 {
+			h.writeError(writer, "ERR value is not a valid float")
+			return
+		}
+		time.Sleep(time.Duration(seconds * float64(time.Second)))
+		h.writeSimpleString(writer, "OK")
+		
+	case "OBJECT":
+		if len(args) != 2 {
+			h.writeError(writer, "ERR wrong number of arguments for 'debug|object' command")
+			return
+		}
+		info, found := h.cache.Inspect(args[1])
+		if !found {
+			h.writeError(writer, "ERR no such key")
+			return
+		}
+		h.writeSimpleString(writer, fmt.Sprintf(
+			"Value at:0x0 refcount:1 encoding:raw serializedlength:%d shard:%d bucket:%d distance:%d cas:%d flags:%d expire_at:%d",
+			info.Size, info.Shard, info.Bucket, info.Distance, info.CAS, info.Flags, info.ExpireAt))
+		
+	case "SET-ACTIVE-EXPIRE":
+		if len(args) != 2 || (string(args[1]) != "0" && string(args[1]) != "1") {
+			h.writeError(writer, "ERR syntax error")
+			return
+		}
+		h.cache.SetActiveExpire(string(args[1]) == "1")
+		h.writeSimpleString(writer, "OK")
+		
+	case "TRACE":
+		// DEBUG TRACE ON logs the timings of every later command of the
+		// connection; DEBUG TRACE LAST returns those of the last one.
+		if len(args) != 2 {
+			h.writeError(writer, "ERR wrong number of arguments for 'debug|trace' command")
+			return
+		}
+		switch strings.ToUpper(string(args[1])) {
+		case "ON":
+			if c.trace == nil {
+				c.trace = &commandTrace{}
+			}
+			h.writeSimpleString(writer, "OK")
+		case "OFF":
+			c.trace = nil
+			h.writeSimpleString(writer, "OK")
+		case "LAST":
+			if c.trace == nil {
+				h.writeError(writer, "ERR tracing is off, turn it on with DEBUG TRACE ON")
+				return
+			}
+			h.writeTrace(writer, &c.trace.last)
+		default:
+			h.writeError(writer, "ERR syntax error")
+		}
+		
+	default:
+		h.writeUnknownSubcommand(writer, "DEBUG", args[0])
+	}
+}
+
+// handleConfig implements CONFIG GET and CONFIG SET. Only the shard count
+// can be changed at runtime; setting it starts an online resize.
+func (h *RedisHandler) handleConfig(writer *bufio.Writer, args [][]byte) {
+	switch strings.ToUpper(string(args[0])) {
+	case "GET":
+		if len(args) != 2 {
+			h.writeError(writer, "ERR wrong number of arguments for 'config|get' command")
+			return
+		}
+		stats := h.cache.Stats()
+		params := [][2]string{
+			{"shards", strconv.Itoa(h.cache.NumShards())},
+			{"maxmemory", strconv.FormatInt(stats.MaxMemory, 10)},
+			{"maxmemory-policy", redisEvictionPolicy(stats.EvictionPolicy)},
+		}
+		var reply []string
+		for _, param := range params {
+			if matchPattern(strings.ToLower(string(args[1])), param[0]) {
+				reply = append(reply, param[0], param[1])
+			}
+		}
+		h.writeArray(writer, reply)
+		
+	case "SET":
+		if len(args) != 3 {
+			h.writeError(writer, "ERR wrong number of arguments for 'config|set' command")
+			return
+		}
+		if !strings.EqualFold(string(args[1]), "shards") {
+			h.writeError(writer, fmt.Sprintf("ERR Unsupported CONFIG parameter: %s", args[1]))
+			return
+		}
+		n, err := parseInt(args[2])
+		if err != nil || n <= 0 || n > 1<<16 {
+			h.writeError(writer, "ERR Invalid argument 'shards': must be a positive integer")
+			return
+		}
+		if err := h.cache.Resize(int(n)); errors.Is(err, cache.ErrResizing) {
+			h.writeError(writer, "ERR a resize is already in progress")
+			return
+		} else if err != nil {
+			h.writeError(writer, "ERR "+err.Error())
+			return
+		}
+		h.writeSimpleString(writer, "OK")
+		
+	default:
+		h.writeUnknownSubcommand(writer, "CONFIG", args[0])
+	}
+}
+
+// handleObject implements OBJECT ENCODING, REFCOUNT, IDLETIME and FREQ.
+// IDLETIME and FREQ need the access metadata the LRU and LFU eviction
+// policies record, and do not count as an access themselves.
+func (h *RedisHandler) handleObject(writer *bufio.Writer, args [][]byte) {
+	sub := strings.ToUpper(string(args[0]))
+	switch sub {
+	case "ENCODING", "REFCOUNT", "IDLETIME", "FREQ":
+	default:
+		h.writeUnknownSubcommand(writer, "OBJECT", args[0])
+		return
+	}
+	if len(args) != 2 {
+		h.writeError(writer, fmt.Sprintf("ERR wrong number of arguments for 'object|%s' command", strings.ToLower(sub)))
+		return
+	}
+	
+	info, found := h.cache.Inspect(args[1])
+	if !found {
+		h.writeNil(writer)
+		return
+	}
+	
+	switch sub {
+	case "ENCODING":
+		h.writeBulkString(writer, "raw")
+		
+	case "REFCOUNT":
+		h.writeInteger(writer, 1)
+		
+	case "IDLETIME":
+		if !info.Tracked {
+			h.writeError(writer, "ERR access times are not tracked, start the server with --evict lru, lfu or slru")
+			return
+		}
+		h.writeInteger(writer, int64(info.Idle/time.Second))
+		
+	case "FREQ":
+		if !info.Tracked {
+			h.writeError(writer, "ERR access frequency is not tracked, start the server with --evict lru or lfu")
+			return
+		}
+		h.writeInteger(writer, int64(info.Frequency))
+	}
+}
+
+// withKeyspace returns a copy of h that serves from ks.
+func (h *RedisHandler) withKeyspace(ks Keyspace) *RedisHandler {
+	c := *h
+	c.cache = ks
+	return &c
+}
+
+// parseClientSwitch parses the ON or OFF argument of CLIENT NO-TOUCH and
+// NO-EVICT, writing the error if it is missing or invalid.
+func (h *RedisHandler) parseClientSwitch(writer *bufio.Writer, args [][]byte) (on, ok bool) {
+	if len(args) != 2 {
+		h.writeError(writer, fmt.Sprintf("ERR wrong number of arguments for 'client|%s' command", strings.ToLower(string(args[0]))))
+		return false, false
+	}
+	switch strings.ToUpper(string(args[1])) {
+	case "ON":
+		return true, true
+	case "OFF":
+		return false, true
+	}
+	h.writeError(writer, "ERR syntax error")
+	return false, false
+}
+
+// handleClient implements CLIENT LIST, NO-EVICT and NO-TOUCH.
+func (h *RedisHandler) handleClient(c *redisClient, args [][]byte) {
+	writer := c.writer
+	switch strings.ToUpper(string(args[0])) {
+	case "LIST":
+		if len(args) != 1 {
+			h.writeError(writer, "ERR syntax error")
+			return
+		}
+		var list []clients.Client
+		if h.config.Clients != nil {
+			list = h.config.Clients.List()
+		}
+		
+		var b strings.Builder
+		now := time.Now()
+		for _, c := range list {
+			fmt.Fprintf(&b, "id=%d addr=%s laddr=%s age=%d proto=%s\n",
+				c.ID, c.Addr, c.LocalAddr, int64(now.Sub(c.ConnectedAt).Seconds()), c.Protocol)
+		}
+		h.writeBulkString(writer, b.String())
+		
+	case "NO-EVICT":
+		// gopogo never evicts clients to reclaim memory, so every
+		// connection is already exempt.
+		if _, ok := h.parseClientSwitch(writer, args); ok {
+			h.writeSimpleString(writer, "OK")
+		}
+		
+	case "NO-TOUCH":
+		if on, ok := h.parseClientSwitch(writer, args); ok {
+			c.noTouch = on
+			h.writeSimpleString(writer, "OK")
+		}
+		
+	default:
+		h.writeUnknownSubcommand(writer, "CLIENT", args[0])
+	}
+}
+
+// handleMemory implements MEMORY USAGE, STATS, PURGE and DOCTOR.
+func (h *RedisHandler) handleMemory(writer *bufio.Writer, args [][]byte) {
+	switch strings.ToUpper(string(args[0])) {
+	case "USAGE":
+		// SAMPLES is accepted for compatibility; values are not nested,
+		// so the size is always exact.
+		if len(args) != 2 && !(len(args) == 4 && strings.EqualFold(string(args[2]), "SAMPLES")) {
+			h.writeError(writer, "ERR syntax error")
+			return
+		}
+		entry, found := h.cache.Load(args[1])
+		if !found {
+			h.writeNil(writer)
+			return
+		}
+		h.writeInteger(writer, entry.MemoryUsage())
+		
+	case "STATS":
+		if len(args) != 1 {
+			h.writeError(writer, "ERR wrong number of arguments for 'memory|stats' command")
+			return
+		}
+		h.writeMemoryStats(writer, h.cache.MemoryStats())
+		
+	case "PURGE":
+		if len(args) != 1 {
+			h.writeError(writer, "ERR wrong number of arguments for 'memory|purge' command")
+			return
+		}
+		h.cache.Purge()
+		h.writeSimpleString(writer, "OK")
+		
+	case "DOCTOR":
+		if len(args) != 1 {
+			h.writeError(writer, "ERR wrong number of arguments for 'memory|doctor' command")
+			return
+		}
+		h.writeBulkString(writer, memoryDoctor(h.cache.SizeReport(bigKeyReportSize)))
+		
+	default:
+		h.writeUnknownSubcommand(writer, "MEMORY", args[0])
+	}
+}
+
+// writeMemoryStats writes MEMORY STATS as the flat field/value array
+// Redis uses, with the fields redis-cli and monitoring tools read plus a
+// nested breakdown per shard.
+func (h *RedisHandler) writeMemoryStats(writer *bufio.Writer, stats *cache.MemoryStats) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	
+	bytesPerKey := int64(0)
+	if stats.Items > 0 {
+		bytesPerKey = (stats.DatasetBytes + stats.Overhead) / int64(stats.Items)
+	}
+	datasetPct := 0.0
+	if mem.HeapAlloc > 0 {
+		datasetPct = 100 * float64(stats.DatasetBytes) / float64(mem.HeapAlloc)
+	}
+	
+	fmt.Fprintf(writer, "*%d\r\n", 2*(8+len(stats.Shards)))
+	// The Go runtime keeps no peak; the heap obtained from the OS never
+	// shrinks below it, so it stands in.
+	h.writeBulkString(writer, "peak.allocated")
+	h.writeInteger(writer, int64(mem.HeapSys))
+	h.writeBulkString(writer, "total.allocated")
+	h.writeInteger(writer, int64(mem.HeapAlloc))
+	h.writeBulkString(writer, "overhead.total")
+	h.writeInteger(writer, stats.Overhead)
+	h.writeBulkString(writer, "keys.count")
+	h.writeInteger(writer, int64(stats.Items))
+	h.writeBulkString(writer, "keys.bytes-per-key")
+	h.writeInteger(writer, bytesPerKey)
+	h.writeBulkString(writer, "dataset.bytes")
+	h.writeInteger(writer, stats.DatasetBytes)
+	h.writeBulkString(writer, "dataset.percentage")
+	h.writeBulkString(writer, strconv.FormatFloat(datasetPct, 'f', 2, 64))
+	h.writeBulkString(writer, "maxmemory")
+	h.writeInteger(writer, stats.MaxMemory)
 	
-	h.writeArray(writer, keys)
+	for i, shard := range stats.Shards {
+		h.writeBulkString(writer, "shard."+strconv.Itoa(i))
+		writer.WriteString("*8\r\n")
+		h.writeBulkString(writer, "keys.count")
+		h.writeInteger(writer, int64(shard.Items))
+		h.writeBulkString(writer, "dataset.bytes")
+		h.writeInteger(writer, shard.DatasetBytes)
+		h.writeBulkString(writer, "overhead.hashtable.main")
+		h.writeInteger(writer, shard.Overhead)
+		h.writeBulkString(writer, "buckets")
+		h.writeInteger(writer, int64(shard.Buckets))
+	}
 }
 
-func (h *RedisHandler) handleInfo(writer *bufio.Writer) {
-	stats := h.cache.Stats()
+// handleTopKeys implements TOPKEYS [count] [PREFIX separator]. Each
+// reply element is a key (or, with PREFIX, a key prefix) followed by its
+// estimated access count, reads and writes.
+func (h *RedisHandler) handleTopKeys(writer *bufio.Writer, args [][]byte) {
+	count := int64(10)
+	separator := ""
 	
-	info := fmt.Sprintf("# Server\r\n"+
-		"redis_version:7.0.0\r\n"+
-		"redis_mode:standalone\r\n"+
-		"process_id:1\r\n"+
-		"tcp_port:6379\r\n"+
-		"\r\n"+
-		"# Keyspace\r\n"+
-		"db0:keys=%d,expires=0\r\n"+
-		"\r\n"+
-		"# Stats\r\n"+
-		"total_commands_processed:%d\r\n"+
-		"keyspace_hits:%d\r\n"+
-		"keyspace_misses:%d\r\n"+
-		"evicted_keys:%d\r\n"+
-		"expired_keys:%d\r\n"+
+	if len(args) > 0 {
+		n, err := parseInt(args[0])
+		if err != nil || n <= 0 {
+			h.writeError(writer, "ERR count should be a positive integer")
+			return
+		}
+		count = n
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		if len(args) != 2 || !strings.EqualFold(string(args[0]), "PREFIX") || len(args[1]) == 0 {
+			h.writeError(writer, "ERR syntax error")
+			return
+		}
+		separator = string(args[1])
+	}
+	
+	var stats []cache.KeyStat
+	if separator == "" {
+		stats = h.cache.TopKeys(int(count))
+	} else {
+		stats = cache.GroupByPrefix(h.cache.TopKeys(0), separator, int(count))
+	}
+	if stats == nil {
+		h.writeError(writer, "ERR hot key tracking is disabled, start the server with --hotkeys")
+		return
+	}
+	
+	fmt.Fprintf(writer, "*%d\r\n", len(stats))
+	for _, stat := range stats {
+		writer.WriteString("*4\r\n")
+		h.writeBulkString(writer, stat.Key)
+		h.writeInteger(writer, int64(stat.Count))
+		h.writeInteger(writer, int64(stat.Reads))
+		h.writeInteger(writer, int64(stat.Writes))
+	}
+}
+
+// handleShardInfo implements SHARDINFO [count]: how evenly keys are
+// spread across shards, then the count shards (default 5) serving the
+// most operations with their lock contention, in the INFO format.
+func (h *RedisHandler) handleShardInfo(writer *bufio.Writer, args [][]byte) {
+	count := 5
+	if len(args) > 1 {
+		h.writeError(writer, "ERR wrong number of arguments for 'shardinfo' command")
+		return
+	}
+	if len(args) == 1 {
+		n, err := parseInt(args[0])
+		if err != nil || n <= 0 {
+			h.writeError(writer, "ERR count should be a positive integer")
+			return
+		}
+		count = int(min(n, 1<<16))
+	}
+	
+	shards := h.cache.ShardStats()
+	keys, minKeys, maxKeys := 0, shards[0].Items, 0
+	for _, shard := range shards {
+		keys += shard.Items
+		minKeys = min(minKeys, shard.Items)
+		maxKeys = max(maxKeys, shard.Items)
+	}
+	mean := float64(keys) / float64(len(shards))
+	var variance float64
+	for _, shard := range shards {
+		variance += (float64(shard.Items) - mean) * (float64(shard.Items) - mean)
+	}
+	skew := 1.0
+	if mean > 0 {
+		skew = float64(maxKeys) / mean
+	}
+	
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Distribution\r\n"+
+		"shards:%d\r\n"+
+		"keys:%d\r\n"+
+		"keys_min:%d\r\n"+
+		"keys_max:%d\r\n"+
+		"keys_mean:%.2f\r\n"+
+		"keys_stddev:%.2f\r\n"+
+		"skew:%.2f\r\n"+
 		"\r\n"+
-		"# Memory\r\n"+
-		"used_memory:%d\r\n"+
-		"used_memory_human:%s\r\n",
-		stats["num_items"],
-		stats["num_ops"],
-		stats["num_hits"],
-		stats["num_misses"],
-		stats["num_evicted"],
-		stats["num_expired"],
-		stats["mem_used"],
-		formatMemory(stats["mem_used"].(int64)))
-	
-	h.writeBulkString(writer, info)
+		"# Most loaded\r\n",
+		len(shards), keys, minKeys, maxKeys, mean,
+		math.Sqrt(variance/float64(len(shards))), skew)
+	
+	sort.SliceStable(shards, func(i, j int) bool { return shards[i].Ops > shards[j].Ops })
+	for _, shard := range shards[:min(count, len(shards))] {
+		fmt.Fprintf(&b, "shard%d:keys=%d,memory=%d,ops=%d,hits=%d,misses=%d,lock_waits=%d,lock_wait_us=%d\r\n",
+			shard.Shard, shard.Items, shard.MemUsed, shard.Ops, shard.Hits, shard.Misses,
+			shard.LockWaits, shard.LockWait.Microseconds())
+	}
+	
+	h.writeBulkString(writer, b.String())
+}
+
+// handleWait implements WAIT numreplicas timeout. gopogo has no
+// replicas, so no write can ever be acknowledged: as Redis does without
+// replicas, WAIT for one or more blocks for the timeout in milliseconds,
+// or until the client disconnects if it is 0, and then reports zero.
+func (h *RedisHandler) handleWait(c *redisClient, numArg, timeoutArg []byte) {
+	numReplicas, err := parseInt(numArg)
+	if err != nil {
+		h.writeError(c.writer, "ERR value is not an integer or out of range")
+		return
+	}
+	timeout, err := parseInt(timeoutArg)
+	if err != nil {
+		h.writeError(c.writer, "ERR timeout is not an integer or out of range")
+		return
+	}
+	if timeout < 0 {
+		h.writeError(c.writer, "ERR timeout is negative")
+		return
+	}
+	
+	if numReplicas > 0 && !c.block(time.Duration(timeout)*time.Millisecond) {
+		return
+	}
+	h.writeInteger(c.writer, 0)
+}
+
+// block waits for d, or indefinitely if d is 0, and reports whether the
+// client is still connected. Commands the client sends meanwhile stay
+// buffered and run afterwards; once they fill the buffer a disconnect
+// can no longer be seen, so an indefinite wait ends there.
+func (c *redisClient) block(d time.Duration) bool {
+	closed := make(chan error, 1)
+	go func() { closed <- c.reader.WaitClosed() }()
+	
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	
+	select {
+	case err := <-closed:
+		if err != nil {
+			return false
+		}
+		if timeout != nil {
+			<-timeout
+		}
+		return true
+	case <-timeout:
+	}
+	
+	// Interrupt the wait so that the reader is ours again.
+	c.conn.SetReadDeadline(time.Now())
+	err := <-closed
+	c.conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return err == nil || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// handleSentinel answers the Sentinel discovery commands as a sentinel
+// that monitors this server alone, so Sentinel-aware clients can be
+// pointed at gopogo directly. The master address is the one the client
+// connected to.
+func (h *RedisHandler) handleSentinel(writer *bufio.Writer, local net.Addr, args [][]byte) {
+	host, port, ok := h.sentinelAddr(local)
+	if !ok {
+		h.writeError(writer, "ERR no TCP address to report for the master")
+		return
+	}
+	master := h.config.SentinelMaster
+	
+	switch strings.ToUpper(string(args[0])) {
+	case "GET-MASTER-ADDR-BY-NAME":
+		if len(args) != 2 {
+			h.writeError(writer, "ERR wrong number of arguments for 'sentinel|get-master-addr-by-name' command")
+		} else if string(args[1]) != master {
+			h.writeNilArray(writer)
+		} else {
+			h.writeArray(writer, []string{host, port})
+		}
+		
+	case "MASTERS":
+		writer.WriteString("*1\r\n")
+		h.writeArray(writer, []string{
+			"name", master,
+			"ip", host,
+			"port", port,
+			"flags", "master",
+			"num-slaves", "0",
+			"num-other-sentinels", "0",
+			"quorum", "1",
+		})
+		
+	case "MASTER":
+		if len(args) != 2 {
+			h.writeError(writer, "ERR wrong number of arguments for 'sentinel|master' command")
+		} else if string(args[1]) != master {
+			h.writeError(writer, "ERR No such master with that name")
+		} else {
+			h.writeArray(writer, []string{"name", master, "ip", host, "port", port, "flags", "master"})
+		}
+		
+	case "REPLICAS", "SLAVES", "SENTINELS":
+		if len(args) != 2 {
+			h.writeError(writer, fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", strings.ToLower(string(args[0]))))
+		} else if string(args[1]) != master {
+			h.writeError(writer, "ERR No such master with that name")
+		} else {
+			writer.WriteString("*0\r\n")
+		}
+		
+	default:
+		h.writeUnknownSubcommand(writer, "SENTINEL", args[0])
+	}
+}
+
+// sentinelAddr returns the master address for a client connected on
+// local: that address over TCP, and otherwise, as on a Unix socket, the
+// configured host and Redis port. Such a client is on this machine, so
+// loopback stands in for a wildcard host. It returns false if gopogo
+// has no TCP port.
+func (h *RedisHandler) sentinelAddr(local net.Addr) (host, port string, ok bool) {
+	if addr, ok := local.(*net.TCPAddr); ok {
+		return addr.IP.String(), strconv.Itoa(addr.Port), true
+	}
+	if h.config.Port == 0 {
+		return "", "", false
+	}
+	
+	host = h.config.Host
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return host, strconv.Itoa(h.config.Port), true
+}
+
+// redisEvictionPolicy names an eviction policy the way Redis reports
+// maxmemory-policy, so monitoring tools recognize it.
+func redisEvictionPolicy(policy string) string {
+	switch policy {
+	case "lru", "slru":
+		// Redis has no segmented LRU; it is an LRU to tools.
+		return "allkeys-lru"
+	case "lfu":
+		return "allkeys-lfu"
+	}
+	return "allkeys-random"
 }
 
 func matchPattern(pattern, key string) bool {
@@ -0,0 +1,669 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/clients"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+// redisSession serves a RedisHandler over a pipe and returns a function
+// that sends one inline command and reads back one reply line, or a
+// whole bulk string reply.
+func redisSession(t *testing.T, c *cache.Cache) func(cmd string) string {
+	t.Helper()
+	return redisSessionWith(t, c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+}
+
+// redisSessionWith is redisSession with the given handler configuration.
+func redisSessionWith(t *testing.T, c *cache.Cache, config *Config) func(cmd string) string {
+	t.Helper()
+
+	h := NewRedisHandler(c, config)
+	client, server := net.Pipe()
+	go h.Handle(server)
+	t.Cleanup(func() { client.Close() })
+
+	reader := bufio.NewReader(client)
+	return func(cmd string) string {
+		t.Helper()
+
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.WriteString(client, cmd+"\r\n"); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if line[0] != '$' || err != nil || n < 0 {
+			return line
+		}
+
+		body := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		return line + string(body)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	c := cache.New(1, 0)
+	do := redisSession(t, c)
+	do("SET key Hello,World")
+
+	big := []byte(strings.Repeat("x", 8<<20) + "tail")
+	c.Store([]byte("big"), big, nil)
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"GETRANGE key 0 4", "$5\r\nHello\r\n"},
+		{"GETRANGE key -5 -1", "$5\r\nWorld\r\n"},
+		{"GETRANGE key 6 100", "$5\r\nWorld\r\n"},
+		{"GETRANGE key -100 4", "$5\r\nHello\r\n"},
+		{"GETRANGE key 5 2", "$0\r\n\r\n"},
+		{"GETRANGE missing 0 -1", "$0\r\n\r\n"},
+		{"SUBSTR key 0 0", "$1\r\nH\r\n"},
+		{"GETRANGE key a 1", "-ERR value is not an integer or out of range\r\n"},
+		{"STRLEN key", ":11\r\n"},
+		{"STRLEN missing", ":0\r\n"},
+		{"GETRANGE big -4 -1", "$4\r\ntail\r\n"},
+		{"STRLEN big", ":8388612\r\n"},
+	}
+	for _, tt := range tests {
+		if got := do(tt.cmd); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestSetNXGet(t *testing.T) {
+	do := redisSession(t, cache.New(1, 0))
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"SET key first NX", "+OK\r\n"},
+		{"SET key second NX", "$-1\r\n"},
+		{"SET key second NX GET", "$5\r\nfirst\r\n"},
+		{"GET key", "$5\r\nfirst\r\n"},
+		{"SET other value NX GET", "$-1\r\n"},
+		{"GET other", "$5\r\nvalue\r\n"},
+		{"SET key third GET", "$5\r\nfirst\r\n"},
+		{"GETSET key fourth", "$5\r\nthird\r\n"},
+		{"GETSET missing value", "$-1\r\n"},
+		{"SET key value NX XX", "-ERR syntax error\r\n"},
+	}
+	for _, tt := range tests {
+		if got := do(tt.cmd); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestConfigShards(t *testing.T) {
+	c := cache.New(4, 0)
+	do := redisSession(t, c)
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"SET key value", "+OK\r\n"},
+		{"CONFIG GET nothing", "*0\r\n"},
+		{"CONFIG SET shards 0", "-ERR Invalid argument 'shards': must be a positive integer\r\n"},
+		{"CONFIG SET maxmemory 1", "-ERR Unsupported CONFIG parameter: maxmemory\r\n"},
+		{"CONFIG SET shards 8", "+OK\r\n"},
+		{"GET key", "$5\r\nvalue\r\n"},
+	}
+	for _, tt := range tests {
+		if got := do(tt.cmd); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.NumShards() != 8 {
+		if time.Now().After(deadline) {
+			t.Fatal("Resize did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := do("GET key"); got != "$5\r\nvalue\r\n" {
+		t.Errorf("GET key after resize = %q", got)
+	}
+	if info := do("INFO"); !strings.Contains(info, "shards:8\r\n") || !strings.Contains(info, "resharding_in_progress:0\r\n") {
+		t.Errorf("INFO after resize = %q", info)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	do := redisSession(t, cache.New(1, 0))
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"SET n 10", "+OK\r\n"},
+		{"INCR n", ":11\r\n"},
+		{"DECRBY n 20", ":-9\r\n"},
+		{"GET n", "$2\r\n-9\r\n"},
+		{"INCR fresh", ":1\r\n"},
+		{"SET text abc", "+OK\r\n"},
+		{"INCR text", "-ERR value is not an integer or out of range\r\n"},
+		{"SET max 9223372036854775807", "+OK\r\n"},
+		{"INCR max", "-ERR increment or decrement would overflow\r\n"},
+	}
+	for _, tt := range tests {
+		if got := do(tt.cmd); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestRedisSizeLimits(t *testing.T) {
+	c := cache.New(1, 0)
+	c.SetSizeLimits(4, 8)
+	do := redisSession(t, c)
+
+	keyErr := "-ERR key exceeds maximum allowed size (max-key-size)\r\n"
+	valueErr := "-ERR string exceeds maximum allowed size (max-value-size)\r\n"
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"SET keys 12345678", "+OK\r\n"},
+		{"SET key-5 v", keyErr},
+		{"SET k 123456789", valueErr},
+		{"SET k 123456789 NX", valueErr},
+		{"MSET a 1 b 123456789", valueErr},
+		{"EXISTS a", ":0\r\n"},
+		{"INCR key-5", keyErr},
+		{"RENAME keys key-5", keyErr},
+		{"BITFIELD keys SET u8 64 1", valueErr},
+		{"GET keys", "$8\r\n12345678\r\n"},
+	}
+	for _, tt := range tests {
+		if got := do(tt.cmd); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestRedisNoTouch(t *testing.T) {
+	c := cache.New(1, 0)
+	c.SetEvictionPolicy(cache.EvictLFU)
+	do := redisSession(t, c)
+	frequency := func() int {
+		info, _ := c.Inspect([]byte("key"))
+		return info.Frequency
+	}
+
+	do("SET key value")
+	start := frequency()
+	do("CLIENT NO-TOUCH ON")
+	for i := 0; i < 50; i++ {
+		do("GET key")
+	}
+	if got := frequency(); got != start {
+		t.Fatalf("GET with NO-TOUCH changed the access counter from %d to %d", start, got)
+	}
+
+	do("RESET")
+	for i := 0; i < 50; i++ {
+		do("GET key")
+	}
+	if got := frequency(); got <= start {
+		t.Fatalf("GET after RESET left the access counter at %d", got)
+	}
+}
+
+// TestRedisConversations replays the RESP conversations in
+// testdata/redis, which were recorded against Redis 7 unless a file's
+// leading "#" comment says otherwise. Each file is a series of commands,
+// on lines starting with "> ", each followed by the exact reply, one RESP
+// line per line. A file whose first line after any comments is
+// "requirepass <password>..." runs with authentication enabled, accepting
+// any of the listed passwords.
+func TestRedisConversations(t *testing.T) {
+	files, err := filepath.Glob("testdata/redis/*.txt")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no conversations found: %v", err)
+	}
+
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".txt"), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+			config := &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})}
+			for len(lines) > 0 && strings.HasPrefix(lines[0], "#") {
+				lines = lines[1:]
+			}
+			if password, ok := strings.CutPrefix(lines[0], "requirepass "); ok {
+				config.Auth = strings.Fields(password)
+				lines = lines[1:]
+			}
+			do := respSession(t, cache.New(4, 0), config)
+
+			for i := 0; i < len(lines); {
+				cmd, ok := strings.CutPrefix(lines[i], "> ")
+				if !ok {
+					t.Fatalf("%s:%d: expected a command, got %q", file, i+1, lines[i])
+				}
+				i++
+				var want strings.Builder
+				for ; i < len(lines) && !strings.HasPrefix(lines[i], "> "); i++ {
+					want.WriteString(lines[i] + "\r\n")
+				}
+
+				if got := do(cmd); got != want.String() {
+					t.Errorf("%s = %q, want %q", cmd, got, want.String())
+				}
+			}
+		})
+	}
+}
+
+// doneHandler is a Handler that closes done when it returns.
+type doneHandler struct {
+	Handler
+	done chan struct{}
+}
+
+func (h doneHandler) Handle(conn net.Conn) {
+	h.Handler.Handle(conn)
+	close(h.done)
+}
+
+// TestWait checks that WAIT without replicas blocks as in Redis.
+func TestWait(t *testing.T) {
+	done := make(chan struct{})
+	handler := NewRedisHandler(cache.New(1, 0), &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+	h := newHarness(t, doneHandler{handler, done}, respReply)
+
+	h.converse([]exchange{
+		{"WAIT 0 0\r\n", ":0\r\n"},
+		{"WAIT 0 10000\r\n", ":0\r\n"},
+		{"WAIT x 0\r\n", "-ERR value is not an integer or out of range\r\n"},
+		{"WAIT 1 -1\r\n", "-ERR timeout is negative\r\n"},
+	})
+
+	// Waiting for a replica lasts the whole timeout, and commands sent
+	// meanwhile run afterwards.
+	start := time.Now()
+	h.converse([]exchange{
+		{"WAIT 1 100\r\nPING\r\n", ":0\r\n"},
+		{"", "+PONG\r\n"},
+	})
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("WAIT 1 100 returned after %v", elapsed)
+	}
+
+	// With no timeout it lasts until the client disconnects.
+	h.conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	io.WriteString(h.conn, "WAIT 1 0\r\n")
+	if reply, err := h.readReply(h.reader); err == nil {
+		t.Errorf("WAIT 1 0 answered %q", reply)
+	}
+	h.conn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("WAIT 1 0 still blocked after the client disconnected")
+	}
+}
+
+// respSession serves a RedisHandler over a pipe and returns a function
+// that sends cmd as a RESP array and reads back one complete reply.
+func respSession(t *testing.T, c *cache.Cache, config *Config) func(cmd string) string {
+	t.Helper()
+
+	h := NewRedisHandler(c, config)
+	client, server := net.Pipe()
+	go h.Handle(server)
+	t.Cleanup(func() { client.Close() })
+
+	reader := bufio.NewReader(client)
+	return func(cmd string) string {
+		t.Helper()
+
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := client.Write(encodeCommand(t, cmd)); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		var reply bytes.Buffer
+		if err := readReply(reader, &reply); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		return reply.String()
+	}
+}
+
+// encodeCommand splits cmd into arguments as redis-cli does, with double
+// quotes around arguments containing spaces or escapes, and encodes them
+// as a RESP array the way client libraries send commands.
+func encodeCommand(t *testing.T, cmd string) []byte {
+	t.Helper()
+
+	var args []string
+	for rest := strings.TrimSpace(cmd); rest != ""; rest = strings.TrimLeft(rest, " ") {
+		if rest[0] != '"' {
+			arg, tail, _ := strings.Cut(rest, " ")
+			args = append(args, arg)
+			rest = tail
+			continue
+		}
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			t.Fatalf("%q: %v", cmd, err)
+		}
+		arg, _ := strconv.Unquote(quoted)
+		args = append(args, arg)
+		rest = rest[len(quoted):]
+	}
+
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return buf
+}
+
+// readReply copies one complete RESP reply from r to w.
+func readReply(r *bufio.Reader, w *bytes.Buffer) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	w.WriteString(line)
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return fmt.Errorf("malformed reply line %q", line)
+	}
+
+	switch line[0] {
+	case '+', '-', ':':
+		return nil
+	case '$':
+		n, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil || n < 0 {
+			return err
+		}
+		_, err = io.CopyN(w, r, int64(n)+2)
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil {
+			return err
+		}
+		for range n {
+			if err := readReply(r, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown reply type in %q", line)
+}
+
+// TestCommandTable checks that COMMAND lists exactly the commands the
+// handler serves.
+func TestCommandTable(t *testing.T) {
+	do := respSession(t, cache.New(1, 0), &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+
+	if got, want := do("COMMAND COUNT"), ":"+strconv.Itoa(len(redisCommands)-1)+"\r\n"; got != want {
+		t.Errorf("COMMAND COUNT = %q, want %q (all but SENTINEL)", got, want)
+	}
+	for i, cmd := range redisCommands {
+		if i > 0 && redisCommands[i-1].name >= cmd.name {
+			t.Errorf("redisCommands is not sorted at %q", cmd.name)
+		}
+		if cmd.name == "quit" || cmd.name == "sentinel" {
+			continue
+		}
+		if got := do(cmd.name); strings.HasPrefix(got, "-ERR unknown command") {
+			t.Errorf("%s is listed but not served: %q", cmd.name, got)
+		}
+	}
+	if got := do("SENTINEL masters"); !strings.HasPrefix(got, "-ERR unknown command") {
+		t.Errorf("SENTINEL without a master = %q", got)
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	sentinelConfig := func(host string, port int) *Config {
+		return &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{}), SentinelMaster: "mymaster", Host: host, Port: port}
+	}
+
+	// A client that is not on TCP, here on a pipe as on a Unix socket,
+	// is given the configured address.
+	tests := []struct {
+		host string
+		port int
+		want string
+	}{
+		{"", 6379, "*2\r\n$9\r\n127.0.0.1\r\n$4\r\n6379\r\n"},
+		{"0.0.0.0", 6379, "*2\r\n$9\r\n127.0.0.1\r\n$4\r\n6379\r\n"},
+		{"::", 6380, "*2\r\n$9\r\n127.0.0.1\r\n$4\r\n6380\r\n"},
+		{"10.0.0.5", 6379, "*2\r\n$8\r\n10.0.0.5\r\n$4\r\n6379\r\n"},
+		{"10.0.0.5", 0, "-ERR no TCP address to report for the master\r\n"},
+	}
+	for _, tt := range tests {
+		do := respSession(t, cache.New(1, 0), sentinelConfig(tt.host, tt.port))
+		if got := do("SENTINEL get-master-addr-by-name mymaster"); got != tt.want {
+			t.Errorf("%s:%d: get-master-addr-by-name = %q, want %q", tt.host, tt.port, got, tt.want)
+		}
+		if got := do("SENTINEL get-master-addr-by-name other"); tt.port != 0 && got != "*-1\r\n" {
+			t.Errorf("%s:%d: get-master-addr-by-name for another master = %q", tt.host, tt.port, got)
+		}
+	}
+
+	// A TCP client is given the address it connected to.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	h := NewRedisHandler(cache.New(1, 0), sentinelConfig("0.0.0.0", 6379))
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			h.Handle(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write(encodeCommand(t, "SENTINEL get-master-addr-by-name mymaster"))
+	var reply bytes.Buffer
+	if err := readReply(bufio.NewReader(conn), &reply); err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	if want := "*2\r\n$9\r\n127.0.0.1\r\n$" + strconv.Itoa(len(port)) + "\r\n" + port + "\r\n"; reply.String() != want {
+		t.Errorf("get-master-addr-by-name over TCP = %q, want %q", reply.String(), want)
+	}
+}
+
+func TestDebugTrace(t *testing.T) {
+	do := respSession(t, cache.New(1, 0), &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{}), EnableDebug: true})
+
+	if got := do("DEBUG TRACE LAST"); !strings.HasPrefix(got, "-ERR tracing is off") {
+		t.Fatalf("DEBUG TRACE LAST before ON = %q", got)
+	}
+	do("DEBUG TRACE ON")
+	do("SET key value")
+	got := do("DEBUG TRACE LAST")
+	if !strings.HasPrefix(got, "*12\r\n$7\r\ncommand\r\n$3\r\nset\r\n") {
+		t.Fatalf("DEBUG TRACE LAST = %q", got)
+	}
+	for _, phase := range []string{"parse_us", "lock_wait_us", "cache_us", "serialize_us", "total_us"} {
+		if !strings.Contains(got, phase) {
+			t.Errorf("DEBUG TRACE LAST is missing %s: %q", phase, got)
+		}
+	}
+	if got := do("GET key"); got != "$5\r\nvalue\r\n" {
+		t.Errorf("traced GET = %q", got)
+	}
+
+	do("RESET")
+	if got := do("DEBUG TRACE LAST"); !strings.HasPrefix(got, "-ERR tracing is off") {
+		t.Errorf("DEBUG TRACE LAST after RESET = %q", got)
+	}
+}
+
+func TestCommandStats(t *testing.T) {
+	do := redisSessionWith(t, cache.New(1, 0), &Config{
+		Limits:   ratelimit.NewRegistry(ratelimit.Limits{}),
+		Commands: NewCommandStats(),
+	})
+	do("SET k v")
+	do("GET k")
+	do("GET k")
+	do("INCR k")
+	do("GET")
+	
+	info := do("INFO commandstats")
+	for _, want := range []string{
+		"# Commandstats\r\n",
+		"cmdstat_get:calls=2,",
+		"rejected_calls=1,failed_calls=0\r\n",
+		"cmdstat_incr:calls=1,",
+		"rejected_calls=0,failed_calls=1\r\n",
+		"cmdstat_set:calls=1,",
+	} {
+		if !strings.Contains(info, want) {
+			t.Errorf("INFO commandstats lacks %q:\n%s", want, info)
+		}
+	}
+	if strings.Contains(info, "# Server") {
+		t.Errorf("INFO commandstats includes the default sections:\n%s", info)
+	}
+	if info := do("INFO latencystats"); !strings.Contains(info, "latency_percentiles_usec_get:p50=") {
+		t.Errorf("INFO latencystats lacks GET:\n%s", info)
+	}
+	if info := do("INFO all"); !strings.Contains(info, "# Server") || !strings.Contains(info, "# Commandstats") {
+		t.Errorf("INFO all lacks a section:\n%s", info)
+	}
+}
+
+func TestInfoSections(t *testing.T) {
+	registry := clients.NewRegistry()
+	do := redisSessionWith(t, cache.New(1, 0), &Config{
+		Limits:  ratelimit.NewRegistry(ratelimit.Limits{}),
+		Clients: registry,
+		Version: "1.2.3",
+		Started: time.Now().Add(-90 * time.Second),
+		Port:    7000,
+	})
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	registry.Add(local, "redis")
+	do("SET k v EX 100")
+	do("SET l v")
+
+	info := do("INFO")
+	for _, want := range []string{
+		"# Server\r\n",
+		"gopogo_version:1.2.3\r\n",
+		fmt.Sprintf("process_id:%d\r\n", os.Getpid()),
+		"tcp_port:7000\r\n",
+		"uptime_in_seconds:90\r\n",
+		"# Clients\r\nconnected_clients:1\r\n",
+		"# Persistence\r\n",
+		"rdb_bgsave_in_progress:0\r\n",
+		"# Replication\r\nrole:master\r\n",
+		"# CPU\r\n",
+		"db0:keys=2,expires=1,avg_ttl=",
+	} {
+		if !strings.Contains(info, want) {
+			t.Errorf("INFO lacks %q:\n%s", want, info)
+		}
+	}
+	if strings.Contains(info, "# Commandstats") {
+		t.Errorf("INFO includes commandstats:\n%s", info)
+	}
+
+	info = do("INFO CPU keyspace")
+	if !strings.Contains(info, "# CPU\r\n") || !strings.Contains(info, "\r\n\r\n# Keyspace\r\n") || strings.Contains(info, "# Server") {
+		t.Errorf("INFO CPU keyspace = %q", info)
+	}
+	if info := do("INFO default"); !strings.Contains(info, "# Server") || strings.Contains(info, "# Latencystats") {
+		t.Errorf("INFO default = %q", info)
+	}
+	if info := do("INFO nosuchsection"); info != "$0\r\n\r\n" {
+		t.Errorf("INFO nosuchsection = %q", info)
+	}
+}
+
+func TestErrorStats(t *testing.T) {
+	errs := NewErrorStats()
+	do := redisSessionWith(t, cache.New(1, 0), &Config{
+		Limits: ratelimit.NewRegistry(ratelimit.Limits{}),
+		Auth:   []string{"secret"},
+		Errors: errs,
+	})
+	do("GET k")
+	do("AUTH wrong")
+	do("AUTH secret")
+	if info := do("INFO stats"); !strings.Contains(info, "acl_access_denied_auth:2\r\n") {
+		t.Errorf("INFO stats lacks acl_access_denied_auth:2:\n%s", info)
+	}
+	if got := do(`GET "k`); !strings.HasPrefix(got, "-ERR Protocol error") {
+		t.Fatalf("unbalanced quotes = %q", got)
+	}
+
+	want := map[string]map[string]uint64{"redis": {"auth": 2, "parse": 1}}
+	if got := errs.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() = %v, want %v", got, want)
+	}
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	prev := -1
+	for _, ns := range []uint64{0, 1, 3, 4, 5, 7, 8, 1000, 1023, 1024, 1 << 40, 1<<63 + 1} {
+		b := latencyBucket(ns)
+		if b < prev || b >= latencyBuckets {
+			t.Errorf("latencyBucket(%d) = %d after %d", ns, b, prev)
+		}
+		if limit := bucketLimit(b); ns > limit || ns < limit*4/5 {
+			t.Errorf("%dns in bucket %d, which ends at %d", ns, b, limit)
+		}
+		prev = b
+	}
+	
+	var counts [latencyBuckets]uint64
+	counts[latencyBucket(1000)] = 99
+	counts[latencyBucket(1_000_000)] = 1
+	if p := percentile(&counts, 100, 0.5); p < 1 || p > 1.25 {
+		t.Errorf("p50 = %vus, want about 1", p)
+	}
+	if p := percentile(&counts, 100, 0.999); p < 1000 || p > 1250 {
+		t.Errorf("p99.9 = %vus, want about 1000", p)
+	}
+}
@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// Handler serves the connections of one protocol. Handle returns when
+// the client disconnects; the server closes conn afterwards.
+type Handler interface {
+	Handle(conn net.Conn)
+}
+
+// Protocol describes a protocol served alongside the built-in ones.
+// Register it from an init function in a package the main package
+// imports, then enable it by name in the server configuration.
+type Protocol struct {
+	// Name identifies the protocol in configuration, CLIENT LIST and
+	// logs. It must not clash with a built-in protocol.
+	Name string
+	// Match reports whether the first bytes a client sent, up to 8 and
+	// possibly fewer, open a connection of this protocol. Registered
+	// matchers run in registration order once the built-in protocols
+	// have been ruled out, before the fallback to Redis. Nil matches
+	// nothing, for protocols reached only through ALPN.
+	Match func(peek []byte) bool
+	// ALPN lists the protocol IDs that select this protocol on TLS
+	// connections.
+	ALPN []string
+	// New creates the protocol's handler when the server starts.
+	New func(c *cache.Cache, config *Config) Handler
+
+	typ Type
+}
+
+// typeRegistered is the first Type assigned by Register.
+const typeRegistered Type = 64
+
+var registry struct {
+	sync.RWMutex
+	protocols []*Protocol
+}
+
+var builtinNames = []string{"redis", "http", "memcache", "postgres", "tls", "memcache-binary", "dns", "unknown", "all"}
+
+// Register adds a protocol and returns the Type that Detect reports for
+// it. It panics if the name is empty or already taken, or New is nil,
+// like other registration functions called from init.
+func Register(p Protocol) Type {
+	if p.Name == "" || p.New == nil {
+		panic("protocol: Register needs a name and a New function")
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if slices.Contains(builtinNames, p.Name) || lookup(p.Name) != nil {
+		panic(fmt.Sprintf("protocol: %q is already registered", p.Name))
+	}
+	p.ALPN = slices.Clone(p.ALPN)
+	p.typ = typeRegistered + Type(len(registry.protocols))
+	registry.protocols = append(registry.protocols, &p)
+	return p.typ
+}
+
+// Lookup returns the registered protocol with the given name.
+func Lookup(name string) (*Protocol, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	p := lookup(name)
+	return p, p != nil
+}
+
+func lookup(name string) *Protocol {
+	for _, p := range registry.protocols {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Type returns the Type that Detect reports for the protocol.
+func (p *Protocol) Type() Type {
+	return p.typ
+}
+
+// registered returns the protocol for a Type assigned by Register.
+func registered(t Type) *Protocol {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	if i := int(t - typeRegistered); t >= typeRegistered && i < len(registry.protocols) {
+		return registry.protocols[i]
+	}
+	return nil
+}
+
+// matchRegistered returns the Type of the first registered protocol
+// that is enabled and whose matcher accepts peek.
+func matchRegistered(peek []byte, enabled func(Type) bool) (Type, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	for _, p := range registry.protocols {
+		if p.Match != nil && enabled(p.typ) && p.Match(peek) {
+			return p.typ, true
+		}
+	}
+	return TypeUnknown, false
+}
@@ -0,0 +1,360 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"slices"
+)
+
+const (
+	// DefaultMaxBulkLen is the default limit for a single bulk string.
+	DefaultMaxBulkLen = 512 * 1024 * 1024
+	// DefaultMaxMultiBulkLen is the default limit for arguments per command.
+	DefaultMaxMultiBulkLen = 1024 * 1024
+
+	maxInlineLen = 64 * 1024
+	bulkChunk    = 64 * 1024
+)
+
+var errInvalidInt = errors.New("invalid integer")
+
+// protocolError reports a malformed frame. The connection cannot be
+// resynchronized after one, so handlers reply and close.
+type protocolError struct {
+	msg string
+}
+
+func (e *protocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+var (
+	errTooBigInline           = &protocolError{"too big inline request"}
+	errInvalidMultiBulkLength = &protocolError{"invalid multibulk length"}
+	errInvalidBulkLength      = &protocolError{"invalid bulk length"}
+	errExpectedBulk           = &protocolError{"expected '$'"}
+	errUnbalancedQuotes       = &protocolError{"unbalanced quotes in request"}
+)
+
+// respReader parses RESP commands from a connection. It reuses its
+// buffers between calls, so the argument slices returned by ReadCommand
+// are only valid until the next call; callers must copy anything they
+// retain.
+type respReader struct {
+	reader          *bufio.Reader
+	args            [][]byte
+	buf             []byte
+	line            []byte
+	offsets         []int
+	maxBulkLen      int64
+	maxMultiBulkLen int64
+}
+
+func newRESPReader(r io.Reader, config *Config) *respReader {
+	reader := &respReader{
+		reader:          bufio.NewReader(r),
+		args:            make([][]byte, 0, 8),
+		buf:             make([]byte, 0, 512),
+		maxBulkLen:      DefaultMaxBulkLen,
+		maxMultiBulkLen: DefaultMaxMultiBulkLen,
+	}
+
+	if config != nil {
+		if config.MaxBulkLen > 0 {
+			reader.maxBulkLen = config.MaxBulkLen
+		}
+		if config.MaxMultiBulkLen > 0 {
+			reader.maxMultiBulkLen = config.MaxMultiBulkLen
+		}
+	}
+
+	return reader
+}
+
+// Wait blocks until the next command's first byte has arrived or the
+// connection fails; ReadCommand then reports the error.
+func (r *respReader) Wait() {
+	r.reader.Peek(1)
+}
+
+// WaitClosed blocks until reading fails and returns the error, leaving
+// whatever arrives meanwhile buffered for ReadCommand. It returns nil if
+// the buffer fills first.
+func (r *respReader) WaitClosed() error {
+	for r.reader.Buffered() < r.reader.Size() {
+		if _, err := r.reader.Peek(r.reader.Buffered() + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadCommand reads the next command, either a multibulk array or an
+// inline command line. It returns a nil slice for empty lines.
+func (r *respReader) ReadCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	if line[0] == '*' {
+		return r.readMultiBulk(line)
+	}
+
+	return r.readInline(line)
+}
+
+func (r *respReader) readLine() ([]byte, error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		r.line = append(r.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			if len(r.line) > maxInlineLen {
+				return nil, errTooBigInline
+			}
+			line, err = r.reader.ReadSlice('\n')
+			r.line = append(r.line, line...)
+		}
+		line = r.line
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return trimCRLF(line), nil
+}
+
+// readInline splits an inline command line into arguments the way
+// redis-cli quotes them. Arguments are separated by whitespace. A
+// double-quoted argument may contain spaces and the escapes \n, \r, \t,
+// \b, \a, \xHH and a backslash before any other byte; in a single-quoted
+// one only \' is an escape.
+func (r *respReader) readInline(line []byte) ([][]byte, error) {
+	// The line is a view into the bufio buffer, so the arguments are
+	// unquoted into buf. Unquoting never lengthens them, so buf is grown
+	// once and the slices into it stay valid.
+	r.buf = slices.Grow(r.buf[:0], len(line))
+	r.args = r.args[:0]
+
+	i := 0
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return r.args, nil
+		}
+
+		start := len(r.buf)
+		var quote byte
+	arg:
+		for ; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case quote == 0 && isInlineSpace(c):
+				break arg
+			case quote == 0 && (c == '"' || c == '\''):
+				quote = c
+			case quote == 0:
+				r.buf = append(r.buf, c)
+			case c == quote:
+				// A closing quote must end the argument.
+				if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+					return nil, errUnbalancedQuotes
+				}
+				quote = 0
+				i++
+				break arg
+			case quote == '\'' && c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+				r.buf = append(r.buf, '\'')
+				i++
+			case quote == '"' && c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+				r.buf = append(r.buf, unhex(line[i+2])<<4|unhex(line[i+3]))
+				i += 3
+			case quote == '"' && c == '\\' && i+1 < len(line):
+				i++
+				r.buf = append(r.buf, unescapeInline(line[i]))
+			default:
+				r.buf = append(r.buf, c)
+			}
+		}
+		if quote != 0 {
+			return nil, errUnbalancedQuotes
+		}
+		r.args = append(r.args, r.buf[start:])
+	}
+}
+
+func isInlineSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// unescapeInline returns the byte a backslash followed by c stands for in
+// a double-quoted inline argument.
+func unescapeInline(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
+
+func (r *respReader) readMultiBulk(line []byte) ([][]byte, error) {
+	count, err := parseInt(line[1:])
+	if err != nil || count < 0 || count > r.maxMultiBulkLen {
+		return nil, errInvalidMultiBulkLength
+	}
+
+	r.buf = r.buf[:0]
+	r.offsets = r.offsets[:0]
+
+	for i := int64(0); i < count; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errExpectedBulk
+		}
+
+		size, err := parseInt(line[1:])
+		if err != nil || size < 0 || size > r.maxBulkLen {
+			return nil, errInvalidBulkLength
+		}
+
+		// Offsets are recorded instead of slices because growing buf
+		// may move it.
+		start := len(r.buf)
+		if err := r.readBulk(int(size)); err != nil {
+			return nil, err
+		}
+		r.offsets = append(r.offsets, start, len(r.buf))
+	}
+
+	r.args = r.args[:0]
+	for i := 0; i < len(r.offsets); i += 2 {
+		r.args = append(r.args, r.buf[r.offsets[i]:r.offsets[i+1]])
+	}
+
+	return r.args, nil
+}
+
+// readBulk appends a bulk payload of the given size to buf and consumes
+// its trailing CRLF. The buffer grows as data arrives rather than up
+// front, so a large announced size costs nothing until it is sent.
+func (r *respReader) readBulk(size int) error {
+	for remaining := size; remaining > 0; {
+		n := min(remaining, bulkChunk)
+		start := len(r.buf)
+		r.buf = slices.Grow(r.buf, n)[:start+n]
+		if _, err := io.ReadFull(r.reader, r.buf[start:]); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+
+	cr, err := r.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	lf, err := r.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if cr != '\r' || lf != '\n' {
+		return errInvalidBulkLength
+	}
+
+	return nil
+}
+
+// readSized reads exactly n bytes from r, which a client announced ahead
+// of sending them. Like readBulk it grows the buffer as the bytes arrive,
+// so a lie about n costs no more memory than the bytes actually sent.
+func readSized(r io.Reader, n int) ([]byte, error) {
+	buf := []byte{}
+	for remaining := n; remaining > 0; {
+		chunk := min(remaining, bulkChunk)
+		start := len(buf)
+		buf = slices.Grow(buf, chunk)[:start+chunk]
+		if _, err := io.ReadFull(r, buf[start:]); err != nil {
+			return nil, err
+		}
+		remaining -= chunk
+	}
+	return buf, nil
+}
+
+func trimCRLF(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line
+}
+
+// parseInt parses a signed decimal integer without allocating.
+func parseInt(b []byte) (int64, error) {
+	if len(b) == 0 {
+		return 0, errInvalidInt
+	}
+
+	neg := false
+	if b[0] == '-' {
+		neg = true
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, errInvalidInt
+		}
+	}
+
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, errInvalidInt
+		}
+		if n > (1<<63-1-int64(c-'0'))/10 {
+			return 0, errInvalidInt
+		}
+		n = n*10 + int64(c-'0')
+	}
+
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
@@ -0,0 +1,228 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// repeatReader replays the same bytes forever.
+type repeatReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.pos:])
+		n += c
+		r.pos = (r.pos + c) % len(r.data)
+	}
+	return n, nil
+}
+
+func TestRESPReaderMultiBulk(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nva\r\nl\r\n*1\r\n$4\r\nPING\r\n"
+	r := newRESPReader(strings.NewReader(input), nil)
+
+	args, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	want := []string{"SET", "key", "va\r\nl"}
+	if len(args) != len(want) {
+		t.Fatalf("Expected %d args, got %d", len(want), len(args))
+	}
+	for i := range want {
+		if string(args[i]) != want[i] {
+			t.Fatalf("Arg %d mismatch: got %q, want %q", i, args[i], want[i])
+		}
+	}
+
+	args, err = r.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	if len(args) != 1 || string(args[0]) != "PING" {
+		t.Fatalf("Unexpected args: %q", args)
+	}
+
+	if _, err = r.ReadCommand(); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestRESPReaderInline(t *testing.T) {
+	r := newRESPReader(strings.NewReader("set  foo\tbar\r\n\r\nget foo\n"), nil)
+
+	args, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	if len(args) != 3 || string(args[0]) != "set" || string(args[1]) != "foo" || string(args[2]) != "bar" {
+		t.Fatalf("Unexpected args: %q", args)
+	}
+
+	args, err = r.ReadCommand()
+	if err != nil || args != nil {
+		t.Fatalf("Expected empty command, got %q, %v", args, err)
+	}
+
+	args, err = r.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	if len(args) != 2 || string(args[1]) != "foo" {
+		t.Fatalf("Unexpected args: %q", args)
+	}
+}
+
+func TestRESPReaderLongLine(t *testing.T) {
+	key := strings.Repeat("k", 10000)
+	r := newRESPReader(strings.NewReader("GET " + key + "\r\n"), nil)
+
+	args, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand failed: %v", err)
+	}
+	if len(args) != 2 || !bytes.Equal(args[1], []byte(key)) {
+		t.Fatal("Long inline argument mismatch")
+	}
+}
+
+func TestRESPReaderInlineQuotes(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`SET "my key" "a b"`, []string{"SET", "my key", "a b"}},
+		{`SET k "tab\there\nnew \"quoted\" \\"`, []string{"SET", "k", "tab\there\nnew \"quoted\" \\"}},
+		{`SET "\x00\xff\xZZ" ''`, []string{"SET", "\x00\xffxZZ", ""}},
+		{`SET 'it\'s' 'no \n escape'`, []string{"SET", "it's", `no \n escape`}},
+		{`GET ab"c d"`, []string{"GET", "abc d"}},
+	}
+
+	for _, tt := range tests {
+		r := newRESPReader(strings.NewReader(tt.line+"\r\n"), nil)
+		args, err := r.ReadCommand()
+		if err != nil {
+			t.Errorf("%s: %v", tt.line, err)
+			continue
+		}
+		got := make([]string, len(args))
+		for i, arg := range args {
+			got[i] = string(arg)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"123", 123, true},
+		{"-42", -42, true},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"9223372036854775808", 0, false},
+		{"", 0, false},
+		{"-", 0, false},
+		{"12a", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseInt([]byte(tt.in))
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseInt(%q) = %d, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestRESPReaderProtocolErrors(t *testing.T) {
+	config := &Config{MaxBulkLen: 16, MaxMultiBulkLen: 4}
+
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"negative multibulk", "*-5\r\n", errInvalidMultiBulkLength},
+		{"multibulk too long", "*5\r\n", errInvalidMultiBulkLength},
+		{"multibulk not a number", "*x\r\n", errInvalidMultiBulkLength},
+		{"negative bulk", "*1\r\n$-1\r\n", errInvalidBulkLength},
+		{"bulk too long", "*1\r\n$1073741824\r\n", errInvalidBulkLength},
+		{"bulk missing crlf", "*1\r\n$3\r\nfooXX", errInvalidBulkLength},
+		{"missing dollar", "*1\r\n:3\r\n", errExpectedBulk},
+		{"inline too long", strings.Repeat("a", maxInlineLen+8192) + "\r\n", errTooBigInline},
+		{"unterminated quote", "SET \"key value\r\n", errUnbalancedQuotes},
+		{"text after quote", "SET \"key\"x value\r\n", errUnbalancedQuotes},
+	}
+
+	for _, tt := range tests {
+		r := newRESPReader(strings.NewReader(tt.input), config)
+		if _, err := r.ReadCommand(); err != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func FuzzRESPReader(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"))
+	f.Add([]byte("PING\r\n"))
+	f.Add([]byte("*1\r\n$-1\r\n"))
+	f.Add([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$2\r\nv"))
+	f.Add([]byte("*9223372036854775807\r\n"))
+
+	config := &Config{MaxBulkLen: 1024, MaxMultiBulkLen: 64}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := newRESPReader(bytes.NewReader(data), config)
+		for {
+			args, err := r.ReadCommand()
+			if err != nil {
+				return
+			}
+			for _, arg := range args {
+				if len(arg) > len(data) {
+					t.Fatalf("argument longer than input: %d", len(arg))
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkRESPReaderMultiBulk(b *testing.B) {
+	cmd := []byte("*3\r\n$3\r\nSET\r\n$10\r\nbench:key1\r\n$16\r\nbench-value-0001\r\n")
+	r := newRESPReader(&repeatReader{data: cmd}, nil)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(cmd)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadCommand(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRESPReaderInline(b *testing.B) {
+	cmd := []byte("SET bench:key1 bench-value-0001\r\n")
+	r := newRESPReader(&repeatReader{data: cmd}, nil)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(cmd)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadCommand(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package protocol
+
+import (
+	"bufio"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// commandTrace collects where the commands of a connection that turned on
+// DEBUG TRACE spend their time.
+type commandTrace struct {
+	// cache is the time spent in cache operations by the running
+	// command.
+	cache time.Duration
+	// last holds the timings of the last command traced.
+	last traceTimings
+}
+
+// traceTimings are the phases of one traced command. Parse covers reading
+// the command once its first byte arrived; Cache the cache operations it
+// made, LockWait included; Serialize the rest of running it, encoding the
+// reply and flushing it to the connection. LockWait is the time any client
+// spent waiting for shard locks while the command ran.
+type traceTimings struct {
+	command   string
+	parse     time.Duration
+	lockWait  time.Duration
+	cache     time.Duration
+	serialize time.Duration
+	total     time.Duration
+}
+
+// logAttrs returns the timings as slog attributes.
+func (t *traceTimings) logAttrs() []any {
+	return []any{
+		"command", t.command,
+		"parse", t.parse,
+		"lock_wait", t.lockWait,
+		"cache", t.cache,
+		"serialize", t.serialize,
+		"total", t.total,
+	}
+}
+
+// writeTrace writes the last traced command's timings, in microseconds, as
+// a flat array of names and values.
+func (h *RedisHandler) writeTrace(writer *bufio.Writer, t *traceTimings) {
+	if t.command == "" {
+		h.writeArrayLen(writer, 0)
+		return
+	}
+	h.writeArrayLen(writer, 12)
+	h.writeBulkString(writer, "command")
+	h.writeBulkString(writer, t.command)
+	for _, phase := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"parse_us", t.parse},
+		{"lock_wait_us", t.lockWait},
+		{"cache_us", t.cache},
+		{"serialize_us", t.serialize},
+		{"total_us", t.total},
+	} {
+		h.writeBulkString(writer, phase.name)
+		h.writeInteger(writer, phase.d.Microseconds())
+	}
+}
+
+// traceCommand runs cmd for a traced connection, records its timings and
+// logs them. start is when the command's first byte arrived and parsed
+// when it had been read in full.
+func (h *RedisHandler) traceCommand(c *redisClient, name []byte, cmd [][]byte, start, parsed time.Time) {
+	trace := c.trace
+	trace.cache = 0
+	command := strings.ToLower(string(cmd[0]))
+	lockWait := h.cache.LockWait()
+
+	traced := h.withKeyspace(tracingKeyspace{h.cache, trace})
+	traced.noTouch = h.noTouch.withKeyspace(tracingKeyspace{h.noTouch.cache, trace})
+	traced.dispatch(c, name, cmd)
+	c.writer.Flush()
+
+	// DEBUG TRACE OFF stops tracing from the next command on.
+	done := time.Now()
+	trace.last = traceTimings{
+		command:   command,
+		parse:     parsed.Sub(start),
+		lockWait:  h.cache.LockWait() - lockWait,
+		cache:     trace.cache,
+		serialize: done.Sub(parsed) - trace.cache,
+		total:     done.Sub(start),
+	}
+	slog.Info("command trace", append([]any{"client", c.conn.RemoteAddr().String()}, trace.last.logAttrs()...)...)
+}
+
+// tracingKeyspace adds the time spent in the key operations of a traced
+// command to its trace.
+type tracingKeyspace struct {
+	Keyspace
+	trace *commandTrace
+}
+
+// timed adds the time since start to the trace.
+func (ks tracingKeyspace) timed(start time.Time) {
+	ks.trace.cache += time.Since(start)
+}
+
+func (ks tracingKeyspace) Store(key, value []byte, opts *cache.StoreOptions) error {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Store(key, value, opts)
+}
+
+func (ks tracingKeyspace) Load(key []byte) (*cache.Entry, bool) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Load(key)
+}
+
+func (ks tracingKeyspace) LoadNoTouch(key []byte) (*cache.Entry, bool) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.LoadNoTouch(key)
+}
+
+func (ks tracingKeyspace) LoadOrStore(key, value []byte, opts *cache.StoreOptions) (*cache.Entry, bool) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.LoadOrStore(key, value, opts)
+}
+
+func (ks tracingKeyspace) Swap(key, value []byte, opts *cache.StoreOptions) (*cache.Entry, bool) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Swap(key, value, opts)
+}
+
+func (ks tracingKeyspace) Fetch(key []byte, opts *cache.StoreOptions, load func() ([]byte, error)) (*cache.Entry, bool, error) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Fetch(key, opts, load)
+}
+
+func (ks tracingKeyspace) Delete(key []byte) bool {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Delete(key)
+}
+
+func (ks tracingKeyspace) LoadAndDelete(key []byte) (*cache.Entry, bool) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.LoadAndDelete(key)
+}
+
+func (ks tracingKeyspace) CompareAndSwap(key, value []byte, cas uint64, opts *cache.StoreOptions) (bool, error) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.CompareAndSwap(key, value, cas, opts)
+}
+
+func (ks tracingKeyspace) CompareAndDelete(key []byte, cas uint64) (bool, error) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.CompareAndDelete(key, cas)
+}
+
+func (ks tracingKeyspace) Increment(key []byte, delta int64) (int64, error) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Increment(key, delta)
+}
+
+func (ks tracingKeyspace) IncrementUnsigned(key []byte, delta uint64, decr bool) (uint64, error) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.IncrementUnsigned(key, delta, decr)
+}
+
+func (ks tracingKeyspace) Update(key []byte, fn func(value []byte, found bool) []byte) error {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Update(key, fn)
+}
+
+func (ks tracingKeyspace) Apply(ops []cache.Op) error {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Apply(ops)
+}
+
+func (ks tracingKeyspace) LoadMany(keys [][]byte) []*cache.Entry {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.LoadMany(keys)
+}
+
+func (ks tracingKeyspace) LoadManyNoTouch(keys [][]byte) []*cache.Entry {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.LoadManyNoTouch(keys)
+}
+
+func (ks tracingKeyspace) StoreMany(keys, values [][]byte, opts *cache.StoreOptions) error {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.StoreMany(keys, values, opts)
+}
+
+func (ks tracingKeyspace) Rename(src, dst []byte, nx bool) (bool, error) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Rename(src, dst, nx)
+}
+
+func (ks tracingKeyspace) Copy(src, dst []byte, replace bool) (bool, error) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Copy(src, dst, replace)
+}
+
+func (ks tracingKeyspace) Iterate(fn func(*cache.Entry) bool) {
+	defer ks.timed(time.Now())
+	ks.Keyspace.Iterate(fn)
+}
+
+func (ks tracingKeyspace) IterateSnapshot(fn func(*cache.Entry) bool) {
+	defer ks.timed(time.Now())
+	ks.Keyspace.IterateSnapshot(fn)
+}
+
+func (ks tracingKeyspace) IterateParallel(fn func(*cache.Entry) bool, workers int) {
+	defer ks.timed(time.Now())
+	ks.Keyspace.IterateParallel(fn, workers)
+}
+
+func (ks tracingKeyspace) Expire(key []byte, expireAt int64) bool {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Expire(key, expireAt)
+}
+
+func (ks tracingKeyspace) Inspect(key []byte) (cache.EntryInfo, bool) {
+	defer ks.timed(time.Now())
+	return ks.Keyspace.Inspect(key)
+}
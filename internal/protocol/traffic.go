@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Traffic counts the commands and bytes of each protocol the server
+// speaks. A nil *Traffic counts nothing.
+type Traffic struct {
+	counters sync.Map // protocol name -> *trafficCounters
+}
+
+// ProtocolStats are the counters of one protocol. A command is a Redis
+// or memcache command, an HTTP request, a Postgres query or execute, or a
+// DNS query. Bytes are counted on the wire as the handler sees it, so TLS
+// records are counted decrypted, except on HTTP/2 connections, whose
+// bytes are not counted.
+type ProtocolStats struct {
+	Commands uint64 `json:"commands"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+type trafficCounters struct {
+	commands atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+func NewTraffic() *Traffic {
+	return &Traffic{}
+}
+
+// of returns the counters of the named protocol, or nil if t is nil.
+func (t *Traffic) of(proto string) *trafficCounters {
+	if t == nil {
+		return nil
+	}
+	if tc, ok := t.counters.Load(proto); ok {
+		return tc.(*trafficCounters)
+	}
+	tc, _ := t.counters.LoadOrStore(proto, &trafficCounters{})
+	return tc.(*trafficCounters)
+}
+
+// Stats returns the counters of every protocol that has had traffic, by
+// name.
+func (t *Traffic) Stats() map[string]ProtocolStats {
+	stats := make(map[string]ProtocolStats)
+	if t == nil {
+		return stats
+	}
+	t.counters.Range(func(name, v any) bool {
+		tc := v.(*trafficCounters)
+		stats[name.(string)] = ProtocolStats{
+			Commands: tc.commands.Load(),
+			BytesIn:  tc.bytesIn.Load(),
+			BytesOut: tc.bytesOut.Load(),
+		}
+		return true
+	})
+	return stats
+}
+
+// Total adds up the counters of every protocol.
+func (t *Traffic) Total() ProtocolStats {
+	var total ProtocolStats
+	for _, s := range t.Stats() {
+		total.Commands += s.Commands
+		total.BytesIn += s.BytesIn
+		total.BytesOut += s.BytesOut
+	}
+	return total
+}
+
+// protocolNames returns the names in stats in order, for output that
+// should not change from one request to the next.
+func protocolNames(stats map[string]ProtocolStats) []string {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (tc *trafficCounters) command() {
+	if tc != nil {
+		tc.commands.Add(1)
+	}
+}
+
+// packet counts a datagram received and the reply sent, for the UDP
+// listeners.
+func (tc *trafficCounters) packet(in, out int) {
+	if tc != nil {
+		tc.bytesIn.Add(uint64(in))
+		tc.bytesOut.Add(uint64(out))
+	}
+}
+
+// wrap returns conn counting the bytes read from and written to it.
+func (tc *trafficCounters) wrap(conn net.Conn) net.Conn {
+	if tc == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, counters: tc}
+}
+
+type countingConn struct {
+	net.Conn
+	counters *trafficCounters
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counters.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.counters.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+// isTLS reports whether conn is a TLS connection, seeing through the
+// byte counting and the server's wrappers, which have an Unwrap method.
+func isTLS(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return true
+		case *countingConn:
+			conn = c.Conn
+		case interface{ Unwrap() net.Conn }:
+			conn = c.Unwrap()
+		default:
+			return false
+		}
+	}
+}
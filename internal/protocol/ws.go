@@ -0,0 +1,439 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// wsGUID is the fixed suffix RFC 6455 hashes with Sec-WebSocket-Key.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocket close codes.
+const (
+	wsCloseNormal   = 1000
+	wsCloseProtocol = 1002
+	wsCloseTooBig   = 1009
+)
+
+var (
+	errWSClosed   = errors.New("websocket closed")
+	errWSProtocol = errors.New("websocket protocol error")
+	errWSTooBig   = errors.New("websocket message too large")
+)
+
+// wsConn reads and writes WebSocket frames on a hijacked connection.
+// Reads happen on one goroutine; writes may come from several.
+type wsConn struct {
+	r          *bufio.Reader
+	maxMessage int64
+
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// readMessage returns the next text or binary message, reassembling
+// fragments and answering pings and close frames on the way. It returns
+// errWSClosed once the client has closed the connection.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame(int64(len(message)))
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.close(wsCloseNormal)
+			return nil, errWSClosed
+		case wsText, wsBinary:
+			if message != nil {
+				return nil, c.fail(errWSProtocol)
+			}
+			message = payload
+		case wsContinuation:
+			if message == nil {
+				return nil, c.fail(errWSProtocol)
+			}
+			message = append(message, payload...)
+		default:
+			return nil, c.fail(errWSProtocol)
+		}
+
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads one frame, of which buffered bytes of its message have
+// already been read. Clients must mask their frames.
+func (c *wsConn) readFrame(buffered int64) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7f)
+	control := opcode&0x8 != 0
+
+	if header[0]&0x70 != 0 || !masked || (control && (!fin || length > 125)) {
+		return false, 0, nil, c.fail(errWSProtocol)
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n := binary.BigEndian.Uint64(ext[:])
+		if n > uint64(c.maxMessage) {
+			return false, 0, nil, c.fail(errWSTooBig)
+		}
+		length = int64(n)
+	}
+	if !control && buffered+length > c.maxMessage {
+		return false, 0, nil, c.fail(errWSTooBig)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes one unfragmented, unmasked frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n <= 125:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	c.w.Write(header)
+	c.w.Write(payload)
+	return c.w.Flush()
+}
+
+// writeJSON writes v as a text message.
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, data)
+}
+
+// close sends a close frame with the given status code.
+func (c *wsConn) close(code uint16) {
+	c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// fail closes the connection for a protocol violation and returns err.
+func (c *wsConn) fail(err error) error {
+	if errors.Is(err, errWSTooBig) {
+		c.close(wsCloseTooBig)
+	} else {
+		c.close(wsCloseProtocol)
+	}
+	return err
+}
+
+// wsRequest is a command frame. Which fields apply depends on Cmd.
+type wsRequest struct {
+	ID       json.RawMessage `json:"id"`
+	Cmd      string          `json:"cmd"`
+	Key      string          `json:"key"`
+	Value    *string         `json:"value"`
+	TTL      int64           `json:"ttl"`
+	Delta    *int64          `json:"delta"`
+	Channel  string          `json:"channel"`
+	Message  string          `json:"message"`
+	Channels []string        `json:"channels"`
+	Patterns []string        `json:"patterns"`
+}
+
+// allowedOrigin reports whether req may open a WebSocket. Browsers let
+// any page open one to any host, so without --auth a page on another site
+// could use a visitor's browser to read and write the cache. They send
+// the page's Origin; other clients send none and are allowed.
+func (h *HTTPHandler) allowedOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == req.Host {
+		return true
+	}
+	for _, allowed := range h.config.WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWebSocket upgrades the connection and serves JSON command frames
+// and pub/sub pushes until the client disconnects.
+func (h *HTTPHandler) handleWebSocket(w http.ResponseWriter, req *http.Request) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket") || key == "" {
+		h.writeError(w, http.StatusBadRequest, "WebSocket upgrade required")
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		h.writeError(w, http.StatusUpgradeRequired, "Unsupported WebSocket version")
+		return
+	}
+	if !h.allowedOrigin(req) {
+		h.writeError(w, http.StatusForbidden, "Origin not allowed")
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		h.writeError(w, http.StatusHTTPVersionNotSupported, "WebSocket requires HTTP/1.1")
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	// The connection is ours now; Handle returns once this does.
+	state, _ := req.Context().Value(httpConnKey{}).(*httpConn)
+	if state != nil {
+		defer state.close()
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw.Writer, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Writer.Flush(); err != nil {
+		return
+	}
+
+	ws := &wsConn{r: rw.Reader, w: rw.Writer, maxMessage: h.maxValueLen()}
+	session := &wsSession{h: h, ws: ws, done: make(chan struct{})}
+	defer session.close()
+
+	for {
+		data, err := ws.readMessage()
+		if err != nil {
+			return
+		}
+		if state != nil && !state.limiter.AllowCommand() {
+			ws.writeJSON(map[string]any{"error": "Rate limit exceeded"})
+			continue
+		}
+		if err := ws.writeJSON(session.do(data)); err != nil {
+			return
+		}
+	}
+}
+
+// headerContains reports whether a comma-separated header lists token,
+// ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsSession is the state of one WebSocket client. Its subscriber is
+// created by the first subscription, which also starts the goroutine
+// that pushes messages.
+type wsSession struct {
+	h    *HTTPHandler
+	ws   *wsConn
+	sub  *subscriber
+	done chan struct{}
+}
+
+func (s *wsSession) close() {
+	close(s.done)
+	if s.sub != nil {
+		s.sub.close()
+	}
+}
+
+// push writes messages from the session's subscriptions until it closes.
+func (s *wsSession) push() {
+	for {
+		select {
+		case msg := <-s.sub.messages:
+			frame := map[string]any{"type": "message", "channel": msg.Channel, "message": msg.Message}
+			if msg.Pattern != "" {
+				frame["type"] = "pmessage"
+				frame["pattern"] = msg.Pattern
+			}
+			if s.ws.writeJSON(frame) != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// do runs one command frame and returns the reply, which echoes the
+// request's id.
+func (s *wsSession) do(data []byte) map[string]any {
+	var req wsRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return map[string]any{"error": "Invalid JSON command"}
+	}
+
+	reply := map[string]any{}
+	if req.ID != nil {
+		reply["id"] = req.ID
+	}
+	result, errMsg := s.run(&req)
+	if errMsg != "" {
+		reply["error"] = errMsg
+	} else {
+		reply["result"] = result
+	}
+	return reply
+}
+
+func (s *wsSession) run(req *wsRequest) (any, string) {
+	ks := s.h.cache
+	key := []byte(req.Key)
+
+	switch strings.ToLower(req.Cmd) {
+	case "ping":
+		return "PONG", ""
+
+	case "get":
+		entry, found := readThrough(ks, s.h.config, TypeHTTP, key)
+		if !found {
+			return nil, ""
+		}
+		return string(entry.Value()), ""
+
+	case "set":
+		if req.Value == nil {
+			return nil, "Value required"
+		}
+		opts := &cache.StoreOptions{TTL: time.Duration(req.TTL) * time.Second}
+		err := ks.Store(key, []byte(*req.Value), opts)
+		switch {
+		case errors.Is(err, cache.ErrKeyTooLarge):
+			return nil, "Key too large"
+		case errors.Is(err, cache.ErrValueTooLarge):
+			return nil, "Value too large"
+		case err != nil:
+			return nil, err.Error()
+		}
+		return "OK", ""
+
+	case "del":
+		if ks.Delete(key) {
+			return 1, ""
+		}
+		return 0, ""
+
+	case "incr":
+		delta := int64(1)
+		if req.Delta != nil {
+			delta = *req.Delta
+		}
+		value, err := ks.Increment(key, delta)
+		if err != nil {
+			return nil, err.Error()
+		}
+		return value, ""
+
+	case "ttl":
+		entry, found := ks.Load(key)
+		if !found {
+			return nil, ""
+		}
+		return ttlSeconds(entry), ""
+
+	case "expire":
+		var expireAt int64
+		if req.TTL > 0 {
+			expireAt = time.Now().Add(time.Duration(req.TTL) * time.Second).UnixNano()
+		}
+		return ks.Expire(key, expireAt), ""
+
+	case "publish":
+		return s.h.pubsub.publish(req.Channel, req.Message), ""
+
+	case "subscribe", "psubscribe", "unsubscribe", "punsubscribe":
+		cmd := strings.ToLower(req.Cmd)
+		pattern := strings.HasPrefix(cmd, "p")
+		names := req.Channels
+		if pattern {
+			names = req.Patterns
+		}
+		if s.sub == nil {
+			s.sub = s.h.pubsub.subscribe()
+			go s.push()
+		}
+		return map[string]int{"subscriptions": s.sub.set(names, pattern, !strings.Contains(cmd, "unsubscribe"))}, ""
+	}
+	return nil, fmt.Sprintf("Unknown command '%s'", req.Cmd)
+}
@@ -0,0 +1,232 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+)
+
+// wsClient is the client end of a WebSocket served over a pipe.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, h *HTTPHandler, path string) *wsClient {
+	t.Helper()
+
+	client, r, resp := upgradeWebSocket(t, h, path, "")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade answered %d", resp.StatusCode)
+	}
+	// The example handshake from RFC 6455, section 1.3.
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept = %q", got)
+	}
+	return &wsClient{t: t, conn: client, r: r}
+}
+
+// upgradeWebSocket sends an upgrade request for path, with extra header
+// lines if any, and returns the connection and the response.
+func upgradeWebSocket(t *testing.T, h *HTTPHandler, path, header string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	go h.Handle(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(client, "GET "+path+" HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+header+"\r\n")
+	r := bufio.NewReader(client)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, r, resp
+}
+
+// send writes a masked frame.
+func (c *wsClient) send(fin bool, opcode byte, payload string) {
+	c.t.Helper()
+
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i := range len(payload) {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// recv reads an unfragmented frame.
+func (c *wsClient) recv() (byte, []byte) {
+	c.t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	n := int(header[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func (c *wsClient) do(cmd string) string {
+	c.t.Helper()
+
+	c.send(true, wsText, cmd)
+	_, reply := c.recv()
+	return string(reply)
+}
+
+func TestWebSocketCommands(t *testing.T) {
+	c := cache.New(1, 0)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+	ws := dialWebSocket(t, h, "/ws")
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`{"id":1,"cmd":"ping"}`, `{"id":1,"result":"PONG"}`},
+		{`{"id":"a","cmd":"set","key":"k","value":"v","ttl":60}`, `{"id":"a","result":"OK"}`},
+		{`{"cmd":"get","key":"k"}`, `{"result":"v"}`},
+		{`{"cmd":"get","key":"missing"}`, `{"result":null}`},
+		{`{"cmd":"ttl","key":"k"}`, `{"result":59}`},
+		{`{"cmd":"incr","key":"n","delta":5}`, `{"result":5}`},
+		{`{"cmd":"del","key":"k"}`, `{"result":1}`},
+		{`{"cmd":"set","key":"k"}`, `{"error":"Value required"}`},
+		{`{"cmd":"nope"}`, `{"error":"Unknown command 'nope'"}`},
+		{`not json`, `{"error":"Invalid JSON command"}`},
+	}
+	for _, tt := range tests {
+		if got := ws.do(tt.cmd); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.cmd, got, tt.want)
+		}
+	}
+
+	// A fragmented message with a ping between its fragments.
+	ws.send(false, wsText, `{"cmd":`)
+	ws.send(true, wsPing, "hi")
+	if op, payload := ws.recv(); op != wsPong || string(payload) != "hi" {
+		t.Errorf("ping answered %d %q", op, payload)
+	}
+	ws.send(true, wsContinuation, `"ping"}`)
+	if _, reply := ws.recv(); string(reply) != `{"result":"PONG"}` {
+		t.Errorf("fragmented ping = %s", reply)
+	}
+
+	ws.send(true, wsClose, "\x03\xe8")
+	if op, _ := ws.recv(); op != wsClose {
+		t.Errorf("close answered with opcode %d", op)
+	}
+}
+
+func TestWebSocketSubscriptions(t *testing.T) {
+	c := cache.New(1, 0)
+	h := NewHTTPHandler(c, &Config{Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+	ws := dialWebSocket(t, h, "/ws")
+
+	if got := ws.do(`{"cmd":"subscribe","channels":["news"]}`); got != `{"result":{"subscriptions":1}}` {
+		t.Errorf("subscribe = %s", got)
+	}
+	if got := ws.do(`{"cmd":"psubscribe","patterns":["__keyspace@0__:user:*"]}`); got != `{"result":{"subscriptions":2}}` {
+		t.Errorf("psubscribe = %s", got)
+	}
+
+	// The reply and the pushed message may arrive in either order.
+	ws.send(true, wsText, `{"cmd":"publish","channel":"news","message":"hello"}`)
+	var frames []string
+	for range 2 {
+		_, payload := ws.recv()
+		frames = append(frames, string(payload))
+	}
+	if !strings.Contains(strings.Join(frames, " "), `{"channel":"news","message":"hello","type":"message"}`) {
+		t.Errorf("publish delivered %q", frames)
+	}
+
+	c.Store([]byte("user:1"), []byte("x"), nil)
+	c.Store([]byte("other"), []byte("x"), nil)
+	c.Delete([]byte("user:1"))
+	for _, event := range []string{"set", "del"} {
+		_, payload := ws.recv()
+		var msg map[string]string
+		json.Unmarshal(payload, &msg)
+		if msg["type"] != "pmessage" || msg["channel"] != "__keyspace@0__:user:1" || msg["message"] != event {
+			t.Errorf("keyspace notification = %s, want %s of user:1", payload, event)
+		}
+	}
+
+	if got := ws.do(`{"cmd":"unsubscribe"}`); got != `{"result":{"subscriptions":1}}` {
+		t.Errorf("unsubscribe from all channels = %s", got)
+	}
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	h := NewHTTPHandler(cache.New(1, 0), &Config{Auth: []string{"secret"}, Limits: ratelimit.NewRegistry(ratelimit.Limits{})})
+	ws := dialWebSocket(t, h, "/ws?token=secret")
+	if got := ws.do(`{"cmd":"ping"}`); got != `{"result":"PONG"}` {
+		t.Errorf("ping = %s", got)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	h := NewHTTPHandler(cache.New(1, 0), &Config{
+		Limits:           ratelimit.NewRegistry(ratelimit.Limits{}),
+		WSAllowedOrigins: []string{"https://app.example.com"},
+	})
+
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{"Origin: http://x\r\n", http.StatusSwitchingProtocols},
+		{"Origin: https://app.example.com\r\n", http.StatusSwitchingProtocols},
+		{"Origin: https://evil.example.com\r\n", http.StatusForbidden},
+		{"Origin: null\r\n", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if _, _, resp := upgradeWebSocket(t, h, "/ws", tt.header); resp.StatusCode != tt.want {
+			t.Errorf("%q: upgrade answered %d, want %d", tt.header, resp.StatusCode, tt.want)
+		}
+	}
+
+	h = NewHTTPHandler(cache.New(1, 0), &Config{
+		Limits:           ratelimit.NewRegistry(ratelimit.Limits{}),
+		WSAllowedOrigins: []string{"*"},
+	})
+	if _, _, resp := upgradeWebSocket(t, h, "/ws", "Origin: https://evil.example.com\r\n"); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("upgrade with every origin allowed answered %d", resp.StatusCode)
+	}
+}
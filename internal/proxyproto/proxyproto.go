@@ -0,0 +1,249 @@
+// Package proxyproto reads the HAProxy PROXY protocol header (versions 1
+// and 2) that load balancers prepend to connections, so the server sees
+// the real client address instead of the proxy's.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// v1MaxLength is the longest a v1 header line can be, CRLF included.
+	v1MaxLength = 107
+	v2HeaderLen = 16
+)
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ErrNoHeader is returned when a connection from a trusted proxy does not
+// start with a PROXY protocol header.
+var ErrNoHeader = errors.New("proxyproto: missing PROXY protocol header")
+
+// ParseTrusted parses a list of IP addresses and CIDR ranges.
+func ParseTrusted(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address range %q", s)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Listener wraps the connections it accepts from trusted proxies in a
+// Conn. Connections from anywhere else are returned unchanged.
+type Listener struct {
+	net.Listener
+	Trusted []*net.IPNet
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return conn, nil
+	}
+	for _, ipnet := range l.Trusted {
+		if ipnet.Contains(addr.IP) {
+			return NewConn(conn), nil
+		}
+	}
+	return conn, nil
+}
+
+// Conn is a connection from a proxy. Its header is read on the first call
+// to ReadHeader, Read, RemoteAddr or LocalAddr, so callers that care about
+// blocking should call ReadHeader under a deadline first.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// ReadHeader reads and parses the PROXY header if it has not been read
+// yet. A header is required; its absence is an error.
+func (c *Conn) ReadHeader() error {
+	c.once.Do(func() {
+		c.remote, c.local, c.err = readHeader(c.reader)
+	})
+	return c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.ReadHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address reported by the proxy, or the
+// proxy's own address if it reported none.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.ReadHeader() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to on the proxy, or
+// the local address if the proxy reported none.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.ReadHeader() == nil && c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readHeader parses a v1 or v2 header. Both addresses are nil for headers
+// that carry none: v1 UNKNOWN, v2 LOCAL and non-IP families.
+func readHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch first[0] {
+	case v1Signature[0]:
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	}
+	return nil, nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		return nil, nil, err
+	}
+	if len(line) > v1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxyproto: v1 header too long or not CRLF terminated")
+	}
+	if !bytes.HasPrefix(line, v1Signature) {
+		return nil, nil, ErrNoHeader
+	}
+
+	fields := strings.Split(string(line[len(v1Signature):len(line)-2]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, fmt.Errorf("proxyproto: unsupported v1 protocol %q", fields[0])
+	}
+	if len(fields) != 5 {
+		return nil, nil, errors.New("proxyproto: malformed v1 header")
+	}
+
+	remote, err := parseV1Addr(fields[1], fields[3])
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, local, nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("proxyproto: malformed v1 address %s:%s", host, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:len(v2Signature)], v2Signature) {
+		return nil, nil, ErrNoHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("proxyproto: unsupported v2 version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL: a health check from the proxy itself.
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("proxyproto: unsupported v2 command %d", header[12]&0x0f)
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX carry no address a client can be
+		// identified by. Any TLVs after the addresses are ignored.
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("proxyproto: v2 address block too short")
+	}
+	remote := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	local := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return remote, local, nil
+}
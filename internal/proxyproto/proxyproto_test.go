@@ -0,0 +1,126 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func v2Header(command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestConn(t *testing.T) {
+	tcp4 := []byte{
+		203, 0, 113, 9, // source
+		198, 51, 100, 1, // destination
+		0xc9, 0x50, // source port 51536
+		0x18, 0xeb, // destination port 6379
+	}
+
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+		local  string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.9 198.51.100.1 51536 6379\r\n"), "203.0.113.9:51536", "198.51.100.1:6379"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::9 2001:db8::1 51536 6379\r\n"), "[2001:db8::9]:51536", "[2001:db8::1]:6379"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v2 tcp4", v2Header(0x1, 0x11, tcp4), "203.0.113.9:51536", "198.51.100.1:6379"},
+		{"v2 tcp4 with tlvs", v2Header(0x1, 0x11, append(tcp4, 0x04, 0x00, 0x01, 0xff)), "203.0.113.9:51536", "198.51.100.1:6379"},
+		{"v2 local", v2Header(0x0, 0x00, nil), "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+
+			go func() {
+				client.Write(append(tt.header, "PING\r\n"...))
+				client.Close()
+			}()
+
+			conn := NewConn(server)
+			if err := conn.ReadHeader(); err != nil {
+				t.Fatalf("ReadHeader failed: %v", err)
+			}
+
+			remote, local := tt.remote, tt.local
+			if remote == "" {
+				remote, local = server.RemoteAddr().String(), server.LocalAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != remote {
+				t.Fatalf("RemoteAddr = %s, want %s", got, remote)
+			}
+			if got := conn.LocalAddr().String(); got != local {
+				t.Fatalf("LocalAddr = %s, want %s", got, local)
+			}
+
+			// The header is consumed; the payload behind it is not.
+			data, _ := io.ReadAll(conn)
+			if string(data) != "PING\r\n" {
+				t.Fatalf("Read %q, want %q", data, "PING\r\n")
+			}
+		})
+	}
+}
+
+func TestConnRejectsMissingHeader(t *testing.T) {
+	for _, input := range []string{
+		"PING\r\n",
+		"*1\r\n$4\r\nPING\r\n",
+		"PROXY TCP4 203.0.113.9\r\n",
+		"PROXY TCP4 203.0.113.9 198.51.100.1 51536 99999\r\n",
+	} {
+		client, server := net.Pipe()
+
+		go func() {
+			client.Write([]byte(input))
+			client.Close()
+		}()
+
+		conn := NewConn(server)
+		if err := conn.ReadHeader(); err == nil {
+			t.Errorf("ReadHeader(%q) succeeded, want an error", input)
+		}
+		if _, err := conn.Read(make([]byte, 16)); err == nil {
+			t.Errorf("Read after a bad header %q succeeded", input)
+		}
+		server.Close()
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	trusted, err := ParseTrusted([]string{"10.0.0.0/24", "192.0.2.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, want := range map[string]bool{
+		"10.0.0.200":  true,
+		"10.0.1.1":    false,
+		"192.0.2.1":   true,
+		"192.0.2.2":   false,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+	} {
+		ip := net.ParseIP(addr)
+		got := false
+		for _, ipnet := range trusted {
+			got = got || ipnet.Contains(ip)
+		}
+		if got != want {
+			t.Errorf("%s trusted = %v, want %v", addr, got, want)
+		}
+	}
+
+	if _, err := ParseTrusted([]string{"not-an-ip"}); err == nil {
+		t.Error("ParseTrusted accepted an invalid address")
+	}
+}
@@ -0,0 +1,319 @@
+// Package ratelimit implements token-bucket limits on command rate and
+// read bandwidth, applied per connection and per client IP. There are no
+// per-user limits until gopogo has ACL users to key them on.
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits configures the rates enforced by a Registry. A zero rate
+// disables that limit. Bursts are one second's worth of the rate.
+type Limits struct {
+	ConnCommands float64
+	ConnBytes    float64
+	IPCommands   float64
+	IPBytes      float64
+}
+
+// Bucket is a token bucket refilled continuously at a fixed rate.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate, burst float64) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow takes n tokens if they are available and reports whether it did.
+func (b *Bucket) Allow(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Take takes n tokens unconditionally, going into debt if needed, and
+// returns how long the caller should wait for the debt to be repaid.
+func (b *Bucket) Take(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type ipState struct {
+	conns    int
+	commands *Bucket
+	bytes    *Bucket
+}
+
+// packetState holds the buckets of a packet source, which unlike a
+// connection has no end, so it is dropped once idle for packetIdle.
+type packetState struct {
+	commands *Bucket
+	bytes    *Bucket
+	last     time.Time
+}
+
+// packetIdle is how long a packet source's buckets are kept without
+// traffic. Bursts are one second's worth of the rate, so by then they
+// have refilled and a new bucket is no different.
+const packetIdle = time.Second
+
+// Registry hands out limiters for new connections and tracks the
+// buckets shared by connections from the same IP.
+type Registry struct {
+	limits Limits
+	mu     sync.Mutex
+	ips    map[string]*ipState
+	// packetAddrs and packetIPs hold the buckets of packet sources, by
+	// address and by IP, and are swept at most every packetIdle.
+	packetAddrs map[string]*packetState
+	packetIPs   map[string]*packetState
+	swept       time.Time
+}
+
+// NewRegistry returns a registry enforcing limits, or nil if no limit
+// is set. A nil registry hands out nil limiters, which allow everything.
+func NewRegistry(limits Limits) *Registry {
+	if limits == (Limits{}) {
+		return nil
+	}
+
+	return &Registry{
+		limits:      limits,
+		ips:         make(map[string]*ipState),
+		packetAddrs: make(map[string]*packetState),
+		packetIPs:   make(map[string]*packetState),
+	}
+}
+
+func newBucket(rate float64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return NewBucket(rate, rate)
+}
+
+// Open returns the limiter for a connection from addr. The caller must
+// Close it when the connection ends.
+func (r *Registry) Open(addr net.Addr) *Limiter {
+	if r == nil {
+		return nil
+	}
+
+	l := &Limiter{
+		registry: r,
+		commands: newBucket(r.limits.ConnCommands),
+		bytes:    newBucket(r.limits.ConnBytes),
+	}
+
+	if r.limits.IPCommands > 0 || r.limits.IPBytes > 0 {
+		l.ip = hostOf(addr)
+
+		r.mu.Lock()
+		state, ok := r.ips[l.ip]
+		if !ok {
+			state = &ipState{
+				commands: newBucket(r.limits.IPCommands),
+				bytes:    newBucket(r.limits.IPBytes),
+			}
+			r.ips[l.ip] = state
+		}
+		state.conns++
+		r.mu.Unlock()
+
+		l.ipCommands = state.commands
+		l.ipBytes = state.bytes
+	}
+
+	return l
+}
+
+// Packet returns the limiter for a datagram from addr. Each source
+// address is held to the per-connection limits and each source IP to
+// the per-IP limits, across datagrams. The limiter needs no Close.
+func (r *Registry) Packet(addr net.Addr) *Limiter {
+	if r == nil {
+		return nil
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.swept) >= packetIdle {
+		for _, m := range []map[string]*packetState{r.packetAddrs, r.packetIPs} {
+			for key, state := range m {
+				if now.Sub(state.last) >= packetIdle {
+					delete(m, key)
+				}
+			}
+		}
+		r.swept = now
+	}
+
+	l := &Limiter{registry: r}
+	if r.limits.ConnCommands > 0 || r.limits.ConnBytes > 0 {
+		state := packetSource(r.packetAddrs, addr.String(), r.limits.ConnCommands, r.limits.ConnBytes, now)
+		l.commands, l.bytes = state.commands, state.bytes
+	}
+	if r.limits.IPCommands > 0 || r.limits.IPBytes > 0 {
+		state := packetSource(r.packetIPs, hostOf(addr), r.limits.IPCommands, r.limits.IPBytes, now)
+		l.ipCommands, l.ipBytes = state.commands, state.bytes
+	}
+	return l
+}
+
+// packetSource returns the state for key in m, creating it with the
+// given rates if there is none, and marks it used at now.
+func packetSource(m map[string]*packetState, key string, commands, bytes float64, now time.Time) *packetState {
+	state, ok := m[key]
+	if !ok {
+		state = &packetState{commands: newBucket(commands), bytes: newBucket(bytes)}
+		m[key] = state
+	}
+	state.last = now
+	return state
+}
+
+func (r *Registry) release(ip string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if state, ok := r.ips[ip]; ok {
+		state.conns--
+		if state.conns <= 0 {
+			delete(r.ips, ip)
+		}
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Limiter applies the limits for a single connection. All methods are
+// safe to call on a nil Limiter.
+type Limiter struct {
+	registry   *Registry
+	ip         string
+	commands   *Bucket
+	bytes      *Bucket
+	ipCommands *Bucket
+	ipBytes    *Bucket
+}
+
+// AllowCommand reports whether the connection may run another command.
+// A rejected command does not consume from the IP budget.
+func (l *Limiter) AllowCommand() bool {
+	if l == nil {
+		return true
+	}
+	if l.commands != nil && !l.commands.Allow(1) {
+		return false
+	}
+	if l.ipCommands != nil && !l.ipCommands.Allow(1) {
+		return false
+	}
+	return true
+}
+
+// AllowPacket reports whether a datagram of n bytes may be served. It
+// counts as one command, and its bytes are refused rather than shaped,
+// since delaying one source would delay every other.
+func (l *Limiter) AllowPacket(n int) bool {
+	if l == nil {
+		return true
+	}
+	if !l.AllowCommand() {
+		return false
+	}
+	for _, b := range []*Bucket{l.bytes, l.ipBytes} {
+		if b != nil && !b.Allow(float64(n)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reader wraps r so that reads are delayed to respect the bandwidth
+// limits. Reads are shaped rather than rejected, since a frame cannot
+// be abandoned part way through.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil || (l.bytes == nil && l.ipBytes == nil) {
+		return r
+	}
+	return &throttledReader{reader: r, limiter: l}
+}
+
+// Close releases the connection's share of the per-IP state.
+func (l *Limiter) Close() {
+	if l == nil || l.ip == "" {
+		return
+	}
+	l.registry.release(l.ip)
+}
+
+type throttledReader struct {
+	reader  io.Reader
+	limiter *Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		var delay time.Duration
+		if t.limiter.bytes != nil {
+			delay = t.limiter.bytes.Take(float64(n))
+		}
+		if t.limiter.ipBytes != nil {
+			delay = max(delay, t.limiter.ipBytes.Take(float64(n)))
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucket(10, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.Allow(1) {
+			t.Fatalf("Allow %d failed within burst", i)
+		}
+	}
+	if b.Allow(1) {
+		t.Fatal("Allow succeeded after burst was exhausted")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !b.Allow(1) {
+		t.Fatal("Allow failed after refill")
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	b := NewBucket(1000, 1000)
+
+	if delay := b.Take(500); delay != 0 {
+		t.Fatalf("Expected no delay within burst, got %v", delay)
+	}
+	delay := b.Take(1000)
+	if delay < 400*time.Millisecond || delay > 600*time.Millisecond {
+		t.Fatalf("Expected ~500ms delay, got %v", delay)
+	}
+}
+
+func TestRegistryPerIP(t *testing.T) {
+	r := NewRegistry(Limits{IPCommands: 2})
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5678}
+
+	l1 := r.Open(addr)
+	l2 := r.Open(other)
+
+	if !l1.AllowCommand() || !l2.AllowCommand() {
+		t.Fatal("Commands within the IP limit were rejected")
+	}
+	if l1.AllowCommand() || l2.AllowCommand() {
+		t.Fatal("Connections from one IP did not share a budget")
+	}
+
+	l1.Close()
+	l2.Close()
+	if len(r.ips) != 0 {
+		t.Fatalf("Expected IP state to be released, have %d entries", len(r.ips))
+	}
+}
+
+func TestRegistryPackets(t *testing.T) {
+	r := NewRegistry(Limits{ConnCommands: 3, IPCommands: 4, IPBytes: 1000})
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	other := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5678}
+
+	// Datagrams from one address share its budget.
+	for i := 0; i < 3; i++ {
+		if !r.Packet(addr).AllowPacket(10) {
+			t.Fatalf("Datagram %d within the limit was refused", i)
+		}
+	}
+	if r.Packet(addr).AllowPacket(10) {
+		t.Fatal("Datagram over the per-address limit was allowed")
+	}
+
+	// Another port on the same IP has its own per-address budget but
+	// shares the per-IP one.
+	if !r.Packet(other).AllowPacket(10) {
+		t.Fatal("Datagram from another port was refused")
+	}
+	if r.Packet(other).AllowPacket(10) {
+		t.Fatal("Datagram over the per-IP limit was allowed")
+	}
+	if r.Packet(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}).AllowPacket(2000) {
+		t.Fatal("Datagram over the per-IP bandwidth was allowed")
+	}
+
+	// Idle sources are forgotten once their buckets have refilled.
+	time.Sleep(packetIdle)
+	if !r.Packet(addr).AllowPacket(10) {
+		t.Fatal("Datagram after the buckets refilled was refused")
+	}
+	if len(r.packetAddrs) != 1 || len(r.packetIPs) != 1 {
+		t.Fatalf("Expected idle sources to be dropped, have %d addresses and %d IPs", len(r.packetAddrs), len(r.packetIPs))
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	r := NewRegistry(Limits{})
+	if r != nil {
+		t.Fatal("Expected nil registry without limits")
+	}
+
+	l := r.Open(&net.TCPAddr{})
+	if !l.AllowCommand() {
+		t.Fatal("Nil limiter rejected a command")
+	}
+
+	src := bytes.NewReader([]byte("data"))
+	if l.Reader(src) != io.Reader(src) {
+		t.Fatal("Nil limiter wrapped the reader")
+	}
+	l.Close()
+}
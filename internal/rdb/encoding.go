@@ -0,0 +1,364 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// crc64Table is the table for the CRC-64/Jones variant Redis uses:
+// reflected, polynomial 0xad93d23594c935a9, zero initial value and no
+// final XOR.
+var crc64Table = func() *[256]uint64 {
+	const poly = 0x95ac9329ac4bc9b5 // 0xad93d23594c935a9 bit-reversed
+	var t [256]uint64
+	for i := range t {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}()
+
+func crc64Update(crc uint64, b []byte) uint64 {
+	for _, c := range b {
+		crc = crc64Table[byte(crc)^c] ^ crc>>8
+	}
+	return crc
+}
+
+// lzfDecompress expands LZF-compressed data to exactly ulen bytes.
+func lzfDecompress(in []byte, ulen uint64) ([]byte, error) {
+	if ulen > uint64(len(in))*256+256 {
+		return nil, errCorrupt // LZF cannot expand this much
+	}
+	out := make([]byte, 0, ulen)
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			// Literal run of ctrl+1 bytes.
+			n := ctrl + 1
+			if i+n > len(in) || uint64(len(out)+n) > ulen {
+				return nil, errCorrupt
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// Back reference.
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errCorrupt
+			}
+			n += int(in[i])
+			i++
+		}
+		n += 2
+		if i >= len(in) {
+			return nil, errCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || uint64(len(out)+n) > ulen {
+			return nil, errCorrupt
+		}
+		// Copy byte by byte: the source may overlap the output.
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if uint64(len(out)) != ulen {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
+
+// parseZiplist returns the elements of a ziplist, integers formatted as
+// decimal strings.
+func parseZiplist(b []byte) ([][]byte, error) {
+	if len(b) < 11 {
+		return nil, errCorrupt
+	}
+	count := int(binary.LittleEndian.Uint16(b[8:10]))
+	items := make([][]byte, 0, count)
+
+	i := 10
+	for {
+		if i >= len(b) {
+			return nil, errCorrupt
+		}
+		if b[i] == 0xff {
+			return items, nil
+		}
+
+		// Skip the previous entry length.
+		if b[i] == 0xfe {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errCorrupt
+		}
+
+		enc := b[i]
+		var item []byte
+		switch enc >> 6 {
+		case 0:
+			n := int(enc & 0x3f)
+			i++
+			if i+n > len(b) {
+				return nil, errCorrupt
+			}
+			item, i = b[i:i+n], i+n
+		case 1:
+			if i+2 > len(b) {
+				return nil, errCorrupt
+			}
+			n := int(enc&0x3f)<<8 | int(b[i+1])
+			i += 2
+			if i+n > len(b) {
+				return nil, errCorrupt
+			}
+			item, i = b[i:i+n], i+n
+		case 2:
+			if i+5 > len(b) {
+				return nil, errCorrupt
+			}
+			n := int(binary.BigEndian.Uint32(b[i+1 : i+5]))
+			i += 5
+			if n < 0 || i+n > len(b) {
+				return nil, errCorrupt
+			}
+			item, i = b[i:i+n], i+n
+		default:
+			var v int64
+			var size int
+			switch {
+			case enc == 0xc0:
+				size = 2
+			case enc == 0xd0:
+				size = 4
+			case enc == 0xe0:
+				size = 8
+			case enc == 0xf0:
+				size = 3
+			case enc == 0xfe:
+				size = 1
+			case enc >= 0xf1 && enc <= 0xfd:
+				v = int64(enc&0x0f) - 1
+			default:
+				return nil, errCorrupt
+			}
+			i++
+			if i+size > len(b) {
+				return nil, errCorrupt
+			}
+			if size > 0 {
+				v = littleEndianInt(b[i : i+size])
+				i += size
+			}
+			item = strconv.AppendInt(nil, v, 10)
+		}
+		items = append(items, item)
+	}
+}
+
+// parseListpack returns the elements of a listpack, integers formatted
+// as decimal strings.
+func parseListpack(b []byte) ([][]byte, error) {
+	if len(b) < 7 {
+		return nil, errCorrupt
+	}
+	items := make([][]byte, 0, int(binary.LittleEndian.Uint16(b[4:6])))
+
+	i := 6
+	for {
+		if i >= len(b) {
+			return nil, errCorrupt
+		}
+		enc := b[i]
+		if enc == 0xff {
+			return items, nil
+		}
+
+		start := i
+		var item []byte
+		var intVal int64
+		isInt := false
+
+		switch {
+		case enc&0x80 == 0: // 7-bit unsigned integer
+			intVal, isInt = int64(enc&0x7f), true
+			i++
+		case enc&0xc0 == 0x80: // string up to 63 bytes
+			n := int(enc & 0x3f)
+			i++
+			if i+n > len(b) {
+				return nil, errCorrupt
+			}
+			item, i = b[i:i+n], i+n
+		case enc&0xe0 == 0xc0: // 13-bit signed integer
+			if i+2 > len(b) {
+				return nil, errCorrupt
+			}
+			v := int64(enc&0x1f)<<8 | int64(b[i+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			intVal, isInt = v, true
+			i += 2
+		case enc&0xf0 == 0xe0: // string up to 4095 bytes
+			if i+2 > len(b) {
+				return nil, errCorrupt
+			}
+			n := int(enc&0x0f)<<8 | int(b[i+1])
+			i += 2
+			if i+n > len(b) {
+				return nil, errCorrupt
+			}
+			item, i = b[i:i+n], i+n
+		case enc == 0xf0: // 32-bit string length
+			if i+5 > len(b) {
+				return nil, errCorrupt
+			}
+			n := int(binary.LittleEndian.Uint32(b[i+1 : i+5]))
+			i += 5
+			if n < 0 || i+n > len(b) {
+				return nil, errCorrupt
+			}
+			item, i = b[i:i+n], i+n
+		case enc >= 0xf1 && enc <= 0xf4:
+			size := [...]int{2, 3, 4, 8}[enc-0xf1]
+			if i+1+size > len(b) {
+				return nil, errCorrupt
+			}
+			intVal, isInt = littleEndianInt(b[i+1:i+1+size]), true
+			i += 1 + size
+		default:
+			return nil, errCorrupt
+		}
+
+		if isInt {
+			item = strconv.AppendInt(nil, intVal, 10)
+		}
+		items = append(items, item)
+
+		// Skip the backlen, which takes one byte per 7 bits of the
+		// entry's length.
+		i += backlenSize(i - start)
+		if i > len(b) {
+			return nil, errCorrupt
+		}
+	}
+}
+
+func backlenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// parseIntset returns the members of an intset as decimal strings.
+func parseIntset(b []byte) ([][]byte, error) {
+	if len(b) < 8 {
+		return nil, errCorrupt
+	}
+	width := int(binary.LittleEndian.Uint32(b[0:4]))
+	count := int(binary.LittleEndian.Uint32(b[4:8]))
+	if (width != 2 && width != 4 && width != 8) || count < 0 || 8+width*count != len(b) {
+		return nil, errCorrupt
+	}
+
+	items := make([][]byte, count)
+	for i := range items {
+		off := 8 + i*width
+		items[i] = strconv.AppendInt(nil, littleEndianInt(b[off:off+width]), 10)
+	}
+	return items, nil
+}
+
+// parseZipmap returns the alternating keys and values of a zipmap, the
+// pre-2.6 small hash encoding.
+func parseZipmap(b []byte) ([][]byte, error) {
+	if len(b) < 2 {
+		return nil, errCorrupt
+	}
+	var items [][]byte
+
+	i := 1
+	readLen := func() (int, bool) {
+		if i >= len(b) {
+			return 0, false
+		}
+		if b[i] < 254 {
+			n := int(b[i])
+			i++
+			return n, true
+		}
+		if b[i] == 254 && i+5 <= len(b) {
+			n := int(binary.LittleEndian.Uint32(b[i+1 : i+5]))
+			i += 5
+			return n, true
+		}
+		return 0, false
+	}
+
+	for {
+		if i >= len(b) {
+			return nil, errCorrupt
+		}
+		if b[i] == 0xff {
+			return items, nil
+		}
+
+		n, ok := readLen()
+		if !ok || i+n > len(b) {
+			return nil, errCorrupt
+		}
+		key := b[i : i+n]
+		i += n
+
+		n, ok = readLen()
+		if !ok || i+1 > len(b) {
+			return nil, errCorrupt
+		}
+		free := int(b[i])
+		i++
+		if i+n+free > len(b) {
+			return nil, errCorrupt
+		}
+		items = append(items, key, b[i:i+n])
+		i += n + free
+	}
+}
+
+// littleEndianInt decodes a signed little-endian integer of 1 to 8 bytes.
+func littleEndianInt(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*uint(len(b))
+	return int64(v<<shift) >> shift
+}
@@ -0,0 +1,57 @@
+package rdb
+
+import (
+	"io"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+// LoadStats counts the outcome of Load.
+type LoadStats struct {
+	Loaded  int
+	Expired int
+	// Skipped counts keys of types the cache cannot hold yet.
+	Skipped map[Type]int
+}
+
+// progressInterval is how many keys Load reads between progress calls.
+const progressInterval = 100000
+
+// Load reads an RDB file into c. String keys are stored with their
+// expiry; keys that have already expired are dropped and keys of other
+// types are counted in Skipped. If progress is non-nil it is called
+// periodically with the running totals.
+func Load(r io.Reader, c *cache.Cache, progress func(LoadStats)) (LoadStats, error) {
+	stats := LoadStats{Skipped: make(map[Type]int)}
+	seen := 0
+
+	err := Parse(r, func(e *Entry) error {
+		seen++
+		if progress != nil && seen%progressInterval == 0 {
+			progress(stats)
+		}
+
+		if e.Type != TypeString {
+			stats.Skipped[e.Type]++
+			return nil
+		}
+
+		opts := &cache.StoreOptions{}
+		if e.ExpireAt > 0 {
+			opts.TTL = time.Until(time.UnixMilli(e.ExpireAt))
+			if opts.TTL <= 0 {
+				stats.Expired++
+				return nil
+			}
+		}
+
+		if err := c.Store(e.Key, e.String, opts); err != nil {
+			return err
+		}
+		stats.Loaded++
+		return nil
+	})
+
+	return stats, err
+}
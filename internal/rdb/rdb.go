@@ -0,0 +1,629 @@
+// Package rdb reads Redis RDB dump files.
+//
+// It understands RDB versions 1 through 12 and the string, list, set,
+// sorted set and hash types in all of their encodings (including the
+// ziplist, listpack, intset, zipmap and quicklist forms), together with
+// key expiry. Streams and module types are reported as unsupported.
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Type is the logical type of a value.
+type Type int
+
+const (
+	TypeString Type = iota
+	TypeList
+	TypeSet
+	TypeZSet
+	TypeHash
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	case TypeSet:
+		return "set"
+	case TypeZSet:
+		return "zset"
+	case TypeHash:
+		return "hash"
+	default:
+		return "unknown"
+	}
+}
+
+// Member is an element of a sorted set.
+type Member struct {
+	Value []byte
+	Score float64
+}
+
+// Field is a hash field.
+type Field struct {
+	Name  []byte
+	Value []byte
+}
+
+// Entry is a key read from an RDB file. Only the field matching Type is
+// set: String for strings, Members for lists and sets (in file order),
+// ZSet for sorted sets and Hash for hashes.
+type Entry struct {
+	DB       int
+	Key      []byte
+	Type     Type
+	ExpireAt int64 // Unix milliseconds, 0 if the key does not expire
+
+	String  []byte
+	Members [][]byte
+	ZSet    []Member
+	Hash    []Field
+}
+
+const maxVersion = 12
+
+// Record and value type codes.
+const (
+	opFunction2    = 0xF5
+	opModuleAux    = 0xF7
+	opIdle         = 0xF8
+	opFreq         = 0xF9
+	opAux          = 0xFA
+	opResizeDB     = 0xFB
+	opExpireTimeMS = 0xFC
+	opExpireTime   = 0xFD
+	opSelectDB     = 0xFE
+	opEOF          = 0xFF
+
+	typeString         = 0
+	typeList           = 1
+	typeSet            = 2
+	typeZSet           = 3
+	typeHash           = 4
+	typeZSet2          = 5
+	typeHashZipmap     = 9
+	typeListZiplist    = 10
+	typeSetIntset      = 11
+	typeZSetZiplist    = 12
+	typeHashZiplist    = 13
+	typeListQuicklist  = 14
+	typeHashListpack   = 16
+	typeZSetListpack   = 17
+	typeListQuicklist2 = 18
+	typeSetListpack    = 20
+)
+
+var (
+	ErrNotRDB      = errors.New("rdb: not an RDB file")
+	ErrBadChecksum = errors.New("rdb: checksum mismatch")
+	errCorrupt     = errors.New("rdb: corrupt file")
+)
+
+// maxChunk bounds each allocation while reading a string, so a corrupt
+// length cannot allocate more than the file actually contains.
+const maxChunk = 1 << 20
+
+// Parse reads an RDB file from r and calls fn for every key. It stops at
+// the first error returned by fn.
+func Parse(r io.Reader, fn func(*Entry) error) error {
+	p := &parser{r: &checksumReader{r: bufio.NewReaderSize(r, 64*1024)}}
+	return p.parse(fn)
+}
+
+type parser struct {
+	r       *checksumReader
+	version int
+}
+
+// checksumReader keeps a running CRC-64 of every byte read through it.
+type checksumReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (c *checksumReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.crc = crc64Update(c.crc, b[:n])
+	return n, err
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc = crc64Update(c.crc, []byte{b})
+	}
+	return b, err
+}
+
+func (p *parser) parse(fn func(*Entry) error) error {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(p.r, header); err != nil || string(header[:5]) != "REDIS" {
+		return ErrNotRDB
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil {
+		return ErrNotRDB
+	}
+	if version < 1 || version > maxVersion {
+		return fmt.Errorf("rdb: unsupported version %d", version)
+	}
+	p.version = version
+
+	entry := &Entry{}
+	db := 0
+
+	for {
+		op, err := p.r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+
+		switch op {
+		case opEOF:
+			return p.checkTrailer()
+
+		case opSelectDB:
+			n, err := p.readLength()
+			if err != nil {
+				return err
+			}
+			db = int(n)
+
+		case opResizeDB:
+			if _, err := p.readLength(); err != nil {
+				return err
+			}
+			if _, err := p.readLength(); err != nil {
+				return err
+			}
+
+		case opAux:
+			if _, err := p.readString(); err != nil {
+				return err
+			}
+			if _, err := p.readString(); err != nil {
+				return err
+			}
+
+		case opExpireTime:
+			var buf [4]byte
+			if _, err := io.ReadFull(p.r, buf[:]); err != nil {
+				return unexpected(err)
+			}
+			entry.ExpireAt = int64(binary.LittleEndian.Uint32(buf[:])) * 1000
+
+		case opExpireTimeMS:
+			var buf [8]byte
+			if _, err := io.ReadFull(p.r, buf[:]); err != nil {
+				return unexpected(err)
+			}
+			entry.ExpireAt = int64(binary.LittleEndian.Uint64(buf[:]))
+
+		case opIdle:
+			if _, err := p.readLength(); err != nil {
+				return err
+			}
+
+		case opFreq:
+			if _, err := p.r.ReadByte(); err != nil {
+				return unexpected(err)
+			}
+
+		case opFunction2:
+			if _, err := p.readString(); err != nil {
+				return err
+			}
+
+		case opModuleAux:
+			return errors.New("rdb: module data is not supported")
+
+		default:
+			entry.DB = db
+			if err := p.readEntry(op, entry); err != nil {
+				return err
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+			entry = &Entry{}
+		}
+	}
+}
+
+func (p *parser) checkTrailer() error {
+	if p.version < 5 {
+		return nil
+	}
+
+	sum := p.r.crc
+	var trailer [8]byte
+	if _, err := io.ReadFull(p.r.r, trailer[:]); err != nil {
+		return unexpected(err)
+	}
+
+	// A zero checksum means checksumming was disabled by the writer.
+	if want := binary.LittleEndian.Uint64(trailer[:]); want != 0 && want != sum {
+		return ErrBadChecksum
+	}
+	return nil
+}
+
+func (p *parser) readEntry(valueType byte, entry *Entry) error {
+	key, err := p.readString()
+	if err != nil {
+		return err
+	}
+	entry.Key = key
+
+	switch valueType {
+	case typeString:
+		entry.Type = TypeString
+		entry.String, err = p.readString()
+
+	case typeList, typeSet:
+		entry.Type = TypeList
+		if valueType == typeSet {
+			entry.Type = TypeSet
+		}
+		entry.Members, err = p.readStringList()
+
+	case typeZSet, typeZSet2:
+		entry.Type = TypeZSet
+		entry.ZSet, err = p.readZSet(valueType == typeZSet2)
+
+	case typeHash:
+		entry.Type = TypeHash
+		var items [][]byte
+		if items, err = p.readStringPairs(); err == nil {
+			entry.Hash = toFields(items)
+		}
+
+	case typeHashZipmap:
+		entry.Type = TypeHash
+		var blob []byte
+		if blob, err = p.readString(); err == nil {
+			var items [][]byte
+			if items, err = parseZipmap(blob); err == nil {
+				entry.Hash = toFields(items)
+			}
+		}
+
+	case typeListZiplist, typeZSetZiplist, typeHashZiplist:
+		var blob []byte
+		if blob, err = p.readString(); err != nil {
+			return err
+		}
+		var items [][]byte
+		if items, err = parseZiplist(blob); err != nil {
+			return err
+		}
+		err = setItems(entry, valueType, items)
+
+	case typeHashListpack, typeZSetListpack, typeSetListpack:
+		var blob []byte
+		if blob, err = p.readString(); err != nil {
+			return err
+		}
+		var items [][]byte
+		if items, err = parseListpack(blob); err != nil {
+			return err
+		}
+		err = setItems(entry, valueType, items)
+
+	case typeSetIntset:
+		entry.Type = TypeSet
+		var blob []byte
+		if blob, err = p.readString(); err == nil {
+			entry.Members, err = parseIntset(blob)
+		}
+
+	case typeListQuicklist, typeListQuicklist2:
+		entry.Type = TypeList
+		entry.Members, err = p.readQuicklist(valueType == typeListQuicklist2)
+
+	default:
+		return fmt.Errorf("rdb: unsupported value type %d for key %q", valueType, key)
+	}
+
+	return err
+}
+
+// setItems stores the flat element list of a ziplist or listpack encoded
+// value according to its type.
+func setItems(entry *Entry, valueType byte, items [][]byte) error {
+	switch valueType {
+	case typeListZiplist:
+		entry.Type = TypeList
+		entry.Members = items
+	case typeSetListpack:
+		entry.Type = TypeSet
+		entry.Members = items
+	case typeHashZiplist, typeHashListpack:
+		if len(items)%2 != 0 {
+			return errCorrupt
+		}
+		entry.Type = TypeHash
+		entry.Hash = toFields(items)
+	case typeZSetZiplist, typeZSetListpack:
+		if len(items)%2 != 0 {
+			return errCorrupt
+		}
+		entry.Type = TypeZSet
+		entry.ZSet = make([]Member, 0, len(items)/2)
+		for i := 0; i < len(items); i += 2 {
+			score, err := strconv.ParseFloat(string(items[i+1]), 64)
+			if err != nil {
+				return errCorrupt
+			}
+			entry.ZSet = append(entry.ZSet, Member{Value: items[i], Score: score})
+		}
+	}
+	return nil
+}
+
+func toFields(items [][]byte) []Field {
+	fields := make([]Field, 0, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		fields = append(fields, Field{Name: items[i], Value: items[i+1]})
+	}
+	return fields
+}
+
+func (p *parser) readStringList() ([][]byte, error) {
+	n, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	items := make([][]byte, 0, min(n, 1024))
+	for i := uint64(0); i < n; i++ {
+		s, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+func (p *parser) readStringPairs() ([][]byte, error) {
+	n, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	items := make([][]byte, 0, min(2*n, 1024))
+	for i := uint64(0); i < 2*n; i++ {
+		s, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+func (p *parser) readZSet(binaryScores bool) ([]Member, error) {
+	n, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Member, 0, min(n, 1024))
+	for i := uint64(0); i < n; i++ {
+		value, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if binaryScores {
+			var buf [8]byte
+			if _, err := io.ReadFull(p.r, buf[:]); err != nil {
+				return nil, unexpected(err)
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(buf[:]))
+		} else if score, err = p.readDoubleString(); err != nil {
+			return nil, err
+		}
+		members = append(members, Member{Value: value, Score: score})
+	}
+	return members, nil
+}
+
+// readDoubleString reads the old textual score encoding: a length byte
+// with 253, 254 and 255 standing for NaN, +Inf and -Inf.
+func (p *parser) readDoubleString() (float64, error) {
+	n, err := p.r.ReadByte()
+	if err != nil {
+		return 0, unexpected(err)
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(p.r, buf); err != nil {
+		return 0, unexpected(err)
+	}
+	f, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil {
+		return 0, errCorrupt
+	}
+	return f, nil
+}
+
+func (p *parser) readQuicklist(v2 bool) ([][]byte, error) {
+	n, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var items [][]byte
+	for i := uint64(0); i < n; i++ {
+		container := uint64(2) // packed
+		if v2 {
+			if container, err = p.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case container == 1: // plain node holding a single element
+			items = append(items, blob)
+		case v2:
+			node, err := parseListpack(blob)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, node...)
+		default:
+			node, err := parseZiplist(blob)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, node...)
+		}
+	}
+	return items, nil
+}
+
+// readLength reads a length-encoded integer. Special string encodings
+// are rejected; readString handles those.
+func (p *parser) readLength() (uint64, error) {
+	n, special, err := p.readLengthOrEncoding()
+	if err != nil {
+		return 0, err
+	}
+	if special {
+		return 0, errCorrupt
+	}
+	return n, nil
+}
+
+// readLengthOrEncoding reads a length, or reports special=true with the
+// encoding type in n for the 11xxxxxx forms.
+func (p *parser) readLengthOrEncoding() (n uint64, special bool, err error) {
+	b, err := p.r.ReadByte()
+	if err != nil {
+		return 0, false, unexpected(err)
+	}
+
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := p.r.ReadByte()
+		if err != nil {
+			return 0, false, unexpected(err)
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case 3:
+		return uint64(b & 0x3f), true, nil
+	}
+
+	switch b {
+	case 0x80:
+		var buf [4]byte
+		if _, err := io.ReadFull(p.r, buf[:]); err != nil {
+			return 0, false, unexpected(err)
+		}
+		return uint64(binary.BigEndian.Uint32(buf[:])), false, nil
+	case 0x81:
+		var buf [8]byte
+		if _, err := io.ReadFull(p.r, buf[:]); err != nil {
+			return 0, false, unexpected(err)
+		}
+		return binary.BigEndian.Uint64(buf[:]), false, nil
+	}
+	return 0, false, errCorrupt
+}
+
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+func (p *parser) readString() ([]byte, error) {
+	n, special, err := p.readLengthOrEncoding()
+	if err != nil {
+		return nil, err
+	}
+
+	if !special {
+		return p.readBytes(n)
+	}
+
+	switch n {
+	case encInt8:
+		b, err := p.r.ReadByte()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		return strconv.AppendInt(nil, int64(int8(b)), 10), nil
+	case encInt16:
+		var buf [2]byte
+		if _, err := io.ReadFull(p.r, buf[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(buf[:]))), 10), nil
+	case encInt32:
+		var buf [4]byte
+		if _, err := io.ReadFull(p.r, buf[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(buf[:]))), 10), nil
+	case encLZF:
+		clen, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := p.readBytes(clen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, ulen)
+	}
+	return nil, errCorrupt
+}
+
+func (p *parser) readBytes(n uint64) ([]byte, error) {
+	buf := make([]byte, 0, min(n, maxChunk))
+	for uint64(len(buf)) < n {
+		chunk := min(n-uint64(len(buf)), maxChunk)
+		start := len(buf)
+		buf = append(buf, make([]byte, chunk)...)
+		if _, err := io.ReadFull(p.r, buf[start:]); err != nil {
+			return nil, unexpected(err)
+		}
+	}
+	return buf, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
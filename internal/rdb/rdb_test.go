@@ -0,0 +1,257 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+)
+
+func TestCRC64(t *testing.T) {
+	// Check value from the Redis source.
+	if sum := crc64Update(0, []byte("123456789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("crc64 = %#x, want 0xe9c6d914c4b8d9ca", sum)
+	}
+}
+
+// rdbWriter builds RDB files for tests.
+type rdbWriter struct {
+	bytes.Buffer
+}
+
+func (w *rdbWriter) length(n int) {
+	switch {
+	case n < 1<<6:
+		w.WriteByte(byte(n))
+	case n < 1<<14:
+		w.WriteByte(byte(n>>8) | 0x40)
+		w.WriteByte(byte(n))
+	default:
+		w.WriteByte(0x80)
+		w.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func (w *rdbWriter) str(s string) {
+	w.length(len(s))
+	w.WriteString(s)
+}
+
+func (w *rdbWriter) finish() []byte {
+	w.WriteByte(opEOF)
+	sum := crc64Update(0, w.Bytes())
+	w.Write(binary.LittleEndian.AppendUint64(nil, sum))
+	return w.Bytes()
+}
+
+func listpack(items ...interface{}) string {
+	var body []byte
+	for _, item := range items {
+		start := len(body)
+		switch v := item.(type) {
+		case string:
+			body = append(body, 0x80|byte(len(v)))
+			body = append(body, v...)
+		case int:
+			body = append(body, byte(v)) // 7-bit unsigned integer
+		}
+		body = append(body, byte(len(body)-start))
+	}
+	body = append(body, 0xff)
+
+	header := binary.LittleEndian.AppendUint32(nil, uint32(6+len(body)))
+	header = binary.LittleEndian.AppendUint16(header, uint16(len(items)))
+	return string(append(header, body...))
+}
+
+func ziplist(items ...interface{}) string {
+	var body []byte
+	for _, item := range items {
+		body = append(body, 0) // previous entry length, unused by the reader
+		switch v := item.(type) {
+		case string:
+			body = append(body, byte(len(v)))
+			body = append(body, v...)
+		case int:
+			body = append(body, 0xc0)
+			body = binary.LittleEndian.AppendUint16(body, uint16(v))
+		}
+	}
+	body = append(body, 0xff)
+
+	header := binary.LittleEndian.AppendUint32(nil, uint32(10+len(body)))
+	header = binary.LittleEndian.AppendUint32(header, 0)
+	header = binary.LittleEndian.AppendUint16(header, uint16(len(items)))
+	return string(append(header, body...))
+}
+
+func buildTestRDB(expireAt int64) []byte {
+	w := &rdbWriter{}
+	w.WriteString("REDIS0011")
+	w.WriteByte(opAux)
+	w.str("redis-ver")
+	w.str("7.2.0")
+	w.WriteByte(opSelectDB)
+	w.length(0)
+	w.WriteByte(opResizeDB)
+	w.length(8)
+	w.length(1)
+
+	w.WriteByte(typeString)
+	w.str("plain")
+	w.str("hello")
+
+	w.WriteByte(opExpireTimeMS)
+	w.Write(binary.LittleEndian.AppendUint64(nil, uint64(expireAt)))
+	w.WriteByte(typeString)
+	w.str("expiring")
+	w.str("soon")
+
+	// Integer-encoded string value.
+	w.WriteByte(typeString)
+	w.str("int")
+	w.WriteByte(0xc1)
+	w.Write(binary.LittleEndian.AppendUint16(nil, uint16(0xfffe)))
+
+	// LZF: literal "a" then a back reference repeating it 9 times.
+	w.WriteByte(typeString)
+	w.str("lzf")
+	w.WriteByte(0xc3)
+	w.length(5)
+	w.length(10)
+	w.Write([]byte{0x00, 'a', 0xe0, 0x00, 0x00})
+
+	w.WriteByte(typeHashListpack)
+	w.str("hash")
+	w.str(listpack("f1", "v1", "f2", 5))
+
+	w.WriteByte(typeSetIntset)
+	w.str("set")
+	intset := binary.LittleEndian.AppendUint32(nil, 2)
+	intset = binary.LittleEndian.AppendUint32(intset, 2)
+	intset = binary.LittleEndian.AppendUint16(intset, 1)
+	intset = binary.LittleEndian.AppendUint16(intset, uint16(0xffff))
+	w.str(string(intset))
+
+	w.WriteByte(typeZSetZiplist)
+	w.str("zset")
+	w.str(ziplist("m1", "1.5", "m2", 300))
+
+	w.WriteByte(typeListQuicklist2)
+	w.str("list")
+	w.length(2)
+	w.length(2) // packed node
+	w.str(listpack("x", "y"))
+	w.length(1) // plain node
+	w.str("z")
+
+	w.WriteByte(typeZSet2)
+	w.str("zset2")
+	w.length(1)
+	w.str("inf")
+	w.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(math.Inf(1))))
+
+	return w.finish()
+}
+
+func TestParse(t *testing.T) {
+	expireAt := time.Now().Add(time.Hour).UnixMilli()
+	data := buildTestRDB(expireAt)
+
+	entries := make(map[string]*Entry)
+	err := Parse(bytes.NewReader(data), func(e *Entry) error {
+		entries[string(e.Key)] = e
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	checkString := func(key, want string) {
+		t.Helper()
+		e := entries[key]
+		if e == nil || e.Type != TypeString || string(e.String) != want {
+			t.Fatalf("%s: got %+v, want string %q", key, e, want)
+		}
+	}
+	checkString("plain", "hello")
+	checkString("expiring", "soon")
+	checkString("int", "-2")
+	checkString("lzf", "aaaaaaaaaa")
+
+	if entries["expiring"].ExpireAt != expireAt || entries["plain"].ExpireAt != 0 {
+		t.Fatal("Expiry not attached to the right key")
+	}
+
+	hash := entries["hash"]
+	if hash.Type != TypeHash || len(hash.Hash) != 2 || string(hash.Hash[1].Name) != "f2" || string(hash.Hash[1].Value) != "5" {
+		t.Fatalf("Unexpected hash: %+v", hash)
+	}
+
+	set := entries["set"]
+	if set.Type != TypeSet || len(set.Members) != 2 || string(set.Members[1]) != "-1" {
+		t.Fatalf("Unexpected set: %+v", set)
+	}
+
+	zset := entries["zset"]
+	if zset.Type != TypeZSet || len(zset.ZSet) != 2 || zset.ZSet[0].Score != 1.5 || zset.ZSet[1].Score != 300 {
+		t.Fatalf("Unexpected zset: %+v", zset)
+	}
+
+	list := entries["list"]
+	if list.Type != TypeList || len(list.Members) != 3 || string(list.Members[2]) != "z" {
+		t.Fatalf("Unexpected list: %+v", list)
+	}
+
+	if z := entries["zset2"]; z.Type != TypeZSet || !math.IsInf(z.ZSet[0].Score, 1) {
+		t.Fatalf("Unexpected zset2: %+v", z)
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	data := buildTestRDB(0)
+	data[20] ^= 0xff
+
+	err := Parse(bytes.NewReader(data), func(*Entry) error { return nil })
+	if err == nil {
+		t.Fatal("Corrupted file parsed without error")
+	}
+
+	// Truncation anywhere must be an error, never a panic.
+	data = buildTestRDB(0)
+	for i := 0; i < len(data); i++ {
+		if err := Parse(bytes.NewReader(data[:i]), func(*Entry) error { return nil }); err == nil {
+			t.Fatalf("Truncated file of %d bytes parsed without error", i)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	c := cache.New(4, 0)
+
+	stats, err := Load(bytes.NewReader(buildTestRDB(time.Now().Add(-time.Minute).UnixMilli())), c, nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if stats.Loaded != 3 || stats.Expired != 1 {
+		t.Fatalf("Expected 3 loaded and 1 expired, got %+v", stats)
+	}
+	if stats.Skipped[TypeHash] != 1 || stats.Skipped[TypeZSet] != 2 {
+		t.Fatalf("Unexpected skipped counts: %v", stats.Skipped)
+	}
+	if entry, found := c.Load([]byte("lzf")); !found || string(entry.Value()) != "aaaaaaaaaa" {
+		t.Fatal("String key not loaded")
+	}
+}
+
+func TestNotRDB(t *testing.T) {
+	err := Parse(bytes.NewReader([]byte("hello world")), func(*Entry) error { return nil })
+	if !errors.Is(err, ErrNotRDB) {
+		t.Fatalf("Expected ErrNotRDB, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// idleConn closes a connection once nothing has been read from or
+// written to it for timeout, so that in the pool model a client that
+// stays connected without sending requests gives its worker back.
+type idleConn struct {
+	net.Conn
+	timeout    time.Duration
+	lastActive atomic.Int64
+	timer      *time.Timer
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) *idleConn {
+	c := &idleConn{Conn: conn, timeout: timeout}
+	c.lastActive.Store(time.Now().UnixNano())
+	c.timer = time.AfterFunc(timeout, c.check)
+	return c
+}
+
+// check closes the connection if it has been idle for the timeout, and
+// otherwise checks again when it would have been.
+func (c *idleConn) check() {
+	idle := time.Since(time.Unix(0, c.lastActive.Load()))
+	if idle >= c.timeout {
+		c.Conn.Close()
+		return
+	}
+	c.timer.Reset(c.timeout - idle)
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// Unwrap returns the connection beneath, for handlers that need to know
+// whether it is a TLS connection.
+func (c *idleConn) Unwrap() net.Conn {
+	return c.Conn
+}
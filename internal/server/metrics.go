@@ -0,0 +1,84 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+	
+	"github.com/grumpylabs/gopogo/internal/metrics"
+)
+
+// startMetrics pushes a metrics sample every Metrics.Interval until the
+// server stops.
+func (s *Server) startMetrics() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.config.Metrics.Close()
+		
+		ticker := time.NewTicker(s.config.Metrics.Interval)
+		defer ticker.Stop()
+		
+		var prev metrics.Sample
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				sample := s.metricsSample(prev)
+				if err := s.config.Metrics.Push(sample); err != nil {
+					slog.Warn("metrics push failed", "err", err)
+				}
+				prev = sample
+			}
+		}
+	}()
+}
+
+// metricsSample reads the cache and connection metrics. The hit rate is
+// that of the lookups since prev was taken.
+func (s *Server) metricsSample(prev metrics.Sample) metrics.Sample {
+	stats := s.cache.Stats()
+	sample := metrics.Sample{
+		Gauges: map[string]float64{
+			"keys":              float64(stats.Items),
+			"memory.used_bytes": float64(stats.MemUsed),
+			"memory.max_bytes":  float64(stats.MaxMemory),
+			"connections":       0,
+			"evictions_per_sec": float64(stats.EvictionsPerSec),
+			"eviction.busy":     stats.EvictionBusy,
+			"uptime_seconds":    time.Since(s.protoConfig.Started).Seconds(),
+		},
+		Counters: map[string]int64{
+			"commands": int64(stats.Ops),
+			"hits":     int64(stats.Hits),
+			"misses":   int64(stats.Misses),
+			"evicted":  int64(stats.Evicted),
+			"expired":  int64(stats.Expired),
+		},
+	}
+	
+	for proto, traffic := range s.protoConfig.Traffic.Stats() {
+		sample.Counters["commands."+proto] = int64(traffic.Commands)
+		sample.Counters["bytes_in."+proto] = int64(traffic.BytesIn)
+		sample.Counters["bytes_out."+proto] = int64(traffic.BytesOut)
+	}
+	
+	for proto, kinds := range s.protoConfig.Errors.Stats() {
+		for kind, n := range kinds {
+			sample.Counters["errors."+proto+"."+kind] = int64(n)
+		}
+	}
+	
+	for _, client := range s.clients.List() {
+		sample.Gauges["connections"]++
+		sample.Gauges["connections."+client.Protocol]++
+	}
+	sample.Counters["connections.rejected"] = int64(s.rejected.Load())
+	
+	hits := sample.Counters["hits"] - prev.Counters["hits"]
+	lookups := hits + sample.Counters["misses"] - prev.Counters["misses"]
+	if lookups > 0 {
+		sample.Gauges["hit_rate"] = float64(hits) / float64(lookups)
+	}
+	return sample
+}
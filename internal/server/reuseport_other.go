@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -4,27 +4,70 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
+	
+	"github.com/grumpylabs/gopogo/internal/admin"
 	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/clients"
+	"github.com/grumpylabs/gopogo/internal/health"
+	"github.com/grumpylabs/gopogo/internal/metrics"
+	"github.com/grumpylabs/gopogo/internal/origin"
+	"github.com/grumpylabs/gopogo/internal/persistence"
 	"github.com/grumpylabs/gopogo/internal/protocol"
+	"github.com/grumpylabs/gopogo/internal/proxyproto"
+	"github.com/grumpylabs/gopogo/internal/ratelimit"
+	"github.com/grumpylabs/gopogo/internal/systemd"
 )
 
 type Config struct {
-	Host          string
-	Port          int
-	Socket        string
-	Auth          string
-	Threads       int
-	TLSPort       int
-	TLSCert       string
-	TLSKey        string
+	Host         string
+	Port         int
+	Socket       string
+	Binds        []string
+	RedisPort    int
+	MemcachePort int
+	// MemcacheUDPPort, if set, also serves memcached commands over UDP.
+	MemcacheUDPPort int
+	// DNSPort, if set, answers DNS queries over UDP and TCP from the
+	// dns:<name>:<type> keys.
+	DNSPort      int
+	DNSTTL       time.Duration
+	HTTPPort     int
+	PostgresPort int
+	SocketPerm   os.FileMode
+	SocketOwner  string
+	Auth         []string
+	Threads      int
+	TLSPort      int
+	TLSCert      string
+	TLSKey       string
+	// TLSKeyPassphrase decrypts TLSKey if it is an encrypted PEM key.
+	TLSKeyPassphrase string
+	// TLSMinVersion, TLSCipherSuites and TLSCurves restrict what TLS
+	// clients may negotiate; zero values leave Go's defaults.
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+	TLSCurves       []tls.CurveID
+	// ProtocolTLS maps a protocol name ("redis", "http", "memcache",
+	// "postgres", or "all" for the rest) to TLSOptional (the default),
+	// TLSRequired or TLSDisabled. TLSExempt lists the client addresses
+	// and CIDR ranges, and "unix" for Unix socket clients, that may use
+	// plaintext for protocols requiring TLS.
+	ProtocolTLS map[string]string
+	TLSExempt   []string
+	// Protocols names the protocols added with protocol.Register to
+	// serve alongside the built-in ones.
+	Protocols     []string
 	HTTP          bool
 	Memcache      bool
 	Postgres      bool
@@ -34,44 +77,202 @@ type Config struct {
 	Cache         *cache.Cache
 	AutoSweep     bool
 	SweepInterval time.Duration
+
+	MaxBulkLen      int64
+	MaxMultiBulkLen int64
+	RateLimits      ratelimit.Limits
+	ReusePort       bool
+	ConnModel       string
+	PoolSize        int
+	// PoolIdleTimeout disconnects clients of the pool model that send
+	// and receive nothing for this long, so that they free their worker.
+	// HTTP clients have their own idle timeout.
+	PoolIdleTimeout time.Duration
+	Admin           bool
+	AdminPort       int
+	SentinelMaster  string
+	EnableDebug     bool
+	Namespaces      map[string]string
+	// HandshakeTimeout bounds the time a client has to complete a TLS
+	// handshake and identify its protocol before it is disconnected.
+	HandshakeTimeout time.Duration
+	// HTTPHeaderTimeout bounds the time an HTTP client has to send its
+	// request headers.
+	HTTPHeaderTimeout time.Duration
+	// WSAllowedOrigins lists the origins of other sites whose pages may
+	// open WebSockets; "*" allows any.
+	WSAllowedOrigins []string
+	// TrustedProxies lists the addresses and CIDR ranges of load
+	// balancers whose connections start with a PROXY protocol header.
+	TrustedProxies []string
+	// Origin, if set, is the backing store that GET misses are read
+	// through from, caching what it returns for OriginTTL.
+	Origin    origin.Origin
+	OriginTTL time.Duration
+	// WriteBehind, if set, is fed every store and delete from Start on,
+	// so data loaded at startup is not written back, and is flushed when
+	// the server stops.
+	WriteBehind *origin.WriteBehind
+	// Snapshots, if set, uploads a snapshot every SnapshotInterval (0 =
+	// only at shutdown) and when the server stops.
+	Snapshots        *persistence.Snapshotter
+	SnapshotInterval time.Duration
+	// Metrics, if set, is sent a sample of the cache and connection
+	// metrics every Metrics.Interval.
+	Metrics *metrics.Pusher
+	// Version and Commit identify the build in INFO, memcached stats
+	// and the stats endpoints.
+	Version string
+	Commit  string
 }
 
+const (
+	// ConnModelGoroutine serves every connection on its own goroutine.
+	ConnModelGoroutine = "goroutine"
+	// ConnModelPool serves connections on a fixed pool of workers.
+	ConnModelPool = "pool"
+	
+	defaultPoolSizePerThread = 256
+	
+	alpnHTTP2    = "h2"
+	alpnHTTP     = "http/1.1"
+	alpnPostgres = "postgresql"
+	
+	// writeBehindFlushTimeout bounds how long Stop waits for queued
+	// changes to reach the backing store.
+	writeBehindFlushTimeout = 30 * time.Second
+	// snapshotTimeout bounds the final snapshot Stop takes.
+	snapshotTimeout = 10 * time.Minute
+)
+
 type Server struct {
 	config    *Config
 	cache     *cache.Cache
 	listeners []net.Listener
-	wg        sync.WaitGroup
-	ctx       context.Context
-	cancel    context.CancelFunc
-	
-	redisHandler    *protocol.RedisHandler
-	httpHandler     *protocol.HTTPHandler
-	memcacheHandler *protocol.MemcacheHandler
-	postgresHandler *protocol.PostgresHandler
+	serving   []atomic.Bool
+	// packetConns are the UDP sockets of the protocols served over UDP.
+	packetConns []packetConn
+	stopping    atomic.Bool
+	stopOnce    sync.Once
+	stopped     chan struct{}
+	wg          sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+	conns       chan acceptedConn
+	// rejected counts the connections closed because the pool was full.
+	rejected atomic.Uint64
+	clients  *clients.Registry
+	proxies  []*net.IPNet
+	certs    *certReloader
+
+	tlsExempt     []*net.IPNet
+	tlsExemptUnix bool
+
+	adminHandler *admin.Handler
+	adminServer  *http.Server
+	protoConfig  *protocol.Config
+	// handlers holds the enabled protocols' handlers, and alpn maps the
+	// ALPN protocol IDs they accept on the TLS listener to them.
+	handlers map[protocol.Type]protocol.Handler
+	alpn     map[string]protocol.Type
+	// detectable lists the enabled protocols that connections on the
+	// shared ports are detected as.
+	detectable []protocol.Type
 }
 
 func New(config *Config) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
 	
 	s := &Server{
-		config: config,
-		cache:  config.Cache,
-		ctx:    ctx,
-		cancel: cancel,
+		config:  config,
+		cache:   config.Cache,
+		ctx:     ctx,
+		cancel:  cancel,
+		clients: clients.NewRegistry(),
+		stopped: make(chan struct{}),
+	}
+	
+	// INFO reports the port Redis clients are most likely to use.
+	redisPort := config.RedisPort
+	if redisPort == 0 {
+		redisPort = config.Port
+	}
+	s.protoConfig = &protocol.Config{
+		Auth:            config.Auth,
+		MaxBulkLen:      config.MaxBulkLen,
+		MaxMultiBulkLen: config.MaxMultiBulkLen,
+		Limits:          ratelimit.NewRegistry(config.RateLimits),
+		SentinelMaster:  config.SentinelMaster,
+		Traffic:         protocol.NewTraffic(),
+		Commands:        protocol.NewCommandStats(),
+		Errors:          protocol.NewErrorStats(),
+		Version:         config.Version,
+		Commit:          config.Commit,
+		Started:         time.Now(),
+		Host:            config.Host,
+		Port:            redisPort,
+		Snapshots:       config.Snapshots,
+		EnableDebug:     config.EnableDebug,
+		Namespaces:      config.Namespaces,
+		Health:          s.Health,
+		Clients:         s.clients,
+		Origin:          config.Origin,
+		OriginTTL:       config.OriginTTL,
+		WriteBehind:     config.WriteBehind,
+		
+		HandshakeTimeout:  config.HandshakeTimeout,
+		HTTPHeaderTimeout: config.HTTPHeaderTimeout,
+		WSAllowedOrigins:  config.WSAllowedOrigins,
+		DNSTTL:            config.DNSTTL,
 	}
 	
+	if config.Admin || config.AdminPort > 0 {
+		s.adminHandler = admin.NewHandler(&admin.Config{
+			Cache:   config.Cache,
+			Clients: s.clients,
+			Auth:    config.Auth,
+			Health:  s.Health,
+		})
+	}
+	if config.Admin {
+		s.protoConfig.Admin = s.adminHandler
+	}
+	
+	s.handlers = make(map[protocol.Type]protocol.Handler)
+	s.alpn = make(map[string]protocol.Type)
 	if config.Redis {
-		s.redisHandler = protocol.NewRedisHandler(config.Cache, config.Auth)
+		s.handlers[protocol.TypeRedis] = protocol.NewRedisHandler(config.Cache, s.protoConfig)
 	}
 	if config.HTTP {
-		s.httpHandler = protocol.NewHTTPHandler(config.Cache, config.Auth)
+		s.handlers[protocol.TypeHTTP] = protocol.NewHTTPHandler(config.Cache, s.protoConfig)
+		s.alpn[alpnHTTP2] = protocol.TypeHTTP
+		s.alpn[alpnHTTP] = protocol.TypeHTTP
 	}
 	if config.Memcache {
-		s.memcacheHandler = protocol.NewMemcacheHandler(config.Cache)
+		s.handlers[protocol.TypeMemcache] = protocol.NewMemcacheHandler(config.Cache, s.protoConfig)
 	}
 	if config.Postgres {
-		s.postgresHandler = protocol.NewPostgresHandler(config.Cache, config.Auth)
+		s.handlers[protocol.TypePostgres] = protocol.NewPostgresHandler(config.Cache, s.protoConfig)
+		s.alpn[alpnPostgres] = protocol.TypePostgres
+	}
+	if config.DNSPort > 0 {
+		s.handlers[protocol.TypeDNS] = protocol.NewDNSHandler(config.Cache, s.protoConfig)
 	}
+	for _, name := range config.Protocols {
+		if p, ok := protocol.Lookup(name); ok {
+			s.handlers[p.Type()] = p.New(config.Cache, s.protoConfig)
+			for _, id := range p.ALPN {
+				s.alpn[id] = p.Type()
+			}
+		}
+	}
+	for proto := range s.handlers {
+		// DNS is served on its own port only.
+		if proto != protocol.TypeDNS {
+			s.detectable = append(s.detectable, proto)
+		}
+	}
+	slices.Sort(s.detectable)
 	
 	return s
 }
@@ -81,9 +282,38 @@ func (s *Server) Start() error {
 		return err
 	}
 	
-	if s.config.AutoSweep {
+	// The sweeper runs even with AutoSweep off so that DEBUG
+	// SET-ACTIVE-EXPIRE can turn it on.
+	s.cache.SetActiveExpire(s.config.AutoSweep)
+	if s.config.SweepInterval > 0 {
 		s.startSweeper()
 	}
+	if s.config.Snapshots != nil && s.config.SnapshotInterval > 0 {
+		s.startSnapshots()
+	}
+	if s.config.WriteBehind != nil {
+		s.cache.AddHooks(s.config.WriteBehind.Hooks())
+	}
+	if s.config.Snapshots != nil && s.config.Snapshots.FullEvery > 1 {
+		s.config.Snapshots.TrackChanges()
+	}
+	
+	if s.certs != nil {
+		s.startCertReloader()
+	}
+	if s.config.Metrics != nil {
+		s.startMetrics()
+	}
+	
+	if s.config.ConnModel == ConnModelPool {
+		s.startWorkers()
+	}
+	
+	if s.config.AdminPort > 0 {
+		if err := s.startAdmin(); err != nil {
+			return err
+		}
+	}
 	
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -91,78 +321,243 @@ func (s *Server) Start() error {
 	go func() {
 		<-sigCh
 		if !s.config.Quiet {
-			fmt.Println("\nShutting down server...")
+			slog.Info("shutting down")
 		}
 		s.Stop()
 	}()
 	
-	for _, listener := range s.listeners {
+	for i, listener := range s.listeners {
+		s.wg.Add(1)
+		go s.serve(listener, &s.serving[i])
+	}
+	for _, pc := range s.packetConns {
 		s.wg.Add(1)
-		go s.serve(listener)
+		go s.serveUDP(pc)
+	}
+	
+	if _, err := systemd.Notify("READY=1"); err != nil && s.config.Verbose {
+		slog.Warn("systemd notify failed", "err", err)
+	}
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		s.startWatchdog(interval)
 	}
 	
 	s.wg.Wait()
+	
+	// Stop may still be flushing state that must outlive the listeners.
+	<-s.stopped
 	return nil
 }
 
 func (s *Server) Stop() {
+	if !s.stopping.Swap(true) {
+		systemd.Notify("STOPPING=1")
+	}
 	s.cancel()
 	
 	for _, listener := range s.listeners {
 		listener.Close()
 	}
+	for _, pc := range s.packetConns {
+		pc.Close()
+	}
+	
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
 	
 	s.wg.Wait()
+	
+	s.stopOnce.Do(func() {
+		defer close(s.stopped)
+		s.flushWriteBehind()
+		if s.config.Snapshots != nil {
+			s.snapshot(context.Background(), snapshotTimeout)
+		}
+	})
+}
+
+func (s *Server) flushWriteBehind() {
+	if s.config.WriteBehind == nil {
+		return
+	}
+	
+	ctx, cancel := context.WithTimeout(context.Background(), writeBehindFlushTimeout)
+	defer cancel()
+	if err := s.config.WriteBehind.Close(ctx); err != nil {
+		slog.Error("write-behind changes not written", "pending", s.config.WriteBehind.Stats().Pending, "err", err)
+	}
+}
+
+// Health reports the state served on /healthz and /readyz. The server is
+// ready once every listener is accepting connections, until Stop.
+func (s *Server) Health() *health.Status {
+	status := &health.Status{
+		Live: !s.stopping.Load(),
+		Replication: health.Replication{
+			Role: "master",
+		},
+	}
+	
+	for i, listener := range s.listeners {
+		status.Listeners = append(status.Listeners, health.Listener{
+			Addr: listener.Addr().String(),
+			Open: i < len(s.serving) && s.serving[i].Load(),
+		})
+	}
+	
+	status.Memory.Used = s.cache.MemUsed()
+	status.Memory.Max = s.cache.MaxMemory()
+	if status.Memory.Max > 0 {
+		status.Memory.Pressure = float64(status.Memory.Used) / float64(status.Memory.Max)
+	}
+	
+	switch {
+	case !status.Live:
+		status.Reason = "shutting down"
+	case len(status.Listeners) == 0:
+		status.Reason = "not listening"
+	default:
+		status.Ready = true
+		for _, listener := range status.Listeners {
+			if !listener.Open {
+				status.Ready = false
+				status.Reason = "listener " + listener.Addr + " is not accepting connections"
+				break
+			}
+		}
+	}
+	
+	return status
+}
+
+// startAdmin serves the admin dashboard on its own port.
+func (s *Server) startAdmin() error {
+	addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.AdminPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin %s: %w", addr, err)
+	}
+	
+	s.adminServer = &http.Server{
+		Handler:           s.adminHandler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	
+	go s.adminServer.Serve(listener)
+	
+	if !s.config.Quiet {
+		slog.Info("admin dashboard", "url", "http://"+addr+"/admin/")
+	}
+	
+	return nil
 }
 
 func (s *Server) setupListeners() error {
-	if s.config.Socket != "" {
-		listener, err := net.Listen("unix", s.config.Socket)
+	proxies, err := proxyproto.ParseTrusted(s.config.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("proxy-protocol: %w", err)
+	}
+	s.proxies = proxies
+	for _, name := range s.config.Protocols {
+		if _, ok := protocol.Lookup(name); !ok {
+			return fmt.Errorf("protocols: %q is not a registered protocol", name)
+		}
+	}
+	if err := s.setupTLSPolicy(); err != nil {
+		return err
+	}
+	
+	var tlsConfig *tls.Config
+	if s.config.TLSCert != "" && s.config.TLSKey != "" {
+		s.certs, err = newCertReloader(s.config.TLSCert, s.config.TLSKey, s.config.TLSKeyPassphrase)
 		if err != nil {
-			return fmt.Errorf("failed to listen on unix socket %s: %w", s.config.Socket, err)
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
 		}
-		s.listeners = append(s.listeners, listener)
 		
-		if !s.config.Quiet {
-			fmt.Printf("Listening on unix socket: %s\n", s.config.Socket)
+		tlsConfig = &tls.Config{
+			GetCertificate:   s.certs.GetCertificate,
+			NextProtos:       s.alpnProtocols(),
+			MinVersion:       s.config.TLSMinVersion,
+			CipherSuites:     s.config.TLSCipherSuites,
+			CurvePreferences: s.config.TLSCurves,
 		}
+		
+		// Postgres clients on the plain listeners may upgrade via
+		// SSLRequest whenever a certificate is configured.
+		s.protoConfig.TLS = tlsConfig
 	}
 	
-	if s.config.Port > 0 {
-		addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
-		listener, err := net.Listen("tcp", addr)
+	if err := s.listenUDP(); err != nil {
+		return err
+	}
+	
+	activated, err := systemd.Listeners()
+	if err != nil {
+		return fmt.Errorf("failed to use socket activation: %w", err)
+	}
+	if len(activated) > 0 {
+		return s.useActivatedListeners(activated, tlsConfig)
+	}
+	
+	if s.config.Socket != "" {
+		listener, err := s.listenUnix(s.config.Socket)
 		if err != nil {
-			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			return fmt.Errorf("failed to listen on unix socket %s: %w", s.config.Socket, err)
 		}
 		s.listeners = append(s.listeners, listener)
 		
 		if !s.config.Quiet {
-			fmt.Printf("Listening on: %s\n", addr)
+			slog.Info("listening", "socket", s.config.Socket)
 		}
 	}
 	
-	if s.config.TLSPort > 0 && s.config.TLSCert != "" && s.config.TLSKey != "" {
-		cert, err := tls.LoadX509KeyPair(s.config.TLSCert, s.config.TLSKey)
-		if err != nil {
-			return fmt.Errorf("failed to load TLS certificate: %w", err)
+	for _, host := range s.bindHosts() {
+		if s.config.Port > 0 {
+			addr := net.JoinHostPort(host, strconv.Itoa(s.config.Port))
+			listeners, err := s.listenTCP(addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			}
+			s.listeners = append(s.listeners, listeners...)
+			
+			if !s.config.Quiet {
+				slog.Info("listening", s.listenAttrs(addr, len(listeners))...)
+			}
 		}
 		
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
+		for _, pp := range s.protocolPorts() {
+			addr := net.JoinHostPort(host, strconv.Itoa(pp.port))
+			listeners, err := s.listenTCP(addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen for %s on %s: %w", pp.proto, addr, err)
+			}
+			for _, listener := range listeners {
+				s.listeners = append(s.listeners, &protocolListener{Listener: listener, proto: pp.proto})
+			}
+			
+			if !s.config.Quiet {
+				slog.Info("listening", append(s.listenAttrs(addr, len(listeners)), "protocol", pp.proto.String())...)
+			}
 		}
 		
-		addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.TLSPort)
-		listener, err := tls.Listen("tcp", addr, tlsConfig)
-		if err != nil {
-			return fmt.Errorf("failed to listen on TLS %s: %w", addr, err)
-		}
-		s.listeners = append(s.listeners, listener)
-		
-		if !s.config.Quiet {
-			fmt.Printf("TLS listening on: %s\n", addr)
+		if tlsConfig != nil && s.config.TLSPort > 0 {
+			addr := net.JoinHostPort(host, strconv.Itoa(s.config.TLSPort))
+			listeners, err := s.listenTCP(addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen on TLS %s: %w", addr, err)
+			}
+			for _, listener := range listeners {
+				s.listeners = append(s.listeners, tls.NewListener(listener, tlsConfig))
+			}
+			
+			if !s.config.Quiet {
+				slog.Info("listening", append(s.listenAttrs(addr, len(listeners)), "tls", true)...)
+			}
 		}
 	}
 	
+	s.serving = make([]atomic.Bool, len(s.listeners))
 	if len(s.listeners) == 0 {
 		return fmt.Errorf("no listeners configured")
 	}
@@ -170,9 +565,185 @@ func (s *Server) setupListeners() error {
 	return nil
 }
 
-func (s *Server) serve(listener net.Listener) {
+// protocolListener is a listener on a port dedicated to one protocol, so
+// its connections skip detection.
+type protocolListener struct {
+	net.Listener
+	proto protocol.Type
+}
+
+type protocolPort struct {
+	proto protocol.Type
+	port  int
+}
+
+// protocolPorts lists the configured per-protocol ports.
+func (s *Server) protocolPorts() []protocolPort {
+	var ports []protocolPort
+	for _, pp := range []protocolPort{
+		{protocol.TypeRedis, s.config.RedisPort},
+		{protocol.TypeMemcache, s.config.MemcachePort},
+		{protocol.TypeHTTP, s.config.HTTPPort},
+		{protocol.TypePostgres, s.config.PostgresPort},
+		{protocol.TypeDNS, s.config.DNSPort},
+	} {
+		if pp.port > 0 {
+			ports = append(ports, pp)
+		}
+	}
+	return ports
+}
+
+// bindHosts returns the addresses to listen on: the Bind list, or Host.
+func (s *Server) bindHosts() []string {
+	if len(s.config.Binds) > 0 {
+		return s.config.Binds
+	}
+	return []string{s.config.Host}
+}
+
+// useActivatedListeners serves the sockets passed by systemd in place of
+// the configured ports. Sockets whose FileDescriptorName= is "tls" speak
+// TLS and need a certificate.
+func (s *Server) useActivatedListeners(activated []systemd.Listener, tlsConfig *tls.Config) error {
+	for _, listener := range activated {
+		if listener.Name == "tls" {
+			if tlsConfig == nil {
+				return fmt.Errorf("socket %s is named tls but no certificate is configured", listener.Addr())
+			}
+			s.listeners = append(s.listeners, tls.NewListener(s.proxyListener(listener.Listener), tlsConfig))
+		} else {
+			s.listeners = append(s.listeners, s.proxyListener(listener.Listener))
+		}
+		
+		if !s.config.Quiet {
+			slog.Info("listening", "addr", listener.Addr().String(), "systemd_socket", listener.Name)
+		}
+	}
+	
+	s.serving = make([]atomic.Bool, len(s.listeners))
+	return nil
+}
+
+// packetConn is a UDP socket serving one protocol.
+type packetConn struct {
+	net.PacketConn
+	proto protocol.Type
+}
+
+// packetHandler is implemented by the handlers of protocols that can be
+// served over UDP.
+type packetHandler interface {
+	ServeUDP(pc net.PacketConn) error
+}
+
+// listenUDP opens the UDP sockets of the protocols served over UDP on
+// each bind address. UDP cannot carry TLS, so a protocol requiring TLS
+// may not have one.
+func (s *Server) listenUDP() error {
+	for _, pp := range []protocolPort{
+		{protocol.TypeMemcache, s.config.MemcacheUDPPort},
+		{protocol.TypeDNS, s.config.DNSPort},
+	} {
+		if pp.port <= 0 {
+			continue
+		}
+		if _, ok := s.handlers[pp.proto].(packetHandler); !ok {
+			return fmt.Errorf("%s over UDP needs the %s protocol enabled", pp.proto, pp.proto)
+		}
+		if s.tlsMode(pp.proto) == TLSRequired {
+			return fmt.Errorf("%s over UDP: %s requires TLS", pp.proto, pp.proto)
+		}
+		
+		for _, host := range s.bindHosts() {
+			addr := net.JoinHostPort(host, strconv.Itoa(pp.port))
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen for %s on UDP %s: %w", pp.proto, addr, err)
+			}
+			s.packetConns = append(s.packetConns, packetConn{pc, pp.proto})
+			
+			if !s.config.Quiet {
+				slog.Info("listening", "addr", addr, "protocol", pp.proto.String(), "udp", true)
+			}
+		}
+	}
+	return nil
+}
+
+// serveUDP serves the requests arriving on pc until it is closed.
+func (s *Server) serveUDP(pc packetConn) {
 	defer s.wg.Done()
 	
+	handler := s.handlers[pc.proto].(packetHandler)
+	if err := handler.ServeUDP(pc.PacketConn); err != nil && !s.stopping.Load() {
+		slog.Error("UDP error", "protocol", pc.proto.String(), "addr", pc.LocalAddr().String(), "err", err)
+	}
+}
+
+// listenTCP opens the TCP listeners for addr. With ReusePort it opens one
+// SO_REUSEPORT listener per thread so the kernel spreads accepts across
+// them; otherwise it opens a single listener.
+func (s *Server) listenTCP(addr string) ([]net.Listener, error) {
+	if !s.config.ReusePort {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{s.proxyListener(listener)}, nil
+	}
+	
+	n := max(s.config.Threads, 1)
+	lc := net.ListenConfig{Control: reusePortControl}
+	listeners := make([]net.Listener, 0, n)
+	
+	for i := 0; i < n; i++ {
+		listener, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, s.proxyListener(listener))
+		
+		// Bind the remaining listeners to the port actually chosen, in
+		// case addr asked for an ephemeral one.
+		addr = listener.Addr().String()
+	}
+	
+	return listeners, nil
+}
+
+// proxyListener expects a PROXY protocol header on the connections
+// listener accepts from trusted proxies, if any are configured.
+func (s *Server) proxyListener(listener net.Listener) net.Listener {
+	if len(s.proxies) == 0 {
+		return listener
+	}
+	return &proxyproto.Listener{Listener: listener, Trusted: s.proxies}
+}
+
+// listenAttrs returns the log attributes of n listeners opened on addr.
+func (s *Server) listenAttrs(addr string, n int) []any {
+	attrs := []any{"addr", addr}
+	if s.config.ReusePort {
+		attrs = append(attrs, "reuseport_listeners", n)
+	}
+	return attrs
+}
+
+func (s *Server) serve(listener net.Listener, open *atomic.Bool) {
+	defer s.wg.Done()
+	
+	proto := protocol.TypeUnknown
+	if pl, ok := listener.(*protocolListener); ok {
+		proto = pl.proto
+	}
+	
+	open.Store(true)
+	defer open.Store(false)
+	
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -181,49 +752,287 @@ func (s *Server) serve(listener net.Listener) {
 				return
 			default:
 				if s.config.Verbose {
-					log.Printf("Accept error: %v", err)
+					slog.Warn("accept error", "err", err)
 				}
 				continue
 			}
 		}
 		
-		go s.handleConnection(conn)
+		s.dispatch(conn, proto)
+	}
+}
+
+// startWorkers starts the connection worker pool. Each worker serves one
+// connection at a time, idle or not, so the pool bounds the number of
+// goroutines and stacks by bounding the number of clients: once all
+// workers are busy, as many connections again wait for one to free up
+// and further clients are disconnected. It does not serve more idle
+// clients than it has workers.
+func (s *Server) startWorkers() {
+	size := s.config.PoolSize
+	if size <= 0 {
+		size = max(s.config.Threads, 1) * defaultPoolSizePerThread
+	}
+	
+	s.conns = make(chan acceptedConn, size)
+	for i := 0; i < size; i++ {
+		go func() {
+			for {
+				select {
+				case <-s.ctx.Done():
+					s.closeWaiting()
+					return
+				case c := <-s.conns:
+					s.handleConnection(c.conn, c.proto)
+				}
+			}
+		}()
+	}
+	
+	if !s.config.Quiet {
+		slog.Info("connection pool", "workers", size)
+	}
+}
+
+// acceptedConn is a connection waiting for a pool worker, with the
+// protocol of its listener or TypeUnknown to detect it.
+type acceptedConn struct {
+	conn  net.Conn
+	proto protocol.Type
+}
+
+func (s *Server) dispatch(conn net.Conn, proto protocol.Type) {
+	if s.conns == nil {
+		go s.handleConnection(conn, proto)
+		return
+	}
+	
+	// Accepting must not wait for a worker, or one protocol's clients
+	// could keep every other listener from being served.
+	select {
+	case s.conns <- acceptedConn{conn, proto}:
+	default:
+		s.rejected.Add(1)
+		slog.Warn("connection pool full, disconnecting", "client", conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+// closeWaiting closes the connections still waiting for a worker when
+// the server stops.
+func (s *Server) closeWaiting() {
+	for {
+		select {
+		case c := <-s.conns:
+			c.conn.Close()
+		default:
+			return
+		}
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+// alpnProtocols lists the ALPN protocol IDs advertised on the TLS
+// listener for the enabled protocols that have one.
+func (s *Server) alpnProtocols() []string {
+	var protos []string
+	for _, id := range []string{alpnHTTP2, alpnHTTP, alpnPostgres} {
+		if _, ok := s.alpn[id]; ok {
+			protos = append(protos, id)
+		}
+	}
+	for _, name := range s.config.Protocols {
+		if p, ok := protocol.Lookup(name); ok {
+			protos = append(protos, p.ALPN...)
+		}
+	}
+	return protos
+}
+
+func (s *Server) handleConnection(conn net.Conn, proto protocol.Type) {
 	defer conn.Close()
 	
-	detector := protocol.NewDetector(conn)
+	if !s.readProxyHeader(conn) {
+		return
+	}
+	
+	if proto != protocol.TypeUnknown {
+		if !s.checkTransport(conn, proto) {
+			return
+		}
+		defer s.clients.Remove(s.clients.Add(conn, proto.String()))
+		s.handle(proto, conn)
+		return
+	}
+	
+	// A client that connects and stays silent, or trickles its first
+	// bytes, would otherwise pin this goroutine forever.
+	if timeout := s.config.HandshakeTimeout; timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			if s.config.Verbose {
+				slog.Info("TLS handshake error", "client", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		
+		// A negotiated ALPN protocol identifies the handler directly.
+		if proto, ok := s.alpn[tlsConn.ConnectionState().NegotiatedProtocol]; ok {
+			conn.SetDeadline(time.Time{})
+			if !s.checkTransport(conn, proto) {
+				return
+			}
+			defer s.clients.Remove(s.clients.Add(conn, proto.String()))
+			s.handle(proto, conn)
+			return
+		}
+	}
+	
+	detector := protocol.NewDetector(conn, s.detectable...)
 	protoType, err := detector.Detect()
 	if err != nil {
 		if s.config.Verbose {
-			log.Printf("Protocol detection error: %v", err)
+			slog.Info("protocol detection error", "client", conn.RemoteAddr().String(), "err", err)
 		}
 		return
 	}
+	conn.SetDeadline(time.Time{})
 	
 	switch protoType {
-	case protocol.TypeRedis:
-		if s.redisHandler != nil {
-			s.redisHandler.Handle(detector.Conn())
-		}
-	case protocol.TypeHTTP:
-		if s.httpHandler != nil {
-			s.httpHandler.Handle(detector.Conn())
-		}
-	case protocol.TypeMemcache:
-		if s.memcacheHandler != nil {
-			s.memcacheHandler.Handle(detector.Conn())
+	case protocol.TypeTLS:
+		s.handleTLSOnPlainPort(detector.Conn())
+		return
+	case protocol.TypeMemcacheBinary:
+		protocol.RejectMemcacheBinary(detector.Conn())
+		return
+	}
+	if !s.checkTransport(conn, protoType) {
+		return
+	}
+	
+	defer s.clients.Remove(s.clients.Add(conn, protoType.String()))
+	
+	s.handle(protoType, detector.Conn())
+}
+
+// readProxyHeader reads the PROXY protocol header of a connection from a
+// trusted proxy, bounded by the handshake timeout, so that the real client
+// address is known before the connection is registered. It reports
+// whether the connection should be served.
+func (s *Server) readProxyHeader(conn net.Conn) bool {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	proxied, ok := conn.(*proxyproto.Conn)
+	if !ok {
+		return true
+	}
+	
+	if timeout := s.config.HandshakeTimeout; timeout > 0 {
+		proxied.SetDeadline(time.Now().Add(timeout))
+		defer proxied.SetDeadline(time.Time{})
+	}
+	if err := proxied.ReadHeader(); err != nil {
+		if s.config.Verbose {
+			slog.Info("PROXY protocol error", "client", proxied.Conn.RemoteAddr().String(), "err", err)
 		}
-	case protocol.TypePostgres:
-		if s.postgresHandler != nil {
-			s.postgresHandler.Handle(detector.Conn())
+		return false
+	}
+	return true
+}
+
+// tlsHandshakeFailure is a fatal TLS alert record (handshake_failure).
+var tlsHandshakeFailure = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28}
+
+// handleTLSOnPlainPort serves a client that started a TLS handshake on a
+// plain listener: over TLS if a certificate is configured, otherwise by
+// refusing the handshake with an alert the client can report.
+func (s *Server) handleTLSOnPlainPort(conn net.Conn) {
+	if s.protoConfig.TLS == nil {
+		conn.Write(tlsHandshakeFailure)
+		return
+	}
+	
+	s.handleConnection(tls.Server(conn, s.protoConfig.TLS), protocol.TypeUnknown)
+}
+
+// handle passes conn to the handler for proto, falling back to Redis for
+// unrecognized traffic.
+func (s *Server) handle(proto protocol.Type, conn net.Conn) {
+	handler, ok := s.handlers[proto]
+	if !ok && proto == protocol.TypeUnknown {
+		handler, ok = s.handlers[protocol.TypeRedis]
+	}
+	if !ok {
+		return
+	}
+	
+	// HTTP has its own idle timeout, and HTTP/2 needs the TLS
+	// connection itself.
+	if s.conns != nil && s.config.PoolIdleTimeout > 0 && proto != protocol.TypeHTTP {
+		conn = newIdleConn(conn, s.config.PoolIdleTimeout)
+	}
+	handler.Handle(conn)
+}
+
+// startWatchdog pings the systemd watchdog until the server stops, so
+// systemd restarts gopogo if it hangs. Each ping first takes every
+// shard's lock, so a wedged shard stops the pings too.
+func (s *Server) startWatchdog(interval time.Duration) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.cache.NumItems()
+				systemd.Notify("WATCHDOG=1")
+			}
 		}
-	default:
-		if s.redisHandler != nil {
-			s.redisHandler.Handle(detector.Conn())
+	}()
+}
+
+func (s *Server) startSnapshots() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		
+		ticker := time.NewTicker(s.config.SnapshotInterval)
+		defer ticker.Stop()
+		
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.snapshot(s.ctx, s.config.SnapshotInterval)
+			}
 		}
+	}()
+}
+
+// snapshot saves and uploads a snapshot, giving up after timeout or when
+// parent is done.
+func (s *Server) snapshot(parent context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	
+	start := time.Now()
+	name, n, err := s.config.Snapshots.Save(ctx)
+	if err != nil {
+		slog.Error("snapshot failed", "err", err)
+		return
+	}
+	if s.config.Verbose {
+		slog.Info("saved snapshot", "name", name, "keys", n, "duration", time.Since(start).Round(time.Millisecond))
 	}
 }
 
@@ -240,10 +1049,12 @@ func (s *Server) startSweeper() {
 			case <-s.ctx.Done():
 				return
 			case <-ticker.C:
+				if !s.cache.ActiveExpire() {
+					continue
+				}
 				expired := s.cache.Sweep()
-				evicted := s.cache.SweepEvicted()
-				if (expired > 0 || evicted > 0) && s.config.Verbose {
-					log.Printf("Swept %d expired and %d evicted entries", expired, evicted)
+				if expired > 0 && s.config.Verbose {
+					slog.Info("swept expired entries", "keys", expired)
 				}
 			}
 		}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/gopogo/internal/cache"
+	"github.com/grumpylabs/gopogo/internal/metrics"
+	"github.com/grumpylabs/gopogo/internal/protocol"
+)
+
+func startTestServer(tb testing.TB, config *Config) (*Server, string) {
+	tb.Helper()
+
+	config.Host = "127.0.0.1"
+	config.Redis = true
+	config.Quiet = true
+	config.Cache = cache.New(16, 0)
+
+	s := New(config)
+	addr := "127.0.0.1:0"
+	listeners, err := s.listenTCP(addr)
+	if err != nil {
+		tb.Fatalf("listen failed: %v", err)
+	}
+	s.listeners = listeners
+	s.serving = make([]atomic.Bool, len(listeners))
+
+	if config.ConnModel == ConnModelPool {
+		s.startWorkers()
+	}
+
+	for i, listener := range s.listeners {
+		s.wg.Add(1)
+		go s.serve(listener, &s.serving[i])
+	}
+
+	tb.Cleanup(s.Stop)
+	return s, listeners[0].Addr().String()
+}
+
+func TestReusePortListeners(t *testing.T) {
+	s, addr := startTestServer(t, &Config{ReusePort: true, Threads: 4})
+
+	if len(s.listeners) != 4 {
+		t.Fatalf("Expected 4 listeners, got %d", len(s.listeners))
+	}
+	for _, listener := range s.listeners {
+		if listener.Addr().String() != addr {
+			t.Fatalf("Listener bound to %s, want %s", listener.Addr(), addr)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := ping(addr); err != nil {
+			t.Fatalf("PING failed: %v", err)
+		}
+	}
+}
+
+func TestPoolBoundsWorkers(t *testing.T) {
+	_, addr := startTestServer(t, &Config{ConnModel: ConnModelPool, PoolSize: 1})
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	// Give the only worker time to pick up the idle connection.
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ping(addr)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Second connection was served while the pool was busy")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	idle.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("PING failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Queued connection was not served after a worker freed up")
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	_, addr := startTestServer(t, &Config{ConnModel: ConnModelPool, PoolSize: 1, PoolIdleTimeout: 100 * time.Millisecond})
+
+	// The client is served once, then holds the only worker while idle.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer idle.Close()
+	if _, err := idle.Write([]byte("PING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(idle)
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("PING failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ping(addr)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("PING failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Idle connection kept the next client from being served")
+	}
+
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Read on the idle connection = %v, want EOF", err)
+	}
+}
+
+func TestPoolFullDisconnects(t *testing.T) {
+	s, addr := startTestServer(t, &Config{ConnModel: ConnModelPool, PoolSize: 1})
+
+	// One connection holds the worker and one waits for it.
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read with the pool full = %v, want EOF", err)
+	}
+	if n := s.metricsSample(metrics.Sample{}).Counters["connections.rejected"]; n != 1 {
+		t.Errorf("connections.rejected = %d, want 1", n)
+	}
+}
+
+func TestProtocolPortSkipsDetection(t *testing.T) {
+	s, _ := startTestServer(t, &Config{})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var open atomic.Bool
+	s.wg.Add(1)
+	go s.serve(&protocolListener{Listener: listener, proto: protocol.TypeRedis}, &open)
+	t.Cleanup(func() { listener.Close() })
+
+	// An inline "get" would be detected as memcache on the shared port.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	conn.Write([]byte("get missing\r\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "$-1\r\n" {
+		t.Fatalf("Expected a Redis nil reply, got %q (%v)", line, err)
+	}
+}
+
+// echoHandler is a minimal registered protocol: it writes back each line
+// it reads.
+type echoHandler struct{}
+
+func (echoHandler) Handle(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+var echoType = protocol.Register(protocol.Protocol{
+	Name:  "echo",
+	Match: func(peek []byte) bool { return bytes.HasPrefix(peek, []byte("ECHO ")) },
+	New:   func(*cache.Cache, *protocol.Config) protocol.Handler { return echoHandler{} },
+})
+
+func TestRegisteredProtocol(t *testing.T) {
+	if echoType.String() != "echo" {
+		t.Fatalf("Registered type is named %q", echoType)
+	}
+	_, addr := startTestServer(t, &Config{Protocols: []string{"echo"}})
+
+	for _, tt := range []struct{ send, want string }{
+		{"ECHO hello\n", "ECHO hello\n"},
+		{"*1\r\n$4\r\nPING\r\n", "+PONG\r\n"},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte(tt.send))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil || line != tt.want {
+			t.Errorf("Sent %q, got %q (%v), want %q", tt.send, line, err, tt.want)
+		}
+	}
+
+	s := New(&Config{Protocols: []string{"missing"}, Cache: cache.New(1, 0)})
+	if err := s.setupListeners(); err == nil {
+		t.Error("Unregistered protocol accepted")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	_, addr := startTestServer(t, &Config{HandshakeTimeout: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// A client that never speaks is disconnected.
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the server to close a silent connection, got %v", err)
+	}
+
+	// A client that identifies itself in time keeps its connection well
+	// past the timeout.
+	if err := ping(addr); err != nil {
+		t.Fatal(err)
+	}
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	for range 2 {
+		conn.Write([]byte("PING\r\n"))
+		if line, err := reader.ReadString('\n'); err != nil || line != "+PONG\r\n" {
+			t.Fatalf("Expected +PONG, got %q (%v)", line, err)
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+}
+
+func ping(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return err
+	}
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	return err
+}
+
+func benchmarkAccept(b *testing.B, config *Config) {
+	_, addr := startTestServer(b, config)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := ping(addr); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkAcceptSingleListener(b *testing.B) {
+	benchmarkAccept(b, &Config{Threads: 4})
+}
+
+func BenchmarkAcceptPool(b *testing.B) {
+	benchmarkAccept(b, &Config{ConnModel: ConnModelPool, Threads: 4})
+}
+
+func BenchmarkAcceptReusePort(b *testing.B) {
+	benchmarkAccept(b, &Config{ReusePort: true, Threads: 4})
+}
+
+func TestHealth(t *testing.T) {
+	s, _ := startTestServer(t, &Config{})
+
+	deadline := time.Now().Add(time.Second)
+	for !s.Health().Ready {
+		if time.Now().After(deadline) {
+			t.Fatalf("server never became ready: %+v", s.Health())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Stop()
+	if status := s.Health(); status.Live || status.Ready {
+		t.Fatalf("stopped server still reported healthy: %+v", status)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gopogo.sock")
+
+	live, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(path); err == nil {
+		t.Fatal("Removed a live socket")
+	}
+
+	// Simulate a crash: the file outlives the listener.
+	live.(*net.UnixListener).SetUnlinkOnClose(false)
+	live.Close()
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatalf("Stale socket not removed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Stale socket file still exists")
+	}
+
+	os.WriteFile(path, nil, 0600)
+	if err := removeStaleSocket(path); err == nil {
+		t.Fatal("Removed a regular file")
+	}
+}
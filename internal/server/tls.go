@@ -0,0 +1,234 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// certPollInterval is how often the TLS certificate and key files are
+// checked for changes.
+const certPollInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version given as 1.0, 1.1, 1.2 or 1.3.
+func ParseTLSVersion(s string) (uint16, error) {
+	if version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", s)
+}
+
+// ParseCipherSuites parses cipher suite names as listed by
+// tls.CipherSuites, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Suites
+// with known weaknesses are refused, as are the TLS 1.3 suites, which Go
+// does not allow to be configured.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		suite := findCipherSuite(tls.CipherSuites(), name)
+		if suite == nil {
+			if findCipherSuite(tls.InsecureCipherSuites(), name) != nil {
+				return nil, fmt.Errorf("cipher suite %s is insecure", name)
+			}
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suite %s is a TLS 1.3 suite, which cannot be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+func findCipherSuite(suites []*tls.CipherSuite, name string) *tls.CipherSuite {
+	for _, suite := range suites {
+		if strings.EqualFold(suite.Name, name) {
+			return suite
+		}
+	}
+	return nil
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519":         tls.X25519,
+	"x25519mlkem768": tls.X25519MLKEM768,
+	"p256":           tls.CurveP256,
+	"p384":           tls.CurveP384,
+	"p521":           tls.CurveP521,
+}
+
+// ParseCurves parses key exchange curve names: X25519, X25519MLKEM768,
+// P256 (or P-256), P384 and P521.
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range names {
+		curve, ok := tlsCurves[strings.ToLower(strings.ReplaceAll(name, "-", ""))]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q (want X25519, X25519MLKEM768, P256, P384 or P521)", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// certReloader serves the TLS certificate through
+// tls.Config.GetCertificate so that it can be replaced while the server
+// runs. Connections already established keep the certificate they were
+// handshaken with; new ones get the current one.
+type certReloader struct {
+	certFile   string
+	keyFile    string
+	passphrase string
+	
+	cert atomic.Pointer[tls.Certificate]
+	
+	mu      sync.Mutex
+	modTime time.Time // newest modification time of the loaded files
+}
+
+func newCertReloader(certFile, keyFile, passphrase string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, passphrase: passphrase}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// reload loads the certificate and key files again. If they cannot be
+// loaded, for example because only one of them has been replaced so far,
+// the current certificate stays in use.
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := loadCertificate(r.certFile, r.keyFile, r.passphrase)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	r.modTime = modTime
+	return nil
+}
+
+// changed reports whether either file has been modified since the
+// certificate was last loaded. Kubernetes secret volumes replace files by
+// swapping a symlink, which os.Stat follows.
+func (r *certReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	modTime, err := r.filesModTime()
+	return err == nil && !modTime.Equal(r.modTime)
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// startCertReloader reloads the TLS certificate when its files change and
+// on SIGHUP.
+func (s *Server) startCertReloader() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer signal.Stop(hup)
+		
+		ticker := time.NewTicker(certPollInterval)
+		defer ticker.Stop()
+		
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				if !s.certs.changed() {
+					continue
+				}
+			case <-hup:
+			}
+			
+			if err := s.certs.reload(); err != nil {
+				slog.Error("failed to reload TLS certificate", "cert", s.certs.certFile, "err", err)
+				continue
+			}
+			if !s.config.Quiet {
+				slog.Info("reloaded TLS certificate", "cert", s.certs.certFile)
+			}
+		}
+	}()
+}
+
+// loadCertificate loads a certificate and its private key from PEM files.
+// A key encrypted with a passphrase in the legacy "Proc-Type: 4,ENCRYPTED"
+// form, as written by openssl -des3 or -aes256, is decrypted first.
+func loadCertificate(certFile, keyFile, passphrase string) (tls.Certificate, error) {
+	if passphrase == "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("%s: no PEM data found", keyFile)
+	}
+	// The legacy PEM encryption is deprecated as insecure, but it is the
+	// only kind the standard library can decrypt.
+	if x509.IsEncryptedPEMBlock(block) {
+		der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return tls.Certificate{}, fmt.Errorf("%s: wrong passphrase", keyFile)
+		}
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("%s: %w", keyFile, err)
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+	
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
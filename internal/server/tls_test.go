@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate with the given serial
+// number and its key, and sets both files' modification time to modTime.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Minute)
+	writeTestCert(t, certFile, keyFile, 1, start)
+
+	r, err := newCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		cert, _ := r.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+	if r.changed() {
+		t.Fatal("Files reported changed right after loading")
+	}
+
+	// Only the certificate has been replaced: the pair does not match, so
+	// the old certificate must stay in use.
+	writeTestCert(t, certFile, filepath.Join(dir, "other.pem"), 2, start.Add(time.Second))
+	if !r.changed() {
+		t.Fatal("Replaced certificate not detected")
+	}
+	if err := r.reload(); err == nil {
+		t.Fatal("Mismatched certificate and key loaded")
+	}
+	if got := serial(); got != 1 {
+		t.Fatalf("Serving certificate %d after a failed reload, want 1", got)
+	}
+
+	writeTestCert(t, certFile, keyFile, 3, start.Add(2*time.Second))
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(); got != 3 {
+		t.Fatalf("Serving certificate %d, want 3", got)
+	}
+	if r.changed() {
+		t.Fatal("Files reported changed after reloading")
+	}
+}
+
+func TestParseTLSOptions(t *testing.T) {
+	if v, err := ParseTLSVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("ParseTLSVersion(1.3) = %x, %v", v, err)
+	}
+	if _, err := ParseTLSVersion("1.4"); err == nil {
+		t.Error("ParseTLSVersion(1.4) succeeded")
+	}
+
+	ids, err := ParseCipherSuites([]string{"tls_ecdhe_rsa_with_aes_128_gcm_sha256"})
+	if err != nil || len(ids) != 1 || ids[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("ParseCipherSuites = %v, %v", ids, err)
+	}
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_AES_128_GCM_SHA256", "TLS_BOGUS"} {
+		if _, err := ParseCipherSuites([]string{name}); err == nil {
+			t.Errorf("ParseCipherSuites(%s) succeeded", name)
+		}
+	}
+
+	curves, err := ParseCurves([]string{"X25519", "P-256"})
+	if err != nil || len(curves) != 2 || curves[0] != tls.X25519 || curves[1] != tls.CurveP256 {
+		t.Errorf("ParseCurves = %v, %v", curves, err)
+	}
+	if _, err := ParseCurves([]string{"P-999"}); err == nil {
+		t.Error("ParseCurves(P-999) succeeded")
+	}
+}
+
+func TestALPNDispatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1, time.Now())
+
+	s, addr := startTestServer(t, &Config{HTTP: true, Postgres: true})
+	certs, err := newCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.protoConfig.TLS = &tls.Config{GetCertificate: certs.GetCertificate, NextProtos: s.alpnProtocols()}
+
+	// A startup message for user test, which detection would also
+	// recognize; the negotiated protocol shows ALPN picked the handler.
+	startup := binary.BigEndian.AppendUint32(nil, 196608)
+	startup = append(startup, "user\x00test\x00\x00"...)
+	startup = append(binary.BigEndian.AppendUint32(nil, uint32(4+len(startup))), startup...)
+
+	tests := []struct {
+		alpn    string
+		request string
+		want    string
+	}{
+		{"postgresql", string(startup), "R"},
+		{"http/1.1", "GET /missing HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 404 Not Found\r\n"},
+		{"", "*1\r\n$4\r\nPING\r\n", "+PONG\r\n"},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		config := &tls.Config{InsecureSkipVerify: true}
+		if tt.alpn != "" {
+			config.NextProtos = []string{tt.alpn}
+		}
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(time.Now().Add(2 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if got := tlsConn.ConnectionState().NegotiatedProtocol; got != tt.alpn {
+			t.Errorf("negotiated %q, want %q", got, tt.alpn)
+		}
+
+		if _, err := tlsConn.Write([]byte(tt.request)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(tt.want))
+		if _, err := io.ReadFull(tlsConn, got); err != nil || string(got) != tt.want {
+			t.Errorf("%q: answered %q (%v), want %q", tt.alpn, got, err, tt.want)
+		}
+	}
+}
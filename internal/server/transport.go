@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	
+	"github.com/grumpylabs/gopogo/internal/protocol"
+	"github.com/grumpylabs/gopogo/internal/proxyproto"
+)
+
+// TLS modes of a protocol, set per protocol name in Config.ProtocolTLS.
+const (
+	// TLSOptional serves the protocol with or without TLS.
+	TLSOptional = "optional"
+	// TLSRequired refuses plaintext connections, except from TLSExempt
+	// addresses.
+	TLSRequired = "required"
+	// TLSDisabled refuses TLS connections.
+	TLSDisabled = "disabled"
+)
+
+// setupTLSPolicy checks Config.ProtocolTLS and parses Config.TLSExempt.
+func (s *Server) setupTLSPolicy() error {
+	for proto, mode := range s.config.ProtocolTLS {
+		switch mode {
+		case TLSOptional, TLSRequired, TLSDisabled:
+		default:
+			return fmt.Errorf("invalid TLS mode %q for %s (want optional, required or disabled)", mode, proto)
+		}
+		if mode == TLSRequired && s.config.TLSCert == "" {
+			return fmt.Errorf("%s requires TLS but no certificate is configured", proto)
+		}
+	}
+	
+	exempt := slices.DeleteFunc(slices.Clone(s.config.TLSExempt), func(addr string) bool {
+		return addr == "unix"
+	})
+	s.tlsExemptUnix = len(exempt) < len(s.config.TLSExempt)
+	nets, err := proxyproto.ParseTrusted(exempt)
+	if err != nil {
+		return fmt.Errorf("tls-exempt: %w", err)
+	}
+	s.tlsExempt = nets
+	
+	if s.tlsMode(protocol.TypePostgres) == TLSRequired {
+		s.protoConfig.RequireTLS = s.mustUseTLS
+	}
+	return nil
+}
+
+// tlsMode returns the TLS mode of proto: its own entry in ProtocolTLS, or
+// the "all" entry. Unrecognized traffic is served as Redis.
+func (s *Server) tlsMode(proto protocol.Type) string {
+	if proto == protocol.TypeUnknown {
+		proto = protocol.TypeRedis
+	}
+	if mode, ok := s.config.ProtocolTLS[proto.String()]; ok {
+		return mode
+	}
+	if mode, ok := s.config.ProtocolTLS["all"]; ok {
+		return mode
+	}
+	return TLSOptional
+}
+
+// checkTransport reports whether conn may be served as proto, telling the
+// client why if not.
+func (s *Server) checkTransport(conn net.Conn, proto protocol.Type) bool {
+	_, secure := conn.(*tls.Conn)
+	
+	switch s.tlsMode(proto) {
+	case TLSRequired:
+		// A plaintext Postgres client may still upgrade with SSLRequest,
+		// so the Postgres handler enforces this itself.
+		if secure || proto == protocol.TypePostgres || !s.mustUseTLS(conn) {
+			break
+		}
+		protocol.Refuse(conn, proto, "TLS is required")
+		return false
+	case TLSDisabled:
+		if !secure {
+			break
+		}
+		protocol.Refuse(conn, proto, "TLS is not allowed for "+proto.String())
+		return false
+	}
+	return true
+}
+
+// mustUseTLS reports whether conn's client must use TLS for a protocol
+// that requires it, that is, whether it is not in TLSExempt.
+func (s *Server) mustUseTLS(conn net.Conn) bool {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.UnixAddr:
+		return !s.tlsExemptUnix
+	case *net.TCPAddr:
+		for _, n := range s.tlsExempt {
+			if n.Contains(addr.IP) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProtocolTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1, time.Now())
+
+	tests := []struct {
+		name   string
+		mode   string
+		exempt []string
+		tls    bool
+		want   string
+	}{
+		{"required plaintext", TLSRequired, nil, false, "-ERR TLS is required\r\n"},
+		{"required tls", TLSRequired, nil, true, "+PONG\r\n"},
+		{"required exempt", TLSRequired, []string{"127.0.0.0/8"}, false, "+PONG\r\n"},
+		{"required other exempt", TLSRequired, []string{"10.0.0.1", "unix"}, false, "-ERR TLS is required\r\n"},
+		{"disabled plaintext", TLSDisabled, nil, false, "+PONG\r\n"},
+		{"disabled tls", TLSDisabled, nil, true, "-ERR TLS is not allowed for redis\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := startTestServer(t, &Config{
+				TLSCert:     certFile,
+				TLSKey:      keyFile,
+				ProtocolTLS: map[string]string{"all": tt.mode},
+				TLSExempt:   tt.exempt,
+			})
+			if err := s.setupTLSPolicy(); err != nil {
+				t.Fatal(err)
+			}
+			certs, err := newCertReloader(certFile, keyFile, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.protoConfig.TLS = &tls.Config{GetCertificate: certs.GetCertificate}
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if tt.tls {
+				conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			}
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := bufio.NewReader(conn).ReadString('\n'); got != tt.want {
+				t.Fatalf("PING = %q (%v), want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenUnix listens on a unix socket at path, first removing a socket
+// file left behind by a process that is no longer running, then applying
+// the configured mode and owner.
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Close removes the socket file on shutdown.
+	listener.(*net.UnixListener).SetUnlinkOnClose(true)
+	
+	if s.config.SocketPerm != 0 {
+		if err := os.Chmod(path, s.config.SocketPerm); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+		}
+	}
+	if s.config.SocketOwner != "" {
+		uid, gid, err := lookupOwner(s.config.SocketOwner)
+		if err == nil {
+			err = os.Chown(path, uid, gid)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set socket owner: %w", err)
+		}
+	}
+	
+	return listener, nil
+}
+
+// removeStaleSocket deletes the socket file at path if nothing is
+// accepting connections on it. It refuses to touch a live socket or a
+// file that is not a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	
+	return os.Remove(path)
+}
+
+// lookupOwner resolves "user[:group]", by name or numeric ID. Without a
+// group the user's primary group is used.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, hasGroup := strings.Cut(owner, ":")
+	
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q", userName)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %q has no numeric ID", userName)
+	}
+	
+	gidStr := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group of %q has no numeric ID", owner)
+	}
+	
+	return uid, gid, nil
+}
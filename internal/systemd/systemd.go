@@ -0,0 +1,107 @@
+// Package systemd implements the two systemd integration protocols gopogo
+// uses: sd_notify readiness notifications and socket activation. Both are
+// no-ops when the process was not started by systemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by socket
+// activation.
+const listenFDsStart = 3
+
+// Listener is a socket passed by systemd. Name is the FileDescriptorName=
+// of its socket unit, which defaults to the unit name.
+type Listener struct {
+	net.Listener
+	Name string
+}
+
+// Notify sends state, such as "READY=1", to the service manager. It
+// returns false without error when NOTIFY_SOCKET is not set.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often the service must send WATCHDOG=1,
+// half the WatchdogSec= the manager set, or 0 if the watchdog is off.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// Listeners returns the sockets passed by socket activation, or nil if
+// there are none. It unsets the activation variables so child processes
+// do not inherit them.
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	listeners := make([]Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("fd %d (%s): %w", listenFDsStart+i, name, err)
+		}
+		listeners = append(listeners, Listener{Listener: listener, Name: name})
+	}
+
+	return listeners, nil
+}
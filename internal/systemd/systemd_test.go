@@ -0,0 +1,61 @@
+package systemd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Fatalf("Notify without NOTIFY_SOCKET: sent=%v err=%v", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if sent, err := Notify("READY=1"); !sent || err != nil {
+		t.Fatalf("Notify failed: sent=%v err=%v", sent, err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatalf("Expected READY=1, got %q (%v)", buf[:n], err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if WatchdogInterval() != 0 {
+		t.Fatal("Expected no watchdog")
+	}
+
+	t.Setenv("WATCHDOG_USEC", "10000000")
+	if got := WatchdogInterval(); got != 5*time.Second {
+		t.Fatalf("Expected 5s, got %v", got)
+	}
+
+	t.Setenv("WATCHDOG_PID", "1")
+	if WatchdogInterval() != 0 {
+		t.Fatal("Watchdog meant for another process was used")
+	}
+}
+
+func TestListenersWithoutActivation(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	listeners, err := Listeners()
+	if listeners != nil || err != nil {
+		t.Fatalf("Expected no listeners, got %v (%v)", listeners, err)
+	}
+}